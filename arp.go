@@ -1,34 +1,271 @@
 package net
 
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/parse"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+const (
+	// the time for which a resolved address is cached; once it
+	// expires, the address is resolved again when it's next used
+	defaultARPExpiry = 60 * time.Second
+	// the time to wait for a reply before retransmitting a request
+	arpRetransTimer = time.Second
+	// the number of requests to send before giving up
+	// on resolving an address
+	maxARPRequests = 3
+	// the maximum number of packets queued for an address being
+	// resolved; once it's reached, the oldest packet is dropped
+	// See https://tools.ietf.org/html/rfc1122#page-23
+	maxARPQueue = 3
+)
+
+type arpEntry struct {
+	mac      MAC
+	resolved bool
+	requests int      // the number of requests sent while unresolved
+	queue    [][]byte // packets awaiting address resolution
+	timer    *timeout.Timeout
+}
+
 // arp represents an instance of the ARP protocol.
+// See https://tools.ietf.org/html/rfc826
 type arp struct {
+	mac  MAC
+	addr IPv4
+	// writes the ARP or IPv4 packet b, which starts with space for an
+	// Ethernet header, to the given MAC; it must not be called with mu held
+	write func(b []byte, dst MAC, et EtherType)
+
+	entries map[IPv4]*arpEntry
+	// timing parameters; the defaults can be overridden in tests
+	expiry, retransTimer time.Duration
+	stopped              bool
+
+	timeoutd *timeout.Daemon
+	mu       sync.Mutex
 }
 
-// newARP creates a new ARP instance; hw and net must be non-zero
-func newARP(hw MAC, net IPv4) (*arp, error) {
+// an arpFrame is a packet to be written once arp.mu is released
+type arpFrame struct {
+	b   []byte
+	dst MAC
+	et  EtherType
+}
+
+// newARP creates a new ARP instance which writes packets using write;
+// hw and net must be non-zero
+func newARP(hw MAC, net IPv4, write func(b []byte, dst MAC, et EtherType)) *arp {
 	if hw == (MAC{}) || net == (IPv4{}) {
 		panic("new arp instance with zero addr")
 	}
-	panic("not implemented")
+	a := &arp{
+		mac:          hw,
+		addr:         net,
+		write:        write,
+		entries:      make(map[IPv4]*arpEntry),
+		expiry:       defaultARPExpiry,
+		retransTimer: arpRetransTimer,
+	}
+	a.timeoutd = timeout.NewDaemon(&a.mu)
+	return a
 }
 
-func (a *arp) HandlePacket(src, dst MAC, payload []byte) error {
-	panic("not implemented")
+// HandlePacket handles the ARP packet b.
+func (a *arp) HandlePacket(b []byte) {
+	if len(b) < arpHeaderLen {
+		// TODO(joshlf): Log it
+		return
+	}
+	var hdr arpHeader
+	readARPHeader(&hdr, b)
+	if hdr.HTYPE != arpHTYPEEthernet || hdr.PTYPE != uint16(EtherTypeIPv4) || hdr.HLEN != 6 || hdr.PLEN != 4 {
+		return
+	}
+
+	a.mu.Lock()
+	out := a.handle(&hdr)
+	a.mu.Unlock()
+	a.flush(out)
 }
 
-func (a *arp) LookupIPv4(ip IPv4) (MAC, error) {
-	panic("not implemented")
+// handle implements the packet reception algorithm; assumes a.mu.Lock
+// See "Packet Reception," https://tools.ietf.org/html/rfc826
+func (a *arp) handle(hdr *arpHeader) []arpFrame {
+	if a.stopped || hdr.SPA == (IPv4{}) {
+		return nil
+	}
+	if hdr.SPA == a.addr {
+		// TODO(joshlf): Log the address conflict
+		return nil
+	}
+	var out []arpFrame
+	// gratuitous ARP (a request or reply announcing the sender's own
+	// address) only updates existing entries, as with any other packet
+	// not addressed to us
+	e, merge := a.entries[hdr.SPA]
+	if merge {
+		out = a.resolved(hdr.SPA, e, hdr.SHA)
+	}
+	if hdr.TPA != a.addr {
+		return out
+	}
+	if !merge {
+		e = &arpEntry{}
+		a.entries[hdr.SPA] = e
+		out = a.resolved(hdr.SPA, e, hdr.SHA)
+	}
+	if hdr.OPER == arpOpRequest {
+		reply := arpHeader{
+			OPER: arpOpReply,
+			SHA:  a.mac,
+			SPA:  a.addr,
+			THA:  hdr.SHA,
+			TPA:  hdr.SPA,
+		}
+		out = append(out, arpFrame{a.packet(&reply), hdr.SHA, EtherTypeARP})
+	}
+	return out
 }
 
-func (a *arp) LookupIPv6(ip IPv6) (MAC, error) {
-	panic("not implemented")
+// resolved records that addr, whose entry is e, has the address mac,
+// returning any packets queued for it; assumes a.mu.Lock
+func (a *arp) resolved(addr IPv4, e *arpEntry, mac MAC) []arpFrame {
+	e.mac = mac
+	e.resolved = true
+	a.setTimer(addr, e, a.expiry)
+	out := make([]arpFrame, len(e.queue))
+	for i, b := range e.queue {
+		out[i] = arpFrame{b, mac, EtherTypeIPv4}
+	}
+	e.queue = nil
+	return out
+}
+
+// WriteTo writes the IPv4 packet b, which starts with space for an Ethernet
+// header, to the neighbor dst. If dst's MAC address isn't known, b is queued
+// and a request is broadcast.
+func (a *arp) WriteTo(b []byte, dst IPv4) {
+	a.mu.Lock()
+	out := a.resolve(b, dst)
+	a.mu.Unlock()
+	a.flush(out)
 }
 
+// assumes a.mu.Lock
+func (a *arp) resolve(b []byte, dst IPv4) []arpFrame {
+	if a.stopped {
+		return nil
+	}
+	e, ok := a.entries[dst]
+	switch {
+	case !ok:
+		e = &arpEntry{queue: [][]byte{b}}
+		a.entries[dst] = e
+		return a.request(dst, e)
+	case !e.resolved:
+		if len(e.queue) == maxARPQueue {
+			// TODO(joshlf): Log it
+			e.queue = e.queue[1:]
+		}
+		e.queue = append(e.queue, b)
+		return nil
+	}
+	return []arpFrame{{b, e.mac, EtherTypeIPv4}}
+}
+
+// request broadcasts a request for addr, whose entry is e, and
+// restarts e's retransmission timer; assumes a.mu.Lock
+func (a *arp) request(addr IPv4, e *arpEntry) []arpFrame {
+	e.requests++
+	a.setTimer(addr, e, a.retransTimer)
+	req := arpHeader{
+		OPER: arpOpRequest,
+		SHA:  a.mac,
+		SPA:  a.addr,
+		TPA:  addr,
+	}
+	return []arpFrame{{a.packet(&req), BroadcastMAC, EtherTypeARP}}
+}
+
+// assumes a.mu.Lock
+func (a *arp) setTimer(addr IPv4, e *arpEntry, d time.Duration) {
+	if e.timer != nil {
+		e.timer.Cancel()
+	}
+	e.timer = a.timeoutd.AddTimeout(func() { a.timeout(addr, e) }, timeout.NowMonotonic().Add(d))
+}
+
+// timeout is called by a.timeoutd with a.mu held when the timer for e, the
+// entry for addr, fires. It releases a.mu while writing any request.
+func (a *arp) timeout(addr IPv4, e *arpEntry) {
+	e.timer = nil
+	var out []arpFrame
+	if !e.resolved && e.requests < maxARPRequests {
+		out = a.request(addr, e)
+	} else {
+		// either the entry expired, or the address couldn't be
+		// resolved, in which case any queued packets are dropped
+		// TODO(joshlf): Send ICMP host unreachable messages
+		delete(a.entries, addr)
+	}
+	a.mu.Unlock()
+	a.flush(out)
+	a.mu.Lock()
+}
+
+// lookup returns the cached MAC address for addr, if any.
+func (a *arp) lookup(addr IPv4) (mac MAC, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.entries[addr]
+	if !ok || !e.resolved {
+		return MAC{}, false
+	}
+	return e.mac, true
+}
+
+// Stop stops all of a's timers and drops any queued packets. Once Stop has
+// returned, a will not write any more packets.
 func (a *arp) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+	a.timeoutd.Stop()
+	for addr := range a.entries {
+		delete(a.entries, addr)
+	}
+}
+
+func (a *arp) flush(out []arpFrame) {
+	for _, f := range out {
+		a.write(f.b, f.dst, f.et)
+		// TODO(joshlf): Log error
+	}
+}
 
+// packet constructs an ARP packet with the header hdr, preceded by space for
+// an Ethernet header. The hardware and protocol fields of hdr are set.
+func (a *arp) packet(hdr *arpHeader) []byte {
+	hdr.HTYPE = arpHTYPEEthernet
+	hdr.PTYPE = uint16(EtherTypeIPv4)
+	hdr.HLEN, hdr.PLEN = 6, 4
+	b := make([]byte, ethernetHeaderLen+arpHeaderLen)
+	writeARPHeader(hdr, b[ethernetHeaderLen:])
+	return b
 }
 
-const arpHeaderLen = 28
+const (
+	arpHeaderLen = 28
+
+	arpHTYPEEthernet = 1
+
+	arpOpRequest = 1
+	arpOpReply   = 2
+)
 
 // https://en.wikipedia.org/wiki/Address_Resolution_Protocol#Packet_structure
 type arpHeader struct {
@@ -40,3 +277,29 @@ type arpHeader struct {
 	THA          MAC
 	TPA          IPv4
 }
+
+// assumes len(b) >= arpHeaderLen
+func readARPHeader(hdr *arpHeader, b []byte) {
+	hdr.HTYPE = parse.GetUint16(&b)
+	hdr.PTYPE = parse.GetUint16(&b)
+	hdr.HLEN = parse.GetByte(&b)
+	hdr.PLEN = parse.GetByte(&b)
+	hdr.OPER = parse.GetUint16(&b)
+	copy(hdr.SHA[:], parse.GetBytes(&b, 6))
+	copy(hdr.SPA[:], parse.GetBytes(&b, 4))
+	copy(hdr.THA[:], parse.GetBytes(&b, 6))
+	copy(hdr.TPA[:], parse.GetBytes(&b, 4))
+}
+
+// assumes len(b) >= arpHeaderLen
+func writeARPHeader(hdr *arpHeader, b []byte) {
+	parse.PutUint16(&b, hdr.HTYPE)
+	parse.PutUint16(&b, hdr.PTYPE)
+	parse.PutByte(&b, hdr.HLEN)
+	parse.PutByte(&b, hdr.PLEN)
+	parse.PutUint16(&b, hdr.OPER)
+	copy(parse.GetBytes(&b, 6), hdr.SHA[:])
+	copy(parse.GetBytes(&b, 4), hdr.SPA[:])
+	copy(parse.GetBytes(&b, 6), hdr.THA[:])
+	copy(parse.GetBytes(&b, 4), hdr.TPA[:])
+}
@@ -0,0 +1,130 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestARP(t *testing.T) {
+	a, b, ifacea, _ := newTestEthernetDevicePair(t)
+	defer a.BringDown()
+	defer b.BringDown()
+	recv := make(chan []byte, 16)
+	b.RegisterIPv4Callback(func(b []byte) { recv <- b })
+
+	addra, addrb := IPv4{10, 0, 0, 1}, IPv4{10, 0, 0, 2}
+	maca, macb := MAC{2, 0, 0, 0, 0, 1}, MAC{2, 0, 0, 0, 0, 2}
+	// the packets are queued until the reply arrives
+	for i := 0; i < 2; i++ {
+		pkt := []byte{'a', 'r', 'p', byte(i)}
+		if n, err := a.WriteToIPv4(pkt, addrb); n != len(pkt) || err != nil {
+			t.Fatalf("unexpected result from WriteToIPv4: (%v, %v); want (%v, <nil>)", n, err, len(pkt))
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-recv:
+			if want := []byte{'a', 'r', 'p', byte(i)}; !bytes.Equal(got, want) {
+				t.Errorf("unexpected packet: got %q; want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet not delivered")
+		}
+	}
+	if n := ifacea.sentTo(BroadcastMAC); n != 1 {
+		t.Errorf("unexpected number of requests: got %v; want 1", n)
+	}
+	if mac, ok := a.arp.lookup(addrb); !ok || mac != macb {
+		t.Errorf("unexpected cached address for %v: got (%v, %v); want (%v, true)", addrb, mac, ok, macb)
+	}
+	// b learned a's address from the request
+	if mac, ok := b.arp.lookup(addra); !ok || mac != maca {
+		t.Errorf("unexpected cached address for %v: got (%v, %v); want (%v, true)", addra, mac, ok, maca)
+	}
+
+	// broadcasts don't need to be resolved
+	a.WriteToIPv4([]byte("broadcast"), IPv4{10, 0, 0, 255})
+	if n := ifacea.sentTo(BroadcastMAC); n != 2 {
+		t.Errorf("unexpected number of broadcast frames: got %v; want 2", n)
+	}
+}
+
+func TestGratuitousARP(t *testing.T) {
+	a, b, _, ifaceb := newTestEthernetDevicePair(t)
+	defer a.BringDown()
+	defer b.BringDown()
+	addrb := IPv4{10, 0, 0, 2}
+	a.WriteToIPv4([]byte("arp"), addrb)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if _, ok := a.arp.lookup(addrb); ok {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("address not resolved")
+		}
+	}
+
+	// announce that 10.0.0.2 has moved, and that
+	// an unknown host has appeared
+	announce := func(addr IPv4, mac MAC) {
+		hdr := arpHeader{OPER: arpOpRequest, SHA: mac, SPA: addr, TPA: addr}
+		ifaceb.WriteFrameSrc(b.arp.packet(&hdr), mac, BroadcastMAC, EtherTypeARP)
+	}
+	moved := MAC{2, 0, 0, 0, 0, 3}
+	announce(addrb, moved)
+	announce(IPv4{10, 0, 0, 4}, MAC{2, 0, 0, 0, 0, 4})
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if mac, _ := a.arp.lookup(addrb); mac == moved {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("cached address not updated by gratuitous ARP")
+		}
+	}
+	// only existing entries are updated
+	if _, ok := a.arp.lookup(IPv4{10, 0, 0, 4}); ok {
+		t.Errorf("unexpected cached address for unknown host")
+	}
+}
+
+func TestARPExpiry(t *testing.T) {
+	a, b, ifacea, _ := newTestEthernetDevicePair(t)
+	defer a.BringDown()
+	defer b.BringDown()
+	a.arp.expiry = 20 * time.Millisecond
+	a.arp.retransTimer = 10 * time.Millisecond
+
+	addrb := IPv4{10, 0, 0, 2}
+	a.WriteToIPv4([]byte("arp"), addrb)
+	var resolved bool
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		_, ok := a.arp.lookup(addrb)
+		resolved = resolved || ok
+		if resolved && !ok {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("cached address did not expire (resolved: %v)", resolved)
+		}
+	}
+
+	// resolution of an address which isn't in use fails
+	before := ifacea.sentTo(BroadcastMAC)
+	addrc := IPv4{10, 0, 0, 3}
+	a.WriteToIPv4([]byte("arp"), addrc)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		a.arp.mu.Lock()
+		_, ok := a.arp.entries[addrc]
+		a.arp.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("unresolved address not removed")
+		}
+	}
+	if n := ifacea.sentTo(BroadcastMAC) - before; n != maxARPRequests {
+		t.Errorf("unexpected number of requests: got %v; want %v", n, maxARPRequests)
+	}
+}
@@ -0,0 +1,68 @@
+package net
+
+// Checksum adds the 16-bit big-endian words of data to the ones' complement
+// sum initial, and returns the result with the carries folded back in. If
+// data has an odd length, it is padded with a zero byte.
+//
+// The Internet checksum used by IPv4, ICMP, TCP, and UDP is the complement of
+// the result (with the checksum field zeroed and initial set to the sum of
+// any pseudo-header), and data whose checksum field is set correctly has a
+// Checksum of 0xFFFF. Since the sum is associative, initial may be the
+// unfolded or folded result of a previous call covering a preceding part of
+// the data, provided that part had an even length.
+// See https://tools.ietf.org/html/rfc1071
+func Checksum(data []byte, initial uint32) uint16 {
+	// a 64-bit accumulator can't overflow for any
+	// buffer which fits in memory
+	sum := uint64(initial)
+	for ; len(data) > 1; data = data[2:] {
+		sum += uint64(data[0])<<8 | uint64(data[1])
+	}
+	if len(data) == 1 {
+		sum += uint64(data[0]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return uint16(sum)
+}
+
+// PseudoHeaderSum computes the sum of the IPv4 or IPv6 pseudo-header for a
+// packet from src to dst of the given protocol and upper-layer length, to be
+// passed to Checksum as its initial value. src and dst must be of the same
+// IP version.
+func PseudoHeaderSum(src, dst IP, proto IPProtocol, length int) uint32 {
+	if src, ok := src.(IPv6); ok {
+		return IPv6PseudoHeaderSum(src, dst.(IPv6), proto, length)
+	}
+	return IPv4PseudoHeaderSum(src.(IPv4), dst.(IPv4), proto, length)
+}
+
+// IPv4PseudoHeaderSum is like PseudoHeaderSum, but for IPv4.
+// See https://tools.ietf.org/html/rfc768
+// and https://tools.ietf.org/html/rfc793#page-17
+func IPv4PseudoHeaderSum(src, dst IPv4, proto IPProtocol, length int) uint32 {
+	sum := uint32(src[0])<<8 | uint32(src[1])
+	sum += uint32(src[2])<<8 | uint32(src[3])
+	sum += uint32(dst[0])<<8 | uint32(dst[1])
+	sum += uint32(dst[2])<<8 | uint32(dst[3])
+	return sum + uint32(length&0xFFFF) + uint32(proto)
+}
+
+// IPv6PseudoHeaderSum is like PseudoHeaderSum, but for IPv6. The length is 32
+// bits rather than 16.
+// See https://tools.ietf.org/html/rfc2460#section-8.1
+func IPv6PseudoHeaderSum(src, dst IPv6, proto IPProtocol, length int) uint32 {
+	var sum uint32
+	for i := 0; i < 16; i += 2 {
+		sum += uint32(src[i])<<8 | uint32(src[i+1])
+		sum += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	return sum + uint32(length>>16&0xFFFF) + uint32(length&0xFFFF) + uint32(proto)
+}
+
+// ipv4HeaderChecksum computes the checksum of the IPv4 header b,
+// whose checksum field must be zero.
+func ipv4HeaderChecksum(b []byte) uint16 {
+	return ^Checksum(b, 0)
+}
@@ -0,0 +1,150 @@
+package net
+
+import "testing"
+
+func TestChecksum(t *testing.T) {
+	large := make([]byte, 1<<20)
+	for i := range large {
+		large[i] = 0xFF
+	}
+	for _, c := range []struct {
+		b       []byte
+		initial uint32
+		want    uint16
+	}{
+		// See https://tools.ietf.org/html/rfc1071#section-3
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0, 0xddf2},
+		{nil, 0, 0},
+		{nil, 0x1FFFE, 0xFFFF},
+		// odd lengths are padded with a zero byte
+		{[]byte{0x01}, 0, 0x0100},
+		{[]byte{0xab, 0xcd, 0xef}, 0, 0x9ace},
+		// end-around carry
+		{[]byte{0xFF, 0xFF, 0x00, 0x01}, 0, 0x0001},
+		{[]byte{0x00, 0x01}, 0xFFFFFFFF, 0x0001},
+		// enough words to overflow a 32-bit sum
+		{large, 0xFFFFFFFF, 0xFFFF},
+	} {
+		if got := Checksum(c.b, c.initial); got != c.want {
+			t.Errorf("unexpected checksum of %d bytes with initial %#x: got %#04x; want %#04x", len(c.b), c.initial, got, c.want)
+		}
+	}
+
+	// the sum can be computed in pieces
+	b := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if got := Checksum(b[4:], uint32(Checksum(b[:4], 0))); got != 0xddf2 {
+		t.Errorf("unexpected checksum computed in pieces: got %#04x; want 0xddf2", got)
+	}
+}
+
+func TestIPv4HeaderChecksum(t *testing.T) {
+	// a captured header
+	// See https://en.wikipedia.org/wiki/IPv4_header_checksum
+	want := []byte{
+		0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+		0xb8, 0x61, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+	}
+	if sum := Checksum(want, 0); sum != 0xFFFF {
+		t.Errorf("unexpected checksum of valid header: got %#04x; want 0xffff", sum)
+	}
+	var hdr ipv4Header
+	readIPv4Header(&hdr, want)
+	hdr.checksum = 0
+	got := make([]byte, 20)
+	writeIPv4Header(&hdr, got)
+	if hdr.checksum != 0xb861 || string(got) != string(want) {
+		t.Errorf("unexpected header: got %x (checksum %#04x); want %x", got, hdr.checksum, want)
+	}
+
+	// updating the TTL updates the checksum
+	setTTL(got, 1)
+	if sum := Checksum(got, 0); sum != 0xFFFF {
+		t.Errorf("unexpected checksum after setting TTL: got %#04x; want 0xffff", sum)
+	}
+}
+
+func TestPseudoHeaderChecksum(t *testing.T) {
+	src4, dst4 := IPv4{192, 168, 0, 1}, IPv4{192, 168, 0, 199}
+	src6 := IPv6{0xfe, 0x80, 15: 1}
+	dst6 := IPv6{0xfe, 0x80, 15: 2}
+	// a UDP datagram from port 54321 to port 53 carrying "hello"
+	udp := []byte{0xd4, 0x31, 0x00, 0x35, 0x00, 0x0d, 0x00, 0x00, 'h', 'e', 'l', 'l', 'o'}
+	// a TCP SYN from port 50000 to port 80
+	tcp := []byte{
+		0xc3, 0x50, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00,
+		0x00, 0x00, 0x50, 0x02, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	for _, c := range []struct {
+		b        []byte
+		src, dst IP
+		proto    IPProtocol
+		want     uint16
+	}{
+		{udp, src4, dst4, IPProtocolUDP, 0x6582},
+		{udp, src6, dst6, IPProtocolUDP, 0xea96},
+		{tcp, src4, dst4, IPProtocolTCP, 0x4a28},
+	} {
+		sum := PseudoHeaderSum(c.src, c.dst, c.proto, len(c.b))
+		if got := ^Checksum(c.b, sum); got != c.want {
+			t.Errorf("unexpected checksum of protocol %v from %v to %v: got %#04x; want %#04x", c.proto, c.src, c.dst, got, c.want)
+		}
+		// verifying the packet with the checksum filled in yields 0xFFFF
+		b := append([]byte(nil), c.b...)
+		off := 6
+		if c.proto == IPProtocolTCP {
+			off = 16
+		}
+		b[off], b[off+1] = byte(c.want>>8), byte(c.want)
+		if got := Checksum(b, sum); got != 0xFFFF {
+			t.Errorf("unexpected checksum of protocol %v packet with checksum set: got %#04x; want 0xffff", c.proto, got)
+		}
+	}
+}
+
+func TestChecksumOffload(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	a, _, deva, recv := newTestIPv4HostPair(1500, proto)
+	devb := deva.peer
+	var corrupt bool
+	var sum uint16
+	deva.drop = func(b []byte) bool {
+		if corrupt {
+			b[10] ^= 0xFF
+		}
+		sum = uint16(b[10])<<8 | uint16(b[11])
+		return false
+	}
+
+	for _, c := range []struct {
+		txCaps, rxCaps DeviceCaps
+		corrupt        bool
+		zero           bool // whether the checksum is left zero
+		delivered      bool
+	}{
+		{0, 0, false, false, true},
+		{0, 0, true, false, false},
+		{0, RxChecksumOffload, true, false, true},
+		{TxChecksumOffload, 0, false, true, false},
+		{TxChecksumOffload, RxChecksumOffload, false, true, true},
+	} {
+		deva.caps, devb.caps, corrupt = c.txCaps, c.rxCaps, c.corrupt
+		if _, err := a.WriteToIPv4([]byte("offload"), IPv4{10, 0, 0, 2}, proto); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+		if (sum == 0) != c.zero {
+			t.Errorf("tx caps %v: unexpected checksum %#04x", c.txCaps, sum)
+		}
+		select {
+		case got := <-recv:
+			if !c.delivered {
+				t.Errorf("tx caps %v, rx caps %v, corrupt %v: unexpected delivery", c.txCaps, c.rxCaps, c.corrupt)
+			} else if string(got) != "offload" {
+				t.Errorf("unexpected payload: got %q; want %q", got, "offload")
+			}
+		default:
+			if c.delivered {
+				t.Errorf("tx caps %v, rx caps %v, corrupt %v: packet not delivered", c.txCaps, c.rxCaps, c.corrupt)
+			}
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package net
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/joshlf/net/internal/errors"
+)
 
 // TODO(joshlf): Maybe rename Device to IPDevice
 // These Devices only support IP operations, and
@@ -31,6 +36,84 @@ type Device interface {
 	// MTU returns the device's maximum transmission unit,
 	// or 0 if no MTU is set.
 	MTU() int
+	// SetMTU sets the device's maximum transmission unit. It is an
+	// error to set an MTU below the minimum for the IP versions that
+	// the device supports (68 for IPv4 and 1280 for IPv6).
+	SetMTU(mtu int) error
+
+	// Stats returns a snapshot of the device's packet counters.
+	Stats() DeviceStats
+	// Capabilities returns the work that the device performs on
+	// behalf of the protocols that use it.
+	Capabilities() DeviceCaps
+}
+
+// DeviceCaps is a set of capability flags describing work that a Device
+// performs, or that is made unnecessary by the device, so that protocols
+// using the device may skip it.
+type DeviceCaps uint8
+
+const (
+	// RxChecksumOffload indicates that packets received by the device
+	// have already had their checksums verified, so they need not be
+	// verified again.
+	RxChecksumOffload DeviceCaps = 1 << iota
+	// TxChecksumOffload indicates that the device computes the
+	// checksums of packets written to it, or doesn't need them to
+	// be computed, so the checksum fields may be left zero.
+	TxChecksumOffload
+)
+
+// DeviceStats holds the counters of packets sent and received by a Device
+// since it was created. Received packets are counted whether or not they are
+// then dropped; RxDropped counts those which were dropped before being
+// delivered, for example because no callback was registered. TxDropped counts
+// packets which were not sent because they were too large, the device was
+// down, or the write failed. RxErrors counts failed reads and malformed
+// packets.
+type DeviceStats struct {
+	RxPackets, TxPackets uint64
+	RxBytes, TxBytes     uint64
+	RxDropped, TxDropped uint64
+	RxErrors             uint64
+}
+
+// deviceStats is a set of counters which can be updated concurrently,
+// and from which a DeviceStats can be obtained. The zero value
+// deviceStats is a valid deviceStats with all counters set to 0.
+type deviceStats struct {
+	rxPackets, txPackets atomic.Uint64
+	rxBytes, txBytes     atomic.Uint64
+	rxDropped, txDropped atomic.Uint64
+	rxErrors             atomic.Uint64
+}
+
+// rx records that a packet of n bytes was received.
+func (s *deviceStats) rx(n int) {
+	s.rxPackets.Add(1)
+	s.rxBytes.Add(uint64(n))
+}
+
+// tx records that a packet of n bytes was sent.
+func (s *deviceStats) tx(n int) {
+	s.txPackets.Add(1)
+	s.txBytes.Add(uint64(n))
+}
+
+func (s *deviceStats) rxDrop()  { s.rxDropped.Add(1) }
+func (s *deviceStats) txDrop()  { s.txDropped.Add(1) }
+func (s *deviceStats) rxError() { s.rxErrors.Add(1) }
+
+func (s *deviceStats) snapshot() DeviceStats {
+	return DeviceStats{
+		RxPackets: s.rxPackets.Load(),
+		TxPackets: s.txPackets.Load(),
+		RxBytes:   s.rxBytes.Load(),
+		TxBytes:   s.txBytes.Load(),
+		RxDropped: s.rxDropped.Load(),
+		TxDropped: s.txDropped.Load(),
+		RxErrors:  s.rxErrors.Load(),
+	}
 }
 
 // An IPv4Device is a Device with IPv4-specific methods.
@@ -150,3 +233,19 @@ func (d *DeviceSet) remove(name string) {
 	delete(d.byName, name)
 	delete(d.byDevice, dev)
 }
+
+// checkMTU returns an error if mtu is below the minimum for a device used for
+// the given IP versions, or above maxMTU. A device which supports IPv6 but has
+// no IPv6 address isn't used for IPv6, so it only needs to support the minimum
+// IPv4 MTU.
+func checkMTU(mtu int, v4, v6 bool) error {
+	switch {
+	case mtu > maxMTU:
+		return errors.Errorf("set MTU: MTU above maximum of %v", maxMTU)
+	case v6 && mtu < minIPv6MTU:
+		return errors.Errorf("set MTU: MTU below IPv6 minimum of %v", minIPv6MTU)
+	case v4 && mtu < minIPv4MTU:
+		return errors.Errorf("set MTU: MTU below IPv4 minimum of %v", minIPv4MTU)
+	}
+	return nil
+}
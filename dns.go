@@ -0,0 +1,431 @@
+package net
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// See https://tools.ietf.org/html/rfc1035#section-4.1
+const (
+	dnsHeaderLen = 12
+	dnsPort      = 53
+	// the largest message sent over UDP without EDNS
+	// See https://tools.ietf.org/html/rfc1035#section-2.3.4
+	dnsMaxUDPLen = 512
+	// the longest name and label
+	dnsMaxNameLen  = 255
+	dnsMaxLabelLen = 63
+
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+
+	dnsFlagQR = 0x8000 // the message is a response
+	dnsFlagTC = 0x0200 // the message was truncated
+	dnsFlagRD = 0x0100 // recursion desired
+
+	dnsRcodeMask     = 0xF
+	dnsRcodeNXDomain = 3
+
+	// the most CNAMEs followed when resolving a name
+	dnsMaxCNAMEs = 8
+
+	defaultDNSTimeout  = 2 * time.Second
+	defaultDNSAttempts = 3
+)
+
+// A Resolver resolves hostnames by sending DNS queries over UDP from a Stack
+// to a recursive DNS server. Positive answers are cached until their TTLs
+// expire. Since queries are only sent over UDP, truncated responses are
+// treated as errors.
+//
+// Resolvers are safe for concurrent access. The zero Resolver is not a valid
+// Resolver; use NewResolver.
+type Resolver struct {
+	stack    *Stack
+	server   UDPAddr
+	timeout  time.Duration // how long to wait for each response
+	attempts int           // how many queries to send before giving up
+
+	cache map[dnsQuestion]dnsCacheEntry
+	// times out queries; stopped when the stack is closed
+	timeoutd *timeout.Daemon
+	mu       sync.Mutex
+}
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	ips     []IP
+	expires time.Time // relative to timeout.NowMonotonic
+}
+
+// NewResolver creates a Resolver which sends queries from s to server. If
+// server.Port is 0, port 53 is used.
+func (s *Stack) NewResolver(server *UDPAddr) *Resolver {
+	r := &Resolver{
+		stack:    s,
+		server:   *server,
+		timeout:  defaultDNSTimeout,
+		attempts: defaultDNSAttempts,
+		cache:    make(map[dnsQuestion]dnsCacheEntry),
+	}
+	if r.server.Port == 0 {
+		r.server.Port = dnsPort
+	}
+	r.timeoutd = timeout.NewDaemon(&r.mu)
+	stop := func() error {
+		r.timeoutd.Stop()
+		return nil
+	}
+	if s.OnClose(stop) != nil {
+		// s is already closed, so queries fail
+		stop()
+	}
+	return r
+}
+
+// SetTimeout sets how long r waits for a response to each query before
+// retransmitting it. The default is 2 seconds.
+func (r *Resolver) SetTimeout(timeout time.Duration) {
+	r.mu.Lock()
+	r.timeout = timeout
+	r.mu.Unlock()
+}
+
+// SetAttempts sets how many times r sends each query before giving up. The
+// default is 3. If n is less than 1, 1 is used.
+func (r *Resolver) SetAttempts(n int) {
+	if n < 1 {
+		n = 1
+	}
+	r.mu.Lock()
+	r.attempts = n
+	r.mu.Unlock()
+}
+
+// LookupHost looks up the IPv4 and IPv6 addresses of the given host. If host
+// is an IP address, it is returned without sending any queries. If the host
+// doesn't exist or has no addresses, the returned error matches
+// ErrNoSuchHost. If the server doesn't respond, the returned error is a
+// timeout error.
+func (r *Resolver) LookupHost(host string) ([]IP, error) {
+	if ip, err := ParseIP(host); err == nil {
+		return []IP{ip}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	var ips []IP
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		res, err := r.lookup(name, qtype)
+		if err != nil {
+			return nil, errors.Annotatef(err, "lookup %v", host)
+		}
+		ips = append(ips, res...)
+	}
+	if len(ips) == 0 {
+		return nil, errors.NoSuchHostf("lookup %v", host)
+	}
+	return ips, nil
+}
+
+// lookup returns the addresses of type qtype of name, following
+// CNAMEs, and using the cache if possible.
+func (r *Resolver) lookup(name string, qtype uint16) ([]IP, error) {
+	q := dnsQuestion{name: name, qtype: qtype}
+	r.mu.Lock()
+	entry, ok := r.cache[q]
+	if ok && timeout.NowMonotonic().After(entry.expires) {
+		delete(r.cache, q)
+		ok = false
+	}
+	r.mu.Unlock()
+	if ok {
+		return entry.ips, nil
+	}
+
+	var ttl uint32
+	target := name
+	for i := 0; ; i++ {
+		resp, err := r.query(dnsQuestion{name: target, qtype: qtype})
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 || resp.ttl < ttl {
+			ttl = resp.ttl
+		}
+		if len(resp.ips) > 0 || resp.target == target {
+			// the answer either has addresses, or has no
+			// addresses and no CNAME to follow
+			if len(resp.ips) > 0 && ttl > 0 {
+				r.mu.Lock()
+				r.cache[q] = dnsCacheEntry{
+					ips:     resp.ips,
+					expires: timeout.NowMonotonic().Add(time.Duration(ttl) * time.Second),
+				}
+				r.mu.Unlock()
+			}
+			return resp.ips, nil
+		}
+		// the server gave us a CNAME without resolving it
+		if i == dnsMaxCNAMEs {
+			return nil, errors.New("too many CNAMEs")
+		}
+		target = resp.target
+	}
+}
+
+// query sends the question q to the server, retransmitting it if no
+// response arrives in time, and returns the answer.
+func (r *Resolver) query(q dnsQuestion) (*dnsAnswer, error) {
+	r.mu.Lock()
+	wait, attempts := r.timeout, r.attempts
+	r.mu.Unlock()
+
+	id := uint16(rand.Uint32())
+	msg, err := encodeDNSQuery(id, q)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := r.stack.DialUDP(nil, &r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, dnsMaxUDPLen)
+	for i := 0; i < attempts; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		expired := make(chan time.Time, 1)
+		r.mu.Lock()
+		to := r.timeoutd.AddTimeout(func() { expired <- timeout.NowMonotonic() }, timeout.NowMonotonic().Add(wait))
+		r.mu.Unlock()
+		if to.Dropped() {
+			return nil, errors.New("resolver's stack is closed")
+		}
+		for {
+			n, addr, _, err := conn.readFrom(buf, expired)
+			if IsTimeout(err) {
+				break
+			}
+			if err != nil {
+				r.cancel(to)
+				return nil, err
+			}
+			if *addr.(*UDPAddr) != r.server {
+				continue
+			}
+			resp, err := parseDNSResponse(buf[:n], id, q)
+			if err != nil {
+				// TODO(joshlf): Log it
+				continue
+			}
+			r.cancel(to)
+			return resp, resp.err
+		}
+	}
+	return nil, errors.Timeoutf("no response from DNS server %v", &r.server)
+}
+
+// cancel cancels the timeout of a query.
+func (r *Resolver) cancel(to *timeout.Timeout) {
+	r.mu.Lock()
+	to.Cancel()
+	r.mu.Unlock()
+}
+
+// encodeDNSQuery encodes a query with the given ID for the question q.
+func encodeDNSQuery(id uint16, q dnsQuestion) ([]byte, error) {
+	if len(q.name) > dnsMaxNameLen-2 {
+		return nil, errors.Errorf("name too long: %v", q.name)
+	}
+	// the encoded name has a length byte before each label
+	// and a zero-length label at the end
+	msg := make([]byte, dnsHeaderLen+len(q.name)+2+4)
+	b := msg
+	parse.PutUint16(&b, id)
+	parse.PutUint16(&b, dnsFlagRD)
+	parse.PutUint16(&b, 1) // one question
+	b = b[6:]              // no answer, authority, or additional records
+	for _, label := range strings.Split(q.name, ".") {
+		if len(label) == 0 || len(label) > dnsMaxLabelLen {
+			return nil, errors.Errorf("invalid name: %v", q.name)
+		}
+		parse.PutByte(&b, byte(len(label)))
+		copy(b, label)
+		b = b[len(label):]
+	}
+	parse.PutByte(&b, 0)
+	parse.PutUint16(&b, q.qtype)
+	parse.PutUint16(&b, dnsClassIN)
+	return msg, nil
+}
+
+// A dnsAnswer is the answer to a query contained in a response.
+type dnsAnswer struct {
+	// the name at the end of the chain of CNAMEs in the response
+	// starting with the name queried; if there are none, the name
+	// queried
+	target string
+	ips    []IP   // addresses of target
+	ttl    uint32 // the smallest TTL of the records used
+	err    error  // non-nil if the server reported an error
+}
+
+// parseDNSResponse parses msg, which must be a response to a query with the
+// given ID for the question q.
+func parseDNSResponse(msg []byte, id uint16, q dnsQuestion) (ans *dnsAnswer, err error) {
+	// since msg could be malformed such that we read past its end, defer
+	// here; we know that panics will only happen because of index
+	// out-of-bounds or malformed names (see parseDNSName), so this is safe
+	defer func() {
+		if r := recover(); r != nil {
+			ans, err = nil, errors.New("malformed DNS response")
+		}
+	}()
+
+	b := msg
+	if parse.GetUint16(&b) != id {
+		return nil, errors.New("DNS response has wrong ID")
+	}
+	flags := parse.GetUint16(&b)
+	qdcount := parse.GetUint16(&b)
+	ancount := parse.GetUint16(&b)
+	b = b[4:] // ignore authority and additional records
+	if flags&dnsFlagQR == 0 {
+		return nil, errors.New("DNS message is not a response")
+	}
+	if qdcount != 1 {
+		return nil, errors.New("DNS response has wrong number of questions")
+	}
+	name := parseDNSName(msg, &b)
+	qtype := parse.GetUint16(&b)
+	parse.GetUint16(&b) // class
+	if name != q.name || qtype != q.qtype {
+		return nil, errors.New("DNS response is for another question")
+	}
+
+	ans = &dnsAnswer{target: q.name}
+	if flags&dnsFlagTC != 0 {
+		// the answer may be incomplete, and we can't retry over TCP
+		// See https://tools.ietf.org/html/rfc2181#section-9
+		ans.err = errors.Errorf("truncated DNS response for %v", q.name)
+		return ans, nil
+	}
+	switch rcode := flags & dnsRcodeMask; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		ans.err = errors.NoSuchHostf("%v", q.name)
+		return ans, nil
+	default:
+		ans.err = errors.Errorf("DNS server returned error code %v", rcode)
+		return ans, nil
+	}
+
+	type record struct {
+		name  string
+		rtype uint16
+		ttl   uint32
+		data  []byte
+	}
+	var records []record
+	for i := 0; i < int(ancount); i++ {
+		var rec record
+		rec.name = parseDNSName(msg, &b)
+		rec.rtype = parse.GetUint16(&b)
+		class := parse.GetUint16(&b)
+		rec.ttl = parse.GetUint32(&b)
+		rec.data = parse.GetBytes(&b, int(parse.GetUint16(&b)))
+		if class == dnsClassIN {
+			records = append(records, rec)
+		}
+	}
+
+	// follow CNAMEs from the name queried, and then collect the addresses
+	// See https://tools.ietf.org/html/rfc1034#section-3.6.2
+	first := true
+	useTTL := func(ttl uint32) {
+		if first || ttl < ans.ttl {
+			ans.ttl = ttl
+		}
+		first = false
+	}
+FOLLOW:
+	for i := 0; i < dnsMaxCNAMEs; i++ {
+		for _, rec := range records {
+			if rec.rtype == dnsTypeCNAME && rec.name == ans.target {
+				data := rec.data
+				// the CNAME may be compressed, so decode it relative to msg
+				ans.target = parseDNSName(msg, &data)
+				useTTL(rec.ttl)
+				continue FOLLOW
+			}
+		}
+		break
+	}
+	for _, rec := range records {
+		if rec.name != ans.target || rec.rtype != q.qtype {
+			continue
+		}
+		switch {
+		case rec.rtype == dnsTypeA && len(rec.data) == 4:
+			var ip IPv4
+			copy(ip[:], rec.data)
+			ans.ips = append(ans.ips, ip)
+		case rec.rtype == dnsTypeAAAA && len(rec.data) == 16:
+			var ip IPv6
+			copy(ip[:], rec.data)
+			ans.ips = append(ans.ips, ip)
+		default:
+			continue
+		}
+		useTTL(rec.ttl)
+	}
+	return ans, nil
+}
+
+// parseDNSName parses the possibly-compressed name at the beginning of *b,
+// which is a slice of msg, advancing *b past it. The name is lowercased and
+// has no trailing dot. It panics if the name is malformed.
+// See https://tools.ietf.org/html/rfc1035#section-4.1.4
+func parseDNSName(msg []byte, b *[]byte) string {
+	var labels []string
+	var length int
+	cur := b
+	for jumps := 0; ; {
+		n := parse.GetByte(cur)
+		switch {
+		case n == 0:
+			return strings.ToLower(strings.Join(labels, "."))
+		case n&0xC0 == 0xC0:
+			// a pointer to a name elsewhere in msg; once we've
+			// followed one, *b is already past the name
+			off := int(n&0x3F)<<8 | int(parse.GetByte(cur))
+			// a name can't sensibly contain more pointers
+			// than msg has bytes, so there must be a loop
+			if jumps++; jumps > len(msg) {
+				panic("DNS name pointer loop")
+			}
+			rest := msg[off:]
+			cur = &rest
+		case n > dnsMaxLabelLen:
+			panic("invalid DNS label length")
+		default:
+			if length += int(n) + 1; length > dnsMaxNameLen {
+				panic("DNS name too long")
+			}
+			labels = append(labels, string(parse.GetBytes(cur, int(n))))
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package net
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/parse"
+)
+
+type testDNSRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte // for a CNAME, the target name
+}
+
+// A testDNSServer answers DNS queries on a UDPConn from a fixed set of
+// records. Names with no records get NXDOMAIN responses, queries for names
+// in drop are ignored, and responses for names in truncate are marked as
+// truncated.
+type testDNSServer struct {
+	conn     *UDPConn
+	records  []testDNSRecord
+	drop     map[string]bool
+	truncate map[string]bool
+	queries  map[string]int // the number of queries received for each name
+
+	mu sync.Mutex
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		id := parse.GetUint16(&b)
+		b = b[10:]
+		name := parseDNSName(buf, &b)
+		qtype := parse.GetUint16(&b)
+
+		s.mu.Lock()
+		s.queries[name]++
+		drop := s.drop[name]
+		s.mu.Unlock()
+		if !drop {
+			s.conn.WriteTo(s.respond(id, name, qtype), addr)
+		}
+	}
+}
+
+// respond returns the response to a query for name of type qtype. The
+// answer contains the records of that type for name, or its CNAME along
+// with the records for the CNAME's target, if there are any.
+func (s *testDNSServer) respond(id uint16, qname string, qtype uint16) []byte {
+	name := qname
+	var answers []testDNSRecord
+	exists := false
+	for _, rec := range s.records {
+		if rec.name != name {
+			continue
+		}
+		exists = true
+		if rec.rtype == dnsTypeCNAME {
+			answers = append(answers, rec)
+			name = string(rec.data)
+		}
+	}
+	for _, rec := range s.records {
+		if rec.name == name && rec.rtype == qtype {
+			answers = append(answers, rec)
+		}
+	}
+
+	msg := make([]byte, 0, 512)
+	flags := uint16(dnsFlagQR | 0x80) // recursion available
+	if !exists {
+		flags |= dnsRcodeNXDomain
+	}
+	if s.truncate[qname] {
+		flags |= dnsFlagTC
+	}
+	msg = append(msg, byte(id>>8), byte(id), byte(flags>>8), byte(flags), 0, 1, 0, byte(len(answers)), 0, 0, 0, 0)
+	q, _ := encodeDNSQuery(0, dnsQuestion{name: qname, qtype: qtype})
+	msg = append(msg, q[dnsHeaderLen:]...)
+	for _, rec := range answers {
+		msg = s.appendName(msg, rec.name)
+		data := rec.data
+		if rec.rtype == dnsTypeCNAME {
+			data = s.appendName(nil, string(rec.data))
+		}
+		msg = append(msg, byte(rec.rtype>>8), byte(rec.rtype), 0, dnsClassIN,
+			byte(rec.ttl>>24), byte(rec.ttl>>16), byte(rec.ttl>>8), byte(rec.ttl),
+			byte(len(data)>>8), byte(len(data)))
+		msg = append(msg, data...)
+	}
+	return msg
+}
+
+// appendName appends name to msg, compressed as a pointer to
+// the question if it's the name in the question.
+func (s *testDNSServer) appendName(msg []byte, name string) []byte {
+	if len(msg) > dnsHeaderLen {
+		b := msg[dnsHeaderLen:]
+		if parseDNSName(msg, &b) == name {
+			return append(msg, 0xC0, dnsHeaderLen)
+		}
+	}
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+func (s *testDNSServer) numQueries(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[name]
+}
+
+func TestResolver(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+
+	conn, err := s.ListenUDP(&UDPAddr{Port: 5353})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer conn.Close()
+	ipv6a, ipv6b := IPv6{0x20, 0x01, 0x0d, 0xb8, 15: 1}, IPv6{0x20, 0x01, 0x0d, 0xb8, 15: 2}
+	srv := &testDNSServer{
+		conn: conn,
+		records: []testDNSRecord{
+			{"a.example", dnsTypeA, 60, []byte{192, 0, 2, 1}},
+			{"a.example", dnsTypeA, 30, []byte{192, 0, 2, 2}},
+			{"a.example", dnsTypeAAAA, 60, ipv6a[:]},
+			{"v6.example", dnsTypeAAAA, 60, ipv6b[:]},
+			{"www.example", dnsTypeCNAME, 60, []byte("a.example")},
+			// resolving this requires a second query for www.example
+			{"alias.example", dnsTypeCNAME, 60, []byte("www.example")},
+			{"uncached.example", dnsTypeA, 0, []byte{192, 0, 2, 3}},
+			{"truncated.example", dnsTypeA, 60, []byte{192, 0, 2, 4}},
+		},
+		drop:     map[string]bool{"drop.example": true},
+		truncate: map[string]bool{"truncated.example": true},
+		queries:  make(map[string]int),
+	}
+	go srv.serve()
+
+	r := s.NewResolver(&UDPAddr{IP: IPv4{127, 0, 0, 1}, Port: 5353})
+	r.SetTimeout(100 * time.Millisecond)
+	r.SetAttempts(2)
+
+	for _, c := range []struct {
+		host string
+		want []string
+	}{
+		{"a.example", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+		{"A.Example.", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+		{"v6.example", []string{"2001:db8::2"}},
+		{"www.example", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+		{"alias.example", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+		{"192.0.2.7", []string{"192.0.2.7"}},
+	} {
+		ips, err := r.LookupHost(c.host)
+		if err != nil {
+			t.Errorf("unexpected error looking up %v: %v", c.host, err)
+			continue
+		}
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ipString(ip))
+		}
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Errorf("unexpected addresses for %v: got %v; want %v", c.host, got, c.want)
+		}
+	}
+
+	// a.example was only queried once for each type; the
+	// other lookups were answered from the cache
+	if n := srv.numQueries("a.example"); n != 2 {
+		t.Errorf("unexpected number of queries for a.example: got %v; want 2", n)
+	}
+	// records with a TTL of 0 aren't cached
+	r.LookupHost("uncached.example")
+	r.LookupHost("uncached.example")
+	if n := srv.numQueries("uncached.example"); n != 4 {
+		t.Errorf("unexpected number of queries for uncached.example: got %v; want 4", n)
+	}
+
+	// truncated responses are errors, and aren't cached
+	for i := 0; i < 2; i++ {
+		if ips, err := r.LookupHost("truncated.example"); err == nil || IsNoSuchHost(err) {
+			t.Errorf("unexpected result looking up host with truncated response: got (%v, %v); want truncation error", ips, err)
+		}
+	}
+	if n := srv.numQueries("truncated.example"); n != 2 {
+		t.Errorf("unexpected number of queries for truncated.example: got %v; want 2", n)
+	}
+
+	if _, err := r.LookupHost("missing.example"); !IsNoSuchHost(err) {
+		t.Errorf("unexpected error looking up nonexistent host: got %v; want no such host", err)
+	}
+
+	start := time.Now()
+	if _, err := r.LookupHost("drop.example"); !IsTimeout(err) {
+		t.Errorf("unexpected error looking up host with no response: got %v; want timeout", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("lookup timed out after %v; want at least two 100ms attempts", d)
+	}
+	if n := srv.numQueries("drop.example"); n != 2 {
+		t.Errorf("unexpected number of queries for unanswered host: got %v; want 2", n)
+	}
+}
@@ -0,0 +1,394 @@
+package net
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// An Emulation describes the network conditions emulated by an emulated
+// device (see NewEmulatedDevice), in the style of Linux's netem. Each
+// probability must be between 0 and 1.
+type Emulation struct {
+	// Delay is the time for which each packet is held before being passed
+	// on. Jitter varies each packet's delay uniformly within Jitter of
+	// Delay. Packets are passed on in the order of their delayed times, so
+	// jitter greater than the interval between packets reorders them.
+	Delay, Jitter time.Duration
+	// Loss is the probability that a packet is dropped.
+	Loss float64
+	// Duplicate is the probability that a packet is passed on twice.
+	Duplicate float64
+	// Reorder is the probability that a packet skips the delay and is passed
+	// on immediately, ahead of packets which are being delayed.
+	Reorder float64
+	// Seed seeds the random number generators which decide the fate of each
+	// packet. Given the same seed, the same sequence of packets sent (or
+	// received) is treated the same way.
+	Seed int64
+}
+
+// NewEmulatedDevice returns a Device which wraps dev, emulating the network
+// conditions described by em for both the packets written to it and the
+// packets it receives. Dropped packets are counted in the TxDropped and
+// RxDropped statistics. Delayed packets are copied, and writing them
+// succeeds immediately; errors from the eventual write are ignored. Bringing
+// the returned Device down discards the packets being delayed, counting them
+// as dropped.
+//
+// The returned Device implements IPv4Device and IPv6Device if dev does; it
+// should be used in place of dev, for example when adding it to a Stack. It
+// has an Unwrap method which returns dev.
+func NewEmulatedDevice(dev Device, em Emulation) (Device, error) {
+	for _, p := range []float64{em.Loss, em.Duplicate, em.Reorder} {
+		if p < 0 || p > 1 {
+			return nil, errors.New("new emulated device: probability out of range")
+		}
+	}
+	if em.Delay < 0 || em.Jitter < 0 {
+		return nil, errors.New("new emulated device: negative delay")
+	}
+	e := newEmulator(em)
+	dev4, ok4 := dev.(IPv4Device)
+	dev6, ok6 := dev.(IPv6Device)
+	switch {
+	case ok4 && ok6:
+		return &emulatedIPDevice{dev.(ipDevice), e}, nil
+	case ok4:
+		return &emulatedIPv4Device{dev4, e}, nil
+	case ok6:
+		return &emulatedIPv6Device{dev6, e}, nil
+	default:
+		return &emulatedDevice{dev, e}, nil
+	}
+}
+
+type emulator struct {
+	em Emulation
+	// sent and received packets use separate generators so that
+	// each direction is deterministic regardless of the other
+	txRand, rxRand *rand.Rand
+	// returns the current time; delayed packets are
+	// passed on once it reaches their delayed times
+	now func() time.Time
+
+	queue emulatorQueue
+	seq   uint64 // breaks ties between packets with equal times
+	// passes on the packets in queue; nil while the device is down
+	timeoutd *timeout.Daemon
+	handle   *timeout.Timeout // non-nil while waiting for the first packet in queue
+	draining bool             // drain is passing on packets
+
+	txDropped, rxDropped uint64
+	mu                   sync.Mutex
+}
+
+func newEmulator(em Emulation) *emulator {
+	e := &emulator{
+		em:     em,
+		txRand: rand.New(rand.NewSource(em.Seed)),
+		rxRand: rand.New(rand.NewSource(em.Seed + 1)),
+		now:    timeout.NowMonotonic,
+	}
+	e.timeoutd = timeout.NewDaemon(&e.mu)
+	return e
+}
+
+// An emulationPlan describes the fate of a packet.
+type emulationPlan struct {
+	drop  bool
+	dup   bool
+	delay time.Duration
+}
+
+// plan decides the fate of a packet using r; it must be called with e.mu held.
+func (e *emulator) plan(r *rand.Rand) (p emulationPlan) {
+	if r.Float64() < e.em.Loss {
+		return emulationPlan{drop: true}
+	}
+	p.dup = r.Float64() < e.em.Duplicate
+	p.delay = e.em.Delay
+	if e.em.Jitter > 0 {
+		p.delay += time.Duration((2*r.Float64() - 1) * float64(e.em.Jitter))
+		if p.delay < 0 {
+			p.delay = 0
+		}
+	}
+	if r.Float64() < e.em.Reorder {
+		p.delay = 0
+	}
+	return p
+}
+
+// transmit passes the packet b, which is being written, to send.
+func (e *emulator) transmit(b []byte, send func(b []byte) (int, error)) (int, error) {
+	e.mu.Lock()
+	p := e.plan(e.txRand)
+	if p.drop {
+		e.txDropped++
+	}
+	e.mu.Unlock()
+	switch {
+	case p.drop:
+		return len(b), nil
+	case p.delay == 0:
+		n, err := send(b)
+		if p.dup {
+			send(b)
+		}
+		return n, err
+	}
+	// the caller may reuse b once we return
+	b = append([]byte(nil), b...)
+	e.delay(p, false, func() {
+		send(b)
+		// TODO(joshlf): Log error
+	})
+	return len(b), nil
+}
+
+// receive passes the packet b, which has been received, to f.
+func (e *emulator) receive(b []byte, f func(b []byte)) {
+	e.mu.Lock()
+	p := e.plan(e.rxRand)
+	if p.drop {
+		e.rxDropped++
+	}
+	e.mu.Unlock()
+	switch {
+	case p.drop:
+		return
+	case p.delay == 0:
+		f(b)
+		if p.dup {
+			f(b)
+		}
+		return
+	}
+	// the device may reuse b once we return
+	b = append([]byte(nil), b...)
+	e.delay(p, true, func() { f(b) })
+}
+
+// delay calls f after p.delay, and again if p.dup is set. rx
+// is set if f passes on a received packet rather than a sent one.
+func (e *emulator) delay(p emulationPlan, rx bool, f func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.timeoutd == nil {
+		// the device is down
+		e.countDropped(rx)
+		return
+	}
+	at := e.now().Add(p.delay)
+	for i := 0; i < 1 || (i < 2 && p.dup); i++ {
+		heap.Push(&e.queue, emulatedPacket{at: at, seq: e.seq, rx: rx, f: f})
+		e.seq++
+	}
+	if e.draining {
+		// drain will schedule the timeout once it's done
+		return
+	}
+	if e.handle != nil {
+		// the new packet may be the first
+		e.handle.Cancel()
+	}
+	e.schedule()
+}
+
+// countDropped counts a packet in the queue as dropped;
+// it must be called with e.mu held.
+func (e *emulator) countDropped(rx bool) {
+	if rx {
+		e.rxDropped++
+	} else {
+		e.txDropped++
+	}
+}
+
+// schedule arranges for drain to be called once the first packet in the
+// queue is due; it must be called with e.mu held.
+func (e *emulator) schedule() {
+	d := e.queue[0].at.Sub(e.now())
+	e.handle = e.timeoutd.AddTimeout(e.drain, timeout.NowMonotonic().Add(d))
+}
+
+// drain passes on the packets which are due in order. It is called by
+// e.timeoutd with e.mu held, but releases it while passing them on, since
+// passing on a packet may cause another to be written.
+func (e *emulator) drain() {
+	e.handle = nil
+	e.draining = true
+	for {
+		now := e.now()
+		var due []func()
+		for len(e.queue) > 0 && !e.queue[0].at.After(now) {
+			due = append(due, heap.Pop(&e.queue).(emulatedPacket).f)
+		}
+		if len(due) == 0 {
+			break
+		}
+		e.mu.Unlock()
+		for _, f := range due {
+			f()
+		}
+		e.mu.Lock()
+	}
+	e.draining = false
+	if len(e.queue) > 0 {
+		e.schedule()
+	}
+}
+
+// bringUp brings dev up and restarts the daemon which passes on delayed
+// packets.
+func (e *emulator) bringUp(dev Device) error {
+	if err := dev.BringUp(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	if e.timeoutd == nil {
+		e.timeoutd = timeout.NewDaemon(&e.mu)
+	}
+	e.mu.Unlock()
+	return nil
+}
+
+// bringDown stops the daemon which passes on delayed packets, discarding
+// them, and brings dev down. Until the device is brought back up, packets
+// which would have been delayed are dropped instead.
+func (e *emulator) bringDown(dev Device) error {
+	e.mu.Lock()
+	if e.timeoutd != nil {
+		e.timeoutd.Stop()
+		e.timeoutd = nil
+	}
+	e.handle = nil
+	for _, p := range e.queue {
+		e.countDropped(p.rx)
+	}
+	e.queue = nil
+	e.mu.Unlock()
+	return dev.BringDown()
+}
+
+// stats adds the packets dropped by e to st.
+func (e *emulator) stats(st DeviceStats) DeviceStats {
+	e.mu.Lock()
+	st.TxDropped += e.txDropped
+	st.RxDropped += e.rxDropped
+	e.mu.Unlock()
+	return st
+}
+
+// tap returns a callback which passes each packet to f through e,
+// or nil if f is nil.
+func (e *emulator) tap(f func(b []byte)) func(b []byte) {
+	if f == nil {
+		return nil
+	}
+	return func(b []byte) { e.receive(b, f) }
+}
+
+type emulatedPacket struct {
+	at  time.Time
+	seq uint64
+	rx  bool
+	f   func()
+}
+
+// emulatorQueue implements heap.Interface, ordering
+// packets by their delayed times.
+type emulatorQueue []emulatedPacket
+
+func (q emulatorQueue) Len() int { return len(q) }
+func (q emulatorQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q emulatorQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *emulatorQueue) Push(x interface{}) { *q = append(*q, x.(emulatedPacket)) }
+func (q *emulatorQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
+
+type emulatedDevice struct {
+	Device
+	e *emulator
+}
+
+func (dev *emulatedDevice) Unwrap() Device     { return dev.Device }
+func (dev *emulatedDevice) Stats() DeviceStats { return dev.e.stats(dev.Device.Stats()) }
+func (dev *emulatedDevice) BringUp() error     { return dev.e.bringUp(dev.Device) }
+func (dev *emulatedDevice) BringDown() error   { return dev.e.bringDown(dev.Device) }
+
+type emulatedIPv4Device struct {
+	IPv4Device
+	e *emulator
+}
+
+func (dev *emulatedIPv4Device) Unwrap() Device     { return dev.IPv4Device }
+func (dev *emulatedIPv4Device) Stats() DeviceStats { return dev.e.stats(dev.IPv4Device.Stats()) }
+func (dev *emulatedIPv4Device) BringUp() error     { return dev.e.bringUp(dev.IPv4Device) }
+func (dev *emulatedIPv4Device) BringDown() error   { return dev.e.bringDown(dev.IPv4Device) }
+
+func (dev *emulatedIPv4Device) RegisterIPv4Callback(f func(b []byte)) {
+	dev.IPv4Device.RegisterIPv4Callback(dev.e.tap(f))
+}
+
+func (dev *emulatedIPv4Device) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.e.transmit(b, func(b []byte) (int, error) { return dev.IPv4Device.WriteToIPv4(b, dst) })
+}
+
+type emulatedIPv6Device struct {
+	IPv6Device
+	e *emulator
+}
+
+func (dev *emulatedIPv6Device) Unwrap() Device     { return dev.IPv6Device }
+func (dev *emulatedIPv6Device) Stats() DeviceStats { return dev.e.stats(dev.IPv6Device.Stats()) }
+func (dev *emulatedIPv6Device) BringUp() error     { return dev.e.bringUp(dev.IPv6Device) }
+func (dev *emulatedIPv6Device) BringDown() error   { return dev.e.bringDown(dev.IPv6Device) }
+
+func (dev *emulatedIPv6Device) RegisterIPv6Callback(f func(b []byte)) {
+	dev.IPv6Device.RegisterIPv6Callback(dev.e.tap(f))
+}
+
+func (dev *emulatedIPv6Device) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.e.transmit(b, func(b []byte) (int, error) { return dev.IPv6Device.WriteToIPv6(b, dst) })
+}
+
+type emulatedIPDevice struct {
+	ipDevice
+	e *emulator
+}
+
+func (dev *emulatedIPDevice) Unwrap() Device     { return dev.ipDevice }
+func (dev *emulatedIPDevice) Stats() DeviceStats { return dev.e.stats(dev.ipDevice.Stats()) }
+func (dev *emulatedIPDevice) BringUp() error     { return dev.e.bringUp(dev.ipDevice) }
+func (dev *emulatedIPDevice) BringDown() error   { return dev.e.bringDown(dev.ipDevice) }
+
+func (dev *emulatedIPDevice) RegisterIPv4Callback(f func(b []byte)) {
+	dev.ipDevice.RegisterIPv4Callback(dev.e.tap(f))
+}
+
+func (dev *emulatedIPDevice) RegisterIPv6Callback(f func(b []byte)) {
+	dev.ipDevice.RegisterIPv6Callback(dev.e.tap(f))
+}
+
+func (dev *emulatedIPDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.e.transmit(b, func(b []byte) (int, error) { return dev.ipDevice.WriteToIPv4(b, dst) })
+}
+
+func (dev *emulatedIPDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.e.transmit(b, func(b []byte) (int, error) { return dev.ipDevice.WriteToIPv6(b, dst) })
+}
@@ -0,0 +1,192 @@
+package net
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newEmulatedLoopback wraps an up LoopbackDevice in an emulated device.
+func newEmulatedLoopback(t *testing.T, em Emulation) (dev *emulatedIPDevice, lo *LoopbackDevice) {
+	lo, err := NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	d, err := NewEmulatedDevice(lo, em)
+	if err != nil {
+		t.Fatalf("unexpected error creating emulated device: %v", err)
+	}
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	return d.(*emulatedIPDevice), lo
+}
+
+func TestEmulatedDeviceLoss(t *testing.T) {
+	const (
+		n    = 10000
+		loss = 0.3
+	)
+	if _, err := NewEmulatedDevice(nil, Emulation{Loss: 1.5}); err == nil {
+		t.Errorf("no error creating emulated device with invalid loss probability")
+	}
+
+	// the same seed drops the same packets
+	var dropped []uint64
+	for i := 0; i < 2; i++ {
+		dev, lo := newEmulatedLoopback(t, Emulation{Loss: loss, Seed: 1})
+		pkt := []byte{0x45}
+		for j := 0; j < n; j++ {
+			dev.WriteToIPv4(pkt, IPv4{127, 0, 0, 1})
+		}
+		// exclude any packets dropped by the loopback device itself
+		dropped = append(dropped, dev.Stats().TxDropped-lo.Stats().TxDropped)
+		lo.BringDown()
+	}
+	if got := float64(dropped[0]) / n; got < loss-0.02 || got > loss+0.02 {
+		t.Errorf("unexpected fraction of packets dropped: got %v; want %v", got, loss)
+	}
+	if dropped[0] != dropped[1] {
+		t.Errorf("different numbers of packets dropped with the same seed: %v and %v", dropped[0], dropped[1])
+	}
+
+	// received packets are dropped too; few enough are sent
+	// that they don't overflow the loopback device's queue
+	const rxn = 200
+	dev, lo := newEmulatedLoopback(t, Emulation{Loss: loss, Seed: 1})
+	defer lo.BringDown()
+	arrived := make(chan struct{}, rxn)
+	dev.RegisterIPv4Callback(func(b []byte) { arrived <- struct{}{} })
+	var received int
+	for i := 0; i < rxn; i++ {
+		lo.WriteToIPv4([]byte{0x45}, IPv4{127, 0, 0, 1})
+	}
+	for received+int(dev.Stats().RxDropped) < rxn {
+		select {
+		case <-arrived:
+			received++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v of %v packets accounted for", received+int(dev.Stats().RxDropped), rxn)
+		}
+	}
+	if got := float64(dev.Stats().RxDropped) / rxn; got < loss-0.1 || got > loss+0.1 {
+		t.Errorf("unexpected fraction of received packets dropped: got %v; want %v", got, loss)
+	}
+}
+
+// A testClock is a clock which only advances when told to.
+type testClock struct {
+	t  time.Time
+	mu sync.Mutex
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestEmulatedDeviceDelay(t *testing.T) {
+	const n = 50
+	em := Emulation{Delay: 20 * time.Millisecond, Jitter: 15 * time.Millisecond, Duplicate: 0.1, Seed: 1}
+	dev, lo := newEmulatedLoopback(t, em)
+	defer lo.BringDown()
+	clock := &testClock{t: time.Now()}
+	dev.e.now = clock.now
+
+	arrived := make(chan uint32, 2*n)
+	// register directly on lo so that only sent packets are emulated
+	lo.RegisterIPv4Callback(func(b []byte) { arrived <- binary.BigEndian.Uint32(b[4:]) })
+
+	// all of the packets are written at the same emulated time, so they
+	// should arrive in the order of their delays, which are replayed
+	// using another emulator with the same seed
+	replay := newEmulator(em)
+	type expected struct {
+		idx   uint32
+		delay time.Duration
+	}
+	var want []expected
+	for i := uint32(0); i < n; i++ {
+		pkt := make([]byte, 8)
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint32(pkt[4:], i)
+		if _, err := dev.WriteToIPv4(pkt, IPv4{127, 0, 0, 1}); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		p := replay.plan(replay.txRand)
+		want = append(want, expected{i, p.delay})
+		if p.dup {
+			want = append(want, expected{i, p.delay})
+		}
+	}
+	sort.SliceStable(want, func(i, j int) bool { return want[i].delay < want[j].delay })
+
+	select {
+	case idx := <-arrived:
+		t.Fatalf("packet %v arrived before its emulated delay", idx)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.advance(time.Second)
+
+	var reordered bool
+	for i, w := range want {
+		select {
+		case idx := <-arrived:
+			if idx != w.idx {
+				t.Fatalf("unexpected packet %v: got %v; want %v", i, idx, w.idx)
+			}
+			if i > 0 && idx < want[i-1].idx {
+				reordered = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %v never arrived", w.idx)
+		}
+	}
+	if !reordered {
+		t.Errorf("jitter didn't reorder any packets")
+	}
+	if len(want) == n {
+		t.Errorf("no packets duplicated")
+	}
+}
+
+func TestEmulatedDeviceBringDown(t *testing.T) {
+	const n = 3
+	dev, lo := newEmulatedLoopback(t, Emulation{Delay: 20 * time.Millisecond})
+	clock := &testClock{t: time.Now()}
+	dev.e.now = clock.now
+	arrived := make(chan struct{}, n)
+	lo.RegisterIPv4Callback(func(b []byte) { arrived <- struct{}{} })
+	for i := 0; i < n; i++ {
+		if _, err := dev.WriteToIPv4([]byte{0x45}, IPv4{127, 0, 0, 1}); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+	if err := dev.BringDown(); err != nil {
+		t.Fatalf("could not bring device down: %v", err)
+	}
+	if got := dev.Stats().TxDropped; got != n {
+		t.Errorf("unexpected dropped packets after bringing device down: got %v; want %v", got, n)
+	}
+
+	// the delayed packets aren't passed on once the device is back up
+	if err := dev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer dev.BringDown()
+	clock.advance(time.Second)
+	select {
+	case <-arrived:
+		t.Errorf("delayed packet arrived after bringing device down")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -39,8 +39,11 @@ type EthernetInterface interface {
 	// Ethernet frames will be dropped.
 	//
 	// If the interface has its MAC set, only Ethernet frames
-	// whose destination MAC is equal to the interface's MAC or
-	// is the broadcast MAC will be returned.
+	// whose destination MAC is equal to the interface's MAC,
+	// is the broadcast MAC, is an IPv4 multicast MAC (one
+	// starting with 01:00:5e), or is an IPv6 multicast MAC
+	// (one starting with 33:33) will be returned. IPv6
+	// multicast is used by Neighbor Discovery.
 	//
 	// RegisterCallback can only be called while the interface
 	// is down.
@@ -80,17 +83,25 @@ type MAC [6]byte
 // BroadcastMAC is the broadcast MAC address.
 var BroadcastMAC = MAC{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 
+// isMulticastMAC returns true if mac is an IPv4 or IPv6 multicast MAC address,
+// which EthernetInterfaces deliver in addition to their own MAC addresses.
+func isMulticastMAC(mac MAC) bool {
+	return (mac[0] == 0x01 && mac[1] == 0x00 && mac[2] == 0x5E) || (mac[0] == 0x33 && mac[1] == 0x33)
+}
+
 // An EthernetDevice is a device which uses an EthernetInterface
 // as its underlying frame transport mechanism. It implements
 // the Device interface.
 type EthernetDevice struct {
-	iface EthernetInterface
-	up    bool
-	// arp                  *arp         // nil if the device is down
+	iface                EthernetInterface
+	up                   bool
+	arp                  *arp // nil if the device is down or has no IPv4 address
+	ndp                  *ndp // nil if the device is down or has no IPv6 address
 	addr4, netmask4      IPv4
 	addr6, netmask6      IPv6
 	addr4Set, addr6Set   bool
 	callback4, callback6 func([]byte) // unset if nil
+	stats                deviceStats
 
 	// ipv4, ipv6 chan []byte // nil if the device is down
 
@@ -138,17 +149,17 @@ func (dev *EthernetDevice) callback(b []byte, src, dst MAC, et EtherType) {
 		return
 	}
 
-	switch et {
-	case EtherTypeARP:
-		// TODO(joshlf): Implement ARP
-	case EtherTypeIPv4:
-		if dev.callback4 != nil {
-			dev.callback4(b)
-		}
-	case EtherTypeIPv6:
-		if dev.callback6 != nil {
-			dev.callback6(b)
-		}
+	dev.stats.rx(len(b))
+	switch {
+	case et == EtherTypeARP && dev.arp != nil:
+		dev.arp.HandlePacket(b)
+	case et == EtherTypeIPv4 && dev.callback4 != nil:
+		dev.callback4(b)
+	case et == EtherTypeIPv6 && dev.ndp != nil && dev.ndp.handlePacket(b):
+	case et == EtherTypeIPv6 && dev.callback6 != nil:
+		dev.callback6(b)
+	default:
+		dev.stats.rxDrop()
 	}
 }
 
@@ -214,7 +225,7 @@ func (dev *EthernetDevice) SetIPv6(addr, netmask IPv6) error {
 	if dev.isUp() {
 		return errors.New("set device IP address on up device")
 	}
-	dev.addr6, dev.netmask6, dev.addr4Set = addr, netmask, true
+	dev.addr6, dev.netmask6, dev.addr6Set = addr, netmask, true
 	return nil
 }
 
@@ -240,7 +251,14 @@ func (dev *EthernetDevice) BringUp() error {
 
 	err := dev.iface.BringUp()
 	if err != nil {
-		errors.Annotate(err, "bring device up")
+		return errors.Annotate(err, "bring device up")
+	}
+	_, mac := dev.iface.MAC()
+	if dev.addr4Set {
+		dev.arp = newARP(mac, dev.addr4, dev.writeFrame)
+	}
+	if dev.addr6Set {
+		dev.ndp = newNDP(mac, dev.addr6, func(b []byte, dst MAC) { dev.writeFrame(b, dst, EtherTypeIPv6) })
 	}
 	dev.up = true
 	return nil
@@ -248,16 +266,29 @@ func (dev *EthernetDevice) BringUp() error {
 
 // BringDown brings dev down. If it is already up, BringDown is a no-op.
 func (dev *EthernetDevice) BringDown() error {
-	dev.mu.Lock()
-	defer dev.mu.Unlock()
-	if !dev.isUp() {
+	if !dev.IsUp() {
 		return nil
 	}
 
+	// the interface may be waiting for its daemons, which may in turn be
+	// waiting to deliver a frame to dev.callback, so dev.mu must not be held
 	err := dev.iface.BringDown()
 	if err != nil {
 		return errors.Annotate(err, "bring device down")
 	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if !dev.isUp() {
+		return nil
+	}
+	if dev.arp != nil {
+		dev.arp.Stop()
+		dev.arp = nil
+	}
+	if dev.ndp != nil {
+		dev.ndp.stop()
+		dev.ndp = nil
+	}
 	dev.up = false
 	return nil
 }
@@ -282,42 +313,93 @@ func (dev *EthernetDevice) MTU() int {
 	return mtu
 }
 
+// SetMTU sets dev's maximum transmission unit. It must be at least the minimum
+// for the IP versions for which dev has addresses. SetMTU can only be called
+// when dev is down.
+func (dev *EthernetDevice) SetMTU(mtu int) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.isUp() {
+		return errors.New("set MTU on up device")
+	}
+	if err := checkMTU(mtu, true, dev.addr6Set); err != nil {
+		return err
+	}
+	return errors.Annotate(dev.iface.SetMTU(uint64(mtu)), "set MTU")
+}
+
+// Stats returns a snapshot of dev's packet counters.
+func (dev *EthernetDevice) Stats() DeviceStats { return dev.stats.snapshot() }
+
+// Capabilities returns dev's capabilities. EthernetInterfaces don't
+// offload any work, so dev has none.
+func (dev *EthernetDevice) Capabilities() DeviceCaps { return 0 }
+
+// WriteToIPv4 implements IPv4Device's WriteToIPv4. The neighbor dst's MAC
+// address is resolved using ARP; while resolution is in progress, b is
+// queued, and WriteToIPv4 returns immediately. Errors writing queued
+// packets are not reported. Broadcast packets are sent to BroadcastMAC,
+// and multicast packets to the corresponding multicast MAC address.
 func (dev *EthernetDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
 	dev.mu.RLock()
 	defer dev.mu.RUnlock()
 	if !dev.isUp() {
+		dev.stats.txDrop()
 		return 0, errors.New("write to down device")
 	}
+	if dev.arp == nil {
+		dev.stats.txDrop()
+		return 0, errors.New("write to device with no IPv4 address")
+	}
 
 	buf := make([]byte, ethernetHeaderLen+len(b))
 	copy(buf[ethernetHeaderLen:], b)
-	var mac MAC // TODO(joshlf): Look it up in ARP
-	if err != nil {
-		return 0, errors.Annotate(err, "write to device")
+	if isIPv4Broadcast(dst, dev.addr4, dev.netmask4) {
+		return dev.writeTo(buf, BroadcastMAC, EtherTypeIPv4)
+	}
+	if isIPv4Multicast(dst) {
+		return dev.writeTo(buf, ipv4MulticastMAC(dst), EtherTypeIPv4)
 	}
-	return dev.writeTo(buf, mac)
+	dev.arp.WriteTo(buf, dst)
+	return len(b), nil
 }
 
+// WriteToIPv6 implements IPv6Device's WriteToIPv6. The neighbor dst's MAC
+// address is resolved using Neighbor Discovery; while resolution is in
+// progress, b is queued, and WriteToIPv6 returns immediately. Errors
+// writing queued packets are not reported.
 func (dev *EthernetDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
 	dev.mu.RLock()
 	defer dev.mu.RUnlock()
 	if !dev.isUp() {
+		dev.stats.txDrop()
 		return 0, errors.New("write to down device")
 	}
+	if dev.ndp == nil {
+		dev.stats.txDrop()
+		return 0, errors.New("write to device with no IPv6 address")
+	}
 
 	buf := make([]byte, ethernetHeaderLen+len(b))
 	copy(buf[ethernetHeaderLen:], b)
-	var mac MAC // TODO(joshlf): Look it up
-	if err != nil {
-		return 0, errors.Annotate(err, "write to device")
-	}
-	return dev.writeTo(buf, mac)
+	dev.ndp.writeTo(buf, dst)
+	return len(b), nil
+}
+
+// writeFrame is used by dev.arp and dev.ndp to write packets
+func (dev *EthernetDevice) writeFrame(b []byte, mac MAC, et EtherType) {
+	dev.writeTo(b, mac, et)
 }
 
 // writeTo implements logic common to WriteToIPv4 and WriteToIPv6;
 // it writes to the given MAC address and returns the correct values
-func (dev *EthernetDevice) writeTo(b []byte, mac MAC) (n int, err error) {
-	n, err = dev.iface.WriteFrame(b, mac, EtherTypeIPv4)
+func (dev *EthernetDevice) writeTo(b []byte, mac MAC, et EtherType) (n int, err error) {
+	n, err = dev.iface.WriteFrame(b, mac, et)
+	if err != nil {
+		dev.stats.txDrop()
+	} else {
+		dev.stats.tx(n)
+	}
 	if n < ethernetHeaderLen {
 		n = 0
 	} else {
@@ -325,3 +407,17 @@ func (dev *EthernetDevice) writeTo(b []byte, mac MAC) (n int, err error) {
 	}
 	return n, errors.Annotate(err, "write to device")
 }
+
+// isIPv4Broadcast returns true if addr is the limited broadcast address or the
+// broadcast address of the subnet with the given address and netmask.
+func isIPv4Broadcast(addr, subnet, netmask IPv4) bool {
+	if addr == (IPv4{255, 255, 255, 255}) {
+		return true
+	}
+	for i := range addr {
+		if addr[i] != subnet[i]|^netmask[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -16,15 +16,19 @@ import (
 
 var (
 	deviceFileFlag string
+	pcapFlag       string
 
 	deviceDrivers = make(map[string]*deviceDriver)
-	devices       net.DeviceSet
 )
 
 type deviceDriver struct {
 	getDevice func(args []string) (net.Device, error)
 	// get any information relevant for printing using 'dev' command
 	getInfo func(dev net.Device) (string, error)
+	// optional; get the same information in a form which can be
+	// encoded as JSON for the --json flag (if nil, the string
+	// returned by getInfo is used)
+	getInfoStructured func(dev net.Device) (interface{}, error)
 
 	// use to initialize driver-type-specific commands
 	// (doesn't really need to be concurrency safe;
@@ -35,6 +39,7 @@ type deviceDriver struct {
 
 func init() {
 	pflag.StringVar(&deviceFileFlag, "device-file", "", "File with device definitions.")
+	pflag.StringVar(&pcapFlag, "pcap", "", "Capture all IP traffic to this pcap file.")
 	postParseFuncs = append(postParseFuncs, func() {
 		if !pflag.Lookup("device-file").Changed {
 			fmt.Fprintln(os.Stderr, "Missing required flag --device-file")
@@ -51,6 +56,19 @@ func init() {
 			fmt.Fprintln(os.Stderr, "could not parse device file:", err)
 			os.Exit(2)
 		}
+		var pw *net.PcapWriter
+		if pcapFlag != "" {
+			pcapfile, err := os.Create(pcapFlag)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "could not create pcap file:", err)
+				os.Exit(2)
+			}
+			pw, err = net.NewPcapWriter(pcapfile, net.LinkTypeRaw)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "could not write pcap file:", err)
+				os.Exit(2)
+			}
+		}
 		for _, pair := range pairs {
 			typ, name, err := parseDevName(pair[0])
 			if err != nil {
@@ -68,22 +86,42 @@ func init() {
 				fmt.Fprintf(os.Stderr, "could not initialize device %v: %v\n", name, err)
 				os.Exit(1)
 			}
+			if pw != nil {
+				dev = net.NewPcapDevice(dev, pw)
+			}
 			err = dev.BringUp()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "could not bring up device %v: %v\n", name, err)
 				os.Exit(1)
 			}
-			devices.Put(name, dev)
-			if dev4, ok := dev.(net.IPv4Device); ok {
-				host.IPv4Host.AddIPv4Device(dev4)
-			}
-			if dev6, ok := dev.(net.IPv6Device); ok {
-				host.IPv6Host.AddIPv6Device(dev6)
+			err = host.AddDevice(name, dev)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not add device %v: %v\n", name, err)
+				os.Exit(1)
 			}
 		}
 	})
 }
 
+// unwrapDevice returns the device wrapped by dev if dev is a wrapper, such
+// as a device returned by net.NewPcapDevice, and dev otherwise. Drivers'
+// getInfo functions expect the unwrapped device.
+func unwrapDevice(dev net.Device) net.Device {
+	if w, ok := dev.(interface{ Unwrap() net.Device }); ok {
+		return w.Unwrap()
+	}
+	return dev
+}
+
+// deviceInfoStructured returns driver's structured info about dev,
+// falling back to the string returned by getInfo.
+func deviceInfoStructured(driver *deviceDriver, dev net.Device) (interface{}, error) {
+	if driver.getInfoStructured != nil {
+		return driver.getInfoStructured(dev)
+	}
+	return driver.getInfo(dev)
+}
+
 // typ is the type part of the name; name is the full name
 func parseDevName(str string) (typ, name string, err error) {
 	parts := strings.Split(str, ":")
@@ -103,27 +141,49 @@ var cmdDev = cli.Command{
 			c.PrintUsage()
 			return
 		}
-		names := devices.ListNames()
+		names := host.DeviceNames()
 		sort.Strings(names)
+		if jsonFlag {
+			devs := []deviceJSON{}
+			for _, name := range names {
+				dev, _ := host.Device(name)
+				typ, _, _ := parseDevName(name)
+				info, err := deviceInfoStructured(deviceDrivers[typ], unwrapDevice(dev))
+				if err != nil {
+					fmt.Printf("get info for %v: %v\n", name, err)
+				}
+				devs = append(devs, deviceJSON{Name: name, Driver: typ, MTU: dev.MTU(), Up: dev.IsUp(), Info: info})
+			}
+			printJSON(devs)
+			return
+		}
 		fmt.Println("Devices")
 		// TODO(joshlf): Print device's IP addres/subnet
-		fmt.Println("Name      MTU       Up     Driver-Specific")
-		fmt.Println("==========================================")
 		const maxlen = 10
 		const maxuplen = 7 // "down" plus a trailing three spaces
+		// names like "unixgram:0" don't fit in the default width
+		namelen := maxlen
+		for _, name := range names {
+			if len(name)+2 > namelen {
+				namelen = len(name) + 2
+			}
+		}
+		header := fmt.Sprintf("%-*v%-*v%-*v%v", namelen, "Name", maxlen, "MTU", maxuplen, "Up", "Driver-Specific")
+		fmt.Println(header)
+		fmt.Println(strings.Repeat("=", len(header)))
 		for _, name := range names {
-			dev, _ := devices.Get(name)
+			dev, _ := host.Device(name)
 			mtu := fmt.Sprint(dev.MTU())
 			up := "up"
 			if !dev.IsUp() {
 				up = "down"
 			}
 			typ, _, _ := parseDevName(name)
-			info, err := deviceDrivers[typ].getInfo(dev)
+			info, err := deviceDrivers[typ].getInfo(unwrapDevice(dev))
 			if err != nil {
 				fmt.Printf("get info for %v: %v\n", name, err)
 			}
-			fmt.Printf("%v%v%v%v\n", name+strings.Repeat(" ", maxlen-len(name)),
+			fmt.Printf("%v%v%v%v\n", name+strings.Repeat(" ", namelen-len(name)),
 				mtu+strings.Repeat(" ", maxlen-len(mtu)),
 				up+strings.Repeat(" ", maxuplen-len(up)), info)
 		}
@@ -142,7 +202,7 @@ var cmdDevUp = cli.Command{
 			return
 		}
 		name := args[0]
-		dev, ok := devices.Get(name)
+		dev, ok := host.Device(name)
 		if !ok {
 			fmt.Println("no such device")
 			return
@@ -166,7 +226,7 @@ var cmdDevDown = cli.Command{
 			return
 		}
 		name := args[0]
-		dev, ok := devices.Get(name)
+		dev, ok := host.Device(name)
 		if !ok {
 			fmt.Println("no such device")
 			return
@@ -178,8 +238,43 @@ var cmdDevDown = cli.Command{
 	},
 }
 
+var cmdDevStats = cli.Command{
+	Name:             "stats",
+	Usage:            "<device>",
+	ShortDescription: "Print a device's packet counters",
+	LongDescription:  "Print a device's packet counters.",
+
+	Run: func(c *cli.Command, args []string) {
+		if len(args) != 1 {
+			c.PrintUsage()
+			return
+		}
+		name := args[0]
+		dev, ok := host.Device(name)
+		if !ok {
+			fmt.Println("no such device")
+			return
+		}
+		stats := dev.Stats()
+		if jsonFlag {
+			printJSON(deviceStatsJSON{
+				RxPackets: stats.RxPackets, RxBytes: stats.RxBytes,
+				RxDropped: stats.RxDropped, RxErrors: stats.RxErrors,
+				TxPackets: stats.TxPackets, TxBytes: stats.TxBytes,
+				TxDropped: stats.TxDropped,
+			})
+			return
+		}
+		fmt.Printf("RX packets %v bytes %v dropped %v errors %v\n",
+			stats.RxPackets, stats.RxBytes, stats.RxDropped, stats.RxErrors)
+		fmt.Printf("TX packets %v bytes %v dropped %v\n",
+			stats.TxPackets, stats.TxBytes, stats.TxDropped)
+	},
+}
+
 func init() {
 	topLevelCommands = append(topLevelCommands, &cmdDev)
 	cmdDev.AddSubcommand(&cmdDevUp)
 	cmdDev.AddSubcommand(&cmdDevDown)
+	cmdDev.AddSubcommand(&cmdDevStats)
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	gonet "net"
 	"strconv"
+	"strings"
 
 	"github.com/joshlf/net"
 	"github.com/joshlf/net/internal/errors"
@@ -42,6 +43,10 @@ var udpIPv4Driver = deviceDriver{
 		laddr, raddr := udpdev.UDPAddrs()
 		return fmt.Sprintf("%v -> %v", laddr, raddr), nil
 	},
+	getInfoStructured: func(dev net.Device) (interface{}, error) {
+		laddr, raddr := dev.(*net.UDPIPv4Device).UDPAddrs()
+		return udpDeviceInfo{LocalAddr: laddr.String(), RemoteAddr: raddr.String()}, nil
+	},
 	init: func() {},
 }
 
@@ -78,10 +83,106 @@ var udpIPv6Driver = deviceDriver{
 		laddr, raddr := udpdev.UDPAddrs()
 		return fmt.Sprintf("%v -> %v", laddr, raddr), nil
 	},
+	getInfoStructured: func(dev net.Device) (interface{}, error) {
+		laddr, raddr := dev.(*net.UDPIPv6Device).UDPAddrs()
+		return udpDeviceInfo{LocalAddr: laddr.String(), RemoteAddr: raddr.String()}, nil
+	},
+	init: func() {},
+}
+
+// a loopback device definition is at most one IPv4 address and
+// at most one IPv6 address followed by an MTU
+var loopbackDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) < 2 || len(args) > 3 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		mtu, err := strconv.Atoi(args[len(args)-1])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition: parse MTU")
+		}
+		dev, err := net.NewLoopbackDevice(mtu)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		err = setDeviceAddrs(dev, args[:len(args)-1])
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		return "loopback", nil
+	},
 	init: func() {},
 }
 
+// a unixgram device definition is at most one IPv4 address and at most
+// one IPv6 address followed by local and remote socket paths and an MTU
+var unixgramDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) < 4 || len(args) > 5 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		n := len(args)
+		mtu, err := strconv.Atoi(args[n-1])
+		if err != nil {
+			return nil, errors.Annotate(err, "parse device definition: parse MTU")
+		}
+		dev, err := net.NewUnixgramDevice(args[n-3], args[n-2], mtu)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		err = setDeviceAddrs(dev, args[:n-3])
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		laddr, raddr := dev.(*net.UnixgramDevice).UnixAddrs()
+		return fmt.Sprintf("%v -> %v", laddr, raddr), nil
+	},
+	getInfoStructured: func(dev net.Device) (interface{}, error) {
+		laddr, raddr := dev.(*net.UnixgramDevice).UnixAddrs()
+		return udpDeviceInfo{LocalAddr: laddr.String(), RemoteAddr: raddr.String()}, nil
+	},
+	init: func() {},
+}
+
+// setDeviceAddrs parses addrs, which must contain at most one IPv4 and at
+// most one IPv6 address in CIDR notation, and sets them on dev.
+func setDeviceAddrs(dev net.Device, addrs []string) error {
+	var set4, set6 bool
+	for _, arg := range addrs {
+		if strings.Contains(arg, ":") {
+			addr, subnet, err := net.ParseCIDRIPv6(arg)
+			if err != nil {
+				return errors.Annotate(err, "parse device address")
+			}
+			dev6, ok := dev.(net.IPv6Device)
+			if !ok || set6 {
+				return errors.New("parse device address: unexpected IPv6 address")
+			}
+			set6 = true
+			if err = dev6.SetIPv6(addr, subnet.Netmask); err != nil {
+				return err
+			}
+		} else {
+			addr, subnet, err := net.ParseCIDRIPv4(arg)
+			if err != nil {
+				return errors.Annotate(err, "parse device address")
+			}
+			dev4, ok := dev.(net.IPv4Device)
+			if !ok || set4 {
+				return errors.New("parse device address: unexpected IPv4 address")
+			}
+			set4 = true
+			if err = dev4.SetIPv4(addr, subnet.Netmask); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func init() {
 	deviceDrivers["udp4"] = &udpIPv4Driver
 	deviceDrivers["udp6"] = &udpIPv6Driver
+	deviceDrivers["lo"] = &loopbackDriver
+	deviceDrivers["unixgram"] = &unixgramDriver
 }
@@ -0,0 +1,77 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	gonet "net"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/errors"
+)
+
+// a TUN device definition is at most one IPv4 address and
+// at most one IPv6 address followed by an interface name
+var tunDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) < 2 || len(args) > 3 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		dev, err := net.NewTUNDevice(args[len(args)-1])
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		err = setDeviceAddrs(dev, args[:len(args)-1])
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		return dev.(*net.TUNDevice).Name(), nil
+	},
+	getInfoStructured: func(dev net.Device) (interface{}, error) {
+		return struct {
+			Name string `json:"name"`
+		}{dev.(*net.TUNDevice).Name()}, nil
+	},
+	init: func() {},
+}
+
+// a raw device definition is at most one IPv4 address and at most
+// one IPv6 address followed by an interface name and a MAC address
+var rawDriver = deviceDriver{
+	getDevice: func(args []string) (net.Device, error) {
+		if len(args) < 3 || len(args) > 4 {
+			return nil, errors.Errorf("parse device definition: unexpected number of whitespace-separated fields: %v", len(args))
+		}
+		hw, err := gonet.ParseMAC(args[len(args)-1])
+		if err != nil || len(hw) != len(net.MAC{}) {
+			return nil, errors.Errorf("parse device definition: invalid MAC address: %v", args[len(args)-1])
+		}
+		var mac net.MAC
+		copy(mac[:], hw)
+		dev, err := net.NewRawSocketDevice(args[len(args)-2], mac)
+		if err != nil {
+			return nil, errors.Annotate(err, "create device from definition")
+		}
+		err = setDeviceAddrs(dev, args[:len(args)-2])
+		return dev, errors.Annotate(err, "create device from definition")
+	},
+	getInfo: func(dev net.Device) (string, error) {
+		rawdev := dev.(*net.RawSocketDevice)
+		mac := rawdev.MAC()
+		return fmt.Sprintf("%v (%v)", rawdev.Name(), gonet.HardwareAddr(mac[:])), nil
+	},
+	getInfoStructured: func(dev net.Device) (interface{}, error) {
+		rawdev := dev.(*net.RawSocketDevice)
+		mac := rawdev.MAC()
+		return struct {
+			Name string `json:"name"`
+			MAC  string `json:"mac"`
+		}{rawdev.Name(), gonet.HardwareAddr(mac[:]).String()}, nil
+	},
+	init: func() {},
+}
+
+func init() {
+	deviceDrivers["tun"] = &tunDriver
+	deviceDrivers["raw"] = &rawDriver
+}
@@ -16,10 +16,7 @@ var (
 	routeFileFlag  string
 	forwardingFlag bool
 
-	host = net.IPHost{
-		IPv4Host: net.NewIPv4Host(),
-		IPv6Host: net.NewIPv6Host(),
-	}
+	host = net.NewStack(net.StackOptions{})
 )
 
 func init() {
@@ -48,7 +45,7 @@ func init() {
 			case internal.RouteEntry:
 				host.AddRoute(route.Subnet, route.Nexthop)
 			case internal.RouteDeviceEntry:
-				dev, ok := devices.Get(route.Device)
+				dev, ok := host.Device(route.Device)
 				if !ok {
 					fmt.Fprintln(os.Stderr, "no such device:", route.Device)
 					os.Exit(2)
@@ -189,6 +186,25 @@ var cmdIPRoute = cli.Command{
 		ipv4DevRoutes := host.IPv4Host.IPv4DeviceRoutes()
 		ipv6Routes := host.IPv6Host.IPv6Routes()
 		ipv6DevRoutes := host.IPv6Host.IPv6DeviceRoutes()
+		if jsonFlag {
+			routes := routesJSON{IPv4: []routeJSON{}, IPv6: []routeJSON{}}
+			for _, r := range ipv4Routes {
+				routes.IPv4 = append(routes.IPv4, routeJSON{Addr: fmt.Sprint(r.Subnet.Addr), Netmask: fmt.Sprint(r.Subnet.Netmask), Nexthop: fmt.Sprint(r.Nexthop)})
+			}
+			for _, r := range ipv4DevRoutes {
+				name, _ := host.DeviceName(r.Device)
+				routes.IPv4 = append(routes.IPv4, routeJSON{Addr: fmt.Sprint(r.Subnet.Addr), Netmask: fmt.Sprint(r.Subnet.Netmask), Device: name})
+			}
+			for _, r := range ipv6Routes {
+				routes.IPv6 = append(routes.IPv6, routeJSON{Addr: fmt.Sprint(r.Subnet.Addr), Netmask: fmt.Sprint(r.Subnet.Netmask), Nexthop: fmt.Sprint(r.Nexthop)})
+			}
+			for _, r := range ipv6DevRoutes {
+				name, _ := host.DeviceName(r.Device)
+				routes.IPv6 = append(routes.IPv6, routeJSON{Addr: fmt.Sprint(r.Subnet.Addr), Netmask: fmt.Sprint(r.Subnet.Netmask), Device: name})
+			}
+			printJSON(routes)
+			return
+		}
 		fmt.Println("IPv4 Routes")
 		printIPv4Routes(ipv4Routes, ipv4DevRoutes)
 		fmt.Println("IPv6 Routes")
@@ -197,7 +213,7 @@ var cmdIPRoute = cli.Command{
 			fmt.Printf("%v %v %v\n", r.Subnet.Addr, r.Subnet.Netmask, r.Nexthop)
 		}
 		for _, r := range ipv6DevRoutes {
-			name, ok := devices.GetName(r.Device)
+			name, ok := host.DeviceName(r.Device)
 			if !ok {
 				panic(fmt.Errorf("unexpected internal error: could not get name for device %v", r.Device))
 			}
@@ -225,7 +241,7 @@ func printIPv4Routes(routes []net.IPv4Route, devroutes []net.IPv4DeviceRoute) {
 		addr += strings.Repeat(" ", maxlen-len(addr))
 		netmask := fmt.Sprint(r.Subnet.Netmask)
 		netmask += strings.Repeat(" ", maxlen-len(netmask))
-		name, ok := devices.GetName(r.Device)
+		name, ok := host.DeviceName(r.Device)
 		if !ok {
 			panic(fmt.Errorf("unexpected internal error: could not get name for device %v", r.Device))
 		}
@@ -233,52 +249,6 @@ func printIPv4Routes(routes []net.IPv4Route, devroutes []net.IPv4DeviceRoute) {
 	}
 }
 
-// sortableRoutes sorts routes by subnet; normal and device routes
-// may be mixed, but IPv4 and IPv6 routes may not be mixed
-type sortableRoutes []interface{}
-
-func (s sortableRoutes) Len() int      { return len(s) }
-func (s sortableRoutes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s sortableRoutes) Less(i, j int) bool {
-	si, sj := s[i], s[j]
-	_, ok4Route := si.(net.IPv4Route)
-	_, ok4DevRoute := si.(net.IPv4DeviceRoute)
-	if ok4Route || ok4DevRoute {
-		var subneti, subnetj net.IPv4Subnet
-		switch si := si.(type) {
-		case net.IPv4Route:
-			subneti = si.Subnet
-		case net.IPv4DeviceRoute:
-			subneti = si.Subnet
-		}
-		switch sj := sj.(type) {
-		case net.IPv4Route:
-			subnetj = sj.Subnet
-		case net.IPv4DeviceRoute:
-			subnetj = sj.Subnet
-		}
-		// TODO(joshlf): Compare them
-		_, _ = subneti, subnetj
-	} else {
-		var subneti, subnetj net.IPv6Subnet
-		switch si := si.(type) {
-		case net.IPv6Route:
-			subneti = si.Subnet
-		case net.IPv6DeviceRoute:
-			subneti = si.Subnet
-		}
-		switch sj := sj.(type) {
-		case net.IPv6Route:
-			subnetj = sj.Subnet
-		case net.IPv6DeviceRoute:
-			subnetj = sj.Subnet
-		}
-		// TODO(joshlf): Compare them
-		_, _ = subneti, subnetj
-	}
-	panic("not implemented")
-}
-
 var cmdIPRouteAdd = cli.Command{
 	Name:             "add",
 	Usage:            "<network-cidr> <nexthop>",
@@ -302,7 +272,7 @@ an address or a device name.`,
 		var nexthopDev net.Device
 		if err != nil {
 			var ok bool
-			nexthopDev, ok = devices.Get(args[1])
+			nexthopDev, ok = host.Device(args[1])
 			if !ok {
 				fmt.Println("nexthop is neither IP address nor device name")
 				return
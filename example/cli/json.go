@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+var jsonFlag bool
+
+func init() {
+	pflag.BoolVar(&jsonFlag, "json", false, "Print device info, stats, and routes as JSON.")
+}
+
+// printJSON prints v as JSON on a single line.
+func printJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Errorf("unexpected internal error: could not encode JSON: %v", err))
+	}
+	fmt.Println(string(b))
+}
+
+type deviceJSON struct {
+	Name   string      `json:"name"`
+	Driver string      `json:"driver"`
+	MTU    int         `json:"mtu"`
+	Up     bool        `json:"up"`
+	Info   interface{} `json:"info"`
+}
+
+type deviceStatsJSON struct {
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxDropped uint64 `json:"rx_dropped"`
+	RxErrors  uint64 `json:"rx_errors"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxDropped uint64 `json:"tx_dropped"`
+}
+
+// a route has either a next hop or a device
+type routeJSON struct {
+	Addr    string `json:"addr"`
+	Netmask string `json:"netmask"`
+	Nexthop string `json:"nexthop,omitempty"`
+	Device  string `json:"device,omitempty"`
+}
+
+type routesJSON struct {
+	IPv4 []routeJSON `json:"ipv4"`
+	IPv6 []routeJSON `json:"ipv6"`
+}
+
+// udpDeviceInfo is the structured info of udp4, udp6, and unixgram devices.
+type udpDeviceInfo struct {
+	LocalAddr  string `json:"local_addr"`
+	RemoteAddr string `json:"remote_addr"`
+}
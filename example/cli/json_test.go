@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJSONOutput(t *testing.T) {
+	dir := t.TempDir()
+	bin := buildCLI(t, dir)
+	lport, rport := freeUDPPort(t), freeUDPPort(t)
+	p := startCLI(t, bin, dir, "A", "10.0.0.1/8", lport, rport, "--json")
+	defer p.cmd.Process.Kill()
+	io.WriteString(p.stdin, "dev\ndev stats udp4:0\nip route\n")
+	p.stdin.Close()
+	if err := p.cmd.Wait(); err != nil {
+		t.Fatalf("CLI exited with error: %v; output:\n%v", err, p.output())
+	}
+
+	// each command's output is a single line following a prompt
+	var lines []string
+	for _, line := range strings.Split(p.output(), "\n") {
+		if line = strings.TrimPrefix(line, "> "); line != "" && line != ">" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 3 {
+		t.Fatalf("unexpected output: got %v lines; want 3:\n%v", len(lines), p.output())
+	}
+
+	var devs []struct {
+		Name   string `json:"name"`
+		Driver string `json:"driver"`
+		MTU    int    `json:"mtu"`
+		Up     bool   `json:"up"`
+		Info   struct {
+			LocalAddr  string `json:"local_addr"`
+			RemoteAddr string `json:"remote_addr"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &devs); err != nil {
+		t.Fatalf("could not unmarshal devices %q: %v", lines[0], err)
+	}
+	if len(devs) != 1 {
+		t.Fatalf("unexpected devices: %+v", devs)
+	}
+	dev := devs[0]
+	if dev.Name != "udp4:0" || dev.Driver != "udp4" || dev.MTU != 1500 || !dev.Up ||
+		!strings.HasSuffix(dev.Info.LocalAddr, ":"+strconv.Itoa(lport)) || !strings.HasSuffix(dev.Info.RemoteAddr, ":"+strconv.Itoa(rport)) {
+		t.Errorf("unexpected device: %+v", dev)
+	}
+
+	var stats map[string]uint64
+	if err := json.Unmarshal([]byte(lines[1]), &stats); err != nil {
+		t.Fatalf("could not unmarshal stats %q: %v", lines[1], err)
+	}
+	for _, k := range []string{"rx_packets", "rx_bytes", "rx_dropped", "rx_errors", "tx_packets", "tx_bytes", "tx_dropped"} {
+		if _, ok := stats[k]; !ok {
+			t.Errorf("missing stat %v in %q", k, lines[1])
+		}
+	}
+
+	var routes struct {
+		IPv4 []map[string]string `json:"ipv4"`
+		IPv6 []map[string]string `json:"ipv6"`
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &routes); err != nil {
+		t.Fatalf("could not unmarshal routes %q: %v", lines[2], err)
+	}
+	want := map[string]string{"addr": "10.0.0.0", "netmask": "255.0.0.0", "device": "udp4:0"}
+	found := false
+	for _, r := range routes.IPv4 {
+		if r["addr"] == want["addr"] && r["netmask"] == want["netmask"] && r["device"] == want["device"] {
+			found = true
+		}
+	}
+	if !found || len(routes.IPv6) != 0 {
+		t.Errorf("unexpected routes: %+v; want an IPv4 route %v", routes, want)
+	}
+}
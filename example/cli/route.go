@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	gonet "net"
+	"sort"
+	"strings"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/example/internal/cli"
+	"github.com/joshlf/net/internal/errors"
+)
+
+// a routeEntry is a route of either IP version; exactly
+// one of nexthop and dev is set
+type routeEntry struct {
+	subnet  net.IPSubnet
+	nexthop net.IP
+	dev     net.Device
+}
+
+// prefixLen returns the length of the route's network prefix.
+func (r routeEntry) prefixLen() int {
+	var mask []byte
+	switch sub := r.subnet.(type) {
+	case net.IPv4Subnet:
+		mask = sub.Netmask[:]
+	case net.IPv6Subnet:
+		mask = sub.Netmask[:]
+	}
+	ones, _ := gonet.IPMask(mask).Size()
+	return ones
+}
+
+func (r routeEntry) String() string {
+	return fmt.Sprintf("%v/%v", r.subnet.Network(), r.prefixLen())
+}
+
+// allRoutes returns the routes of both IP versions, IPv4 first, each sorted
+// from the longest prefix to the shortest (the order in which they match).
+func allRoutes() []routeEntry {
+	var v4, v6 []routeEntry
+	for _, r := range host.IPv4Host.IPv4Routes() {
+		v4 = append(v4, routeEntry{subnet: r.Subnet, nexthop: r.Nexthop})
+	}
+	for _, r := range host.IPv4Host.IPv4DeviceRoutes() {
+		v4 = append(v4, routeEntry{subnet: r.Subnet, dev: r.Device})
+	}
+	for _, r := range host.IPv6Host.IPv6Routes() {
+		v6 = append(v6, routeEntry{subnet: r.Subnet, nexthop: r.Nexthop})
+	}
+	for _, r := range host.IPv6Host.IPv6DeviceRoutes() {
+		v6 = append(v6, routeEntry{subnet: r.Subnet, dev: r.Device})
+	}
+	for _, routes := range [][]routeEntry{v4, v6} {
+		sort.SliceStable(routes, func(i, j int) bool {
+			if li, lj := routes[i].prefixLen(), routes[j].prefixLen(); li != lj {
+				return li > lj
+			}
+			return routes[i].String() < routes[j].String()
+		})
+	}
+	return append(v4, v6...)
+}
+
+// routeDevice returns the device through which r's packets are sent: its
+// device if it is a device route, or otherwise the device of the most
+// specific device route to its next hop.
+func routeDevice(routes []routeEntry, r routeEntry) (net.Device, bool) {
+	if r.dev != nil {
+		return r.dev, true
+	}
+	// routes are sorted from the longest prefix to the shortest
+	for _, other := range routes {
+		if other.dev != nil && other.subnet.Contains(r.nexthop) {
+			return other.dev, true
+		}
+	}
+	return nil, false
+}
+
+// parsePrefix parses a network prefix in CIDR notation.
+func parsePrefix(s string) (net.IPSubnet, error) {
+	if strings.Contains(s, ":") {
+		_, subnet, err := net.ParseCIDRIPv6(s)
+		return subnet, errors.Annotate(err, "parse prefix")
+	}
+	_, subnet, err := net.ParseCIDRIPv4(s)
+	return subnet, errors.Annotate(err, "parse prefix")
+}
+
+var cmdRoute = cli.Command{
+	Name:             "route",
+	ShortDescription: "View and manipulate the routing table",
+	LongDescription:  "View and manipulate the routing table.",
+}
+
+var cmdRouteList = cli.Command{
+	Name:             "list",
+	ShortDescription: "List routes",
+	LongDescription: `List the routes in the routing table, IPv4 first, each from the
+longest prefix to the shortest. Each route is shown with the device
+through which matching packets are sent; for routes through a next
+hop, that is the device of the most specific route to the next hop.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 0 {
+			cmd.PrintUsage()
+			return
+		}
+		routes := allRoutes()
+		if jsonFlag {
+			out := []routeJSON{}
+			for _, r := range routes {
+				rj := routeJSON{Addr: fmt.Sprint(r.subnet.Network()), Netmask: netmaskString(r.subnet), Device: routeDeviceName(routes, r)}
+				if r.nexthop != nil {
+					rj.Nexthop = fmt.Sprint(r.nexthop)
+				}
+				out = append(out, rj)
+			}
+			printJSON(out)
+			return
+		}
+
+		const prefixlen = len("0000:0000:0000:0000:0000:0000:0000:0000/128")
+		fmt.Printf("%-*v   %-*v   %v\n", prefixlen, "Prefix", prefixlen, "Next Hop", "Device")
+		for _, r := range routes {
+			nexthop := "-"
+			if r.nexthop != nil {
+				nexthop = fmt.Sprint(r.nexthop)
+			}
+			fmt.Printf("%-*v   %-*v   %v\n", prefixlen, r, prefixlen, nexthop, routeDeviceName(routes, r))
+		}
+	},
+}
+
+// routeDeviceName returns the name of the device through which r's
+// packets are sent, or "?" if its next hop is unreachable.
+func routeDeviceName(routes []routeEntry, r routeEntry) string {
+	dev, ok := routeDevice(routes, r)
+	if !ok {
+		return "?"
+	}
+	name, ok := host.DeviceName(dev)
+	if !ok {
+		panic(fmt.Errorf("unexpected internal error: could not get name for device %v", dev))
+	}
+	return name
+}
+
+// netmaskString returns subnet's netmask in dotted (IPv4)
+// or colon-separated (IPv6) form.
+func netmaskString(subnet net.IPSubnet) string {
+	switch sub := subnet.(type) {
+	case net.IPv4Subnet:
+		return fmt.Sprint(sub.Netmask)
+	case net.IPv6Subnet:
+		return fmt.Sprint(sub.Netmask)
+	}
+	panic("unreachable")
+}
+
+var cmdRouteAdd = cli.Command{
+	Name:             "add",
+	Usage:            "<prefix> (<nexthop> [<device>] | <device>)",
+	ShortDescription: "Add a route",
+	LongDescription: `Add a route for the given prefix, which is in CIDR notation, either
+through a next hop address or directly through a device. If both a
+next hop and a device are given, the next hop must be reachable
+through the device.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 2 && len(args) != 3 {
+			cmd.PrintUsage()
+			return
+		}
+		subnet, err := parsePrefix(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if err := addRoute(subnet, args[1], args[2:]); err != nil {
+			fmt.Println(err)
+		}
+	},
+}
+
+// addRoute adds a route to subnet through nexthop, which is either an address
+// or (if dev is empty) a device name. If dev has an element, it is the name
+// of the device through which nexthop must be reachable.
+func addRoute(subnet net.IPSubnet, nexthop string, dev []string) error {
+	addr, err := net.ParseIP(nexthop)
+	if err != nil {
+		if len(dev) > 0 {
+			return errors.Annotate(err, "parse next hop")
+		}
+		d, ok := host.Device(nexthop)
+		if !ok {
+			return errors.Errorf("add route: next hop is neither an IP address nor a device name: %v", nexthop)
+		}
+		return errors.Annotate(host.AddDeviceRoute(subnet, d), "add route")
+	}
+	if addr.IPVersion() != subnet.IPVersion() {
+		return errors.Errorf("add route: next hop %v is not of the prefix's IP version", addr)
+	}
+	if len(dev) > 0 {
+		d, ok := host.Device(dev[0])
+		if !ok {
+			return errors.Errorf("add route: no such device: %v", dev[0])
+		}
+		if via, ok := routeDevice(allRoutes(), routeEntry{subnet: subnet, nexthop: addr}); !ok || via != d {
+			return errors.Errorf("add route: next hop %v is not reachable through %v", addr, dev[0])
+		}
+	}
+	return errors.Annotate(host.AddRoute(subnet, addr), "add route")
+}
+
+var cmdRouteDel = cli.Command{
+	Name:             "del",
+	Usage:            "<prefix>",
+	ShortDescription: "Delete a route",
+	LongDescription:  "Delete the route for the given prefix, which is in CIDR notation.",
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 1 {
+			cmd.PrintUsage()
+			return
+		}
+		subnet, err := parsePrefix(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, r := range allRoutes() {
+			if net.SubnetEqual(r.subnet, subnet) {
+				host.DeleteRoute(subnet)
+				return
+			}
+		}
+		fmt.Println("no such route:", args[0])
+	},
+}
+
+func init() {
+	topLevelCommands = append(topLevelCommands, &cmdRoute)
+	cmdRoute.AddSubcommand(&cmdRouteList)
+	cmdRoute.AddSubcommand(&cmdRouteAdd)
+	cmdRoute.AddSubcommand(&cmdRouteDel)
+}
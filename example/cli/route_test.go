@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRouteCommands(t *testing.T) {
+	dir := t.TempDir()
+	bin := buildCLI(t, dir)
+	p := startCLI(t, bin, dir, "A", "10.0.0.1/8", freeUDPPort(t), freeUDPPort(t))
+	defer p.cmd.Process.Kill()
+	io.WriteString(p.stdin, strings.Join([]string{
+		// overlapping routes, added in order of increasing prefix length
+		"route add 10.1.0.0/16 10.0.0.5",
+		"route add 10.1.2.0/24 10.0.0.6 udp4:0",
+		"route add 10.2.0.0/16 10.0.0.7 nosuchdev",
+		"route add 10.2.0.0/33 10.0.0.7",
+		"route list",
+		"route del 10.1.0.0/16",
+		"route list",
+	}, "\n")+"\n")
+	p.stdin.Close()
+	if err := p.cmd.Wait(); err != nil {
+		t.Fatalf("CLI exited with error: %v; output:\n%v", err, p.output())
+	}
+	out := p.output()
+	for _, want := range []string{"no such device: nosuchdev", "parse prefix"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing error %q in output:\n%v", want, out)
+		}
+	}
+
+	// each listing starts with a header
+	listings := strings.Split(out, "Prefix")[1:]
+	if len(listings) != 2 {
+		t.Fatalf("unexpected number of route listings: got %v; want 2; output:\n%v", len(listings), out)
+	}
+	var prefixes []string
+	for _, line := range strings.Split(listings[0], "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			break
+		}
+		prefixes = append(prefixes, fields[0])
+		if fields[2] != "udp4:0" {
+			t.Errorf("unexpected device for route to %v: got %v; want udp4:0", fields[0], fields[2])
+		}
+	}
+	want := []string{"10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8"}
+	if strings.Join(prefixes, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected routes: got %v; want %v", prefixes, want)
+	}
+	if strings.Contains(listings[1], "10.1.0.0/16") || !strings.Contains(listings[1], "10.1.2.0/24") {
+		t.Errorf("unexpected routes after deleting 10.1.0.0/16:%v", listings[1])
+	}
+}
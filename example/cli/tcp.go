@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joshlf/net/example/internal/cli"
+	"github.com/joshlf/net/tcp"
+)
+
+const tcpDialTimeout = 10 * time.Second
+
+var tcpHost *tcp.Host
+
+func init() {
+	var err error
+	tcpHost, err = tcp.NewHost(&host.IPHost)
+	if err != nil {
+		panic(fmt.Errorf("unexpected internal error: could not create TCP host: %v", err))
+	}
+}
+
+var cmdTCP = cli.Command{
+	Name:             "tcp",
+	ShortDescription: "TCP-related commands",
+	LongDescription:  "TCP-related commands.",
+}
+
+var cmdTCPConnect = cli.Command{
+	Name:             "connect",
+	Usage:            "<address>:<port>",
+	ShortDescription: "Open a TCP connection and pump stdin/stdout across it",
+	LongDescription: `Open a TCP connection to the given address and port, such as
+10.0.0.1:80 or [fe80::1]:80. Once it is established, the rest of
+standard input is sent over the connection, and anything received
+is written to standard output. When standard input is closed, the
+sending side of the connection is closed, and the command returns
+once the other side closes its side as well.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 1 {
+			cmd.PrintUsage()
+			return
+		}
+		conn, err := tcpHost.DialTimeout("tcp", args[0], tcpDialTimeout)
+		if err != nil {
+			fmt.Println("could not connect:", err)
+			return
+		}
+		fmt.Println("connected to", conn.RemoteAddr())
+		pumpTCP(conn.(*tcp.NetConn).Conn)
+	},
+}
+
+var cmdTCPListen = cli.Command{
+	Name:             "listen",
+	Usage:            "<port>",
+	ShortDescription: "Accept a TCP connection and pump stdin/stdout across it",
+	LongDescription: `Listen on the given port on all addresses, and accept a single
+connection. Once it is established, the rest of standard input is
+sent over the connection, and anything received is written to
+standard output, as with 'tcp connect'.`,
+
+	Run: func(cmd *cli.Command, args []string) {
+		if len(args) != 1 {
+			cmd.PrintUsage()
+			return
+		}
+		port, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			fmt.Println("could not parse port:", err)
+			return
+		}
+		l, err := tcpHost.ListenDualStack(tcp.Port(port), 0, false)
+		if err != nil {
+			fmt.Println("could not listen:", err)
+			return
+		}
+		fmt.Println("listening on port", port)
+		conn, err := l.AcceptTCP()
+		l.Close()
+		if err != nil {
+			fmt.Println("could not accept:", err)
+			return
+		}
+		fmt.Println("accepted connection from", tcp.NewNetConn(conn).RemoteAddr())
+		pumpTCP(conn)
+	},
+}
+
+// pumpTCP sends the rest of cli.Stdin over conn while copying anything
+// received on conn to os.Stdout, like netcat. Once cli.Stdin is exhausted,
+// it closes the sending side of conn, waits for the other side to do the
+// same, and closes conn.
+func pumpTCP(conn *tcp.Conn) {
+	done := make(chan struct{})
+	go func() {
+		if _, err := io.Copy(os.Stdout, conn); err != nil {
+			fmt.Println("receive:", err)
+		}
+		close(done)
+	}()
+	if _, err := io.Copy(conn, cli.Stdin); err != nil {
+		fmt.Println("send:", err)
+	}
+	conn.CloseWrite()
+	<-done
+	conn.Close()
+}
+
+func init() {
+	topLevelCommands = append(topLevelCommands, &cmdTCP)
+	cmdTCP.AddSubcommand(&cmdTCPConnect)
+	cmdTCP.AddSubcommand(&cmdTCPListen)
+}
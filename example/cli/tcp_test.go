@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	gonet "net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freeUDPPort returns a loopback UDP port which is not currently in use.
+func freeUDPPort(t *testing.T) int {
+	conn, err := gonet.ListenUDP("udp", &gonet.UDPAddr{IP: gonet.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen on UDP: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*gonet.UDPAddr).Port
+}
+
+// A cliProcess is a running instance of the CLI.
+type cliProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu     sync.Mutex
+	stdout bytes.Buffer
+}
+
+func (p *cliProcess) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stdout.Write(b)
+}
+
+func (p *cliProcess) output() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stdout.String()
+}
+
+// waitOutput waits for the process's output to contain s.
+func (p *cliProcess) waitOutput(t *testing.T, s string) {
+	for start := time.Now(); !strings.Contains(p.output(), s); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for output %q; got:\n%v", s, p.output())
+		}
+	}
+}
+
+// buildCLI builds the CLI binary in dir, returning its path. Tests which
+// call it are skipped in short mode.
+func buildCLI(t *testing.T, dir string) string {
+	if testing.Short() {
+		t.Skip("skipping test which builds and runs the CLI in short mode")
+	}
+	bin := filepath.Join(dir, "cli")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("could not build CLI: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// startCLI runs the CLI binary with a single udp4 device with the given
+// address, sending from lport to rport on localhost, and any extra
+// command-line arguments.
+func startCLI(t *testing.T, bin, dir, name, addr string, lport, rport int, args ...string) *cliProcess {
+	devs := filepath.Join(dir, name+".devs")
+	routes := filepath.Join(dir, name+".routes")
+	def := fmt.Sprintf("udp4:0 %v localhost:%v localhost:%v 1500\n", addr, lport, rport)
+	if err := os.WriteFile(devs, []byte(def), 0644); err != nil {
+		t.Fatalf("could not write device file: %v", err)
+	}
+	if err := os.WriteFile(routes, []byte("10.0.0.0/8\tudp4:0\n"), 0644); err != nil {
+		t.Fatalf("could not write route file: %v", err)
+	}
+	p := new(cliProcess)
+	p.cmd = exec.Command(bin, append([]string{"--device-file", devs, "--route-file", routes}, args...)...)
+	p.cmd.Stdout = p
+	p.cmd.Stderr = p
+	var err error
+	if p.stdin, err = p.cmd.StdinPipe(); err != nil {
+		t.Fatalf("could not create stdin pipe: %v", err)
+	}
+	if err := p.cmd.Start(); err != nil {
+		t.Fatalf("could not start CLI: %v", err)
+	}
+	return p
+}
+
+func TestTCPCommands(t *testing.T) {
+	dir := t.TempDir()
+	bin := buildCLI(t, dir)
+
+	aport, bport := freeUDPPort(t), freeUDPPort(t)
+	a := startCLI(t, bin, dir, "A", "10.0.0.1/8", aport, bport)
+	defer a.cmd.Process.Kill()
+	b := startCLI(t, bin, dir, "B", "10.0.0.2/8", bport, aport)
+	defer b.cmd.Process.Kill()
+
+	io.WriteString(a.stdin, "tcp listen 7\n")
+	a.waitOutput(t, "listening on port 7")
+	io.WriteString(b.stdin, "tcp connect 10.0.0.1:7\n")
+	b.waitOutput(t, "connected to 10.0.0.1:7")
+	a.waitOutput(t, "accepted connection from 10.0.0.2:")
+
+	io.WriteString(b.stdin, "hello from B\n")
+	a.waitOutput(t, "hello from B\n")
+	io.WriteString(a.stdin, "hello from A\n")
+	b.waitOutput(t, "hello from A\n")
+
+	// closing standard input closes each side of the connection,
+	// after which both CLIs exit
+	b.stdin.Close()
+	a.stdin.Close()
+	for _, p := range []*cliProcess{a, b} {
+		done := make(chan error, 1)
+		go func() { done <- p.cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("CLI exited with error: %v; output:\n%v", err, p.output())
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("CLI didn't exit after its input was closed; output:\n%v", p.output())
+		}
+	}
+}
@@ -3,6 +3,7 @@ package cli
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"strings"
@@ -135,26 +136,36 @@ func printAvailableCommands(cmds ...*Command) {
 	}
 }
 
-// RunCLI runs an interactive command-line interface, reading from os.Stdin
+// Stdin is the buffered reader from which RunCLI reads commands. Commands
+// which read further input from the terminal must read it from Stdin rather
+// than from os.Stdin so that no input is lost to buffering.
+var Stdin = bufio.NewReader(os.Stdin)
+
+// RunCLI runs an interactive command-line interface, reading from Stdin
 // and writing to os.Stdout
 func RunCLI(cmds ...*Command) (err error) {
-	s := bufio.NewScanner(os.Stdin)
 	fmt.Print("> ")
-	for s.Scan() {
-		err = ExecuteCommands(s.Text(), cmds...)
-		switch {
-		case IsNoCommand(err):
-			fmt.Println(err)
-			fmt.Println("To list available commands, type 'help'.")
-			fmt.Println("To get help for a specific command, type '<command> -h' or '<command> --help'.")
-		case err != nil:
-			return errors.Annotate(err, "run CLI")
+	for {
+		line, rerr := Stdin.ReadString('\n')
+		if line != "" {
+			err = ExecuteCommands(strings.TrimSuffix(line, "\n"), cmds...)
+			switch {
+			case IsNoCommand(err):
+				fmt.Println(err)
+				fmt.Println("To list available commands, type 'help'.")
+				fmt.Println("To get help for a specific command, type '<command> -h' or '<command> --help'.")
+			case err != nil:
+				return errors.Annotate(err, "run CLI")
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return errors.Annotate(rerr, "run CLI")
 		}
 		fmt.Print("> ")
 	}
-	if err = s.Err(); err != nil {
-		return errors.Annotate(err, "run CLI")
-	}
 	fmt.Println()
 	return nil
 }
@@ -0,0 +1,98 @@
+package net
+
+import "sync"
+
+// SetInboundHook sets a function which is called with each packet received on
+// one of s's devices before s processes it. pkt is the IP packet, including
+// its header. If the hook returns true, the packet is dropped. If f is nil,
+// the hook is removed.
+//
+// The hook is called synchronously in the receive path of the device, and may
+// be called concurrently for packets received on different devices, so it
+// must be safe for concurrent use and should return quickly. No locks are
+// held while it runs, but it must not retain pkt after returning.
+func (s *Stack) SetInboundHook(f func(pkt []byte) (drop bool)) {
+	s.hooks.mu.Lock()
+	s.hooks.inbound = f
+	s.hooks.mu.Unlock()
+}
+
+// SetOutboundHook sets a function which is called with each packet just
+// before s writes it to one of its devices, including forwarded packets and
+// each fragment of a fragmented packet. pkt is the IP packet, including its
+// header. If the hook returns true for drop, the packet is silently dropped;
+// otherwise, modified is written in place of pkt. The hook may modify pkt in
+// place and return it, but it is responsible for updating any checksums which
+// the modification invalidates. If f is nil, the hook is removed.
+//
+// The hook is called synchronously by the goroutine sending the packet, and
+// may be called concurrently, so it must be safe for concurrent use and should
+// return quickly. It is called with s's routing state locked for reading, so
+// it must not send packets through s or modify s's configuration (for
+// example, by adding routes).
+func (s *Stack) SetOutboundHook(f func(pkt []byte) (modified []byte, drop bool)) {
+	s.hooks.mu.Lock()
+	s.hooks.outbound = f
+	s.hooks.mu.Unlock()
+}
+
+// packetHooks holds a Stack's packet hooks. It is shared by the
+// Stack's IPv4 and IPv6 hosts, for which it is nil if they don't
+// belong to a Stack.
+type packetHooks struct {
+	inbound  func(pkt []byte) (drop bool)
+	outbound func(pkt []byte) (modified []byte, drop bool)
+
+	mu sync.RWMutex
+}
+
+// in runs the inbound hook on pkt, and reports whether to drop it.
+func (h *packetHooks) in(pkt []byte) (drop bool) {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	f := h.inbound
+	h.mu.RUnlock()
+	return f != nil && f(pkt)
+}
+
+// out runs the outbound hook on pkt, and returns the packet to write in its
+// place, or reports that it should be dropped.
+func (h *packetHooks) out(pkt []byte) (modified []byte, drop bool) {
+	if h == nil {
+		return pkt, false
+	}
+	h.mu.RLock()
+	f := h.outbound
+	h.mu.RUnlock()
+	if f == nil {
+		return pkt, false
+	}
+	return f(pkt)
+}
+
+// writeIPv4 writes pkt to dev after running it through the outbound hook. A
+// dropped packet is reported as written.
+func (h *packetHooks) writeIPv4(dev IPv4Device, pkt []byte, nexthop IPv4) (n int, err error) {
+	modified, drop := h.out(pkt)
+	if drop {
+		return len(pkt), nil
+	}
+	if n, err = dev.WriteToIPv4(modified, nexthop); err == nil {
+		n = len(pkt)
+	}
+	return n, err
+}
+
+// writeIPv6 is like writeIPv4, but for IPv6 devices.
+func (h *packetHooks) writeIPv6(dev IPv6Device, pkt []byte, nexthop IPv6) (n int, err error) {
+	modified, drop := h.out(pkt)
+	if drop {
+		return len(pkt), nil
+	}
+	if n, err = dev.WriteToIPv6(modified, nexthop); err == nil {
+		n = len(pkt)
+	}
+	return n, err
+}
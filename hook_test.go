@@ -0,0 +1,67 @@
+package net
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPacketHooks(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+	c, err := s.ListenUDP(&UDPAddr{Port: 1234})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+	addr := &UDPAddr{IP: IPv4{127, 0, 0, 1}, Port: 1234}
+
+	var dropped int32
+	s.SetInboundHook(func(pkt []byte) bool {
+		if bytes.HasSuffix(pkt, []byte("drop me")) {
+			atomic.AddInt32(&dropped, 1)
+			return true
+		}
+		return false
+	})
+	for _, msg := range []string{"drop me", "hello"} {
+		if _, err := c.WriteTo([]byte(msg), addr); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "hello" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "hello")
+	}
+	if n := atomic.LoadInt32(&dropped); n != 1 {
+		t.Errorf("unexpected number of packets dropped by inbound hook: got %v; want 1", n)
+	}
+	s.SetInboundHook(nil)
+
+	s.SetOutboundHook(func(pkt []byte) ([]byte, bool) {
+		ihl := int(pkt[0]&0xF) * 4
+		// the checksum is optional for UDP over IPv4
+		pkt[ihl+6], pkt[ihl+7] = 0, 0
+		pkt[len(pkt)-1] = '!'
+		return pkt, false
+	})
+	if _, err := c.WriteTo([]byte("hello?"), addr); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "hello!" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "hello!")
+	}
+
+	// the outbound hook runs synchronously, so it can be removed
+	// as soon as the write returns
+	s.SetOutboundHook(func(pkt []byte) ([]byte, bool) { return nil, true })
+	if n, err := c.WriteTo([]byte("dropped"), addr); n != len("dropped") || err != nil {
+		t.Errorf("unexpected result writing dropped packet: got %v (err: %v); want %v", n, err, len("dropped"))
+	}
+	s.SetOutboundHook(nil)
+	if _, err := c.WriteTo([]byte("hello"), addr); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "hello" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "hello")
+	}
+}
@@ -0,0 +1,348 @@
+package net
+
+import (
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// ICMP message types
+const (
+	// See https://tools.ietf.org/html/rfc792
+	icmpv4TypeDestUnreachable = 3
+	icmpv4TypeSourceQuench    = 4
+	icmpv4TypeRedirect        = 5
+	icmpv4TypeTimeExceeded    = 11
+	icmpv4TypeParamProblem    = 12
+
+	// See https://tools.ietf.org/html/rfc4443#section-2.1
+	icmpv6TypeDestUnreachable = 1
+	icmpv6TypeTimeExceeded    = 3
+	icmpv6TypeParamProblem    = 4
+)
+
+// the ICMPv4 destination unreachable code indicating
+// that fragmentation was needed but the DF flag was set
+const icmpv4CodeFragNeeded = 4
+
+// ICMPv6 time exceeded codes
+// See https://tools.ietf.org/html/rfc4443#section-3.3
+const (
+	icmpv6CodeHopLimitExceeded   = 0
+	icmpv6CodeReassemblyExceeded = 1
+)
+
+const (
+	// the length of the ICMP header, including the
+	// 4 bytes whose meaning depends on the message type
+	icmpHeaderLen = 8
+	// the number of bytes of the original payload
+	// quoted in an ICMPv4 error message
+	icmpv4QuoteLen = 8
+	// the maximum length of an ICMPv6 error message; no error message
+	// may cause a packet to exceed the minimum IPv6 MTU
+	// See https://tools.ietf.org/html/rfc4443#section-3.1
+	maxICMPv6ErrorLen = 1280 - 40
+)
+
+// An UnreachableCode indicates why a packet could not be delivered to its
+// destination. It is reported in ICMP destination unreachable messages.
+//
+// The codes used by ICMPv4 and ICMPv6 differ; an UnreachableCode represents
+// the reasons common to both. In ICMPv6, an unrecognized protocol is reported
+// by a parameter problem message instead, but it is still reported here as
+// UnreachableProtocol.
+type UnreachableCode uint8
+
+const (
+	UnreachableNet UnreachableCode = iota
+	UnreachableHost
+	UnreachableProtocol
+	UnreachablePort
+	UnreachableProhibited
+)
+
+func (c UnreachableCode) String() string {
+	switch c {
+	case UnreachableNet:
+		return "network unreachable"
+	case UnreachableHost:
+		return "host unreachable"
+	case UnreachableProtocol:
+		return "protocol unreachable"
+	case UnreachablePort:
+		return "port unreachable"
+	case UnreachableProhibited:
+		return "communication administratively prohibited"
+	default:
+		return "unknown unreachable code"
+	}
+}
+
+// err returns the sentinel error describing c. Administratively prohibited
+// destinations are reported as unreachable hosts.
+func (c UnreachableCode) err() error {
+	switch c {
+	case UnreachableNet:
+		return errors.ErrNetUnreachable
+	case UnreachableProtocol:
+		return errors.ErrProtocolUnreachable
+	case UnreachablePort:
+		return errors.ErrPortUnreachable
+	default:
+		return errors.ErrHostUnreachable
+	}
+}
+
+// icmpv4Code returns the ICMPv4 code for c.
+// See https://tools.ietf.org/html/rfc1122#page-39
+func (c UnreachableCode) icmpv4Code() uint8 {
+	switch c {
+	case UnreachableNet:
+		return 0
+	case UnreachableHost:
+		return 1
+	case UnreachableProtocol:
+		return 2
+	case UnreachablePort:
+		return 3
+	default:
+		// See https://tools.ietf.org/html/rfc1812#section-5.2.7.1
+		return 13
+	}
+}
+
+// parseICMPv4UnreachableCode parses an ICMPv4 destination unreachable code.
+// It returns false for codes which don't indicate that the destination is
+// unreachable, such as "fragmentation needed."
+func parseICMPv4UnreachableCode(code uint8) (UnreachableCode, bool) {
+	switch code {
+	case 0, 6, 9, 11:
+		return UnreachableNet, true
+	case 1, 5, 7, 10, 12:
+		return UnreachableHost, true
+	case 2:
+		return UnreachableProtocol, true
+	case 3:
+		return UnreachablePort, true
+	case 13, 14, 15:
+		return UnreachableProhibited, true
+	default:
+		return 0, false
+	}
+}
+
+// icmpv6Code returns the ICMPv6 destination unreachable code for c. c must
+// not be UnreachableProtocol, which has no equivalent.
+// See https://tools.ietf.org/html/rfc4443#section-3.1
+func (c UnreachableCode) icmpv6Code() uint8 {
+	switch c {
+	case UnreachableNet:
+		return 0
+	case UnreachableHost:
+		return 3
+	case UnreachablePort:
+		return 4
+	default:
+		return 1
+	}
+}
+
+func parseICMPv6UnreachableCode(code uint8) (UnreachableCode, bool) {
+	switch code {
+	case 0, 2:
+		return UnreachableNet, true
+	case 3:
+		return UnreachableHost, true
+	case 4:
+		return UnreachablePort, true
+	case 1, 5, 6:
+		return UnreachableProhibited, true
+	default:
+		return 0, false
+	}
+}
+
+// isICMPv4Error returns true if the ICMPv4 message b is an error message.
+// Error messages must never be sent in response to other error messages,
+// so if b is malformed, it is treated as an error message to be safe.
+// See https://tools.ietf.org/html/rfc1122#page-38
+func isICMPv4Error(b []byte) bool {
+	if len(b) < 1 {
+		return true
+	}
+	switch b[0] {
+	case icmpv4TypeDestUnreachable, icmpv4TypeSourceQuench, icmpv4TypeRedirect,
+		icmpv4TypeTimeExceeded, icmpv4TypeParamProblem:
+		return true
+	default:
+		return false
+	}
+}
+
+// isICMPv6Error is like isICMPv4Error, but for ICMPv6. All ICMPv6 error
+// messages have types below 128.
+// See https://tools.ietf.org/html/rfc4443#section-2.1
+func isICMPv6Error(b []byte) bool {
+	return len(b) < 1 || b[0] < 128
+}
+
+// icmpv4Unreachable constructs an ICMPv4 destination unreachable message in
+// response to the packet with the header hdr and the payload b.
+// See https://tools.ietf.org/html/rfc792#page-4
+func icmpv4Unreachable(code UnreachableCode, hdr *ipv4Header, b []byte) []byte {
+	msg := icmpv4Error(icmpv4TypeDestUnreachable, code.icmpv4Code(), hdr, b)
+	setICMPChecksum(msg, Checksum(msg, 0))
+	return msg
+}
+
+// icmpv4FragNeeded constructs an ICMPv4 fragmentation needed message in
+// response to the packet with the header hdr and the payload b, which could
+// not be forwarded over a link with the given MTU.
+func icmpv4FragNeeded(mtu int, hdr *ipv4Header, b []byte) []byte {
+	msg := icmpv4Error(icmpv4TypeDestUnreachable, icmpv4CodeFragNeeded, hdr, b)
+	msg[6], msg[7] = byte(mtu>>8), byte(mtu)
+	setICMPChecksum(msg, Checksum(msg, 0))
+	return msg
+}
+
+// icmpv4TimeExceeded constructs an ICMPv4 time exceeded message in response
+// to the packet with the header hdr and the payload b, whose TTL expired
+// in transit.
+// See https://tools.ietf.org/html/rfc792#page-6
+func icmpv4TimeExceeded(hdr *ipv4Header, b []byte) []byte {
+	msg := icmpv4Error(icmpv4TypeTimeExceeded, 0, hdr, b)
+	setICMPChecksum(msg, Checksum(msg, 0))
+	return msg
+}
+
+// icmpv4Error constructs an ICMPv4 error message with the given type and code
+// quoting the packet with the header hdr and the payload b, but does not
+// compute the checksum.
+func icmpv4Error(typ, code uint8, hdr *ipv4Header, b []byte) []byte {
+	if len(b) > icmpv4QuoteLen {
+		b = b[:icmpv4QuoteLen]
+	}
+	msg := make([]byte, icmpHeaderLen+20+len(b))
+	msg[0] = typ
+	msg[1] = code
+	// the original header is quoted without options
+	quoted := *hdr
+	quoted.IHL = 5
+	writeIPv4Header(&quoted, msg[icmpHeaderLen:])
+	copy(msg[icmpHeaderLen+20:], b)
+	return msg
+}
+
+// icmpv6Unreachable constructs an ICMPv6 message indicating that the packet
+// with the header hdr and the payload b could not be delivered. src is the
+// address the message will be sent from, which is covered by the checksum.
+// See https://tools.ietf.org/html/rfc4443#section-3.1
+func icmpv6Unreachable(code UnreachableCode, hdr *ipv6Header, b []byte, src IPv6) []byte {
+	var msg []byte
+	if code == UnreachableProtocol {
+		// reported as an unrecognized next header; the
+		// pointer identifies the next header field
+		// See https://tools.ietf.org/html/rfc4443#section-3.4
+		msg = icmpv6Error(icmpv6TypeParamProblem, 1, hdr, b)
+		msg[7] = 6
+	} else {
+		msg = icmpv6Error(icmpv6TypeDestUnreachable, code.icmpv6Code(), hdr, b)
+	}
+	setICMPChecksum(msg, Checksum(msg, IPv6PseudoHeaderSum(src, hdr.src, IPProtocolICMPv6, len(msg))))
+	return msg
+}
+
+// icmpv6TimeExceeded constructs an ICMPv6 time exceeded message with the
+// given code in response to the packet with the header hdr and the payload b,
+// whose hop limit expired in transit or which couldn't be reassembled in time.
+// src is as for icmpv6Unreachable.
+// See https://tools.ietf.org/html/rfc4443#section-3.3
+func icmpv6TimeExceeded(code uint8, hdr *ipv6Header, b []byte, src IPv6) []byte {
+	msg := icmpv6Error(icmpv6TypeTimeExceeded, code, hdr, b)
+	setICMPChecksum(msg, Checksum(msg, IPv6PseudoHeaderSum(src, hdr.src, IPProtocolICMPv6, len(msg))))
+	return msg
+}
+
+// icmpv6Error is like icmpv4Error, but for ICMPv6.
+func icmpv6Error(typ, code uint8, hdr *ipv6Header, b []byte) []byte {
+	if max := maxICMPv6ErrorLen - icmpHeaderLen - 40; len(b) > max {
+		b = b[:max]
+	}
+	msg := make([]byte, icmpHeaderLen+40+len(b))
+	msg[0] = typ
+	msg[1] = code
+	writeIPv6Header(hdr, msg[icmpHeaderLen:])
+	copy(msg[icmpHeaderLen+40:], b)
+	return msg
+}
+
+// parseICMPv4Unreachable parses the ICMPv4 message b. If it is a destination
+// unreachable message, it returns the code and the header and payload of
+// the original packet quoted in the message.
+func parseICMPv4Unreachable(b []byte) (code UnreachableCode, hdr ipv4Header, payload []byte, ok bool) {
+	if len(b) < icmpHeaderLen+20 || b[0] != icmpv4TypeDestUnreachable || Checksum(b, 0) != 0xFFFF {
+		return 0, hdr, nil, false
+	}
+	code, ok = parseICMPv4UnreachableCode(b[1])
+	if !ok {
+		return 0, hdr, nil, false
+	}
+	b = b[icmpHeaderLen:]
+	readIPv4Header(&hdr, b)
+	hdrlen := int(hdr.IHL) * 4
+	if hdr.version != 4 || hdrlen < 20 || len(b) < hdrlen {
+		return 0, hdr, nil, false
+	}
+	return code, hdr, b[hdrlen:], true
+}
+
+// parseICMPv4FragNeeded parses the ICMPv4 message b. If it is a fragmentation
+// needed message, it returns the reported next-hop MTU and the header and
+// payload of the original packet quoted in the message. If the next-hop MTU
+// was not reported, as by routers predating RFC 1191, mtu is 0.
+// See https://tools.ietf.org/html/rfc1191#section-4
+func parseICMPv4FragNeeded(b []byte) (mtu int, hdr ipv4Header, payload []byte, ok bool) {
+	if len(b) < icmpHeaderLen+20 || b[0] != icmpv4TypeDestUnreachable ||
+		b[1] != icmpv4CodeFragNeeded || Checksum(b, 0) != 0xFFFF {
+		return 0, hdr, nil, false
+	}
+	mtu = int(b[6])<<8 | int(b[7])
+	b = b[icmpHeaderLen:]
+	readIPv4Header(&hdr, b)
+	hdrlen := int(hdr.IHL) * 4
+	if hdr.version != 4 || hdrlen < 20 || len(b) < hdrlen {
+		return 0, hdr, nil, false
+	}
+	return mtu, hdr, b[hdrlen:], true
+}
+
+// parseICMPv6Unreachable is like parseICMPv4Unreachable, but for ICMPv6.
+// src and dst are the addresses of the packet carrying b, which are covered
+// by the checksum.
+func parseICMPv6Unreachable(b []byte, src, dst IPv6) (code UnreachableCode, hdr ipv6Header, payload []byte, ok bool) {
+	if len(b) < icmpHeaderLen+40 || Checksum(b, IPv6PseudoHeaderSum(src, dst, IPProtocolICMPv6, len(b))) != 0xFFFF {
+		return 0, hdr, nil, false
+	}
+	switch {
+	case b[0] == icmpv6TypeDestUnreachable:
+		code, ok = parseICMPv6UnreachableCode(b[1])
+	case b[0] == icmpv6TypeParamProblem && b[1] == 1:
+		code, ok = UnreachableProtocol, true
+	}
+	if !ok {
+		return 0, hdr, nil, false
+	}
+	b = b[icmpHeaderLen:]
+	readIPv6Header(&hdr, b)
+	if hdr.version != 6 {
+		return 0, hdr, nil, false
+	}
+	return code, hdr, b[40:], true
+}
+
+// setICMPChecksum sets the checksum field of the ICMP message b
+// given the sum of the message with the checksum field zeroed.
+func setICMPChecksum(b []byte, sum uint16) {
+	b = b[2:]
+	parse.PutUint16(&b, ^sum)
+}
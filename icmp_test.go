@@ -0,0 +1,107 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIPv4Unreachable(t *testing.T) {
+	const proto = 253
+	a, b, _, recv := newTestIPv4HostPair(1500, proto)
+	addra, addrb := IPv4{10, 0, 0, 1}, IPv4{10, 0, 0, 2}
+
+	type report struct {
+		code     UnreachableCode
+		b        []byte
+		src, dst IPv4
+	}
+	var reports []report
+	callback := func(code UnreachableCode, b []byte, src, dst IPv4) {
+		reports = append(reports, report{code, append([]byte(nil), b...), src, dst})
+	}
+	a.RegisterIPv4UnreachableCallback(callback, proto)
+	a.RegisterIPv4UnreachableCallback(callback, proto+1)
+
+	// a stand-in for a transport header with ports; only the
+	// first 8 bytes are quoted in the ICMP message
+	payload := []byte{0, 1, 0, 2, 3, 4, 5, 6, 7, 8, 9}
+	check := func(what string, code UnreachableCode) {
+		if len(reports) != 1 {
+			t.Fatalf("%v: unexpected number of unreachable reports: got %v; want 1", what, len(reports))
+		}
+		r := reports[0]
+		reports = nil
+		if r.code != code {
+			t.Errorf("%v: unexpected code: got %v; want %v", what, r.code, code)
+		}
+		if !bytes.Equal(r.b, payload[:8]) {
+			t.Errorf("%v: unexpected quoted payload: got %v; want %v", what, r.b, payload[:8])
+		}
+		if r.src != addra || r.dst != addrb {
+			t.Errorf("%v: unexpected addresses: got %v -> %v; want %v -> %v", what, r.src, r.dst, addra, addrb)
+		}
+	}
+
+	// no callback is registered for proto+1
+	a.WriteToIPv4(payload, addrb, proto+1)
+	check("unregistered protocol", UnreachableProtocol)
+
+	// the transport reports that nothing is listening on the port
+	b.RegisterIPv4Callback(func(p []byte, src, dst IPv4) {
+		b.WriteIPv4Unreachable(UnreachablePort, p, src, dst, proto)
+	}, proto)
+	a.WriteToIPv4(payload, addrb, proto)
+	check("closed port", UnreachablePort)
+	select {
+	case <-recv:
+		t.Errorf("packet delivered to replaced callback")
+	default:
+	}
+
+	// errors are never sent in response to errors
+	b.RegisterIPv4Callback(nil, IPProtocolICMP)
+	msg := icmpv4Unreachable(UnreachablePort, &ipv4Header{version: 4, IHL: 5, src: addrb, dst: addra}, payload)
+	var n int
+	a.RegisterIPv4Callback(func(p []byte, src, dst IPv4) { n++ }, IPProtocolICMP)
+	b.WriteToIPv4(msg, addra, IPProtocolICMP)
+	if n != 1 {
+		t.Fatalf("ICMP message not delivered")
+	}
+	a.RegisterIPv4Callback(nil, IPProtocolICMP)
+	a.RegisterIPv4Callback(nil, proto)
+	b.WriteToIPv4(msg, addra, IPProtocolICMP)
+	if len(reports) != 0 {
+		t.Errorf("unexpected unreachable reports for ICMP error: %+v", reports)
+	}
+}
+
+func TestICMPv6Unreachable(t *testing.T) {
+	src, _ := ParseIPv6("fd00::1")
+	dst, _ := ParseIPv6("fd00::2")
+	payload := make([]byte, 2000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	hdr := ipv6Header{version: 6, len: 40 + uint16(len(payload)), nextHdr: 253, hopLimit: 32, src: src, dst: dst}
+
+	for _, code := range []UnreachableCode{UnreachableNet, UnreachableHost, UnreachableProtocol, UnreachablePort, UnreachableProhibited} {
+		// the message is sent from dst back to src
+		msg := icmpv6Unreachable(code, &hdr, payload, dst)
+		if len(msg) != maxICMPv6ErrorLen {
+			t.Errorf("%v: unexpected message length: got %v; want %v", code, len(msg), maxICMPv6ErrorLen)
+		}
+		gotCode, gotHdr, gotPayload, ok := parseICMPv6Unreachable(msg, dst, src)
+		if !ok {
+			t.Errorf("%v: could not parse message", code)
+			continue
+		}
+		if gotCode != code || gotHdr != hdr || !bytes.Equal(gotPayload, payload[:len(gotPayload)]) {
+			t.Errorf("%v: unexpected parse result: (%v, %+v, %v bytes)", code, gotCode, gotHdr, len(gotPayload))
+		}
+		// the checksum covers the addresses
+		other, _ := ParseIPv6("fd00::3")
+		if _, _, _, ok := parseICMPv6Unreachable(msg, other, src); ok {
+			t.Errorf("%v: parsed message with wrong addresses", code)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package net
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+const (
+	igmpLen = 8
+
+	igmpTypeQuery    = 0x11
+	igmpTypeV1Report = 0x12
+	igmpTypeV2Report = 0x16
+	igmpTypeLeave    = 0x17
+
+	// the maximum delay before repeating an unsolicited report
+	igmpUnsolicitedReportInterval = 10 * time.Second
+	// the number of unsolicited reports sent when joining a group
+	igmpRobustness = 2
+	// the maximum response time of IGMPv1 queries, which don't specify one
+	igmpV1MaxRespTime = 10 * time.Second
+)
+
+var (
+	// the group of all multicast hosts, of which every host is
+	// a member on every device, and which is never reported
+	igmpAllSystems = IPv4{224, 0, 0, 1}
+	// the group of all multicast routers, to which leave messages are sent
+	igmpAllRouters = IPv4{224, 0, 0, 2}
+)
+
+// isIPv4Multicast returns true if addr is a multicast address.
+func isIPv4Multicast(addr IPv4) bool {
+	return addr[0]&0xF0 == 224
+}
+
+// ipv4MulticastMAC returns the Ethernet multicast MAC
+// address to which packets for addr are sent.
+// See https://tools.ietf.org/html/rfc1112#section-6.4
+func ipv4MulticastMAC(addr IPv4) MAC {
+	return MAC{0x01, 0x00, 0x5E, addr[1] & 0x7F, addr[2], addr[3]}
+}
+
+type igmpKey struct {
+	dev   IPv4Device
+	group IPv4
+}
+
+type igmpGroup struct {
+	// the number of unsolicited reports left to send after joining
+	unsolicited int
+	// whether we sent the last report for the group; if another host
+	// did, it will keep the group alive, so we needn't send a leave
+	lastReporter bool
+	timer        *timeout.Timeout // nil if no report is pending
+	deadline     time.Time        // when timer fires, relative to timeout.NowMonotonic
+}
+
+// igmp represents an instance of the IGMPv2 protocol, which tracks the
+// multicast groups joined on each of a host's devices and reports their
+// membership to multicast routers.
+// See https://tools.ietf.org/html/rfc2236
+type igmp struct {
+	// writes the IGMP message b to dst through dev; it must
+	// not be called with mu held
+	write func(dev IPv4Device, b []byte, dst IPv4)
+
+	groups map[igmpKey]*igmpGroup // make sure to check if nil before modifying
+	// timing parameter; the default can be overridden in tests
+	unsolicitedInterval time.Duration
+
+	timeoutd *timeout.Daemon // created along with groups
+	mu       sync.Mutex
+}
+
+// an igmpMessage is a message to be written once igmp.mu is released
+type igmpMessage struct {
+	dev IPv4Device
+	b   []byte
+	dst IPv4
+}
+
+// join joins group on dev. If it has already been joined, join is a no-op.
+func (g *igmp) join(dev IPv4Device, group IPv4) error {
+	if !isIPv4Multicast(group) {
+		return errors.Errorf("join group: %v is not a multicast address", group)
+	}
+	g.mu.Lock()
+	var out []igmpMessage
+	key := igmpKey{dev, group}
+	if g.groups == nil {
+		g.groups = make(map[igmpKey]*igmpGroup)
+		g.timeoutd = timeout.NewDaemon(&g.mu)
+	}
+	if _, ok := g.groups[key]; !ok {
+		e := &igmpGroup{}
+		g.groups[key] = e
+		if group != igmpAllSystems {
+			// See https://tools.ietf.org/html/rfc2236#section-3
+			e.unsolicited = igmpRobustness - 1
+			out = g.report(key, e)
+			g.setTimer(key, e, g.randDelay(g.interval()))
+		}
+	}
+	g.mu.Unlock()
+	g.flush(out)
+	return nil
+}
+
+// leave leaves group on dev. It is an error if group hasn't been joined.
+func (g *igmp) leave(dev IPv4Device, group IPv4) error {
+	g.mu.Lock()
+	key := igmpKey{dev, group}
+	e, ok := g.groups[key]
+	if !ok {
+		g.mu.Unlock()
+		return errors.Errorf("leave group: %v has not been joined", group)
+	}
+	g.stopTimer(e)
+	delete(g.groups, key)
+	var out []igmpMessage
+	if e.lastReporter {
+		out = []igmpMessage{{dev, igmpPacket(igmpTypeLeave, 0, group), igmpAllRouters}}
+	}
+	g.mu.Unlock()
+	g.flush(out)
+	return nil
+}
+
+// removeDevice leaves all of the groups joined on dev
+// without sending leave messages.
+func (g *igmp) removeDevice(dev IPv4Device) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, e := range g.groups {
+		if key.dev == dev {
+			g.stopTimer(e)
+			delete(g.groups, key)
+		}
+	}
+}
+
+// isMember returns true if group has been joined on dev.
+func (g *igmp) isMember(dev IPv4Device, group IPv4) bool {
+	if group == igmpAllSystems {
+		return true
+	}
+	g.mu.Lock()
+	_, ok := g.groups[igmpKey{dev, group}]
+	g.mu.Unlock()
+	return ok
+}
+
+// handle handles the IGMP message b, received on dev.
+func (g *igmp) handle(dev IPv4Device, b []byte) {
+	if len(b) < igmpLen || Checksum(b, 0) != 0xFFFF {
+		// TODO(joshlf): Log it
+		return
+	}
+	var group IPv4
+	copy(group[:], b[4:8])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch b[0] {
+	case igmpTypeQuery:
+		// See https://tools.ietf.org/html/rfc2236#section-3
+		maxResp := time.Duration(b[1]) * time.Second / 10
+		if maxResp == 0 {
+			maxResp = igmpV1MaxRespTime
+		}
+		for key, e := range g.groups {
+			if key.dev == dev && key.group != igmpAllSystems && (group == IPv4{} || group == key.group) {
+				g.scheduleReport(key, e, maxResp)
+			}
+		}
+	case igmpTypeV1Report, igmpTypeV2Report:
+		// another member has reported the group, so our report
+		// would be redundant
+		if e, ok := g.groups[igmpKey{dev, group}]; ok && e.timer != nil {
+			g.stopTimer(e)
+			e.unsolicited = 0
+			e.lastReporter = false
+		}
+	}
+}
+
+// scheduleReport schedules a report for key, whose entry is e, in response
+// to a query with the maximum response time maxResp. If a report is already
+// scheduled sooner, it is left alone; assumes g.mu.Lock
+func (g *igmp) scheduleReport(key igmpKey, e *igmpGroup, maxResp time.Duration) {
+	if e.timer != nil && e.deadline.Sub(timeout.NowMonotonic()) <= maxResp {
+		return
+	}
+	g.setTimer(key, e, g.randDelay(maxResp))
+}
+
+// report constructs a report for key, whose entry is e; assumes g.mu.Lock
+func (g *igmp) report(key igmpKey, e *igmpGroup) []igmpMessage {
+	e.lastReporter = true
+	return []igmpMessage{{key.dev, igmpPacket(igmpTypeV2Report, 0, key.group), key.group}}
+}
+
+// assumes g.mu.Lock
+func (g *igmp) setTimer(key igmpKey, e *igmpGroup, d time.Duration) {
+	g.stopTimer(e)
+	e.deadline = timeout.NowMonotonic().Add(d)
+	e.timer = g.timeoutd.AddTimeout(func() { g.timeout(key, e) }, e.deadline)
+}
+
+// assumes g.mu.Lock
+func (g *igmp) stopTimer(e *igmpGroup) {
+	if e.timer != nil {
+		e.timer.Cancel()
+		e.timer = nil
+	}
+}
+
+// timeout is called by g.timeoutd with g.mu held when the timer for e, the
+// entry for key, fires. It releases g.mu while writing the report.
+func (g *igmp) timeout(key igmpKey, e *igmpGroup) {
+	e.timer = nil
+	out := g.report(key, e)
+	if e.unsolicited > 0 {
+		e.unsolicited--
+	}
+	if e.unsolicited > 0 {
+		g.setTimer(key, e, g.randDelay(g.interval()))
+	}
+	g.mu.Unlock()
+	g.flush(out)
+	g.mu.Lock()
+}
+
+// interval returns the maximum delay before repeating an unsolicited report.
+func (g *igmp) interval() time.Duration {
+	if g.unsolicitedInterval == 0 {
+		return igmpUnsolicitedReportInterval
+	}
+	return g.unsolicitedInterval
+}
+
+// randDelay returns a random delay in [0, max), which spreads out the reports
+// of the members of a group so that all but the first can be suppressed.
+func (g *igmp) randDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (g *igmp) flush(out []igmpMessage) {
+	for _, m := range out {
+		g.write(m.dev, m.b, m.dst)
+		// TODO(joshlf): Log error
+	}
+}
+
+// igmpPacket constructs an IGMP message with the given type,
+// maximum response time (in tenths of a second), and group.
+func igmpPacket(typ, maxResp uint8, group IPv4) []byte {
+	b := make([]byte, igmpLen)
+	buf := b
+	parse.PutByte(&buf, typ)
+	parse.PutByte(&buf, maxResp)
+	parse.PutUint16(&buf, 0)
+	copy(parse.GetBytes(&buf, 4), group[:])
+	setICMPChecksum(b, Checksum(b, 0))
+	return b
+}
@@ -0,0 +1,97 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIGMP(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	s := newTestStack(t)
+	defer s.close()
+	host := s.IPv4Host.(*ipv4ConfigurationHost)
+	host.igmp.unsolicitedInterval = 50 * time.Millisecond
+	recvd := make(chan IPv4, 16)
+	s.IPv4Host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { recvd <- dst }, proto)
+
+	group, other := IPv4{239, 1, 1, 1}, IPv4{239, 2, 2, 2}
+	// expectIGMP expects s to send an IGMP message of the given type to dst
+	expectIGMP := func(typ uint8, dst IPv4) {
+		t.Helper()
+		hdr, b := recv(t, s.peer0)
+		if hdr.proto != IPProtocolIGMP || hdr.dst != dst || hdr.TTL != 1 || len(b) != igmpLen || b[0] != typ || IPv4(b[4:8]) != group {
+			t.Fatalf("unexpected packet: got (proto %v, dst %v, TTL %v, %x); want IGMP message of type %#x to %v with TTL 1",
+				hdr.proto, hdr.dst, hdr.TTL, b, typ, dst)
+		}
+	}
+	// deliver sends a datagram to each of dsts, followed by one to s itself,
+	// and returns the destinations of those which were delivered
+	deliver := func(dsts ...IPv4) (got []IPv4) {
+		t.Helper()
+		for _, dst := range append(dsts, IPv4{10, 0, 0, 1}) {
+			s.send(t, &ipv4Header{TTL: 10, proto: proto, src: IPv4{10, 0, 0, 2}, dst: dst}, []byte("hello"))
+		}
+		for {
+			select {
+			case dst := <-recvd:
+				if dst == (IPv4{10, 0, 0, 1}) {
+					return got
+				}
+				got = append(got, dst)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("datagram not delivered")
+			}
+		}
+	}
+	// query sends a membership query for group
+	// with the given maximum response time
+	query := func(maxResp uint8) {
+		s.send(t, &ipv4Header{TTL: 1, proto: IPProtocolIGMP, src: IPv4{10, 0, 0, 2}, dst: igmpAllSystems},
+			igmpPacket(igmpTypeQuery, maxResp, IPv4{}))
+	}
+
+	if err := s.JoinGroup(s.eth0, IPv4{10, 0, 0, 5}); err == nil {
+		t.Errorf("no error joining non-multicast group")
+	}
+	if err := s.JoinGroup(s.eth0, group); err != nil {
+		t.Fatalf("unexpected error joining group: %v", err)
+	}
+	// one report is sent immediately, and another shortly after
+	expectIGMP(igmpTypeV2Report, group)
+	expectIGMP(igmpTypeV2Report, group)
+
+	if got := deliver(other, group); len(got) != 1 || got[0] != group {
+		t.Errorf("unexpected datagrams delivered: got %v; want only the one to %v", got, group)
+	}
+
+	// a query is answered within its maximum response time (here, 100ms)
+	query(1)
+	expectIGMP(igmpTypeV2Report, group)
+
+	// another member's report suppresses ours
+	query(100)
+	s.send(t, &ipv4Header{TTL: 1, proto: IPProtocolIGMP, src: IPv4{10, 0, 0, 2}, dst: group},
+		igmpPacket(igmpTypeV2Report, 0, group))
+	deliver()
+	host.igmp.mu.Lock()
+	e := host.igmp.groups[igmpKey{s.eth0, group}]
+	pending, last := e.timer != nil, e.lastReporter
+	host.igmp.mu.Unlock()
+	if pending || last {
+		t.Errorf("report not suppressed: pending %v, last reporter %v", pending, last)
+	}
+
+	// since we sent the last report, a leave is sent
+	query(1)
+	expectIGMP(igmpTypeV2Report, group)
+	if err := s.LeaveGroup(s.eth0, group); err != nil {
+		t.Fatalf("unexpected error leaving group: %v", err)
+	}
+	expectIGMP(igmpTypeLeave, igmpAllRouters)
+	if got := deliver(group); len(got) != 0 {
+		t.Errorf("unexpected datagrams delivered after leaving group: %v", got)
+	}
+	if err := s.LeaveGroup(s.eth0, group); err == nil {
+		t.Errorf("no error leaving group which hasn't been joined")
+	}
+}
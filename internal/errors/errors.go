@@ -1,27 +1,135 @@
 package errors
 
-import "github.com/juju/errors"
+import (
+	stderrors "errors"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+)
 
 // TODO(joshlf): Add parse error type?
 
-// New is equivalent to New from the github.com/juju/errors package.
+// Sentinel errors describing common network failures. Errors returned by this
+// package's constructors match the appropriate sentinel using the standard
+// library's errors.Is, even once annotated.
+var (
+	ErrTimeout             error = &timeout{errors.NewErr("i/o timeout")}
+	ErrConnRefused               = stderrors.New("connection refused")
+	ErrConnReset                 = stderrors.New("connection reset by peer")
+	ErrNetUnreachable            = stderrors.New("network unreachable")
+	ErrHostUnreachable           = stderrors.New("host unreachable")
+	ErrProtocolUnreachable       = stderrors.New("protocol unreachable")
+	ErrPortUnreachable           = stderrors.New("port unreachable")
+	ErrNoSuchHost                = stderrors.New("no such host")
+	ErrIdleTimeout               = stderrors.New("idle timeout")
+)
+
+// New is equivalent to New from the github.com/juju/errors package, except
+// that a stack trace is captured if stack traces are enabled (see
+// SetStackTraces).
 func New(message string) error {
-	return errors.New(message)
+	if atomic.LoadUint32(&stackTraces) == 0 {
+		return errors.New(message)
+	}
+	err := errors.NewErr("%s", message)
+	err.SetLocation(1)
+	return &traced{err, callers()}
 }
 
-// Annotate is equivalent to Annotate from the github.com/juju/errors package.
+// Annotate is equivalent to Annotate from the github.com/juju/errors package,
+// except that the returned error also has an Unwrap method which returns
+// other so that it can be inspected using the standard library's errors.Is
+// and errors.As.
 func Annotate(other error, message string) error {
-	return errors.Annotate(other, message)
+	if other == nil {
+		return nil
+	}
+	err := errors.NewErrWithCause(other, "%s", message)
+	err.SetLocation(1)
+	return &annotated{err}
 }
 
-// Annotatef is equivalent to Annotatef from the github.com/juju/errors package.
+// Annotatef is like Annotate, but is equivalent to Annotatef from the
+// github.com/juju/errors package.
 func Annotatef(other error, format string, args ...interface{}) error {
-	return errors.Annotatef(other, format, args)
+	if other == nil {
+		return nil
+	}
+	err := errors.NewErrWithCause(other, format, args...)
+	err.SetLocation(1)
+	return &annotated{err}
 }
 
-// Errorf is equivalent to Errorf from the github.com/juju/errors package.
+type annotated struct {
+	errors.Err
+}
+
+// Unwrap returns the annotated error.
+func (a *annotated) Unwrap() error { return a.Underlying() }
+
+// Errorf is equivalent to Errorf from the github.com/juju/errors package,
+// except that a stack trace is captured if stack traces are enabled (see
+// SetStackTraces).
 func Errorf(format string, args ...interface{}) error {
-	return errors.Errorf(format, args...)
+	if atomic.LoadUint32(&stackTraces) == 0 {
+		return errors.Errorf(format, args...)
+	}
+	err := errors.NewErr(format, args...)
+	err.SetLocation(1)
+	return &traced{err, callers()}
+}
+
+// the maximum number of frames in a stack trace
+const maxStackDepth = 32
+
+// stackTraces is 1 if stack traces are enabled and 0 otherwise;
+// it is accessed atomically
+var stackTraces uint32
+
+// SetStackTraces controls whether errors created by New and Errorf capture a
+// stack trace, which can be retrieved with StackTrace. Capturing a stack trace
+// is expensive, so it is disabled by default; when disabled, the only cost is
+// an atomic load per error.
+func SetStackTraces(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&stackTraces, v)
+}
+
+// StackTrace returns the stack trace captured when err, or the error it
+// annotates, was created, starting with the frame which created it. If
+// err has no stack trace, StackTrace returns nil.
+func StackTrace(err error) []runtime.Frame {
+	var t *traced
+	if !stderrors.As(err, &t) {
+		return nil
+	}
+	frames := runtime.CallersFrames(t.pcs)
+	var trace []runtime.Frame
+	for {
+		frame, more := frames.Next()
+		trace = append(trace, frame)
+		if !more {
+			return trace
+		}
+	}
+}
+
+type traced struct {
+	errors.Err
+	pcs []uintptr
+}
+
+// callers returns the program counters of the stack
+// beginning with the caller of callers' caller.
+func callers() []uintptr {
+	pcs := make([]uintptr, maxStackDepth)
+	// skip runtime.Callers, callers, and its caller
+	n := runtime.Callers(3, pcs)
+	return pcs[:n]
 }
 
 // Cause is equivalent to Cause from the github.com/juju/errors package.
@@ -66,6 +174,14 @@ type timeout struct {
 
 func (t *timeout) Timeout() bool { return true }
 
+// Temporary returns true so that timeout errors satisfy the standard library's
+// net.Error interface; like the standard library's timeouts, they are
+// temporary.
+func (t *timeout) Temporary() bool { return true }
+
+// Is reports whether target is ErrTimeout.
+func (t *timeout) Is(target error) bool { return target == ErrTimeout }
+
 // Timeoutf constructs a new timeout error with a Timeout() bool method that
 // returns true.
 func Timeoutf(format string, args ...interface{}) error {
@@ -87,6 +203,9 @@ type noRoute struct {
 	errors.Err
 }
 
+// Is reports whether target is ErrNetUnreachable.
+func (n *noRoute) Is(target error) bool { return target == ErrNetUnreachable }
+
 // NewNoRoute constructs a new error indicating that there is no route to the
 // given host.
 func NewNoRoute(host string) error {
@@ -94,7 +213,7 @@ func NewNoRoute(host string) error {
 	if host == "" {
 		err = errors.NewErr("no route to host")
 	} else {
-		err = errors.NewErr(host + ": no route to host")
+		err = errors.NewErr("%s: no route to host", host)
 	}
 	err.SetLocation(1)
 	return &noRoute{err}
@@ -106,3 +225,69 @@ func IsNoRoute(err error) bool {
 	_, ok := errors.Cause(err).(*noRoute)
 	return ok
 }
+
+type unreachable struct {
+	kind error
+	errors.Err
+}
+
+// Is reports whether target is the sentinel error describing the kind of u.
+// Port unreachable errors also match ErrConnRefused, since that is how a
+// closed port is reported.
+func (u *unreachable) Is(target error) bool {
+	return target == u.kind || (u.kind == ErrPortUnreachable && target == ErrConnRefused)
+}
+
+// NewUnreachable constructs a new error indicating that the given host could
+// not be reached, as reported by an ICMP destination unreachable message.
+// kind is one of the sentinel unreachable errors (such as ErrHostUnreachable),
+// and describes the reason.
+func NewUnreachable(host string, kind error) error {
+	var err errors.Err
+	if host == "" {
+		err = errors.NewErr("%v", kind)
+	} else {
+		err = errors.NewErr("%s: %v", host, kind)
+	}
+	err.SetLocation(1)
+	return &unreachable{kind, err}
+}
+
+// IsUnreachable returns true if err is an unreachable error as constructed
+// using NewUnreachable.
+func IsUnreachable(err error) bool {
+	_, ok := errors.Cause(err).(*unreachable)
+	return ok
+}
+
+// ConnRefusedf constructs a new error indicating that a connection was
+// refused by the remote host. It matches ErrConnRefused.
+func ConnRefusedf(format string, args ...interface{}) error {
+	err := errors.NewErrWithCause(ErrConnRefused, format, args...)
+	err.SetLocation(1)
+	return &annotated{err}
+}
+
+// ConnResetf constructs a new error indicating that a connection was reset
+// by the remote host. It matches ErrConnReset.
+func ConnResetf(format string, args ...interface{}) error {
+	err := errors.NewErrWithCause(ErrConnReset, format, args...)
+	err.SetLocation(1)
+	return &annotated{err}
+}
+
+// NoSuchHostf constructs a new error indicating that a hostname
+// doesn't exist. It matches ErrNoSuchHost.
+func NoSuchHostf(format string, args ...interface{}) error {
+	err := errors.NewErrWithCause(ErrNoSuchHost, format, args...)
+	err.SetLocation(1)
+	return &annotated{err}
+}
+
+// IdleTimeoutf constructs a new error indicating that a connection was reset
+// because it was idle for too long. It matches ErrIdleTimeout.
+func IdleTimeoutf(format string, args ...interface{}) error {
+	err := errors.NewErrWithCause(ErrIdleTimeout, format, args...)
+	err.SetLocation(1)
+	return &annotated{err}
+}
@@ -0,0 +1,106 @@
+package errors
+
+import (
+	stderrors "errors"
+	"strings"
+	"testing"
+)
+
+func TestAnnotateUnwrap(t *testing.T) {
+	sentinel := New("sentinel")
+	err := Annotate(Annotatef(Annotate(sentinel, "first"), "second %v", 2), "third")
+	if got, want := err.Error(), "third: second 2: first: sentinel"; got != want {
+		t.Errorf("unexpected message: got %q; want %q", got, want)
+	}
+	if !stderrors.Is(err, sentinel) {
+		t.Errorf("errors.Is did not find annotated sentinel")
+	}
+	if Cause(err) != sentinel {
+		t.Errorf("unexpected cause: got %v; want %v", Cause(err), sentinel)
+	}
+	if Annotate(nil, "annotation") != nil || Annotatef(nil, "annotation") != nil {
+		t.Errorf("annotating nil error returned non-nil error")
+	}
+}
+
+func TestAnnotateAs(t *testing.T) {
+	err := Annotate(Annotate(MTUf(1280, "packet too big"), "first"), "second")
+	var m *mtu
+	if !stderrors.As(err, &m) || m.mtu != 1280 {
+		t.Errorf("errors.As did not find annotated MTU error")
+	}
+	if !IsMTU(err) || GetMTU(err) != 1280 {
+		t.Errorf("annotated MTU error not recognized")
+	}
+
+	err = Annotate(NewUnreachable("10.0.0.1:53", ErrPortUnreachable), "write")
+	var u *unreachable
+	if !stderrors.As(err, &u) || !IsUnreachable(err) {
+		t.Errorf("errors.As did not find annotated unreachable error")
+	}
+	if got, want := err.Error(), "write: 10.0.0.1:53: port unreachable"; got != want {
+		t.Errorf("unexpected message: got %q; want %q", got, want)
+	}
+}
+
+func TestSentinels(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		is   []error
+		isnt []error
+	}{
+		{Timeoutf("read timed out"), []error{ErrTimeout}, []error{ErrConnReset}},
+		{NewNoRoute("10.0.0.1"), []error{ErrNetUnreachable}, []error{ErrHostUnreachable}},
+		{NewUnreachable("10.0.0.1", ErrHostUnreachable), []error{ErrHostUnreachable}, []error{ErrConnRefused}},
+		{NewUnreachable("10.0.0.1:53", ErrPortUnreachable), []error{ErrPortUnreachable, ErrConnRefused}, []error{ErrHostUnreachable}},
+		{ConnRefusedf("tcp"), []error{ErrConnRefused}, []error{ErrConnReset}},
+		{ConnResetf("tcp"), []error{ErrConnReset}, []error{ErrConnRefused, ErrTimeout}},
+		{NoSuchHostf("lookup example.com"), []error{ErrNoSuchHost}, []error{ErrTimeout}},
+	} {
+		err := Annotate(c.err, "annotation")
+		for _, target := range c.is {
+			if !stderrors.Is(err, target) {
+				t.Errorf("%v: errors.Is(err, %q) returned false", err, target)
+			}
+		}
+		for _, target := range c.isnt {
+			if stderrors.Is(err, target) {
+				t.Errorf("%v: errors.Is(err, %q) returned true", err, target)
+			}
+		}
+	}
+	if got, want := ConnResetf("tcp").Error(), "tcp: connection reset by peer"; got != want {
+		t.Errorf("unexpected message: got %q; want %q", got, want)
+	}
+}
+
+// newTracedError is the origin of the error in TestStackTrace.
+func newTracedError() error {
+	return Errorf("origin %v", 1)
+}
+
+func TestStackTrace(t *testing.T) {
+	if StackTrace(Annotate(newTracedError(), "annotation")) != nil {
+		t.Errorf("got stack trace with stack traces disabled")
+	}
+
+	SetStackTraces(true)
+	defer SetStackTraces(false)
+	err := Annotatef(Annotate(newTracedError(), "first"), "second")
+	if got, want := err.Error(), "second: first: origin 1"; got != want {
+		t.Errorf("unexpected message: got %q; want %q", got, want)
+	}
+	trace := StackTrace(err)
+	if len(trace) < 2 {
+		t.Fatalf("stack trace too short: %v", trace)
+	}
+	if !strings.HasSuffix(trace[0].Function, ".newTracedError") {
+		t.Errorf("unexpected origin: got %v; want newTracedError", trace[0].Function)
+	}
+	if !strings.HasSuffix(trace[1].Function, ".TestStackTrace") {
+		t.Errorf("unexpected caller of origin: got %v; want TestStackTrace", trace[1].Function)
+	}
+	if StackTrace(New("traced")) == nil {
+		t.Errorf("no stack trace from New")
+	}
+}
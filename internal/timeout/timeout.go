@@ -27,11 +27,11 @@ import (
 // cancelled, the daemon will then just release the lock without
 // doing any work). Thus, each timeout object has a cancel field.
 // When a timeout is cancelled, the goroutine doing the cancelling
-// atomically sets the cancel field to 1. Then, when the daemon
+// atomically sets the cancel field to cancelled. Then, when the daemon
 // wakes up from sleep, it atomically loads the cancel field. If the
-// field has been set to 1, then the daemon simply throws away the
-// timeout object, and waits for the next timeout. If the field is
-// still 0, the daemon acquires the global Conn lock (actually, it
+// field has been set to cancelled, then the daemon simply throws away
+// the timeout object, and waits for the next timeout. If the field is
+// still pending, the daemon acquires the global Conn lock (actually, it
 // releases the Daemon lock and then acquires the Conn lock and
 // then the Daemon lock (in that order) to avoid a deadlock
 // with another goroutine, having already acquired the Conn lock,
@@ -40,7 +40,7 @@ import (
 // cancel field and acquiring the Conn lock, another goroutine acquired
 // the Conn lock, did some work, and canceled the timeout. Thus, after
 // acquiring the Conn lock, the daemon must re-check the cancel field.
-// If the cancel field is 1, the daemon immediately releases the
+// If the cancel field is cancelled, the daemon immediately releases the
 // global Conn lock, throws the timeout away, and waits for the next
 // timeout.
 //
@@ -50,24 +50,83 @@ import (
 // acquires the global Conn lock, then the timeout's callback is
 // executed. In this case, it is the responsibility of the callback
 // to clear any record of the timeout from the Conn object.
+//
+// If a cancelled timeout were only thrown away once it reached the top
+// of the heap, timeouts which are scheduled far in the future and then
+// cancelled (as keepalive and idle timers often are) could accumulate
+// indefinitely. Thus, each timeout records its index in the heap, and
+// if Cancel can acquire the Daemon lock without blocking, it removes
+// the timeout from the heap immediately. Otherwise, it falls back to
+// setting the cancel field, and the daemon counts the cancelled
+// timeouts left in the heap; once they make up more than half of it,
+// AddTimeout rebuilds the heap without them.
 
 // A Timeout is a handle on a timeout which allows it to be cancelled.
 type Timeout struct {
-	f      func()
-	t      time.Time
-	cancel uint32 // 1 if cancelled, 0 otherwise; only access atomically
+	f func()
+	t time.Time
+	d *Daemon
+	// the index of the timeout in d.timeouts, or -1 if it isn't
+	// in the heap; only access with d.mu held
+	index int
+	// pending, cancelled, or done (the callback has been or will never
+	// be called); only access atomically
+	cancel uint32
+	// true if the Daemon had already been stopped when t was
+	// added; never modified after AddTimeout returns
+	dropped bool
 }
 
-// Cancel cancels t. The caller must acquire a lock on the locker used
-// to construct the related Daemon (in the call to NewDaemon) before
+// Cancel cancels t. The caller must acquire a lock on the locker used to
+// construct the related Daemon (in the call to NewDaemon or Init) before
 // calling Cancel. Otherwise, the behavior of Cancel is undefined.
+// Unless the daemon is busy, t is removed from it immediately.
 func (t *Timeout) Cancel() {
-	atomic.StoreUint32(&t.cancel, 1)
+	if !atomic.CompareAndSwapUint32(&t.cancel, pending, cancelled) {
+		return
+	}
+	d := t.d
+	if d.mu.TryLock() {
+		if t.index >= 0 {
+			heap.Remove(&d.timeouts, t.index)
+			d.reclaimed++
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+	}
+	// either the daemon has already popped t, and will
+	// throw it away, or it's busy; leave t to be thrown
+	// away or compacted
+	atomic.AddInt64(&d.cancelled, 1)
 }
 
+// Dropped returns true if t was added to a Daemon which had already been
+// stopped, in which case its callback will never be called. A caller which
+// would otherwise wait for the callback (for example, to tear down a
+// connection) can use this to detect that it must not.
+func (t *Timeout) Dropped() bool { return t.dropped }
+
+// the states of a Timeout
+const (
+	pending = iota
+	cancelled
+	done
+)
+
+// the minimum size of the heap before it is compacted
+const minCompactLen = 64
+
 // A Daemon is a handle on a daemon goroutine which allows for the scheduling
 // and execution of timeouts and their related callbacks.
 type Daemon struct {
+	// the number of cancelled timeouts in the heap, or which have
+	// been popped but not yet thrown away; only access atomically
+	cancelled int64
+	// the number of cancelled timeouts removed from
+	// the heap by Cancel or by compaction
+	reclaimed uint64
+
 	locker   sync.Locker
 	timeouts heapTimeouts
 	// used when len(timeouts) == 0 and the daemon needs to
@@ -99,25 +158,33 @@ type Daemon struct {
 	// if stopped == true.
 	stopped bool
 	mu      sync.Mutex
+	// closed when the daemon goroutine returns
+	done chan struct{}
 }
 
-// TODO(joshlf): Any way to make NewDaemon return a Daemon instead of a *Daemon?
-// It'd be better for locality to embed the Daemon directly in the Conn struct.
-// It would probably require something like an Init method instead of using
-// NewDaemon.
-
 // NewDaemon starts a new daemon and returns a handle to it.
 // A lock on locker will be acquired before any timeout's
 // callback is executed.
 func NewDaemon(locker sync.Locker) *Daemon {
-	d := &Daemon{locker: locker}
+	d := new(Daemon)
+	d.Init(locker)
+	return d
+}
+
+// Init is like NewDaemon, but starts the daemon using d, which must be the
+// zero value. This allows a Daemon to be embedded by value in another struct
+// (such as the one whose lock is locker) rather than allocated separately.
+// d must not be copied after Init has been called.
+func (d *Daemon) Init(locker sync.Locker) {
+	d.locker = locker
 	d.cond.L = &d.mu
 	d.wake = make(chan struct{}, 1)
+	d.done = make(chan struct{})
 	go d.daemon()
-	return d
 }
 
-// Stop stops d.
+// Stop stops d. No timeout callbacks are called once Stop has returned,
+// including those of timeouts which are added afterwards (see AddTimeout).
 func (d *Daemon) Stop() {
 	// NOTE(joshlf): Stop may return before the daemon goroutine
 	// has returned, but the goroutine will return eventually.
@@ -140,13 +207,34 @@ func (d *Daemon) Stop() {
 	d.mu.Unlock()
 }
 
+// StopAndWait stops d, and waits for the daemon goroutine to return. It must
+// not be called with a lock held on the locker passed to NewDaemon or Init,
+// since the daemon may be waiting to acquire it.
+func (d *Daemon) StopAndWait() {
+	d.Stop()
+	<-d.done
+}
+
 // AddTimeout schedules f to be called at time t, which must be calculated
 // relative to NowMonotonic (not time.Now). The returned *Timeout can be used
 // to cancel the timeout, in which case f will not be called. It is guaranteed
-//  that f will not be called before time t.
+// that f will not be called before time t. f is called with a lock held
+// on the locker passed to NewDaemon or Init, and may itself call AddTimeout.
+//
+// If d has been stopped, f will never be called; the returned Timeout's
+// Dropped method returns true, and it need not be cancelled.
 func (d *Daemon) AddTimeout(f func(), t time.Time) *Timeout {
-	to := &Timeout{f: f, t: t}
+	to := &Timeout{f: f, t: t, d: d, index: -1}
 	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		to.cancel = done
+		to.dropped = true
+		return to
+	}
+	if n := len(d.timeouts); n >= minCompactLen && atomic.LoadInt64(&d.cancelled) > int64(n/2) {
+		d.compact()
+	}
 	heap.Push(&d.timeouts, to)
 	if len(d.timeouts) == 1 {
 		// there were previously 0 which means that
@@ -161,7 +249,40 @@ func (d *Daemon) AddTimeout(f func(), t time.Time) *Timeout {
 	return to
 }
 
+// compact removes cancelled timeouts from the heap.
+// It must be called with d.mu held.
+func (d *Daemon) compact() {
+	live := d.timeouts[:0]
+	for _, to := range d.timeouts {
+		if atomic.LoadUint32(&to.cancel) != cancelled {
+			live = append(live, to)
+		}
+	}
+	removed := len(d.timeouts) - len(live)
+	for i := len(live); i < len(d.timeouts); i++ {
+		// allow the removed timeouts to be garbage collected
+		d.timeouts[i] = nil
+	}
+	d.timeouts = live
+	for i, to := range live {
+		to.index = i
+	}
+	heap.Init(&d.timeouts)
+	atomic.AddInt64(&d.cancelled, -int64(removed))
+	d.reclaimed += uint64(removed)
+}
+
+// Reclaimed returns the number of cancelled timeouts which have been removed
+// from d before they were due, either by Cancel or by compaction, rather than
+// when they were due.
+func (d *Daemon) Reclaimed() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reclaimed
+}
+
 func (d *Daemon) daemon() {
+	defer close(d.done)
 	for {
 		d.mu.Lock()
 		if d.stopped {
@@ -169,16 +290,18 @@ func (d *Daemon) daemon() {
 			return
 		}
 
-		if len(d.timeouts) == 0 {
-			// no timeouts; block until one is available
-			d.cond.Wait()
-			if d.stopped {
-				d.mu.Unlock()
-				return
+		for {
+			if len(d.timeouts) == 0 {
+				// no timeouts, possibly because Cancel removed
+				// them while we slept; block until one is available
+				d.cond.Wait()
+				if d.stopped {
+					d.mu.Unlock()
+					return
+				}
+				continue
 			}
-		}
 
-		for {
 			// loop until we're sure it's after to.t (to keep
 			// guarantee documented in d.AddTimeout)
 
@@ -203,7 +326,7 @@ func (d *Daemon) daemon() {
 		}
 
 		to := heap.Pop(&d.timeouts).(*Timeout)
-		if atomic.LoadUint32(&to.cancel) == 0 {
+		if atomic.LoadUint32(&to.cancel) == pending {
 			// it wasn't cancelled; we now have to release d.mu
 			// before acquiring d.locker in order to avoid a
 			// deadlock with another goroutine calling d.AddTimeout.
@@ -227,13 +350,20 @@ func (d *Daemon) daemon() {
 			// supposed to fire already, they will be handled
 			// in the next loop iteration.
 
-			if atomic.LoadUint32(&to.cancel) == 0 {
+			if atomic.LoadUint32(&to.cancel) == pending {
 				// it wasn't cancelled between checking to.cancel
-				// and acquiring d.locker
+				// and acquiring d.locker; release d.mu so that
+				// the callback can schedule new timeouts. Since
+				// we hold d.locker, it can't be cancelled now.
+				atomic.StoreUint32(&to.cancel, done)
+				d.mu.Unlock()
 				to.f()
+				d.locker.Unlock()
+				continue
 			}
 			d.locker.Unlock()
 		}
+		atomic.AddInt64(&d.cancelled, -1)
 		d.mu.Unlock()
 	}
 }
@@ -258,11 +388,21 @@ type heapTimeouts []*Timeout
 
 func (h *heapTimeouts) Len() int           { return len(*h) }
 func (h *heapTimeouts) Less(i, j int) bool { return (*h)[i].t.Before((*h)[j].t) }
-func (h *heapTimeouts) Swap(i, j int)      { (*h)[i], (*h)[j] = (*h)[j], (*h)[i] }
-func (h *heapTimeouts) Push(x interface{}) { *h = append(*h, x.(*Timeout)) }
+func (h *heapTimeouts) Swap(i, j int) {
+	(*h)[i], (*h)[j] = (*h)[j], (*h)[i]
+	(*h)[i].index = i
+	(*h)[j].index = j
+}
+func (h *heapTimeouts) Push(x interface{}) {
+	to := x.(*Timeout)
+	to.index = len(*h)
+	*h = append(*h, to)
+}
 func (h *heapTimeouts) Pop() interface{} {
 	x := (*h)[len(*h)-1]
+	(*h)[len(*h)-1] = nil
 	*h = (*h)[:len(*h)-1]
+	x.index = -1
 	return x
 }
 
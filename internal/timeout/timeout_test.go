@@ -0,0 +1,355 @@
+package timeout
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// NOTE(joshlf): Make sure to run this test with the race detector on
+
+func TestTimeout(t *testing.T) {
+	// The point of this test is to make sure that every timeout callback
+	// is called at most once, and those that are cancelled are never
+	// called.
+
+	var mu sync.Mutex
+	type timeoutTest struct {
+		calls     int
+		cancelled bool
+		f         func()
+	}
+	makeTimeoutTest := func() *timeoutTest {
+		var tt timeoutTest
+		tt.f = func() {
+			if tt.cancelled {
+				t.Fatalf("cancelled timeout callback called")
+			}
+			tt.calls++
+			if tt.calls > 1 {
+				t.Fatalf("timeout callback called more than once")
+			}
+		}
+		return &tt
+	}
+	timeoutTests := make(map[*timeoutTest]*Timeout)
+
+	// run the test for one second
+	end := NowMonotonic().Add(time.Second)
+	numgoroutines := 4 // minimum
+	if runtime.NumCPU() > numgoroutines {
+		numgoroutines = runtime.NumCPU()
+	}
+
+	daemon := NewDaemon(&mu)
+	var wg sync.WaitGroup
+	wg.Add(numgoroutines)
+	for i := 0; i < numgoroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				if NowMonotonic().After(end) {
+					return
+				}
+
+				if rand.Int()%100 == 0 {
+					// 1 in 100 chance of cancelling existing timeout;
+					// randomly pick one timeout and cancel it
+					mu.Lock()
+					for _, to := range timeoutTests {
+						to.Cancel()
+						break
+					}
+					mu.Unlock()
+				} else {
+					// 99 in 100 chance of spawning a new timeout
+					tt := makeTimeoutTest()
+					to := daemon.AddTimeout(tt.f, NowMonotonic().Add(time.Millisecond*10))
+					mu.Lock()
+					timeoutTests[tt] = to
+					mu.Unlock()
+				}
+
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestTimeoutOrder(t *testing.T) {
+	// The point of this test is to make sure that if a timeout is scheduled
+	// while the daemon is sleeping waiting for an existing timeout, and the
+	// newly-scheduled timeout precedes the timeout for on which the daemon
+	// is sleeping, the newly-scheduled timeout is executed first, and without
+	// an excessive delay.
+
+	var mu sync.Mutex
+	daemon := NewDaemon(&mu)
+
+	var counter int
+	now := NowMonotonic()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	getCallback := func(counterVal int, target time.Time) func() {
+		return func() {
+			defer wg.Done()
+			now := NowMonotonic()
+			counter++
+			if counter != counterVal {
+				t.Errorf("got unexpected counter value after increment: got %v; want %v", counter, counterVal)
+			}
+			if now.Sub(target) > 100*time.Millisecond {
+				t.Errorf("timeout execution delay too large: %v", now.Sub(target))
+			}
+		}
+	}
+	deadline := now.Add(300 * time.Millisecond)
+	daemon.AddTimeout(getCallback(2, deadline), deadline)
+	time.Sleep(10 * time.Millisecond) // give the daemon a chance to sleep on it
+	deadline = now.Add(100 * time.Millisecond)
+	daemon.AddTimeout(getCallback(1, deadline), deadline)
+	wg.Wait()
+}
+
+func TestTimeoutLiveness(t *testing.T) {
+	// The point of this test is to make sure that every non-cancelled
+	// timeout is eventually called
+
+	var mu sync.Mutex
+	daemon := NewDaemon(&mu)
+
+	// access the counter without synchronization
+	// from the timeout callbacks; this will give
+	// the race detector a chance to detect a race
+	// if the normal synchronization isn't functioning
+	// properly
+	var counter int
+	messages := make([]string, 0, 3)
+	var wg sync.WaitGroup
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		target := NowMonotonic().Add(time.Millisecond * 10 * time.Duration(i))
+		f := func() {
+			counter++
+			diff := NowMonotonic().Sub(target) // how late we were
+			if diff < 0 {
+				messages = append(messages, fmt.Sprintf("callback executed %v before target", diff))
+			} else {
+				messages = append(messages, fmt.Sprintf("callback executed %v after target", diff))
+			}
+			wg.Done()
+		}
+		daemon.AddTimeout(f, target)
+	}
+
+	wg.Wait()
+	if counter != 3 {
+		t.Errorf("unexpected counter: got %v; want %v", counter, 3)
+	}
+	for _, msg := range messages {
+		fmt.Println(msg)
+	}
+}
+
+func TestStopAndWait(t *testing.T) {
+	test := func(name string, add func(d *Daemon)) {
+		var mu sync.Mutex
+		daemon := NewDaemon(&mu)
+		add(daemon)
+		done := make(chan struct{})
+		go func() {
+			daemon.StopAndWait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v: StopAndWait didn't return", name)
+		}
+	}
+
+	// the daemon is waiting for a timeout to be added
+	test("idle", func(d *Daemon) {})
+	// the daemon is sleeping until the next timeout
+	test("sleeping", func(d *Daemon) {
+		d.AddTimeout(func() { t.Errorf("callback executed after StopAndWait") }, NowMonotonic().Add(time.Hour))
+	})
+}
+
+func TestAddTimeoutAfterStop(t *testing.T) {
+	var mu sync.Mutex
+	daemon := NewDaemon(&mu)
+	to := daemon.AddTimeout(func() {}, NowMonotonic().Add(time.Hour))
+	if to.Dropped() {
+		t.Errorf("timeout added before Stop reported dropped")
+	}
+	daemon.StopAndWait()
+
+	called := make(chan struct{}, 1)
+	to = daemon.AddTimeout(func() { called <- struct{}{} }, NowMonotonic())
+	if !to.Dropped() {
+		t.Errorf("timeout added after Stop not reported dropped")
+	}
+	select {
+	case <-called:
+		t.Errorf("callback of timeout added after Stop executed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	to.Cancel()
+}
+
+func TestCompaction(t *testing.T) {
+	// The point of this test is to make sure that timeouts which are
+	// scheduled far in the future and then cancelled don't accumulate
+	// in the heap.
+
+	var mu sync.Mutex
+	daemon := NewDaemon(&mu)
+	defer daemon.StopAndWait()
+
+	const rounds, perRound = 100, 100
+	for i := 0; i < rounds; i++ {
+		tos := make([]*Timeout, perRound)
+		for j := range tos {
+			tos[j] = daemon.AddTimeout(func() { t.Errorf("cancelled timeout callback called") }, NowMonotonic().Add(time.Hour))
+		}
+		// holding the daemon lock prevents Cancel from
+		// removing the timeouts from the heap itself
+		mu.Lock()
+		daemon.mu.Lock()
+		for _, to := range tos {
+			to.Cancel()
+			// cancelling again has no effect
+			to.Cancel()
+		}
+		daemon.mu.Unlock()
+		mu.Unlock()
+	}
+
+	daemon.mu.Lock()
+	n := len(daemon.timeouts)
+	daemon.mu.Unlock()
+	if n > 2*perRound+minCompactLen {
+		t.Errorf("heap not compacted: got %v timeouts; want at most %v", n, 2*perRound+minCompactLen)
+	}
+	if r, want := daemon.Reclaimed(), uint64(rounds*perRound-n); r != want {
+		t.Errorf("unexpected number of reclaimed timeouts: got %v; want %v", r, want)
+	}
+}
+
+func TestCancelRemoves(t *testing.T) {
+	// The point of this test is to make sure that Cancel removes
+	// timeouts from the heap, leaving it a valid heap, and that
+	// removed timeouts are never called.
+
+	var mu sync.Mutex
+	daemon := NewDaemon(&mu)
+	defer daemon.StopAndWait()
+
+	// checkHeap checks that the heap is valid, that each timeout
+	// knows its index, and that it contains no cancelled timeouts
+	checkHeap := func() {
+		daemon.mu.Lock()
+		defer daemon.mu.Unlock()
+		h := daemon.timeouts
+		for i, to := range h {
+			if to.index != i {
+				t.Fatalf("timeout at index %v has index %v", i, to.index)
+			}
+			if i > 0 && h.Less(i, (i-1)/2) {
+				t.Fatalf("timeout at index %v is before its parent", i)
+			}
+			if atomic.LoadUint32(&to.cancel) == cancelled {
+				t.Fatalf("cancelled timeout at index %v", i)
+			}
+		}
+	}
+
+	called := make(chan struct{}, 1)
+	f := func() {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+	}
+	mu.Lock()
+	base := NowMonotonic().Add(time.Hour)
+	var tos []*Timeout
+	for i := 0; i < 1000; i++ {
+		tos = append(tos, daemon.AddTimeout(f, base.Add(time.Duration(rand.Intn(1000))*time.Millisecond)))
+	}
+	// the soonest timeout is about to expire
+	soon := daemon.AddTimeout(f, NowMonotonic().Add(20*time.Millisecond))
+	mu.Unlock()
+	// give the daemon a chance to sleep on the soonest timeout
+	time.Sleep(5 * time.Millisecond)
+
+	mu.Lock()
+	soon.Cancel()
+	for _, i := range rand.Perm(len(tos))[:len(tos)/2] {
+		tos[i].Cancel()
+	}
+	mu.Unlock()
+	checkHeap()
+	select {
+	case <-called:
+		t.Fatalf("cancelled timeout callback called")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// once the heap has been emptied, timeouts still fire
+	mu.Lock()
+	for _, to := range tos {
+		to.Cancel()
+	}
+	mu.Unlock()
+	checkHeap()
+	mu.Lock()
+	daemon.AddTimeout(f, NowMonotonic())
+	mu.Unlock()
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout added after the heap was emptied wasn't called")
+	}
+}
+
+func TestInit(t *testing.T) {
+	// The point of this test is to make sure that a Daemon embedded by
+	// value and initialized with Init behaves like one from NewDaemon.
+
+	type embedder struct {
+		mu      sync.Mutex
+		daemon  Daemon
+		counter int
+	}
+	var e embedder
+	e.daemon.Init(&e.mu)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	e.mu.Lock()
+	e.daemon.AddTimeout(func() { e.counter++; wg.Done() }, NowMonotonic().Add(10*time.Millisecond))
+	cancelled := e.daemon.AddTimeout(func() { t.Errorf("cancelled timeout callback called") }, NowMonotonic().Add(10*time.Millisecond))
+	cancelled.Cancel()
+	e.mu.Unlock()
+	wg.Wait()
+
+	e.mu.Lock()
+	if e.counter != 1 {
+		t.Errorf("unexpected counter: got %v; want 1", e.counter)
+	}
+	e.mu.Unlock()
+
+	e.daemon.StopAndWait()
+	e.mu.Lock()
+	if to := e.daemon.AddTimeout(func() {}, NowMonotonic()); !to.Dropped() {
+		t.Errorf("timeout added after Stop not reported dropped")
+	}
+	e.mu.Unlock()
+}
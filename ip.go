@@ -1,6 +1,8 @@
 package net
 
 import (
+	"bytes"
+	"math/big"
 	"net"
 
 	"github.com/joshlf/net/internal/errors"
@@ -18,6 +20,30 @@ func (i IPv4) String() string {
 	return net.IP(i[:]).String()
 }
 
+// Next returns the address following i, wrapping
+// around from 255.255.255.255 to 0.0.0.0.
+func (i IPv4) Next() IP {
+	incBytes(i[:])
+	return i
+}
+
+// Add returns i plus n, which may be negative, wrapping
+// around at either end of the address space.
+func (i IPv4) Add(n *big.Int) IP {
+	addBytes(i[:], n)
+	return i
+}
+
+// Compare returns -1, 0, or 1 if i is less than, equal to, or greater than
+// other. IPv4 addresses are less than all IPv6 addresses.
+func (i IPv4) Compare(other IP) int {
+	o, ok := other.(IPv4)
+	if !ok {
+		return -1
+	}
+	return bytes.Compare(i[:], o[:])
+}
+
 // IPv6 is an IPv6 address
 type IPv6 [16]byte
 
@@ -30,10 +56,63 @@ func (i IPv6) String() string {
 	return net.IP(i[:]).String()
 }
 
+// Next returns the address following i, wrapping around
+// from ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff to ::.
+func (i IPv6) Next() IP {
+	incBytes(i[:])
+	return i
+}
+
+// Add returns i plus n, which may be negative, wrapping
+// around at either end of the address space.
+func (i IPv6) Add(n *big.Int) IP {
+	addBytes(i[:], n)
+	return i
+}
+
+// Compare returns -1, 0, or 1 if i is less than, equal to, or greater than
+// other. IPv6 addresses are greater than all IPv4 addresses.
+func (i IPv6) Compare(other IP) int {
+	o, ok := other.(IPv6)
+	if !ok {
+		return 1
+	}
+	return bytes.Compare(i[:], o[:])
+}
+
+// incBytes increments the big-endian integer b in
+// place, wrapping around to 0 if every bit is set.
+func incBytes(b []byte) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			// no carry
+			return
+		}
+	}
+}
+
+// addBytes adds n to the big-endian integer b in
+// place, modulo 2 to the power of b's length in bits.
+func addBytes(b []byte, n *big.Int) {
+	sum := new(big.Int).SetBytes(b)
+	sum.Add(sum, n)
+	// Mod returns the Euclidean modulus, which is never negative
+	sum.Mod(sum, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	sum.FillBytes(b)
+}
+
 // IP is an IPv4 or IPv6 address. It is only implemented by IPv4 and IPv6.
 type IP interface {
 	// IPVersion is the IP's version - 4 or 6.
 	IPVersion() int
+	// Next returns the following address of the same IP version.
+	Next() IP
+	// Add returns the address n after the IP, or before it if n is
+	// negative, of the same IP version.
+	Add(n *big.Int) IP
+	// Compare compares the IP to other, returning -1, 0, or 1.
+	Compare(other IP) int
 	isIP()
 }
 
@@ -80,6 +159,61 @@ func (sub IPv4Subnet) Has(addr IPv4) bool {
 	return addr == sub.Addr
 }
 
+// Contains is like Has, but it takes an address of either IP version, and
+// returns false if addr is IPv6. Unlike Has, it doesn't require the address
+// bits of sub which are not in the netmask to be zero.
+func (sub IPv4Subnet) Contains(addr IP) bool {
+	addr4, ok := addr.(IPv4)
+	if !ok {
+		return false
+	}
+	for i, b := range addr4 {
+		if b&sub.Netmask[i] != sub.Addr[i]&sub.Netmask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Network returns the network address of sub - its address with all
+// of the bits which are not in the netmask cleared.
+func (sub IPv4Subnet) Network() IP {
+	return canonicalSubnet(sub).(IPv4Subnet).Addr
+}
+
+// Broadcast returns the broadcast address of sub - its address with all of
+// the bits which are not in the netmask set.
+func (sub IPv4Subnet) Broadcast() IPv4 {
+	addr := sub.Addr
+	for i := range addr {
+		addr[i] |= ^sub.Netmask[i]
+	}
+	return addr
+}
+
+// NumHosts returns the number of host addresses in sub, which excludes the
+// network and broadcast addresses. /31 and /32 subnets have no network or
+// broadcast addresses, so all of their addresses are host addresses.
+// See https://tools.ietf.org/html/rfc3021
+func (sub IPv4Subnet) NumHosts() *big.Int {
+	n := numAddrs(sub, 32)
+	if two := big.NewInt(2); n.Cmp(two) > 0 {
+		n.Sub(n, two)
+	}
+	return n
+}
+
+// Hosts returns an iterator over the host addresses in sub (see NumHosts) in
+// ascending order. Each call returns the next address, or false once there
+// are none left.
+func (sub IPv4Subnet) Hosts() func() (IP, bool) {
+	first, last := sub.Network(), IP(sub.Broadcast())
+	if numAddrs(sub, 32).Cmp(big.NewInt(2)) > 0 {
+		first, last = first.Next(), last.Add(big.NewInt(-1))
+	}
+	return hostIterator(first, last)
+}
+
 // IPv6Subnet is an IPv6 address and subnet mask. NOTE: Because address bits
 // that are not in the netmask do not affect equality, it is not safe to
 // determine subnet equality by comparing two IPv6Subnets using ==. Instead,
@@ -120,11 +254,81 @@ func (sub IPv6Subnet) Has(addr IPv6) bool {
 	return addr == sub.Addr
 }
 
+// Contains is like Has, but it takes an address of either IP version, and
+// returns false if addr is IPv4. Unlike Has, it doesn't require the address
+// bits of sub which are not in the netmask to be zero.
+func (sub IPv6Subnet) Contains(addr IP) bool {
+	addr6, ok := addr.(IPv6)
+	if !ok {
+		return false
+	}
+	for i, b := range addr6 {
+		if b&sub.Netmask[i] != sub.Addr[i]&sub.Netmask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Network returns the network address of sub - its address with all
+// of the bits which are not in the netmask cleared.
+func (sub IPv6Subnet) Network() IP {
+	return canonicalSubnet(sub).(IPv6Subnet).Addr
+}
+
+// NumHosts returns the number of addresses in sub. IPv6 has no broadcast
+// addresses, so unlike with IPv4, every address is counted.
+func (sub IPv6Subnet) NumHosts() *big.Int {
+	return numAddrs(sub, 128)
+}
+
+// Hosts returns an iterator over the addresses in sub (see NumHosts) in
+// ascending order. Each call returns the next address, or false once there
+// are none left.
+func (sub IPv6Subnet) Hosts() func() (IP, bool) {
+	last := sub.Addr
+	for i := range last {
+		last[i] |= ^sub.Netmask[i]
+	}
+	return hostIterator(sub.Network(), last)
+}
+
+// hostIterator returns an iterator over the addresses from first to last,
+// inclusive. The iterator stops after last rather than when the addresses
+// wrap around, so the whole address space can be iterated over.
+func hostIterator(first, last IP) func() (IP, bool) {
+	next, done := first, false
+	return func() (IP, bool) {
+		if done {
+			return nil, false
+		}
+		ip := next
+		done = ip.Compare(last) == 0
+		next = ip.Next()
+		return ip, true
+	}
+}
+
+// numAddrs returns the number of addresses in sub,
+// whose addresses are bits bits long.
+func numAddrs(sub IPSubnet, bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-prefixLen(sub)))
+}
+
 // IPSubnet is an IPv4 or IPv6 subnet. It is only implemented by IPv4Subnet and
 // IPv6Subnet.
 type IPSubnet interface {
 	// IPVersion returns the subnet's IP version - 4 or 6.
 	IPVersion() int
+	// Contains returns true if addr is in the subnet. If addr is not of
+	// the subnet's IP version, it returns false.
+	Contains(addr IP) bool
+	// Network returns the subnet's network address.
+	Network() IP
+	// NumHosts returns the number of host addresses in the subnet.
+	NumHosts() *big.Int
+	// Hosts returns an iterator over the subnet's host addresses.
+	Hosts() func() (IP, bool)
 	isIPSubnet()
 }
 
@@ -8,48 +8,114 @@ type IPv4Host interface {
 	AddIPv4Device(dev IPv4Device)
 	RemoveIPv4Device(dev IPv4Device)
 	RegisterIPv4Callback(f func(b []byte, src, dst IPv4), proto IPProtocol)
+	RegisterIPv4InfoCallback(f func(b []byte, src, dst IPv4, info PacketInfo), proto IPProtocol)
 	AddIPv4Route(subnet IPv4Subnet, nexthop IPv4)
 	AddIPv4DeviceRoute(subnet IPv4Subnet, dev IPv4Device)
+	DeleteIPv4Route(subnet IPv4Subnet)
 	IPv4Routes() []IPv4Route
 	IPv4DeviceRoutes() []IPv4DeviceRoute
 	SetForwarding(on bool)
 	Forwarding() bool
 	WriteToIPv4(b []byte, addr IPv4, proto IPProtocol) (n int, err error)
+	WriteToIPv4From(b []byte, src, addr IPv4, proto IPProtocol) (n int, err error)
+	RegisterIPv4UnreachableCallback(f func(code UnreachableCode, b []byte, src, dst IPv4), proto IPProtocol)
+	WriteIPv4Unreachable(code UnreachableCode, b []byte, src, dst IPv4, proto IPProtocol) error
+	RegisterIPv4PathMTUCallback(f func(mtu int, b []byte, src, dst IPv4), proto IPProtocol)
+	IPv4PathMTU(addr IPv4) int
+	IPv4SourceAddr(addr IPv4) (IPv4, error)
+	JoinIPv4Group(dev IPv4Device, group IPv4) error
+	LeaveIPv4Group(dev IPv4Device, group IPv4) error
 
 	// SetTTL sets the TTL for all outoing packets. If ttl is 0, a default TTL
 	// will be used.
 	SetTTL(ttl uint8)
+	// SetDontFragment sets whether the DF flag is set on all outgoing packets.
+	SetDontFragment(on bool)
+	// SetBroadcast sets whether packets may be sent to broadcast addresses.
+	SetBroadcast(on bool)
+	// SetDSCP sets the DSCP for all outgoing packets. It is an error if dscp
+	// does not fit in 6 bits.
+	SetDSCP(dscp uint8) error
+	// SetECN sets the ECN codepoint for all outgoing packets. It is an
+	// error if ecn does not fit in 2 bits.
+	SetECN(ecn uint8) error
 
 	// GetConfigCopyIPv4 returns an IPv4Host which is simply a wrapper around
 	// the original host, but which allows setting configuration values
 	// without setting those values on the original host. In particular, all
-	// methods except for SetTTL operate directly on the original host.
+	// methods except for SetTTL, SetDontFragment, SetBroadcast, SetDSCP, and
+	// SetECN operate directly on the original host.
 	GetConfigCopyIPv4() IPv4Host
 }
 
 type IPv6Host interface {
 	AddIPv6Device(dev IPv6Device)
 	RemoveIPv6Device(dev IPv6Device)
+	JoinIPv6Group(dev IPv6Device, group IPv6) error
+	LeaveIPv6Group(dev IPv6Device, group IPv6) error
 	RegisterIPv6Callback(f func(b []byte, src, dst IPv6), proto IPProtocol)
+	RegisterIPv6InfoCallback(f func(b []byte, src, dst IPv6, info PacketInfo), proto IPProtocol)
 	AddIPv6Route(subnet IPv6Subnet, nexthop IPv6)
 	AddIPv6DeviceRoute(subnet IPv6Subnet, dev IPv6Device)
+	DeleteIPv6Route(subnet IPv6Subnet)
 	IPv6Routes() []IPv6Route
 	IPv6DeviceRoutes() []IPv6DeviceRoute
 	SetForwarding(on bool)
 	Forwarding() bool
 	WriteToIPv6(b []byte, addr IPv6, proto IPProtocol) (n int, err error)
+	WriteToIPv6From(b []byte, src, addr IPv6, proto IPProtocol) (n int, err error)
+	RegisterIPv6UnreachableCallback(f func(code UnreachableCode, b []byte, src, dst IPv6), proto IPProtocol)
+	WriteIPv6Unreachable(code UnreachableCode, b []byte, src, dst IPv6, proto IPProtocol) error
+	IPv6SourceAddr(addr IPv6) (IPv6, error)
+	IPv6PathMTU(addr IPv6) int
 
 	// SetTTL sets the TTL for all outoing packets. If ttl is 0, a default TTL
 	// will be used.
 	SetTTL(ttl uint8)
+	// SetDSCP sets the DSCP for all outgoing packets. It is an error if dscp
+	// does not fit in 6 bits.
+	SetDSCP(dscp uint8) error
+	// SetECN sets the ECN codepoint for all outgoing packets. It is an
+	// error if ecn does not fit in 2 bits.
+	SetECN(ecn uint8) error
 
 	// GetConfigCopyIPv6 returns an IPv6Host which is simply a wrapper around
 	// the original host, but which allows setting configuration values
 	// without setting those values on the original host. In particular, all
-	// methods except for SetTTL operate directly on the original host.
+	// methods except for SetTTL, SetDSCP, and SetECN operate directly on the
+	// original host.
 	GetConfigCopyIPv6() IPv6Host
 }
 
+// PacketInfo holds fields from the header of a received packet which
+// are not otherwise passed to callbacks.
+type PacketInfo struct {
+	// TTL is the IPv4 TTL or IPv6 hop limit.
+	TTL uint8
+	// DSCP is the differentiated services codepoint - the upper 6 bits of
+	// the IPv4 type of service or IPv6 traffic class field.
+	DSCP uint8
+	// ECN is the ECN codepoint - the lower 2 bits of the IPv4 type of
+	// service or IPv6 traffic class field.
+	ECN uint8
+	// Device is the device on which the packet was received.
+	Device Device
+}
+
+// ECN codepoints, which indicate whether the endpoints of a packet's
+// transport protocol support ECN, and if so, whether a router has marked
+// the packet to indicate congestion.
+// See https://tools.ietf.org/html/rfc3168#section-5
+const (
+	ECNNotECT = 0 // the transport isn't ECN-capable
+	ECNECT1   = 1 // ECN-capable transport
+	ECNECT0   = 2 // ECN-capable transport
+	ECNCE     = 3 // congestion experienced
+
+	// the largest ECN codepoint, which is 2 bits
+	maxECN = 3
+)
+
 type IPHost struct {
 	IPv4Host
 	IPv6Host
@@ -78,6 +144,18 @@ func (host *IPHost) RegisterCallback(f func(b []byte, src, dst IP), proto IPProt
 	host.IPv6Host.RegisterIPv6Callback(func(b []byte, src, dst IPv6) { f(b, src, dst) }, proto)
 }
 
+// RegisterInfoCallback is like RegisterCallback, but f is also passed
+// information from the header of the packet.
+func (host *IPHost) RegisterInfoCallback(f func(b []byte, src, dst IP, info PacketInfo), proto IPProtocol) {
+	host.IPv4Host.RegisterIPv4InfoCallback(func(b []byte, src, dst IPv4, info PacketInfo) { f(b, src, dst, info) }, proto)
+	host.IPv6Host.RegisterIPv6InfoCallback(func(b []byte, src, dst IPv6, info PacketInfo) { f(b, src, dst, info) }, proto)
+}
+
+func (host *IPHost) RegisterUnreachableCallback(f func(code UnreachableCode, b []byte, src, dst IP), proto IPProtocol) {
+	host.IPv4Host.RegisterIPv4UnreachableCallback(func(code UnreachableCode, b []byte, src, dst IPv4) { f(code, b, src, dst) }, proto)
+	host.IPv6Host.RegisterIPv6UnreachableCallback(func(code UnreachableCode, b []byte, src, dst IPv6) { f(code, b, src, dst) }, proto)
+}
+
 func (host *IPHost) AddRoute(subnet IPSubnet, nexthop IP) error {
 	if subnet.IPVersion() != nexthop.IPVersion() {
 		return errors.New("add route: mixed IP subnet and next hop versions")
@@ -109,6 +187,59 @@ func (host *IPHost) AddDeviceRoute(subnet IPSubnet, dev Device) error {
 	return nil
 }
 
+// DeleteRoute deletes the route or device route for subnet, if any.
+func (host *IPHost) DeleteRoute(subnet IPSubnet) {
+	switch subnet := subnet.(type) {
+	case IPv4Subnet:
+		host.IPv4Host.DeleteIPv4Route(subnet)
+	case IPv6Subnet:
+		host.IPv6Host.DeleteIPv6Route(subnet)
+	}
+}
+
+// JoinGroup joins the multicast group on dev, so that packets addressed to the
+// group which are received on dev are delivered to the registered callbacks.
+// Packets addressed to groups which haven't been joined are dropped.
+func (host *IPHost) JoinGroup(dev Device, group IP) error {
+	switch group := group.(type) {
+	case IPv4:
+		dev4, ok := dev.(IPv4Device)
+		if !ok {
+			return errors.New("join group: IPv4 group with non-IPv4-enabled device")
+		}
+		return host.IPv4Host.JoinIPv4Group(dev4, group)
+	case IPv6:
+		dev6, ok := dev.(IPv6Device)
+		if !ok {
+			return errors.New("join group: IPv6 group with non-IPv6-enabled device")
+		}
+		return host.IPv6Host.JoinIPv6Group(dev6, group)
+	default:
+		panic("unreachable")
+	}
+}
+
+// LeaveGroup leaves the multicast group on dev. It is an error if the group
+// hasn't been joined on dev.
+func (host *IPHost) LeaveGroup(dev Device, group IP) error {
+	switch group := group.(type) {
+	case IPv4:
+		dev4, ok := dev.(IPv4Device)
+		if !ok {
+			return errors.New("leave group: IPv4 group with non-IPv4-enabled device")
+		}
+		return host.IPv4Host.LeaveIPv4Group(dev4, group)
+	case IPv6:
+		dev6, ok := dev.(IPv6Device)
+		if !ok {
+			return errors.New("leave group: IPv6 group with non-IPv6-enabled device")
+		}
+		return host.IPv6Host.LeaveIPv6Group(dev6, group)
+	default:
+		panic("unreachable")
+	}
+}
+
 func (host *IPHost) SetForwarding(on bool) {
 	host.IPv4Host.SetForwarding(on)
 	host.IPv6Host.SetForwarding(on)
@@ -125,11 +256,50 @@ func (host *IPHost) WriteTo(b []byte, addr IP, proto IPProtocol) (n int, err err
 	}
 }
 
+// WriteToFrom is like WriteTo, but the packet is sent from src, which must be
+// the address of one of host's devices, of the same IP version as addr. If src
+// is nil, it is equivalent to WriteTo.
+func (host *IPHost) WriteToFrom(b []byte, src, addr IP, proto IPProtocol) (n int, err error) {
+	if src != nil && src.IPVersion() != addr.IPVersion() {
+		return 0, errors.New("write packet: mixed source and destination IP versions")
+	}
+	switch addr := addr.(type) {
+	case IPv4:
+		var src4 IPv4
+		if src != nil {
+			src4 = src.(IPv4)
+		}
+		return host.IPv4Host.WriteToIPv4From(b, src4, addr, proto)
+	case IPv6:
+		var src6 IPv6
+		if src != nil {
+			src6 = src.(IPv6)
+		}
+		return host.IPv6Host.WriteToIPv6From(b, src6, addr, proto)
+	default:
+		panic("unreachable")
+	}
+}
+
 func (host *IPHost) SetTTL(ttl uint8) {
 	host.IPv4Host.SetTTL(ttl)
 	host.IPv6Host.SetTTL(ttl)
 }
 
+func (host *IPHost) SetDSCP(dscp uint8) error {
+	if err := host.IPv4Host.SetDSCP(dscp); err != nil {
+		return err
+	}
+	return host.IPv6Host.SetDSCP(dscp)
+}
+
+func (host *IPHost) SetECN(ecn uint8) error {
+	if err := host.IPv4Host.SetECN(ecn); err != nil {
+		return err
+	}
+	return host.IPv6Host.SetECN(ecn)
+}
+
 func (host *IPHost) GetConfigCopy() *IPHost {
 	return &IPHost{
 		IPv4Host: host.IPv4Host.GetConfigCopyIPv4(),
@@ -1,6 +1,7 @@
 package net
 
 import (
+	"math/big"
 	"testing"
 )
 
@@ -55,3 +56,251 @@ func TestIPv6Packet(t *testing.T) {
 		t.Error("Parsed IPv6 packet isn't equivalent to input")
 	}
 }
+
+func TestDSCP(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	const dscp = 46   // expedited forwarding
+	a, _, deva, recv := newTestIPv4HostPair(1500, proto)
+	var tos byte
+	deva.drop = func(b []byte) bool {
+		tos = b[1]
+		return false
+	}
+	if err := a.SetDSCP(64); err == nil {
+		t.Errorf("no error setting DSCP which exceeds 6 bits")
+	}
+	if err := a.SetDSCP(dscp); err != nil {
+		t.Fatalf("unexpected error setting DSCP: %v", err)
+	}
+	if _, err := a.WriteToIPv4([]byte("hello"), IPv4{10, 0, 0, 2}, proto); err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	<-recv
+	if tos != dscp<<2 {
+		t.Errorf("unexpected type of service: got %#x; want %#x", tos, dscp<<2)
+	}
+
+	// the DSCP and ECN bits are encoded independently
+	buf := make([]byte, 40)
+	writeIPv4Header(&ipv4Header{version: 4, IHL: 5, DSCP: dscp, ECN: 1}, buf)
+	if buf[1] != dscp<<2|1 {
+		t.Errorf("unexpected encoded IPv4 type of service: got %#x; want %#x", buf[1], dscp<<2|1)
+	}
+	writeIPv6Header(&ipv6Header{version: 6, trafficClass: dscp<<2 | 1}, buf)
+	var hdr ipv6Header
+	readIPv6Header(&hdr, buf)
+	if hdr.trafficClass>>2 != dscp || hdr.trafficClass&3 != 1 {
+		t.Errorf("unexpected decoded IPv6 traffic class: got %#x; want %#x", hdr.trafficClass, dscp<<2|1)
+	}
+}
+
+func TestECN(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	a, b, deva, _ := newTestIPv4HostPair(1500, proto)
+	var tos byte
+	deva.drop = func(b []byte) bool {
+		tos = b[1]
+		return false
+	}
+	info := make(chan PacketInfo, 1)
+	b.RegisterIPv4InfoCallback(func(b []byte, src, dst IPv4, i PacketInfo) { info <- i }, proto)
+	a.SetDSCP(46)
+	if err := a.SetECN(4); err == nil {
+		t.Errorf("no error setting ECN which exceeds 2 bits")
+	}
+	if err := a.SetECN(ECNECT0); err != nil {
+		t.Fatalf("unexpected error setting ECN: %v", err)
+	}
+	if _, err := a.WriteToIPv4([]byte("hello"), IPv4{10, 0, 0, 2}, proto); err != nil {
+		t.Fatalf("unexpected error writing packet: %v", err)
+	}
+	if tos != 46<<2|ECNECT0 {
+		t.Errorf("unexpected type of service: got %#x; want %#x", tos, 46<<2|ECNECT0)
+	}
+	if i := <-info; i.ECN != ECNECT0 || i.DSCP != 46 {
+		t.Errorf("unexpected packet info: got %+v; want DSCP 46 and ECN %v", i, ECNECT0)
+	}
+
+	// a copy's ECN codepoint is independent of the original's
+	c := a.GetConfigCopyIPv4()
+	c.SetECN(ECNNotECT)
+	a.WriteToIPv4([]byte("hello"), IPv4{10, 0, 0, 2}, proto)
+	if i := <-info; i.ECN != ECNECT0 {
+		t.Errorf("unexpected ECN after setting copy's ECN: got %v; want %v", i.ECN, ECNECT0)
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	pow2 := func(n uint) *big.Int { return new(big.Int).Lsh(big.NewInt(1), n) }
+	for _, c := range []struct {
+		cidr      string
+		network   string
+		broadcast string // IPv4 only
+		numHosts  *big.Int
+		in, out   []string
+	}{
+		{"192.0.2.77/24", "192.0.2.0", "192.0.2.255", big.NewInt(254),
+			[]string{"192.0.2.0", "192.0.2.1", "192.0.2.255"},
+			[]string{"192.0.3.0", "192.0.1.255", "2001:db8::1"}},
+		{"192.0.2.5/31", "192.0.2.4", "192.0.2.5", big.NewInt(2),
+			[]string{"192.0.2.4", "192.0.2.5"},
+			[]string{"192.0.2.3", "192.0.2.6"}},
+		{"192.0.2.5/32", "192.0.2.5", "192.0.2.5", big.NewInt(1),
+			[]string{"192.0.2.5"},
+			[]string{"192.0.2.4", "192.0.2.6"}},
+		{"192.0.2.5/0", "0.0.0.0", "255.255.255.255", big.NewInt(1<<32 - 2),
+			[]string{"0.0.0.0", "192.0.2.5", "255.255.255.255"},
+			[]string{"::", "2001:db8::1"}},
+		{"2001:db8::1/64", "2001:db8::", "", pow2(64),
+			[]string{"2001:db8::", "2001:db8::ffff:ffff:ffff:ffff"},
+			[]string{"2001:db8:0:1::", "192.0.2.1"}},
+		{"2001:db8::5/127", "2001:db8::4", "", big.NewInt(2),
+			[]string{"2001:db8::4", "2001:db8::5"},
+			[]string{"2001:db8::3", "2001:db8::6"}},
+		{"2001:db8::5/128", "2001:db8::5", "", big.NewInt(1),
+			[]string{"2001:db8::5"},
+			[]string{"2001:db8::4", "2001:db8::6"}},
+		{"::/0", "::", "", pow2(128),
+			[]string{"::", "2001:db8::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+			[]string{"0.0.0.0"}},
+	} {
+		ip, sub, err := ParseCIDR(c.cidr)
+		if err != nil {
+			t.Fatalf("%v: unexpected error parsing: %v", c.cidr, err)
+		}
+		// ParseCIDR returns the canonical subnet, but
+		// the methods shouldn't depend on it
+		switch s := sub.(type) {
+		case IPv4Subnet:
+			s.Addr = ip.(IPv4)
+			sub = s
+			if got := s.Broadcast().String(); got != c.broadcast {
+				t.Errorf("%v: unexpected broadcast address: got %v; want %v", c.cidr, got, c.broadcast)
+			}
+		case IPv6Subnet:
+			s.Addr = ip.(IPv6)
+			sub = s
+		}
+		if got := ipString(sub.Network()); got != c.network {
+			t.Errorf("%v: unexpected network address: got %v; want %v", c.cidr, got, c.network)
+		}
+		if got := sub.NumHosts(); got.Cmp(c.numHosts) != 0 {
+			t.Errorf("%v: unexpected number of hosts: got %v; want %v", c.cidr, got, c.numHosts)
+		}
+		for _, s := range c.in {
+			if ip, _ := ParseIP(s); !sub.Contains(ip) {
+				t.Errorf("%v: does not contain %v", c.cidr, s)
+			}
+		}
+		for _, s := range c.out {
+			if ip, _ := ParseIP(s); sub.Contains(ip) {
+				t.Errorf("%v: unexpectedly contains %v", c.cidr, s)
+			}
+		}
+	}
+}
+
+func TestIPArithmetic(t *testing.T) {
+	parse := func(s string) IP {
+		ip, err := ParseIP(s)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %v: %v", s, err)
+		}
+		return ip
+	}
+	bigInt := func(s string) *big.Int {
+		n, _ := new(big.Int).SetString(s, 0)
+		return n
+	}
+
+	for _, c := range []struct{ ip, next string }{
+		{"192.0.2.1", "192.0.2.2"},
+		{"192.0.2.255", "192.0.3.0"},
+		{"10.255.255.255", "11.0.0.0"},
+		{"255.255.255.255", "0.0.0.0"},
+		{"2001:db8::ffff", "2001:db8::1:0"},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", "2001:db9::"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "::"},
+	} {
+		if got := ipString(parse(c.ip).Next()); got != c.next {
+			t.Errorf("unexpected address after %v: got %v; want %v", c.ip, got, c.next)
+		}
+	}
+
+	for _, c := range []struct {
+		ip  string
+		n   *big.Int
+		sum string
+	}{
+		{"192.0.2.1", big.NewInt(0), "192.0.2.1"},
+		{"192.0.2.1", big.NewInt(256), "192.0.3.1"},
+		{"192.0.2.1", big.NewInt(-2), "192.0.1.255"},
+		{"0.0.0.1", big.NewInt(-2), "255.255.255.255"},
+		{"255.255.255.255", big.NewInt(1 << 32), "255.255.255.255"},
+		{"2001:db8::", bigInt("0x10000000000000000"), "2001:db8:0:1::"},
+		{"::", big.NewInt(-1), "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+	} {
+		if got := ipString(parse(c.ip).Add(c.n)); got != c.sum {
+			t.Errorf("unexpected sum of %v and %v: got %v; want %v", c.ip, c.n, got, c.sum)
+		}
+	}
+
+	for _, c := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"192.0.2.1", "192.0.2.1", 0},
+		{"192.0.2.1", "192.0.2.2", -1},
+		{"192.0.3.0", "192.0.2.255", 1},
+		{"255.255.255.255", "::", -1},
+		{"::", "0.0.0.0", 1},
+		{"2001:db8::1", "2001:db8::1", 0},
+		{"2001:db8::1:0", "2001:db8::ffff", 1},
+	} {
+		if got := parse(c.a).Compare(parse(c.b)); got != c.cmp {
+			t.Errorf("unexpected comparison of %v and %v: got %v; want %v", c.a, c.b, got, c.cmp)
+		}
+	}
+}
+
+func TestSubnetHosts(t *testing.T) {
+	for _, c := range []struct {
+		cidr        string
+		first, last string
+	}{
+		{"192.0.2.8/29", "192.0.2.9", "192.0.2.14"},
+		{"192.0.2.255/23", "192.0.2.1", "192.0.3.254"},
+		{"192.0.2.5/31", "192.0.2.4", "192.0.2.5"},
+		{"192.0.2.5/32", "192.0.2.5", "192.0.2.5"},
+		{"2001:db8::/120", "2001:db8::", "2001:db8::ff"},
+		{"2001:db8::5/127", "2001:db8::4", "2001:db8::5"},
+		{"2001:db8::5/128", "2001:db8::5", "2001:db8::5"},
+	} {
+		_, sub, _ := ParseCIDR(c.cidr)
+		hosts := sub.Hosts()
+		var first, last, prev IP
+		var n int64
+		for ip, ok := hosts(); ok; ip, ok = hosts() {
+			if !sub.Contains(ip) {
+				t.Errorf("%v: iterated over %v, which isn't in the subnet", c.cidr, ip)
+			}
+			if prev != nil && ip.Compare(prev) != 1 {
+				t.Errorf("%v: %v iterated over after %v", c.cidr, ip, prev)
+			}
+			if first == nil {
+				first = ip
+			}
+			last, prev = ip, ip
+			n++
+		}
+		if ipString(first) != c.first || ipString(last) != c.last {
+			t.Errorf("%v: unexpected first and last hosts: got %v and %v; want %v and %v", c.cidr, first, last, c.first, c.last)
+		}
+		if want := sub.NumHosts(); want.Cmp(big.NewInt(n)) != 0 {
+			t.Errorf("%v: unexpected number of hosts: got %v; want %v", c.cidr, n, want)
+		}
+		if _, ok := hosts(); ok {
+			t.Errorf("%v: iterator continued after the last host", c.cidr)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package net
+
+import "github.com/joshlf/net/internal/errors"
+
+const (
+	// flags in the IPv4 header
+	ipv4FlagDF = 0x2 // don't fragment
+	ipv4FlagMF = 0x1 // more fragments
+
+	// the maximum length of an IPv4 payload (without options)
+	maxIPv4Payload = 0xFFFF - 20
+
+	// See https://tools.ietf.org/html/rfc791#page-15
+	ipv4OptionEOL    = 0    // end of option list
+	ipv4OptionNOP    = 1    // no operation
+	ipv4OptionCopied = 0x80 // set in the types of options copied into every fragment
+)
+
+// fragmentIPv4 splits the payload b, which is to be sent with the header hdr
+// and the options opts, into packets which fit within mtu. The header of each
+// packet is a copy of hdr with the length and fragmentation fields updated.
+// The first packet carries all of opts, and the rest carry only the options
+// which are copied into every fragment. If hdr is itself the header of a
+// fragment (that is, it has a non-zero offset or the MF flag set), the
+// resulting fragments are fragments of the original datagram. If caps, the
+// capabilities of the device the fragments will be written to, includes
+// TxChecksumOffload, their header checksums are left zero.
+// See https://tools.ietf.org/html/rfc791#page-26
+func fragmentIPv4(hdr ipv4Header, opts, b []byte, mtu int, caps DeviceCaps) ([][]byte, error) {
+	if hdr.flags&ipv4FlagDF != 0 {
+		return nil, errors.MTUf(mtu, "fragment IPv4 packet: don't fragment flag set")
+	}
+	// every fragment except the last must carry
+	// a multiple of 8 bytes of payload; the first
+	// has the most options, and so the least room
+	if (mtu-20-len(opts))&^7 <= 0 {
+		return nil, errors.MTUf(mtu, "fragment IPv4 packet: MTU too small")
+	}
+
+	copied := copiedIPv4Options(opts)
+	more := hdr.flags&ipv4FlagMF != 0
+	off := hdr.fragOff
+	var pkts [][]byte
+	for len(b) > 0 {
+		hdrlen := 20 + len(opts)
+		max := (mtu - hdrlen) &^ 7
+		n := len(b)
+		hdr.flags &^= ipv4FlagMF
+		if n > max {
+			n = max
+			hdr.flags |= ipv4FlagMF
+		} else if more {
+			// the last fragment of a fragment isn't
+			// necessarily the last of the datagram
+			hdr.flags |= ipv4FlagMF
+		}
+		hdr.IHL = uint8(hdrlen / 4)
+		hdr.len = uint16(hdrlen + n)
+		hdr.fragOff = off
+		pkt := make([]byte, int(hdr.len))
+		copy(pkt[20:], opts)
+		encodeIPv4Header(&hdr, pkt, caps)
+		copy(pkt[hdrlen:], b[:n])
+		pkts = append(pkts, pkt)
+		b = b[n:]
+		off += uint16(n / 8)
+		opts = copied
+	}
+	return pkts, nil
+}
+
+// copiedIPv4Options returns the options in opts which are copied into every
+// fragment, padded to a multiple of 4 bytes. Parsing stops at the end of the
+// option list or at the first malformed option.
+func copiedIPv4Options(opts []byte) []byte {
+	var copied []byte
+	for len(opts) > 0 && opts[0] != ipv4OptionEOL {
+		if opts[0] == ipv4OptionNOP {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		n := int(opts[1])
+		if opts[0]&ipv4OptionCopied != 0 {
+			copied = append(copied, opts[:n]...)
+		}
+		opts = opts[n:]
+	}
+	for len(copied)%4 != 0 {
+		copied = append(copied, ipv4OptionEOL)
+	}
+	return copied
+}
+
+// isIPv4Fragment returns true if hdr is the header of a fragment
+// rather than of a complete datagram.
+func isIPv4Fragment(hdr *ipv4Header) bool {
+	return hdr.flags&ipv4FlagMF != 0 || hdr.fragOff != 0
+}
+
+type ipv4FragmentKey struct {
+	src, dst IPv4
+	proto    IPProtocol
+	id       uint16
+}
+
+// An ipv4Reassembler reassembles fragmented IPv4 datagrams. The zero value
+// ipv4Reassembler is a valid ipv4Reassembler using defaultReassemblyTimeout.
+type ipv4Reassembler struct {
+	reassembler
+}
+
+// add adds the fragment with the header hdr and the payload b. If it completes
+// a datagram, the datagram's payload is returned.
+func (r *ipv4Reassembler) add(hdr *ipv4Header, b []byte) (payload []byte, ok bool) {
+	key := ipv4FragmentKey{src: hdr.src, dst: hdr.dst, proto: hdr.proto, id: hdr.id}
+	return r.reassembler.add(key, int(hdr.fragOff)*8, hdr.flags&ipv4FlagMF != 0, b, maxIPv4Payload, nil)
+}
@@ -0,0 +1,99 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestIPv4Fragmentation(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	a, b, deva, recv := newTestIPv4HostPair(1280, proto)
+	var frags int
+	deva.drop = func(b []byte) bool { frags++; return false }
+
+	payload := make([]byte, 4096)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	n, err := a.WriteToIPv4(payload, IPv4{10, 0, 0, 2}, proto)
+	if n != len(payload) || err != nil {
+		t.Fatalf("unexpected result from WriteToIPv4: (%v, %v); want (%v, <nil>)", n, err, len(payload))
+	}
+	// each fragment carries (1280-20)&^7 = 1256 bytes
+	if frags != 4 {
+		t.Errorf("unexpected number of fragments: got %v; want 4", frags)
+	}
+	select {
+	case got := <-recv:
+		if !bytes.Equal(got, payload) {
+			t.Errorf("reassembled payload differs from original")
+		}
+	default:
+		t.Fatalf("datagram wasn't reassembled")
+	}
+	if n := b.frags.pending(); n != 0 {
+		t.Errorf("unexpected number of pending reassemblies: got %v; want 0", n)
+	}
+}
+
+func TestIPv4ReassemblyTimeout(t *testing.T) {
+	const proto = 253
+	a, b, deva, recv := newTestIPv4HostPair(1280, proto)
+	b.frags.timeout = 10 * time.Millisecond
+
+	// drop the last fragment
+	var last []byte
+	deva.drop = func(b []byte) bool {
+		var hdr ipv4Header
+		readIPv4Header(&hdr, b)
+		if hdr.flags&ipv4FlagMF == 0 {
+			last = append([]byte(nil), b...)
+			return true
+		}
+		return false
+	}
+	a.WriteToIPv4(make([]byte, 4096), IPv4{10, 0, 0, 2}, proto)
+	if n := b.frags.pending(); n != 1 {
+		t.Fatalf("unexpected number of pending reassemblies: got %v; want 1", n)
+	}
+	for start := time.Now(); b.frags.pending() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("incomplete datagram not discarded after timeout")
+		}
+	}
+
+	// the last fragment alone can't complete the datagram
+	deva.drop = nil
+	deva.WriteToIPv4(last, IPv4{10, 0, 0, 2})
+	select {
+	case <-recv:
+		t.Errorf("datagram delivered after its other fragments were discarded")
+	default:
+	}
+}
+
+func TestIPv4ReassemblyOverlap(t *testing.T) {
+	var r ipv4Reassembler
+	hdr := ipv4Header{id: 1, flags: ipv4FlagMF}
+	if _, ok := r.add(&hdr, make([]byte, 16)); ok {
+		t.Fatalf("datagram completed by first fragment")
+	}
+	// overlaps the first fragment
+	hdr.fragOff, hdr.flags = 1, 0
+	if _, ok := r.add(&hdr, make([]byte, 16)); ok {
+		t.Fatalf("datagram with overlapping fragments completed")
+	}
+	if n := r.pending(); n != 0 {
+		t.Errorf("datagram with overlapping fragments wasn't discarded")
+	}
+
+	// too many datagrams at once
+	for i := 0; i < maxReassemblies+1; i++ {
+		hdr := ipv4Header{id: uint16(i), flags: ipv4FlagMF}
+		r.add(&hdr, make([]byte, 8))
+	}
+	if n := r.pending(); n != maxReassemblies {
+		t.Errorf("unexpected number of pending reassemblies: got %v; want %v", n, maxReassemblies)
+	}
+}
@@ -3,6 +3,7 @@ package net
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/joshlf/net/internal/errors"
 	"github.com/joshlf/net/internal/parse"
@@ -10,7 +11,10 @@ import (
 
 const (
 	// default IPv4 TTL or IPv6 hops
-	defaultTTL = 32
+	// See https://tools.ietf.org/html/rfc1700#page-64
+	defaultTTL = 64
+	// the largest DSCP, which is 6 bits
+	maxDSCP = 63
 )
 
 // IPProtocol represents the protocol field of an IPv4 packet and the
@@ -18,21 +22,39 @@ const (
 type IPProtocol uint8
 
 const (
-	IPProtocolTCP IPProtocol = 6
+	IPProtocolICMP   IPProtocol = 1
+	IPProtocolIGMP   IPProtocol = 2
+	IPProtocolTCP    IPProtocol = 6
+	IPProtocolUDP    IPProtocol = 17
+	IPProtocolICMPv6 IPProtocol = 58
 )
 
 type ipv4Host struct {
 	table     ipv4RoutingTable
 	devices   map[IPv4Device]bool // make sure to check if nil before modifying
-	callbacks [256]func(b []byte, src, dst IPv4)
-	forward   bool
+	callbacks [256]func(b []byte, src, dst IPv4, info PacketInfo)
+	// called when a packet of the given protocol is reported unreachable
+	unreachables [256]func(code UnreachableCode, b []byte, src, dst IPv4)
+	// called when a packet of the given protocol is reported too big
+	mtuCallbacks [256]func(mtu int, b []byte, src, dst IPv4)
+	pmtu         pmtuCache
+	forward      bool
+	frags        ipv4Reassembler
+	igmp         igmp
+	nextID       uint32       // accessed atomically
+	hooks        *packetHooks // nil if not part of a Stack
 
 	mu sync.RWMutex
 }
 
 type ipv4ConfigurationHost struct {
 	*ipv4Host
-	ttl uint8
+	ttl  uint8
+	df   bool
+	dscp uint8
+	ecn  uint8
+	// whether packets may be sent to broadcast addresses
+	broadcast bool
 
 	mu sync.RWMutex
 }
@@ -43,8 +65,10 @@ func (host *ipv4ConfigurationHost) lock()    { host.mu.Lock(); host.ipv4Host.mu.
 func (host *ipv4ConfigurationHost) unlock()  { host.ipv4Host.mu.Unlock(); host.mu.Unlock() }
 
 func NewIPv4Host() IPv4Host {
+	host := &ipv4Host{devices: make(map[IPv4Device]bool)}
+	host.igmp.write = host.writeIGMP
 	return &ipv4ConfigurationHost{
-		ipv4Host: &ipv4Host{devices: make(map[IPv4Device]bool)},
+		ipv4Host: host,
 		ttl:      defaultTTL,
 	}
 }
@@ -58,6 +82,52 @@ func (host *ipv4ConfigurationHost) SetTTL(ttl uint8) {
 	host.mu.Unlock()
 }
 
+// SetDontFragment sets whether the DF flag is set on outgoing packets. If it
+// is, packets are never fragmented; instead, writes of packets larger than
+// the path MTU fail with an MTU error.
+func (host *ipv4ConfigurationHost) SetDontFragment(on bool) {
+	host.mu.Lock()
+	host.df = on
+	host.mu.Unlock()
+}
+
+// SetBroadcast sets whether packets may be sent to broadcast addresses - the
+// limited broadcast address, 255.255.255.255, and the subnet-directed
+// broadcast address of the device through which they are routed. Like the
+// SO_BROADCAST socket option, it is off by default, so that broadcasts aren't
+// sent by mistake; writes to broadcast addresses fail until it is set.
+func (host *ipv4ConfigurationHost) SetBroadcast(on bool) {
+	host.mu.Lock()
+	host.broadcast = on
+	host.mu.Unlock()
+}
+
+// SetDSCP sets the DSCP of outgoing packets. The ECN bits are unaffected.
+// See https://tools.ietf.org/html/rfc2474#section-3
+func (host *ipv4ConfigurationHost) SetDSCP(dscp uint8) error {
+	if dscp > maxDSCP {
+		return errors.New("set DSCP: DSCP exceeds 6 bits")
+	}
+	host.mu.Lock()
+	host.dscp = dscp
+	host.mu.Unlock()
+	return nil
+}
+
+// SetECN sets the ECN codepoint of outgoing packets. Since routers only mark
+// packets with ECN-capable codepoints, it should only be set by transport
+// protocols which respond to congestion notifications.
+// See https://tools.ietf.org/html/rfc3168#section-5
+func (host *ipv4ConfigurationHost) SetECN(ecn uint8) error {
+	if ecn > maxECN {
+		return errors.New("set ECN: ECN exceeds 2 bits")
+	}
+	host.mu.Lock()
+	host.ecn = ecn
+	host.mu.Unlock()
+	return nil
+}
+
 func (host *ipv4ConfigurationHost) GetConfigCopyIPv4() IPv4Host {
 	host.rlock()
 	new := *host
@@ -81,6 +151,27 @@ func (host *ipv4ConfigurationHost) RemoveIPv4Device(dev IPv4Device) {
 	}
 	dev.RegisterIPv4Callback(nil)
 	delete(host.devices, dev)
+	host.igmp.removeDevice(dev)
+}
+
+// JoinIPv4Group joins the multicast group on dev, which must have been added
+// to host, so that packets addressed to the group which are received on dev
+// are delivered. Membership is reported to multicast routers using IGMP. If
+// the group has already been joined on dev, JoinIPv4Group is a no-op.
+func (host *ipv4ConfigurationHost) JoinIPv4Group(dev IPv4Device, group IPv4) error {
+	host.rlock()
+	ok := host.devices[dev]
+	host.runlock()
+	if !ok {
+		return errors.New("join group: device not added to host")
+	}
+	return host.igmp.join(dev, group)
+}
+
+// LeaveIPv4Group leaves the multicast group on dev. It is an error if the
+// group hasn't been joined on dev.
+func (host *ipv4ConfigurationHost) LeaveIPv4Group(dev IPv4Device, group IPv4) error {
+	return host.igmp.leave(dev, group)
 }
 
 func (host *ipv4ConfigurationHost) AddIPv4Route(subnet IPv4Subnet, nexthop IPv4) {
@@ -95,6 +186,13 @@ func (host *ipv4ConfigurationHost) AddIPv4DeviceRoute(subnet IPv4Subnet, dev IPv
 	host.unlock()
 }
 
+// DeleteIPv4Route deletes the route or device route for subnet, if any.
+func (host *ipv4ConfigurationHost) DeleteIPv4Route(subnet IPv4Subnet) {
+	host.lock()
+	host.table.DeleteRoute(subnet)
+	host.unlock()
+}
+
 func (host *ipv4ConfigurationHost) IPv4Routes() []IPv4Route {
 	host.rlock()
 	routes := host.table.Routes()
@@ -130,19 +228,140 @@ func (host *ipv4ConfigurationHost) Forwarding() bool {
 // protocol is received. It overwrites any previously-registered callbacks.
 // If f is nil, any previously-registered callbacks are cleared.
 func (host *ipv4ConfigurationHost) RegisterIPv4Callback(f func(b []byte, src, dst IPv4), proto IPProtocol) {
+	if f == nil {
+		host.RegisterIPv4InfoCallback(nil, proto)
+		return
+	}
+	host.RegisterIPv4InfoCallback(func(b []byte, src, dst IPv4, info PacketInfo) { f(b, src, dst) }, proto)
+}
+
+// RegisterIPv4InfoCallback is like RegisterIPv4Callback, but f is also passed
+// information from the packet's header, such as the TTL with which it was
+// received. Only one callback may be registered for each protocol using
+// either method.
+func (host *ipv4ConfigurationHost) RegisterIPv4InfoCallback(f func(b []byte, src, dst IPv4, info PacketInfo), proto IPProtocol) {
 	host.lock()
 	host.callbacks[int(proto)] = f
 	host.unlock()
 }
 
+// RegisterIPv4UnreachableCallback registers f to be called whenever an ICMP
+// message is received indicating that a packet of the given protocol sent by
+// host could not be delivered. b is the beginning of the original packet's
+// payload - at least 8 bytes if the sender of the message complied with the
+// standard - and src and dst are its source and destination addresses. It
+// overwrites any previously-registered callbacks. If f is nil, any
+// previously-registered callbacks are cleared.
+func (host *ipv4ConfigurationHost) RegisterIPv4UnreachableCallback(f func(code UnreachableCode, b []byte, src, dst IPv4), proto IPProtocol) {
+	host.lock()
+	host.unreachables[int(proto)] = f
+	host.unlock()
+}
+
+// WriteIPv4Unreachable sends an ICMP destination unreachable message to src
+// in response to the packet of the given protocol with the payload b received
+// from src and addressed to dst. Since b does not include the IP header, the
+// header quoted in the message is reconstructed from the other arguments.
+//
+// Per RFC 1122, no message is sent if the packet was addressed to a multicast
+// or broadcast address, or if it was itself an ICMP error message.
+func (host *ipv4ConfigurationHost) WriteIPv4Unreachable(code UnreachableCode, b []byte, src, dst IPv4, proto IPProtocol) error {
+	hdr := ipv4Header{
+		version: 4,
+		IHL:     5,
+		len:     20 + uint16(len(b)),
+		TTL:     host.ttl,
+		proto:   proto,
+		src:     src,
+		dst:     dst,
+	}
+	host.rlock()
+	err := host.writeUnreachable(code, &hdr, b)
+	host.runlock()
+	return err
+}
+
+// RegisterIPv4PathMTUCallback registers f to be called whenever an ICMP
+// message is received indicating that a packet of the given protocol sent by
+// host was too big to be forwarded without fragmentation. mtu is the new path
+// MTU to the packet's destination, and b, src, and dst are as for
+// RegisterIPv4UnreachableCallback. It overwrites any previously-registered
+// callbacks. If f is nil, any previously-registered callbacks are cleared.
+func (host *ipv4ConfigurationHost) RegisterIPv4PathMTUCallback(f func(mtu int, b []byte, src, dst IPv4), proto IPProtocol) {
+	host.lock()
+	host.mtuCallbacks[int(proto)] = f
+	host.unlock()
+}
+
+// IPv4PathMTU returns the path MTU to addr - the smallest MTU discovered along
+// the path, or the MTU of the first-hop device if none has been discovered.
+// It returns 0 if there is no route to addr or the first-hop device has no MTU.
+func (host *ipv4ConfigurationHost) IPv4PathMTU(addr IPv4) int {
+	host.rlock()
+	mtu := host.pathMTU(addr)
+	host.runlock()
+	return mtu
+}
+
+// IPv4SourceAddr returns the source address of packets sent to addr - the
+// address of the device through which addr is routed. Protocols whose
+// checksums cover the source address can use it to compute them.
+func (host *ipv4ConfigurationHost) IPv4SourceAddr(addr IPv4) (IPv4, error) {
+	host.rlock()
+	src, err := host.sourceAddr(addr)
+	host.runlock()
+	return src, err
+}
+
 func (host *ipv4ConfigurationHost) WriteToIPv4(b []byte, addr IPv4, proto IPProtocol) (n int, err error) {
 	host.rlock()
-	n, err = host.write(b, addr, proto, host.ttl)
+	n, err = host.write(b, IPv4{}, addr, proto, host.ttl, host.dscp, host.ecn, host.df, host.broadcast)
 	host.runlock()
 	return n, err
 }
 
-func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n int, err error) {
+// WriteToIPv4From is like WriteToIPv4, but the packet is sent from src, which
+// must be the address of one of host's devices, rather than from the address
+// of the device through which addr is routed. If src is the zero address, it
+// is equivalent to WriteToIPv4.
+func (host *ipv4ConfigurationHost) WriteToIPv4From(b []byte, src, addr IPv4, proto IPProtocol) (n int, err error) {
+	host.rlock()
+	defer host.runlock()
+	if src != (IPv4{}) && !host.isLocal(src) {
+		return 0, errors.Errorf("write IPv4 packet: source address %v is not local", src)
+	}
+	return host.write(b, src, addr, proto, host.ttl, host.dscp, host.ecn, host.df, host.broadcast)
+}
+
+// assumes host.mu.RLock
+func (host *ipv4Host) pathMTU(addr IPv4) int {
+	_, dev, ok := host.table.Lookup(addr)
+	if !ok {
+		return 0
+	}
+	mtu := dev.MTU()
+	if p := host.pmtu.get(addr); p > 0 && (mtu == 0 || p < mtu) {
+		mtu = p
+	}
+	return mtu
+}
+
+// assumes host.mu.RLock
+func (host *ipv4Host) sourceAddr(addr IPv4) (IPv4, error) {
+	_, dev, ok := host.table.Lookup(addr)
+	if !ok {
+		return IPv4{}, errors.NewNoRoute(addr.String())
+	}
+	devaddr, _, ok := dev.(IPv4Device).IPv4()
+	if !ok {
+		return IPv4{}, errors.New("device has no IPv4 address")
+	}
+	return devaddr, nil
+}
+
+// write writes b to addr. If src is the zero address, the address of the
+// device through which addr is routed is used as the source address.
+func (host *ipv4Host) write(b []byte, src, addr IPv4, proto IPProtocol, ttl, dscp, ecn uint8, df, broadcast bool) (n int, err error) {
 	nexthop, dev, ok := host.table.Lookup(addr)
 	if !ok {
 		return 0, errors.Annotate(errors.NewNoRoute(addr.String()), "write IPv4 packet")
@@ -151,6 +370,14 @@ func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n
 	if !ok {
 		return 0, errors.New("device has no IPv4 address")
 	}
+	if isDeviceBroadcast(dev.(IPv4Device), addr) {
+		if !broadcast {
+			return 0, errors.New("write IPv4 packet: broadcast not permitted")
+		}
+		// broadcasts are sent to every host on the device's
+		// link, even if addr is routed through a gateway
+		nexthop = addr
+	}
 
 	if len(b) > math.MaxUint16-20 {
 		// MTU errors are only for link-layer payloads
@@ -160,16 +387,43 @@ func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n
 	hdr.version = 4
 	hdr.IHL = 5
 	hdr.len = 20 + uint16(len(b))
+	hdr.id = uint16(atomic.AddUint32(&host.nextID, 1))
+	hdr.DSCP = dscp
+	hdr.ECN = ecn
 	hdr.TTL = ttl
 	hdr.proto = proto
 	hdr.src = devaddr
+	if src != (IPv4{}) {
+		hdr.src = src
+	}
 	hdr.dst = addr
+	if df {
+		hdr.flags = ipv4FlagDF
+		if mtu := host.pathMTU(addr); mtu > 0 && int(hdr.len) > mtu {
+			return 0, errors.MTUf(mtu, "write IPv4 packet: packet exceeds path MTU")
+		}
+	}
+
+	if mtu := dev.MTU(); mtu > 0 && int(hdr.len) > mtu {
+		pkts, err := fragmentIPv4(hdr, nil, b, mtu, dev.Capabilities())
+		if err != nil {
+			return 0, errors.Annotate(err, "write IPv4 packet")
+		}
+		for _, pkt := range pkts {
+			if _, err := host.hooks.writeIPv4(dev.(IPv4Device), pkt, nexthop); err != nil {
+				// the datagram can't be reassembled
+				// without every fragment
+				return 0, errors.Annotate(err, "write IPv4 packet")
+			}
+		}
+		return len(b), nil
+	}
 
 	buf := make([]byte, int(hdr.len))
-	writeIPv4Header(&hdr, buf)
+	encodeIPv4Header(&hdr, buf, dev.Capabilities())
 	copy(buf[20:], b)
 
-	n, err = dev.WriteToIPv4(buf, nexthop)
+	n, err = host.hooks.writeIPv4(dev.(IPv4Device), buf, nexthop)
 	if n < 20 {
 		n = 0
 	} else {
@@ -180,60 +434,268 @@ func (host *ipv4Host) write(b []byte, addr IPv4, proto IPProtocol, ttl uint8) (n
 
 func (host *ipv4Host) callback(dev IPv4Device, b []byte) {
 	// We accept the device as an argument
-	// because we may use it in the future,
+	// to check its capabilities, and because
+	// we may use it further in the future,
 	// for example for a NAT server to tell
 	// which of multiple private-addressed
 	// networks a packet came from.
+	if host.hooks.in(b) {
+		return
+	}
 	if len(b) < 20 {
 		return
 	}
 	var hdr ipv4Header
 	readIPv4Header(&hdr, b)
-	if int(hdr.len) != len(b) {
+	if int(hdr.len) != len(b) || hdr.IHL < 5 || int(hdr.IHL)*4 > len(b) {
+		// TODO(joshlf): Log it
+		return
+	}
+	if dev.Capabilities()&RxChecksumOffload == 0 && Checksum(b[:int(hdr.IHL)*4], 0) != 0xFFFF {
 		// TODO(joshlf): Log it
 		return
 	}
+	// TODO(joshlf): Let transport protocols skip verifying their checksums
+	// as well, which requires passing the device's capabilities along with
+	// each packet
 
 	host.mu.RLock()
 	defer host.mu.RUnlock()
-	var us bool
-	for dev := range host.devices {
-		addr, _, ok := dev.IPv4()
-		if ok && addr == hdr.dst {
-			us = true
-			break
+	// options are ignored, but must be skipped
+	payload := b[int(hdr.IHL)*4:]
+	switch {
+	case host.isLocal(hdr.dst):
+		host.deliver(dev, &hdr, payload)
+	case isIPv4Multicast(hdr.dst):
+		// multicast packets are never forwarded
+		if host.igmp.isMember(dev, hdr.dst) {
+			host.deliver(dev, &hdr, payload)
 		}
+	case isDeviceBroadcast(dev, hdr.dst):
+		// nor are broadcasts
+		// See https://tools.ietf.org/html/rfc1812#section-5.3.5
+		host.deliver(dev, &hdr, payload)
+	case host.forward:
+		host.forwardPacket(&hdr, b)
 	}
+}
 
-	if us {
-		// deliver
-		c := host.callbacks[int(hdr.proto)]
-		if c == nil {
+// forwardPacket forwards the packet b with the header hdr, which is
+// not addressed to host, to its next hop; assumes host.mu.RLock
+func (host *ipv4Host) forwardPacket(hdr *ipv4Header, b []byte) {
+	// the payload starts after any options
+	payload := b[int(hdr.IHL)*4:]
+	if hdr.TTL < 2 {
+		// TTL is or would become 0 after decrement
+		// See "TTL" section, https://tools.ietf.org/html/rfc791#page-14
+		host.writeTimeExceeded(hdr, payload)
+		// TODO(joshlf): Log error
+		return
+	}
+	nexthop, dev, ok := host.table.Lookup(hdr.dst)
+	if !ok {
+		host.writeUnreachable(UnreachableNet, hdr, payload)
+		// TODO(joshlf): Log error
+		return
+	}
+	hdr.TTL--
+	setTTL(b, hdr.TTL)
+	if mtu := dev.MTU(); mtu > 0 && len(b) > mtu {
+		pkts, err := fragmentIPv4(*hdr, b[20:int(hdr.IHL)*4], payload, mtu, dev.Capabilities())
+		if err != nil {
+			// the DF flag is set; let the
+			// source know to send smaller packets
+			host.writeFragNeeded(mtu, hdr, payload)
+			// TODO(joshlf): Log error
 			return
 		}
-		c(b[20:], hdr.src, hdr.dst)
-	} else if host.forward {
-		// forward
-		if hdr.TTL < 2 {
-			// TTL is or would become 0 after decrement
-			// See "TTL" section, https://tools.ietf.org/html/rfc791#page-14
-			return
+		for _, pkt := range pkts {
+			host.hooks.writeIPv4(dev.(IPv4Device), pkt, nexthop)
+			// TODO(joshlf): Log error
 		}
-		hdr.TTL--
-		setTTL(b, hdr.TTL)
-		nexthop, dev, ok := host.table.Lookup(hdr.dst)
+		return
+	}
+	host.hooks.writeIPv4(dev.(IPv4Device), b, nexthop)
+	// TODO(joshlf): Log error
+}
+
+// assumes host.mu.RLock
+func (host *ipv4Host) isLocal(addr IPv4) bool {
+	for dev := range host.devices {
+		devaddr, _, ok := dev.IPv4()
+		if ok && devaddr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeviceBroadcast returns true if addr is the limited broadcast address or
+// the subnet-directed broadcast address of dev.
+func isDeviceBroadcast(dev IPv4Device, addr IPv4) bool {
+	devaddr, netmask, ok := dev.IPv4()
+	if !ok {
+		return addr == IPv4{255, 255, 255, 255}
+	}
+	// a device with a /32 netmask has no broadcast address
+	// other than the limited broadcast address
+	return addr != devaddr && isIPv4Broadcast(addr, devaddr, netmask)
+}
+
+// isBroadcast returns true if addr is a broadcast address
+// of any of host's devices; assumes host.mu.RLock
+func (host *ipv4Host) isBroadcast(addr IPv4) bool {
+	for dev := range host.devices {
+		if isDeviceBroadcast(dev, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver delivers the payload b of a packet with the header hdr, received
+// on dev and addressed to host; assumes host.mu.RLock
+func (host *ipv4Host) deliver(dev IPv4Device, hdr *ipv4Header, b []byte) {
+	c := host.callbacks[int(hdr.proto)]
+	if c == nil && hdr.proto != IPProtocolICMP && hdr.proto != IPProtocolIGMP {
+		host.writeUnreachable(UnreachableProtocol, hdr, b)
+		// TODO(joshlf): Log error
+		return
+	}
+	if isIPv4Fragment(hdr) {
+		var ok bool
+		b, ok = host.frags.add(hdr, b)
 		if !ok {
-			// TODO(joshlf): ICMP reply
 			return
 		}
-		dev.WriteToIPv4(b, nexthop)
-		// TODO(joshlf): Log error
 	}
+	switch hdr.proto {
+	case IPProtocolICMP:
+		host.handleICMP(b)
+	case IPProtocolIGMP:
+		host.igmp.handle(dev, b)
+	}
+	if c != nil {
+		c(b, hdr.src, hdr.dst, PacketInfo{TTL: hdr.TTL, DSCP: hdr.DSCP, ECN: hdr.ECN, Device: dev})
+	}
+}
+
+// writeIGMP writes the IGMP message b to dst, a multicast address, through
+// dev. IGMP messages are never forwarded by routers, so the TTL is 1.
+func (host *ipv4Host) writeIGMP(dev IPv4Device, b []byte, dst IPv4) {
+	// TODO(joshlf): Include the Router Alert option once options are
+	// supported (see https://tools.ietf.org/html/rfc2236#section-2)
+	src, _, _ := dev.IPv4()
+	hdr := ipv4Header{
+		version: 4,
+		IHL:     5,
+		len:     20 + uint16(len(b)),
+		id:      uint16(atomic.AddUint32(&host.nextID, 1)),
+		TTL:     1,
+		proto:   IPProtocolIGMP,
+		src:     src,
+		dst:     dst,
+	}
+	buf := make([]byte, int(hdr.len))
+	encodeIPv4Header(&hdr, buf, dev.Capabilities())
+	copy(buf[20:], b)
+	host.hooks.writeIPv4(dev, buf, dst)
+	// TODO(joshlf): Log error
+}
+
+// handleICMP handles an ICMP message addressed to host,
+// dispatching any errors to the appropriate callbacks;
+// assumes host.mu.RLock
+func (host *ipv4Host) handleICMP(b []byte) {
+	if mtu, hdr, payload, ok := parseICMPv4FragNeeded(b); ok {
+		host.handleFragNeeded(mtu, &hdr, payload)
+		return
+	}
+	code, hdr, payload, ok := parseICMPv4Unreachable(b)
+	if !ok || !host.isLocal(hdr.src) {
+		// either not a destination unreachable message,
+		// or the packet it refers to wasn't sent by us
+		return
+	}
+	if f := host.unreachables[int(hdr.proto)]; f != nil {
+		f(code, payload, hdr.src, hdr.dst)
+	}
+}
+
+// handleFragNeeded handles a fragmentation needed message reporting that the
+// packet with the header hdr and the payload b was too big for a link with
+// the given MTU; assumes host.mu.RLock
+// See https://tools.ietf.org/html/rfc1191#section-6
+func (host *ipv4Host) handleFragNeeded(mtu int, hdr *ipv4Header, b []byte) {
+	if !host.isLocal(hdr.src) {
+		return
+	}
+	if mtu == 0 {
+		// the router predates RFC 1191, so estimate the
+		// MTU from the size of the packet it rejected
+		mtu = pmtuPlateau(int(hdr.len))
+	}
+	if mtu >= int(hdr.len) {
+		// the packet would have fit, so the message is bogus
+		return
+	}
+	host.pmtu.update(hdr.dst, mtu)
+	if f := host.mtuCallbacks[int(hdr.proto)]; f != nil {
+		f(host.pathMTU(hdr.dst), b, hdr.src, hdr.dst)
+	}
+}
+
+// writeUnreachable sends an ICMP destination unreachable message in response
+// to the packet with the header hdr and the payload b; assumes host.mu.RLock
+func (host *ipv4Host) writeUnreachable(code UnreachableCode, hdr *ipv4Header, b []byte) error {
+	if !shouldSendICMPv4Error(hdr, b) || host.isBroadcast(hdr.dst) {
+		return nil
+	}
+	// TODO(joshlf): Rate limit ICMP errors
+	_, err := host.write(icmpv4Unreachable(code, hdr, b), IPv4{}, hdr.src, IPProtocolICMP, defaultTTL, 0, 0, false, false)
+	return errors.Annotate(err, "write ICMP destination unreachable")
 }
 
-// TODO(joshlf):
-//   - support options
-//   - compute and validate checksums
+// writeTimeExceeded sends an ICMP time exceeded message in response to the
+// packet with the header hdr and the payload b, whose TTL expired before
+// it could be forwarded; assumes host.mu.RLock
+func (host *ipv4Host) writeTimeExceeded(hdr *ipv4Header, b []byte) error {
+	if !shouldSendICMPv4Error(hdr, b) {
+		return nil
+	}
+	_, err := host.write(icmpv4TimeExceeded(hdr, b), IPv4{}, hdr.src, IPProtocolICMP, defaultTTL, 0, 0, false, false)
+	return errors.Annotate(err, "write ICMP time exceeded")
+}
+
+// writeFragNeeded sends an ICMP fragmentation needed message in response to
+// the packet with the header hdr and the payload b, which could not be
+// forwarded over a link with the given MTU; assumes host.mu.RLock
+func (host *ipv4Host) writeFragNeeded(mtu int, hdr *ipv4Header, b []byte) error {
+	if !shouldSendICMPv4Error(hdr, b) {
+		return nil
+	}
+	_, err := host.write(icmpv4FragNeeded(mtu, hdr, b), IPv4{}, hdr.src, IPProtocolICMP, defaultTTL, 0, 0, false, false)
+	return errors.Annotate(err, "write ICMP fragmentation needed")
+}
+
+// shouldSendICMPv4Error returns true if an ICMP error message may be sent
+// in response to the packet with the header hdr and the payload b.
+// See https://tools.ietf.org/html/rfc1122#page-38
+func shouldSendICMPv4Error(hdr *ipv4Header, b []byte) bool {
+	switch {
+	case hdr.fragOff != 0:
+		// only the first fragment is answered
+		return false
+	case hdr.dst[0] >= 224 || hdr.src[0] >= 224 || hdr.src == (IPv4{}):
+		// multicast, broadcast, or otherwise not a single host
+		return false
+	case hdr.proto == IPProtocolICMP && isICMPv4Error(b):
+		return false
+	}
+	return true
+}
+
+// TODO(joshlf): Support options
 
 type ipv4Header struct {
 	version  uint8
@@ -250,8 +712,18 @@ type ipv4Header struct {
 	src, dst IPv4
 }
 
-// assumes b is long enough
+// writeIPv4Header writes hdr to buf, computing the header checksum and
+// storing it in hdr.checksum; assumes b is long enough
 func writeIPv4Header(hdr *ipv4Header, buf []byte) {
+	encodeIPv4Header(hdr, buf, 0)
+}
+
+// encodeIPv4Header is like writeIPv4Header, but if caps, the capabilities of
+// the device the packet will be written to, includes TxChecksumOffload, the
+// checksum isn't computed, and is left zero. The checksum covers any options
+// indicated by hdr.IHL, which must already have been written to buf.
+func encodeIPv4Header(hdr *ipv4Header, buf []byte, caps DeviceCaps) {
+	b := buf
 	parse.GetBytes(&buf, 1)[0] = (hdr.version << 4) | hdr.IHL
 	parse.GetBytes(&buf, 1)[0] = (hdr.DSCP << 2) | hdr.ECN
 	parse.PutUint16(&buf, hdr.len)
@@ -260,9 +732,15 @@ func writeIPv4Header(hdr *ipv4Header, buf []byte) {
 	parse.GetBytes(&buf, 1)[0] = byte(hdr.fragOff)
 	parse.GetBytes(&buf, 1)[0] = hdr.TTL
 	parse.GetBytes(&buf, 1)[0] = byte(hdr.proto)
-	parse.PutUint16(&buf, hdr.checksum)
+	parse.PutUint16(&buf, 0)
 	copy(parse.GetBytes(&buf, 4), hdr.src[:])
 	copy(parse.GetBytes(&buf, 4), hdr.dst[:])
+	hdr.checksum = 0
+	if caps&TxChecksumOffload == 0 {
+		hdr.checksum = ipv4HeaderChecksum(b[:int(hdr.IHL)*4])
+	}
+	b = b[10:]
+	parse.PutUint16(&b, hdr.checksum)
 }
 
 // assumes b is long enough
@@ -287,7 +765,10 @@ func readIPv4Header(hdr *ipv4Header, buf []byte) {
 
 // setTTL sets the TTL in the IP header encoded in b
 // without having to expensively rewrite the entire
-// header using writeIPv4Header
+// header using writeIPv4Header, updating the checksum
 func setTTL(b []byte, ttl uint8) {
 	b[8] = ttl
+	b[10], b[11] = 0, 0
+	sum := ipv4HeaderChecksum(b[:int(b[0]&0xF)*4])
+	b[10], b[11] = byte(sum>>8), byte(sum)
 }
@@ -0,0 +1,78 @@
+package net
+
+import "sync"
+
+// A testIPv4Device is an IPv4Device which delivers packets directly to its
+// peer. If drop is non-nil, packets for which it returns true are dropped.
+type testIPv4Device struct {
+	addr     IPv4
+	mtu      int
+	caps     DeviceCaps
+	peer     *testIPv4Device
+	drop     func(b []byte) bool
+	callback func(b []byte)
+	mu       sync.Mutex
+}
+
+// newTestIPv4DevicePair creates a pair of connected testIPv4Devices
+// with the given addresses and MTU.
+func newTestIPv4DevicePair(a, b IPv4, mtu int) (*testIPv4Device, *testIPv4Device) {
+	deva := &testIPv4Device{addr: a, mtu: mtu}
+	devb := &testIPv4Device{addr: b, mtu: mtu, peer: deva}
+	deva.peer = devb
+	return deva, devb
+}
+
+func (dev *testIPv4Device) BringUp() error           { return nil }
+func (dev *testIPv4Device) BringDown() error         { return nil }
+func (dev *testIPv4Device) IsUp() bool               { return true }
+func (dev *testIPv4Device) MTU() int                 { return dev.mtu }
+func (dev *testIPv4Device) Stats() DeviceStats       { return DeviceStats{} }
+func (dev *testIPv4Device) Capabilities() DeviceCaps { return dev.caps }
+func (dev *testIPv4Device) SetMTU(mtu int) error     { dev.mtu = mtu; return nil }
+
+func (dev *testIPv4Device) IPv4() (addr, netmask IPv4, ok bool) {
+	return dev.addr, IPv4{255, 255, 255, 0}, true
+}
+func (dev *testIPv4Device) SetIPv4(addr, netmask IPv4) error { return nil }
+func (dev *testIPv4Device) UnsetIPv4() error                 { return nil }
+
+func (dev *testIPv4Device) RegisterIPv4Callback(f func([]byte)) {
+	dev.mu.Lock()
+	dev.callback = f
+	dev.mu.Unlock()
+}
+
+func (dev *testIPv4Device) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	if len(b) > dev.mtu {
+		panic("packet exceeds MTU")
+	}
+	if dev.drop != nil && dev.drop(b) {
+		return len(b), nil
+	}
+	dev.peer.mu.Lock()
+	f := dev.peer.callback
+	dev.peer.mu.Unlock()
+	if f != nil {
+		f(append([]byte(nil), b...))
+	}
+	return len(b), nil
+}
+
+// newTestIPv4HostPair creates a pair of IPv4Hosts connected by a pair of
+// testIPv4Devices with the given MTU. Packets received by the second host
+// with the given protocol are sent on the returned channel.
+func newTestIPv4HostPair(mtu int, proto IPProtocol) (a, b *ipv4ConfigurationHost, deva *testIPv4Device, recv chan []byte) {
+	addra, addrb := IPv4{10, 0, 0, 1}, IPv4{10, 0, 0, 2}
+	subnet := IPv4Subnet{Addr: IPv4{10, 0, 0, 0}, Netmask: IPv4{255, 255, 255, 0}}
+	deva, devb := newTestIPv4DevicePair(addra, addrb, mtu)
+	a = NewIPv4Host().(*ipv4ConfigurationHost)
+	b = NewIPv4Host().(*ipv4ConfigurationHost)
+	a.AddIPv4Device(deva)
+	b.AddIPv4Device(devb)
+	a.AddIPv4DeviceRoute(subnet, deva)
+	b.AddIPv4DeviceRoute(subnet, devb)
+	recv = make(chan []byte, 16)
+	b.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { recv <- b }, proto)
+	return a, b, deva, recv
+}
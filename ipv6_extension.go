@@ -0,0 +1,124 @@
+package net
+
+// IPv6 extension headers, identified by the next header field of the
+// header preceding them.
+// See https://tools.ietf.org/html/rfc8200#section-4
+const (
+	ipv6ExtHopByHop     IPProtocol = 0
+	ipv6ExtRouting      IPProtocol = 43
+	ipv6ExtFragment     IPProtocol = 44
+	ipv6ExtNoNextHeader IPProtocol = 59
+	ipv6ExtDestOptions  IPProtocol = 60
+
+	// the maximum number of extension headers in a packet; legitimate
+	// packets carry only a few, so longer chains are dropped rather than
+	// spending time on them
+	maxIPv6ExtHeaders = 8
+)
+
+// walkExtHeaders walks the chain of extension headers at the start of the
+// payload b of a packet with the header hdr. If the packet is a fragment, it
+// is reassembled, and the walk continues once the last fragment arrives. It
+// returns the upper-layer protocol and payload; ok is false if the chain is
+// malformed or too long, or if there's nothing to deliver yet. Assumes
+// host.mu.RLock
+func (host *ipv6Host) walkExtHeaders(hdr *ipv6Header, b []byte) (proto IPProtocol, payload []byte, ok bool) {
+	orig := b
+	proto = hdr.nextHdr
+	for n := 0; ; n++ {
+		switch proto {
+		case ipv6ExtHopByHop, ipv6ExtRouting, ipv6ExtFragment, ipv6ExtDestOptions:
+		case ipv6ExtNoNextHeader:
+			return 0, nil, false
+		default:
+			return proto, b, true
+		}
+		if n == maxIPv6ExtHeaders {
+			// TODO(joshlf): Log it
+			return 0, nil, false
+		}
+
+		switch proto {
+		case ipv6ExtHopByHop:
+			if n != 0 {
+				// only allowed immediately after the IPv6 header
+				// See https://tools.ietf.org/html/rfc8200#section-4.1
+				return 0, nil, false
+			}
+			proto, b, ok = parseIPv6Options(b)
+		case ipv6ExtDestOptions:
+			proto, b, ok = parseIPv6Options(b)
+		case ipv6ExtRouting:
+			proto, b, ok = parseIPv6Routing(b)
+		case ipv6ExtFragment:
+			var frag ipv6FragmentHeader
+			if len(b) < 8 {
+				return 0, nil, false
+			}
+			readIPv6FragmentHeader(&frag, b)
+			proto, b, ok = frag.nextHdr, b[8:], true
+			if frag.off != 0 || frag.more {
+				// a non-atomic fragment; the headers following
+				// the fragment header belong to the reassembled
+				// payload (see RFC 6946 regarding atomic fragments)
+				b, ok = host.frags.add(hdr, &frag, b, orig)
+			}
+		}
+		if !ok {
+			// TODO(joshlf): Log it
+			return 0, nil, false
+		}
+	}
+}
+
+// parseIPv6Options parses the Hop-by-Hop or Destination Options header at the
+// start of b, returning the next header and the rest of b. Since no options are
+// supported, ok is false if the header contains an option other than padding
+// whose type doesn't allow it to be skipped.
+// See https://tools.ietf.org/html/rfc8200#section-4.2
+func parseIPv6Options(b []byte) (next IPProtocol, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return 0, nil, false
+	}
+	l := (int(b[1]) + 1) * 8
+	if len(b) < l {
+		return 0, nil, false
+	}
+	opts := b[2:l]
+	for len(opts) > 0 {
+		typ := opts[0]
+		if typ == 0 {
+			// Pad1 has no length or data
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return 0, nil, false
+		}
+		// the upper 2 bits give the action for unrecognized options;
+		// 00 means to skip it, and all others mean to drop the packet
+		// TODO(joshlf): Send parameter problem messages when requested
+		if typ != 1 && typ>>6 != 0 {
+			return 0, nil, false
+		}
+		opts = opts[2+int(opts[1]):]
+	}
+	return IPProtocol(b[0]), b[l:], true
+}
+
+// parseIPv6Routing parses the Routing header at the start of b, returning the
+// next header and the rest of b. Since no routing types are supported, ok is
+// false unless there are no segments left, in which case the header is ignored.
+// See https://tools.ietf.org/html/rfc8200#section-4.4
+func parseIPv6Routing(b []byte) (next IPProtocol, rest []byte, ok bool) {
+	if len(b) < 8 {
+		return 0, nil, false
+	}
+	l := (int(b[1]) + 1) * 8
+	if len(b) < l || b[3] != 0 {
+		// TODO(joshlf): Send a parameter problem message
+		// pointing at the routing type
+		return 0, nil, false
+	}
+	return IPProtocol(b[0]), b[l:], true
+}
@@ -0,0 +1,94 @@
+package net
+
+import "testing"
+
+// ipv6TestPacket constructs a packet from ::1 to itself whose payload is the
+// given extension headers followed by a UDP datagram from port 5678 to port
+// 1234 carrying data. ext begins with the header identified by next.
+func ipv6TestPacket(next IPProtocol, ext []byte, data string) []byte {
+	lo := IPv6{15: 1}
+	udp := append([]byte{0x16, 0x2E, 0x04, 0xD2, 0, byte(8 + len(data)), 0, 0}, data...)
+	setUDPChecksum(udp, udpChecksum(udp, lo, lo))
+	hdr := ipv6Header{
+		version:  6,
+		len:      uint16(40 + len(ext) + len(udp)),
+		nextHdr:  next,
+		hopLimit: defaultTTL,
+		src:      lo,
+		dst:      lo,
+	}
+	b := make([]byte, int(hdr.len))
+	writeIPv6Header(&hdr, b)
+	copy(b[40:], ext)
+	copy(b[40+len(ext):], udp)
+	return b
+}
+
+// ipv6TestOptions constructs a Destination Options header followed by
+// next, containing opts and padded to 8 bytes.
+func ipv6TestOptions(next IPProtocol, opts ...byte) []byte {
+	b := append([]byte{byte(next), 0}, opts...)
+	if pad := 8 - len(b); pad == 1 {
+		b = append(b, 0) // Pad1
+	} else if pad > 1 {
+		b = append(b, 1, byte(pad-2)) // PadN
+		b = append(b, make([]byte, pad-2)...)
+	}
+	return b
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+	c, err := s.ListenUDP(&UDPAddr{Port: 1234})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+
+	write := func(b []byte) {
+		if _, err := lo.WriteToIPv6(b, IPv6{15: 1}); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+	}
+
+	write(ipv6TestPacket(ipv6ExtDestOptions, ipv6TestOptions(IPProtocolUDP), "options"))
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "options" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "options")
+	}
+
+	// a Hop-by-Hop header followed by a Routing header with no segments left
+	hop := ipv6TestOptions(ipv6ExtRouting)
+	routing := []byte{byte(IPProtocolUDP), 0, 0, 0, 0, 0, 0, 0}
+	write(ipv6TestPacket(ipv6ExtHopByHop, append(hop, routing...), "routing"))
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "routing" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "routing")
+	}
+
+	// malformed packets are dropped
+	var long []byte
+	for i := 0; i < maxIPv6ExtHeaders; i++ {
+		long = append(long, ipv6TestOptions(ipv6ExtDestOptions)...)
+	}
+	long = append(long, ipv6TestOptions(IPProtocolUDP)...)
+	for _, b := range [][]byte{
+		// too many extension headers
+		ipv6TestPacket(ipv6ExtDestOptions, long, "long"),
+		// Hop-by-Hop not immediately after the IPv6 header
+		ipv6TestPacket(ipv6ExtDestOptions, append(ipv6TestOptions(ipv6ExtHopByHop), ipv6TestOptions(IPProtocolUDP)...), "hop"),
+		// an unrecognized option which must not be skipped
+		ipv6TestPacket(ipv6ExtDestOptions, ipv6TestOptions(IPProtocolUDP, 0x40, 0), "option"),
+		// a Routing header with segments left
+		ipv6TestPacket(ipv6ExtRouting, []byte{byte(IPProtocolUDP), 0, 0, 1, 0, 0, 0, 0}, "segments"),
+		// a truncated header
+		ipv6TestPacket(ipv6ExtDestOptions, []byte{byte(IPProtocolUDP), 1}, "short")[:42],
+	} {
+		b = append([]byte(nil), b...)
+		b[4], b[5] = byte(len(b)>>8), byte(len(b))
+		write(b)
+	}
+	write(ipv6TestPacket(ipv6ExtDestOptions, ipv6TestOptions(IPProtocolUDP, 0x1E, 0), "good"))
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "good" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "good")
+	}
+}
@@ -0,0 +1,103 @@
+package net
+
+import (
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+// the maximum length of a reassembled IPv6 payload
+const maxIPv6Payload = 0xFFFF - 40
+
+// fragmentIPv6 splits the payload b, which is to be sent with the header hdr,
+// into packets which fit within mtu. Each packet carries a Fragment header
+// with the identification id followed by a piece of b; its IPv6 header is a
+// copy of hdr with the length and next header fields updated.
+// See https://tools.ietf.org/html/rfc8200#section-4.5
+func fragmentIPv6(hdr ipv6Header, b []byte, id uint32, mtu int) ([][]byte, error) {
+	// every fragment except the last must carry
+	// a multiple of 8 bytes of payload
+	max := (mtu - 48) &^ 7
+	if max <= 0 {
+		return nil, errors.MTUf(mtu, "fragment IPv6 packet: MTU too small")
+	}
+
+	frag := ipv6FragmentHeader{nextHdr: hdr.nextHdr, id: id}
+	hdr.nextHdr = ipv6ExtFragment
+	var pkts [][]byte
+	for len(b) > 0 {
+		n := len(b)
+		frag.more = n > max
+		if frag.more {
+			n = max
+		}
+		hdr.len = 48 + uint16(n)
+		pkt := make([]byte, int(hdr.len))
+		writeIPv6Header(&hdr, pkt)
+		writeIPv6FragmentHeader(&frag, pkt[40:])
+		copy(pkt[48:], b[:n])
+		pkts = append(pkts, pkt)
+		b = b[n:]
+		frag.off += n
+	}
+	return pkts, nil
+}
+
+type ipv6FragmentHeader struct {
+	nextHdr IPProtocol
+	off     int // in bytes
+	more    bool
+	id      uint32
+}
+
+// See https://tools.ietf.org/html/rfc8200#section-4.5
+func readIPv6FragmentHeader(frag *ipv6FragmentHeader, b []byte) {
+	frag.nextHdr = IPProtocol(parse.GetByte(&b))
+	parse.GetByte(&b) // reserved
+	off := parse.GetUint16(&b)
+	frag.off = int(off>>3) * 8
+	frag.more = off&1 != 0
+	frag.id = parse.GetUint32(&b)
+}
+
+func writeIPv6FragmentHeader(frag *ipv6FragmentHeader, b []byte) {
+	parse.PutByte(&b, byte(frag.nextHdr))
+	parse.PutByte(&b, 0)
+	off := uint16(frag.off/8) << 3
+	if frag.more {
+		off |= 1
+	}
+	parse.PutUint16(&b, off)
+	parse.PutUint32(&b, frag.id)
+}
+
+type ipv6FragmentKey struct {
+	src, dst IPv6
+	id       uint32
+}
+
+// An ipv6Reassembler reassembles fragmented IPv6 packets. The zero value
+// ipv6Reassembler is a valid ipv6Reassembler using defaultReassemblyTimeout.
+type ipv6Reassembler struct {
+	reassembler
+}
+
+// an ipv6Packet is a copy of a received packet
+type ipv6Packet struct {
+	hdr ipv6Header
+	b   []byte
+}
+
+// add adds the fragment with the IPv6 header hdr, the fragment header frag,
+// and the fragmentable part b. orig is the fragment's entire payload; if frag
+// is the first fragment, it is retained so that the packet can be quoted in an
+// ICMPv6 error if reassembly times out. If the fragment completes a packet,
+// the reassembled fragmentable part is returned.
+func (r *ipv6Reassembler) add(hdr *ipv6Header, frag *ipv6FragmentHeader, b, orig []byte) (payload []byte, ok bool) {
+	key := ipv6FragmentKey{src: hdr.src, dst: hdr.dst, id: frag.id}
+	var first interface{}
+	if frag.off == 0 {
+		// orig belongs to the device, which may reuse it
+		first = &ipv6Packet{hdr: *hdr, b: append([]byte(nil), orig...)}
+	}
+	return r.reassembler.add(key, frag.off, frag.more, b, maxIPv6Payload, first)
+}
@@ -0,0 +1,138 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestIPv6Fragmentation(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+	c, err := s.ListenUDP(&UDPAddr{Port: 1234})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+
+	payload := make([]byte, 4096)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	before := lo.Stats().TxPackets
+	if _, err := c.WriteTo(payload, &UDPAddr{IP: IPv6{15: 1}, Port: 1234}); err != nil {
+		t.Fatalf("unexpected error writing datagram: %v", err)
+	}
+	// each fragment carries (1500-48)&^7 = 1448 bytes of
+	// the 4104-byte UDP datagram
+	if n := lo.Stats().TxPackets - before; n != 3 {
+		t.Errorf("unexpected number of fragments: got %v; want 3", n)
+	}
+
+	if r := readFrom(t, c); r.err != nil || !bytes.Equal(r.b, payload) {
+		t.Errorf("reassembled payload differs from original (err: %v)", r.err)
+	}
+	if n := s.IPv6Host.(*ipv6ConfigurationHost).frags.pending(); n != 0 {
+		t.Errorf("unexpected number of pending reassemblies: got %v; want 0", n)
+	}
+}
+
+func TestIPv6Reassembly(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+	c, err := s.ListenUDP(&UDPAddr{Port: 1234})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+
+	// split the packet's payload into two fragments, which are sent out
+	// of order: the first carries the UDP header and the first 8 bytes
+	// of data
+	pkt := ipv6TestPacket(IPProtocolUDP, nil, "fragmented datagram")
+	var hdr ipv6Header
+	readIPv6Header(&hdr, pkt)
+	payload := pkt[40:]
+	for i, off := range []int{16, 0} {
+		frag := ipv6FragmentHeader{nextHdr: IPProtocolUDP, off: off, more: off == 0, id: 7}
+		b := payload[off:]
+		if frag.more {
+			b = b[:16]
+		}
+		hdr.nextHdr = ipv6ExtFragment
+		hdr.len = uint16(40 + 8 + len(b))
+		buf := make([]byte, int(hdr.len))
+		writeIPv6Header(&hdr, buf)
+		writeIPv6FragmentHeader(&frag, buf[40:])
+		copy(buf[48:], b)
+		if _, err := lo.WriteToIPv6(buf, IPv6{15: 1}); err != nil {
+			t.Fatalf("unexpected error writing fragment %v: %v", i, err)
+		}
+	}
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "fragmented datagram" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "fragmented datagram")
+	}
+}
+
+func TestIPv6ReassemblyTimeout(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	lo, err := NewLoopbackDevice(1280)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	addr := IPv6{15: 1}
+	lo.SetIPv6(addr, IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer lo.BringDown()
+	host := NewIPv6Host().(*ipv6ConfigurationHost)
+	host.frags.timeout = 10 * time.Millisecond
+	host.AddIPv6Device(lo)
+	host.AddIPv6DeviceRoute(IPv6Subnet{Addr: addr, Netmask: IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}, lo)
+	recv := make(chan []byte, 16)
+	host.RegisterIPv6Callback(func(b []byte, src, dst IPv6) { recv <- b }, proto)
+	icmp := make(chan []byte, 16)
+	host.RegisterIPv6Callback(func(b []byte, src, dst IPv6) {
+		// the host's MLD reports are looped back as well
+		if b[0] != icmpv6TypeMLDReport {
+			icmp <- b
+		}
+	}, IPProtocolICMPv6)
+
+	// send all but the last fragment
+	hdr := ipv6Header{version: 6, nextHdr: proto, hopLimit: defaultTTL, src: addr, dst: addr}
+	pkts, err := fragmentIPv6(hdr, make([]byte, 4096), 1, 1280)
+	if err != nil {
+		t.Fatalf("unexpected error fragmenting packet: %v", err)
+	}
+	for _, pkt := range pkts[:len(pkts)-1] {
+		lo.WriteToIPv6(pkt, addr)
+	}
+
+	select {
+	case b := <-icmp:
+		if len(b) < icmpHeaderLen+48 || b[0] != icmpv6TypeTimeExceeded || b[1] != icmpv6CodeReassemblyExceeded {
+			t.Fatalf("unexpected ICMPv6 message: %x", b)
+		}
+		// the first fragment is quoted
+		var quoted ipv6FragmentHeader
+		readIPv6FragmentHeader(&quoted, b[icmpHeaderLen+40:])
+		if quoted.off != 0 || !quoted.more || quoted.id != 1 {
+			t.Errorf("unexpected quoted fragment header: %+v", quoted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no time exceeded message after reassembly timeout")
+	}
+	if n := host.frags.pending(); n != 0 {
+		t.Errorf("unexpected number of pending reassemblies: got %v; want 0", n)
+	}
+
+	// the last fragment alone can't complete the packet
+	lo.WriteToIPv6(pkts[len(pkts)-1], addr)
+	select {
+	case <-recv:
+		t.Errorf("packet delivered after its other fragments were discarded")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
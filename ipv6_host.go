@@ -3,6 +3,7 @@ package net
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/joshlf/net/internal/errors"
 	"github.com/joshlf/net/internal/parse"
@@ -11,15 +12,23 @@ import (
 type ipv6Host struct {
 	table     ipv6RoutingTable
 	devices   map[IPv6Device]bool
-	callbacks [256]func(b []byte, src, dst IPv6)
-	forward   bool
+	callbacks [256]func(b []byte, src, dst IPv6, info PacketInfo)
+	// called when a packet of the given protocol is reported unreachable
+	unreachables [256]func(code UnreachableCode, b []byte, src, dst IPv6)
+	forward      bool
+	frags        ipv6Reassembler
+	mld          mld
+	nextID       uint32       // accessed atomically
+	hooks        *packetHooks // nil if not part of a Stack
 
 	mu sync.RWMutex
 }
 
 type ipv6ConfigurationHost struct {
 	*ipv6Host
-	ttl uint8
+	ttl  uint8
+	dscp uint8
+	ecn  uint8
 
 	mu sync.RWMutex
 }
@@ -30,8 +39,11 @@ func (host *ipv6ConfigurationHost) lock()    { host.mu.Lock(); host.ipv6Host.mu.
 func (host *ipv6ConfigurationHost) unlock()  { host.ipv6Host.mu.Unlock(); host.mu.Unlock() }
 
 func NewIPv6Host() IPv6Host {
+	host := &ipv6Host{devices: make(map[IPv6Device]bool)}
+	host.frags.expired = host.reassemblyExpired
+	host.mld.write = host.writeMLD
 	return &ipv6ConfigurationHost{
-		ipv6Host: &ipv6Host{devices: make(map[IPv6Device]bool)},
+		ipv6Host: host,
 		ttl:      defaultTTL,
 	}
 }
@@ -45,6 +57,30 @@ func (host *ipv6ConfigurationHost) SetTTL(ttl uint8) {
 	host.mu.Unlock()
 }
 
+// SetDSCP is like the IPv4 host's SetDSCP; it sets the upper 6 bits of the
+// traffic class of outgoing packets.
+func (host *ipv6ConfigurationHost) SetDSCP(dscp uint8) error {
+	if dscp > maxDSCP {
+		return errors.New("set DSCP: DSCP exceeds 6 bits")
+	}
+	host.mu.Lock()
+	host.dscp = dscp
+	host.mu.Unlock()
+	return nil
+}
+
+// SetECN is like the IPv4 host's SetECN; it sets the lower 2 bits of the
+// traffic class of outgoing packets.
+func (host *ipv6ConfigurationHost) SetECN(ecn uint8) error {
+	if ecn > maxECN {
+		return errors.New("set ECN: ECN exceeds 2 bits")
+	}
+	host.mu.Lock()
+	host.ecn = ecn
+	host.mu.Unlock()
+	return nil
+}
+
 func (host *ipv6ConfigurationHost) GetConfigCopyIPv6() IPv6Host {
 	host.rlock()
 	new := *host
@@ -55,9 +91,16 @@ func (host *ipv6ConfigurationHost) GetConfigCopyIPv6() IPv6Host {
 
 func (host *ipv6ConfigurationHost) AddIPv6Device(dev IPv6Device) {
 	host.lock()
-	defer host.unlock()
 	dev.RegisterIPv6Callback(func(b []byte) { host.callback(dev, b) })
 	host.devices[dev] = true
+	host.unlock()
+	// Neighbor Discovery relies on membership of the solicited-node group,
+	// which must be reported so that switches which snoop on MLD forward
+	// neighbor solicitations to us
+	// See https://tools.ietf.org/html/rfc4861#section-7.2.1
+	if addr, _, ok := dev.IPv6(); ok {
+		host.mld.join(dev, solicitedNodeAddr(addr))
+	}
 }
 
 func (host *ipv6ConfigurationHost) RemoveIPv6Device(dev IPv6Device) {
@@ -68,6 +111,27 @@ func (host *ipv6ConfigurationHost) RemoveIPv6Device(dev IPv6Device) {
 	}
 	dev.RegisterIPv6Callback(nil)
 	delete(host.devices, dev)
+	host.mld.removeDevice(dev)
+}
+
+// JoinIPv6Group joins the multicast group on dev, which must have been added
+// to host, so that packets addressed to the group which are received on dev
+// are delivered. Membership is reported to multicast routers using MLD. If
+// the group has already been joined on dev, JoinIPv6Group is a no-op.
+func (host *ipv6ConfigurationHost) JoinIPv6Group(dev IPv6Device, group IPv6) error {
+	host.rlock()
+	ok := host.devices[dev]
+	host.runlock()
+	if !ok {
+		return errors.New("join group: device not added to host")
+	}
+	return host.mld.join(dev, group)
+}
+
+// LeaveIPv6Group leaves the multicast group on dev. It is an error if the
+// group hasn't been joined on dev.
+func (host *ipv6ConfigurationHost) LeaveIPv6Group(dev IPv6Device, group IPv6) error {
+	return host.mld.leave(dev, group)
 }
 
 func (host *ipv6ConfigurationHost) AddIPv6Route(subnet IPv6Subnet, nexthop IPv6) {
@@ -82,6 +146,13 @@ func (host *ipv6ConfigurationHost) AddIPv6DeviceRoute(subnet IPv6Subnet, dev IPv
 	host.unlock()
 }
 
+// DeleteIPv6Route deletes the route or device route for subnet, if any.
+func (host *ipv6ConfigurationHost) DeleteIPv6Route(subnet IPv6Subnet) {
+	host.lock()
+	host.table.DeleteRoute(subnet)
+	host.unlock()
+}
+
 func (host *ipv6ConfigurationHost) IPv6Routes() []IPv6Route {
 	host.rlock()
 	routes := host.table.Routes()
@@ -110,21 +181,107 @@ func (host *ipv6ConfigurationHost) Forwarding() bool {
 }
 
 func (host *ipv6ConfigurationHost) RegisterIPv6Callback(f func(b []byte, src, dst IPv6), proto IPProtocol) {
+	if f == nil {
+		host.RegisterIPv6InfoCallback(nil, proto)
+		return
+	}
+	host.RegisterIPv6InfoCallback(func(b []byte, src, dst IPv6, info PacketInfo) { f(b, src, dst) }, proto)
+}
+
+// RegisterIPv6InfoCallback is like RegisterIPv4InfoCallback, but for IPv6.
+// info.TTL is the hop limit with which the packet was received.
+func (host *ipv6ConfigurationHost) RegisterIPv6InfoCallback(f func(b []byte, src, dst IPv6, info PacketInfo), proto IPProtocol) {
 	host.lock()
 	host.callbacks[int(proto)] = f
 	host.unlock()
 }
 
+// RegisterIPv6UnreachableCallback is like RegisterIPv4UnreachableCallback,
+// but for IPv6. b is as much of the original packet's payload as fit in the
+// ICMPv6 message.
+func (host *ipv6ConfigurationHost) RegisterIPv6UnreachableCallback(f func(code UnreachableCode, b []byte, src, dst IPv6), proto IPProtocol) {
+	host.lock()
+	host.unreachables[int(proto)] = f
+	host.unlock()
+}
+
+// WriteIPv6Unreachable is like WriteIPv4Unreachable, but for IPv6. If code is
+// UnreachableProtocol, an ICMPv6 parameter problem message is sent instead.
+func (host *ipv6ConfigurationHost) WriteIPv6Unreachable(code UnreachableCode, b []byte, src, dst IPv6, proto IPProtocol) error {
+	hdr := ipv6Header{
+		version:  6,
+		len:      40 + uint16(len(b)),
+		nextHdr:  proto,
+		hopLimit: host.ttl,
+		src:      src,
+		dst:      dst,
+	}
+	host.rlock()
+	err := host.writeUnreachable(code, &hdr, b)
+	host.runlock()
+	return err
+}
+
+// IPv6SourceAddr is like IPv4SourceAddr, but for IPv6.
+func (host *ipv6ConfigurationHost) IPv6SourceAddr(addr IPv6) (IPv6, error) {
+	host.rlock()
+	src, err := host.sourceAddr(addr)
+	host.runlock()
+	return src, err
+}
+
+// IPv6PathMTU is like IPv4PathMTU, but for IPv6. Since path MTU discovery
+// isn't implemented for IPv6, it is always the MTU of the first-hop device.
+func (host *ipv6ConfigurationHost) IPv6PathMTU(addr IPv6) int {
+	host.rlock()
+	mtu := host.pathMTU(addr)
+	host.runlock()
+	return mtu
+}
+
 func (host *ipv6ConfigurationHost) WriteToIPv6(b []byte, addr IPv6, proto IPProtocol) (n int, err error) {
 	host.rlock()
-	n, err = host.write(b, addr, proto, host.ttl)
+	n, err = host.write(b, IPv6{}, addr, proto, host.ttl, host.dscp, host.ecn)
 	host.runlock()
 	return n, err
 }
 
-func (host *ipv6Host) write(b []byte, addr IPv6, proto IPProtocol, hops uint8) (n int, err error) {
-	host.mu.RLock()
-	defer host.mu.RUnlock()
+// WriteToIPv6From is like WriteToIPv4From, but for IPv6.
+func (host *ipv6ConfigurationHost) WriteToIPv6From(b []byte, src, addr IPv6, proto IPProtocol) (n int, err error) {
+	host.rlock()
+	defer host.runlock()
+	if src != (IPv6{}) && !host.isLocal(src) {
+		return 0, errors.Errorf("write IPv6 packet: source address %v is not local", src)
+	}
+	return host.write(b, src, addr, proto, host.ttl, host.dscp, host.ecn)
+}
+
+// assumes host.mu.RLock
+func (host *ipv6Host) pathMTU(addr IPv6) int {
+	_, dev, ok := host.table.Lookup(addr)
+	if !ok {
+		return 0
+	}
+	return dev.MTU()
+}
+
+// assumes host.mu.RLock
+func (host *ipv6Host) sourceAddr(addr IPv6) (IPv6, error) {
+	_, dev, ok := host.table.Lookup(addr)
+	if !ok {
+		return IPv6{}, errors.NewNoRoute(addr.String())
+	}
+	devaddr, _, ok := dev.(IPv6Device).IPv6()
+	if !ok {
+		return IPv6{}, errors.New("device has no IPv6 address")
+	}
+	return devaddr, nil
+}
+
+// assumes host.mu.RLock
+// write writes b to addr. If src is the zero address, the address of the
+// device through which addr is routed is used as the source address.
+func (host *ipv6Host) write(b []byte, src, addr IPv6, proto IPProtocol, hops, dscp, ecn uint8) (n int, err error) {
 	nexthop, dev, ok := host.table.Lookup(addr)
 	if !ok {
 		return 0, errors.Annotate(errors.NewNoRoute(addr.String()), "write IPv6 packet")
@@ -141,17 +298,38 @@ func (host *ipv6Host) write(b []byte, addr IPv6, proto IPProtocol, hops uint8) (
 
 	var hdr ipv6Header
 	hdr.version = 6
+	// the lower 2 bits are used for ECN
+	// See https://tools.ietf.org/html/rfc3168#section-5
+	hdr.trafficClass = dscp<<2 | ecn
 	hdr.len = 40 + uint16(len(b))
 	hdr.nextHdr = proto
 	hdr.hopLimit = hops
 	hdr.src = devaddr
+	if src != (IPv6{}) {
+		hdr.src = src
+	}
 	hdr.dst = addr
 
+	if mtu := dev.MTU(); mtu > 0 && int(hdr.len) > mtu {
+		pkts, err := fragmentIPv6(hdr, b, atomic.AddUint32(&host.nextID, 1), mtu)
+		if err != nil {
+			return 0, errors.Annotate(err, "write IPv6 packet")
+		}
+		for _, pkt := range pkts {
+			if _, err := host.hooks.writeIPv6(dev.(IPv6Device), pkt, nexthop); err != nil {
+				// the packet can't be reassembled
+				// without every fragment
+				return 0, errors.Annotate(err, "write IPv6 packet")
+			}
+		}
+		return len(b), nil
+	}
+
 	buf := make([]byte, int(hdr.len))
 	writeIPv6Header(&hdr, buf)
 	copy(buf[40:], b)
 
-	n, err = dev.WriteToIPv6(buf, nexthop)
+	n, err = host.hooks.writeIPv6(dev.(IPv6Device), buf, nexthop)
 	if n < 40 {
 		n = 0
 	} else {
@@ -197,6 +375,9 @@ func readIPv6Header(hdr *ipv6Header, buf []byte) {
 }
 
 func (host *ipv6Host) callback(dev IPv6Device, b []byte) {
+	if host.hooks.in(b) {
+		return
+	}
 	if len(b) < 40 {
 		return
 	}
@@ -209,36 +390,181 @@ func (host *ipv6Host) callback(dev IPv6Device, b []byte) {
 
 	host.mu.RLock()
 	defer host.mu.RUnlock()
-	var us bool
-	for dev := range host.devices {
-		addr, _, ok := dev.IPv6()
-		if ok && addr == hdr.dst {
-			us = true
-			break
+	switch {
+	case host.isLocal(hdr.dst):
+		host.deliver(dev, &hdr, b[40:])
+	case isIPv6Multicast(hdr.dst):
+		// multicast packets are never forwarded
+		if host.isMember(dev, hdr.dst) {
+			host.deliver(dev, &hdr, b[40:])
 		}
+	case host.forward:
+		host.forwardPacket(&hdr, b)
 	}
+}
 
-	if us {
-		// deliver
-		c := host.callbacks[int(hdr.nextHdr)]
-		if c == nil {
-			return
-		}
-		c(b[40:], hdr.src, hdr.dst)
-	} else if host.forward {
-		// forward
-		if hdr.hopLimit < 2 {
-			// TTL is or would become 0 after decrement
-			// See "TTL" section, https://tools.ietf.org/html/rfc791#page-14
-			return
-		}
-		hdr.hopLimit--
-		setTTL(b, hdr.hopLimit)
-		nexthop, dev, ok := host.table.Lookup(hdr.dst)
-		if !ok {
-			// XXX: ICMPv6 reply
-			return
+// forwardPacket forwards the packet b with the header hdr, which is
+// not addressed to host, to its next hop; assumes host.mu.RLock
+func (host *ipv6Host) forwardPacket(hdr *ipv6Header, b []byte) {
+	if hdr.hopLimit < 2 {
+		// hop limit is or would become 0 after decrement
+		// See https://tools.ietf.org/html/rfc2460#section-3
+		host.writeTimeExceeded(icmpv6CodeHopLimitExceeded, hdr, b[40:])
+		// TODO(joshlf): Log error
+		return
+	}
+	nexthop, dev, ok := host.table.Lookup(hdr.dst)
+	if !ok {
+		host.writeUnreachable(UnreachableNet, hdr, b[40:])
+		// TODO(joshlf): Log error
+		return
+	}
+	// TODO(joshlf): Send a packet too big message if
+	// the packet exceeds the outgoing device's MTU
+	hdr.hopLimit--
+	setHopLimit(b, hdr.hopLimit)
+	host.hooks.writeIPv6(dev.(IPv6Device), b, nexthop)
+	// TODO(joshlf): Log error
+}
+
+// assumes host.mu.RLock
+func (host *ipv6Host) isLocal(addr IPv6) bool {
+	for dev := range host.devices {
+		devaddr, _, ok := dev.IPv6()
+		if ok && devaddr == addr {
+			return true
 		}
-		dev.WriteToIPv6(b, nexthop)
 	}
+	return false
+}
+
+// isMember returns true if the multicast group has been joined on dev. The
+// solicited-node group of dev's address is always considered joined, even if
+// the address was set after dev was added to host; assumes host.mu.RLock
+func (host *ipv6Host) isMember(dev IPv6Device, group IPv6) bool {
+	if addr, _, ok := dev.IPv6(); ok && group == solicitedNodeAddr(addr) {
+		return true
+	}
+	return host.mld.isMember(dev, group)
+}
+
+// deliver delivers the payload b of a packet with the header hdr, received
+// on dev and addressed to host; assumes host.mu.RLock
+func (host *ipv6Host) deliver(dev IPv6Device, hdr *ipv6Header, b []byte) {
+	proto, payload, ok := host.walkExtHeaders(hdr, b)
+	if !ok {
+		return
+	}
+	c := host.callbacks[int(proto)]
+	if c == nil && proto != IPProtocolICMPv6 {
+		// TODO(joshlf): If there are extension headers, the
+		// pointer should identify the last next header field
+		host.writeUnreachable(UnreachableProtocol, hdr, b)
+		// TODO(joshlf): Log error
+		return
+	}
+	if proto == IPProtocolICMPv6 {
+		host.handleICMP(payload, hdr.src, hdr.dst)
+		host.mld.handle(dev, payload, hdr.src, hdr.dst)
+	}
+	if c != nil {
+		c(payload, hdr.src, hdr.dst, PacketInfo{TTL: hdr.hopLimit, DSCP: hdr.trafficClass >> 2, ECN: hdr.trafficClass & 3, Device: dev})
+	}
+}
+
+// writeMLD writes the MLD message b to dst, a multicast address, through dev.
+// MLD messages are never forwarded by routers, so the hop limit is 1, and they
+// carry a Router Alert option so that routers examine them.
+// See https://tools.ietf.org/html/rfc2710#section-3
+func (host *ipv6Host) writeMLD(dev IPv6Device, b []byte, dst IPv6) {
+	// TODO(joshlf): Use a link-local source address once they're supported
+	src, _, _ := dev.IPv6()
+	setICMPChecksum(b, Checksum(b, IPv6PseudoHeaderSum(src, dst, IPProtocolICMPv6, len(b))))
+	hdr := ipv6Header{
+		version:  6,
+		len:      uint16(40 + len(mldHopByHop) + len(b)),
+		nextHdr:  ipv6ExtHopByHop,
+		hopLimit: 1,
+		src:      src,
+		dst:      dst,
+	}
+	buf := make([]byte, int(hdr.len))
+	writeIPv6Header(&hdr, buf)
+	copy(buf[40:], mldHopByHop[:])
+	copy(buf[40+len(mldHopByHop):], b)
+	host.hooks.writeIPv6(dev, buf, dst)
+	// TODO(joshlf): Log error
+}
+
+// handleICMP handles an ICMPv6 message sent from src to dst,
+// dispatching any errors to the appropriate callbacks;
+// assumes host.mu.RLock
+func (host *ipv6Host) handleICMP(b []byte, src, dst IPv6) {
+	code, hdr, payload, ok := parseICMPv6Unreachable(b, src, dst)
+	if !ok || !host.isLocal(hdr.src) {
+		// either not a destination unreachable message,
+		// or the packet it refers to wasn't sent by us
+		return
+	}
+	if f := host.unreachables[int(hdr.nextHdr)]; f != nil {
+		f(code, payload, hdr.src, hdr.dst)
+	}
+}
+
+// writeUnreachable sends an ICMPv6 message indicating that the packet with the
+// header hdr and the payload b could not be delivered; assumes host.mu.RLock
+func (host *ipv6Host) writeUnreachable(code UnreachableCode, hdr *ipv6Header, b []byte) error {
+	err := host.writeError(hdr, b, func(src IPv6) []byte { return icmpv6Unreachable(code, hdr, b, src) })
+	return errors.Annotate(err, "write ICMPv6 destination unreachable")
+}
+
+// writeTimeExceeded sends an ICMPv6 time exceeded message with the given code
+// in response to the packet with the header hdr and the payload b, whose hop
+// limit expired before it could be forwarded or which couldn't be reassembled
+// in time; assumes host.mu.RLock
+func (host *ipv6Host) writeTimeExceeded(code uint8, hdr *ipv6Header, b []byte) error {
+	err := host.writeError(hdr, b, func(src IPv6) []byte { return icmpv6TimeExceeded(code, hdr, b, src) })
+	return errors.Annotate(err, "write ICMPv6 time exceeded")
+}
+
+// reassemblyExpired is called by host.frags when a packet times out after its
+// first fragment, first, has arrived.
+// See https://tools.ietf.org/html/rfc8200#section-4.5
+func (host *ipv6Host) reassemblyExpired(first interface{}) {
+	pkt := first.(*ipv6Packet)
+	host.mu.RLock()
+	host.writeTimeExceeded(icmpv6CodeReassemblyExceeded, &pkt.hdr, pkt.b)
+	// TODO(joshlf): Log error
+	host.mu.RUnlock()
+}
+
+// writeError sends the ICMPv6 error message constructed by msg in response to
+// the packet with the header hdr and the payload b. msg is passed the source
+// address of the message, which is covered by the checksum; assumes
+// host.mu.RLock
+// See https://tools.ietf.org/html/rfc4443#section-2.4
+func (host *ipv6Host) writeError(hdr *ipv6Header, b []byte, msg func(src IPv6) []byte) error {
+	switch {
+	case hdr.dst[0] == 0xFF || hdr.src[0] == 0xFF || hdr.src == (IPv6{}):
+		// multicast, or otherwise not a single host
+		return nil
+	case hdr.nextHdr == IPProtocolICMPv6 && isICMPv6Error(b):
+		return nil
+	}
+	// the source address is covered by the checksum,
+	// so we need to know it before calling write
+	src, err := host.sourceAddr(hdr.src)
+	if err != nil {
+		return err
+	}
+	// TODO(joshlf): Rate limit ICMPv6 errors
+	_, err = host.write(msg(src), IPv6{}, hdr.src, IPProtocolICMPv6, defaultTTL, 0, 0)
+	return err
+}
+
+// setHopLimit sets the hop limit in the IPv6 header encoded in b
+// without having to expensively rewrite the entire header
+// using writeIPv6Header
+func setHopLimit(b []byte, hops uint8) {
+	b[7] = hops
 }
@@ -0,0 +1,260 @@
+package net
+
+import (
+	"github.com/joshlf/net/internal/errors"
+)
+
+// the number of packets which can be queued on a LoopbackDevice before
+// further packets are dropped
+const loopbackQueueLen = 256
+
+// LoopbackDevice is an in-memory device which delivers every packet written
+// to it back to itself. It is capable of sending and receiving both IPv4 and
+// IPv6 packets. When added to a Stack or IPHost along with a device route for
+// its subnet (such as 127.0.0.0/8 or ::1/128), packets sent to addresses in
+// that subnet are delivered locally without leaving the process.
+//
+// Packets are delivered asynchronously by a daemon goroutine. If packets are
+// written faster than they can be delivered, they are dropped once
+// loopbackQueueLen packets are queued.
+//
+// The zero LoopbackDevice is not a valid LoopbackDevice. LoopbackDevices are
+// safe for concurrent access.
+type LoopbackDevice struct {
+	mtu   int
+	queue chan []byte // down if nil
+
+	addr4, netmask4 IPv4
+	addr4Set        bool
+	addr6, netmask6 IPv6
+	addr6Set        bool
+
+	callback4, callback6 func(b []byte) // unset if nil
+	stats                deviceStats
+
+	sync syncer
+}
+
+var _ IPv4Device = &LoopbackDevice{}
+var _ IPv6Device = &LoopbackDevice{}
+
+// NewLoopbackDevice creates a new LoopbackDevice with the given MTU, which is
+// down by default. If mtu is 0, the device has no MTU.
+func NewLoopbackDevice(mtu int) (*LoopbackDevice, error) {
+	if mtu < 0 {
+		return nil, errors.New("new LoopbackDevice: negative MTU")
+	}
+	if mtu > maxMTU {
+		return nil, errors.Errorf("new LoopbackDevice: MTU above maximum of %v", maxMTU)
+	}
+	return &LoopbackDevice{mtu: mtu}, nil
+}
+
+// BringUp brings dev up. If it is already up, BringUp is a no-op.
+func (dev *LoopbackDevice) BringUp() error {
+	return dev.sync.BringUp(func() error {
+		dev.sync.Lock()
+		dev.queue = make(chan []byte, loopbackQueueLen)
+		dev.sync.Unlock()
+		return nil
+	}, dev.readDaemon)
+}
+
+// BringDown brings dev down, discarding any queued packets. If it is already
+// down, BringDown is a no-op.
+func (dev *LoopbackDevice) BringDown() error {
+	return dev.sync.BringDown(func() error {
+		dev.sync.Lock()
+		dev.queue = nil
+		dev.sync.Unlock()
+		return nil
+	})
+}
+
+// IsUp returns true if dev is up.
+func (dev *LoopbackDevice) IsUp() bool {
+	dev.sync.RLock()
+	up := dev.isUp()
+	dev.sync.RUnlock()
+	return up
+}
+
+func (dev *LoopbackDevice) isUp() bool {
+	return dev.queue != nil
+}
+
+// MTU returns dev's MTU.
+func (dev *LoopbackDevice) MTU() int {
+	dev.sync.RLock()
+	mtu := dev.mtu
+	dev.sync.RUnlock()
+	return mtu
+}
+
+// SetMTU sets dev's MTU. If mtu is 0, the device will have no MTU. Otherwise,
+// it must be at least the minimum for the IP versions for which dev has
+// addresses. SetMTU can be called while dev is up.
+func (dev *LoopbackDevice) SetMTU(mtu int) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if mtu != 0 {
+		if err := checkMTU(mtu, true, dev.addr6Set); err != nil {
+			return err
+		}
+	}
+	dev.mtu = mtu
+	return nil
+}
+
+// Stats returns a snapshot of dev's packet counters.
+func (dev *LoopbackDevice) Stats() DeviceStats { return dev.stats.snapshot() }
+
+// Capabilities returns dev's capabilities. Since packets never leave memory,
+// they can't be corrupted, so dev offloads checksums in both directions.
+func (dev *LoopbackDevice) Capabilities() DeviceCaps {
+	return RxChecksumOffload | TxChecksumOffload
+}
+
+// IPv4 returns dev's IPv4 address and network mask if they have been set.
+func (dev *LoopbackDevice) IPv4() (addr, netmask IPv4, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addr4, dev.netmask4, dev.addr4Set
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv4 sets dev's IPv4 address and network mask, returning any error
+// encountered. SetIPv4 can only be called when dev is down.
+func (dev *LoopbackDevice) SetIPv4(addr, netmask IPv4) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("set device IP address on up device")
+	}
+	dev.addr4, dev.netmask4, dev.addr4Set = addr, netmask, true
+	return nil
+}
+
+// UnsetIPv4 unsets dev's IPv4 address and network mask, returning any error
+// encountered. UnsetIPv4 can only be called when dev is down.
+func (dev *LoopbackDevice) UnsetIPv4() error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("unset device IP address on up device")
+	}
+	dev.addr4, dev.netmask4, dev.addr4Set = IPv4{}, IPv4{}, false
+	return nil
+}
+
+// IPv6 returns dev's IPv6 address and network mask if they have been set.
+func (dev *LoopbackDevice) IPv6() (addr, netmask IPv6, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addr6, dev.netmask6, dev.addr6Set
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv6 sets dev's IPv6 address and network mask, returning any error
+// encountered. SetIPv6 can only be called when dev is down.
+func (dev *LoopbackDevice) SetIPv6(addr, netmask IPv6) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("set device IP address on up device")
+	}
+	dev.addr6, dev.netmask6, dev.addr6Set = addr, netmask, true
+	return nil
+}
+
+// UnsetIPv6 unsets dev's IPv6 address and network mask, returning any error
+// encountered. UnsetIPv6 can only be called when dev is down.
+func (dev *LoopbackDevice) UnsetIPv6() error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("unset device IP address on up device")
+	}
+	dev.addr6, dev.netmask6, dev.addr6Set = IPv6{}, IPv6{}, false
+	return nil
+}
+
+// RegisterIPv4Callback registers f to be called when IPv4 packets are received.
+func (dev *LoopbackDevice) RegisterIPv4Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback4 = f
+	dev.sync.Unlock()
+}
+
+// RegisterIPv6Callback registers f to be called when IPv6 packets are received.
+func (dev *LoopbackDevice) RegisterIPv6Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback6 = f
+	dev.sync.Unlock()
+}
+
+// WriteToIPv4 queues the IPv4 packet b to be received by dev. dst is ignored.
+func (dev *LoopbackDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.write(b)
+}
+
+// WriteToIPv6 queues the IPv6 packet b to be received by dev. dst is ignored.
+func (dev *LoopbackDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.write(b)
+}
+
+func (dev *LoopbackDevice) write(b []byte) (n int, err error) {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	if dev.mtu > 0 && len(b) > dev.mtu {
+		dev.stats.txDrop()
+		return 0, errors.MTUf(dev.mtu, "write to device: IP packet exceeds MTU")
+	}
+	if !dev.isUp() {
+		dev.stats.txDrop()
+		return 0, errors.New("write to down device")
+	}
+	select {
+	// the caller may reuse b once we return
+	case dev.queue <- append([]byte(nil), b...):
+		dev.stats.tx(len(b))
+	default:
+		// like a real device, drop the packet if the queue is full
+		// TODO(joshlf): Log it
+		dev.stats.txDrop()
+	}
+	return len(b), nil
+}
+
+func (dev *LoopbackDevice) readDaemon() {
+	dev.sync.RLock()
+	queue := dev.queue
+	dev.sync.RUnlock()
+	for {
+		var b []byte
+		select {
+		case <-dev.sync.StopChan():
+			return
+		case b = <-queue:
+		}
+		dev.stats.rx(len(b))
+		if len(b) == 0 {
+			dev.stats.rxError()
+			continue
+		}
+
+		// don't hold the lock while calling the callbacks, which will
+		// often write right back to dev (for example, to reply to b)
+		dev.sync.RLock()
+		callback4, callback6 := dev.callback4, dev.callback6
+		dev.sync.RUnlock()
+		switch {
+		case b[0]>>4 == 4 && callback4 != nil:
+			callback4(b)
+		case b[0]>>4 == 6 && callback6 != nil:
+			callback6(b)
+		default:
+			dev.stats.rxDrop()
+		}
+	}
+}
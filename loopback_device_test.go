@@ -0,0 +1,58 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLoopbackDevice(t *testing.T) {
+	const udp = 17
+	lo, err := NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	lo.SetIPv4(IPv4{127, 0, 0, 1}, IPv4{255, 0, 0, 0})
+	lo.SetIPv6(IPv6{15: 1}, IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	s := NewStack(StackOptions{})
+	if err := s.AddDevice("lo", lo); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer lo.BringDown()
+
+	type packet struct {
+		b        []byte
+		src, dst IP
+	}
+	recv := make(chan packet, 1)
+	s.RegisterCallback(func(b []byte, src, dst IP) {
+		recv <- packet{append([]byte(nil), b...), src, dst}
+	}, udp)
+
+	// a UDP datagram from port 1234 to port 5678 without a checksum
+	datagram := []byte{0x04, 0xD2, 0x16, 0x2E, 0, 13, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+	for _, addr := range []IP{IPv4{127, 0, 0, 1}, IPv6{15: 1}} {
+		if _, err := s.WriteTo(datagram, addr, udp); err != nil {
+			t.Fatalf("unexpected error writing to %v: %v", addr, err)
+		}
+		select {
+		case p := <-recv:
+			if !bytes.Equal(p.b, datagram) || p.src != addr || p.dst != addr {
+				t.Errorf("unexpected packet: got %v -> %v: %v; want %v -> %v: %v", p.src, p.dst, p.b, addr, addr, datagram)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("datagram to %v not looped back", addr)
+		}
+	}
+
+	if _, err := lo.WriteToIPv4(make([]byte, 1501), IPv4{127, 0, 0, 1}); !IsMTU(err) {
+		t.Errorf("unexpected error writing packet larger than MTU: got %v; want MTU error", err)
+	}
+	lo.BringDown()
+	if _, err := lo.WriteToIPv4(make([]byte, 20), IPv4{127, 0, 0, 1}); err == nil {
+		t.Errorf("no error writing to down device")
+	}
+}
@@ -0,0 +1,283 @@
+package net
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+const (
+	mldLen = 24
+
+	icmpv6TypeMLDQuery  = 130
+	icmpv6TypeMLDReport = 131
+	icmpv6TypeMLDDone   = 132
+
+	// the maximum delay before repeating an unsolicited report
+	mldUnsolicitedReportInterval = 10 * time.Second
+	// the number of unsolicited reports sent when joining a group
+	mldRobustness = 2
+)
+
+var (
+	// the group of all nodes, of which every node is a member
+	// on every device, and which is never reported
+	mldAllNodes = IPv6{0: 0xFF, 1: 0x02, 15: 0x01}
+	// the group of all routers, to which done messages are sent
+	mldAllRouters = IPv6{0: 0xFF, 1: 0x02, 15: 0x02}
+
+	// the Hop-by-Hop Options header which precedes MLD messages, carrying
+	// a Router Alert option (type 5, with the value 0 for MLD) followed by
+	// two bytes of padding
+	// See https://tools.ietf.org/html/rfc2711
+	mldHopByHop = [8]byte{byte(IPProtocolICMPv6), 0, 5, 2, 0, 0, 1, 0}
+)
+
+// isIPv6Multicast returns true if addr is a multicast address.
+func isIPv6Multicast(addr IPv6) bool {
+	return addr[0] == 0xFF
+}
+
+type mldKey struct {
+	dev   IPv6Device
+	group IPv6
+}
+
+type mldGroup struct {
+	// the number of unsolicited reports left to send after joining
+	unsolicited int
+	// whether we sent the last report for the group; if another node
+	// did, it will keep the group alive, so we needn't send a done
+	lastReporter bool
+	timer        *timeout.Timeout // nil if no report is pending
+	deadline     time.Time        // when timer fires, relative to timeout.NowMonotonic
+}
+
+// mld represents an instance of the MLDv1 protocol, the IPv6 counterpart to
+// IGMPv2, which tracks the multicast groups joined on each of a host's devices
+// and reports their membership to multicast routers.
+// See https://tools.ietf.org/html/rfc2710
+type mld struct {
+	// writes the MLD message b to dst through dev; it must
+	// not be called with mu held
+	write func(dev IPv6Device, b []byte, dst IPv6)
+
+	groups map[mldKey]*mldGroup // make sure to check if nil before modifying
+	// timing parameter; the default can be overridden in tests
+	unsolicitedInterval time.Duration
+
+	timeoutd *timeout.Daemon // created along with groups
+	mu       sync.Mutex
+}
+
+// an mldMessage is a message to be written once mld.mu is released
+type mldMessage struct {
+	dev IPv6Device
+	b   []byte
+	dst IPv6
+}
+
+// join joins group on dev. If it has already been joined, join is a no-op.
+func (m *mld) join(dev IPv6Device, group IPv6) error {
+	if !isIPv6Multicast(group) {
+		return errors.Errorf("join group: %v is not a multicast address", group)
+	}
+	m.mu.Lock()
+	var out []mldMessage
+	key := mldKey{dev, group}
+	if m.groups == nil {
+		m.groups = make(map[mldKey]*mldGroup)
+		m.timeoutd = timeout.NewDaemon(&m.mu)
+	}
+	if _, ok := m.groups[key]; !ok {
+		e := &mldGroup{}
+		m.groups[key] = e
+		if mldReported(group) {
+			// See https://tools.ietf.org/html/rfc2710#section-4
+			e.unsolicited = mldRobustness - 1
+			out = m.report(key, e)
+			m.setTimer(key, e, m.randDelay(m.interval()))
+		}
+	}
+	m.mu.Unlock()
+	m.flush(out)
+	return nil
+}
+
+// leave leaves group on dev. It is an error if group hasn't been joined.
+func (m *mld) leave(dev IPv6Device, group IPv6) error {
+	m.mu.Lock()
+	key := mldKey{dev, group}
+	e, ok := m.groups[key]
+	if !ok {
+		m.mu.Unlock()
+		return errors.Errorf("leave group: %v has not been joined", group)
+	}
+	m.stopTimer(e)
+	delete(m.groups, key)
+	var out []mldMessage
+	if e.lastReporter {
+		out = []mldMessage{{dev, mldPacket(icmpv6TypeMLDDone, 0, group), mldAllRouters}}
+	}
+	m.mu.Unlock()
+	m.flush(out)
+	return nil
+}
+
+// removeDevice leaves all of the groups joined on dev
+// without sending done messages.
+func (m *mld) removeDevice(dev IPv6Device) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, e := range m.groups {
+		if key.dev == dev {
+			m.stopTimer(e)
+			delete(m.groups, key)
+		}
+	}
+}
+
+// isMember returns true if group has been joined on dev.
+func (m *mld) isMember(dev IPv6Device, group IPv6) bool {
+	if group == mldAllNodes {
+		return true
+	}
+	m.mu.Lock()
+	_, ok := m.groups[mldKey{dev, group}]
+	m.mu.Unlock()
+	return ok
+}
+
+// handle handles the ICMPv6 message b, sent from src to dst and received on
+// dev, if it's an MLD message.
+func (m *mld) handle(dev IPv6Device, b []byte, src, dst IPv6) {
+	if len(b) < mldLen || (b[0] != icmpv6TypeMLDQuery && b[0] != icmpv6TypeMLDReport) {
+		// done messages are only of interest to routers
+		return
+	}
+	if Checksum(b, IPv6PseudoHeaderSum(src, dst, IPProtocolICMPv6, len(b))) != 0xFFFF {
+		// TODO(joshlf): Log it
+		return
+	}
+	var group IPv6
+	copy(group[:], b[8:24])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch b[0] {
+	case icmpv6TypeMLDQuery:
+		// See https://tools.ietf.org/html/rfc2710#section-4
+		maxResp := time.Duration(uint16(b[4])<<8|uint16(b[5])) * time.Millisecond
+		for key, e := range m.groups {
+			if key.dev == dev && mldReported(key.group) && (group == IPv6{} || group == key.group) {
+				m.scheduleReport(key, e, maxResp)
+			}
+		}
+	case icmpv6TypeMLDReport:
+		// another listener has reported the group, so our report
+		// would be redundant
+		if e, ok := m.groups[mldKey{dev, group}]; ok && e.timer != nil {
+			m.stopTimer(e)
+			e.unsolicited = 0
+			e.lastReporter = false
+		}
+	}
+}
+
+// scheduleReport schedules a report for key, whose entry is e, in response
+// to a query with the maximum response delay maxResp. If a report is already
+// scheduled sooner, it is left alone; assumes m.mu.Lock
+func (m *mld) scheduleReport(key mldKey, e *mldGroup, maxResp time.Duration) {
+	if e.timer != nil && e.deadline.Sub(timeout.NowMonotonic()) <= maxResp {
+		return
+	}
+	m.setTimer(key, e, m.randDelay(maxResp))
+}
+
+// report constructs a report for key, whose entry is e; assumes m.mu.Lock
+func (m *mld) report(key mldKey, e *mldGroup) []mldMessage {
+	e.lastReporter = true
+	return []mldMessage{{key.dev, mldPacket(icmpv6TypeMLDReport, 0, key.group), key.group}}
+}
+
+// assumes m.mu.Lock
+func (m *mld) setTimer(key mldKey, e *mldGroup, d time.Duration) {
+	m.stopTimer(e)
+	e.deadline = timeout.NowMonotonic().Add(d)
+	e.timer = m.timeoutd.AddTimeout(func() { m.timeout(key, e) }, e.deadline)
+}
+
+// assumes m.mu.Lock
+func (m *mld) stopTimer(e *mldGroup) {
+	if e.timer != nil {
+		e.timer.Cancel()
+		e.timer = nil
+	}
+}
+
+// timeout is called by m.timeoutd with m.mu held when the timer for e, the
+// entry for key, fires. It releases m.mu while writing the report.
+func (m *mld) timeout(key mldKey, e *mldGroup) {
+	e.timer = nil
+	out := m.report(key, e)
+	if e.unsolicited > 0 {
+		e.unsolicited--
+	}
+	if e.unsolicited > 0 {
+		m.setTimer(key, e, m.randDelay(m.interval()))
+	}
+	m.mu.Unlock()
+	m.flush(out)
+	m.mu.Lock()
+}
+
+// interval returns the maximum delay before repeating an unsolicited report.
+func (m *mld) interval() time.Duration {
+	if m.unsolicitedInterval == 0 {
+		return mldUnsolicitedReportInterval
+	}
+	return m.unsolicitedInterval
+}
+
+// randDelay returns a random delay in [0, max), which spreads out the reports
+// of the listeners of a group so that all but the first can be suppressed.
+func (m *mld) randDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (m *mld) flush(out []mldMessage) {
+	for _, msg := range out {
+		m.write(msg.dev, msg.b, msg.dst)
+		// TODO(joshlf): Log error
+	}
+}
+
+// mldReported returns true if membership of group is reported. The all-nodes
+// group and groups of interface-local or reserved scope are never reported.
+// See https://tools.ietf.org/html/rfc2710#section-5
+func mldReported(group IPv6) bool {
+	scope := group[1] & 0xF
+	return group != mldAllNodes && scope > 1
+}
+
+// mldPacket constructs an MLD message with the given type, maximum response
+// delay (in milliseconds), and group. Its checksum, which covers the source
+// and destination addresses, is left zero.
+func mldPacket(typ uint8, maxResp uint16, group IPv6) []byte {
+	b := make([]byte, mldLen)
+	buf := b
+	parse.PutByte(&buf, typ)
+	parse.PutByte(&buf, 0)
+	parse.PutUint16(&buf, 0)
+	parse.PutUint16(&buf, maxResp)
+	parse.PutUint16(&buf, 0)
+	copy(parse.GetBytes(&buf, 16), group[:])
+	return b
+}
@@ -0,0 +1,141 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMLD(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	// the peer is a bare testEthernetInterface so that
+	// the frames sent to it can be inspected directly
+	ifacea, peer := newTestEthernetInterfacePair()
+	peer.mac = MAC{2, 0, 0, 0, 0, 2}
+	dev, err := NewEthernetDevice(ifacea, MAC{2, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	addr, src := IPv6{0xfd, 15: 1}, IPv6{0xfd, 15: 2}
+	dev.SetIPv6(addr, IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err := dev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer dev.BringDown()
+
+	type frame struct {
+		b   []byte
+		dst MAC
+	}
+	frames := make(chan frame, 16)
+	peer.RegisterCallback(func(b []byte, src, dst MAC, et EtherType) {
+		if et == EtherTypeIPv6 && len(b) >= 40 && IPProtocol(b[6]) == ipv6ExtHopByHop {
+			frames <- frame{b, dst}
+		}
+	})
+
+	s := NewStack(StackOptions{})
+	host := s.IPv6Host.(*ipv6ConfigurationHost)
+	host.mld.unsolicitedInterval = 50 * time.Millisecond
+	recvd := make(chan IPv6, 16)
+	s.IPv6Host.RegisterIPv6Callback(func(b []byte, src, dst IPv6) { recvd <- dst }, proto)
+
+	solicited := solicitedNodeAddr(addr)
+	group, other := IPv6{0xFF, 0x05, 14: 0x12, 15: 0x34}, IPv6{0xFF, 0x05, 14: 0x56, 15: 0x78}
+	// expectMLD expects s to send an MLD message of the given type for group
+	// to dst, which is mapped to the corresponding Ethernet multicast address
+	expectMLD := func(typ uint8, group, dst IPv6) {
+		t.Helper()
+		var f frame
+		select {
+		case f = <-frames:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no MLD message of type %v sent", typ)
+		}
+		var hdr ipv6Header
+		readIPv6Header(&hdr, f.b)
+		if f.dst != ipv6MulticastMAC(dst) || hdr.dst != dst || hdr.hopLimit != 1 {
+			t.Fatalf("unexpected packet: got (dst %v (MAC %v), hop limit %v); want dst %v (MAC %v) with hop limit 1",
+				hdr.dst, f.dst, hdr.hopLimit, dst, ipv6MulticastMAC(dst))
+		}
+		proto, msg, ok := host.walkExtHeaders(&hdr, f.b[40:])
+		if !ok || proto != IPProtocolICMPv6 || len(msg) != mldLen || msg[0] != typ || IPv6(msg[8:24]) != group ||
+			Checksum(msg, IPv6PseudoHeaderSum(hdr.src, hdr.dst, IPProtocolICMPv6, len(msg))) != 0xFFFF {
+			t.Fatalf("unexpected message: got %x; want MLD message of type %v for %v", f.b[40:], typ, group)
+		}
+	}
+	// send sends an IPv6 packet with the given payload
+	// from src to dst, preceded by the given extension headers
+	send := func(dst IPv6, next IPProtocol, ext, payload []byte) {
+		hdr := ipv6Header{version: 6, len: uint16(40 + len(ext) + len(payload)), nextHdr: next, hopLimit: 1, src: src, dst: dst}
+		b := make([]byte, ethernetHeaderLen+int(hdr.len))
+		writeIPv6Header(&hdr, b[ethernetHeaderLen:])
+		copy(b[ethernetHeaderLen+40:], ext)
+		copy(b[ethernetHeaderLen+40+len(ext):], payload)
+		mac := ifacea.mac
+		if isIPv6Multicast(dst) {
+			mac = ipv6MulticastMAC(dst)
+		}
+		peer.WriteFrame(b, mac, EtherTypeIPv6)
+	}
+	// deliver sends a datagram to each of dsts, followed by one to s itself,
+	// and returns the destinations of those which were delivered
+	deliver := func(dsts ...IPv6) (got []IPv6) {
+		t.Helper()
+		for _, dst := range append(dsts, addr) {
+			send(dst, proto, nil, []byte("hello"))
+		}
+		for {
+			select {
+			case dst := <-recvd:
+				if dst == addr {
+					return got
+				}
+				got = append(got, dst)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("datagram not delivered")
+			}
+		}
+	}
+
+	// the solicited-node group is joined as soon as the device is added
+	if err := s.AddDevice("eth0", dev); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	expectMLD(icmpv6TypeMLDReport, solicited, solicited)
+	expectMLD(icmpv6TypeMLDReport, solicited, solicited)
+	if got := deliver(group, solicited, mldAllNodes); len(got) != 2 || got[0] != solicited || got[1] != mldAllNodes {
+		t.Errorf("unexpected datagrams delivered: got %v; want those to %v and %v", got, solicited, mldAllNodes)
+	}
+
+	if err := s.JoinGroup(dev, addr); err == nil {
+		t.Errorf("no error joining non-multicast group")
+	}
+	if err := s.JoinGroup(dev, group); err != nil {
+		t.Fatalf("unexpected error joining group: %v", err)
+	}
+	// one report is sent immediately, and another shortly after
+	expectMLD(icmpv6TypeMLDReport, group, group)
+	expectMLD(icmpv6TypeMLDReport, group, group)
+	if got := deliver(other, group); len(got) != 1 || got[0] != group {
+		t.Errorf("unexpected datagrams delivered: got %v; want only the one to %v", got, group)
+	}
+
+	// a query for the group is answered within its
+	// maximum response delay (here, 100ms)
+	query := mldPacket(icmpv6TypeMLDQuery, 100, group)
+	setICMPChecksum(query, Checksum(query, IPv6PseudoHeaderSum(src, group, IPProtocolICMPv6, len(query))))
+	send(group, ipv6ExtHopByHop, mldHopByHop[:], query)
+	expectMLD(icmpv6TypeMLDReport, group, group)
+
+	// since we sent the last report, a done is sent
+	if err := s.LeaveGroup(dev, group); err != nil {
+		t.Fatalf("unexpected error leaving group: %v", err)
+	}
+	expectMLD(icmpv6TypeMLDDone, group, mldAllRouters)
+	if got := deliver(group); len(got) != 0 {
+		t.Errorf("unexpected datagrams delivered after leaving group: %v", got)
+	}
+	if err := s.LeaveGroup(dev, group); err == nil {
+		t.Errorf("no error leaving group which hasn't been joined")
+	}
+}
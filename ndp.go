@@ -0,0 +1,485 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/parse"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// Neighbor Discovery message types and options
+// See https://tools.ietf.org/html/rfc4861#section-4
+const (
+	icmpv6TypeNeighborSolicitation  = 135
+	icmpv6TypeNeighborAdvertisement = 136
+
+	ndpOptionSourceLinkAddr = 1
+	ndpOptionTargetLinkAddr = 2
+
+	// flags in a neighbor advertisement
+	ndpFlagRouter    = 0x80
+	ndpFlagSolicited = 0x40
+	ndpFlagOverride  = 0x20
+
+	// the length of a neighbor solicitation or advertisement
+	// without options
+	ndpMessageLen = 24
+	// the hop limit with which all ND messages are sent; any
+	// other hop limit means the message was forwarded
+	ndpHopLimit = 255
+)
+
+// protocol constants
+// See https://tools.ietf.org/html/rfc4861#section-10
+const (
+	maxMulticastSolicit  = 3
+	maxUnicastSolicit    = 3
+	defaultReachableTime = 30 * time.Second
+	defaultRetransTimer  = time.Second
+	delayFirstProbeTime  = 5 * time.Second
+
+	// the maximum number of packets queued for a neighbor
+	// whose link-layer address is being resolved; once it's
+	// reached, the oldest packet is dropped
+	// See https://tools.ietf.org/html/rfc4861#section-7.2.2
+	maxNeighborQueue = 3
+)
+
+// A neighborState is the state of a neighbor cache entry.
+// See https://tools.ietf.org/html/rfc4861#section-7.3.2
+type neighborState uint8
+
+const (
+	// address resolution is in progress
+	neighborIncomplete neighborState = iota
+	// the neighbor was recently known to be reachable
+	neighborReachable
+	// the neighbor's reachability is unknown, but nothing
+	// will be done until a packet is sent to it
+	neighborStale
+	// a packet was recently sent to a stale neighbor; waiting
+	// for upper-layer protocols to confirm reachability
+	neighborDelay
+	// reachability is being confirmed with unicast solicitations
+	neighborProbe
+)
+
+func (s neighborState) String() string {
+	switch s {
+	case neighborIncomplete:
+		return "INCOMPLETE"
+	case neighborReachable:
+		return "REACHABLE"
+	case neighborStale:
+		return "STALE"
+	case neighborDelay:
+		return "DELAY"
+	case neighborProbe:
+		return "PROBE"
+	}
+	return "UNKNOWN"
+}
+
+type neighbor struct {
+	state  neighborState
+	mac    MAC      // unset while INCOMPLETE
+	probes int      // the number of solicitations sent in the current state
+	queue  [][]byte // packets awaiting address resolution
+	timer  *timeout.Timeout
+}
+
+// ndp represents an instance of the Neighbor Discovery protocol, the IPv6
+// analog of ARP, on an Ethernet device. It maintains a neighbor cache which
+// maps the IPv6 addresses of neighbors to their MAC addresses, resolving
+// addresses on demand and verifying that cached neighbors are still
+// reachable.
+// See https://tools.ietf.org/html/rfc4861
+type ndp struct {
+	mac  MAC
+	addr IPv6
+	// writes the packet b, which starts with space for an Ethernet
+	// header, to the given MAC; it must not be called with mu held
+	write func(b []byte, dst MAC)
+
+	neighbors map[IPv6]*neighbor
+	// timing parameters; the defaults can be overridden in tests
+	reachableTime, retransTimer, delayFirstProbe time.Duration
+	stopped                                      bool
+
+	timeoutd *timeout.Daemon
+	mu       sync.Mutex
+}
+
+// an ndpFrame is a packet to be written once ndp.mu is released
+type ndpFrame struct {
+	b   []byte
+	dst MAC
+}
+
+// newNDP creates a new ND instance for a device with the given MAC and
+// IPv6 addresses, which writes packets using write.
+func newNDP(mac MAC, addr IPv6, write func(b []byte, dst MAC)) *ndp {
+	n := &ndp{
+		mac:             mac,
+		addr:            addr,
+		write:           write,
+		neighbors:       make(map[IPv6]*neighbor),
+		reachableTime:   defaultReachableTime,
+		retransTimer:    defaultRetransTimer,
+		delayFirstProbe: delayFirstProbeTime,
+	}
+	n.timeoutd = timeout.NewDaemon(&n.mu)
+	return n
+}
+
+// stop stops all of n's timers and drops any queued packets. Once stop has
+// returned, n will not write any more packets.
+func (n *ndp) stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stopped = true
+	n.timeoutd.Stop()
+	for addr := range n.neighbors {
+		delete(n.neighbors, addr)
+	}
+}
+
+// state returns the state of the neighbor cache entry for addr, if any.
+func (n *ndp) state(addr IPv6) (state neighborState, mac MAC, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.neighbors[addr]
+	if !ok {
+		return 0, MAC{}, false
+	}
+	return e.state, e.mac, true
+}
+
+// writeTo writes the IPv6 packet b, which starts with space for an Ethernet
+// header, to the neighbor dst. If dst's MAC address isn't known, b is queued
+// until address resolution completes.
+// See https://tools.ietf.org/html/rfc4861#section-7.3.3
+func (n *ndp) writeTo(b []byte, dst IPv6) {
+	if dst[0] == 0xFF {
+		n.write(b, ipv6MulticastMAC(dst))
+		return
+	}
+	n.mu.Lock()
+	out := n.resolve(b, dst)
+	n.mu.Unlock()
+	n.flush(out)
+}
+
+// resolve arranges for b to be written to dst, returning the frames to be
+// written immediately; assumes n.mu.Lock
+func (n *ndp) resolve(b []byte, dst IPv6) []ndpFrame {
+	if n.stopped {
+		return nil
+	}
+	e, ok := n.neighbors[dst]
+	if !ok {
+		e = &neighbor{state: neighborIncomplete, queue: [][]byte{b}}
+		n.neighbors[dst] = e
+		return n.solicit(dst, e)
+	}
+	switch e.state {
+	case neighborIncomplete:
+		if len(e.queue) == maxNeighborQueue {
+			// TODO(joshlf): Log it
+			e.queue = e.queue[1:]
+		}
+		e.queue = append(e.queue, b)
+		return nil
+	case neighborStale:
+		n.setState(dst, e, neighborDelay)
+	}
+	return []ndpFrame{{b, e.mac}}
+}
+
+// setState moves e, the entry for addr, to the given state, restarting its
+// timer appropriately; assumes n.mu.Lock
+func (n *ndp) setState(addr IPv6, e *neighbor, state neighborState) {
+	if e.timer != nil {
+		e.timer.Cancel()
+		e.timer = nil
+	}
+	e.state = state
+	e.probes = 0
+	var d time.Duration
+	switch state {
+	case neighborReachable:
+		d = n.reachableTime
+	case neighborDelay:
+		d = n.delayFirstProbe
+	case neighborIncomplete, neighborProbe:
+		d = n.retransTimer
+	default:
+		return
+	}
+	e.timer = n.timeoutd.AddTimeout(func() { n.timeout(addr, e) }, timeout.NowMonotonic().Add(d))
+}
+
+// solicit sends a neighbor solicitation for addr, whose entry is e, and
+// restarts e's retransmission timer. While e is INCOMPLETE, the solicitation
+// is multicast; otherwise, it's sent directly to the cached MAC address.
+// Assumes n.mu.Lock
+func (n *ndp) solicit(addr IPv6, e *neighbor) []ndpFrame {
+	probes := e.probes + 1
+	n.setState(addr, e, e.state)
+	e.probes = probes
+
+	msg := n.message(icmpv6TypeNeighborSolicitation, 0, addr, ndpOptionSourceLinkAddr)
+	if e.state == neighborIncomplete {
+		dst := solicitedNodeAddr(addr)
+		return []ndpFrame{{n.packet(msg, dst), ipv6MulticastMAC(dst)}}
+	}
+	return []ndpFrame{{n.packet(msg, addr), e.mac}}
+}
+
+// timeout is called by n.timeoutd with n.mu held when the timer for e, the
+// entry for addr, fires. It releases n.mu while writing any solicitation.
+func (n *ndp) timeout(addr IPv6, e *neighbor) {
+	e.timer = nil
+	var out []ndpFrame
+	switch e.state {
+	case neighborIncomplete, neighborProbe:
+		max := maxMulticastSolicit
+		if e.state == neighborProbe {
+			max = maxUnicastSolicit
+		}
+		if e.probes < max {
+			out = n.solicit(addr, e)
+			break
+		}
+		// the neighbor is unreachable; any queued packets are dropped
+		// TODO(joshlf): Send ICMPv6 address unreachable messages
+		delete(n.neighbors, addr)
+	case neighborReachable:
+		n.setState(addr, e, neighborStale)
+	case neighborDelay:
+		e.state = neighborProbe
+		out = n.solicit(addr, e)
+	}
+	n.mu.Unlock()
+	n.flush(out)
+	n.mu.Lock()
+}
+
+// handlePacket handles the IPv6 packet b if it's a neighbor solicitation or
+// advertisement, returning true if so.
+func (n *ndp) handlePacket(b []byte) bool {
+	if len(b) < 40+ndpMessageLen {
+		return false
+	}
+	var hdr ipv6Header
+	readIPv6Header(&hdr, b)
+	msg := b[40:]
+	if hdr.nextHdr != IPProtocolICMPv6 ||
+		(msg[0] != icmpv6TypeNeighborSolicitation && msg[0] != icmpv6TypeNeighborAdvertisement) {
+		return false
+	}
+	if int(hdr.len) != len(b) || hdr.hopLimit != ndpHopLimit || msg[1] != 0 ||
+		Checksum(msg, IPv6PseudoHeaderSum(hdr.src, hdr.dst, IPProtocolICMPv6, len(msg))) != 0xFFFF {
+		// See https://tools.ietf.org/html/rfc4861#section-7.1
+		// TODO(joshlf): Log it
+		return true
+	}
+	var target IPv6
+	copy(target[:], msg[8:24])
+	mac, hasMAC, ok := parseNDPOptions(msg[ndpMessageLen:], msg[0])
+	if !ok || target[0] == 0xFF {
+		return true
+	}
+
+	n.mu.Lock()
+	var out []ndpFrame
+	if msg[0] == icmpv6TypeNeighborSolicitation {
+		out = n.handleSolicitation(&hdr, target, mac, hasMAC)
+	} else {
+		out = n.handleAdvertisement(&hdr, msg[4], target, mac, hasMAC)
+	}
+	n.mu.Unlock()
+	n.flush(out)
+	return true
+}
+
+// handleSolicitation handles a neighbor solicitation with the header hdr for
+// target, which carried the source link-layer address mac if hasMAC is set;
+// assumes n.mu.Lock
+// See https://tools.ietf.org/html/rfc4861#section-7.2.3
+func (n *ndp) handleSolicitation(hdr *ipv6Header, target IPv6, mac MAC, hasMAC bool) []ndpFrame {
+	unspecified := hdr.src == IPv6{}
+	if n.stopped || target != n.addr || (unspecified && hasMAC) {
+		return nil
+	}
+	var out []ndpFrame
+	if hasMAC {
+		out = n.update(hdr.src, mac)
+	}
+
+	if unspecified {
+		// the sender is performing duplicate address
+		// detection, so it can't receive unicast
+		dst := IPv6{0: 0xFF, 1: 0x02, 15: 1}
+		msg := n.message(icmpv6TypeNeighborAdvertisement, ndpFlagOverride, n.addr, ndpOptionTargetLinkAddr)
+		return append(out, ndpFrame{n.packet(msg, dst), ipv6MulticastMAC(dst)})
+	}
+	msg := n.message(icmpv6TypeNeighborAdvertisement, ndpFlagSolicited|ndpFlagOverride, n.addr, ndpOptionTargetLinkAddr)
+	return append(out, n.resolve(n.packet(msg, hdr.src), hdr.src)...)
+}
+
+// update records that the neighbor addr has the MAC address mac, as claimed
+// by a solicitation it sent; assumes n.mu.Lock
+func (n *ndp) update(addr IPv6, mac MAC) []ndpFrame {
+	e, ok := n.neighbors[addr]
+	switch {
+	case !ok:
+		e = &neighbor{mac: mac}
+		n.neighbors[addr] = e
+		n.setState(addr, e, neighborStale)
+	case e.state == neighborIncomplete:
+		e.mac = mac
+		n.setState(addr, e, neighborStale)
+		return n.dequeue(e)
+	case e.mac != mac:
+		e.mac = mac
+		n.setState(addr, e, neighborStale)
+	}
+	return nil
+}
+
+// handleAdvertisement handles a neighbor advertisement with the header hdr and
+// the given flags for target, which carried the target link-layer address mac
+// if hasMAC is set; assumes n.mu.Lock
+// See https://tools.ietf.org/html/rfc4861#section-7.2.5
+func (n *ndp) handleAdvertisement(hdr *ipv6Header, flags byte, target IPv6, mac MAC, hasMAC bool) []ndpFrame {
+	solicited := flags&ndpFlagSolicited != 0
+	override := flags&ndpFlagOverride != 0
+	if hdr.dst[0] == 0xFF && solicited {
+		return nil
+	}
+	e, ok := n.neighbors[target]
+	if !ok {
+		// we aren't interested in this neighbor
+		return nil
+	}
+
+	if e.state == neighborIncomplete {
+		if !hasMAC {
+			return nil
+		}
+		e.mac = mac
+		if solicited {
+			n.setState(target, e, neighborReachable)
+		} else {
+			n.setState(target, e, neighborStale)
+		}
+		return n.dequeue(e)
+	}
+
+	changed := hasMAC && mac != e.mac
+	if !override && changed {
+		// don't trust the new address without confirmation
+		if e.state == neighborReachable {
+			n.setState(target, e, neighborStale)
+		}
+		return nil
+	}
+	if changed {
+		e.mac = mac
+	}
+	switch {
+	case solicited:
+		n.setState(target, e, neighborReachable)
+	case changed:
+		n.setState(target, e, neighborStale)
+	}
+	return nil
+}
+
+// dequeue returns the frames for the packets queued on e, which
+// has just been resolved; assumes n.mu.Lock
+func (n *ndp) dequeue(e *neighbor) []ndpFrame {
+	out := make([]ndpFrame, len(e.queue))
+	for i, b := range e.queue {
+		out[i] = ndpFrame{b, e.mac}
+	}
+	e.queue = nil
+	return out
+}
+
+func (n *ndp) flush(out []ndpFrame) {
+	for _, f := range out {
+		n.write(f.b, f.dst)
+		// TODO(joshlf): Log error
+	}
+}
+
+// message constructs a neighbor solicitation or advertisement with the given
+// flags for target, carrying n's MAC address in an option of the given type.
+func (n *ndp) message(typ, flags byte, target IPv6, opt byte) []byte {
+	msg := make([]byte, ndpMessageLen+8)
+	msg[0] = typ
+	msg[4] = flags
+	copy(msg[8:24], target[:])
+	msg[24] = opt
+	msg[25] = 1 // in units of 8 bytes
+	copy(msg[26:32], n.mac[:])
+	return msg
+}
+
+// packet constructs a packet carrying the ND message msg from n's address to
+// dst, preceded by space for an Ethernet header. The checksum of msg is set.
+func (n *ndp) packet(msg []byte, dst IPv6) []byte {
+	setICMPChecksum(msg, Checksum(msg, IPv6PseudoHeaderSum(n.addr, dst, IPProtocolICMPv6, len(msg))))
+	hdr := ipv6Header{
+		version:  6,
+		len:      40 + uint16(len(msg)),
+		nextHdr:  IPProtocolICMPv6,
+		hopLimit: ndpHopLimit,
+		src:      n.addr,
+		dst:      dst,
+	}
+	b := make([]byte, ethernetHeaderLen+int(hdr.len))
+	writeIPv6Header(&hdr, b[ethernetHeaderLen:])
+	copy(b[ethernetHeaderLen+40:], msg)
+	return b
+}
+
+// parseNDPOptions parses the options of a neighbor solicitation or
+// advertisement of the given type, returning the link-layer address from the
+// source or target link-layer address option, respectively. Other options are
+// ignored. ok is false if the options are malformed.
+// See https://tools.ietf.org/html/rfc4861#section-4.6
+func parseNDPOptions(b []byte, typ byte) (mac MAC, hasMAC, ok bool) {
+	want := byte(ndpOptionSourceLinkAddr)
+	if typ == icmpv6TypeNeighborAdvertisement {
+		want = ndpOptionTargetLinkAddr
+	}
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] == 0 || len(b) < int(b[1])*8 {
+			return MAC{}, false, false
+		}
+		opt := parse.GetBytes(&b, int(b[1])*8)
+		if opt[0] == want && len(opt) >= 8 {
+			copy(mac[:], opt[2:8])
+			hasMAC = true
+		}
+	}
+	return mac, hasMAC, true
+}
+
+// solicitedNodeAddr returns the solicited-node multicast address for addr,
+// to which solicitations for addr are sent.
+// See https://tools.ietf.org/html/rfc4291#section-2.7.1
+func solicitedNodeAddr(addr IPv6) IPv6 {
+	return IPv6{0: 0xFF, 1: 0x02, 11: 0x01, 12: 0xFF, 13: addr[13], 14: addr[14], 15: addr[15]}
+}
+
+// ipv6MulticastMAC returns the Ethernet multicast MAC
+// address to which packets for addr are sent.
+// See https://tools.ietf.org/html/rfc2464#section-7
+func ipv6MulticastMAC(addr IPv6) MAC {
+	return MAC{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]}
+}
@@ -0,0 +1,238 @@
+package net
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A testEthernetInterface is an EthernetInterface which delivers frames to
+// its peer asynchronously, recording the destination of each frame written.
+// If cut is set, frames are recorded, but not delivered.
+type testEthernetInterface struct {
+	mac      MAC
+	mtu      int
+	peer     *testEthernetInterface
+	frames   chan func()
+	callback func(b []byte, src, dst MAC, et EtherType)
+	sent     []MAC
+	cut      bool
+	mu       sync.Mutex
+}
+
+func newTestEthernetInterfacePair() (*testEthernetInterface, *testEthernetInterface) {
+	a := &testEthernetInterface{mtu: 1500, frames: make(chan func(), 64)}
+	b := &testEthernetInterface{mtu: 1500, frames: make(chan func(), 64), peer: a}
+	a.peer = b
+	for _, iface := range []*testEthernetInterface{a, b} {
+		go func(frames chan func()) {
+			for f := range frames {
+				f()
+			}
+		}(iface.frames)
+	}
+	return a, b
+}
+
+func (iface *testEthernetInterface) BringUp() error   { return nil }
+func (iface *testEthernetInterface) BringDown() error { return nil }
+func (iface *testEthernetInterface) IsUp() bool       { return true }
+func (iface *testEthernetInterface) MTU() int         { return iface.mtu }
+
+func (iface *testEthernetInterface) SetMTU(mtu uint64) error { iface.mtu = int(mtu); return nil }
+
+func (iface *testEthernetInterface) MAC() (ok bool, mac MAC) { return true, iface.mac }
+func (iface *testEthernetInterface) SetMAC(mac MAC) error    { iface.mac = mac; return nil }
+
+func (iface *testEthernetInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.mu.Lock()
+	iface.callback = f
+	iface.mu.Unlock()
+}
+
+func (iface *testEthernetInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	return iface.WriteFrameSrc(b, iface.mac, dst, et)
+}
+
+func (iface *testEthernetInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	iface.mu.Lock()
+	iface.sent = append(iface.sent, dst)
+	cut := iface.cut
+	iface.mu.Unlock()
+	peer := iface.peer
+	if cut || (dst != peer.mac && dst != BroadcastMAC && !isMulticastMAC(dst)) {
+		return len(b), nil
+	}
+	payload := append([]byte(nil), b[ethernetHeaderLen:]...)
+	peer.frames <- func() {
+		peer.mu.Lock()
+		f := peer.callback
+		peer.mu.Unlock()
+		if f != nil {
+			f(payload, src, dst, et)
+		}
+	}
+	return len(b), nil
+}
+
+// sentTo returns the number of frames written to dst.
+func (iface *testEthernetInterface) sentTo(dst MAC) int {
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+	var n int
+	for _, mac := range iface.sent {
+		if mac == dst {
+			n++
+		}
+	}
+	return n
+}
+
+func (iface *testEthernetInterface) setCut(cut bool) {
+	iface.mu.Lock()
+	iface.cut = cut
+	iface.mu.Unlock()
+}
+
+// newTestEthernetDevicePair creates a pair of up EthernetDevices, addressed
+// 10.0.0.1 and fd00::1, and 10.0.0.2 and fd00::2, which are connected by a
+// pair of testEthernetInterfaces.
+func newTestEthernetDevicePair(t *testing.T) (a, b *EthernetDevice, ifacea, ifaceb *testEthernetInterface) {
+	ifacea, ifaceb = newTestEthernetInterfacePair()
+	a, err := NewEthernetDevice(ifacea, MAC{2, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	b, err = NewEthernetDevice(ifaceb, MAC{2, 0, 0, 0, 0, 2})
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	a.SetIPv4(IPv4{10, 0, 0, 1}, IPv4{255, 255, 255, 0})
+	b.SetIPv4(IPv4{10, 0, 0, 2}, IPv4{255, 255, 255, 0})
+	netmask := IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	a.SetIPv6(IPv6{0xfd, 15: 1}, netmask)
+	b.SetIPv6(IPv6{0xfd, 15: 2}, netmask)
+	for _, dev := range []*EthernetDevice{a, b} {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("could not bring device up: %v", err)
+		}
+	}
+	return a, b, ifacea, ifaceb
+}
+
+// waitNeighbor waits for the neighbor cache entry for addr to reach the given
+// state, or, if ok is false, to be removed.
+func waitNeighbor(t *testing.T, n *ndp, addr IPv6, want neighborState, ok bool) {
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		state, _, exists := n.state(addr)
+		if exists == ok && (!ok || state == want) {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			if ok {
+				t.Fatalf("neighbor %v not %v: got %v (exists: %v)", addr, want, state, exists)
+			}
+			t.Fatalf("neighbor %v not removed: got %v", addr, state)
+		}
+	}
+}
+
+func TestNeighborDiscovery(t *testing.T) {
+	a, b, ifacea, _ := newTestEthernetDevicePair(t)
+	defer a.BringDown()
+	defer b.BringDown()
+	recv := make(chan []byte, 16)
+	b.RegisterIPv6Callback(func(b []byte) { recv <- b })
+
+	hdr := ipv6Header{version: 6, len: 48, nextHdr: 253, hopLimit: defaultTTL, src: IPv6{0xfd, 15: 1}, dst: IPv6{0xfd, 15: 2}}
+	pkt := make([]byte, 48)
+	writeIPv6Header(&hdr, pkt)
+	copy(pkt[40:], "neighbor")
+	// the packet is queued until the advertisement arrives
+	for i := 0; i < 2; i++ {
+		if n, err := a.WriteToIPv6(pkt, hdr.dst); n != len(pkt) || err != nil {
+			t.Fatalf("unexpected result from WriteToIPv6: (%v, %v); want (%v, <nil>)", n, err, len(pkt))
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-recv:
+			if !bytes.Equal(got, pkt) {
+				t.Errorf("unexpected packet: got %x; want %x", got, pkt)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet not delivered")
+		}
+	}
+	// the solicitation was multicast to the solicited-node address
+	if n := ifacea.sentTo(MAC{0x33, 0x33, 0xff, 0, 0, 2}); n != 1 {
+		t.Errorf("unexpected number of multicast solicitations: got %v; want 1", n)
+	}
+
+	if state, mac, ok := a.ndp.state(hdr.dst); !ok || state != neighborReachable || mac != (MAC{2, 0, 0, 0, 0, 2}) {
+		t.Errorf("unexpected neighbor cache entry: got (%v, %v, %v); want (REACHABLE, %v, true)", state, mac, ok, MAC{2, 0, 0, 0, 0, 2})
+	}
+	// b learned a's address from the solicitation, and has
+	// since sent the advertisement directly to a
+	if state, mac, ok := b.ndp.state(hdr.src); !ok || state != neighborDelay || mac != (MAC{2, 0, 0, 0, 0, 1}) {
+		t.Errorf("unexpected neighbor cache entry: got (%v, %v, %v); want (DELAY, %v, true)", state, mac, ok, MAC{2, 0, 0, 0, 0, 1})
+	}
+	if _, _, ok := a.ndp.state(IPv6{0xfd, 15: 3}); ok {
+		t.Errorf("unexpected neighbor cache entry for unused address")
+	}
+}
+
+func TestNeighborStates(t *testing.T) {
+	a, b, ifacea, ifaceb := newTestEthernetDevicePair(t)
+	defer a.BringDown()
+	defer b.BringDown()
+	for _, dev := range []*EthernetDevice{a, b} {
+		dev.ndp.reachableTime = 100 * time.Millisecond
+		dev.ndp.delayFirstProbe = 10 * time.Millisecond
+		dev.ndp.retransTimer = 10 * time.Millisecond
+	}
+	addrb, macb := IPv6{0xfd, 15: 2}, MAC{2, 0, 0, 0, 0, 2}
+	pkt := make([]byte, 40)
+
+	a.WriteToIPv6(pkt, addrb)
+	waitNeighbor(t, a.ndp, addrb, neighborReachable, true)
+	waitNeighbor(t, a.ndp, addrb, neighborStale, true)
+
+	// sending to a stale neighbor starts verifying that it's reachable
+	a.WriteToIPv6(pkt, addrb)
+	if state, _, _ := a.ndp.state(addrb); state != neighborDelay {
+		t.Fatalf("unexpected state after write to stale neighbor: got %v; want DELAY", state)
+	}
+	// no confirmation arrives before the delay expires, so it's probed
+	// with a unicast solicitation, and the advertisement confirms it
+	for start := time.Now(); ifacea.sentTo(macb) < 3; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("stale neighbor not probed")
+		}
+	}
+	waitNeighbor(t, a.ndp, addrb, neighborReachable, true)
+
+	// an unreachable neighbor is removed once probes go unanswered
+	ifacea.setCut(true)
+	ifaceb.setCut(true)
+	waitNeighbor(t, a.ndp, addrb, neighborStale, true)
+	before := ifacea.sentTo(macb)
+	a.WriteToIPv6(pkt, addrb)
+	waitNeighbor(t, a.ndp, addrb, 0, false)
+	// the packet, followed by each probe
+	if n := ifacea.sentTo(macb) - before; n != 1+maxUnicastSolicit {
+		t.Errorf("unexpected number of frames sent to unreachable neighbor: got %v; want %v", n, 1+maxUnicastSolicit)
+	}
+
+	// address resolution of a neighbor which doesn't exist fails
+	addrc := IPv6{0xfd, 15: 3}
+	a.WriteToIPv6(pkt, addrc)
+	if state, _, _ := a.ndp.state(addrc); state != neighborIncomplete {
+		t.Fatalf("unexpected state during address resolution: got %v; want INCOMPLETE", state)
+	}
+	waitNeighbor(t, a.ndp, addrc, 0, false)
+	if n := ifacea.sentTo(ipv6MulticastMAC(solicitedNodeAddr(addrc))); n != maxMulticastSolicit {
+		t.Errorf("unexpected number of multicast solicitations: got %v; want %v", n, maxMulticastSolicit)
+	}
+}
@@ -1,6 +1,26 @@
 package net
 
-import "github.com/joshlf/net/internal/errors"
+import (
+	stderrors "errors"
+	"runtime"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// Sentinel errors describing common network failures. Errors returned by this
+// package and its subpackages wrap the appropriate sentinel, and can be
+// checked using the standard library's errors.Is or the predicates below.
+var (
+	ErrTimeout             = errors.ErrTimeout
+	ErrConnRefused         = errors.ErrConnRefused
+	ErrConnReset           = errors.ErrConnReset
+	ErrNetUnreachable      = errors.ErrNetUnreachable
+	ErrHostUnreachable     = errors.ErrHostUnreachable
+	ErrProtocolUnreachable = errors.ErrProtocolUnreachable
+	ErrPortUnreachable     = errors.ErrPortUnreachable
+	ErrNoSuchHost          = errors.ErrNoSuchHost
+	ErrIdleTimeout         = errors.ErrIdleTimeout
+)
 
 // IsMTU returns true if err is an MTU-related error.
 func IsMTU(err error) bool {
@@ -16,3 +36,54 @@ func IsNoRoute(err error) bool {
 func IsTimeout(err error) bool {
 	return errors.IsTimeout(err)
 }
+
+// IsUnreachable returns true if err indicates that a packet's destination was
+// reported unreachable.
+func IsUnreachable(err error) bool {
+	return errors.IsUnreachable(err)
+}
+
+// IsConnRefused returns true if err indicates that a connection attempt was
+// refused, or that a datagram was sent to a port on which nothing is
+// listening.
+func IsConnRefused(err error) bool {
+	return stderrors.Is(err, ErrConnRefused)
+}
+
+// IsConnReset returns true if err indicates that a connection was reset.
+func IsConnReset(err error) bool {
+	return stderrors.Is(err, ErrConnReset)
+}
+
+// IsNoSuchHost returns true if err indicates that a hostname doesn't exist.
+func IsNoSuchHost(err error) bool {
+	return stderrors.Is(err, ErrNoSuchHost)
+}
+
+// IsHostUnreachable returns true if err indicates that a host was reported
+// unreachable.
+func IsHostUnreachable(err error) bool {
+	return stderrors.Is(err, ErrHostUnreachable)
+}
+
+// IsNetUnreachable returns true if err indicates that there was no route to
+// a host, or that its network was reported unreachable.
+func IsNetUnreachable(err error) bool {
+	return stderrors.Is(err, ErrNetUnreachable)
+}
+
+// SetStackTraces controls whether errors created by this package and its
+// subpackages capture a stack trace at the point of their creation, which
+// can be retrieved with StackTrace. It is disabled by default since capturing
+// a stack trace is expensive.
+func SetStackTraces(enabled bool) {
+	errors.SetStackTraces(enabled)
+}
+
+// StackTrace returns the stack trace captured when err was created, starting
+// with the frame which created it. The stack trace is retained when err is
+// annotated. If stack traces were disabled when err was created (see
+// SetStackTraces), StackTrace returns nil.
+func StackTrace(err error) []runtime.Frame {
+	return errors.StackTrace(err)
+}
@@ -0,0 +1,203 @@
+package net
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// LinkType identifies the link-layer header type of the packets in a pcap
+// file.
+// See http://www.tcpdump.org/linktypes.html
+type LinkType uint32
+
+const (
+	// LinkTypeEthernet indicates that packets begin with an Ethernet header.
+	LinkTypeEthernet LinkType = 1
+	// LinkTypeRaw indicates that packets are raw IPv4 or IPv6 packets with
+	// no link-layer header, as sent and received by IP devices.
+	LinkTypeRaw LinkType = 101
+)
+
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	// the maximum number of bytes of each packet which are captured
+	pcapSnapLen = 65535
+
+	pcapHeaderLen       = 24
+	pcapRecordHeaderLen = 16
+)
+
+// A PcapWriter writes packets to an io.Writer in the classic pcap file
+// format, which can be read by tools such as Wireshark and tcpdump. All
+// fields are written in little-endian byte order.
+// See https://wiki.wireshark.org/Development/LibpcapFileFormat
+//
+// PcapWriters are safe for concurrent access. The zero PcapWriter is not
+// a valid PcapWriter.
+type PcapWriter struct {
+	w io.Writer
+	// returns the time at which each packet was captured
+	now func() time.Time
+
+	mu sync.Mutex
+}
+
+// NewPcapWriter creates a new PcapWriter which writes packets of the given
+// link type to w. The pcap file header is written immediately.
+func NewPcapWriter(w io.Writer, linkType LinkType) (*PcapWriter, error) {
+	var hdr [pcapHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:], pcapVersionMinor)
+	// the time zone offset and timestamp accuracy (hdr[8:16]) are always 0
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], uint32(linkType))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, errors.Annotate(err, "write pcap header")
+	}
+	// tools reading the file expect wall clock time, so timestamps
+	// don't come from a monotonic clock like timeout.NowMonotonic
+	return &PcapWriter{w: w, now: time.Now}, nil
+}
+
+// WritePacket writes a record containing the packet b, timestamped with the
+// current time. Only the first 65535 bytes of b are written.
+func (pw *PcapWriter) WritePacket(b []byte) error {
+	origLen := len(b)
+	if len(b) > pcapSnapLen {
+		b = b[:pcapSnapLen]
+	}
+	buf := make([]byte, pcapRecordHeaderLen+len(b))
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	now := pw.now()
+	binary.LittleEndian.PutUint32(buf[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(origLen))
+	copy(buf[pcapRecordHeaderLen:], b)
+	_, err := pw.w.Write(buf)
+	return errors.Annotate(err, "write pcap record")
+}
+
+// NewPcapDevice returns a Device which wraps dev, writing every IP packet
+// sent or received by dev to pw, which should have been created with
+// LinkTypeRaw. The returned Device implements IPv4Device and IPv6Device
+// if dev does; it should be used in place of dev, for example when adding
+// it to a Stack. Errors writing to pw are ignored so that they don't
+// interfere with the flow of traffic.
+//
+// The returned Device has an Unwrap method which returns dev.
+func NewPcapDevice(dev Device, pw *PcapWriter) Device {
+	dev4, ok4 := dev.(IPv4Device)
+	dev6, ok6 := dev.(IPv6Device)
+	switch {
+	case ok4 && ok6:
+		return &pcapIPDevice{dev.(ipDevice), pw}
+	case ok4:
+		return &pcapIPv4Device{dev4, pw}
+	case ok6:
+		return &pcapIPv6Device{dev6, pw}
+	default:
+		return &pcapDevice{dev, pw}
+	}
+}
+
+// ipDevice is a device which is capable of
+// sending and receiving both IPv4 and IPv6
+type ipDevice interface {
+	IPv4Device
+	IPv6Device
+}
+
+// tap returns a callback which writes each packet to pw before passing it to
+// f, or nil if f is nil.
+func (pw *PcapWriter) tap(f func(b []byte)) func(b []byte) {
+	if f == nil {
+		return nil
+	}
+	return func(b []byte) {
+		pw.WritePacket(b)
+		// TODO(joshlf): Log error
+		f(b)
+	}
+}
+
+// tapWrite writes b to pw if it was written successfully by a device.
+func (pw *PcapWriter) tapWrite(b []byte, n int, err error) (int, error) {
+	if err == nil {
+		pw.WritePacket(b)
+		// TODO(joshlf): Log error
+	}
+	return n, err
+}
+
+type pcapDevice struct {
+	Device
+	pw *PcapWriter
+}
+
+func (dev *pcapDevice) Unwrap() Device { return dev.Device }
+
+type pcapIPv4Device struct {
+	IPv4Device
+	pw *PcapWriter
+}
+
+func (dev *pcapIPv4Device) Unwrap() Device { return dev.IPv4Device }
+
+func (dev *pcapIPv4Device) RegisterIPv4Callback(f func(b []byte)) {
+	dev.IPv4Device.RegisterIPv4Callback(dev.pw.tap(f))
+}
+
+func (dev *pcapIPv4Device) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	n, err = dev.IPv4Device.WriteToIPv4(b, dst)
+	return dev.pw.tapWrite(b, n, err)
+}
+
+type pcapIPv6Device struct {
+	IPv6Device
+	pw *PcapWriter
+}
+
+func (dev *pcapIPv6Device) Unwrap() Device { return dev.IPv6Device }
+
+func (dev *pcapIPv6Device) RegisterIPv6Callback(f func(b []byte)) {
+	dev.IPv6Device.RegisterIPv6Callback(dev.pw.tap(f))
+}
+
+func (dev *pcapIPv6Device) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	n, err = dev.IPv6Device.WriteToIPv6(b, dst)
+	return dev.pw.tapWrite(b, n, err)
+}
+
+type pcapIPDevice struct {
+	ipDevice
+	pw *PcapWriter
+}
+
+func (dev *pcapIPDevice) Unwrap() Device { return dev.ipDevice }
+
+func (dev *pcapIPDevice) RegisterIPv4Callback(f func(b []byte)) {
+	dev.ipDevice.RegisterIPv4Callback(dev.pw.tap(f))
+}
+
+func (dev *pcapIPDevice) RegisterIPv6Callback(f func(b []byte)) {
+	dev.ipDevice.RegisterIPv6Callback(dev.pw.tap(f))
+}
+
+func (dev *pcapIPDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	n, err = dev.ipDevice.WriteToIPv4(b, dst)
+	return dev.pw.tapWrite(b, n, err)
+}
+
+func (dev *pcapIPDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	n, err = dev.ipDevice.WriteToIPv6(b, dst)
+	return dev.pw.tapWrite(b, n, err)
+}
@@ -0,0 +1,100 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// parsePcap parses the pcap file b, returning its link type and
+// the captured and original lengths of each of its records.
+func parsePcap(t *testing.T, b []byte) (linkType LinkType, inclLens, origLens []int) {
+	if len(b) < pcapHeaderLen {
+		t.Fatalf("pcap file too short for header: %v bytes", len(b))
+	}
+	if magic := binary.LittleEndian.Uint32(b); magic != pcapMagic {
+		t.Fatalf("unexpected magic number: got %#x; want %#x", magic, pcapMagic)
+	}
+	linkType = LinkType(binary.LittleEndian.Uint32(b[20:]))
+	for b = b[pcapHeaderLen:]; len(b) > 0; {
+		if len(b) < pcapRecordHeaderLen {
+			t.Fatalf("pcap file too short for record header: %v bytes", len(b))
+		}
+		incl := int(binary.LittleEndian.Uint32(b[8:]))
+		orig := int(binary.LittleEndian.Uint32(b[12:]))
+		b = b[pcapRecordHeaderLen:]
+		if len(b) < incl {
+			t.Fatalf("pcap file too short for record: %v bytes; want %v", len(b), incl)
+		}
+		b = b[incl:]
+		inclLens = append(inclLens, incl)
+		origLens = append(origLens, orig)
+	}
+	return linkType, inclLens, origLens
+}
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf, LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	for _, n := range []int{60, pcapSnapLen + 100} {
+		if err := pw.WritePacket(make([]byte, n)); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+	}
+	linkType, incl, orig := parsePcap(t, buf.Bytes())
+	if linkType != LinkTypeEthernet {
+		t.Errorf("unexpected link type: got %v; want %v", linkType, LinkTypeEthernet)
+	}
+	// the second packet is truncated to the snap length
+	if len(incl) != 2 || incl[0] != 60 || orig[0] != 60 || incl[1] != pcapSnapLen || orig[1] != pcapSnapLen+100 {
+		t.Errorf("unexpected record lengths: got %v captured, %v original; want [60 %v], [60 %v]", incl, orig, pcapSnapLen, pcapSnapLen+100)
+	}
+}
+
+func TestPcapDevice(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf, LinkTypeRaw)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	lo, _ := NewLoopbackDevice(1500)
+	lo.SetIPv4(IPv4{127, 0, 0, 1}, IPv4{255, 0, 0, 0})
+	dev := NewPcapDevice(lo, pw)
+	if _, ok := dev.(IPv6Device); !ok {
+		t.Fatalf("wrapped dual-stack device does not implement IPv6Device")
+	}
+	s := NewStack(StackOptions{})
+	if err := s.AddDevice("lo", dev); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := dev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer dev.BringDown()
+
+	c, err := s.ListenUDP(&UDPAddr{Port: 1234})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.WriteTo([]byte("hello"), &UDPAddr{IP: IPv4{127, 0, 0, 1}, Port: 1234}); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if r := readFrom(t, c); r.err != nil {
+		t.Fatalf("unexpected error reading: %v", r.err)
+	}
+
+	// the datagram was captured once when it was sent and again before
+	// it was delivered to c, so both records have been written by now
+	want := 20 + udpHeaderLen + len("hello")
+	linkType, incl, orig := parsePcap(t, buf.Bytes())
+	if linkType != LinkTypeRaw {
+		t.Errorf("unexpected link type: got %v; want %v", linkType, LinkTypeRaw)
+	}
+	if len(incl) != 2 || incl[0] != want || incl[1] != want || orig[0] != want || orig[1] != want {
+		t.Errorf("unexpected record lengths: got %v captured, %v original; want two of %v", incl, orig, want)
+	}
+}
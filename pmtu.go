@@ -0,0 +1,97 @@
+package net
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// the smallest MTU that every IPv4 link must support
+	// See https://tools.ietf.org/html/rfc791#page-25
+	minIPv4MTU = 68
+	// the smallest MTU that every IPv6 link must support
+	// See https://tools.ietf.org/html/rfc2460#section-5
+	minIPv6MTU = 1280
+	// the largest MTU that a device may have, since no IP packet can be
+	// larger (IPv6 jumbograms, which we don't support, aside)
+	maxMTU = 0xFFFF
+	// how long a discovered path MTU is trusted before we try the first-hop
+	// MTU again in case the path has changed; since a larger MTU which
+	// doesn't fit will just be reported again, this is how we probe for
+	// increases. See https://tools.ietf.org/html/rfc1191#section-6.3
+	pmtuTimeout = 10 * time.Minute
+	// the maximum number of destinations whose path MTUs are cached
+	maxPMTUEntries = 1024
+)
+
+// pmtuPlateaus are common MTUs, from largest to smallest, used to estimate the
+// path MTU when a router reports that fragmentation is needed but not the MTU.
+// See https://tools.ietf.org/html/rfc1191#section-7
+var pmtuPlateaus = []int{65535, 32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, minIPv4MTU}
+
+// pmtuPlateau returns the largest plateau smaller than len, the total length
+// of a packet which was too big.
+func pmtuPlateau(len int) int {
+	for _, p := range pmtuPlateaus {
+		if p < len {
+			return p
+		}
+	}
+	return minIPv4MTU
+}
+
+type pmtuEntry struct {
+	mtu     int
+	expires time.Time
+}
+
+// A pmtuCache caches the path MTUs discovered for IPv4 destinations. The zero
+// value pmtuCache is a valid, empty pmtuCache.
+type pmtuCache struct {
+	entries map[IPv4]pmtuEntry // make sure to check if nil before modifying
+
+	mu sync.Mutex
+}
+
+// get returns the path MTU for dst, or 0 if none has been discovered.
+func (c *pmtuCache) get(dst IPv4) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[dst]
+	if !ok {
+		return 0
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, dst)
+		return 0
+	}
+	return e.mtu
+}
+
+// update records that the path MTU for dst is at most mtu.
+// It returns false if mtu isn't smaller than the current estimate.
+func (c *pmtuCache) update(dst IPv4, mtu int) bool {
+	if mtu < minIPv4MTU {
+		// a legitimate router would never report this, so ignore
+		// it rather than letting it reduce us to tiny packets
+		return false
+	}
+	if cur := c.get(dst); cur != 0 && cur <= mtu {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[IPv4]pmtuEntry)
+	}
+	if _, ok := c.entries[dst]; !ok && len(c.entries) >= maxPMTUEntries {
+		// evict an arbitrary entry; the worst that can happen
+		// is that its path MTU has to be discovered again
+		for addr := range c.entries {
+			delete(c.entries, addr)
+			break
+		}
+	}
+	c.entries[dst] = pmtuEntry{mtu: mtu, expires: time.Now().Add(pmtuTimeout)}
+	return true
+}
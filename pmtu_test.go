@@ -0,0 +1,58 @@
+package net
+
+import "testing"
+
+func TestPathMTUDiscovery(t *testing.T) {
+	const proto = 253
+	a, b, _, _ := newTestIPv4HostPair(1500, proto)
+	addra, addrb := IPv4{10, 0, 0, 1}, IPv4{10, 0, 0, 2}
+	dfa := a.GetConfigCopyIPv4()
+	dfa.SetDontFragment(true)
+
+	var mtus []int
+	a.RegisterIPv4PathMTUCallback(func(mtu int, b []byte, src, dst IPv4) {
+		if src != addra || dst != addrb {
+			t.Errorf("unexpected addresses: got %v -> %v; want %v -> %v", src, dst, addra, addrb)
+		}
+		mtus = append(mtus, mtu)
+	}, proto)
+	if mtu := a.IPv4PathMTU(addrb); mtu != 1500 {
+		t.Fatalf("unexpected initial path MTU: got %v; want 1500", mtu)
+	}
+
+	// tooBig simulates a router reporting that a packet of the given
+	// length was too big for a link with the given MTU
+	tooBig := func(len, mtu int) {
+		hdr := ipv4Header{version: 4, IHL: 5, len: uint16(len), flags: ipv4FlagDF, proto: proto, src: addra, dst: addrb}
+		b.WriteToIPv4(icmpv4FragNeeded(mtu, &hdr, make([]byte, 8)), addra, IPProtocolICMP)
+	}
+	check := func(what string, want int) {
+		if len(mtus) != 1 || mtus[0] != want {
+			t.Errorf("%v: unexpected path MTU callbacks: got %v; want [%v]", what, mtus, want)
+		}
+		mtus = nil
+		if mtu := a.IPv4PathMTU(addrb); mtu != want {
+			t.Errorf("%v: unexpected path MTU: got %v; want %v", what, mtu, want)
+		}
+	}
+
+	tooBig(1500, 1280)
+	check("reported MTU", 1280)
+	_, err := dfa.WriteToIPv4(make([]byte, 1400), addrb, proto)
+	if !IsMTU(err) {
+		t.Errorf("unexpected error writing packet larger than path MTU with DF: %v", err)
+	}
+	if _, err := a.WriteToIPv4(make([]byte, 1400), addrb, proto); err != nil {
+		t.Errorf("unexpected error writing packet larger than path MTU without DF: %v", err)
+	}
+
+	// a router which doesn't report the MTU
+	tooBig(1280, 0)
+	check("plateau", 1006)
+
+	// reports of larger MTUs than the packet are bogus
+	tooBig(500, 1000)
+	if len(mtus) != 0 || a.IPv4PathMTU(addrb) != 1006 {
+		t.Errorf("path MTU updated by bogus report")
+	}
+}
@@ -0,0 +1,294 @@
+//go:build linux
+
+package net
+
+import (
+	"encoding/binary"
+	gonet "net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// the maximum size of a frame read from a packet socket: a maximum-sized
+// packet and its Ethernet header; since frames are read whole, this leaves
+// room for offloads (such as GRO) which hand us frames larger than the MTU
+const maxRawSocketFrame = maxMTU + ethernetHeaderLen
+
+// htons converts x to network byte order, which is how packet
+// sockets expect protocol numbers to be given.
+func htons(x uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], x)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+// RawSocketInterface is an EthernetInterface backed by a Linux packet socket
+// (AF_PACKET, SOCK_RAW) bound to an existing network interface. Every frame
+// the interface receives is delivered to the RawSocketInterface, and frames
+// written to it are sent out of the interface as-is. Since the kernel's own
+// network stack keeps using the interface, the RawSocketInterface should be
+// given a MAC address of its own, and the interface may need to be put in
+// promiscuous mode (for example, using the ip command) for frames to that
+// MAC address to be received. Opening packet sockets requires the CAP_NET_RAW
+// capability.
+//
+// The packet socket is opened when the RawSocketInterface is brought up and
+// closed when it is brought down.
+//
+// The zero RawSocketInterface is not a valid RawSocketInterface.
+// RawSocketInterfaces are safe for concurrent access.
+type RawSocketInterface struct {
+	name  string
+	index int
+	file  *os.File // down if nil
+	mtu   int
+
+	mac    MAC
+	macSet bool
+
+	callback func(b []byte, src, dst MAC, et EtherType) // unset if nil
+
+	sync syncer
+}
+
+var _ EthernetInterface = &RawSocketInterface{}
+
+// NewRawSocketInterface creates a new RawSocketInterface bound to the named
+// network interface, which must exist. It is down by default, and its MTU is
+// initially that of the network interface.
+func NewRawSocketInterface(name string) (*RawSocketInterface, error) {
+	ifi, err := gonet.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.Annotate(err, "new RawSocketInterface")
+	}
+	return &RawSocketInterface{name: name, index: ifi.Index, mtu: ifi.MTU}, nil
+}
+
+// Name returns the name of the network interface to which iface is bound.
+func (iface *RawSocketInterface) Name() string { return iface.name }
+
+// BringUp brings iface up by opening its packet socket. If it is already up,
+// BringUp is a no-op.
+func (iface *RawSocketInterface) BringUp() error {
+	return iface.sync.BringUp(func() error {
+		iface.sync.Lock()
+		defer iface.sync.Unlock()
+
+		// a non-blocking socket is registered with the runtime poller by
+		// os.NewFile, which allows the read daemon to use read deadlines
+		// to notice when it's told to stop
+		proto := htons(syscall.ETH_P_ALL)
+		fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, int(proto))
+		if err != nil {
+			return errors.Annotate(os.NewSyscallError("socket", err), "bring interface up")
+		}
+		err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.index})
+		if err != nil {
+			syscall.Close(fd)
+			return errors.Annotate(os.NewSyscallError("bind", err), "bring interface up")
+		}
+		iface.file = os.NewFile(uintptr(fd), iface.name)
+		return nil
+	}, iface.readDaemon)
+}
+
+// BringDown brings iface down, closing its packet socket. If it is already
+// down, BringDown is a no-op.
+func (iface *RawSocketInterface) BringDown() error {
+	return iface.sync.BringDown(func() error {
+		iface.sync.Lock()
+		defer iface.sync.Unlock()
+		err := iface.file.Close()
+		iface.file = nil
+		return errors.Annotate(err, "bring interface down")
+	})
+}
+
+// IsUp returns true if iface is up.
+func (iface *RawSocketInterface) IsUp() bool {
+	iface.sync.RLock()
+	up := iface.isUp()
+	iface.sync.RUnlock()
+	return up
+}
+
+func (iface *RawSocketInterface) isUp() bool {
+	return iface.file != nil
+}
+
+// MAC returns iface's MAC address, if any.
+func (iface *RawSocketInterface) MAC() (ok bool, mac MAC) {
+	iface.sync.RLock()
+	ok, mac = iface.macSet, iface.mac
+	iface.sync.RUnlock()
+	return ok, mac
+}
+
+// SetMAC sets iface's MAC address. It is an error to call SetMAC with the
+// broadcast MAC, or while iface is up.
+func (iface *RawSocketInterface) SetMAC(mac MAC) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MAC on up interface")
+	}
+	if mac == BroadcastMAC {
+		return errors.New("set MAC to broadcast MAC")
+	}
+	iface.mac, iface.macSet = mac, true
+	return nil
+}
+
+// MTU returns iface's MTU.
+func (iface *RawSocketInterface) MTU() int {
+	iface.sync.RLock()
+	mtu := iface.mtu
+	iface.sync.RUnlock()
+	return mtu
+}
+
+// SetMTU sets iface's MTU. This only limits the size of frames written to
+// iface; the MTU of the network interface in the kernel is unchanged. It is
+// an error to set an MTU of 0 or to call SetMTU while iface is up.
+func (iface *RawSocketInterface) SetMTU(mtu uint64) error {
+	iface.sync.Lock()
+	defer iface.sync.Unlock()
+	if iface.isUp() {
+		return errors.New("set MTU on up interface")
+	}
+	if mtu == 0 {
+		return errors.New("set MTU to 0")
+	}
+	iface.mtu = int(mtu)
+	return nil
+}
+
+// RegisterCallback implements EthernetInterface's RegisterCallback.
+func (iface *RawSocketInterface) RegisterCallback(f func(b []byte, src, dst MAC, et EtherType)) {
+	iface.sync.Lock()
+	iface.callback = f
+	iface.sync.Unlock()
+}
+
+// WriteFrame implements EthernetInterface's WriteFrame.
+func (iface *RawSocketInterface) WriteFrame(b []byte, dst MAC, et EtherType) (n int, err error) {
+	iface.sync.RLock()
+	src, ok := iface.mac, iface.macSet
+	iface.sync.RUnlock()
+	if !ok {
+		return 0, errors.New("write frame from interface with no MAC address")
+	}
+	return iface.WriteFrameSrc(b, src, dst, et)
+}
+
+// WriteFrameSrc implements EthernetInterface's WriteFrameSrc.
+func (iface *RawSocketInterface) WriteFrameSrc(b []byte, src, dst MAC, et EtherType) (n int, err error) {
+	iface.sync.RLock()
+	defer iface.sync.RUnlock()
+	if !iface.isUp() {
+		return 0, errors.New("write to down interface")
+	}
+	if len(b) > iface.mtu+ethernetHeaderLen {
+		return 0, errors.MTUf(iface.mtu, "write frame: payload exceeds MTU")
+	}
+	writeEthernetHeader(ethernetHeader{src: src, dst: dst, et: et}, b)
+	n, err = iface.file.Write(b)
+	return n, errors.Annotate(err, "write frame")
+}
+
+// accepts returns true if a frame sent to dst should be delivered to iface's
+// callback; see EthernetInterface's RegisterCallback. Assumes iface.sync.RLock.
+func (iface *RawSocketInterface) accepts(dst MAC) bool {
+	return !iface.macSet || dst == iface.mac || dst == BroadcastMAC || isMulticastMAC(dst)
+}
+
+func (iface *RawSocketInterface) readDaemon() {
+	b := make([]byte, maxRawSocketFrame)
+	for {
+		select {
+		case <-iface.sync.StopChan():
+			return
+		default:
+		}
+
+		iface.sync.RLock()
+		err := iface.file.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		if err != nil {
+			// TODO(joshlf): Log it
+			iface.sync.RUnlock()
+			continue
+		}
+		n, outgoing, err := iface.read(b)
+		if err != nil || outgoing {
+			// TODO(joshlf): Log errors other than timeouts
+			iface.sync.RUnlock()
+			continue
+		}
+		eh, err := parseEthernetHeader(b[:n])
+		if err == nil && iface.callback != nil && iface.accepts(eh.dst) {
+			iface.callback(b[eh.EncodedLen():n], eh.src, eh.dst, eh.et)
+		}
+		iface.sync.RUnlock()
+	}
+}
+
+// read reads a single frame into b. The socket sees the frames sent out of the
+// network interface as well as those received on it, including those written
+// by iface itself; outgoing reports whether the frame was one of the former.
+// Assumes iface.sync.RLock.
+func (iface *RawSocketInterface) read(b []byte) (n int, outgoing bool, err error) {
+	rc, err := iface.file.SyscallConn()
+	if err != nil {
+		return 0, false, err
+	}
+	var from syscall.Sockaddr
+	rerr := rc.Read(func(fd uintptr) bool {
+		n, from, err = syscall.Recvfrom(int(fd), b, 0)
+		return err != syscall.EAGAIN
+	})
+	if rerr != nil {
+		return 0, false, rerr
+	}
+	if err != nil {
+		return 0, false, os.NewSyscallError("recvfrom", err)
+	}
+	ll, ok := from.(*syscall.SockaddrLinklayer)
+	return n, ok && ll.Pkttype == syscall.PACKET_OUTGOING, nil
+}
+
+// RawSocketDevice is an EthernetDevice whose frames are sent and received
+// using a RawSocketInterface, allowing it to exchange traffic with real hosts
+// on the network to which a Linux network interface is attached. Like the
+// RawSocketInterface, it requires the CAP_NET_RAW capability to be brought up.
+type RawSocketDevice struct {
+	*EthernetDevice
+	iface *RawSocketInterface
+}
+
+// NewRawSocketDevice creates a new RawSocketDevice bound to the named network
+// interface, using mac as its MAC address. The returned device is down, and has
+// no associated IPv4 or IPv6 addresses.
+func NewRawSocketDevice(name string, mac MAC) (*RawSocketDevice, error) {
+	iface, err := NewRawSocketInterface(name)
+	if err != nil {
+		return nil, errors.Annotate(err, "new RawSocketDevice")
+	}
+	dev, err := NewEthernetDevice(iface, mac)
+	if err != nil {
+		return nil, errors.Annotate(err, "new RawSocketDevice")
+	}
+	return &RawSocketDevice{EthernetDevice: dev, iface: iface}, nil
+}
+
+// Name returns the name of the network interface to which dev is bound.
+func (dev *RawSocketDevice) Name() string { return dev.iface.Name() }
+
+// MAC returns dev's MAC address.
+func (dev *RawSocketDevice) MAC() MAC {
+	_, mac := dev.iface.MAC()
+	return mac
+}
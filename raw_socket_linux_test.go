@@ -0,0 +1,75 @@
+//go:build linux && rawsocket
+
+// This test creates a pair of veth interfaces, so it requires the
+// CAP_NET_ADMIN and CAP_NET_RAW capabilities and the ip command. Run it with:
+//
+//   go test -tags rawsocket -run TestRawSocketDevice
+
+package net
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRawSocketDevice(t *testing.T) {
+	// the kernel's end of the pair is nettest0; the device is bound to nettest1
+	ip := func(args ...string) {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("could not configure interfaces (is CAP_NET_ADMIN missing?): %v: %s", err, out)
+		}
+	}
+	ip("link", "add", "nettest0", "type", "veth", "peer", "name", "nettest1")
+	defer exec.Command("ip", "link", "del", "nettest0").Run()
+	ip("addr", "add", "10.98.0.1/24", "dev", "nettest0")
+	ip("link", "set", "nettest0", "up")
+	ip("link", "set", "nettest1", "up")
+
+	dev, err := NewRawSocketDevice("nettest1", MAC{0x02, 0, 0, 0, 0, 0x02})
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	if err := dev.SetIPv4(IPv4{10, 98, 0, 2}, IPv4{255, 255, 255, 0}); err != nil {
+		t.Fatalf("could not set device address: %v", err)
+	}
+	s := NewStack(StackOptions{})
+	if err := s.AddDevice("raw0", dev); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := dev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up (is CAP_NET_RAW missing?): %v", err)
+	}
+	defer dev.BringDown()
+	type packet struct {
+		b        []byte
+		src, dst IPv4
+	}
+	recv := make(chan packet, 16)
+	const udp = 17
+	s.IPv4Host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) {
+		recv <- packet{append([]byte(nil), b...), src, dst}
+	}, udp)
+
+	// the kernel resolves the device's MAC address using ARP, which the
+	// device answers, and then sends it the datagram
+	conn, err := net.Dial("udp", "10.98.0.2:9")
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+
+	select {
+	case p := <-recv:
+		// skip the 8-byte UDP header
+		if p.src != (IPv4{10, 98, 0, 1}) || p.dst != (IPv4{10, 98, 0, 2}) || len(p.b) < 8 || string(p.b[8:]) != "hello" {
+			t.Errorf("unexpected packet from kernel: %v -> %v: %q", p.src, p.dst, p.b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no packet received from kernel")
+	}
+}
@@ -0,0 +1,174 @@
+package net
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// the time to wait for all of a datagram's fragments to arrive
+	// See https://tools.ietf.org/html/rfc1122#page-57
+	defaultReassemblyTimeout = 60 * time.Second
+	// the maximum number of datagrams being reassembled at once; once it is
+	// reached, fragments of new datagrams are dropped until a slot frees up
+	maxReassemblies = 64
+	// the maximum number of fragments in a single datagram; this is
+	// enough to carry a maximum-sized datagram over a link with an
+	// MTU of 296, the smallest MTU in common use
+	maxFragments = 256
+)
+
+type fragment struct {
+	off int
+	b   []byte
+}
+
+// a reassembly is a partially-reassembled datagram
+type reassembly struct {
+	frags []fragment
+	len   int         // the length of the payload, or -1 if not yet known
+	have  int         // the number of bytes received so far
+	first interface{} // passed to the reassembler's expired function
+	timer *time.Timer
+}
+
+// A reassembler reassembles fragmented IP datagrams. Datagrams whose
+// fragments don't all arrive within the reassembly timeout are discarded.
+//
+// In order to resist attacks which use fragments to exhaust memory or to
+// confuse the reassembly of legitimate datagrams, the number of datagrams
+// being reassembled and the number of fragments per datagram are limited,
+// and any datagram with overlapping fragments is discarded entirely (see
+// RFC 5722, which mandates this for IPv6).
+//
+// The zero value reassembler is a valid reassembler using
+// defaultReassemblyTimeout, maxReassemblies, and maxFragments.
+type reassembler struct {
+	// keyed by a fragment key such as ipv4FragmentKey or ipv6FragmentKey
+	datagrams    map[interface{}]*reassembly // make sure to check if nil before modifying
+	timeout      time.Duration               // if 0, defaultReassemblyTimeout is used
+	maxDatagrams int                         // if 0, maxReassemblies is used
+	maxFrags     int                         // if 0, maxFragments is used
+	// if non-nil, called without r.mu held when a datagram times out after
+	// its first fragment has arrived, so that the sender can be notified
+	expired func(first interface{})
+
+	mu sync.Mutex
+}
+
+// add adds the fragment b of the datagram identified by key. off is the
+// offset of b in the datagram's payload, more is set if further fragments
+// follow b, and max is the maximum length of a payload. If off is 0, first is
+// retained to be passed to r.expired. If b completes the datagram, the
+// datagram's payload is returned.
+func (r *reassembler) add(key interface{}, off int, more bool, b []byte, max int, first interface{}) (payload []byte, ok bool) {
+	if (more && (len(b) == 0 || len(b)%8 != 0)) || off+len(b) > max {
+		// TODO(joshlf): Log it
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.datagrams[key]
+	if !ok {
+		if len(r.datagrams) >= r.datagramLimit() {
+			return nil, false
+		}
+		if r.datagrams == nil {
+			r.datagrams = make(map[interface{}]*reassembly)
+		}
+		timeout := r.timeout
+		if timeout == 0 {
+			timeout = defaultReassemblyTimeout
+		}
+		d = &reassembly{len: -1}
+		d.timer = time.AfterFunc(timeout, func() { r.expire(key, d) })
+		r.datagrams[key] = d
+	}
+
+	end := off + len(b)
+	if (d.len != -1 && (end > d.len || (!more && end != d.len))) || len(d.frags) >= r.fragmentLimit() {
+		r.discard(key, d)
+		return nil, false
+	}
+	for _, f := range d.frags {
+		if off < f.off+len(f.b) && f.off < end {
+			if off == f.off && len(b) == len(f.b) {
+				// a duplicate; ignore it
+				return nil, false
+			}
+			r.discard(key, d)
+			return nil, false
+		}
+	}
+	if !more {
+		for _, f := range d.frags {
+			if f.off+len(f.b) > end {
+				r.discard(key, d)
+				return nil, false
+			}
+		}
+		d.len = end
+	}
+
+	// b belongs to the device, which may reuse it
+	d.frags = append(d.frags, fragment{off: off, b: append([]byte(nil), b...)})
+	d.have += len(b)
+	if off == 0 {
+		d.first = first
+	}
+	if d.have != d.len {
+		return nil, false
+	}
+	// since there are no overlaps, the fragments cover the whole payload
+	payload = make([]byte, d.len)
+	for _, f := range d.frags {
+		copy(payload[f.off:], f.b)
+	}
+	r.discard(key, d)
+	return payload, true
+}
+
+// assumes r.mu.Lock
+func (r *reassembler) discard(key interface{}, d *reassembly) {
+	d.timer.Stop()
+	delete(r.datagrams, key)
+}
+
+func (r *reassembler) expire(key interface{}, d *reassembly) {
+	r.mu.Lock()
+	// the datagram may have already been completed or discarded,
+	// and a new one with the same key may have taken its place
+	expired := r.datagrams[key] == d
+	if expired {
+		delete(r.datagrams, key)
+	}
+	r.mu.Unlock()
+	if expired && d.first != nil && r.expired != nil {
+		r.expired(d.first)
+	}
+}
+
+// pending returns the number of datagrams being reassembled.
+func (r *reassembler) pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.datagrams)
+}
+
+// datagramLimit returns the maximum number of datagrams being reassembled
+// at once.
+func (r *reassembler) datagramLimit() int {
+	if r.maxDatagrams == 0 {
+		return maxReassemblies
+	}
+	return r.maxDatagrams
+}
+
+// fragmentLimit returns the maximum number of fragments in a single datagram.
+func (r *reassembler) fragmentLimit() int {
+	if r.maxFrags == 0 {
+		return maxFragments
+	}
+	return r.maxFrags
+}
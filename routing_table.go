@@ -1,14 +1,15 @@
 package net
 
-import "sync"
+import (
+	"sort"
+	"sync"
+
+	"github.com/joshlf/net/internal/errors"
+)
 
 // TODO(joshlf): Eventually specialize separate IPv4 and IPv6 versions
 // for performance (get rid of interface and type assertion overhead)
 
-// TODO(joshlf): What about subnet refinement? We assume each IP is only in
-// a single subnet, but we also allow multiple subnets that are "unequal"
-// because one is a subset of the other.
-
 type IPv4Route struct {
 	Subnet  IPv4Subnet
 	Nexthop IPv4
@@ -30,11 +31,11 @@ type IPv6DeviceRoute struct {
 }
 
 type ipv4RoutingTable struct {
-	rt routingTable
+	rt RouteTable
 }
 
 func (rt *ipv4RoutingTable) AddRoute(subnet IPv4Subnet, nexthop IPv4) {
-	rt.rt.AddRoute(subnet, nexthop)
+	rt.rt.AddRoute(Route{Subnet: subnet, Nexthop: nexthop})
 }
 
 func (rt *ipv4RoutingTable) DeleteRoute(subnet IPv4Subnet) {
@@ -42,16 +43,12 @@ func (rt *ipv4RoutingTable) DeleteRoute(subnet IPv4Subnet) {
 }
 
 func (rt *ipv4RoutingTable) AddDeviceRoute(subnet IPv4Subnet, dev IPv4Device) {
-	rt.rt.AddDeviceRoute(subnet, dev)
-}
-
-func (rt *ipv4RoutingTable) DeleteDeviceRoute(subnet IPv4Subnet) {
-	rt.rt.DeleteDeviceRoute(subnet)
+	rt.rt.AddRoute(Route{Subnet: subnet, Device: dev})
 }
 
 func (rt *ipv4RoutingTable) Lookup(addr IPv4) (nexthop IPv4, dev IPv4Device, ok bool) {
-	n, d := rt.rt.Lookup(addr)
-	if n == nil {
+	n, d, err := rt.rt.Lookup(addr)
+	if err != nil {
 		return IPv4{}, nil, false
 	}
 	return n.(IPv4), d.(IPv4Device), true
@@ -60,31 +57,35 @@ func (rt *ipv4RoutingTable) Lookup(addr IPv4) (nexthop IPv4, dev IPv4Device, ok
 func (rt *ipv4RoutingTable) Routes() []IPv4Route {
 	var routes []IPv4Route
 	for _, route := range rt.rt.Routes() {
-		routes = append(routes, IPv4Route{
-			Subnet:  route.subnet.(IPv4Subnet),
-			Nexthop: route.nexthop.(IPv4),
-		})
+		if route.Nexthop != nil {
+			routes = append(routes, IPv4Route{
+				Subnet:  route.Subnet.(IPv4Subnet),
+				Nexthop: route.Nexthop.(IPv4),
+			})
+		}
 	}
 	return routes
 }
 
 func (rt *ipv4RoutingTable) DeviceRoutes() []IPv4DeviceRoute {
 	var routes []IPv4DeviceRoute
-	for _, route := range rt.rt.DeviceRoutes() {
-		routes = append(routes, IPv4DeviceRoute{
-			Subnet: route.subnet.(IPv4Subnet),
-			Device: route.device.(IPv4Device),
-		})
+	for _, route := range rt.rt.Routes() {
+		if route.Nexthop == nil {
+			routes = append(routes, IPv4DeviceRoute{
+				Subnet: route.Subnet.(IPv4Subnet),
+				Device: route.Device.(IPv4Device),
+			})
+		}
 	}
 	return routes
 }
 
 type ipv6RoutingTable struct {
-	rt routingTable
+	rt RouteTable
 }
 
 func (rt *ipv6RoutingTable) AddRoute(subnet IPv6Subnet, nexthop IPv6) {
-	rt.rt.AddRoute(subnet, nexthop)
+	rt.rt.AddRoute(Route{Subnet: subnet, Nexthop: nexthop})
 }
 
 func (rt *ipv6RoutingTable) DeleteRoute(subnet IPv6Subnet) {
@@ -92,16 +93,12 @@ func (rt *ipv6RoutingTable) DeleteRoute(subnet IPv6Subnet) {
 }
 
 func (rt *ipv6RoutingTable) AddDeviceRoute(subnet IPv6Subnet, dev IPv6Device) {
-	rt.rt.AddDeviceRoute(subnet, dev)
-}
-
-func (rt *ipv6RoutingTable) DeleteDeviceRoute(subnet IPv6Subnet) {
-	rt.rt.DeleteDeviceRoute(subnet)
+	rt.rt.AddRoute(Route{Subnet: subnet, Device: dev})
 }
 
 func (rt *ipv6RoutingTable) Lookup(addr IPv6) (nexthop IPv6, dev IPv6Device, ok bool) {
-	n, d := rt.rt.Lookup(addr)
-	if n == nil {
+	n, d, err := rt.rt.Lookup(addr)
+	if err != nil {
 		return IPv6{}, nil, false
 	}
 	return n.(IPv6), d.(IPv6Device), true
@@ -110,133 +107,183 @@ func (rt *ipv6RoutingTable) Lookup(addr IPv6) (nexthop IPv6, dev IPv6Device, ok
 func (rt *ipv6RoutingTable) Routes() []IPv6Route {
 	var routes []IPv6Route
 	for _, route := range rt.rt.Routes() {
-		routes = append(routes, IPv6Route{
-			Subnet:  route.subnet.(IPv6Subnet),
-			Nexthop: route.nexthop.(IPv6),
-		})
+		if route.Nexthop != nil {
+			routes = append(routes, IPv6Route{
+				Subnet:  route.Subnet.(IPv6Subnet),
+				Nexthop: route.Nexthop.(IPv6),
+			})
+		}
 	}
 	return routes
 }
 
 func (rt *ipv6RoutingTable) DeviceRoutes() []IPv6DeviceRoute {
 	var routes []IPv6DeviceRoute
-	for _, route := range rt.rt.DeviceRoutes() {
-		routes = append(routes, IPv6DeviceRoute{
-			Subnet: route.subnet.(IPv6Subnet),
-			Device: route.device.(IPv6Device),
-		})
+	for _, route := range rt.rt.Routes() {
+		if route.Nexthop == nil {
+			routes = append(routes, IPv6DeviceRoute{
+				Subnet: route.Subnet.(IPv6Subnet),
+				Device: route.Device.(IPv6Device),
+			})
+		}
 	}
 	return routes
 }
 
-// routingTable is generic so that it can work with either IPv4 or IPv6,
-// but any given instance should only be used with one of the two versions,
-// and the implementation assumes this is happening.
-type routingTable struct {
-	routes       []routingTableIPRoute
-	deviceRoutes []routingTableDeviceRoute
-	mu           sync.RWMutex
+// A Route is an entry in a RouteTable. Packets addressed to Subnet are sent
+// through Device to Nexthop. If Nexthop is nil, Subnet is directly connected
+// to Device, and packets are sent directly to their destinations. If Device
+// is nil, the device is the one through which Nexthop is directly reachable,
+// which is looked up in the same RouteTable.
+//
+// All of a Route's fields must have the same IP version, and
+// Device must implement the corresponding IPv4Device or IPv6Device
+// interface.
+type Route struct {
+	Subnet  IPSubnet
+	Nexthop IP
+	Device  Device
 }
 
-type routingTableIPRoute struct {
-	subnet  IPSubnet
-	nexthop IP
+// A RouteTable maps destination addresses to the next hop and device through
+// which packets to them should be sent. It can hold both IPv4 and IPv6 routes.
+// When multiple routes match a destination, the most specific one - the one
+// with the longest prefix - is used, so a default route (0.0.0.0/0 or ::/0)
+// is only used if no other route matches.
+//
+// RouteTables are safe for concurrent access. The zero RouteTable is a valid,
+// empty RouteTable.
+type RouteTable struct {
+	routes []Route // sorted by decreasing prefix length
+	mu     sync.RWMutex
 }
 
-type routingTableDeviceRoute struct {
-	subnet IPSubnet
-	device Device
-}
-
-func (r *routingTable) AddRoute(subnet IPSubnet, nexthop IP) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.routes {
-		if SubnetEqual(rr.subnet, subnet) {
-			r.routes[i].nexthop = nexthop
-			return
+// AddRoute adds route to t, replacing any existing route for the same subnet.
+func (t *RouteTable) AddRoute(route Route) error {
+	if route.Nexthop == nil && route.Device == nil {
+		return errors.New("add route: neither next hop nor device")
+	}
+	if route.Nexthop != nil && route.Nexthop.IPVersion() != route.Subnet.IPVersion() {
+		return errors.New("add route: mixed IP subnet and next hop versions")
+	}
+	route.Subnet = canonicalSubnet(route.Subnet)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, r := range t.routes {
+		if SubnetEqual(r.Subnet, route.Subnet) {
+			t.routes[i] = route
+			return nil
 		}
 	}
-	r.routes = append(r.routes, routingTableIPRoute{subnet: subnet, nexthop: nexthop})
+	// keep the routes sorted by decreasing prefix length so that
+	// the first match in Lookup is the longest-prefix match
+	plen := prefixLen(route.Subnet)
+	i := sort.Search(len(t.routes), func(i int) bool { return prefixLen(t.routes[i].Subnet) < plen })
+	t.routes = append(t.routes, Route{})
+	copy(t.routes[i+1:], t.routes[i:])
+	t.routes[i] = route
+	return nil
 }
 
-func (r *routingTable) DeleteRoute(subnet IPSubnet) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.routes {
-		if SubnetEqual(rr.subnet, subnet) {
-			copy(r.routes[i:], r.routes[i+1:])
-			r.routes = r.routes[:len(r.routes)-1]
-			return
+// DeleteRoute deletes the route for subnet from t, returning
+// false if there was none.
+func (t *RouteTable) DeleteRoute(subnet IPSubnet) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, r := range t.routes {
+		if SubnetEqual(r.Subnet, subnet) {
+			copy(t.routes[i:], t.routes[i+1:])
+			t.routes = t.routes[:len(t.routes)-1]
+			return true
 		}
 	}
+	return false
 }
 
-func (r *routingTable) AddDeviceRoute(subnet IPSubnet, dev Device) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.deviceRoutes {
-		if SubnetEqual(rr.subnet, subnet) {
-			r.deviceRoutes[i].device = dev
-			return
-		}
+// Lookup returns the next hop and device to which packets to dst should be
+// sent. If dst is directly reachable, nexthop is dst itself.
+func (t *RouteTable) Lookup(dst IP) (nexthop IP, dev Device, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	r, ok := t.lookup(dst, false)
+	switch {
+	case !ok:
+		return nil, nil, errors.NewNoRoute(ipString(dst))
+	case r.Nexthop == nil:
+		return dst, r.Device, nil
+	case r.Device != nil:
+		return r.Nexthop, r.Device, nil
 	}
-	r.deviceRoutes = append(r.deviceRoutes, routingTableDeviceRoute{
-		subnet: subnet,
-		device: dev,
-	})
+	// only look one level deep so that routing loops are impossible
+	nr, ok := t.lookup(r.Nexthop, true)
+	if !ok {
+		return nil, nil, errors.NewNoRoute(ipString(dst))
+	}
+	return r.Nexthop, nr.Device, nil
 }
 
-func (r *routingTable) DeleteDeviceRoute(subnet IPSubnet) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for i, rr := range r.deviceRoutes {
-		if SubnetEqual(rr.subnet, subnet) {
-			copy(r.deviceRoutes[i:], r.deviceRoutes[i+1:])
-			r.deviceRoutes = r.deviceRoutes[:len(r.deviceRoutes)-1]
-			return
+// lookup returns the longest-prefix match for addr, considering only routes
+// with devices if withDevice is true; assumes t.mu.RLock
+func (t *RouteTable) lookup(addr IP, withDevice bool) (Route, bool) {
+	for _, r := range t.routes {
+		if (!withDevice || r.Device != nil) && SubnetHas(r.Subnet, addr) {
+			return r, true
 		}
 	}
+	return Route{}, false
 }
 
-func (r *routingTable) Lookup(addr IP) (nexthop IP, dev Device) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	dev = r.lookupDeviceRoute(addr)
-	if dev != nil {
-		return addr, dev
-	}
-	for _, rr := range r.routes {
-		if SubnetHas(rr.subnet, addr) {
-			dev = r.lookupDeviceRoute(rr.nexthop)
-			if dev == nil {
-				return nil, nil
-			}
-			return rr.nexthop, dev
-		}
-	}
-	return nil, nil
+// Routes returns the routes in t, from most to least specific.
+func (t *RouteTable) Routes() []Route {
+	t.mu.RLock()
+	routes := append([]Route(nil), t.routes...)
+	t.mu.RUnlock()
+	return routes
 }
 
-func (r *routingTable) lookupDeviceRoute(addr IP) Device {
-	for _, r := range r.deviceRoutes {
-		if SubnetHas(r.subnet, addr) {
-			return r.device
+// canonicalSubnet clears the bits of sub's address which are not in its
+// netmask, which Has requires.
+func canonicalSubnet(sub IPSubnet) IPSubnet {
+	switch sub := sub.(type) {
+	case IPv4Subnet:
+		for i := range sub.Addr {
+			sub.Addr[i] &= sub.Netmask[i]
+		}
+		return sub
+	case IPv6Subnet:
+		for i := range sub.Addr {
+			sub.Addr[i] &= sub.Netmask[i]
 		}
+		return sub
+	default:
+		panic("unreachable")
 	}
-	return nil
 }
 
-func (r *routingTable) Routes() []routingTableIPRoute {
-	r.mu.RLock()
-	routes := append([]routingTableIPRoute(nil), r.routes...)
-	r.mu.RUnlock()
-	return routes
+// prefixLen returns the number of bits set in sub's netmask.
+func prefixLen(sub IPSubnet) int {
+	var mask []byte
+	switch sub := sub.(type) {
+	case IPv4Subnet:
+		mask = sub.Netmask[:]
+	case IPv6Subnet:
+		mask = sub.Netmask[:]
+	}
+	var n int
+	for _, b := range mask {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
 }
 
-func (r *routingTable) DeviceRoutes() []routingTableDeviceRoute {
-	r.mu.RLock()
-	routes := append([]routingTableDeviceRoute(nil), r.deviceRoutes...)
-	r.mu.RUnlock()
-	return routes
+func ipString(ip IP) string {
+	if s, ok := ip.(interface {
+		String() string
+	}); ok {
+		return s.String()
+	}
+	return ""
 }
@@ -0,0 +1,106 @@
+package net
+
+import (
+	"testing"
+)
+
+// ipv4Subnet constructs the subnet a.b.c.d/plen.
+func ipv4Subnet(a, b, c, d byte, plen uint) IPv4Subnet {
+	mask := ^uint32(0) << (32 - plen)
+	if plen == 0 {
+		mask = 0
+	}
+	return IPv4Subnet{
+		Addr:    IPv4{a, b, c, d},
+		Netmask: IPv4{byte(mask >> 24), byte(mask >> 16), byte(mask >> 8), byte(mask)},
+	}
+}
+
+func TestRouteTableLongestPrefixMatch(t *testing.T) {
+	eth0 := &testIPv4Device{}
+	eth1 := &testIPv4Device{}
+	eth2 := &testIPv4Device{}
+
+	var rt RouteTable
+	routes := []Route{
+		{Subnet: ipv4Subnet(0, 0, 0, 0, 0), Nexthop: IPv4{10, 0, 0, 1}},
+		{Subnet: ipv4Subnet(10, 0, 0, 0, 8), Device: eth0},
+		{Subnet: ipv4Subnet(10, 1, 0, 0, 16), Device: eth1},
+		{Subnet: ipv4Subnet(10, 1, 2, 0, 24), Nexthop: IPv4{10, 1, 0, 254}},
+		// not canonical; should be treated as 10.1.2.128/25
+		{Subnet: ipv4Subnet(10, 1, 2, 200, 25), Device: eth2},
+	}
+	for _, r := range routes {
+		if err := rt.AddRoute(r); err != nil {
+			t.Fatalf("unexpected error adding route %v: %v", r, err)
+		}
+	}
+
+	for i, c := range []struct {
+		dst     IPv4
+		nexthop IPv4
+		dev     Device
+	}{
+		{IPv4{8, 8, 8, 8}, IPv4{10, 0, 0, 1}, eth0},
+		{IPv4{10, 2, 3, 4}, IPv4{10, 2, 3, 4}, eth0},
+		{IPv4{10, 1, 3, 4}, IPv4{10, 1, 3, 4}, eth1},
+		{IPv4{10, 1, 2, 3}, IPv4{10, 1, 0, 254}, eth1},
+		{IPv4{10, 1, 2, 129}, IPv4{10, 1, 2, 129}, eth2},
+	} {
+		nexthop, dev, err := rt.Lookup(c.dst)
+		if err != nil {
+			t.Errorf("case %v: unexpected error: %v", i, err)
+			continue
+		}
+		if nexthop != c.nexthop || dev != c.dev {
+			t.Errorf("case %v: unexpected route to %v: got (%v, %p); want (%v, %p)", i, c.dst, nexthop, dev, c.nexthop, c.dev)
+		}
+	}
+
+	// IPv4 routes should never match IPv6 addresses
+	if _, _, err := rt.Lookup(IPv6{0: 0xfd}); !IsNoRoute(err) {
+		t.Errorf("unexpected error looking up IPv6 address: got %v; want no route", err)
+	}
+
+	// replacing a route keeps its position
+	if err := rt.AddRoute(Route{Subnet: ipv4Subnet(10, 1, 0, 0, 16), Device: eth2}); err != nil {
+		t.Fatalf("unexpected error replacing route: %v", err)
+	}
+	if _, dev, _ := rt.Lookup(IPv4{10, 1, 3, 4}); dev != eth2 {
+		t.Errorf("replaced route not used")
+	}
+	if n := len(rt.Routes()); n != len(routes) {
+		t.Errorf("unexpected number of routes: got %v; want %v", n, len(routes))
+	}
+}
+
+func TestRouteTableDeleteRoute(t *testing.T) {
+	eth0 := &testIPv4Device{}
+	eth1 := &testIPv4Device{}
+
+	var rt RouteTable
+	rt.AddRoute(Route{Subnet: ipv4Subnet(10, 0, 0, 0, 8), Device: eth0})
+	rt.AddRoute(Route{Subnet: ipv4Subnet(10, 1, 0, 0, 16), Device: eth1})
+
+	if !rt.DeleteRoute(ipv4Subnet(10, 1, 0, 0, 16)) {
+		t.Fatalf("route not deleted")
+	}
+	if rt.DeleteRoute(ipv4Subnet(10, 1, 0, 0, 16)) {
+		t.Errorf("route deleted twice")
+	}
+	// the less specific route should now be used
+	if _, dev, err := rt.Lookup(IPv4{10, 1, 3, 4}); err != nil || dev != eth0 {
+		t.Errorf("unexpected result after deletion: (%p, %v); want (%p, <nil>)", dev, err, eth0)
+	}
+
+	rt.DeleteRoute(ipv4Subnet(10, 0, 0, 0, 8))
+	if _, _, err := rt.Lookup(IPv4{10, 1, 3, 4}); !IsNoRoute(err) {
+		t.Errorf("unexpected error from empty table: got %v; want no route", err)
+	}
+
+	// a next hop which isn't directly reachable is no route
+	rt.AddRoute(Route{Subnet: ipv4Subnet(0, 0, 0, 0, 0), Nexthop: IPv4{192, 168, 0, 1}})
+	if _, _, err := rt.Lookup(IPv4{8, 8, 8, 8}); !IsNoRoute(err) || !IsNetUnreachable(err) {
+		t.Errorf("unexpected error with unreachable next hop: got %v; want no route", err)
+	}
+}
@@ -0,0 +1,230 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// the maximum number of packets waiting to be sent by a shaped device;
+// once the queue is full, further packets are dropped
+const shaperQueueLen = 64
+
+// NewShapedDevice returns a Device which wraps dev, limiting the rate at which
+// packets are sent to rate bytes per second using a token bucket which holds
+// up to burst bytes. Packets which would exceed the rate are queued and sent
+// once enough tokens have accumulated; like a real device, once the queue is
+// full, further packets are dropped and counted in the TxDropped statistic.
+// Writes of packets larger than burst return an error, so burst should be at
+// least dev's MTU. Received packets are unaffected. Bringing the returned
+// Device down discards any queued packets, counting them as dropped.
+//
+// The returned Device implements IPv4Device and IPv6Device if dev does; it
+// should be used in place of dev, for example when adding it to a Stack. It
+// has an Unwrap method which returns dev.
+func NewShapedDevice(dev Device, rate, burst int) (Device, error) {
+	if rate <= 0 || burst <= 0 {
+		return nil, errors.New("new shaped device: rate and burst must be positive")
+	}
+	s := &shaper{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   timeout.NowMonotonic(),
+	}
+	s.timeoutd = timeout.NewDaemon(&s.mu)
+	dev4, ok4 := dev.(IPv4Device)
+	dev6, ok6 := dev.(IPv6Device)
+	switch {
+	case ok4 && ok6:
+		return &shapedIPDevice{dev.(ipDevice), s}, nil
+	case ok4:
+		return &shapedIPv4Device{dev4, s}, nil
+	case ok6:
+		return &shapedIPv6Device{dev6, s}, nil
+	default:
+		return &shapedDevice{dev, s}, nil
+	}
+}
+
+// A shaper is a token bucket which paces a sequence of writes.
+type shaper struct {
+	rate   float64 // bytes per second
+	burst  float64 // the maximum number of tokens
+	tokens float64
+	last   time.Time // when tokens was last updated
+
+	queue []shapedPacket
+	// drains the queue; nil while the device is down
+	timeoutd *timeout.Daemon
+	handle   *timeout.Timeout // non-nil while the queue is being drained
+	dropped  uint64
+	mu       sync.Mutex
+}
+
+type shapedPacket struct {
+	n    int
+	send func()
+}
+
+// refill adds the tokens accumulated since they were last updated;
+// it must be called with s.mu held.
+func (s *shaper) refill() {
+	now := timeout.NowMonotonic()
+	s.tokens += now.Sub(s.last).Seconds() * s.rate
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+}
+
+// write writes the packet b using send once the rate allows. If the packet
+// must wait, it is copied and queued, and write returns immediately. send is
+// called with s.mu held so that packets are sent in order.
+func (s *shaper) write(b []byte, send func(b []byte) (int, error)) (int, error) {
+	if float64(len(b)) > s.burst {
+		return 0, errors.New("write to shaped device: packet exceeds burst size")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refill()
+	if len(s.queue) == 0 && s.tokens >= float64(len(b)) {
+		s.tokens -= float64(len(b))
+		return send(b)
+	}
+	if len(s.queue) >= shaperQueueLen || s.timeoutd == nil {
+		// TODO(joshlf): Log it
+		s.dropped++
+		return len(b), nil
+	}
+	// the caller may reuse b once we return
+	b = append([]byte(nil), b...)
+	s.queue = append(s.queue, shapedPacket{n: len(b), send: func() {
+		send(b)
+		// TODO(joshlf): Log error
+	}})
+	if s.handle == nil {
+		s.schedule()
+	}
+	return len(b), nil
+}
+
+// schedule arranges for drain to be called once there are enough tokens to
+// send the first queued packet; it must be called with s.mu held.
+func (s *shaper) schedule() {
+	need := float64(s.queue[0].n) - s.tokens
+	d := time.Duration(need / s.rate * float64(time.Second))
+	s.handle = s.timeoutd.AddTimeout(s.drain, timeout.NowMonotonic().Add(d))
+}
+
+// drain sends as many queued packets as the accumulated tokens allow.
+// It is called by s.timeoutd with s.mu held.
+func (s *shaper) drain() {
+	s.handle = nil
+	s.refill()
+	for len(s.queue) > 0 && s.tokens >= float64(s.queue[0].n) {
+		p := s.queue[0]
+		s.queue[0] = shapedPacket{}
+		s.queue = s.queue[1:]
+		s.tokens -= float64(p.n)
+		p.send()
+	}
+	if len(s.queue) > 0 {
+		s.schedule()
+	}
+}
+
+// bringUp brings dev up and restarts the daemon which drains the queue.
+func (s *shaper) bringUp(dev Device) error {
+	if err := dev.BringUp(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.timeoutd == nil {
+		s.timeoutd = timeout.NewDaemon(&s.mu)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// bringDown stops the daemon which drains the queue, discarding any queued
+// packets, and brings dev down. Until the device is brought back up, packets
+// which would have been queued are dropped instead.
+func (s *shaper) bringDown(dev Device) error {
+	s.mu.Lock()
+	if s.timeoutd != nil {
+		s.timeoutd.Stop()
+		s.timeoutd = nil
+	}
+	s.handle = nil
+	s.dropped += uint64(len(s.queue))
+	s.queue = nil
+	s.mu.Unlock()
+	return dev.BringDown()
+}
+
+// stats adds the packets dropped by s to st.
+func (s *shaper) stats(st DeviceStats) DeviceStats {
+	s.mu.Lock()
+	st.TxDropped += s.dropped
+	s.mu.Unlock()
+	return st
+}
+
+type shapedDevice struct {
+	Device
+	s *shaper
+}
+
+func (dev *shapedDevice) Unwrap() Device     { return dev.Device }
+func (dev *shapedDevice) Stats() DeviceStats { return dev.s.stats(dev.Device.Stats()) }
+func (dev *shapedDevice) BringUp() error     { return dev.s.bringUp(dev.Device) }
+func (dev *shapedDevice) BringDown() error   { return dev.s.bringDown(dev.Device) }
+
+type shapedIPv4Device struct {
+	IPv4Device
+	s *shaper
+}
+
+func (dev *shapedIPv4Device) Unwrap() Device     { return dev.IPv4Device }
+func (dev *shapedIPv4Device) Stats() DeviceStats { return dev.s.stats(dev.IPv4Device.Stats()) }
+func (dev *shapedIPv4Device) BringUp() error     { return dev.s.bringUp(dev.IPv4Device) }
+func (dev *shapedIPv4Device) BringDown() error   { return dev.s.bringDown(dev.IPv4Device) }
+
+func (dev *shapedIPv4Device) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.s.write(b, func(b []byte) (int, error) { return dev.IPv4Device.WriteToIPv4(b, dst) })
+}
+
+type shapedIPv6Device struct {
+	IPv6Device
+	s *shaper
+}
+
+func (dev *shapedIPv6Device) Unwrap() Device     { return dev.IPv6Device }
+func (dev *shapedIPv6Device) Stats() DeviceStats { return dev.s.stats(dev.IPv6Device.Stats()) }
+func (dev *shapedIPv6Device) BringUp() error     { return dev.s.bringUp(dev.IPv6Device) }
+func (dev *shapedIPv6Device) BringDown() error   { return dev.s.bringDown(dev.IPv6Device) }
+
+func (dev *shapedIPv6Device) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.s.write(b, func(b []byte) (int, error) { return dev.IPv6Device.WriteToIPv6(b, dst) })
+}
+
+type shapedIPDevice struct {
+	ipDevice
+	s *shaper
+}
+
+func (dev *shapedIPDevice) Unwrap() Device     { return dev.ipDevice }
+func (dev *shapedIPDevice) Stats() DeviceStats { return dev.s.stats(dev.ipDevice.Stats()) }
+func (dev *shapedIPDevice) BringUp() error     { return dev.s.bringUp(dev.ipDevice) }
+func (dev *shapedIPDevice) BringDown() error   { return dev.s.bringDown(dev.ipDevice) }
+
+func (dev *shapedIPDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.s.write(b, func(b []byte) (int, error) { return dev.ipDevice.WriteToIPv4(b, dst) })
+}
+
+func (dev *shapedIPDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.s.write(b, func(b []byte) (int, error) { return dev.ipDevice.WriteToIPv6(b, dst) })
+}
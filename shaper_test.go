@@ -0,0 +1,111 @@
+package net
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShapedDevice(t *testing.T) {
+	const (
+		rate     = 200000 // bytes per second
+		burst    = 2000
+		pktLen   = 1000
+		duration = time.Second
+	)
+	lo, err := NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	if _, err := NewShapedDevice(lo, 0, burst); err == nil {
+		t.Errorf("no error creating shaped device with zero rate")
+	}
+	dev, err := NewShapedDevice(lo, rate, burst)
+	if err != nil {
+		t.Fatalf("unexpected error creating shaped device: %v", err)
+	}
+	sdev := dev.(ipDevice)
+	var rx int64
+	sdev.RegisterIPv4Callback(func(b []byte) { atomic.AddInt64(&rx, int64(len(b))) })
+	if err := sdev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer sdev.BringDown()
+
+	if _, err := sdev.WriteToIPv4(make([]byte, burst+1), IPv4{127, 0, 0, 1}); err == nil {
+		t.Errorf("no error writing packet larger than burst size")
+	}
+
+	// write as fast as possible; the excess is dropped
+	pkt := make([]byte, pktLen)
+	pkt[0] = 0x45
+	start := time.Now()
+	for time.Since(start) < duration {
+		if _, err := sdev.WriteToIPv4(pkt, IPv4{127, 0, 0, 1}); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	elapsed := time.Since(start)
+	got := float64(atomic.LoadInt64(&rx)) / elapsed.Seconds()
+	if got < 0.8*rate || got > 1.2*rate {
+		t.Errorf("unexpected throughput: got %.0f bytes/s; want approximately %v bytes/s", got, rate)
+	}
+	if sdev.Stats().TxDropped == 0 {
+		t.Errorf("no packets dropped writing faster than the rate")
+	}
+	if _, ok := dev.(interface{ Unwrap() Device }); !ok {
+		t.Errorf("shaped device has no Unwrap method")
+	}
+}
+
+func TestShapedDeviceBringDown(t *testing.T) {
+	const (
+		rate   = 2000 // bytes per second
+		pktLen = 1000
+	)
+	lo, err := NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	dev, err := NewShapedDevice(lo, rate, pktLen)
+	if err != nil {
+		t.Fatalf("unexpected error creating shaped device: %v", err)
+	}
+	sdev := dev.(ipDevice)
+	var rx int64
+	sdev.RegisterIPv4Callback(func(b []byte) { atomic.AddInt64(&rx, 1) })
+	if err := sdev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+
+	// the first packet is sent immediately, and the rest are queued
+	pkt := make([]byte, pktLen)
+	pkt[0] = 0x45
+	for i := 0; i < 3; i++ {
+		if _, err := sdev.WriteToIPv4(pkt, IPv4{127, 0, 0, 1}); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+	for start := time.Now(); atomic.LoadInt64(&rx) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 100*time.Millisecond {
+			t.Fatalf("first packet not received")
+		}
+	}
+	if err := sdev.BringDown(); err != nil {
+		t.Fatalf("could not bring device down: %v", err)
+	}
+	if n := sdev.Stats().TxDropped; n != 2 {
+		t.Errorf("unexpected dropped packets after bringing device down: got %v; want 2", n)
+	}
+
+	// the queued packets aren't sent once the device is back up
+	if err := sdev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer sdev.BringDown()
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt64(&rx); n != 1 {
+		t.Errorf("unexpected packets received: got %v; want 1", n)
+	}
+}
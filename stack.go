@@ -0,0 +1,237 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// A Stack is a network stack hosting any number of named Devices. Packets
+// received on any of a Stack's Devices which are addressed to one of its
+// Devices are delivered locally to the callback registered for their protocol.
+// Other packets are dropped or, if forwarding is turned on with SetForwarding,
+// forwarded to the next hop according to the Stack's routing table, with
+// their TTLs decremented. Packets whose TTLs expire are answered with ICMP
+// time exceeded messages. Thus, a Stack can act as a multi-homed host or as
+// a simple router.
+//
+// Stack embeds an IPHost, which is used to configure routing and forwarding,
+// register callbacks, and send packets. Stack's AddDevice and RemoveDevice
+// methods should be used instead of the IPHost's equivalents so that the
+// Stack can keep track of device names. UDP is handled by the Stack itself
+// (see ListenUDP); registering a UDP callback on the IPHost replaces it.
+//
+// Stacks are safe for concurrent access. The zero Stack is not a valid Stack.
+type Stack struct {
+	IPHost
+	devices DeviceSet
+	udp     udpMux
+	hooks   packetHooks
+	opts    StackOptions
+
+	// held while adding or removing devices so that the
+	// DeviceSet and the IPHost are updated atomically
+	mu      sync.Mutex
+	closers []func() error // protected by mu; see OnClose
+	closed  bool           // protected by mu
+}
+
+// StackOptions configures a Stack, and the hosts for transport protocols which
+// run on it. A zero field selects the default for that option, so the zero
+// StackOptions configures a Stack with all of the defaults.
+type StackOptions struct {
+	// ReassemblyTimeout is how long to wait for all of the fragments of a
+	// fragmented datagram to arrive before discarding it. The default is
+	// 60 seconds.
+	ReassemblyTimeout time.Duration
+	// MaxReassemblies is the maximum number of datagrams of each IP version
+	// being reassembled at once; once it is reached, fragments of new
+	// datagrams are dropped. The default is 64.
+	MaxReassemblies int
+	// MaxReassemblyFragments is the maximum number of fragments in a single
+	// datagram. The default is 256.
+	MaxReassemblyFragments int
+
+	// The remaining options are defaults for the connections of a tcp.Host
+	// created with tcp.NewStackHost; see the Host methods of the same names
+	// for their meanings and defaults. Like those methods, they can be
+	// overridden for individual connections or listeners where the tcp
+	// package allows it.
+	MSL                                time.Duration
+	InitialCwnd                        int
+	MinRTO, MaxRTO                     time.Duration
+	EphemeralPortMin, EphemeralPortMax uint16
+	// MaxWindowScale is the largest window scale offered by new connections.
+	// Since 0 selects the default of 14, window scaling can't be disabled
+	// altogether.
+	MaxWindowScale uint8
+	// KeepAlive is whether new connections send keepalive probes, and
+	// KeepAlivePeriod is how long they must be idle before they do.
+	KeepAlive       bool
+	KeepAlivePeriod time.Duration
+}
+
+// NewStack creates a new Stack with no devices, configured by opts.
+func NewStack(opts StackOptions) *Stack {
+	s := &Stack{IPHost: IPHost{
+		IPv4Host: NewIPv4Host(),
+		IPv6Host: NewIPv6Host(),
+	}, opts: opts}
+	host4 := s.IPv4Host.(*ipv4ConfigurationHost)
+	host6 := s.IPv6Host.(*ipv6ConfigurationHost)
+	host4.hooks = &s.hooks
+	host6.hooks = &s.hooks
+	for _, r := range []*reassembler{&host4.frags.reassembler, &host6.frags.reassembler} {
+		r.timeout = opts.ReassemblyTimeout
+		r.maxDatagrams = opts.MaxReassemblies
+		r.maxFrags = opts.MaxReassemblyFragments
+	}
+	s.udp.init(&s.IPHost)
+	return s
+}
+
+// Options returns the options with which s was created.
+func (s *Stack) Options() StackOptions {
+	return s.opts
+}
+
+// AddDevice adds dev to s under the given name. It is an error if the name is
+// already in use or if dev has already been added. If dev has an address,
+// a device route for its subnet is added so that hosts on the same network
+// are directly reachable. It is an error if s has been closed.
+func (s *Stack) AddDevice(name string, dev Device) error {
+	dev4, ok4 := dev.(IPv4Device)
+	dev6, ok6 := dev.(IPv6Device)
+	if !ok4 && !ok6 {
+		return errors.New("add device: device is neither IPv4- nor IPv6-enabled")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("add device: stack is closed")
+	}
+	if _, ok := s.devices.Get(name); ok {
+		return errors.New("add device: name already in use")
+	}
+	if _, ok := s.devices.GetName(dev); ok {
+		return errors.New("add device: device already added")
+	}
+	s.devices.Put(name, dev)
+	if ok4 {
+		s.IPv4Host.AddIPv4Device(dev4)
+		if addr, netmask, ok := dev4.IPv4(); ok {
+			s.IPv4Host.AddIPv4DeviceRoute(canonicalSubnet(IPv4Subnet{Addr: addr, Netmask: netmask}).(IPv4Subnet), dev4)
+		}
+	}
+	if ok6 {
+		s.IPv6Host.AddIPv6Device(dev6)
+		if addr, netmask, ok := dev6.IPv6(); ok {
+			s.IPv6Host.AddIPv6DeviceRoute(canonicalSubnet(IPv6Subnet{Addr: addr, Netmask: netmask}).(IPv6Subnet), dev6)
+		}
+	}
+	return nil
+}
+
+// RemoveDevice removes the named device from s, along with any device routes
+// through it. Routes whose next hops are only reachable through the device are
+// left in place, but packets matching them can't be sent until a device route
+// to their next hops is added again. If there is no such device,
+// RemoveDevice is a no-op.
+func (s *Stack) RemoveDevice(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dev, ok := s.devices.Get(name)
+	if !ok {
+		return
+	}
+	if dev4, ok := dev.(IPv4Device); ok {
+		for _, r := range s.IPv4Host.IPv4DeviceRoutes() {
+			if r.Device == dev4 {
+				s.IPv4Host.DeleteIPv4Route(r.Subnet)
+			}
+		}
+		s.IPv4Host.RemoveIPv4Device(dev4)
+	}
+	if dev6, ok := dev.(IPv6Device); ok {
+		for _, r := range s.IPv6Host.IPv6DeviceRoutes() {
+			if r.Device == dev6 {
+				s.IPv6Host.DeleteIPv6Route(r.Subnet)
+			}
+		}
+		s.IPv6Host.RemoveIPv6Device(dev6)
+	}
+	s.devices.Put(name, nil)
+}
+
+// OnClose registers f to be called when s is closed, before its devices are
+// brought down. It is used by hosts for transport protocols which run on s,
+// such as a tcp.Host created with tcp.NewStackHost, to shut down along with
+// s. Functions are called in the order in which they were registered. It is
+// an error if s has already been closed, in which case f will never be called.
+func (s *Stack) OnClose(f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("on close: stack is closed")
+	}
+	s.closers = append(s.closers, f)
+	return nil
+}
+
+// Close shuts down s. Any functions registered with OnClose are called first,
+// so that, for example, TCP connections can be reset while s's devices are
+// still up. Then its UDP sockets are closed, so that goroutines blocked
+// reading from them return errors, and its devices are brought down and
+// removed. The first error encountered is returned. Once s has been closed,
+// devices can't be added to it and UDP sockets can't be created on it, and
+// further calls to Close are no-ops.
+func (s *Stack) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+	var err error
+	for _, f := range closers {
+		if e := f(); e != nil && err == nil {
+			err = errors.Annotate(e, "close")
+		}
+	}
+
+	s.udp.closeAll()
+	s.mu.Lock()
+	names := s.devices.ListNames()
+	s.mu.Unlock()
+	for _, name := range names {
+		dev, ok := s.devices.Get(name)
+		if !ok {
+			continue
+		}
+		if e := dev.BringDown(); e != nil && err == nil {
+			err = errors.Annotatef(e, "close: bring down %v", name)
+		}
+		s.RemoveDevice(name)
+	}
+	return err
+}
+
+// Device returns the named device.
+func (s *Stack) Device(name string) (dev Device, ok bool) {
+	return s.devices.Get(name)
+}
+
+// DeviceName returns the name under which dev was added to s.
+func (s *Stack) DeviceName(dev Device) (name string, ok bool) {
+	return s.devices.GetName(dev)
+}
+
+// DeviceNames returns the names of s's devices.
+func (s *Stack) DeviceNames() []string {
+	return s.devices.ListNames()
+}
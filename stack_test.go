@@ -0,0 +1,309 @@
+package net
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeUDPAddr returns a loopback UDP address which is not currently in use.
+func freeUDPAddr(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen on UDP: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// newTestUDPIPv4Device creates a UDPIPv4Device with the given address and a
+// /24 netmask, along with a UDP connection to its link-local peer.
+func newTestUDPIPv4Device(t *testing.T, addr IPv4) (dev *UDPIPv4Device, peer *net.UDPConn) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen on UDP: %v", err)
+	}
+	dev, err = NewUDPIPv4Device(freeUDPAddr(t), peer.LocalAddr().(*net.UDPAddr), 1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	if err := dev.SetIPv4(addr, IPv4{255, 255, 255, 0}); err != nil {
+		t.Fatalf("could not set device address: %v", err)
+	}
+	return dev, peer
+}
+
+// testStack is a Stack with two UDPIPv4Devices, eth0 (10.0.0.1/24) and eth1
+// (10.0.1.1/24), whose link-local peers are peer0 and peer1 respectively.
+type testStack struct {
+	*Stack
+	eth0, eth1   *UDPIPv4Device
+	peer0, peer1 *net.UDPConn
+}
+
+func newTestStack(t *testing.T) *testStack {
+	s := &testStack{Stack: NewStack(StackOptions{})}
+	s.eth0, s.peer0 = newTestUDPIPv4Device(t, IPv4{10, 0, 0, 1})
+	s.eth1, s.peer1 = newTestUDPIPv4Device(t, IPv4{10, 0, 1, 1})
+	if err := s.AddDevice("eth0", s.eth0); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := s.AddDevice("eth1", s.eth1); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	for _, dev := range []Device{s.eth0, s.eth1} {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("could not bring device up: %v", err)
+		}
+	}
+	return s
+}
+
+func (s *testStack) close() {
+	s.eth0.BringDown()
+	s.eth1.BringDown()
+	s.peer0.Close()
+	s.peer1.Close()
+}
+
+// send sends an IPv4 packet with the given header and payload
+// from peer0 to s through eth0.
+func (s *testStack) send(t *testing.T, hdr *ipv4Header, payload []byte) {
+	s.sendOptions(t, hdr, nil, payload)
+}
+
+// sendOptions is like send, but the header carries the given options,
+// whose length must be a multiple of 4.
+func (s *testStack) sendOptions(t *testing.T, hdr *ipv4Header, options, payload []byte) {
+	hdrlen := 20 + len(options)
+	pkt := make([]byte, hdrlen+len(payload))
+	hdr.version, hdr.IHL, hdr.len = 4, uint8(hdrlen/4), uint16(len(pkt))
+	writeIPv4Header(hdr, pkt)
+	copy(pkt[20:], options)
+	copy(pkt[hdrlen:], payload)
+	// the checksum covers the options as well
+	pkt[10], pkt[11] = 0, 0
+	sum := ipv4HeaderChecksum(pkt[:hdrlen])
+	pkt[10], pkt[11] = byte(sum>>8), byte(sum)
+	laddr, _ := s.eth0.UDPAddrs()
+	if _, err := s.peer0.WriteToUDP(pkt, laddr); err != nil {
+		t.Fatalf("could not write packet: %v", err)
+	}
+}
+
+// recv receives an IPv4 packet on peer, returning its header and payload.
+func recv(t *testing.T, peer *net.UDPConn) (ipv4Header, []byte) {
+	hdr, _, payload := recvOptions(t, peer)
+	return hdr, payload
+}
+
+// recvOptions is like recv, but also returns the packet's options.
+func recvOptions(t *testing.T, peer *net.UDPConn) (hdr ipv4Header, options, payload []byte) {
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+	readIPv4Header(&hdr, buf[:n])
+	hdrlen := int(hdr.IHL) * 4
+	return hdr, buf[20:hdrlen], buf[hdrlen:n]
+}
+
+func TestStack(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	s := newTestStack(t)
+	defer s.close()
+	if err := s.AddDevice("eth0", s.eth1); err == nil {
+		t.Errorf("no error adding device with duplicate name")
+	}
+	s.SetForwarding(true)
+	local := make(chan IPv4, 1)
+	s.IPv4Host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) { local <- dst }, proto)
+
+	// send a packet through eth0 to the host on eth1's network
+	payload := []byte("hello")
+	hdr := ipv4Header{TTL: 10, proto: proto, src: IPv4{10, 0, 0, 2}, dst: IPv4{10, 0, 1, 2}}
+	s.send(t, &hdr, payload)
+	got, b := recv(t, s.peer1)
+	if got.dst != hdr.dst || got.TTL != hdr.TTL-1 || !bytes.Equal(b, payload) {
+		t.Errorf("unexpected forwarded packet: got (dst %v, TTL %v, %q); want (dst %v, TTL %v, %q)",
+			got.dst, got.TTL, b, hdr.dst, hdr.TTL-1, payload)
+	}
+
+	// a packet addressed to eth1 but received on eth0 is delivered locally
+	hdr.dst = IPv4{10, 0, 1, 1}
+	s.send(t, &hdr, payload)
+	select {
+	case dst := <-local:
+		if dst != hdr.dst {
+			t.Errorf("unexpected destination of local packet: got %v; want %v", dst, hdr.dst)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("packet not delivered locally")
+	}
+
+	s.RemoveDevice("eth1")
+	if _, ok := s.Device("eth1"); ok {
+		t.Errorf("device not removed")
+	}
+	for _, r := range s.IPv4Host.IPv4DeviceRoutes() {
+		if r.Device == s.eth1 {
+			t.Errorf("route through removed device not deleted: %v", r.Subnet)
+		}
+	}
+}
+
+func TestStackForwarding(t *testing.T) {
+	const proto = 253
+	s := newTestStack(t)
+	defer s.close()
+	src := IPv4{10, 0, 0, 2}
+
+	// forwarding is off by default
+	hdr := ipv4Header{TTL: 10, proto: proto, src: src, dst: IPv4{10, 0, 1, 2}}
+	s.send(t, &hdr, []byte("hello"))
+	s.peer1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := s.peer1.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Errorf("packet forwarded with forwarding off")
+	}
+	s.SetForwarding(true)
+	s.send(t, &hdr, []byte("world"))
+	if _, b := recv(t, s.peer1); string(b) != "world" {
+		t.Errorf("unexpected forwarded payload: got %q; want %q", b, "world")
+	}
+
+	// the TTL would expire in transit
+	hdr.TTL = 1
+	s.send(t, &hdr, []byte("hello"))
+	got, b := recv(t, s.peer0)
+	if got.proto != IPProtocolICMP || got.src != (IPv4{10, 0, 0, 1}) || got.dst != src ||
+		len(b) < icmpHeaderLen || b[0] != icmpv4TypeTimeExceeded || b[1] != 0 {
+		t.Errorf("expected ICMP time exceeded from 10.0.0.1 to %v; got protocol %v from %v to %v: %v", src, got.proto, got.src, got.dst, b)
+	}
+
+	// no route to the destination
+	hdr.TTL, hdr.dst = 10, IPv4{192, 168, 0, 1}
+	s.send(t, &hdr, []byte("hello"))
+	got, b = recv(t, s.peer0)
+	code, quoted, _, ok := parseICMPv4Unreachable(b)
+	if got.proto != IPProtocolICMP || !ok || code != UnreachableNet || quoted.dst != hdr.dst {
+		t.Errorf("expected ICMP network unreachable for %v; got protocol %v: %v", hdr.dst, got.proto, b)
+	}
+
+	// ICMP errors quote the payload of packets with options,
+	// not the options themselves
+	options := []byte{1, 1, 1, 1} // four NOPs
+	hdr.TTL, hdr.dst = 1, IPv4{10, 0, 1, 2}
+	s.sendOptions(t, &hdr, options, []byte("hello"))
+	_, b = recv(t, s.peer0)
+	if len(b) < icmpHeaderLen+20 || b[0] != icmpv4TypeTimeExceeded || string(b[icmpHeaderLen+20:]) != "hello" {
+		t.Errorf("expected ICMP time exceeded quoting %q; got %v", "hello", b)
+	}
+	hdr.TTL, hdr.dst = 10, IPv4{192, 168, 0, 1}
+	s.sendOptions(t, &hdr, options, []byte("hello"))
+	_, b = recv(t, s.peer0)
+	if _, _, payload, ok := parseICMPv4Unreachable(b); !ok || string(payload) != "hello" {
+		t.Errorf("expected ICMP network unreachable quoting %q; got %v", "hello", b)
+	}
+
+	// when a packet with options is fragmented, the first fragment carries
+	// all of them, and the rest carry only the router alert option, which
+	// is copied into every fragment
+	if err := s.eth1.SetMTU(100); err != nil {
+		t.Fatalf("could not set MTU: %v", err)
+	}
+	routerAlert := []byte{0x94, 4, 0, 0}
+	options = append([]byte{1, 1, 1, 1}, routerAlert...)
+	payload := make([]byte, 200)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	hdr.TTL, hdr.dst = 10, IPv4{10, 0, 1, 2}
+	s.sendOptions(t, &hdr, options, payload)
+	var reassembled []byte
+	for more := true; more; {
+		got, opts, b := recvOptions(t, s.peer1)
+		want := routerAlert
+		if len(reassembled) == 0 {
+			want = options
+		}
+		if string(opts) != string(want) || int(got.fragOff)*8 != len(reassembled) {
+			t.Fatalf("unexpected fragment header: %+v with options %v; want options %v", got, opts, want)
+		}
+		// the checksum covers the options
+		raw := make([]byte, 20+len(opts))
+		copy(raw[20:], opts)
+		sum := got
+		writeIPv4Header(&sum, raw)
+		if sum.checksum != got.checksum {
+			t.Errorf("unexpected fragment header checksum: got %#04x; want %#04x", got.checksum, sum.checksum)
+		}
+		reassembled = append(reassembled, b...)
+		more = got.flags&ipv4FlagMF != 0
+	}
+	if string(reassembled) != string(payload) {
+		t.Errorf("unexpected fragmented payload: got %v; want %v", reassembled, payload)
+	}
+}
+
+func TestStackClose(t *testing.T) {
+	s, _ := newLoopbackStack(t)
+	c, err := s.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 1))
+		errs <- err
+	}()
+	// OnClose functions are called in order while the devices are still up
+	var called []int
+	for i := 0; i < 2; i++ {
+		i := i
+		s.OnClose(func() error {
+			if len(s.DeviceNames()) == 0 {
+				t.Errorf("devices removed before OnClose function %v was called", i)
+			}
+			called = append(called, i)
+			return nil
+		})
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error closing stack: %v", err)
+	}
+	if len(called) != 2 || called[0] != 0 || called[1] != 1 {
+		t.Errorf("unexpected OnClose calls: got %v; want [0 1]", called)
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("no error reading from socket after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocked read didn't return after Close")
+	}
+	if names := s.DeviceNames(); len(names) != 0 {
+		t.Errorf("unexpected devices after Close: %v", names)
+	}
+
+	// nothing can be added to a closed stack
+	if _, err := s.ListenUDP(nil); err == nil {
+		t.Errorf("no error listening on closed stack")
+	}
+	lo, err := NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	if err := s.AddDevice("lo", lo); err == nil {
+		t.Errorf("no error adding device to closed stack")
+	}
+	if err := s.OnClose(func() error { return nil }); err == nil {
+		t.Errorf("no error registering OnClose function on closed stack")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("unexpected error closing stack twice: %v", err)
+	}
+}
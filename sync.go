@@ -70,6 +70,15 @@ func (s *syncer) BringDown(post func() error) error {
 	return post()
 }
 
+// WhileUpOrDown calls f, passing it whether s is up, and returns its result.
+// s is not brought up or down until f returns. As with BringUp and BringDown,
+// f is responsible for acquiring any necessary locks.
+func (s *syncer) WhileUpOrDown(f func(up bool) error) error {
+	s.up.Lock()
+	defer s.up.Unlock()
+	return f(s.stop != nil)
+}
+
 // StopChan returns a channel which, when closed, instructs all spawned
 // daemons to return. StopChan must only be called from daemon goroutines
 // spawned using BringUp - for all other callers, its behavior is undefined,
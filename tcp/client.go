@@ -1,19 +1,24 @@
 package tcp
 
 import (
+	"io"
 	"time"
 
 	"github.com/joshlf/net/internal/errors"
-	"github.com/joshlf/net/tcp/internal/timeout"
+	"github.com/joshlf/net/internal/timeout"
 )
 
 var (
 	timeoutErr = errors.Timeoutf("i/o timeout")
+	closedErr  = errors.New("use of closed connection")
+	// returned by DialContext if its context is canceled
+	canceledErr = errors.New("operation was canceled")
 )
 
-// TODO(joshlf): Deal with EOFs for reading and writing
-
-// Read implements the net.Conn Read method.
+// Read implements the net.Conn Read method. Data received before the other
+// side closed the connection is always returned first. After that, Read
+// returns io.EOF if the other side closed the connection gracefully with a
+// FIN, or an error matching net.ErrConnReset if it reset the connection.
 func (c *Conn) Read(b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, nil
@@ -21,11 +26,22 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.readClosed {
+		return 0, closedErr
+	}
 	if reachedDeadline(c.rdeadline) {
 		return 0, timeoutErr
 	}
 
-	for n = c.incoming.Available(); n == 0; n = c.incoming.Available() {
+	for n = c.readable(); n == 0; n = c.readable() {
+		switch {
+		case c.readClosed:
+			return 0, closedErr
+		case c.finRcvd:
+			return 0, io.EOF
+		case c.state == StateClosed:
+			return 0, c.closeReason()
+		}
 		c.readCond.Wait()
 		if reachedDeadline(c.rdeadline) {
 			return 0, timeoutErr
@@ -36,40 +52,339 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		n = len(b)
 	}
 
+	prev := c.incoming.Cap()
 	c.incoming.ReadAndAdvance(b[:n])
+	c.counters.BytesRead += uint64(n)
+	c.active()
+	c.autoTune(n)
+	c.windowUpdate(prev)
 	return n, nil
 }
 
-// Write implements the net.Conn Write method.
+// Write implements the net.Conn Write method. Write copies b into the send
+// buffer, blocking while it is full until acknowledgments from the other side
+// free space in it (see SetWriteBuffer). If the write deadline passes or the
+// connection is closed first, Write returns the number of bytes which were
+// copied along with an error.
 func (c *Conn) Write(b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.write([][]byte{b}, false)
+}
+
+// Writev is like Write, but writes the concatenation of bufs, like the
+// standard library's net.Buffers. Rather than being concatenated first, each
+// buffer is copied directly into the send buffer, and segments are only sent
+// once as much of bufs as will fit has been copied, so a small header followed
+// by a body isn't sent as a segment of its own.
+func (c *Conn) Writev(bufs [][]byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(bufs, false)
+}
 
+// write writes the concatenation of bufs to the send buffer, blocking until
+// it has all been written. If urgent is set, the last byte is marked as
+// urgent before it is sent. assumes c.mu.Lock
+func (c *Conn) write(bufs [][]byte, urgent bool) (n int, err error) {
 	if reachedDeadline(c.wdeadline) {
 		return 0, timeoutErr
 	}
 
-	for len(b) > 0 {
-		var avail int
-		for avail = c.outgoing.Cap(); avail == 0; avail = c.outgoing.Cap() {
+	// the offset into bufs[0] of the data not yet written; bufs
+	// itself is left alone, since it belongs to the caller
+	var off int
+	for {
+		for len(bufs) > 0 && len(bufs[0]) == 0 {
+			bufs = bufs[1:]
+		}
+		if len(bufs) == 0 {
+			return n, nil
+		}
+		if c.state == StateClosed {
+			return n, c.closeReason()
+		}
+		if c.finQueued {
+			return n, closedErr
+		}
+		for c.outgoing.Cap() == 0 {
 			c.writeCond.Wait()
+			if c.state == StateClosed {
+				return n, c.closeReason()
+			}
+			if c.finQueued {
+				return n, closedErr
+			}
 			if reachedDeadline(c.wdeadline) {
 				// we may have already written some data; return n
 				return n, timeoutErr
 			}
 		}
-		if avail > len(b) {
-			avail = len(b)
+		// fill the send buffer from as many of bufs as will fit
+		for len(bufs) > 0 && c.outgoing.Cap() > 0 {
+			b := bufs[0][off:]
+			avail := c.outgoing.Cap()
+			if avail > len(b) {
+				avail = len(b)
+			}
+			c.outgoing.Write(b[:avail])
+			n += avail
+			off += avail
+			if off == len(bufs[0]) {
+				bufs, off = bufs[1:], 0
+			}
+		}
+		c.active()
+		if urgent && len(bufs) == 0 {
+			c.sndUp = c.sndEnd()
+			c.sndUrgent = true
 		}
-		c.outgoing.Write(b[:avail])
-		b = b[avail:]
-		n += avail
+		c.transmit()
 	}
+}
 
-	return n, nil
+// closeReason returns the error to report from an operation on c once it has
+// been closed: the reason the connection failed if it was refused or reset,
+// and closedErr otherwise.
+func (c *Conn) closeReason() error {
+	if c.err != nil {
+		return c.err
+	}
+	return closedErr
+}
+
+// Close closes the connection. Any buffered data is sent, followed by a FIN;
+// by default, Close returns without waiting for the data or the FIN to be
+// acknowledged (see SetLinger). Subsequent calls to Read and Write return an
+// error. If CloseWrite has already been called, Close only closes the read
+// half. If the connection was already reset or timed out, Close returns nil.
+// Once the FIN has been acknowledged, the other side has 60 seconds to send
+// its own FIN before the connection is reset.
+// See "CLOSE Call," https://tools.ietf.org/html/rfc793#page-60
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readClosed {
+		return closedErr
+	}
+	c.readClosed = true
+	c.readCond.Broadcast()
+	if c.state == StateClosed {
+		// the connection was already torn down by a RST or a timeout; as
+		// with the standard library, closing it still succeeds, and the
+		// cause was already reported by Read and Write
+		return nil
+	}
+	if c.linger == 0 {
+		c.abortLocked()
+		return nil
+	}
+	if !c.finQueued {
+		if err := c.closeWrite(); err != nil {
+			return err
+		}
+	}
+	// if CloseWrite was called earlier, the FIN may already be acknowledged
+	c.startFINWait2Timer()
+	if c.linger > 0 {
+		return c.waitDrained(timeout.NowMonotonic().Add(c.linger))
+	}
+	return nil
+}
+
+// waitDrained waits for all sent data and the FIN to be acknowledged. If that
+// hasn't happened by deadline, the connection is aborted.
+func (c *Conn) waitDrained(deadline time.Time) error {
+	handle := c.timeoutd.AddTimeout(c.writeCond.Broadcast, deadline)
+	defer handle.Cancel()
+	for {
+		switch c.state {
+		case StateFINWait2, StateTimeWait:
+			return nil
+		case StateClosed:
+			return c.err
+		}
+		if reachedDeadline(deadline) {
+			c.abortLocked()
+			return errors.Timeoutf("close: linger timed out with data unacknowledged")
+		}
+		c.writeCond.Wait()
+	}
+}
+
+// CloseWrite closes the write half of the connection. Any buffered data is
+// sent, followed by a FIN, and subsequent calls to Write return an error.
+// Data sent by the other side can still be read until its FIN arrives, at
+// which point Read returns io.EOF. Close must still be called to release the
+// connection.
+func (c *Conn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finQueued {
+		return closedErr
+	}
+	return c.closeWrite()
+}
+
+// closeWrite queues a FIN and moves c into the appropriate state.
+func (c *Conn) closeWrite() error {
+	switch c.state {
+	case StateListen, StateSYNSent:
+		c.close()
+		return nil
+	case StateSYNRcvd:
+		// the FIN will be sent once the connection is established
+		c.finQueued = true
+	case StateEstablished:
+		c.finQueued = true
+		c.setState(StateFINWait1)
+	case StateCloseWait:
+		c.finQueued = true
+		c.setState(StateLastACK)
+	default:
+		return closedErr
+	}
+	c.writeCond.Broadcast()
+	c.transmit()
+	return nil
+}
+
+// SetNoDelay controls whether Nagle's algorithm is disabled. By default, as
+// with standard sockets, Nagle's algorithm is enabled: while any sent data is
+// unacknowledged, small writes are buffered until a full segment is available
+// or all outstanding data is acknowledged. If noDelay is true, data is sent as
+// soon as the windows allow instead.
+//
+// Nagle's algorithm interacts poorly with delayed ACKs. If the peer delays its
+// ACK of a small segment, and the application won't write more until it has
+// heard back from the peer (for example, a write-write-read pattern), then the
+// second write waits for the delayed ACK timer to expire on the other side.
+// Latency-sensitive protocols which exhibit this pattern should set noDelay.
+func (c *Conn) SetNoDelay(noDelay bool) {
+	c.mu.Lock()
+	c.noDelay = noDelay
+	if noDelay {
+		// flush anything Nagle's algorithm was holding back
+		c.transmit()
+	}
+	c.mu.Unlock()
+}
+
+// SetRestartAfterIdle controls whether the congestion window is collapsed to
+// the initial window when c sends data after being idle for longer than the
+// retransmission timeout, so that it doesn't burst a full window of data into
+// a network whose conditions may have changed. It is on by default, and only
+// takes effect if c's CongestionControl implements IdleRestarter.
+// See https://tools.ietf.org/html/rfc5681#section-4.1
+func (c *Conn) SetRestartAfterIdle(on bool) {
+	c.mu.Lock()
+	c.idleRestart = on
+	c.mu.Unlock()
+}
+
+// SetLinger sets the behavior of Close when sent data hasn't yet been
+// acknowledged. If d is negative, which is the default, Close returns
+// immediately, and the data and the FIN are delivered in the background. If d
+// is positive, Close blocks until they have been acknowledged, or until d has
+// elapsed, in which case the connection is reset, the data is discarded, and
+// Close returns a timeout error. If d is 0, Close resets the connection
+// immediately, discarding any unacknowledged data, and the connection is
+// released without entering TIME_WAIT. However long the linger, once Close
+// has returned, the connection is reset if the other side doesn't send its
+// FIN in time (see Close).
+func (c *Conn) SetLinger(d time.Duration) {
+	c.mu.Lock()
+	c.linger = d
+	c.mu.Unlock()
+}
+
+// SetReassemblyLimit sets the maximum number of bytes received out of order
+// that c buffers until the gaps preceding them are filled. Beyond the limit,
+// the data furthest ahead of the gaps is dropped, and the other side will have
+// to retransmit it. This bounds the memory that a peer can make c spend on
+// data which can't yet be read. The default is half of the receive buffer.
+func (c *Conn) SetReassemblyLimit(n int) {
+	c.mu.Lock()
+	c.reassemblyLimit = n
+	c.incoming.TrimOutOfOrder(n)
+	c.mu.Unlock()
+}
+
+// SetChallengeACKLimit sets the maximum number of challenge ACKs that c sends
+// per second. A challenge ACK is sent in response to a RST or SYN which may
+// have been forged by an attacker, and the limit keeps them from being used
+// to flood the other side. If n is 0, challenge ACKs are not limited. The
+// default is 100. See https://tools.ietf.org/html/rfc5961#section-7
+func (c *Conn) SetChallengeACKLimit(n int) {
+	c.mu.Lock()
+	c.challengeLimit = n
+	if c.challengeTokens > n {
+		c.challengeTokens = n
+	}
+	c.mu.Unlock()
+}
+
+// SetReadBuffer sets the size of c's receive buffer, which bounds the window
+// advertised to the other side, and thus throughput: at most one buffer's worth
+// of data can be received per round trip. The size is clamped to at least 2KiB.
+// The window scale, which is fixed by the handshake, is chosen to fit the
+// buffer size at the time, so once the connection is established, the buffer
+// can't grow beyond 64KiB times the scale; use Host.SetReadBuffer to size
+// the buffers of new connections. Data already received is preserved, so the
+// buffer is never shrunk beyond it. Setting the size disables auto-tuning.
+func (c *Conn) SetReadBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == StateClosed {
+		return closedErr
+	}
+	c.autoTuneMax = 0
+	c.setReadBuffer(bytes)
+	return nil
+}
+
+// SetReadBufferAutoTuning enables receive buffer auto-tuning, which sizes the
+// receive buffer to keep the advertised window ahead of the rate at which the
+// application reads, up to max bytes. If max is 0, auto-tuning is disabled,
+// which is the default. Like a large buffer, auto-tuning depends on window
+// scaling, so it must be enabled before the connection is established; see
+// Host.SetReadBufferAutoTuning. If the other side doesn't support window
+// scaling, auto-tuning has no effect.
+func (c *Conn) SetReadBufferAutoTuning(max int) {
+	c.mu.Lock()
+	c.setAutoTuning(max)
+	c.mu.Unlock()
+}
+
+// SetWriteBuffer sets the size of c's send buffer, which holds data written
+// to c until it is acknowledged; once it is full, Write blocks. The size is
+// clamped to at least 2KiB. Data already written is preserved, so the buffer
+// is never shrunk beyond it.
+func (c *Conn) SetWriteBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == StateClosed {
+		return closedErr
+	}
+	c.setWriteBuffer(bytes)
+	return nil
+}
+
+// SetMSSClamp sets c's MSS clamp, overriding the host's or listener's (see
+// Host.SetMSSClamp). Since the MSS is only exchanged during the handshake,
+// which has already completed for dialed and accepted connections, it only
+// limits the size of the segments that c sends. If mss is 0, the clamp is
+// derived from the path MTU.
+func (c *Conn) SetMSSClamp(mss uint16) {
+	c.mu.Lock()
+	c.mssClamp = mss
+	if clamp := c.clampMSS(); clamp > 0 && c.mss > clamp {
+		c.mss = clamp
+	}
+	c.mu.Unlock()
 }
 
 // NOTE(joshlf): The deadline mechanism is a tad subtle, so we document it
@@ -108,7 +423,11 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 // arrived. By monotonicity, any caller in the future will find the same
 // to be true.
 
-// SetDeadline implements the net.Conn SetDeadline method.
+// SetDeadline implements the net.Conn SetDeadline method. Once the deadline
+// passes, blocked and future calls to Read and Write return an error with a
+// Timeout() bool method that returns true (see net.IsTimeout). A deadline in
+// the past takes effect immediately, and the zero time clears the deadline.
+// Setting a deadline replaces any previous one.
 func (c *Conn) SetDeadline(t time.Time) {
 	t = timeToMonotonic(t)
 	c.mu.Lock()
@@ -135,7 +454,10 @@ func (c *Conn) SetWriteDeadline(t time.Time) {
 
 func (c *Conn) setReadDeadline(t time.Time) {
 	c.rdeadline = t
-	c.rdhandle.Cancel()
+	if c.rdhandle != nil {
+		c.rdhandle.Cancel()
+		c.rdhandle = nil
+	}
 	if t == (time.Time{}) {
 		return
 	}
@@ -144,7 +466,10 @@ func (c *Conn) setReadDeadline(t time.Time) {
 
 func (c *Conn) setWriteDeadline(t time.Time) {
 	c.wdeadline = t
-	c.wdhandle.Cancel()
+	if c.wdhandle != nil {
+		c.wdhandle.Cancel()
+		c.wdhandle = nil
+	}
 	if t == (time.Time{}) {
 		return
 	}
@@ -168,8 +493,12 @@ func reachedDeadline(t time.Time) bool {
 }
 
 // Converts a time.Time obtained using time.Now to a roughly-equivalent time
-// in the space used by timeout.NowMonotonic.
+// in the space used by timeout.NowMonotonic. The zero time, which means no
+// deadline, is left as is.
 func timeToMonotonic(t time.Time) time.Time {
+	if t == (time.Time{}) {
+		return t
+	}
 	diff := t.Sub(time.Now())
 	return timeout.NowMonotonic().Add(diff)
 }
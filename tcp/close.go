@@ -0,0 +1,142 @@
+package tcp
+
+import "github.com/joshlf/net/internal/timeout"
+
+// sndEnd returns the sequence number just past the last byte of buffered data.
+// If a FIN has been queued, it occupies sndEnd.
+func (conn *Conn) sndEnd() seq {
+	return seq(conn.outgoing.Seq()) + seq(conn.outgoing.Len())
+}
+
+// finAcked reports whether our FIN has been sent and acknowledged.
+func (conn *Conn) finAcked() bool {
+	return conn.finQueued && conn.sndUna.gt(conn.sndEnd())
+}
+
+func (conn *Conn) sendFIN() {
+	var f flags
+	f.SetACK(true)
+	f.SetFIN(true)
+	conn.send(f, conn.sndNxt, payload{})
+	conn.sndNxt++
+	if conn.sndNxt.gt(conn.sndMax) {
+		conn.sndMax = conn.sndNxt
+	}
+	if conn.rtxHandle == nil {
+		conn.startRetransmitTimer()
+	}
+}
+
+// abort resets the connection: a RST is sent to the other side, and conn is
+// closed without waiting for any data to be sent or acknowledged.
+// See "ABORT Call," https://tools.ietf.org/html/rfc793#page-62
+func (conn *Conn) abort() {
+	conn.mu.Lock()
+	conn.abortLocked()
+	conn.mu.Unlock()
+}
+
+func (conn *Conn) abortLocked() {
+	if conn.state == StateClosed {
+		return
+	}
+	if conn.state != StateListen && conn.state != StateSYNSent {
+		var f flags
+		f.SetRST(true)
+		conn.send(f, conn.sndNxt, payload{})
+	}
+	conn.close()
+}
+
+// handleFIN processes the FIN flag of an acceptable segment. The FIN is only
+// processed once all of the data preceding it has been received; otherwise,
+// it is dropped, and the other side will retransmit it.
+// See "eighth, check the FIN bit," https://tools.ietf.org/html/rfc793#page-75
+func (conn *Conn) handleFIN(hdr *genericHeader, b []byte) {
+	if conn.finRcvd || hdr.seq+seq(len(b)) != conn.rcvNxt {
+		return
+	}
+
+	conn.finRcvd = true
+	conn.rcvNxt++
+	conn.sendAck()
+	conn.readCond.Broadcast()
+
+	switch conn.state {
+	case StateSYNRcvd, StateEstablished:
+		conn.setState(StateCloseWait)
+	case StateFINWait1:
+		if conn.finAcked() {
+			conn.enterTimeWait()
+		} else {
+			conn.setState(StateClosing)
+		}
+	case StateFINWait2:
+		conn.enterTimeWait()
+	}
+}
+
+// enterTimeWait moves conn into TIME_WAIT, or restarts the TIME_WAIT timer if
+// conn is already in TIME_WAIT. Once 2*MSL has elapsed, conn is closed.
+func (conn *Conn) enterTimeWait() {
+	conn.stopTimers()
+	if conn.state != StateTimeWait {
+		conn.setState(StateTimeWait)
+	}
+	conn.twHandle = conn.timeoutd.AddTimeout(conn.timeWaitTimeout, timeout.NowMonotonic().Add(2*conn.msl))
+}
+
+func (conn *Conn) timeWaitTimeout() {
+	conn.twHandle = nil
+	conn.close()
+}
+
+// startFINWait2Timer starts the FIN_WAIT_2 timer if conn is orphaned in
+// FIN_WAIT_2: the application has closed it, and our FIN has been
+// acknowledged, but the other side's FIN hasn't arrived. Since nothing is
+// left to read what the other side sends, conn is reset once the timer
+// expires rather than waiting indefinitely for a FIN that may never come.
+// This is the same safeguard as Linux's tcp_fin_timeout.
+func (conn *Conn) startFINWait2Timer() {
+	if conn.state != StateFINWait2 || !conn.readClosed || conn.fw2Handle != nil {
+		return
+	}
+	conn.fw2Handle = conn.timeoutd.AddTimeout(conn.finWait2Expired, timeout.NowMonotonic().Add(conn.fw2Timeout))
+}
+
+func (conn *Conn) finWait2Expired() {
+	conn.fw2Handle = nil
+	if conn.state == StateFINWait2 {
+		conn.abortLocked()
+	}
+}
+
+func (conn *Conn) stopFINWait2Timer() {
+	if conn.fw2Handle != nil {
+		conn.fw2Handle.Cancel()
+		conn.fw2Handle = nil
+	}
+}
+
+// reopen reports whether hdr is a SYN which may reopen conn's four-tuple while
+// conn is in TIME_WAIT, in which case conn is closed. The SYN must be newer than
+// anything received on conn: if timestamps are in use, its timestamp must be
+// newer, and otherwise, its sequence number must be greater than rcvNxt.
+// See https://tools.ietf.org/html/rfc6191#section-2
+func (conn *Conn) reopen(hdr *genericHeader) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.state != StateTimeWait || !hdr.SYN() || hdr.ACK() || hdr.RST() {
+		return false
+	}
+	var ok bool
+	if conn.tsOK && hdr.tsSet {
+		ok = int32(hdr.tsVal-conn.tsRecent) > 0
+	} else {
+		ok = hdr.seq.gt(conn.rcvNxt)
+	}
+	if ok {
+		conn.close()
+	}
+	return ok
+}
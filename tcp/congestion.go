@@ -0,0 +1,314 @@
+package tcp
+
+import (
+	"math"
+	"time"
+
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// A CongestionControl implements a congestion control algorithm. A Conn
+// reports transmissions, acknowledgements, and losses to its CongestionControl,
+// and never sends more unacknowledged data than the CongestionControl's
+// congestion window allows.
+//
+// A CongestionControl is only ever accessed by a single Conn, and the Conn
+// synchronizes all calls, so implementations do not need to be safe for
+// concurrent access.
+type CongestionControl interface {
+	// OnPacketSent is called whenever a segment carrying bytes bytes of
+	// data is transmitted, including retransmissions. Since retransmitted
+	// data is reported again, the total sent less the total acknowledged
+	// isn't the amount of data in flight; that is passed to OnLoss instead.
+	OnPacketSent(bytes uint32)
+	// OnAck is called whenever an ACK acknowledges new data. acked is the
+	// number of newly-acknowledged bytes, and rtt is the round-trip time
+	// sample taken from the ACK, or 0 if no sample is available. The
+	// window should grow according to acked rather than the number of
+	// calls to OnAck, since a receiver can split its ACKs to send as many
+	// as it likes. See https://tools.ietf.org/html/rfc3465
+	OnAck(acked uint32, rtt time.Duration)
+	// OnLoss is called when the retransmission timer expires, indicating
+	// that all outstanding data should be considered lost. flight is the
+	// number of bytes which were outstanding (the FlightSize of RFC 5681).
+	OnLoss(flight uint32)
+	// CongestionWindow returns the current congestion window in bytes.
+	CongestionWindow() uint32
+}
+
+// A FastRecovery is a CongestionControl which takes part in fast recovery.
+// If a Conn's CongestionControl does not implement FastRecovery, the Conn
+// still performs fast retransmit, but treats it like a retransmission
+// timeout, calling OnLoss instead.
+// See https://tools.ietf.org/html/rfc6582#section-3.2
+type FastRecovery interface {
+	CongestionControl
+	// EnterRecovery is called when the third duplicate ACK is received
+	// and the lost segment is retransmitted. flight is the number of
+	// bytes which were outstanding, as for OnLoss.
+	EnterRecovery(flight uint32)
+	// OnDupAck is called for each further duplicate ACK
+	// received during fast recovery.
+	OnDupAck()
+	// ExitRecovery is called when an ACK acknowledges all of the data
+	// which was outstanding when fast recovery was entered. During fast
+	// recovery, OnAck is only called for partial ACKs, which acknowledge
+	// some but not all of this data; the final ACK is reported to OnAck
+	// immediately before ExitRecovery is called.
+	ExitRecovery()
+}
+
+// An ECNCongestionControl is a CongestionControl which responds to explicit
+// congestion notifications. A Conn only marks its segments as ECN-capable if
+// ECN has been negotiated and its CongestionControl implements
+// ECNCongestionControl; otherwise, congested routers drop them instead.
+// See https://tools.ietf.org/html/rfc3168#section-6.1.2
+type ECNCongestionControl interface {
+	CongestionControl
+	// OnECE is called when an ACK echoes a congestion experienced mark
+	// set by a router on a segment sent by the Conn. It is called at most
+	// once per round trip, and never during fast recovery. The window
+	// should be reduced as if a segment had been lost, but nothing is
+	// retransmitted. flight is the number of bytes which are outstanding,
+	// as for OnLoss.
+	OnECE(flight uint32)
+}
+
+// An InitialWindowSetter is a CongestionControl whose initial congestion
+// window can be configured. When a Conn is established, it sets the initial
+// window of its CongestionControl (see Host.SetInitialCwnd) if it implements
+// InitialWindowSetter; otherwise, the CongestionControl's own initial window
+// is used.
+type InitialWindowSetter interface {
+	CongestionControl
+	// SetInitialWindow sets the congestion window to cwnd bytes. It is called
+	// once, before any data has been sent.
+	SetInitialWindow(cwnd uint32)
+}
+
+// An IdleRestarter is a CongestionControl which collapses its congestion
+// window after the connection has been idle. A Conn which restarts after
+// idle periods (see Conn.SetRestartAfterIdle) calls OnIdle before sending
+// new data if it hasn't sent anything for longer than the RTO; otherwise, the
+// congestion window is left alone. See "Restarting Idle Connections,"
+// https://tools.ietf.org/html/rfc5681#section-4.1
+type IdleRestarter interface {
+	CongestionControl
+	// OnIdle is called when the connection has been idle for longer than
+	// the RTO. restartWindow is the initial window; the congestion window
+	// should be reduced to it if it is larger.
+	OnIdle(restartWindow uint32)
+}
+
+// A LossUndoer is a CongestionControl which can undo its response to a
+// retransmission timeout or fast retransmit. A Conn which detects that a
+// timeout was spurious (see Conn.SetFRTO), or that every segment retransmitted
+// in response to a loss arrived twice (see NegotiatedOptions.SACK), calls
+// UndoLoss; otherwise, the congestion window stays reduced even though nothing
+// was lost.
+// See https://tools.ietf.org/html/rfc5682#section-3 and
+// https://tools.ietf.org/html/rfc3708
+type LossUndoer interface {
+	CongestionControl
+	// UndoLoss is called when the last call to OnLoss, or to EnterRecovery
+	// for a FastRecovery, turns out to have been unnecessary. If it was
+	// EnterRecovery, ExitRecovery is called first. The congestion window
+	// should be restored to at least what it was before the loss. inflight
+	// is the number of bytes which are actually in flight, which OnLoss
+	// considered lost.
+	UndoLoss(inflight uint32)
+}
+
+// abcLimit is the most segments by which slow start grows the congestion
+// window in response to a single ACK. See https://tools.ietf.org/html/rfc3465
+const abcLimit = 2
+
+// defaultInitCwnd is the default initial congestion window, in segments.
+// See https://tools.ietf.org/html/rfc6928
+const defaultInitCwnd = 10
+
+// NewReno returns a CongestionControl implementing the NewReno algorithm
+// described in RFC 5681 and RFC 6582 for a connection with the given maximum
+// segment size. It implements FastRecovery, ECNCongestionControl,
+// InitialWindowSetter, IdleRestarter, and LossUndoer, and is the default
+// CongestionControl for new connections.
+func NewReno(mss int) CongestionControl {
+	m := uint32(mss)
+	return &newReno{
+		mss:      m,
+		cwnd:     initialWindow(m),
+		ssthresh: math.MaxUint32,
+	}
+}
+
+// initialWindow computes the initial congestion window for the given MSS.
+// See "Initial Window," https://tools.ietf.org/html/rfc5681#section-3.1
+func initialWindow(mss uint32) uint32 {
+	switch {
+	case mss > 2190:
+		return 2 * mss
+	case mss > 1095:
+		return 3 * mss
+	default:
+		return 4 * mss
+	}
+}
+
+type newReno struct {
+	mss      uint32
+	cwnd     uint32
+	ssthresh uint32
+	recovery bool // whether we are in fast recovery
+	// bytes acknowledged in congestion avoidance
+	// since cwnd last grew; see OnAck
+	bytesAcked uint32
+	// whether slow start follows a retransmission timeout,
+	// during which cwnd grows more conservatively
+	rtoSlowStart bool
+	// cwnd and ssthresh before the last call to OnLoss or EnterRecovery
+	priorCwnd, priorSSThresh uint32
+}
+
+// ssthresh is computed from the flight size passed to OnLoss,
+// so there's nothing to keep track of
+func (n *newReno) OnPacketSent(bytes uint32) {}
+
+func (n *newReno) SetInitialWindow(cwnd uint32) { n.cwnd = cwnd }
+
+func (n *newReno) OnIdle(restartWindow uint32) {
+	if restartWindow < n.cwnd {
+		n.cwnd = restartWindow
+	}
+}
+
+func (n *newReno) OnAck(acked uint32, rtt time.Duration) {
+	if n.recovery {
+		// partial ACK: deflate the window by the amount of new data
+		// acknowledged, and add back one segment if at least one
+		// segment's worth was acknowledged
+		// See step 3, https://tools.ietf.org/html/rfc6582#section-3.2
+		if acked > n.cwnd {
+			acked = n.cwnd
+		}
+		n.cwnd -= acked
+		if acked >= n.mss {
+			n.cwnd += n.mss
+		}
+		return
+	}
+	if n.cwnd < n.ssthresh {
+		// slow start: the number of bytes acknowledged, but
+		// no more than abcLimit segments (or one segment
+		// after a timeout) per ACK
+		// See https://tools.ietf.org/html/rfc3465#section-2.2
+		limit := abcLimit * n.mss
+		if n.rtoSlowStart {
+			limit = n.mss
+		}
+		if acked > limit {
+			acked = limit
+		}
+		n.cwnd += acked
+		return
+	}
+	n.rtoSlowStart = false
+	// congestion avoidance: one MSS for each cwnd
+	// bytes acknowledged, or once per RTT
+	// See https://tools.ietf.org/html/rfc3465#section-2.1
+	n.bytesAcked += acked
+	if n.bytesAcked >= n.cwnd {
+		n.bytesAcked -= n.cwnd
+		n.cwnd += n.mss
+	}
+}
+
+func (n *newReno) OnLoss(flight uint32) {
+	n.priorCwnd, n.priorSSThresh = n.cwnd, n.ssthresh
+	n.setSSThresh(flight)
+	n.recovery = false
+	n.bytesAcked = 0
+	n.rtoSlowStart = true
+	// the loss window is one segment
+	n.cwnd = n.mss
+}
+
+// UndoLoss restores the state before OnLoss or EnterRecovery,
+// keeping any growth since then.
+func (n *newReno) UndoLoss(inflight uint32) {
+	if n.cwnd < n.priorCwnd {
+		n.cwnd = n.priorCwnd
+	}
+	if n.ssthresh < n.priorSSThresh {
+		n.ssthresh = n.priorSSThresh
+	}
+	n.rtoSlowStart = false
+}
+
+func (n *newReno) EnterRecovery(flight uint32) {
+	// See step 2, https://tools.ietf.org/html/rfc6582#section-3.2
+	n.priorCwnd, n.priorSSThresh = n.cwnd, n.ssthresh
+	n.setSSThresh(flight)
+	n.bytesAcked = 0
+	n.cwnd = n.ssthresh + 3*n.mss
+	n.recovery = true
+}
+
+// the window is artificially inflated by one segment for each duplicate
+// ACK, since each one indicates that a segment has left the network
+func (n *newReno) OnDupAck() { n.cwnd += n.mss }
+
+func (n *newReno) ExitRecovery() {
+	// See step 3, https://tools.ietf.org/html/rfc6582#section-3.2
+	n.cwnd = n.ssthresh
+	n.recovery = false
+}
+
+// See https://tools.ietf.org/html/rfc3168#section-6.1.2
+func (n *newReno) OnECE(flight uint32) {
+	n.setSSThresh(flight)
+	n.bytesAcked = 0
+	n.cwnd = n.ssthresh
+}
+
+// setSSThresh sets ssthresh in response to a loss with flight bytes
+// outstanding. See equation (4), https://tools.ietf.org/html/rfc5681#section-3.1
+func (n *newReno) setSSThresh(flight uint32) {
+	n.ssthresh = flight / 2
+	if n.ssthresh < 2*n.mss {
+		n.ssthresh = 2 * n.mss
+	}
+}
+
+func (n *newReno) CongestionWindow() uint32 { return n.cwnd }
+
+// setInitialWindow sets the initial congestion window of conn's
+// CongestionControl to conn.initCwnd segments, clamped to the window
+// advertised by the other side, but no smaller than one segment.
+func (conn *Conn) setInitialWindow() {
+	iws, ok := conn.cc.(InitialWindowSetter)
+	if !ok {
+		return
+	}
+	mss := uint32(conn.sendMSS())
+	cwnd := uint32(conn.initCwnd) * mss
+	if cwnd > conn.sndWnd {
+		cwnd = conn.sndWnd
+	}
+	if cwnd < mss {
+		cwnd = mss
+	}
+	iws.SetInitialWindow(cwnd)
+}
+
+// restartAfterIdle collapses the congestion window to the initial window if
+// nothing is in flight and nothing has been sent for longer than the RTO.
+func (conn *Conn) restartAfterIdle() {
+	if !conn.idleRestart || conn.lastSend.IsZero() || conn.sndUna != conn.sndMax {
+		return
+	}
+	ir, ok := conn.cc.(IdleRestarter)
+	if !ok || timeout.NowMonotonic().Sub(conn.lastSend) <= conn.rtt.rto {
+		return
+	}
+	ir.OnIdle(uint32(conn.initCwnd) * uint32(conn.sendMSS()))
+}
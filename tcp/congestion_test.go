@@ -0,0 +1,138 @@
+package tcp
+
+import "testing"
+
+// A ccEvent is a synthetic event to feed to a CongestionControl. Exactly
+// one of sent, acked, loss, enter, dupAck, and exit should be set; the last
+// three require that the CongestionControl implement FastRecovery. flight is
+// the flight size reported with loss and enter. cwnd is the congestion window
+// expected after the event has been processed.
+type ccEvent struct {
+	sent   uint32
+	acked  uint32
+	loss   bool
+	enter  bool
+	dupAck bool
+	exit   bool
+	flight uint32
+	cwnd   uint32
+}
+
+// testCongestionControl feeds events to cc in order, and checks that the
+// congestion window after each event matches the expected value.
+func testCongestionControl(t *testing.T, cc CongestionControl, events []ccEvent) {
+	for i, ev := range events {
+		switch {
+		case ev.sent > 0:
+			cc.OnPacketSent(ev.sent)
+		case ev.acked > 0:
+			cc.OnAck(ev.acked, 0)
+		case ev.loss:
+			cc.OnLoss(ev.flight)
+		case ev.enter:
+			cc.(FastRecovery).EnterRecovery(ev.flight)
+		case ev.dupAck:
+			cc.(FastRecovery).OnDupAck()
+		case ev.exit:
+			cc.(FastRecovery).ExitRecovery()
+		}
+		if cwnd := cc.CongestionWindow(); cwnd != ev.cwnd {
+			t.Fatalf("event %v (%+v): unexpected cwnd: got %v; want %v", i, ev, cwnd, ev.cwnd)
+		}
+	}
+}
+
+func TestNewReno(t *testing.T) {
+	testCongestionControl(t, NewReno(1000), []ccEvent{
+		// initial window is 4 segments for an MSS of 1000
+		{sent: 4000, cwnd: 4000},
+		// slow start: the number of bytes acknowledged
+		{acked: 1000, cwnd: 5000},
+		{acked: 1000, cwnd: 6000},
+		// 2000 bytes still in flight, so ssthresh is the
+		// minimum of 2 segments, and cwnd is the loss window
+		{loss: true, flight: 2000, cwnd: 1000},
+		{sent: 1000, cwnd: 1000},
+		{acked: 1000, cwnd: 2000},
+		// cwnd has reached ssthresh; congestion avoidance:
+		// one MSS once cwnd bytes have been acknowledged
+		{sent: 4000, cwnd: 2000},
+		{acked: 1000, cwnd: 2000},
+		{acked: 1000, cwnd: 3000},
+		{acked: 1000, cwnd: 3000},
+		{acked: 1000, cwnd: 3000},
+	})
+
+	testCongestionControl(t, NewReno(1460), []ccEvent{
+		// initial window is 3 segments for an MSS of 1460
+		{sent: 4380, cwnd: 4380},
+		{acked: 1460, cwnd: 5840},
+		// ssthresh is half of the 2920 bytes in flight,
+		// but no less than 2 segments
+		{loss: true, flight: 2920, cwnd: 1460},
+		{sent: 1460, cwnd: 1460},
+		{acked: 1460, cwnd: 2920},
+		{sent: 2920, cwnd: 2920},
+		{acked: 1460, cwnd: 2920},
+		{acked: 1460, cwnd: 4380},
+	})
+}
+
+func TestNewRenoFastRecovery(t *testing.T) {
+	testCongestionControl(t, NewReno(1000), []ccEvent{
+		{sent: 4000, cwnd: 4000},
+		{acked: 1000, cwnd: 5000},
+		{sent: 5000, cwnd: 5000},
+		// 8000 bytes in flight, so ssthresh is 4000, and
+		// cwnd is inflated by the 3 duplicate ACKs
+		{enter: true, flight: 8000, cwnd: 7000},
+		{dupAck: true, cwnd: 8000},
+		{dupAck: true, cwnd: 9000},
+		// a partial ACK deflates the window by the amount acknowledged,
+		// but adds back one segment
+		{acked: 2000, cwnd: 8000},
+		// the final ACK is reported before recovery is exited, which
+		// deflates the window to ssthresh
+		{acked: 6000, cwnd: 3000},
+		{exit: true, cwnd: 4000},
+		// congestion avoidance
+		{sent: 4000, cwnd: 4000},
+		{acked: 3000, cwnd: 4000},
+		{acked: 1000, cwnd: 5000},
+	})
+}
+
+func TestNewRenoByteCounting(t *testing.T) {
+	testCongestionControl(t, NewReno(1000), []ccEvent{
+		{sent: 4000, cwnd: 4000},
+		// a segment's worth of small ACKs only grows
+		// the window by a segment in slow start
+		{acked: 250, cwnd: 4250},
+		{acked: 250, cwnd: 4500},
+		{acked: 250, cwnd: 4750},
+		{acked: 250, cwnd: 5000},
+		// but a stretch ACK grows it by no more than two
+		{acked: 3000, cwnd: 7000},
+		{sent: 8000, cwnd: 7000},
+		// after a timeout, by no more than one
+		{loss: true, flight: 8000, cwnd: 1000},
+		{sent: 3000, cwnd: 1000},
+		{acked: 3000, cwnd: 2000},
+	})
+
+	testCongestionControl(t, NewReno(1000), []ccEvent{
+		{sent: 8000, cwnd: 4000},
+		{enter: true, flight: 8000, cwnd: 7000},
+		{acked: 8000, cwnd: 1000},
+		{exit: true, cwnd: 4000},
+		// in congestion avoidance, a window's worth of
+		// small ACKs grows the window by one segment,
+		// no matter how many there are
+		{sent: 4000, cwnd: 4000},
+		{acked: 100, cwnd: 4000},
+		{acked: 100, cwnd: 4000},
+		{acked: 1800, cwnd: 4000},
+		{acked: 1900, cwnd: 4000},
+		{acked: 100, cwnd: 5000},
+	})
+}
@@ -6,41 +6,45 @@ import (
 	"sync"
 	"time"
 
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/timeout"
 	"github.com/joshlf/net/tcp/internal/buffer"
-	"github.com/joshlf/net/tcp/internal/timeout"
 )
 
-type state uint8
+// A State is a state of the TCP state machine.
+// See "Connection State Diagram," https://tools.ietf.org/html/rfc793#page-23
+type State uint8
 
+// States of the TCP state machine
 const (
-	stateListen state = iota
-	stateSYNRcvd
-	stateSYNSent
-	stateEstablished
-	stateFINWait1
-	stateFINWait2
-	stateClosing
-	stateTimeWait
-	stateCloseWait
-	stateLastACK
-	stateClosed
+	StateListen State = iota
+	StateSYNRcvd
+	StateSYNSent
+	StateEstablished
+	StateFINWait1
+	StateFINWait2
+	StateClosing
+	StateTimeWait
+	StateCloseWait
+	StateLastACK
+	StateClosed
 )
 
 var stateStrs = [...]string{
-	stateListen:      "LISTEN",
-	stateSYNRcvd:     "SYN_RCVD",
-	stateSYNSent:     "SYN_SENT",
-	stateEstablished: "ESTABLISHED",
-	stateFINWait1:    "FIN_WAIT_1",
-	stateFINWait2:    "FIN_WAIT_2",
-	stateClosing:     "CLOSING",
-	stateTimeWait:    "TIME_WAIT",
-	stateCloseWait:   "CLOSE_WAIT",
-	stateLastACK:     "LAST_ACK",
-	stateClosed:      "CLOSED",
-}
-
-func (s state) String() string {
+	StateListen:      "LISTEN",
+	StateSYNRcvd:     "SYN_RCVD",
+	StateSYNSent:     "SYN_SENT",
+	StateEstablished: "ESTABLISHED",
+	StateFINWait1:    "FIN_WAIT_1",
+	StateFINWait2:    "FIN_WAIT_2",
+	StateClosing:     "CLOSING",
+	StateTimeWait:    "TIME_WAIT",
+	StateCloseWait:   "CLOSE_WAIT",
+	StateLastACK:     "LAST_ACK",
+	StateClosed:      "CLOSED",
+}
+
+func (s State) String() string {
 	if int(s) >= len(stateStrs) {
 		return fmt.Sprintf("UNKNOWN_STATE(%v)", int(s))
 	}
@@ -49,13 +53,283 @@ func (s state) String() string {
 
 type seq uint32
 
+// Sequence numbers are compared modulo 2^32; see "Sequence Numbers,"
+// https://tools.ietf.org/html/rfc793#section-3.3
+
+func (s seq) lt(other seq) bool  { return int32(s-other) < 0 }
+func (s seq) leq(other seq) bool { return int32(s-other) <= 0 }
+func (s seq) gt(other seq) bool  { return int32(s-other) > 0 }
+func (s seq) geq(other seq) bool { return int32(s-other) >= 0 }
+
+const (
+	// default size of the send and receive buffers
+	defaultBufferSize = 65535
+	// the smallest and largest allowed sizes of the send and receive
+	// buffers; the largest is the largest window that can be advertised
+	minBufferSize = 2048
+	maxBufferSize = 0xFFFF << maxWindowScale
+	// the largest window scale; see
+	// https://tools.ietf.org/html/rfc7323#section-2.3
+	maxWindowScale = 14
+	// the MSS assumed when the other side doesn't send an MSS option;
+	// see https://tools.ietf.org/html/rfc1122#page-86
+	defaultMSS = 536
+	// the length of the timestamp option, including padding
+	timestampOptionLen = 12
+	// PAWS is not applied if no segment has been received for this long;
+	// see https://tools.ietf.org/html/rfc7323#section-5.5
+	pawsIdleTimeout = 24 * 24 * time.Hour
+	// the maximum time that an ACK may be delayed; see
+	// https://tools.ietf.org/html/rfc1122#page-96
+	defaultACKDelay = 200 * time.Millisecond
+	// the maximum segment lifetime; see
+	// https://tools.ietf.org/html/rfc793#page-28
+	defaultMSL = 2 * time.Minute
+	// how long a connection closed by the application may wait in
+	// FIN_WAIT_2 for the other side's FIN; see startFINWait2Timer
+	defaultFINWait2Timeout = 60 * time.Second
+	// the default maximum number of bytes received out of order
+	// to buffer; see SetReassemblyLimit
+	defaultReassemblyLimit = defaultBufferSize / 2
+	// the default maximum number of challenge ACKs to send per second;
+	// see SetChallengeACKLimit
+	defaultChallengeACKLimit = 100
+	// the default number of times to retransmit a SYN or SYN-ACK
+	// before giving up; see Host.SetSYNRetries
+	defaultSYNRetries = 6
+	// the minimum RTO once data transmission begins if the SYN was
+	// retransmitted; see https://tools.ietf.org/html/rfc6298#section-5
+	synRetransmitRTO = 3 * time.Second
+)
+
 type Conn struct {
-	state    state
+	state    State
 	statefn  func(conn *Conn, hdr *genericHeader, b []byte)
-	timeoutd *timeout.Daemon
+	timeoutd timeout.Daemon
 	incoming buffer.ReadBuffer
 	outgoing buffer.WriteBuffer
 
+	// send sequence variables; see "Send Sequence Space,"
+	// https://tools.ietf.org/html/rfc793#page-20
+	iss    seq
+	sndUna seq
+	sndNxt seq
+	sndMax seq // highest sequence number sent; sndNxt < sndMax after a retransmission
+	sndWnd uint32
+	sndWl1 seq
+	sndWl2 seq
+
+	// receive sequence variables; see "Receive Sequence Space,"
+	// https://tools.ietf.org/html/rfc793#page-20
+	irs    seq
+	rcvNxt seq
+
+	// buffer sizes and window scaling; see
+	// https://tools.ietf.org/html/rfc7323#section-2
+	rcvBufSize  int   // size of the receive buffer
+	sndBufSize  int   // size of the send buffer
+	wsOK        bool  // whether window scaling was negotiated
+	sndShift    uint8 // the other side's window scale, applied to windows it advertises
+	rcvShift    uint8 // our window scale, applied to windows we advertise
+	maxRcvShift uint8 // the largest window scale we offer
+
+	// receive buffer auto-tuning state; see autoTune
+	autoTuneMax    int           // the largest buffer auto-tuning may use; 0 if disabled
+	autoTuneMin    int           // the buffer size when the connection was established
+	autoTuneTarget int           // the size the buffer shrinks toward as data is read
+	rcvCopied      int           // bytes read since rcvSpaceTime
+	rcvSpaceTime   time.Time     // when the current measurement began
+	rcvRTT         time.Duration // RTT estimated from timestamps as the receiver; 0 if unknown
+
+	// the maximum number of bytes received out of order to
+	// buffer while waiting for the gap preceding them to fill
+	reassemblyLimit int
+
+	mss      uint16 // maximum size of outgoing segments
+	mssClamp uint16 // the maximum MSS to advertise or accept; see clampMSS
+	noDelay  bool   // whether Nagle's algorithm is disabled
+	initCwnd int    // the initial congestion window in segments
+	cc       CongestionControl
+	newCC    func(mss int) CongestionControl
+
+	// whether to collapse the congestion window after idle
+	// periods, and when data was last sent; see restartAfterIdle
+	idleRestart bool
+	lastSend    time.Time
+
+	counters Counters // see Stats
+
+	// SYN retransmission state
+	synHandle   *timeout.Timeout // guaranteed to be nil if canceled
+	synRetries  int              // retransmissions of the SYN before giving up
+	synAttempts int              // the number of times the SYN has been sent
+	synStart    time.Time        // when the SYN was first sent
+
+	// retransmission state
+	rtt       rtoEstimator
+	rtxHandle *timeout.Timeout // guaranteed to be nil if canceled
+	// Only one segment is timed at once, and a retransmission
+	// invalidates the measurement (Karn's algorithm); see
+	// https://tools.ietf.org/html/rfc6298#section-3
+	rttTiming bool
+	rttSeq    seq // the sample completes when rttSeq is acknowledged
+	rttStart  time.Time
+
+	// fast retransmit and fast recovery state;
+	// see https://tools.ietf.org/html/rfc6582
+	dupAcks    int  // consecutive duplicate ACKs received
+	inRecovery bool // whether we are in fast recovery
+	recover    seq  // sndMax at the last loss event; see dragRecover
+
+	// F-RTO state; see SetFRTO
+	frtoEnabled bool
+	frto        int // frtoOff, frtoFirstAck, or frtoSecondAck
+	// in frtoSecondAck, new data may be sent up to frtoLimit
+	// regardless of the congestion window
+	frtoLimit seq
+
+	// SACK state; see https://tools.ietf.org/html/rfc2018
+	sackOK bool // whether SACK was negotiated
+	// out-of-order blocks recently reported to the other
+	// side, most recently received first; see setSACK
+	rcvSACK  [maxSACKBlocks]sackBlock
+	nrcvSACK int
+	// data the other side has received above sndUna, in order
+	scoreboard []sackBlock
+	// during fast recovery, the first byte not yet
+	// retransmitted; see retransmitHole
+	sackRtxNext seq
+	// DSACK state; see https://tools.ietf.org/html/rfc2883
+	dsack    sackBlock // duplicate data to report in the next ACK
+	dsackSet bool      // whether dsack is valid
+	// undo state for the current loss episode;
+	// see https://tools.ietf.org/html/rfc3708
+	undoActive  bool // whether the episode may still be undone
+	undoRetrans int  // segments retransmitted and not yet reported by a DSACK
+	undoEnd     seq  // sndMax when the episode began
+
+	// persist timer state; see "Probing Zero Windows,"
+	// https://tools.ietf.org/html/rfc1122#page-92
+	persistHandle   *timeout.Timeout // guaranteed to be nil if canceled
+	persistInterval time.Duration    // 0 if the persist timer isn't backing off
+
+	// timestamp state; see https://tools.ietf.org/html/rfc7323
+	tsOK          bool      // whether timestamps were negotiated
+	tsOffset      uint32    // randomizes our timestamp clock
+	tsRecent      uint32    // the peer's timestamp to echo
+	tsRecentAge   time.Time // when tsRecent was last updated
+	tsLastAckSent seq       // the ACK number of the last segment sent
+	// our timestamp when data was last retransmitted, and sndMax at the
+	// time; tsRtxGuard is true until that has been acknowledged (see tsRTT)
+	tsRtx      uint32
+	tsRtxEnd   seq
+	tsRtxGuard bool
+	minRTT     time.Duration // the smallest RTT sampled from timestamps
+
+	// challenge ACK rate limiting; see https://tools.ietf.org/html/rfc5961#section-7
+	challengeLimit  int       // challenge ACKs allowed per second; 0 for no limit
+	challengeTokens int       // challenge ACKs left in the current second
+	challengeStart  time.Time // when the current second began
+
+	// cork state; see SetCork
+	cork       bool
+	corkHandle *timeout.Timeout // guaranteed to be nil if canceled
+	corkFlush  bool             // whether the cork timer has expired and data is being flushed
+
+	// keepalive state; see SetKeepAlive
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+	kaHandle        *timeout.Timeout // guaranteed to be nil if canceled
+	kaProbes        int              // probes sent since anything was heard
+	lastHeard       time.Time        // when a segment was last received
+
+	// idle timeout state; see SetIdleTimeout
+	idleTimeout time.Duration
+	idleHandle  *timeout.Timeout // guaranteed to be nil if canceled
+	lastActive  time.Time        // when data was last sent or received
+
+	// throughput sampling state; see SetThroughputInterval
+	tputInterval time.Duration
+	tputHandle   *timeout.Timeout // guaranteed to be nil if canceled
+	tputDue      time.Time        // when the next sample is due
+	tputLast     time.Time        // when the last sample was taken
+	tputRead     uint64           // counters.BytesRead when the last sample was taken
+	tputAcked    uint64           // counters.BytesAcked when the last sample was taken
+	tputSamples  []Sample         // a ring of the most recent samples; nil if disabled
+	tputNext     int              // the index of the oldest sample once the ring is full
+
+	// pacing state; see SetPacing
+	pacing     bool
+	paceHandle *timeout.Timeout // guaranteed to be nil if canceled
+	paceNext   time.Time        // when the next segment may be sent
+
+	// delayed ACK state
+	ackDelay   time.Duration
+	ackHandle  *timeout.Timeout // guaranteed to be nil if canceled
+	rcvUnacked int              // bytes received since the last ACK was sent
+
+	// urgent data state; see https://tools.ietf.org/html/rfc6093
+	urgStyle   UrgentPointerStyle
+	sndUp      seq  // the sequence number following our latest urgent byte
+	sndUrgent  bool // whether urgent data up to sndUp is unacknowledged
+	rcvUp      seq  // the sequence number following their latest urgent byte
+	rcvUrgent  bool // whether Read has yet to reach the urgent byte
+	oob        byte // the urgent byte, if oobValid
+	oobValid   bool // whether oob holds an urgent byte not yet read by ReadUrgent
+	oobPending bool // whether an urgent byte has been signaled, but not yet received
+
+	// ECN state; see https://tools.ietf.org/html/rfc3168#section-6.1
+	ecn        bool // whether to negotiate ECN in the handshake
+	ecnOK      bool // whether ECN was negotiated
+	ecnEcho    bool // whether to set ECE on outgoing segments
+	cwrPending bool // whether to set CWR on the next new data segment
+	ecnRecover seq  // sndMax at the last response to ECE; see dragECNRecover
+
+	// path MTU discovery state; see https://tools.ietf.org/html/rfc1191
+	pathMTU     func() int // queries the path MTU; nil if unavailable
+	pmtu        int        // the last known path MTU, or 0 if unknown
+	pmtuChecked time.Time  // when pathMTU was last queried
+	overhead    int        // the length of the IP and TCP headers without options
+
+	// output transmits a segment to the other side of the connection.
+	// It is called with mu held, so it must not call back into the
+	// Conn synchronously. It is responsible for filling in the ports
+	// and the checksum.
+	output func(hdr *genericHeader, p payload)
+
+	// the local and remote addresses of the connection
+	local, remote twoTuple
+
+	// the results of the handshake; nil until it completes
+	negotiated *NegotiatedOptions
+
+	// the Listener which created this Conn; nil once
+	// the Conn has been placed in its accept queue
+	listener *Listener
+	// the Listener whose connection limit this Conn counts toward;
+	// nil until it is placed in the accept queue, and once it has
+	// been closed or entered TIME_WAIT
+	counted *Listener
+	// whether the connection was opened passively, by a SYN in LISTEN
+	passive bool
+
+	// connection teardown state
+	finQueued  bool          // Close or CloseWrite has been called; send a FIN after all data
+	readClosed bool          // Close has been called; Read returns an error
+	linger     time.Duration // see SetLinger; negative for a graceful close
+	finRcvd    bool          // the other side's FIN has been received
+	msl        time.Duration
+	twHandle   *timeout.Timeout // guaranteed to be nil if canceled
+	fw2Timeout time.Duration
+	fw2Handle  *timeout.Timeout // guaranteed to be nil if canceled
+	// the error reported to clients once the connection is closed;
+	// nil if it was closed normally
+	err error
+	// stateHook, if non-nil, is called with mu held whenever conn enters
+	// TIME_WAIT or CLOSED. Like output, it must not call back into the
+	// Conn synchronously.
+	stateHook func(conn *Conn, s State)
+
 	// client stuff
 	readCond, writeCond  sync.Cond
 	rdeadline, wdeadline time.Time
@@ -64,41 +338,1237 @@ type Conn struct {
 	mu sync.Mutex
 }
 
-func newListenConn() *Conn {
-	// TODO(joshlf): Set buffer size appropriately
+// newConn creates a new Conn with no state. If newCC is nil, NewReno is used.
+func newConn(output func(hdr *genericHeader, p payload), newCC func(mss int) CongestionControl) *Conn {
+	if newCC == nil {
+		newCC = NewReno
+	}
 	c := &Conn{
-		state:    stateListen,
-		statefn:  (*Conn).listen,
-		outgoing: *buffer.NewWriteBuffer(1024, rand.Uint32()),
+		mss:      defaultMSS,
+		newCC:    newCC,
+		rtt:      newRTOEstimator(),
+		tsOffset: rand.Uint32(),
+		ackDelay: defaultACKDelay,
+		msl:      defaultMSL,
+		linger:   -1,
+		initCwnd: defaultInitCwnd,
+		overhead: headerOverhead,
+		output:   output,
+
+		synRetries:      defaultSYNRetries,
+		keepAlivePeriod: defaultKeepAlivePeriod,
+		fw2Timeout:      defaultFINWait2Timeout,
+		idleRestart:     true,
+		frtoEnabled:     true,
+		rcvBufSize:      defaultBufferSize,
+		sndBufSize:      defaultBufferSize,
+		maxRcvShift:     maxWindowScale,
+		reassemblyLimit: defaultReassemblyLimit,
+		challengeLimit:  defaultChallengeACKLimit,
 	}
-	c.timeoutd = timeout.NewDaemon(&c.mu)
+	c.setISS(seq(rand.Uint32()))
+	// the receive buffer is allocated once the other side's SYN is received;
+	// until then, an empty one allows Read to be called before the
+	// connection is established
+	c.incoming = *buffer.NewReadBuffer(0, 0)
+	c.timeoutd.Init(&c.mu)
 	c.readCond.L = &c.mu
 	c.writeCond.L = &c.mu
 	return c
 }
 
-func (conn *Conn) callback(hdr *genericHeader, b []byte) { conn.statefn(conn, hdr, b) }
+// setISS initializes the send sequence space with the given initial
+// sequence number. It must be called before the SYN is sent.
+func (conn *Conn) setISS(iss seq) {
+	conn.iss = iss
+	conn.sndUna = iss
+	conn.sndNxt = iss
+	conn.sndMax = iss
+	conn.recover = iss
+	// the SYN occupies iss, so data starts at iss+1
+	conn.outgoing = *buffer.NewWriteBuffer(conn.sndBufSize, uint32(iss+1))
+}
 
-func (conn *Conn) listen(hdr *genericHeader, b []byte) {
+func newListenConn(output func(hdr *genericHeader, p payload), newCC func(mss int) CongestionControl) *Conn {
+	c := newConn(output, newCC)
+	c.setState(StateListen)
+	return c
+}
+
+// newDialConn creates a new Conn and sends the initial SYN.
+func newDialConn(output func(hdr *genericHeader, p payload), newCC func(mss int) CongestionControl) *Conn {
+	c := newConn(output, newCC)
+	c.dial()
+	return c
+}
+
+// dial moves a new Conn into SYN_SENT and sends the initial SYN.
+func (conn *Conn) dial() {
+	conn.mu.Lock()
+	conn.setState(StateSYNSent)
+	conn.sendSYN()
+	conn.mu.Unlock()
+}
+
+// waitEstablished waits for the handshake started by dial to complete,
+// returning an error if the connection is refused or if the handshake
+// hasn't completed by deadline (if it is non-zero) or before cancel (if it
+// is non-nil) is closed, in which case the connection is closed.
+func (conn *Conn) waitEstablished(deadline time.Time, cancel <-chan struct{}) error {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
-	if !hdr.SYN() {
-		panic("internal error: non-SYN delivered to state LISTEN")
+	if deadline != (time.Time{}) {
+		// borrow the write deadline to wake up at the deadline
+		conn.setWriteDeadline(timeToMonotonic(deadline))
+		defer conn.setWriteDeadline(time.Time{})
 	}
+	canceled := false
+	if cancel != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-cancel:
+				conn.mu.Lock()
+				canceled = true
+				conn.writeCond.Broadcast()
+				conn.mu.Unlock()
+			case <-done:
+			}
+		}()
+	}
+	for conn.state == StateSYNSent || conn.state == StateSYNRcvd {
+		if reachedDeadline(conn.wdeadline) {
+			conn.close()
+			return timeoutErr
+		}
+		if canceled {
+			conn.close()
+			return canceledErr
+		}
+		conn.writeCond.Wait()
+	}
+	if conn.state == StateClosed {
+		return conn.closeReason()
+	}
+	return nil
+}
 
-	conn.incoming = *buffer.NewReadBuffer(1024, hdr.seq+1)
-	// TODO(joshlf)
+// setState sets conn.state and the corresponding conn.statefn.
+func (conn *Conn) setState(s State) {
+	conn.state = s
+	switch s {
+	case StateListen:
+		conn.statefn = (*Conn).listen
+	case StateSYNSent:
+		conn.statefn = (*Conn).synSent
+	case StateClosed:
+		conn.statefn = (*Conn).closed
+	default:
+		conn.statefn = (*Conn).synchronized
+	}
+	if s == StateTimeWait || s == StateClosed {
+		if conn.counted != nil {
+			conn.counted.released()
+			conn.counted = nil
+		}
+		if conn.stateHook != nil {
+			conn.stateHook(conn, s)
+		}
+	}
 }
 
-func (conn *Conn) sendReset(hdr *genericHeader) {
-	// See "Reset Generation," https://tools.ietf.org/html/rfc793#page-36
-	// TODO(joshlf)
+// sending reports whether conn may send data or a FIN in its current state.
+func (conn *Conn) sending() bool {
+	switch conn.state {
+	case StateEstablished, StateCloseWait, StateFINWait1, StateClosing, StateLastACK:
+		return true
+	}
+	return false
 }
 
-// State returns the name of the TCP state that conn is currently in.
-func (conn *Conn) State() string {
+func (conn *Conn) callback(hdr *genericHeader, b []byte) {
 	conn.mu.Lock()
-	str := conn.state.String()
+	conn.statefn(conn, hdr, b)
 	conn.mu.Unlock()
-	return str
+}
+
+// See "If the state is LISTEN," https://tools.ietf.org/html/rfc793#page-65
+func (conn *Conn) listen(hdr *genericHeader, b []byte) {
+	switch {
+	case hdr.RST():
+		return
+	case hdr.ACK():
+		conn.sendReset(hdr, b)
+		return
+	case !hdr.SYN():
+		return
+	}
+
+	conn.passive = true
+	conn.synReceived(hdr)
+	conn.setState(StateSYNRcvd)
+	conn.sendSYN()
+	// TODO(joshlf): Queue any data in the SYN for delivery once
+	// the connection is established
+}
+
+// See "If the state is SYN-SENT," https://tools.ietf.org/html/rfc793#page-66
+func (conn *Conn) synSent(hdr *genericHeader, b []byte) {
+	if hdr.ACK() && (hdr.ack.leq(conn.iss) || hdr.ack.gt(conn.sndMax)) {
+		if !hdr.RST() {
+			conn.sendReset(hdr, b)
+		}
+		return
+	}
+	if hdr.RST() {
+		if hdr.ACK() {
+			// the connection was refused
+			conn.err = errors.ConnRefusedf("tcp")
+			conn.close()
+		}
+		return
+	}
+	if !hdr.SYN() {
+		return
+	}
+
+	conn.synReceived(hdr)
+	if !hdr.ACK() {
+		// Simultaneous open: the other side is also in SYN_SENT,
+		// so its SYN crossed ours. Acknowledge it with a SYN-ACK.
+		// See Figure 8, https://tools.ietf.org/html/rfc793#page-32
+		conn.setState(StateSYNRcvd)
+		conn.sendSYN()
+		return
+	}
+	conn.sndUna = hdr.ack
+	conn.establish(hdr)
+	conn.sendAck()
+}
+
+func (conn *Conn) closed(hdr *genericHeader, b []byte) {
+	if !hdr.RST() {
+		conn.sendReset(hdr, b)
+	}
+}
+
+// synchronized handles segments in all of the synchronized states.
+// See "Otherwise," https://tools.ietf.org/html/rfc793#page-69
+func (conn *Conn) synchronized(hdr *genericHeader, b []byte) {
+	if conn.paws(hdr) {
+		if !hdr.RST() {
+			conn.sendAck()
+		}
+		return
+	}
+	if conn.state == StateSYNRcvd && hdr.SYN() && !hdr.ACK() && hdr.seq == conn.irs {
+		// the other side retransmitted its SYN, so our
+		// SYN-ACK may have been lost; send it again
+		conn.sendSYN()
+		return
+	}
+	if conn.state == StateSYNRcvd && hdr.SYN() && hdr.ACK() && hdr.seq == conn.irs {
+		// In a simultaneous open, the other side's SYN-ACK crosses
+		// ours. We've already received its SYN, so trim it off and
+		// process the rest of the segment; its ACK of our SYN
+		// completes the handshake.
+		trimmed := *hdr
+		trimmed.SetSYN(false)
+		trimmed.seq++
+		hdr = &trimmed
+	}
+	if !conn.acceptable(hdr, b) {
+		if !hdr.RST() {
+			if end := hdr.seq + seq(len(b)); len(b) > 0 && end.leq(conn.rcvNxt) {
+				conn.duplicateReceived(hdr.seq, end)
+			}
+			conn.sendAck()
+		}
+		if conn.state == StateTimeWait && hdr.FIN() {
+			// the other side retransmitted its FIN, so our
+			// ACK of it must have been lost; restart the timer
+			conn.enterTimeWait()
+		}
+		return
+	}
+	if hdr.RST() {
+		conn.handleReset(hdr)
+		return
+	}
+	conn.heard()
+	if hdr.SYN() {
+		// Rather than resetting the connection, which would allow an
+		// attacker who can guess a sequence number in the window to
+		// do so, send a challenge ACK. If the other side really has
+		// restarted, it will reply with a RST at the right sequence
+		// number. See https://tools.ietf.org/html/rfc5961#section-4.2
+		conn.challengeAck()
+		return
+	}
+	if !hdr.ACK() {
+		return
+	}
+	if conn.tsOK && hdr.tsSet && hdr.seq.leq(conn.tsLastAckSent) {
+		// See "Which Timestamp to Echo,"
+		// https://tools.ietf.org/html/rfc7323#section-4.3
+		conn.tsRecent = hdr.tsVal
+		conn.tsRecentAge = timeout.NowMonotonic()
+	}
+
+	if conn.state == StateSYNRcvd {
+		if hdr.ack.leq(conn.sndUna) || hdr.ack.gt(conn.sndMax) {
+			conn.sendReset(hdr, b)
+			return
+		}
+		if conn.listener != nil {
+			ok, reset := conn.listener.established(conn)
+			if reset {
+				// the listener is at its connection limit
+				conn.abortLocked()
+				return
+			}
+			if !ok {
+				// The accept queue is full; drop the ACK and
+				// remain half-open. The other side will send
+				// the ACK again along with its next segment.
+				return
+			}
+			conn.counted = conn.listener
+			conn.listener = nil
+		}
+		conn.establish(hdr)
+	}
+	conn.handleAck(hdr, b)
+	if conn.state == StateClosed {
+		// the ACK completed a LAST_ACK
+		return
+	}
+	conn.handleECN(hdr)
+	conn.handleUrgent(hdr)
+	conn.handleData(hdr, b)
+	conn.captureUrgent()
+	if hdr.FIN() {
+		conn.handleFIN(hdr, b)
+	}
+	conn.transmit()
+}
+
+// synReceived initializes the receive state of conn from the SYN hdr.
+func (conn *Conn) synReceived(hdr *genericHeader) {
+	conn.irs = hdr.seq
+	conn.rcvNxt = hdr.seq + 1
+	conn.rcvUp = conn.rcvNxt
+	conn.incoming = *buffer.NewReadBuffer(conn.rcvBufSize, uint32(conn.rcvNxt))
+	if hdr.mssSet {
+		conn.mss = hdr.mss
+	}
+	if clamp := conn.clampMSS(); clamp > 0 && conn.mss > clamp {
+		conn.mss = clamp
+	}
+	// We always offer timestamps in our SYN, so they're
+	// in use if and only if the other side's SYN has them.
+	conn.tsOK = hdr.tsSet
+	// See https://tools.ietf.org/html/rfc3168#section-6.1.1
+	if hdr.ACK() {
+		// a SYN-ACK agrees to use ECN by setting ECE alone
+		conn.ecnOK = conn.ecn && hdr.ECE() && !hdr.CWR()
+	} else {
+		conn.ecnOK = conn.ecn && hdr.ECE() && hdr.CWR()
+	}
+	if hdr.tsSet {
+		conn.tsRecent = hdr.tsVal
+		conn.tsRecentAge = timeout.NowMonotonic()
+	}
+	conn.sackOK = hdr.sackPermitted
+	// likewise, window scaling is only used if both sides offer it
+	conn.wsOK = hdr.wsSet
+	if hdr.wsSet {
+		conn.sndShift = hdr.wscale
+		if conn.sndShift > maxWindowScale {
+			conn.sndShift = maxWindowScale
+		}
+	} else {
+		conn.rcvShift = 0
+	}
+}
+
+// paws reports whether hdr should be discarded as an old duplicate according
+// to the PAWS test. See https://tools.ietf.org/html/rfc7323#section-5.3
+func (conn *Conn) paws(hdr *genericHeader) bool {
+	if !conn.tsOK || !hdr.tsSet || hdr.RST() {
+		// TODO(joshlf): RFC 7323 says that non-RST segments without
+		// timestamps should be dropped once timestamps are in use,
+		// but we accept them because Postel's Law
+		return false
+	}
+	if timeout.NowMonotonic().Sub(conn.tsRecentAge) > pawsIdleTimeout {
+		// tsRecent is too old to be trusted, since
+		// the peer's timestamp clock may have wrapped
+		return false
+	}
+	// timestamps are compared modulo 2^32, just like sequence numbers
+	return int32(hdr.tsVal-conn.tsRecent) < 0
+}
+
+// tsNow returns the current value of our timestamp clock,
+// which ticks once per millisecond.
+func (conn *Conn) tsNow() uint32 {
+	return uint32(timeout.NowMonotonic().UnixNano()/int64(time.Millisecond)) + conn.tsOffset
+}
+
+// tsRTT returns the round-trip time sample from the timestamp echoed by hdr,
+// an acceptable ACK of new data, or false if it doesn't yield one. The echoed
+// timestamp identifies the segment that triggered the ACK even if it was a
+// retransmission, so unlike with timing, Karn's algorithm doesn't apply.
+// See https://tools.ietf.org/html/rfc7323#section-4.1
+//
+// However, if the other side received the original segment and delayed its
+// ACK until the retransmission arrived, it echoes the timestamp of the
+// retransmission, and the sample underestimates the RTT. So until the
+// retransmitted data has been acknowledged, a sample from the echo of a
+// retransmission is only taken if it is no shorter than the smallest sample
+// taken so far.
+func (conn *Conn) tsRTT(hdr *genericHeader) (time.Duration, bool) {
+	if hdr.tsEcr == 0 {
+		// the other side may not echo a timestamp
+		// until it has received one with an ACK
+		return 0, false
+	}
+	d := int32(conn.tsNow() - hdr.tsEcr)
+	if d < 0 {
+		// we never sent this timestamp
+		return 0, false
+	}
+	rtt := time.Duration(d) * time.Millisecond
+	if rtt == 0 {
+		// below the resolution of the timestamp clock
+		rtt = time.Millisecond
+	}
+	if conn.tsRtxGuard {
+		if hdr.ack.geq(conn.tsRtxEnd) {
+			conn.tsRtxGuard = false
+		}
+		if int32(hdr.tsEcr-conn.tsRtx) >= 0 && rtt < conn.minRTT {
+			return 0, false
+		}
+	}
+	if conn.minRTT == 0 || rtt < conn.minRTT {
+		conn.minRTT = rtt
+	}
+	return rtt, true
+}
+
+// retransmitted records that a segment of data up to sndMax has just been
+// retransmitted for tsRTT and dsackReceived.
+func (conn *Conn) retransmitted() {
+	conn.undoRetrans++
+	if conn.tsOK {
+		conn.tsRtx = conn.tsNow()
+		conn.tsRtxEnd = conn.sndMax
+		conn.tsRtxGuard = true
+	}
+}
+
+// sendMSS returns the maximum amount of data that can
+// be sent in a segment, taking options into account.
+// See https://tools.ietf.org/html/rfc6691
+func (conn *Conn) sendMSS() int {
+	mss := int(conn.mss)
+	if conn.pmtu > 0 && conn.pmtu-conn.overhead < mss {
+		mss = conn.pmtu - conn.overhead
+	}
+	if conn.tsOK {
+		mss -= timestampOptionLen
+	}
+	return mss
+}
+
+// clampMSS returns the MSS clamp: the MSS advertised in our SYN, and the
+// largest MSS we accept from the other side. Unless it has been set
+// explicitly, it is derived from the path MTU. If neither is known, it
+// returns 0, in which case no MSS is advertised.
+func (conn *Conn) clampMSS() uint16 {
+	if conn.mssClamp > 0 {
+		return conn.mssClamp
+	}
+	if conn.pathMTU == nil {
+		return 0
+	}
+	mss := conn.pathMTU() - conn.overhead
+	switch {
+	case mss <= 0:
+		return 0
+	case mss > 0xFFFF:
+		return 0xFFFF
+	}
+	return uint16(mss)
+}
+
+// establish moves conn into state ESTABLISHED in response to hdr.
+func (conn *Conn) establish(hdr *genericHeader) {
+	conn.setState(StateEstablished)
+	conn.sndWnd = conn.sndWindow(hdr)
+	conn.sndWl1 = hdr.seq
+	conn.sndWl2 = hdr.ack
+	conn.synEstablished()
+	conn.cc = conn.newCC(int(conn.mss))
+	conn.setInitialWindow()
+	conn.ecnRecover = conn.iss
+	conn.autoTuneMin = conn.rcvBufSize
+	conn.autoTuneTarget = conn.rcvBufSize
+	conn.rcvSpaceTime = timeout.NowMonotonic()
+	conn.snapshotOptions()
+	conn.restartKeepAlive()
+	if conn.finQueued {
+		// Close was called during the handshake
+		conn.setState(StateFINWait1)
+	}
+	conn.readCond.Broadcast()
+	conn.writeCond.Broadcast()
+}
+
+// close moves conn into state CLOSED, stops its timers,
+// and wakes up any blocked clients.
+func (conn *Conn) close() {
+	if conn.listener != nil {
+		conn.listener.abandoned()
+		conn.listener = nil
+	}
+	conn.stopTimers()
+	conn.setState(StateClosed)
+	conn.timeoutd.Stop()
+	conn.readCond.Broadcast()
+	conn.writeCond.Broadcast()
+}
+
+// stopTimers stops all of conn's protocol timers.
+func (conn *Conn) stopTimers() {
+	conn.stopRetransmitTimer()
+	conn.stopPersistTimer()
+	conn.cancelDelayedAck()
+	conn.stopCorkTimer()
+	conn.stopPaceTimer()
+	conn.stopSYNTimer()
+	conn.stopIdleTimer()
+	conn.stopKeepAliveTimer()
+	conn.stopThroughputTimer()
+	conn.stopFINWait2Timer()
+	if conn.twHandle != nil {
+		conn.twHandle.Cancel()
+		conn.twHandle = nil
+	}
+}
+
+// acceptable implements the segment acceptability test.
+// See https://tools.ietf.org/html/rfc793#page-69
+func (conn *Conn) acceptable(hdr *genericHeader, b []byte) bool {
+	seglen := segLen(hdr, b)
+	wnd := seq(conn.incoming.Cap())
+	inWindow := func(s seq) bool {
+		return conn.rcvNxt.leq(s) && s.lt(conn.rcvNxt+wnd)
+	}
+	switch {
+	case seglen == 0 && wnd == 0:
+		return hdr.seq == conn.rcvNxt
+	case seglen == 0:
+		return inWindow(hdr.seq)
+	case wnd == 0:
+		return false
+	default:
+		return inWindow(hdr.seq) || inWindow(hdr.seq+seglen-1)
+	}
+}
+
+// segLen returns the length of a segment in sequence space,
+// which includes the SYN and FIN flags.
+func segLen(hdr *genericHeader, b []byte) seq {
+	n := seq(len(b))
+	if hdr.SYN() {
+		n++
+	}
+	if hdr.FIN() {
+		n++
+	}
+	return n
+}
+
+// handleAck processes the ACK field of an acceptable segment.
+func (conn *Conn) handleAck(hdr *genericHeader, b []byte) {
+	if hdr.ack.gt(conn.sndMax) {
+		// acknowledges something not yet sent
+		conn.sendAck()
+		return
+	}
+	if hdr.nsack > 0 && conn.sackOK {
+		conn.sacked(hdr)
+	}
+	dup := conn.isDupAck(hdr, b)
+	if dup {
+		conn.handleDupAck()
+	}
+	prevUna := conn.sndUna
+	if hdr.ack.gt(conn.sndUna) {
+		// The SYN and FIN occupy sequence numbers,
+		// but don't occupy space in the buffer.
+		acked := uint32(0)
+		if d := int32(hdr.ack - seq(conn.outgoing.Seq())); d > 0 {
+			acked = uint32(d)
+			if acked > uint32(conn.outgoing.Len()) {
+				acked = uint32(conn.outgoing.Len())
+			}
+		}
+		var rtt time.Duration
+		switch {
+		case conn.tsOK && hdr.tsSet:
+			// Every ACK of new data yields a sample, weighted by the
+			// number expected per round trip: one for every other
+			// full-sized segment in flight, as the other side ACKs
+			// at least that often. See Appendix G,
+			// https://tools.ietf.org/html/rfc7323#appendix-G
+			if sample, ok := conn.tsRTT(hdr); ok {
+				rtt = sample
+				mss2 := 2 * conn.sendMSS()
+				n := (int(conn.sndMax-conn.sndUna) + mss2 - 1) / mss2
+				if n < 1 {
+					n = 1
+				}
+				conn.rtt.sampleWeighted(rtt, n)
+			}
+			conn.rttTiming = false
+		case conn.rttTiming && hdr.ack.geq(conn.rttSeq):
+			rtt = timeout.NowMonotonic().Sub(conn.rttStart)
+			conn.rtt.sample(rtt)
+			conn.rttTiming = false
+		}
+		conn.sndUna = hdr.ack
+		if conn.sndNxt.lt(conn.sndUna) {
+			// the other side received data that we're about to
+			// retransmit after going back to sndUna
+			conn.sndNxt = conn.sndUna
+		}
+		if acked > 0 {
+			conn.outgoing.Advance(int(acked))
+			conn.counters.BytesAcked += uint64(acked)
+			conn.cc.OnAck(acked, rtt)
+			conn.writeCond.Broadcast()
+		}
+		conn.dupAcks = 0
+		conn.trimScoreboard()
+		conn.urgentAcked()
+		if conn.inRecovery {
+			conn.handleRecoveryAck()
+		} else {
+			conn.dragRecover(prevUna)
+		}
+		conn.dragECNRecover(prevUna)
+
+		// See (5.2) and (5.3), https://tools.ietf.org/html/rfc6298#section-5
+		conn.stopRetransmitTimer()
+		if conn.sndUna != conn.sndMax {
+			conn.startRetransmitTimer()
+		}
+	}
+	if conn.frto != frtoOff {
+		conn.frtoAck(hdr, dup, prevUna)
+	}
+	if hdr.nsack > 0 && conn.sackOK {
+		conn.dsackReceived(hdr)
+	}
+
+	if conn.sndWl1.lt(hdr.seq) || (conn.sndWl1 == hdr.seq && conn.sndWl2.leq(hdr.ack)) {
+		wnd := conn.sndWindow(hdr)
+		if wnd == 0 && conn.sndWnd != 0 {
+			conn.counters.ZeroWindows++
+		}
+		conn.sndWnd = wnd
+		conn.sndWl1 = hdr.seq
+		conn.sndWl2 = hdr.ack
+		if conn.sndWnd > 0 {
+			conn.stopPersistTimer()
+			conn.persistInterval = 0
+		}
+	}
+
+	if conn.finAcked() {
+		switch conn.state {
+		case StateFINWait1:
+			conn.setState(StateFINWait2)
+			conn.startFINWait2Timer()
+			// wake up a lingering Close
+			conn.writeCond.Broadcast()
+		case StateClosing:
+			conn.enterTimeWait()
+			conn.writeCond.Broadcast()
+		case StateLastACK:
+			conn.close()
+		}
+	}
+}
+
+// handleData processes the payload of an acceptable segment.
+func (conn *Conn) handleData(hdr *genericHeader, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	switch conn.state {
+	case StateEstablished, StateFINWait1, StateFINWait2:
+	default:
+		return
+	}
+
+	conn.sampleRcvRTT(hdr)
+
+	s := hdr.seq
+	// out-of-order segments are ACKed immediately so that the other side
+	// learns of the hole; see https://tools.ietf.org/html/rfc5681#section-4.2
+	immediate := s != conn.rcvNxt
+	if s.gt(conn.rcvNxt) {
+		conn.counters.OutOfOrderSegs++
+	}
+	if s.lt(conn.rcvNxt) {
+		// trim data we've already received
+		dup := int(conn.rcvNxt - s)
+		if dup >= len(b) {
+			conn.duplicateReceived(s, s+seq(len(b)))
+			conn.sendAck()
+			return
+		}
+		conn.duplicateReceived(s, conn.rcvNxt)
+		b = b[dup:]
+		s = conn.rcvNxt
+	}
+	// trim data that doesn't fit in the window
+	if wnd := conn.incoming.Cap() - int(s-conn.rcvNxt); len(b) > wnd {
+		b = b[:wnd]
+	}
+
+	conn.incoming.Write(b, uint32(s))
+	conn.rcvNxt = seq(conn.incoming.Next())
+	conn.active()
+	conn.incoming.TrimOutOfOrder(conn.reassemblyLimit)
+	if s.gt(conn.rcvNxt) {
+		conn.outOfOrderReceived(s)
+	}
+	if conn.rcvNxt.gt(s + seq(len(b))) {
+		// this segment filled a hole, and data
+		// that had arrived out of order is now
+		// in sequence
+		immediate = true
+	}
+	conn.readCond.Broadcast()
+
+	conn.rcvUnacked += len(b)
+	if immediate || conn.rcvUnacked >= 2*conn.sendMSS() {
+		// ACK at least every second full-sized segment
+		conn.sendAck()
+		return
+	}
+	if conn.ackHandle == nil {
+		conn.ackHandle = conn.timeoutd.AddTimeout(conn.delayedAckTimeout, timeout.NowMonotonic().Add(conn.ackDelay))
+	}
+}
+
+func (conn *Conn) delayedAckTimeout() {
+	conn.ackHandle = nil
+	conn.sendAck()
+}
+
+func (conn *Conn) cancelDelayedAck() {
+	if conn.ackHandle != nil {
+		conn.ackHandle.Cancel()
+		conn.ackHandle = nil
+	}
+}
+
+// transmit sends as much buffered data as the send window
+// and the congestion window allow.
+func (conn *Conn) transmit() {
+	if !conn.sending() {
+		return
+	}
+	conn.checkPathMTU()
+	conn.restartAfterIdle()
+
+	for {
+		wnd := conn.sndWnd
+		if cwnd := conn.frtoWindow(conn.limitedTransmitWindow(conn.cc.CongestionWindow())); cwnd < wnd {
+			wnd = cwnd
+		}
+		inflight := uint32(conn.sndNxt - conn.sndUna)
+		offset := int(conn.sndNxt - seq(conn.outgoing.Seq()))
+		unsent := conn.outgoing.Len() - offset
+		if conn.sndWnd == 0 && inflight == 0 && unsent > 0 && conn.persistHandle == nil {
+			// nothing is in flight, so only a window probe can
+			// tell us when the other side's window reopens
+			conn.startPersistTimer()
+		}
+		if unsent <= 0 && conn.finQueued && conn.sndNxt == conn.sndEnd() {
+			// all data has been sent, but the FIN hasn't
+			// (or it has, but it's being retransmitted)
+			conn.sendFIN()
+			return
+		}
+		if inflight >= wnd || unsent <= 0 {
+			return
+		}
+
+		smss := conn.sendMSS()
+		n := unsent
+		if n > smss {
+			n = smss
+		}
+		urgent := conn.sndUrgent && conn.sndUp.gt(conn.sndNxt)
+		if n < smss && !urgent && conn.corked() {
+			return
+		}
+		if n < smss && inflight > 0 && !conn.noDelay && !urgent {
+			// Nagle's algorithm: don't send a partial segment while
+			// data is unacknowledged (unless it contains urgent data,
+			// which shouldn't wait); see
+			// https://tools.ietf.org/html/rfc896
+			return
+		}
+		if n > int(wnd-inflight) {
+			n = int(wnd - inflight)
+		}
+		if conn.paced() {
+			return
+		}
+		var f flags
+		f.SetACK(true)
+		conn.send(f, conn.sndNxt, conn.sendBufferPayload(conn.sndNxt, n))
+		if conn.sndNxt.lt(conn.sndMax) {
+			conn.counters.SegsRetransmitted++
+			conn.counters.BytesRetransmitted += uint64(n)
+			conn.retransmitted()
+		}
+		if conn.sndNxt == conn.sndMax && !conn.rttTiming {
+			// only time new data; see Karn's algorithm
+			conn.rttTiming = true
+			conn.rttSeq = conn.sndNxt + seq(n)
+			conn.rttStart = timeout.NowMonotonic()
+		}
+		conn.lastSend = timeout.NowMonotonic()
+		conn.paceSent(n)
+		conn.sndNxt += seq(n)
+		if conn.sndNxt.gt(conn.sndMax) {
+			conn.sndMax = conn.sndNxt
+		}
+		conn.cc.OnPacketSent(uint32(n))
+		if conn.rtxHandle == nil {
+			// See (5.1), https://tools.ietf.org/html/rfc6298#section-5
+			conn.startRetransmitTimer()
+		}
+	}
+}
+
+func (conn *Conn) startRetransmitTimer() {
+	conn.rtxHandle = conn.timeoutd.AddTimeout(conn.retransmitTimeout, timeout.NowMonotonic().Add(conn.rtt.rto))
+}
+
+func (conn *Conn) stopRetransmitTimer() {
+	if conn.rtxHandle != nil {
+		conn.rtxHandle.Cancel()
+		conn.rtxHandle = nil
+	}
+}
+
+// retransmitTimeout is called when the retransmission timer expires. All
+// outstanding data is considered lost, and is retransmitted starting at sndUna
+// with a backed-off RTO. See https://tools.ietf.org/html/rfc6298#section-5
+func (conn *Conn) retransmitTimeout() {
+	conn.rtxHandle = nil
+	if conn.sndUna == conn.sndMax || !conn.sending() {
+		return
+	}
+
+	conn.counters.TimeoutRetransmits++
+	conn.lossEpisode()
+	conn.frtoTimeout()
+	conn.rtt.backoff()
+	// the timed segment is about to be retransmitted,
+	// so any sample it produced would be ambiguous
+	conn.rttTiming = false
+	conn.cc.OnLoss(conn.flightSize())
+	// duplicate ACKs of the data we're about to retransmit
+	// shouldn't trigger fast retransmit; see
+	// https://tools.ietf.org/html/rfc6582#section-3.2
+	conn.inRecovery = false
+	conn.dupAcks = 0
+	conn.recover = conn.sndMax
+	conn.clearScoreboard()
+	conn.sndNxt = conn.sndUna
+	conn.transmit()
+	if conn.rtxHandle == nil && conn.persistHandle == nil {
+		conn.startRetransmitTimer()
+	}
+}
+
+func (conn *Conn) startPersistTimer() {
+	if conn.persistInterval == 0 {
+		conn.persistInterval = conn.rtt.rto
+	}
+	conn.persistHandle = conn.timeoutd.AddTimeout(conn.persistTimeout, timeout.NowMonotonic().Add(conn.persistInterval))
+}
+
+func (conn *Conn) stopPersistTimer() {
+	if conn.persistHandle != nil {
+		conn.persistHandle.Cancel()
+		conn.persistHandle = nil
+	}
+}
+
+// persistTimeout is called when the persist timer expires. It sends a window
+// probe consisting of the first unacknowledged byte, and then rearms the timer
+// with exponential backoff.
+func (conn *Conn) persistTimeout() {
+	conn.persistHandle = nil
+	if !conn.sending() {
+		return
+	}
+	offset := int(conn.sndNxt - seq(conn.outgoing.Seq()))
+	if conn.sndWnd != 0 || conn.outgoing.Len()-offset <= 0 {
+		return
+	}
+
+	// The probe is sent without advancing sndNxt; if the other side
+	// accepts the byte, its ACK advances sndUna (and thus sndNxt) past
+	// it, and otherwise it will be sent again as normal data once the
+	// window reopens. It does count towards sndMax so that an ACK
+	// covering it is acceptable.
+	var f flags
+	f.SetACK(true)
+	conn.send(f, conn.sndNxt, conn.sendBufferPayload(conn.sndNxt, 1))
+	if end := conn.sndNxt + 1; end.gt(conn.sndMax) {
+		conn.sndMax = end
+	}
+
+	conn.persistInterval *= 2
+	if conn.persistInterval > conn.rtt.max {
+		conn.persistInterval = conn.rtt.max
+	}
+	conn.startPersistTimer()
+}
+
+// window returns the receive window to advertise.
+func (conn *Conn) window() uint32 {
+	if conn.state == StateSYNSent || conn.state == StateListen {
+		// the receive buffer hasn't been allocated yet
+		return uint32(conn.rcvBufSize)
+	}
+	return uint32(conn.incoming.Cap())
+}
+
+// windowUpdate sends an ACK advertising the new receive window if the window
+// has grown sufficiently since it was prev. Waiting for the window to grow by
+// at least an MSS or half the buffer avoids silly window syndrome.
+// See https://tools.ietf.org/html/rfc1122#page-97
+func (conn *Conn) windowUpdate(prev int) {
+	switch conn.state {
+	case StateEstablished, StateFINWait1, StateFINWait2:
+	default:
+		return
+	}
+	thresh := conn.sendMSS()
+	if half := conn.rcvBufSize / 2; half < thresh {
+		thresh = half
+	}
+	if conn.incoming.Cap()-prev >= thresh || (prev == 0 && conn.incoming.Cap() > 0) {
+		conn.sendAck()
+	}
+}
+
+// send sends a segment with the given flags, sequence number, and payload.
+// If the ACK flag is set, the acknowledgement number is set to conn.rcvNxt,
+// and any pending delayed ACK is canceled since this segment subsumes it.
+func (conn *Conn) send(f flags, s seq, p payload) {
+	conn.counters.SegsSent++
+	var hdr genericHeader
+	hdr.seq = s
+	if f.ACK() {
+		hdr.ack = conn.rcvNxt
+		conn.tsLastAckSent = conn.rcvNxt
+		conn.cancelDelayedAck()
+		conn.rcvUnacked = 0
+	}
+	if conn.tsOK || (f.SYN() && !f.ACK()) {
+		hdr.tsSet = true
+		hdr.tsVal = conn.tsNow()
+		if f.ACK() {
+			hdr.tsEcr = conn.tsRecent
+		}
+	}
+	hdr.flags = f
+	if f.SYN() {
+		if clamp := conn.clampMSS(); clamp > 0 {
+			hdr.mssSet = true
+			hdr.mss = clamp
+		}
+		// we always offer window scaling, but only
+		// accept it if the other side offered it
+		if !f.ACK() || conn.wsOK {
+			hdr.wsSet = true
+			hdr.wscale = conn.rcvShift
+		}
+		// likewise for SACK
+		if !f.ACK() || conn.sackOK {
+			hdr.sackPermitted = true
+		}
+	}
+	if f.ACK() && !f.SYN() {
+		conn.setUrgentPointer(&hdr, s)
+		conn.setECN(&hdr, s, p.Len())
+		conn.setSACK(&hdr)
+	}
+	hdr.window = conn.encodeWindow(f.SYN())
+	conn.output(&hdr, p)
+}
+
+func (conn *Conn) sendAck() {
+	var f flags
+	f.SetACK(true)
+	conn.send(f, conn.sndNxt, payload{})
+}
+
+// sendSYN sends a SYN (or, if a SYN has been received, a SYN-ACK).
+func (conn *Conn) sendSYN() {
+	var f flags
+	f.SetSYN(true)
+	f.SetACK(conn.state == StateSYNRcvd)
+	if conn.ecn {
+		// See https://tools.ietf.org/html/rfc3168#section-6.1.1
+		if f.ACK() {
+			f.SetECE(conn.ecnOK)
+		} else {
+			f.SetECE(true)
+			f.SetCWR(true)
+		}
+	}
+	conn.send(f, conn.iss, payload{})
+	conn.sndNxt = conn.iss + 1
+	conn.sndMax = conn.sndNxt
+	conn.synAttempts++
+	if conn.synAttempts == 1 {
+		conn.synStart = timeout.NowMonotonic()
+	}
+	if conn.synHandle == nil {
+		conn.startSYNTimer()
+	}
+}
+
+func (conn *Conn) startSYNTimer() {
+	conn.synHandle = conn.timeoutd.AddTimeout(conn.synTimeout, timeout.NowMonotonic().Add(conn.rtt.rto))
+}
+
+func (conn *Conn) stopSYNTimer() {
+	if conn.synHandle != nil {
+		conn.synHandle.Cancel()
+		conn.synHandle = nil
+	}
+}
+
+// synTimeout is called when the SYN timer expires. The SYN (or SYN-ACK) is
+// retransmitted with a backed-off RTO, or, if it has already been
+// retransmitted synRetries times, the connection is closed with a timeout
+// error. See https://tools.ietf.org/html/rfc6298#section-5
+func (conn *Conn) synTimeout() {
+	conn.synHandle = nil
+	if conn.state != StateSYNSent && conn.state != StateSYNRcvd {
+		return
+	}
+	if conn.synAttempts > conn.synRetries {
+		conn.err = timeoutErr
+		conn.close()
+		return
+	}
+	conn.rtt.backoff()
+	conn.sendSYN()
+}
+
+// synEstablished stops the SYN timer once the handshake has completed, and
+// initializes the RTO. If the SYN was only sent once, the handshake yields an
+// RTT sample; otherwise, the sample would be ambiguous (see Karn's
+// algorithm), and the RTO is reset to at least 3 seconds.
+// See (5.7), https://tools.ietf.org/html/rfc6298#section-5
+func (conn *Conn) synEstablished() {
+	conn.stopSYNTimer()
+	switch {
+	case conn.synAttempts == 1:
+		conn.rtt.sample(timeout.NowMonotonic().Sub(conn.synStart))
+	case conn.synAttempts > 1 && conn.rtt.rto < synRetransmitRTO:
+		conn.rtt.setRTO(synRetransmitRTO)
+	}
+}
+
+// challengeAck sends a challenge ACK in response to a RST or SYN which might
+// have been forged, unless more than challengeLimit have been sent in the
+// last second, so that an attacker can't use them to flood the other side.
+// See https://tools.ietf.org/html/rfc5961#section-7
+func (conn *Conn) challengeAck() {
+	if conn.challengeLimit > 0 {
+		if now := timeout.NowMonotonic(); now.Sub(conn.challengeStart) >= time.Second {
+			conn.challengeStart = now
+			conn.challengeTokens = conn.challengeLimit
+		}
+		if conn.challengeTokens == 0 {
+			return
+		}
+		conn.challengeTokens--
+	}
+	conn.sendAck()
+}
+
+// sendReset sends a RST in response to the segment hdr.
+func (conn *Conn) sendReset(hdr *genericHeader, b []byte) {
+	conn.output(makeReset(hdr, b), payload{})
+}
+
+// makeReset returns a RST in response to the segment hdr.
+// See "Reset Generation," https://tools.ietf.org/html/rfc793#page-36
+func makeReset(hdr *genericHeader, b []byte) *genericHeader {
+	var rst genericHeader
+	rst.SetRST(true)
+	if hdr.ACK() {
+		rst.seq = hdr.ack
+	} else {
+		rst.SetACK(true)
+		rst.ack = hdr.seq + segLen(hdr, b)
+	}
+	return &rst
+}
+
+// handleReset processes a RST which has passed the acceptability test. Since
+// an attacker who can guess a sequence number in the window could otherwise
+// reset the connection, only a RST at exactly rcvNxt is accepted; any other
+// RST in the window elicits a challenge ACK, to which the other side will
+// reply with a correct RST if it really has lost the connection.
+// See https://tools.ietf.org/html/rfc5961#section-3.2
+func (conn *Conn) handleReset(hdr *genericHeader) {
+	if conn.state == StateTimeWait {
+		// ignore RSTs in TIME_WAIT to avoid TIME_WAIT
+		// assassination; see https://tools.ietf.org/html/rfc1337
+		return
+	}
+	if hdr.seq != conn.rcvNxt {
+		conn.challengeAck()
+		return
+	}
+	// See "If the RST bit is set," https://tools.ietf.org/html/rfc793#page-70
+	switch conn.state {
+	case StateSYNRcvd:
+		if !conn.passive {
+			// we opened the connection actively (a simultaneous
+			// open), so the other side has refused it
+			conn.err = errors.ConnRefusedf("tcp")
+		}
+		// otherwise, the listener forgets about the connection
+	case StateClosing, StateLastACK:
+		// we've already closed, so there's nobody to tell
+	default:
+		conn.err = errors.ConnResetf("tcp")
+	}
+	conn.close()
+}
+
+// State returns the TCP state that conn is currently in.
+func (conn *Conn) State() State {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.state
+}
+
+// Stats is a snapshot of the state of a connection, as returned by
+// (*Conn).Stats. Sequence numbers are absolute (not relative to the
+// initial sequence numbers). See "Send Sequence Space" and "Receive
+// Sequence Space," https://tools.ietf.org/html/rfc793#page-20
+type Stats struct {
+	State State
+
+	SndUna uint32 // oldest unacknowledged sequence number
+	SndNxt uint32 // next sequence number to be sent
+	SndWnd uint32 // send window advertised by the other side
+	RcvNxt uint32 // next sequence number expected
+	RcvWnd uint32 // receive window advertised to the other side
+	// bytes received out of order, waiting for a gap to be filled
+	OutOfOrder int
+
+	// the congestion window, or 0 if the connection
+	// hasn't been established yet
+	CongestionWindow uint32
+	MSS              int // maximum amount of data sent in a segment
+	SRTT             time.Duration
+	RTO              time.Duration
+	// the rate in bytes per second at which transmissions
+	// are paced, or 0 if they aren't; see SetPacing
+	PacingRate uint64
+
+	Counters
+}
+
+// Counters count events over the lifetime of a connection. They are
+// reported by (*Conn).Stats.
+type Counters struct {
+	SegsSent           uint64 // segments sent, including retransmissions and bare ACKs
+	SegsRetransmitted  uint64 // segments of data retransmitted
+	BytesRetransmitted uint64 // bytes of data retransmitted
+	BytesAcked         uint64 // bytes of data acknowledged by the other side
+	BytesRead          uint64 // bytes of data read by the application
+	// retransmissions triggered by duplicate ACKs, or by
+	// partial ACKs during fast recovery
+	FastRetransmits uint64
+	// times the retransmission timer expired, after which
+	// all outstanding data is retransmitted
+	TimeoutRetransmits uint64
+	DupAcksReceived    uint64 // duplicate ACKs received; see isDupAck
+	ZeroWindows        uint64 // times the other side's window closed
+	OutOfOrderSegs     uint64 // segments received beyond the next sequence number expected
+	KeepAliveProbes    uint64 // keepalive probes sent; see SetKeepAlive
+	// retransmission timeouts found to be spurious; see SetFRTO
+	SpuriousTimeouts uint64
+	DSACKsReceived   uint64 // ACKs received reporting duplicate data
+	// fast retransmits and timeouts found to be spurious
+	// because every retransmission was reported by a DSACK
+	SpuriousRecoveries uint64
+}
+
+// Stats returns a snapshot of the current state of conn. It is meant for
+// debugging and monitoring, and has no effect on the connection.
+func (conn *Conn) Stats() Stats {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	st := Stats{
+		State:  conn.state,
+		SndUna: uint32(conn.sndUna),
+		SndNxt: uint32(conn.sndNxt),
+		SndWnd: conn.sndWnd,
+		RcvNxt: uint32(conn.rcvNxt),
+		RcvWnd: uint32(conn.window()),
+		MSS:    conn.sendMSS(),
+		SRTT:   conn.rtt.srtt,
+		RTO:    conn.rtt.rto,
+
+		OutOfOrder: conn.incoming.OutOfOrder(),
+		Counters:   conn.counters,
+	}
+	st.PacingRate = conn.pacingRate()
+	if conn.cc != nil {
+		st.CongestionWindow = conn.cc.CongestionWindow()
+	}
+	return st
+}
+
+// SRTT returns the smoothed round-trip time of the connection,
+// or 0 if no round-trip time has been measured yet.
+func (conn *Conn) SRTT() time.Duration {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.rtt.srtt
+}
+
+// RTO returns the current retransmission timeout of the connection.
+func (conn *Conn) RTO() time.Duration {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.rtt.rto
 }
@@ -0,0 +1,2319 @@
+package tcp
+
+import (
+	"bytes"
+	stderrors "errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net"
+)
+
+type testSegment struct {
+	hdr genericHeader
+	b   []byte
+}
+
+// A testLink captures the segments sent by a Conn so that tests
+// can inspect them and explicitly deliver them to the other side.
+type testLink struct {
+	segs []testSegment
+	mu   sync.Mutex
+}
+
+func (l *testLink) output(hdr *genericHeader, p payload) {
+	l.mu.Lock()
+	l.segs = append(l.segs, testSegment{hdr: *hdr, b: p.Bytes()})
+	l.mu.Unlock()
+}
+
+// take removes and returns all of the segments captured so far.
+func (l *testLink) take() []testSegment {
+	l.mu.Lock()
+	segs := l.segs
+	l.segs = nil
+	l.mu.Unlock()
+	return segs
+}
+
+// wait waits up to a second for at least n segments to be captured,
+// and then removes and returns all of the segments captured so far.
+func (l *testLink) wait(n int) []testSegment {
+	var segs []testSegment
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		segs = append(segs, l.take()...)
+		if len(segs) >= n {
+			break
+		}
+	}
+	return segs
+}
+
+// deliver delivers segs to c.
+func deliver(c *Conn, segs []testSegment) {
+	for _, s := range segs {
+		c.callback(&s.hdr, s.b)
+	}
+}
+
+// dataSegments returns the number of segments in segs which carry data.
+func dataSegments(segs []testSegment) int {
+	var n int
+	for _, s := range segs {
+		if len(s.b) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// newTestConnPair creates a pair of Conns and completes the three-way
+// handshake between them. Segments sent by the client are captured by
+// clink, and segments sent by the server by slink. Both Conns delay
+// ACKs by testACKDelay.
+func newTestConnPair(t *testing.T) (client, server *Conn, clink, slink *testLink) {
+	clink, slink = new(testLink), new(testLink)
+	client = newDialConn(clink.output, nil)
+	server = newListenConn(slink.output, nil)
+	client.ackDelay = testACKDelay
+	server.ackDelay = testACKDelay
+	deliver(server, clink.take()) // SYN
+	deliver(client, slink.take()) // SYN-ACK
+	deliver(server, clink.take()) // ACK
+	if client.State() != StateEstablished || server.State() != StateEstablished {
+		t.Fatalf("handshake failed: client in %v, server in %v", client.State(), server.State())
+	}
+	return client, server, clink, slink
+}
+
+const testACKDelay = 50 * time.Millisecond
+
+func TestNagle(t *testing.T) {
+	const writes = 100
+
+	test := func(noDelay bool, wantFirst, wantSecond int) {
+		client, server, clink, slink := newTestConnPair(t)
+		client.SetNoDelay(noDelay)
+		for i := 0; i < writes; i++ {
+			client.Write([]byte{byte(i)})
+		}
+		segs := clink.take()
+		if n := dataSegments(segs); n != wantFirst {
+			t.Errorf("noDelay=%v: unexpected number of segments before ACK: got %v; want %v", noDelay, n, wantFirst)
+		}
+		// acknowledging the outstanding data should release any
+		// data held back by Nagle (though if only one small segment
+		// was sent, the server will delay its ACK)
+		deliver(server, segs)
+		deliver(client, slink.wait(1))
+		if n := dataSegments(clink.take()); n != wantSecond {
+			t.Errorf("noDelay=%v: unexpected number of segments after ACK: got %v; want %v", noDelay, n, wantSecond)
+		}
+	}
+
+	test(false, 1, 1)
+	test(true, writes, 0)
+}
+
+func TestCork(t *testing.T) {
+	const writes = 10
+
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+	client.SetCork(true)
+	for i := 0; i < writes; i++ {
+		client.Write([]byte{byte(i)})
+	}
+	if n := dataSegments(clink.take()); n != 0 {
+		t.Errorf("unexpected number of segments sent while corked: got %v; want 0", n)
+	}
+	client.SetCork(false)
+	segs := clink.take()
+	if n := dataSegments(segs); n != 1 || len(segs[0].b) != writes {
+		t.Fatalf("unexpected segments after uncorking: got %v data segments; want 1 of %v bytes", n, writes)
+	}
+	deliver(server, segs)
+	deliver(client, slink.wait(1))
+
+	// full-sized segments are sent while corked, and the
+	// rest is sent once it has been held back for maxCorkDelay
+	client.SetCork(true)
+	mss := client.sendMSS()
+	start := time.Now()
+	client.Write(make([]byte, mss+1))
+	if segs := clink.take(); dataSegments(segs) != 1 || len(segs[0].b) != mss {
+		t.Fatalf("expected one full-sized segment to be sent while corked")
+	}
+	segs = clink.wait(1)
+	if dataSegments(segs) != 1 || len(segs[0].b) != 1 {
+		t.Fatalf("expected held back data to be sent after the cork timer expired")
+	}
+	if d := time.Since(start); d < maxCorkDelay {
+		t.Errorf("held back data sent after %v; want at least %v", d, maxCorkDelay)
+	}
+
+	// closing the connection flushes held back data
+	client.Write([]byte{0})
+	if n := dataSegments(clink.take()); n != 0 {
+		t.Errorf("unexpected number of segments sent while corked: got %v; want 0", n)
+	}
+	client.Close()
+	if n := dataSegments(clink.take()); n != 1 {
+		t.Errorf("unexpected number of segments sent after closing: got %v; want 1", n)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	const segs = 10
+	const srtt = 100 * time.Millisecond
+
+	client, _, clink, _ := newTestConnPair(t)
+	client.SetNoDelay(true)
+	mss := client.sendMSS()
+	client.mu.Lock()
+	client.rtt.srtt = srtt
+	cwnd := client.cc.CongestionWindow()
+	client.mu.Unlock()
+	if cwnd < segs*uint32(mss) {
+		t.Fatalf("congestion window too small for test: %v", cwnd)
+	}
+
+	// without pacing, the whole window is sent at once
+	client.Write(make([]byte, segs*mss))
+	if n := dataSegments(clink.take()); n != segs {
+		t.Fatalf("unexpected number of segments sent without pacing: got %v; want %v", n, segs)
+	}
+
+	client, _, clink, _ = newTestConnPair(t)
+	client.SetNoDelay(true)
+	client.SetPacing(true)
+	client.mu.Lock()
+	client.rtt.srtt = srtt
+	client.mu.Unlock()
+	if rate := client.Stats().PacingRate; rate != uint64(cwnd)*10 {
+		t.Errorf("unexpected pacing rate: got %v; want %v", rate, uint64(cwnd)*10)
+	}
+	interval := srtt * time.Duration(mss) / time.Duration(cwnd)
+	start := time.Now()
+	client.Write(make([]byte, segs*mss))
+	if n := dataSegments(clink.take()); n != 1 {
+		t.Errorf("unexpected number of segments sent at once with pacing: got %v; want 1", n)
+	}
+	var sent int
+	for sent < segs-1 && time.Since(start) < 5*time.Second {
+		sent += dataSegments(clink.wait(1))
+	}
+	if sent != segs-1 {
+		t.Fatalf("unexpected number of paced segments sent: got %v; want %v", sent, segs-1)
+	}
+	if d := time.Since(start); d < (segs-1)*interval {
+		t.Errorf("%v segments sent in %v; want at least %v", segs, d, (segs-1)*interval)
+	}
+}
+
+func TestRestartAfterIdle(t *testing.T) {
+	test := func(on bool) {
+		client, server, clink, slink := newTestConnPair(t)
+		client.SetNoDelay(true)
+		client.SetRestartAfterIdle(on)
+		cwnd := func() uint32 {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return client.cc.CongestionWindow()
+		}
+		idle := func() bool {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return client.sndUna == client.sndMax
+		}
+
+		// grow the congestion window beyond the initial window
+		iw := uint32(defaultInitCwnd * client.sendMSS())
+		client.Write(make([]byte, 3*int(iw)))
+		for i := 0; i < 100 && !idle(); i++ {
+			deliver(server, clink.take())
+			deliver(client, slink.wait(1))
+		}
+		grown := cwnd()
+		if !idle() || grown <= iw {
+			t.Fatalf("on=%v: congestion window didn't grow: got %v; initial window is %v", on, grown, iw)
+		}
+
+		client.mu.Lock()
+		client.rtt.rto = 50 * time.Millisecond
+		client.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		client.Write([]byte{0})
+		want := grown
+		if on {
+			want = iw
+		}
+		if got := cwnd(); got != want {
+			t.Errorf("on=%v: unexpected congestion window after idling: got %v; want %v", on, got, want)
+		}
+	}
+
+	test(true)
+	test(false)
+}
+
+func TestDelayedAck(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+
+	// two back-to-back full-sized segments are ACKed immediately
+	client.Write(make([]byte, 2*client.sendMSS()))
+	segs := clink.take()
+	if n := dataSegments(segs); n != 2 {
+		t.Fatalf("unexpected number of data segments: got %v; want 2", n)
+	}
+	deliver(server, segs)
+	acks := slink.take()
+	if len(acks) != 1 {
+		t.Fatalf("unexpected number of ACKs for two full segments: got %v; want 1", len(acks))
+	}
+	if want := segs[1].hdr.seq + seq(len(segs[1].b)); acks[0].hdr.ack != want {
+		t.Errorf("unexpected ACK number: got %v; want %v", acks[0].hdr.ack, want)
+	}
+	deliver(client, acks)
+
+	// a lone segment is ACKed only once the timer expires
+	client.Write([]byte("hello"))
+	start := time.Now()
+	deliver(server, clink.take())
+	if acks := slink.take(); len(acks) != 0 {
+		t.Fatalf("lone segment ACKed immediately")
+	}
+	acks = slink.wait(1)
+	if len(acks) != 1 {
+		t.Fatalf("unexpected number of ACKs for lone segment: got %v; want 1", len(acks))
+	}
+	if d := time.Since(start); d < testACKDelay {
+		t.Errorf("lone segment ACKed after %v; want at least %v", d, testACKDelay)
+	}
+}
+
+// startPump starts a goroutine which continuously delivers segments captured
+// by l to c. The returned function stops the goroutine, and returns once it
+// has quit.
+func startPump(l *testLink, c *Conn) (stop func()) {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			deliver(c, l.take())
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+func TestPersist(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.mu.Lock()
+	client.rtt.min = 10 * time.Millisecond
+	client.rtt.rto = client.rtt.min
+	client.mu.Unlock()
+
+	stopc := startPump(clink, server)
+	defer func() { stopc() }()
+	stops := startPump(slink, client)
+
+	// fill the server's receive buffer so that it advertises a zero window
+	const extra = 10000
+	data := make([]byte, defaultBufferSize+extra)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go client.Write(data)
+	stalled := func() bool {
+		server.mu.Lock()
+		full := server.incoming.Cap() == 0
+		server.mu.Unlock()
+		client.mu.Lock()
+		zero := client.sndWnd == 0 && client.sndUna == client.sndNxt
+		client.mu.Unlock()
+		return full && zero
+	}
+	for start := time.Now(); !stalled(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("zero window never advertised")
+		}
+	}
+	if n := client.Stats().ZeroWindows; n != 1 {
+		t.Errorf("unexpected number of zero windows: got %v; want 1", n)
+	}
+
+	// drain the buffer, but drop the resulting window update
+	// so that only a window probe can restart the flow of data
+	stops()
+	buf := make([]byte, len(data))
+	if n, err := server.Read(buf); n != defaultBufferSize || err != nil {
+		t.Fatalf("unexpected result from Read: (%v, %v); want (%v, <nil>)", n, err, defaultBufferSize)
+	}
+	slink.take()
+	stops = startPump(slink, client)
+	defer func() { stops() }()
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	var n int
+	for n < extra {
+		m, err := server.Read(buf[defaultBufferSize+n:])
+		if err != nil {
+			t.Fatalf("data didn't resume after the window reopened: %v", err)
+		}
+		n += m
+	}
+	for i := range data {
+		if buf[i] != data[i] {
+			t.Fatalf("unexpected byte at offset %v: got %v; want %v", i, buf[i], data[i])
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	const period = 20 * time.Millisecond
+	client.SetKeepAlivePeriod(period)
+	client.SetKeepAlive(true)
+
+	// the client only reads, so it only hears from the server
+	// by probing it, which keeps the connection open
+	stopc := startPump(clink, server)
+	stops := startPump(slink, client)
+	res := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		res <- err
+	}()
+	time.Sleep(20 * period)
+	select {
+	case err := <-res:
+		t.Fatalf("connection closed while the other side was responding: %v", err)
+	default:
+	}
+	if n := client.Stats().KeepAliveProbes; n < 2 {
+		t.Errorf("unexpected number of keepalive probes: got %v; want at least 2", n)
+	}
+	// a probe may be waiting for its ACK
+	for start := time.Now(); !client.IsAlive(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("connection not alive while the other side was responding")
+		}
+	}
+
+	// once the server goes away, the probes go unacknowledged,
+	// and the client eventually closes the connection
+	stopc()
+	stops()
+	select {
+	case err := <-res:
+		if !net.IsTimeout(err) {
+			t.Errorf("unexpected error from read after the other side went away: got %v; want timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection not closed after the other side went away")
+	}
+	if client.IsAlive() {
+		t.Errorf("connection alive after the other side went away")
+	}
+	if n := dataSegments(clink.take()); n != 0 {
+		t.Errorf("unexpected data segments sent by the client: got %v; want 0", n)
+	}
+}
+
+func TestIsAlive(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	const period = 200 * time.Millisecond
+	client.SetKeepAlivePeriod(period)
+	client.SetKeepAlive(true)
+
+	// a probe which has just been sent doesn't make the connection
+	// look dead, and neither does the other side's ACK of it
+	probe := clink.wait(1)
+	if client.Stats().KeepAliveProbes != 1 {
+		t.Fatalf("no keepalive probe sent")
+	}
+	if !client.IsAlive() {
+		t.Errorf("connection not alive while waiting for the ACK of a probe")
+	}
+	deliver(server, probe)
+	deliver(client, slink.take())
+	if !client.IsAlive() {
+		t.Errorf("connection not alive after the ACK of a probe")
+	}
+
+	// but once a probe has gone unanswered for a full period, it does
+	clink.wait(1)
+	if !client.IsAlive() {
+		t.Errorf("connection not alive while waiting for the ACK of a probe")
+	}
+	probe = clink.wait(1)
+	if client.Stats().KeepAliveProbes != 3 {
+		t.Fatalf("no keepalive probe sent after an unanswered one")
+	}
+	if client.IsAlive() {
+		t.Errorf("connection alive after a probe went unanswered")
+	}
+	deliver(server, probe)
+	deliver(client, slink.take())
+	if !client.IsAlive() {
+		t.Errorf("connection not alive after the ACK of a probe")
+	}
+}
+
+func TestTimestampRTT(t *testing.T) {
+	// test sends a segment, drops it, and returns the client's SRTT before
+	// the segment was sent (as sampled from the handshake) and once the
+	// retransmission has been ACKed. If timestamps is false, the client's SYN
+	// is stripped of its timestamp option so that they aren't negotiated.
+	test := func(timestamps bool) (before, after time.Duration) {
+		clink, slink := new(testLink), new(testLink)
+		client := newDialConn(clink.output, nil)
+		server := newListenConn(slink.output, nil)
+		server.ackDelay = testACKDelay
+		syn := clink.take()
+		if !timestamps {
+			syn[0].hdr.tsSet = false
+		}
+		deliver(server, syn)
+		deliver(client, slink.take())
+		deliver(server, clink.take())
+		if client.tsOK != timestamps || server.tsOK != timestamps {
+			t.Fatalf("unexpected timestamp negotiation: got client %v, server %v; want %v", client.tsOK, server.tsOK, timestamps)
+		}
+
+		before = client.SRTT()
+		client.mu.Lock()
+		client.rtt.min = 10 * time.Millisecond
+		client.rtt.rto = client.rtt.min
+		client.mu.Unlock()
+		client.Write([]byte("hello"))
+		clink.take() // lost
+		deliver(server, clink.wait(1))
+		deliver(client, slink.wait(1))
+		return before, client.SRTT()
+	}
+
+	// Karn's algorithm forbids taking a sample from a retransmitted
+	// segment, but with timestamps, the sample is unambiguous
+	if before, after := test(false); after != before {
+		t.Errorf("got RTT sample from retransmitted segment without timestamps: SRTT changed from %v to %v", before, after)
+	}
+	if before, after := test(true); after == before {
+		t.Errorf("got no RTT sample from retransmitted segment with timestamps")
+	}
+}
+
+func TestTimestampRTTEveryACK(t *testing.T) {
+	client, _, clink, _ := newTestConnPair(t)
+	client.SetNoDelay(true)
+	client.mu.Lock()
+	tsVal := client.tsRecent
+	client.mu.Unlock()
+
+	// ack acknowledges everything the client has sent, echoing
+	// a timestamp which the client sent delay ago
+	ack := func(delay time.Duration) {
+		client.mu.Lock()
+		var s testSegment
+		s.hdr.SetACK(true)
+		s.hdr.seq = client.rcvNxt
+		s.hdr.ack = client.sndMax
+		s.hdr.window = 0xFFFF
+		s.hdr.tsSet = true
+		tsVal++
+		s.hdr.tsVal = tsVal
+		s.hdr.tsEcr = client.tsNow() - uint32(delay/time.Millisecond)
+		client.mu.Unlock()
+		deliver(client, []testSegment{s})
+	}
+	// send sends a segment and acknowledges it after delay
+	send := func(delay time.Duration) {
+		client.Write([]byte("a"))
+		clink.take()
+		ack(delay)
+	}
+	within := func(got, want time.Duration) bool {
+		return got > want-5*time.Millisecond && got < want+5*time.Millisecond
+	}
+
+	// with one segment in flight, every ACK is a full-weight
+	// sample, so the estimate tracks the delay within a few
+	// dozen round trips as it changes
+	for _, delay := range []time.Duration{50 * time.Millisecond, 150 * time.Millisecond, 50 * time.Millisecond} {
+		for i := 0; i < 50; i++ {
+			send(delay)
+		}
+		if srtt := client.SRTT(); !within(srtt, delay) {
+			t.Errorf("SRTT doesn't track delay: got %v; want %v", srtt, delay)
+		}
+	}
+
+	// an ACK of a retransmission which echoes its timestamp, but
+	// which arrives sooner than any round trip measured so far, was
+	// triggered by the original segment and yields no sample
+	before := client.SRTT()
+	client.Write([]byte("a"))
+	client.mu.Lock()
+	client.retransmitFirst()
+	client.mu.Unlock()
+	clink.take()
+	ack(0)
+	if srtt := client.SRTT(); srtt != before {
+		t.Errorf("got RTT sample from early ACK of retransmission: SRTT changed from %v to %v", before, srtt)
+	}
+	// but once the retransmission has been acknowledged, shorter
+	// round trips are sampled as usual
+	send(0)
+	if srtt := client.SRTT(); srtt >= before {
+		t.Errorf("got no RTT sample from short round trip: SRTT changed from %v to %v", before, srtt)
+	}
+
+	// an echoed timestamp which was never sent yields no sample
+	before = client.SRTT()
+	send(-time.Second)
+	if srtt := client.SRTT(); srtt != before {
+		t.Errorf("got RTT sample from timestamp in the future: SRTT changed from %v to %v", before, srtt)
+	}
+}
+
+func TestPAWS(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.Write([]byte("a"))
+	segs := clink.take()
+	deliver(server, segs)
+	slink.take()
+	seg := segs[0]
+
+	available := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.incoming.Available()
+	}
+
+	// an old duplicate: the next sequence number,
+	// but with a timestamp older than the last one
+	old := seg
+	old.hdr.seq++
+	old.hdr.tsVal--
+	old.b = []byte("b")
+	deliver(server, []testSegment{old})
+	if n := available(); n != 1 {
+		t.Errorf("segment with old timestamp was accepted")
+	}
+	if acks := slink.take(); len(acks) != 1 {
+		t.Errorf("segment with old timestamp wasn't ACKed")
+	}
+
+	// timestamps are compared modulo 2^32, so a small
+	// timestamp is newer than a large one
+	server.mu.Lock()
+	server.tsRecent = 0xFFFFFFF0
+	server.mu.Unlock()
+	wrapped := old
+	wrapped.hdr.tsVal = 5
+	deliver(server, []testSegment{wrapped})
+	if n := available(); n != 2 {
+		t.Errorf("segment with wrapped timestamp was rejected")
+	}
+	server.mu.Lock()
+	tsRecent := server.tsRecent
+	server.mu.Unlock()
+	if tsRecent != 5 {
+		t.Errorf("unexpected recent timestamp: got %v; want 5", tsRecent)
+	}
+}
+
+func TestFastRetransmit(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+
+	// drop the first of four segments; the server
+	// sends a duplicate ACK for each of the others
+	client.Write(make([]byte, 4*client.sendMSS()))
+	segs := clink.take()
+	if n := dataSegments(segs); n != 4 {
+		t.Fatalf("unexpected number of data segments: got %v; want 4", n)
+	}
+	deliver(server, segs[1:])
+	acks := slink.take()
+	if len(acks) != 3 {
+		t.Fatalf("unexpected number of duplicate ACKs: got %v; want 3", len(acks))
+	}
+
+	for i, ack := range acks {
+		deliver(client, []testSegment{ack})
+		rtx := clink.take()
+		if i < dupAckThreshold-1 {
+			if len(rtx) != 0 {
+				t.Fatalf("retransmitted after %v duplicate ACKs", i+1)
+			}
+			continue
+		}
+		// the RTO is at least a second, so this can
+		// only have been sent by fast retransmit
+		if len(rtx) != 1 || rtx[0].hdr.seq != segs[0].hdr.seq || len(rtx[0].b) != len(segs[0].b) {
+			t.Fatalf("unexpected segments after %v duplicate ACKs: %+v", i+1, rtx)
+		}
+		if !client.inRecovery {
+			t.Fatalf("not in fast recovery after %v duplicate ACKs", i+1)
+		}
+		deliver(server, rtx)
+	}
+
+	// the retransmission fills the hole, and the ACK
+	// of all of the outstanding data ends recovery
+	deliver(client, slink.take())
+	if client.inRecovery {
+		t.Errorf("still in fast recovery after all data was ACKed")
+	}
+	if client.sndUna != client.sndMax {
+		t.Errorf("data still outstanding after recovery: sndUna %v, sndMax %v", client.sndUna, client.sndMax)
+	}
+	cc := client.cc.(*newReno)
+	if cc.cwnd != cc.ssthresh {
+		t.Errorf("unexpected cwnd after recovery: got %v; want ssthresh (%v)", cc.cwnd, cc.ssthresh)
+	}
+
+	cst, sst := client.Stats(), server.Stats()
+	if cst.DupAcksReceived != 3 || cst.FastRetransmits != 1 || cst.SegsRetransmitted != 1 || cst.TimeoutRetransmits != 0 {
+		t.Errorf("unexpected client counters: %+v", cst.Counters)
+	}
+	if sst.OutOfOrderSegs != 3 {
+		t.Errorf("unexpected number of out-of-order segments received: got %v; want 3", sst.OutOfOrderSegs)
+	}
+}
+
+func TestConsecutiveRecoveries(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+	mss := client.sendMSS()
+	cc := client.cc.(*newReno)
+
+	// recover writes n segments, the first of which is lost and recovered
+	// with a fast retransmit, preceded by one which isn't so that the
+	// duplicate ACKs are beyond the previous recovery point. It returns
+	// ssthresh once recovery has begun.
+	recover := func(n int) uint32 {
+		client.mu.Lock()
+		cc.cwnd = uint32(2 * n * mss)
+		client.mu.Unlock()
+		client.Write(make([]byte, mss))
+		deliver(server, clink.take())
+		deliver(client, slink.take())
+
+		client.Write(make([]byte, n*mss))
+		segs := clink.take()
+		if got := dataSegments(segs); got != n {
+			t.Fatalf("unexpected number of data segments: got %v; want %v", got, n)
+		}
+		deliver(server, segs[1:])
+		deliver(client, slink.take())
+		client.mu.Lock()
+		inRecovery, ssthresh := client.inRecovery, cc.ssthresh
+		client.mu.Unlock()
+		if !inRecovery {
+			t.Fatalf("fast recovery not entered")
+		}
+		deliver(server, clink.take())
+		deliver(client, slink.take())
+		if client.inRecovery || client.sndUna != client.sndMax {
+			t.Fatalf("recovery not complete")
+		}
+		return ssthresh
+	}
+
+	// ssthresh is half of the data in flight each time; the
+	// retransmissions of earlier recoveries aren't counted
+	for i := 0; i < 2; i++ {
+		if got, want := recover(8), uint32(4*mss); got != want {
+			t.Errorf("recovery %v: unexpected ssthresh: got %v; want %v", i+1, got, want)
+		}
+	}
+
+	// duplicate ACKs exactly at the previous recovery point don't cover
+	// more than it, so they don't trigger another reduction
+	client.mu.Lock()
+	if client.sndUna != client.recover {
+		t.Fatalf("unexpected recovery point: got %v; want %v", client.recover, client.sndUna)
+	}
+	ssthresh := cc.ssthresh
+	client.mu.Unlock()
+	client.Write(make([]byte, 4*mss))
+	segs := clink.take()
+	deliver(server, segs[1:])
+	deliver(client, slink.take())
+	client.mu.Lock()
+	inRecovery, dupAcks := client.inRecovery, client.dupAcks
+	client.mu.Unlock()
+	if inRecovery || dupAcks != 3 || cc.ssthresh != ssthresh {
+		t.Errorf("unexpected result of duplicate ACKs at recover: in recovery %v, %v duplicate ACKs, ssthresh %v; want false, 3, %v", inRecovery, dupAcks, cc.ssthresh, ssthresh)
+	}
+	if n := dataSegments(clink.take()); n != 0 {
+		t.Errorf("unexpected retransmission of %v segments", n)
+	}
+}
+
+func TestRecoverWraparound(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+	mss := client.sendMSS()
+
+	// as if almost 2^31 bytes had been acknowledged since the last loss;
+	// after the next ACK, recover would be more than 2^31 behind sndUna
+	client.mu.Lock()
+	client.recover = client.sndUna - (1 << 31) + 100
+	client.mu.Unlock()
+	client.Write(make([]byte, 2*mss))
+	deliver(server, clink.take())
+	deliver(client, slink.take())
+
+	client.Write(make([]byte, 4*mss))
+	segs := clink.take()
+	deliver(server, segs[1:])
+	deliver(client, slink.take())
+	if rtx := clink.take(); len(rtx) == 0 || rtx[0].hdr.seq != segs[0].hdr.seq {
+		t.Errorf("first segment not retransmitted after three duplicate ACKs")
+	}
+}
+
+func TestLimitedTransmit(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+	mss := client.sendMSS()
+	client.mu.Lock()
+	cc := client.cc.(*newReno)
+	cc.cwnd = uint32(3 * mss)
+	client.mu.Unlock()
+
+	// with a window of three segments, losing the first
+	// only produces two duplicate ACKs
+	client.Write(make([]byte, 5*mss))
+	segs := clink.take()
+	if n := dataSegments(segs); n != 3 {
+		t.Fatalf("unexpected number of data segments: got %v; want 3", n)
+	}
+	deliver(server, segs[1:])
+	acks := slink.take()
+	if len(acks) != 2 {
+		t.Fatalf("unexpected number of duplicate ACKs: got %v; want 2", len(acks))
+	}
+
+	// each sends a new segment without changing cwnd
+	for i, ack := range acks {
+		deliver(client, []testSegment{ack})
+		sent := clink.take()
+		want := segs[2].hdr.seq + seq((i+1)*mss)
+		if len(sent) != 1 || sent[0].hdr.seq != want || len(sent[0].b) != mss {
+			t.Fatalf("unexpected segments after %v duplicate ACKs: %+v", i+1, sent)
+		}
+		client.mu.Lock()
+		cwnd := cc.cwnd
+		client.mu.Unlock()
+		if cwnd != uint32(3*mss) {
+			t.Fatalf("cwnd changed after %v duplicate ACKs: got %v; want %v", i+1, cwnd, 3*mss)
+		}
+		deliver(server, sent)
+	}
+
+	// which elicits the third duplicate ACK, and thus fast retransmit
+	acks = slink.take()
+	if len(acks) != 2 {
+		t.Fatalf("unexpected number of duplicate ACKs: got %v; want 2", len(acks))
+	}
+	deliver(client, acks[:1])
+	rtx := clink.take()
+	if len(rtx) != 1 || rtx[0].hdr.seq != segs[0].hdr.seq {
+		t.Fatalf("unexpected segments after third duplicate ACK: %+v", rtx)
+	}
+	if st := client.Stats(); st.FastRetransmits != 1 || st.TimeoutRetransmits != 0 {
+		t.Errorf("unexpected client counters: %+v", st.Counters)
+	}
+}
+
+func TestSACK(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+	if !client.sackOK || !server.sackOK {
+		t.Fatalf("SACK not negotiated")
+	}
+
+	// drop the first and third of eight segments
+	client.Write(make([]byte, 8*client.sendMSS()))
+	segs := clink.take()
+	if n := dataSegments(segs); n != 8 {
+		t.Fatalf("unexpected number of data segments: got %v; want 8", n)
+	}
+	block := func(segs ...testSegment) sackBlock {
+		last := segs[len(segs)-1]
+		return sackBlock{segs[0].hdr.seq, last.hdr.seq + seq(len(last.b))}
+	}
+
+	// each ACK reports the block containing the segment which triggered
+	// it first, followed by the other blocks most recently reported
+	var acks []testSegment
+	for _, test := range []struct {
+		seg  int
+		want []sackBlock
+	}{
+		{1, []sackBlock{block(segs[1])}},
+		{3, []sackBlock{block(segs[3]), block(segs[1])}},
+		{4, []sackBlock{block(segs[3], segs[4]), block(segs[1])}},
+		{5, []sackBlock{block(segs[3], segs[5]), block(segs[1])}},
+		{6, []sackBlock{block(segs[3], segs[6]), block(segs[1])}},
+		{7, []sackBlock{block(segs[3], segs[7]), block(segs[1])}},
+	} {
+		deliver(server, segs[test.seg:test.seg+1])
+		ack := slink.take()
+		if len(ack) != 1 {
+			t.Fatalf("unexpected ACKs of segment %v: %+v", test.seg, ack)
+		}
+		if got := ack[0].hdr.sack[:ack[0].hdr.nsack]; !equalBlocks(got, test.want) {
+			t.Errorf("unexpected SACK blocks after segment %v: got %+v; want %+v", test.seg, got, test.want)
+		}
+		acks = append(acks, ack...)
+	}
+
+	// the third duplicate ACK triggers a fast retransmit of the first
+	// segment; by the fourth, three segments above the second hole have
+	// been SACKed, so it is presumed lost and retransmitted too, without
+	// waiting for a partial ACK
+	deliver(client, acks[:3])
+	rtx := clink.take()
+	if len(rtx) != 1 || rtx[0].hdr.seq != segs[0].hdr.seq || len(rtx[0].b) != len(segs[0].b) {
+		t.Fatalf("unexpected segments after three duplicate ACKs: %+v", rtx)
+	}
+	deliver(client, acks[3:4])
+	rtx = append(rtx, clink.take()...)
+	if len(rtx) != 2 || rtx[1].hdr.seq != segs[2].hdr.seq || len(rtx[1].b) != len(segs[2].b) {
+		t.Fatalf("unexpected segments after four duplicate ACKs: %+v", rtx)
+	}
+	// nothing else is missing
+	deliver(client, acks[4:])
+	if segs := clink.take(); len(segs) != 0 {
+		t.Fatalf("unexpected segments after six duplicate ACKs: %+v", segs)
+	}
+
+	// the partial ACK of the first retransmission doesn't trigger
+	// another retransmission of the second hole
+	deliver(server, rtx[:1])
+	ack := slink.take()
+	if len(ack) != 1 || !equalBlocks(ack[0].hdr.sack[:ack[0].hdr.nsack], []sackBlock{block(segs[3], segs[7])}) {
+		t.Fatalf("unexpected ACK of first hole: %+v", ack)
+	}
+	deliver(client, ack)
+	if segs := clink.take(); len(segs) != 0 {
+		t.Fatalf("unexpected segments after partial ACK: %+v", segs)
+	}
+
+	// once the holes are filled, blocks are no longer reported
+	deliver(server, rtx[1:])
+	ack = slink.take()
+	if len(ack) != 1 || ack[0].hdr.nsack != 0 {
+		t.Fatalf("unexpected ACK of second hole: %+v", ack)
+	}
+	deliver(client, ack)
+	if client.inRecovery || client.sndUna != client.sndMax {
+		t.Errorf("unexpected state after both holes were filled: inRecovery %v, sndUna %v, sndMax %v", client.inRecovery, client.sndUna, client.sndMax)
+	}
+	if len(client.scoreboard) != 0 {
+		t.Errorf("scoreboard not empty once everything was acknowledged: %+v", client.scoreboard)
+	}
+	if st := client.Stats(); st.FastRetransmits != 2 || st.SegsRetransmitted != 2 || st.TimeoutRetransmits != 0 {
+		t.Errorf("unexpected client counters: %+v", st.Counters)
+	}
+}
+
+func equalBlocks(a, b []sackBlock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDSACK(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetNoDelay(true)
+	if !client.sackOK || !server.sackOK {
+		t.Fatalf("SACK not negotiated")
+	}
+	client.mu.Lock()
+	cwnd := client.cc.CongestionWindow()
+	client.mu.Unlock()
+
+	// delay the first of four segments; the duplicate
+	// ACKs of the others trigger a fast retransmit
+	client.Write(make([]byte, 4*client.sendMSS()))
+	segs := clink.take()
+	if n := dataSegments(segs); n != 4 {
+		t.Fatalf("unexpected number of data segments: got %v; want 4", n)
+	}
+	deliver(server, segs[1:])
+	deliver(client, slink.take())
+	rtx := clink.take()
+	if len(rtx) != 1 || rtx[0].hdr.seq != segs[0].hdr.seq {
+		t.Fatalf("unexpected segments after duplicate ACKs: %+v", rtx)
+	}
+
+	// the delayed segment arrives, ending recovery
+	// with the congestion window reduced
+	deliver(server, segs[:1])
+	deliver(client, slink.take())
+	client.mu.Lock()
+	reduced := client.cc.CongestionWindow()
+	client.mu.Unlock()
+	if client.inRecovery || reduced >= cwnd {
+		t.Fatalf("unexpected state after recovery: inRecovery %v, cwnd %v", client.inRecovery, reduced)
+	}
+
+	// the retransmission arrives as well, and
+	// the server reports it as a duplicate
+	deliver(server, rtx)
+	acks := slink.take()
+	if len(acks) != 1 || acks[0].hdr.nsack != 1 {
+		t.Fatalf("unexpected ACKs of duplicate segment: %+v", acks)
+	}
+	want := sackBlock{rtx[0].hdr.seq, rtx[0].hdr.seq + seq(len(rtx[0].b))}
+	if got := acks[0].hdr.sack[0]; got != want {
+		t.Errorf("unexpected DSACK block: got %+v; want %+v", got, want)
+	}
+	deliver(client, acks)
+
+	st := client.Stats()
+	if st.DSACKsReceived != 1 || st.SpuriousRecoveries != 1 || st.FastRetransmits != 1 {
+		t.Errorf("unexpected client counters: %+v", st.Counters)
+	}
+	if st.CongestionWindow < cwnd {
+		t.Errorf("congestion window not restored after spurious fast retransmit: got %v; want at least %v", st.CongestionWindow, cwnd)
+	}
+
+	// only the most recent duplicate is reported, and only once
+	deliver(server, rtx)
+	if acks := slink.take(); len(acks) != 1 || acks[0].hdr.nsack != 1 {
+		t.Fatalf("unexpected ACKs of duplicate segment: %+v", acks)
+	}
+	server.mu.Lock()
+	server.sendAck()
+	server.mu.Unlock()
+	if acks := slink.take(); len(acks) != 1 || acks[0].hdr.nsack != 0 {
+		t.Errorf("DSACK reported more than once: %+v", acks)
+	}
+}
+
+func TestFRTO(t *testing.T) {
+	// test sends more than a window of data, and lets the retransmission
+	// timer expire as if the RTT had suddenly increased. The segments turn
+	// out to have been delayed rather than lost; the first four are
+	// delivered, and the ACK of each pair is delivered to the client. It
+	// returns the client, its congestion window before the timeout, the
+	// end of the data sent before the timeout, and the segments it sent
+	// in response to each ACK. If stale is set, the client first acts as
+	// if almost 2^31 bytes had been acknowledged since the last loss.
+	test := func(frto, stale bool) (client *Conn, cwnd uint32, sndMax seq, sent [2][]testSegment) {
+		client, server, clink, slink := newTestConnPair(t)
+		client.SetNoDelay(true)
+		client.SetFRTO(frto)
+		if stale {
+			// after the next ACK, recover would be
+			// more than 2^31 behind sndUna
+			client.mu.Lock()
+			client.recover = client.sndUna - (1 << 31) + 100
+			client.mu.Unlock()
+			client.Write(make([]byte, 2*client.sendMSS()))
+			deliver(server, clink.take())
+			deliver(client, slink.take())
+		}
+		client.mu.Lock()
+		client.rtt.min = 10 * time.Millisecond
+		client.rtt.rto = client.rtt.min
+		cwnd = client.cc.CongestionWindow()
+		mss := client.sendMSS()
+		client.mu.Unlock()
+
+		client.Write(make([]byte, int(cwnd)+4*mss))
+		segs := clink.take()
+		rtx := clink.wait(1)
+		if len(rtx) == 0 || rtx[0].hdr.seq != segs[0].hdr.seq {
+			t.Fatalf("first segment not retransmitted after timeout")
+		}
+		// make sure the timer doesn't expire again
+		client.mu.Lock()
+		sndMax = client.sndMax
+		client.rtt.min, client.rtt.rto = time.Minute, time.Minute
+		client.stopRetransmitTimer()
+		client.startRetransmitTimer()
+		client.mu.Unlock()
+
+		for i := range sent {
+			deliver(server, segs[2*i:2*i+2])
+			deliver(client, slink.take())
+			sent[i] = clink.take()
+		}
+		return client, cwnd, sndMax, sent
+	}
+
+	// with F-RTO, the client sends new data in response to the first ACK,
+	// and the second shows that the timeout was spurious, so the rest of
+	// the data isn't retransmitted, and the congestion window is restored
+	client, cwnd, sndMax, sent := test(true, false)
+	if n := dataSegments(sent[0]); n != 2 {
+		t.Errorf("unexpected number of segments sent after first ACK: got %v; want 2", n)
+	}
+	for _, segs := range sent {
+		for _, s := range segs {
+			if len(s.b) > 0 && s.hdr.seq.lt(sndMax) {
+				t.Errorf("segment at %v retransmitted after spurious timeout", s.hdr.seq)
+			}
+		}
+	}
+	st := client.Stats()
+	if st.SpuriousTimeouts != 1 || st.TimeoutRetransmits != 1 {
+		t.Errorf("unexpected client counters: %+v", st.Counters)
+	}
+	if st.CongestionWindow < cwnd {
+		t.Errorf("congestion window not restored after spurious timeout: got %v; want at least %v", st.CongestionWindow, cwnd)
+	}
+
+	// F-RTO is still used long after the last loss
+	client, _, _, _ = test(true, true)
+	if st := client.Stats(); st.SpuriousTimeouts != 1 {
+		t.Errorf("spurious timeout not detected once recover was more than 2^31 behind sndUna: %+v", st.Counters)
+	}
+
+	// without F-RTO, the client retransmits in slow start
+	client, cwnd, sndMax, sent = test(false, false)
+	if len(sent[0]) == 0 || len(sent[0][0].b) == 0 || !sent[0][0].hdr.seq.lt(sndMax) {
+		t.Errorf("data not retransmitted after first ACK")
+	}
+	st = client.Stats()
+	if st.SpuriousTimeouts != 0 || st.SegsRetransmitted < 2 {
+		t.Errorf("unexpected client counters: %+v", st.Counters)
+	}
+	if st.CongestionWindow >= cwnd {
+		t.Errorf("congestion window not reduced after timeout: got %v; want less than %v", st.CongestionWindow, cwnd)
+	}
+}
+
+func TestSYNRetransmit(t *testing.T) {
+	const rto = 20 * time.Millisecond
+	// newShortRTOConn returns a Conn which sends segments
+	// with l and retransmits its SYN or SYN-ACK after rto
+	newShortRTOConn := func(l *testLink) *Conn {
+		c := newConn(l.output, nil)
+		c.rtt.min = rto
+		c.rtt.rto = rto
+		return c
+	}
+
+	clink, slink := new(testLink), new(testLink)
+	client := newShortRTOConn(clink)
+	server := newShortRTOConn(slink)
+	server.setState(StateListen)
+	start := time.Now()
+	client.dial()
+
+	// drop the first two SYNs; each retransmission backs off
+	clink.take()
+	clink.wait(1)
+	first := time.Since(start)
+	syn := clink.wait(1)
+	second := time.Since(start) - first
+	if len(syn) != 1 || !syn[0].hdr.SYN() {
+		t.Fatalf("unexpected segments instead of retransmitted SYN: %+v", syn)
+	}
+	// allow for the time taken to notice the first retransmission
+	if first < rto || second < 3*rto/2 {
+		t.Errorf("unexpected SYN retransmission intervals: got %v and %v; want about %v and %v", first, second, rto, 2*rto)
+	}
+
+	// drop the SYN-ACK; the server retransmits it
+	deliver(server, syn)
+	slink.take()
+	deliver(client, slink.wait(1))
+	deliver(server, clink.take())
+	if client.State() != StateEstablished || server.State() != StateEstablished {
+		t.Fatalf("handshake failed: client in %v, server in %v", client.State(), server.State())
+	}
+	// the handshake RTT is ambiguous once the SYN is retransmitted
+	if srtt, rto := client.SRTT(), client.RTO(); srtt != 0 || rto != synRetransmitRTO {
+		t.Errorf("unexpected RTT state after SYN retransmission: got SRTT %v, RTO %v; want 0, %v", srtt, rto, synRetransmitRTO)
+	}
+
+	// the handshake yields an RTT sample if the SYN isn't retransmitted
+	if client, _, _, _ := newTestConnPair(t); client.SRTT() == 0 {
+		t.Errorf("no RTT sample from handshake")
+	}
+
+	// give up after synRetries retransmissions
+	clink = new(testLink)
+	client = newShortRTOConn(clink)
+	client.synRetries = 2
+	client.dial()
+	if err := client.waitEstablished(time.Time{}, nil); !net.IsTimeout(err) {
+		t.Errorf("unexpected error from unanswered handshake: got %v; want timeout", err)
+	}
+	if n := len(clink.take()); n != 3 {
+		t.Errorf("unexpected number of SYNs sent: got %v; want 3", n)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	clink := new(testLink)
+	client := newDialConn(clink.output, nil)
+	syn := clink.take()[0]
+
+	var rst testSegment
+	rst.hdr.SetRST(true)
+	rst.hdr.SetACK(true)
+	rst.hdr.ack = syn.hdr.seq + 1
+	deliver(client, []testSegment{rst})
+	if client.State() != StateClosed {
+		t.Fatalf("unexpected state after RST: got %v; want CLOSED", client.State())
+	}
+	if _, err := client.Read(make([]byte, 1)); !net.IsConnRefused(err) {
+		t.Errorf("unexpected error reading from refused connection: got %v; want connection refused", err)
+	}
+	if _, err := client.Write([]byte("a")); !stderrors.Is(err, net.ErrConnRefused) {
+		t.Errorf("unexpected error writing to refused connection: got %v; want connection refused", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server, _, slink := newTestConnPair(t)
+	slink.take()
+
+	server.mu.Lock()
+	var rst testSegment
+	rst.hdr.SetRST(true)
+	rst.hdr.seq = server.rcvNxt
+	server.mu.Unlock()
+	deliver(server, []testSegment{rst})
+	if server.State() != StateClosed {
+		t.Fatalf("unexpected state after RST: got %v; want CLOSED", server.State())
+	}
+	if _, err := server.Read(make([]byte, 1)); !net.IsConnReset(err) {
+		t.Errorf("unexpected error reading from reset connection: got %v; want connection reset", err)
+	}
+	if _, err := server.Write([]byte("a")); !stderrors.Is(err, net.ErrConnReset) {
+		t.Errorf("unexpected error writing to reset connection: got %v; want connection reset", err)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("unexpected error closing reset connection: %v", err)
+	}
+
+	// a connection which is closed without a RST reports no cause
+	client.mu.Lock()
+	client.close()
+	client.mu.Unlock()
+	if _, err := client.Read(make([]byte, 1)); err != closedErr {
+		t.Errorf("unexpected error reading from closed connection: got %v; want %v", err, closedErr)
+	}
+}
+
+func TestDeadlineError(t *testing.T) {
+	client, _, _, _ := newTestConnPair(t)
+	client.SetReadDeadline(time.Now().Add(-time.Second))
+	_, err := client.Read(make([]byte, 1))
+	if !net.IsTimeout(err) || !stderrors.Is(err, net.ErrTimeout) {
+		t.Errorf("unexpected error reading past deadline: got %v; want timeout", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server, clink, _ := newTestConnPair(t)
+	// the server's ACKs aren't delivered, so Nagle's
+	// algorithm would hold back the second write
+	client.SetNoDelay(true)
+
+	read := func() <-chan error {
+		res := make(chan error, 1)
+		go func() {
+			_, err := server.Read(make([]byte, 1))
+			res <- err
+		}()
+		return res
+	}
+	wait := func(res <-chan error) error {
+		select {
+		case err := <-res:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatalf("read did not return")
+			panic("unreachable")
+		}
+	}
+
+	// a blocked read is interrupted by the deadline
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := wait(read()); !net.IsTimeout(err) {
+		t.Errorf("unexpected error from read past deadline: got %v; want timeout", err)
+	}
+
+	// a read which completes before the deadline succeeds
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res := read()
+	client.Write([]byte("a"))
+	deliver(server, clink.wait(1))
+	if err := wait(res); err != nil {
+		t.Errorf("unexpected error from read before deadline: %v", err)
+	}
+
+	// clearing an expired deadline allows reads to succeed again
+	server.SetReadDeadline(time.Now().Add(-time.Second))
+	if err := wait(read()); !net.IsTimeout(err) {
+		t.Errorf("unexpected error from read with deadline in the past: got %v; want timeout", err)
+	}
+	server.SetReadDeadline(time.Time{})
+	res = read()
+	client.Write([]byte("b"))
+	deliver(server, clink.wait(1))
+	if err := wait(res); err != nil {
+		t.Errorf("unexpected error from read after clearing deadline: %v", err)
+	}
+	server.mu.Lock()
+	handle := server.rdhandle
+	server.mu.Unlock()
+	if handle != nil {
+		t.Errorf("timer still armed after clearing deadline")
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	client, _, _, _ := newTestConnPair(t)
+
+	// nothing is acknowledged, so the write blocks once the send buffer fills
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := client.Write(make([]byte, 2*defaultBufferSize))
+	if !net.IsTimeout(err) {
+		t.Errorf("unexpected error from write past deadline: got %v; want timeout", err)
+	}
+	if n != defaultBufferSize {
+		t.Errorf("unexpected number of bytes written: got %v; want %v", n, defaultBufferSize)
+	}
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	defer startPump(clink, server)()
+	defer startPump(slink, client)()
+
+	// the data fills the server's receive buffer, and then the
+	// client's send buffer, with some left over
+	const extra = 10000
+	data := make([]byte, 2*defaultBufferSize+extra)
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := client.Write(data)
+		done <- result{n, err}
+	}()
+	waitFor(t, "zero window", func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.sndWnd == 0 && client.outgoing.Cap() == 0
+	})
+	select {
+	case r := <-done:
+		t.Fatalf("Write returned with the receiver stalled: (%v, %v)", r.n, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// reading reopens the window, which frees space in the
+	// send buffer as the data is acknowledged
+	buf := make([]byte, len(data))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for n := 0; n < len(data); {
+		m, err := server.Read(buf[n:])
+		if err != nil {
+			t.Fatalf("unexpected error reading after %v bytes: %v", n, err)
+		}
+		n += m
+	}
+	select {
+	case r := <-done:
+		if r.n != len(data) || r.err != nil {
+			t.Errorf("unexpected result from Write: (%v, %v); want (%v, <nil>)", r.n, r.err, len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Write still blocked after the window reopened")
+	}
+}
+
+func TestWritev(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+
+	// a header and body are sent in one segment, rather
+	// than the header being sent in a segment of its own
+	hdr, body := []byte("HTTP/1.1 200 OK\r\n\r\n"), []byte("hello")
+	if n, err := client.Writev([][]byte{hdr, nil, body}); n != len(hdr)+len(body) || err != nil {
+		t.Fatalf("unexpected result from Writev: (%v, %v); want (%v, <nil>)", n, err, len(hdr)+len(body))
+	}
+	segs := clink.take()
+	if n := dataSegments(segs); n != 1 {
+		t.Errorf("unexpected number of data segments: got %v; want 1", n)
+	}
+	deliver(server, segs)
+	buf := make([]byte, 64)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != string(hdr)+string(body) {
+		t.Errorf("unexpected read: got %q (err: %v); want %q", buf[:n], err, string(hdr)+string(body))
+	}
+
+	// buffers larger than the send buffer are written in order
+	defer startPump(clink, server)()
+	defer startPump(slink, client)()
+	bufs := [][]byte{hdr, make([]byte, 2*defaultBufferSize), body}
+	for i := range bufs[1] {
+		bufs[1][i] = byte(i)
+	}
+	want := bytes.Join(bufs, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Writev(bufs)
+		done <- err
+	}()
+	got := make([]byte, len(want))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("data not received concatenated in order")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error from Writev: %v", err)
+	}
+	if len(bufs) != 3 || len(bufs[1]) != 2*defaultBufferSize {
+		t.Errorf("Writev modified its argument")
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+
+	if err := client.CloseWrite(); err != nil {
+		t.Fatalf("unexpected error from CloseWrite: %v", err)
+	}
+	if _, err := client.Write([]byte("a")); err == nil {
+		t.Errorf("no error writing after CloseWrite")
+	}
+	if err := client.CloseWrite(); err == nil {
+		t.Errorf("no error from second CloseWrite")
+	}
+	deliver(server, clink.take()) // FIN
+	deliver(client, slink.take()) // ACK of FIN
+	if client.State() != StateFINWait2 || server.State() != StateCloseWait {
+		t.Fatalf("unexpected states after CloseWrite: client %v, server %v", client.State(), server.State())
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("unexpected error reading after FIN: got %v; want %v", err, io.EOF)
+	}
+
+	// the server can still send data, which the client receives
+	if _, err := server.Write([]byte("reply")); err != nil {
+		t.Fatalf("unexpected error writing after peer's CloseWrite: %v", err)
+	}
+	deliver(client, slink.wait(1))
+	buf := make([]byte, 16)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("unexpected read after CloseWrite: got %q (err: %v); want %q", buf[:n], err, "reply")
+	}
+
+	// once the server closes too, the connection closes fully
+	server.Close()
+	deliver(client, slink.wait(1))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Errorf("unexpected error reading after peer's FIN: got %v; want %v", err, io.EOF)
+	}
+	deliver(server, clink.wait(1))
+	if client.State() != StateTimeWait || server.State() != StateClosed {
+		t.Errorf("unexpected states after both sides closed: client %v, server %v", client.State(), server.State())
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("unexpected error from Close after CloseWrite: %v", err)
+	}
+	if _, err := client.Read(buf); err != closedErr {
+		t.Errorf("unexpected error reading after Close: got %v; want %v", err, closedErr)
+	}
+}
+
+func TestFINWait2Timeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	client, server, clink, slink := newTestConnPair(t)
+	client.fw2Timeout = timeout
+
+	// after CloseWrite, the client can still read, so it waits
+	// for the server's FIN indefinitely
+	client.CloseWrite()
+	deliver(server, clink.take()) // FIN
+	deliver(client, slink.take()) // ACK of FIN
+	time.Sleep(2 * timeout)
+	if client.State() != StateFINWait2 {
+		t.Fatalf("unexpected state after CloseWrite: got %v; want FIN_WAIT_2", client.State())
+	}
+
+	// once it's closed, the server's FIN must arrive in time
+	start := time.Now()
+	client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != StateClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection still in %v long after Close", client.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if d := time.Since(start); d < timeout {
+		t.Errorf("FIN_WAIT_2 timed out after %v; want at least %v", d, timeout)
+	}
+	if segs := clink.take(); len(segs) != 1 || !segs[0].hdr.RST() {
+		t.Errorf("unexpected segments after FIN_WAIT_2 timed out: got %+v; want a RST", segs)
+	}
+}
+
+func TestStats(t *testing.T) {
+	check := func(step string, c *Conn, want State) Stats {
+		t.Helper()
+		st := c.Stats()
+		if st.State != want || c.State() != want {
+			t.Errorf("%v: unexpected state: got %v; want %v", step, st.State, want)
+		}
+		return st
+	}
+
+	clink, slink := new(testLink), new(testLink)
+	client := newDialConn(clink.output, nil)
+	server := newListenConn(slink.output, nil)
+	check("listen", server, StateListen)
+	st := check("dial", client, StateSYNSent)
+	if st.SndNxt != st.SndUna+1 || st.CongestionWindow != 0 {
+		t.Errorf("dial: unexpected stats: %+v", st)
+	}
+
+	deliver(server, clink.take()) // SYN
+	check("SYN received", server, StateSYNRcvd)
+	deliver(client, slink.take()) // SYN-ACK
+	check("SYN-ACK received", client, StateEstablished)
+	deliver(server, clink.take()) // ACK
+	check("ACK received", server, StateEstablished)
+
+	client.SetNoDelay(true)
+	client.Write([]byte("hello"))
+	cst := check("write", client, StateEstablished)
+	if cst.SndNxt != cst.SndUna+5 || cst.CongestionWindow == 0 || cst.RcvWnd == 0 || cst.SndWnd == 0 {
+		t.Errorf("write: unexpected client stats: %+v", cst)
+	}
+	deliver(server, clink.take())
+	sst := check("data received", server, StateEstablished)
+	if sst.RcvNxt != cst.SndNxt {
+		t.Errorf("data received: server's RcvNxt is %v; want client's SndNxt %v", sst.RcvNxt, cst.SndNxt)
+	}
+
+	client.Close()
+	check("close", client, StateFINWait1)
+	deliver(server, clink.take()) // FIN
+	check("FIN received", server, StateCloseWait)
+	deliver(client, slink.wait(1)) // ACK
+	check("FIN ACKed", client, StateFINWait2)
+	if st := client.Stats(); st.SndUna != st.SndNxt {
+		t.Errorf("FIN ACKed: data and FIN not acknowledged: %+v", st)
+	}
+	server.Close()
+	check("server close", server, StateLastACK)
+	deliver(client, slink.take()) // FIN
+	check("server FIN received", client, StateTimeWait)
+	deliver(server, clink.take()) // ACK
+	check("server FIN ACKed", server, StateClosed)
+}
+
+func TestStatsRetransmit(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	client.mu.Lock()
+	client.rtt.min = 100 * time.Millisecond
+	client.rtt.rto = client.rtt.min
+	client.mu.Unlock()
+	client.SetNoDelay(true)
+
+	before := client.Stats().Counters
+	client.Write([]byte("hello"))
+	clink.take() // lost
+	deliver(server, clink.wait(1))
+	deliver(client, slink.wait(1))
+
+	st := client.Stats()
+	if st.SndUna != st.SndNxt {
+		t.Fatalf("retransmitted data not acknowledged: %+v", st)
+	}
+	got := st.Counters
+	want := Counters{
+		SegsSent:           before.SegsSent + 2,
+		SegsRetransmitted:  1,
+		BytesRetransmitted: 5,
+		BytesAcked:         5,
+		TimeoutRetransmits: 1,
+	}
+	if got != want {
+		t.Errorf("unexpected counters: got %+v; want %+v", got, want)
+	}
+}
+
+func TestUrgent(t *testing.T) {
+	for _, style := range []UrgentPointerStyle{UrgentPointerBSD, UrgentPointerRFC1122} {
+		client, server, clink, slink := newTestConnPair(t)
+		client.SetUrgentPointerStyle(style)
+		server.SetUrgentPointerStyle(style)
+
+		client.Write([]byte("abc"))
+		client.WriteUrgent([]byte("!"))
+		client.Write([]byte("def"))
+		// the urgent byte isn't held back by Nagle's algorithm,
+		// but the data following it is
+		segs := clink.take()
+		if n := dataSegments(segs); n != 2 {
+			t.Fatalf("style %v: unexpected number of data segments: got %v; want 2", style, n)
+		}
+		urg := segs[len(segs)-1]
+		wantPtr := uint16(1)
+		if style == UrgentPointerRFC1122 {
+			wantPtr = 0
+		}
+		if string(urg.b) != "!" || !urg.hdr.URG() || urg.hdr.urgptr != wantPtr {
+			t.Errorf("style %v: unexpected urgent segment: got %q (URG: %v, pointer: %v); want %q (URG: true, pointer: %v)",
+				style, urg.b, urg.hdr.URG(), urg.hdr.urgptr, "!", wantPtr)
+		}
+		if segs[0].hdr.URG() {
+			t.Errorf("style %v: URG set on segment preceding urgent data", style)
+		}
+		deliver(server, segs)
+		deliver(client, slink.wait(1))
+		segs = clink.take()
+		if n := dataSegments(segs); n != 1 || segs[0].hdr.URG() {
+			t.Errorf("style %v: unexpected segments following urgent data", style)
+		}
+		deliver(server, segs)
+
+		if !server.UrgentPending() {
+			t.Errorf("style %v: urgent data not pending", style)
+		}
+		if b, err := server.ReadUrgent(); b != '!' || err != nil {
+			t.Errorf("style %v: unexpected result from ReadUrgent: (%q, %v); want ('!', <nil>)", style, b, err)
+		}
+		if _, err := server.ReadUrgent(); err != noUrgentErr {
+			t.Errorf("style %v: unexpected error from second ReadUrgent: got %v; want %v", style, err, noUrgentErr)
+		}
+		if server.UrgentPending() {
+			t.Errorf("style %v: urgent data still pending after ReadUrgent", style)
+		}
+
+		// Read stops at the urgent byte, and skips it
+		buf := make([]byte, 16)
+		for _, want := range []string{"abc", "def"} {
+			if server.AtUrgentMark() != (want == "def") {
+				t.Errorf("style %v: unexpected result from AtUrgentMark before reading %q", style, want)
+			}
+			n, err := server.Read(buf)
+			if string(buf[:n]) != want || err != nil {
+				t.Errorf("style %v: unexpected result from Read: (%q, %v); want (%q, <nil>)", style, buf[:n], err, want)
+			}
+		}
+		if server.AtUrgentMark() {
+			t.Errorf("style %v: still at urgent mark after reading past it", style)
+		}
+
+		// once the urgent data is acknowledged, URG is no longer sent
+		deliver(client, slink.wait(1))
+		client.Write([]byte("ghi"))
+		segs = clink.take()
+		for _, s := range segs {
+			if s.hdr.URG() {
+				t.Errorf("style %v: URG set after urgent data was acknowledged", style)
+			}
+		}
+		deliver(server, segs)
+		server.Read(buf)
+
+		// urgent data sent more than 2^31 bytes after the previous mark
+		// isn't mistaken for it
+		server.mu.Lock()
+		server.rcvUp = server.rcvNxt - (1 << 31) - 100
+		server.mu.Unlock()
+		client.WriteUrgent([]byte("?"))
+		deliver(server, clink.take())
+		if b, err := server.ReadUrgent(); b != '?' || err != nil {
+			t.Errorf("style %v: unexpected result from ReadUrgent long after the previous mark: (%q, %v); want ('?', <nil>)", style, b, err)
+		}
+	}
+}
+
+func TestSimultaneousOpen(t *testing.T) {
+	la, lb := new(testLink), new(testLink)
+	a := newDialConn(la.output, nil)
+	b := newDialConn(lb.output, nil)
+	// both SYNs are sent before either is delivered, so they cross
+	stopa := startPump(la, b)
+	defer stopa()
+	stopb := startPump(lb, a)
+	defer stopb()
+
+	deadline := time.Now().Add(time.Second)
+	for _, c := range []*Conn{a, b} {
+		if err := c.waitEstablished(deadline, nil); err != nil {
+			t.Fatalf("unexpected error from handshake: %v", err)
+		}
+		if s := c.State(); s != StateEstablished {
+			t.Fatalf("unexpected state after handshake: got %v; want %v", s, StateEstablished)
+		}
+	}
+
+	a.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := b.Read(buf); string(buf[:n]) != "hello" || err != nil {
+		t.Errorf("unexpected result from Read: (%q, %v); want (%q, <nil>)", buf[:n], err, "hello")
+	}
+}
+
+func TestECN(t *testing.T) {
+	// newECNConnPair is like newTestConnPair, but
+	// the client and server may negotiate ECN
+	newECNConnPair := func(clientECN, serverECN bool) (client, server *Conn, clink, slink *testLink) {
+		clink, slink = new(testLink), new(testLink)
+		client = newConn(clink.output, nil)
+		server = newListenConn(slink.output, nil)
+		client.ecn = clientECN
+		server.ecn = serverECN
+		client.ackDelay = testACKDelay
+		server.ackDelay = testACKDelay
+		client.dial()
+		syn := clink.take()
+		if len(syn) != 1 || syn[0].hdr.ECE() != clientECN || syn[0].hdr.CWR() != clientECN {
+			t.Fatalf("unexpected ECN flags on SYN (ECN: %v): %+v", clientECN, syn)
+		}
+		deliver(server, syn)
+		synack := slink.take()
+		if len(synack) != 1 || synack[0].hdr.ECE() != (clientECN && serverECN) || synack[0].hdr.CWR() {
+			t.Fatalf("unexpected ECN flags on SYN-ACK (ECN: %v, %v): %+v", clientECN, serverECN, synack)
+		}
+		deliver(client, synack)
+		deliver(server, clink.take())
+		if client.State() != StateEstablished || server.State() != StateEstablished {
+			t.Fatalf("handshake failed: client in %v, server in %v", client.State(), server.State())
+		}
+		return client, server, clink, slink
+	}
+
+	for _, tc := range []struct{ client, server bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+		client, server, clink, _ := newECNConnPair(tc.client, tc.server)
+		want := tc.client && tc.server
+		if client.ecnOK != want || server.ecnOK != want {
+			t.Errorf("ECN (%v, %v): unexpected negotiation result: client %v, server %v; want %v",
+				tc.client, tc.server, client.ecnOK, server.ecnOK, want)
+		}
+		client.Write([]byte("foo"))
+		for _, s := range clink.take() {
+			if s.hdr.ect != (want && len(s.b) > 0) {
+				t.Errorf("ECN (%v, %v): unexpected ECT on segment carrying %v bytes: %v", tc.client, tc.server, len(s.b), s.hdr.ect)
+			}
+		}
+	}
+
+	client, server, clink, slink := newECNConnPair(true, true)
+	client.SetNoDelay(true)
+	cc := client.cc.(*newReno)
+	cc.cwnd = 20 * cc.mss
+
+	// a router marks every segment, and the server echoes it
+	client.Write(make([]byte, 20*client.sendMSS()))
+	segs := clink.take()
+	if n := dataSegments(segs); n != 20 {
+		t.Fatalf("unexpected number of data segments: got %v; want 20", n)
+	}
+	for i := range segs {
+		segs[i].hdr.ce = true
+	}
+	deliver(server, segs)
+	acks := slink.take()
+	if len(acks) == 0 {
+		t.Fatalf("no ACKs sent")
+	}
+	for _, ack := range acks {
+		if !ack.hdr.ECE() {
+			t.Fatalf("ECE not set on ACK of segments marked CE")
+		}
+	}
+
+	// the window is halved once, and nothing is retransmitted
+	deliver(client, acks[:1])
+	if flight := client.flightSize(); cc.ssthresh != flight/2 || cc.cwnd != cc.ssthresh {
+		t.Errorf("unexpected window after ECE: got cwnd %v, ssthresh %v; want both %v", cc.cwnd, cc.ssthresh, flight/2)
+	}
+	ssthresh := cc.ssthresh
+	deliver(client, acks[1:])
+	if cc.ssthresh != ssthresh {
+		t.Errorf("window reduced more than once per round trip: ssthresh %v; want %v", cc.ssthresh, ssthresh)
+	}
+	if n := dataSegments(clink.take()); n != 0 {
+		t.Errorf("unexpected number of data segments after ECE: got %v; want 0", n)
+	}
+
+	// the next new data carries CWR, after which the server stops echoing
+	client.Write([]byte("foo"))
+	segs = clink.take()
+	if len(segs) != 1 || !segs[0].hdr.CWR() || !segs[0].hdr.ect {
+		t.Fatalf("unexpected segments after window reduction: %+v", segs)
+	}
+	deliver(server, segs)
+	for _, ack := range slink.wait(1) {
+		if ack.hdr.ECE() {
+			t.Errorf("ECE set after CWR was received")
+		}
+	}
+
+	// as if almost 2^31 bytes had been acknowledged since the window was
+	// last reduced; after the next ACK, ecnRecover would be more than 2^31
+	// behind sndUna, but an ECE is still responded to
+	client, server, clink, slink = newECNConnPair(true, true)
+	client.SetNoDelay(true)
+	mss := client.sendMSS()
+	client.mu.Lock()
+	client.ecnRecover = client.sndUna - (1 << 31) + 100
+	client.mu.Unlock()
+	client.Write(make([]byte, 2*mss))
+	deliver(server, clink.take())
+	deliver(client, slink.take())
+
+	client.Write(make([]byte, 2*mss))
+	segs = clink.take()
+	for i := range segs {
+		segs[i].hdr.ce = true
+	}
+	deliver(server, segs)
+	deliver(client, slink.take())
+	client.mu.Lock()
+	cwrPending := client.cwrPending
+	client.mu.Unlock()
+	if !cwrPending {
+		t.Errorf("ECE ignored once ecnRecover was more than 2^31 behind sndUna")
+	}
+}
+
+func TestLinger(t *testing.T) {
+	data := []byte("unacknowledged")
+
+	// by default, Close returns without waiting for the data
+	client, _, clink, _ := newTestConnPair(t)
+	client.Write(data)
+	if err := client.Close(); err != nil {
+		t.Fatalf("unexpected error from Close: %v", err)
+	}
+	if client.State() != StateFINWait1 {
+		t.Errorf("unexpected state after Close: got %v; want FIN_WAIT_1", client.State())
+	}
+	for _, s := range clink.take() {
+		if s.hdr.RST() {
+			t.Errorf("RST sent by graceful Close")
+		}
+	}
+
+	// with a linger, Close waits for the data and FIN to be acknowledged
+	const fw2Timeout = 50 * time.Millisecond
+	client, server, clink, slink := newTestConnPair(t)
+	client.SetLinger(time.Second)
+	client.fw2Timeout = fw2Timeout
+	client.Write(data)
+	stopc, stops := startPump(clink, server), startPump(slink, client)
+	err := client.Close()
+	stopc()
+	stops()
+	if err != nil {
+		t.Fatalf("unexpected error from lingering Close: %v", err)
+	}
+	if s := client.State(); s != StateFINWait2 {
+		t.Errorf("unexpected state after lingering Close: got %v; want FIN_WAIT_2", s)
+	}
+	buf := make([]byte, 2*len(data))
+	if n, err := server.Read(buf); string(buf[:n]) != string(data) || err != nil {
+		t.Errorf("unexpected result from Read: (%q, %v); want (%q, <nil>)", buf[:n], err, data)
+	}
+	// the server never sends its FIN, so the client doesn't stay in
+	// FIN_WAIT_2 once the linger is over
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != StateClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection still in %v long after lingering Close", client.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// if the linger expires, the connection is aborted
+	const linger = 50 * time.Millisecond
+	client, _, clink, _ = newTestConnPair(t)
+	client.SetLinger(linger)
+	client.Write(data)
+	start := time.Now()
+	err = client.Close()
+	if !net.IsTimeout(err) {
+		t.Errorf("unexpected error from Close after linger expired: got %v; want timeout", err)
+	}
+	if d := time.Since(start); d < linger {
+		t.Errorf("Close returned after %v; want at least %v", d, linger)
+	}
+	if client.State() != StateClosed {
+		t.Errorf("unexpected state after linger expired: got %v; want CLOSED", client.State())
+	}
+	if segs := clink.take(); len(segs) == 0 || !segs[len(segs)-1].hdr.RST() {
+		t.Errorf("RST not sent after linger expired")
+	}
+
+	// with a linger of 0, Close resets the connection immediately
+	client, server, clink, slink = newTestConnPair(t)
+	client.SetLinger(0)
+	client.Write(data)
+	clink.take()
+	if err := client.Close(); err != nil {
+		t.Fatalf("unexpected error from Close with zero linger: %v", err)
+	}
+	segs := clink.take()
+	if len(segs) != 1 || !segs[0].hdr.RST() || len(segs[0].b) != 0 {
+		t.Fatalf("unexpected segments after Close with zero linger: %+v", segs)
+	}
+	// the server never received the data, so the RST is beyond the
+	// sequence number it expects; it sends a challenge ACK, and the
+	// closed client replies with a RST that the server accepts
+	deliver(server, segs)
+	deliver(client, slink.take())
+	deliver(server, clink.take())
+	if _, err := server.Read(buf); !net.IsConnReset(err) {
+		t.Errorf("unexpected error reading from reset connection: got %v; want connection reset", err)
+	}
+}
+
+func TestReadEOF(t *testing.T) {
+	client, server, clink, slink := newTestConnPair(t)
+	defer startPump(clink, server)()
+	defer startPump(slink, client)()
+
+	// a stream which is closed gracefully is read in full, after
+	// which Read returns io.EOF, so io.Copy returns no error
+	data := make([]byte, 3*defaultBufferSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, server); err != nil {
+		t.Fatalf("unexpected error from io.Copy: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("unexpected data: got %v bytes; want %v", buf.Len(), len(data))
+	}
+	if n, err := server.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("unexpected result from Read after EOF: (%v, %v); want (0, %v)", n, err, io.EOF)
+	}
+
+	// data received before a RST can still be read,
+	// after which Read returns the reset error
+	client, server, clink, _ = newTestConnPair(t)
+	client.SetNoDelay(true)
+	client.Write([]byte("abc"))
+	client.abort()
+	deliver(server, clink.take())
+	b := make([]byte, 16)
+	if n, err := server.Read(b); string(b[:n]) != "abc" || err != nil {
+		t.Errorf("unexpected result from Read before RST: (%q, %v); want (%q, <nil>)", b[:n], err, "abc")
+	}
+	if _, err := server.Read(b); err == io.EOF || !net.IsConnReset(err) {
+		t.Errorf("unexpected error from Read after RST: got %v; want connection reset", err)
+	}
+}
+
+func TestReassembly(t *testing.T) {
+	client, server, clink, _ := newTestConnPair(t)
+	client.SetNoDelay(true)
+	smss := client.sendMSS()
+	data := make([]byte, 4*smss)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// readAll reads n bytes from server and checks them against data
+	// starting at offset off
+	readAll := func(off, n int) {
+		buf := make([]byte, n)
+		for got := 0; got < n; {
+			m, err := server.Read(buf[got:])
+			if err != nil {
+				t.Fatalf("unexpected error from Read: %v", err)
+			}
+			got += m
+		}
+		for i, b := range buf {
+			if b != data[off+i] {
+				t.Fatalf("unexpected byte at offset %v: got %v; want %v", off+i, b, data[off+i])
+			}
+		}
+	}
+
+	// segments delivered out of order are read in order
+	client.Write(data[:3*smss])
+	segs := clink.take()
+	if n := dataSegments(segs); n != 3 {
+		t.Fatalf("unexpected number of data segments: got %v; want 3", n)
+	}
+	deliver(server, segs[:1])
+	deliver(server, segs[2:])
+	if st := server.Stats(); st.OutOfOrder != smss {
+		t.Errorf("unexpected number of out-of-order bytes: got %v; want %v", st.OutOfOrder, smss)
+	}
+	deliver(server, segs[1:2])
+	if st := server.Stats(); st.OutOfOrder != 0 {
+		t.Errorf("unexpected number of out-of-order bytes after gap filled: got %v; want 0", st.OutOfOrder)
+	}
+	readAll(0, 3*smss)
+
+	// beyond the limit, the segment furthest out is dropped
+	client, server, clink, _ = newTestConnPair(t)
+	client.SetNoDelay(true)
+	server.SetReassemblyLimit(smss)
+	client.Write(data)
+	segs = clink.take()
+	if n := dataSegments(segs); n != 4 {
+		t.Fatalf("unexpected number of data segments: got %v; want 4", n)
+	}
+	deliver(server, segs[2:3])
+	deliver(server, segs[1:2])
+	if st := server.Stats(); st.OutOfOrder != smss {
+		t.Errorf("unexpected number of out-of-order bytes at limit: got %v; want %v", st.OutOfOrder, smss)
+	}
+	deliver(server, segs[:1])
+	if st := server.Stats(); st.RcvNxt != uint32(segs[2].hdr.seq) {
+		t.Errorf("unexpected RcvNxt after filling gap: got %v; want %v (the dropped segment)", st.RcvNxt, segs[2].hdr.seq)
+	}
+	readAll(0, 2*smss)
+	// the dropped segment is retransmitted
+	deliver(server, segs[2:])
+	readAll(2*smss, 2*smss)
+}
+
+func TestResetStates(t *testing.T) {
+	// rst returns a RST for c at the given offset from rcvNxt
+	rst := func(c *Conn, off int) []testSegment {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var s testSegment
+		s.hdr.SetRST(true)
+		s.hdr.seq = c.rcvNxt + seq(off)
+		return []testSegment{s}
+	}
+
+	// a RST in SYN_SENT must acknowledge our SYN
+	clink := new(testLink)
+	client := newDialConn(clink.output, nil)
+	syn := clink.take()[0]
+	bad := rst(client, 0)
+	bad[0].hdr.SetACK(true)
+	bad[0].hdr.ack = syn.hdr.seq + 2
+	deliver(client, bad)
+	if client.State() != StateSYNSent {
+		t.Errorf("RST with unacceptable ACK closed connection in SYN_SENT")
+	}
+
+	// a RST in SYN_RCVD of a passive open just forgets the connection
+	clink, slink := new(testLink), new(testLink)
+	client = newDialConn(clink.output, nil)
+	server := newListenConn(slink.output, nil)
+	deliver(server, clink.take())
+	deliver(server, rst(server, 0))
+	if server.State() != StateClosed || server.err != nil {
+		t.Errorf("unexpected result of RST in SYN_RCVD: state %v, error %v; want CLOSED, <nil>", server.State(), server.err)
+	}
+
+	for _, test := range []struct {
+		state State
+		setup func(client, server *Conn, clink, slink *testLink) *Conn
+		err   error // the expected error, or nil if closed without one
+	}{
+		{StateEstablished, func(client, server *Conn, clink, slink *testLink) *Conn {
+			return server
+		}, net.ErrConnReset},
+		{StateFINWait1, func(client, server *Conn, clink, slink *testLink) *Conn {
+			client.CloseWrite()
+			return client
+		}, net.ErrConnReset},
+		{StateFINWait2, func(client, server *Conn, clink, slink *testLink) *Conn {
+			client.CloseWrite()
+			deliver(server, clink.take())
+			deliver(client, slink.wait(1))
+			return client
+		}, net.ErrConnReset},
+		{StateCloseWait, func(client, server *Conn, clink, slink *testLink) *Conn {
+			client.CloseWrite()
+			deliver(server, clink.take())
+			return server
+		}, net.ErrConnReset},
+		{StateLastACK, func(client, server *Conn, clink, slink *testLink) *Conn {
+			client.CloseWrite()
+			deliver(server, clink.take())
+			server.CloseWrite()
+			return server
+		}, nil},
+	} {
+		client, server, clink, slink := newTestConnPair(t)
+		c := test.setup(client, server, clink, slink)
+		clink.take()
+		slink.take()
+		link := clink
+		if c == server {
+			link = slink
+		}
+		if s := c.State(); s != test.state {
+			t.Fatalf("unexpected state: got %v; want %v", s, test.state)
+		}
+
+		// an out-of-window RST is dropped silently, and an in-window
+		// RST at the wrong sequence number elicits a challenge ACK
+		deliver(c, rst(c, defaultBufferSize+1))
+		if segs := link.take(); len(segs) != 0 || c.State() != test.state {
+			t.Errorf("%v: out-of-window RST not ignored: %v response segments, state %v", test.state, len(segs), c.State())
+		}
+		deliver(c, rst(c, 1))
+		if segs := link.take(); len(segs) != 1 || !segs[0].hdr.ACK() || segs[0].hdr.RST() || c.State() != test.state {
+			t.Errorf("%v: unexpected response to in-window RST: %+v, state %v", test.state, segs, c.State())
+		}
+
+		deliver(c, rst(c, 0))
+		if c.State() != StateClosed {
+			t.Errorf("%v: unexpected state after RST: got %v; want CLOSED", test.state, c.State())
+		}
+		if test.err == nil && c.err != nil || test.err != nil && !stderrors.Is(c.err, test.err) {
+			t.Errorf("%v: unexpected error after RST: got %v; want %v", test.state, c.err, test.err)
+		}
+		// closing a reset connection still succeeds
+		if err := c.Close(); err != nil {
+			t.Errorf("%v: unexpected error from Close after RST: %v", test.state, err)
+		}
+		if err := c.Close(); err != closedErr {
+			t.Errorf("%v: unexpected error from second Close: got %v; want %v", test.state, err, closedErr)
+		}
+	}
+
+	// a RST in TIME_WAIT is ignored; see RFC 1337
+	client, server, clink, slink = newTestConnPair(t)
+	client.CloseWrite()
+	deliver(server, clink.take())
+	server.CloseWrite()
+	deliver(client, slink.take())
+	if client.State() != StateTimeWait {
+		t.Fatalf("unexpected state: got %v; want TIME_WAIT", client.State())
+	}
+	deliver(client, rst(client, 0))
+	if client.State() != StateTimeWait {
+		t.Errorf("RST closed connection in TIME_WAIT")
+	}
+}
+
+func TestChallengeACK(t *testing.T) {
+	_, server, _, slink := newTestConnPair(t)
+	slink.take()
+
+	server.mu.Lock()
+	rcvNxt := server.rcvNxt
+	server.mu.Unlock()
+	var rst, syn testSegment
+	rst.hdr.SetRST(true)
+	rst.hdr.seq = rcvNxt + 100
+	syn.hdr.SetSYN(true)
+	syn.hdr.seq = rcvNxt + 100
+
+	// an in-window SYN or off-sequence RST elicits
+	// a challenge ACK without affecting the connection
+	for _, seg := range []testSegment{rst, syn} {
+		deliver(server, []testSegment{seg})
+		acks := slink.take()
+		if len(acks) != 1 || !acks[0].hdr.ACK() || acks[0].hdr.RST() || acks[0].hdr.ack != rcvNxt {
+			t.Errorf("unexpected response to RST: %v, SYN: %v: %+v", seg.hdr.RST(), seg.hdr.SYN(), acks)
+		}
+		if server.State() != StateEstablished {
+			t.Fatalf("unexpected state after RST: %v, SYN: %v: got %v; want ESTABLISHED", seg.hdr.RST(), seg.hdr.SYN(), server.State())
+		}
+	}
+
+	// challenge ACKs are rate limited
+	const limit = 3
+	server.SetChallengeACKLimit(limit)
+	server.mu.Lock()
+	server.challengeStart = time.Time{}
+	server.mu.Unlock()
+	for i := 0; i < 2*limit; i++ {
+		deliver(server, []testSegment{rst})
+	}
+	if n := len(slink.take()); n != limit {
+		t.Errorf("unexpected number of challenge ACKs: got %v; want %v", n, limit)
+	}
+	// once a second has passed, more are allowed
+	server.mu.Lock()
+	server.challengeStart = server.challengeStart.Add(-time.Second)
+	server.mu.Unlock()
+	deliver(server, []testSegment{rst})
+	if n := len(slink.take()); n != 1 {
+		t.Errorf("unexpected number of challenge ACKs after a second: got %v; want 1", n)
+	}
+	if server.State() != StateEstablished {
+		t.Errorf("unexpected state after challenge ACKs: got %v; want ESTABLISHED", server.State())
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	const big = 1 << 20
+	clink, slink := new(testLink), new(testLink)
+	client := newConn(clink.output, nil)
+	server := newListenConn(slink.output, nil)
+	client.SetReadBuffer(big)
+	server.SetReadBuffer(big)
+	client.dial()
+	syn := clink.take()
+	if len(syn) != 1 || !syn[0].hdr.wsSet || syn[0].hdr.wscale != 5 || syn[0].hdr.window != 0xFFFF {
+		t.Fatalf("unexpected SYN: %+v", syn)
+	}
+	deliver(server, syn)
+	deliver(client, slink.take())
+	deliver(server, clink.take())
+	if client.State() != StateEstablished || server.State() != StateEstablished {
+		t.Fatalf("handshake failed: client in %v, server in %v", client.State(), server.State())
+	}
+
+	// the large receive buffer is advertised using the window scale
+	if wnd := server.Stats().SndWnd; wnd <= 0xFFFF || wnd > big || big-wnd >= 1<<5 {
+		t.Errorf("unexpected scaled window: got %v; want about %v", wnd, big)
+	}
+	// but once the window scale is fixed, the buffer can't grow beyond it
+	client.SetReadBuffer(2 * big)
+	if wnd := client.Stats().RcvWnd; wnd != 0xFFFF<<5 {
+		t.Errorf("unexpected window after growing buffer: got %v; want %v", wnd, 0xFFFF<<5)
+	}
+
+	// shrinking the buffer preserves the data in it
+	client.SetNoDelay(true)
+	data := make([]byte, 3*client.sendMSS())
+	for i := range data {
+		data[i] = byte(i)
+	}
+	client.Write(data)
+	deliver(server, clink.take())
+	server.SetReadBuffer(0)
+	buf := make([]byte, len(data))
+	if n, _ := server.Read(buf); n != len(data) || !bytes.Equal(buf, data) {
+		t.Errorf("data lost after shrinking the receive buffer")
+	}
+	if wnd := server.Stats().RcvWnd; wnd != minBufferSize {
+		t.Errorf("unexpected window after shrinking the buffer: got %v; want %v", wnd, minBufferSize)
+	}
+
+	// Write blocks once the send buffer is full, and
+	// resumes once it has grown to make room
+	client, _, _, _ = newTestConnPair(t)
+	client.SetWriteBuffer(4096)
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := client.Write(make([]byte, 3*4096))
+	if n != 4096 || !net.IsTimeout(err) {
+		t.Errorf("unexpected result of writing beyond the send buffer: (%v, %v); want (4096, timeout)", n, err)
+	}
+	client.SetWriteDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		client.Write(make([]byte, 2*4096))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client.SetWriteBuffer(3 * 4096)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Write still blocked after growing the send buffer")
+	}
+}
+
+func TestAutoTuning(t *testing.T) {
+	const max = 1 << 20
+	clink, slink := new(testLink), new(testLink)
+	client := newConn(clink.output, nil)
+	server := newListenConn(slink.output, nil)
+	server.SetReadBufferAutoTuning(max)
+	client.SetWriteBuffer(max)
+	client.SetNoDelay(true)
+	client.dial()
+	deliver(server, clink.take())
+	deliver(client, slink.take())
+	deliver(server, clink.take())
+	if client.State() != StateEstablished || server.State() != StateEstablished {
+		t.Fatalf("handshake failed: client in %v, server in %v", client.State(), server.State())
+	}
+	rcvBufSize := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.rcvBufSize
+	}
+	if n := rcvBufSize(); n != defaultBufferSize {
+		t.Fatalf("unexpected initial receive buffer size: got %v; want %v", n, defaultBufferSize)
+	}
+	// the window scale leaves room to grow
+	if client.sndShift != windowShift(max) {
+		t.Fatalf("unexpected window scale: got %v; want %v", client.sndShift, windowShift(max))
+	}
+	// only the window limits the sender
+	client.mu.Lock()
+	client.cc.(*newReno).cwnd = 1 << 30
+	client.mu.Unlock()
+
+	stopc, stops := startPump(clink, server), startPump(slink, client)
+	defer func() {
+		stopc()
+		stops()
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			client.Write(buf)
+		}
+	}()
+
+	// the application reads as fast as data arrives, so
+	// the window is what limits throughput, and it grows
+	buf := make([]byte, 1<<16)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for rcvBufSize() < max {
+		if _, err := server.Read(buf); err != nil {
+			t.Fatalf("receive buffer didn't grow to %v (stuck at %v): %v", max, rcvBufSize(), err)
+		}
+	}
+	if n := rcvBufSize(); n != max {
+		t.Errorf("unexpected receive buffer size: got %v; want %v", n, max)
+	}
+}
@@ -0,0 +1,57 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// maxCorkDelay bounds how long a corked connection holds back a partial
+// segment, as with Linux's TCP_CORK.
+const maxCorkDelay = 200 * time.Millisecond
+
+// SetCork controls whether the connection is corked. While it is corked,
+// only full-sized segments are sent, and the rest of the data written is held
+// back until more is written to fill a segment, the connection is uncorked or
+// closed, or the data has been held back for 200ms. This allows an
+// application which writes a message in several pieces to have them sent in
+// as few segments as possible, regardless of whether data is outstanding
+// (unlike Nagle's algorithm; see SetNoDelay). Uncorking the connection sends
+// any data held back immediately.
+func (c *Conn) SetCork(cork bool) {
+	c.mu.Lock()
+	c.cork = cork
+	if !cork {
+		c.stopCorkTimer()
+		c.transmit()
+	}
+	c.mu.Unlock()
+}
+
+// corked reports whether a partial segment should be held back because the
+// connection is corked, starting the cork timer if it isn't already running.
+func (conn *Conn) corked() bool {
+	if !conn.cork || conn.corkFlush || conn.finQueued {
+		return false
+	}
+	if conn.corkHandle == nil {
+		conn.corkHandle = conn.timeoutd.AddTimeout(conn.corkTimeout, timeout.NowMonotonic().Add(maxCorkDelay))
+	}
+	return true
+}
+
+// corkTimeout is called when a partial segment has been held back for
+// maxCorkDelay, and sends it.
+func (conn *Conn) corkTimeout() {
+	conn.corkHandle = nil
+	conn.corkFlush = true
+	conn.transmit()
+	conn.corkFlush = false
+}
+
+func (conn *Conn) stopCorkTimer() {
+	if conn.corkHandle != nil {
+		conn.corkHandle.Cancel()
+		conn.corkHandle = nil
+	}
+}
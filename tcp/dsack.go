@@ -0,0 +1,62 @@
+package tcp
+
+// duplicateReceived records that the data in [start, end) was received again
+// so that the next ACK reports it as a DSACK. Only the most recent duplicate
+// is reported. See https://tools.ietf.org/html/rfc2883#section-4
+func (conn *Conn) duplicateReceived(start, end seq) {
+	if !conn.sackOK || start == end {
+		return
+	}
+	conn.dsack = sackBlock{start, end}
+	conn.dsackSet = true
+}
+
+// lossEpisode is called when a fast retransmit or retransmission timeout
+// begins a new loss episode, before anything is retransmitted. If every
+// segment retransmitted during the episode is later reported by a DSACK,
+// nothing was lost, and the congestion control response is undone.
+// See https://tools.ietf.org/html/rfc3708
+func (conn *Conn) lossEpisode() {
+	// DSACKs for segments retransmitted during an earlier episode which
+	// hasn't been undone can't be told apart from those for this one
+	conn.undoActive = conn.sackOK && !(conn.undoActive && conn.undoRetrans > 0)
+	conn.undoRetrans = 0
+	conn.undoEnd = conn.sndMax
+}
+
+// isDSACK reports whether the first SACK block of hdr reports a duplicate,
+// which it does if it lies below the cumulative ACK or within the second
+// block. See https://tools.ietf.org/html/rfc2883#section-4.1
+func isDSACK(hdr *genericHeader) bool {
+	blk := hdr.sack[0]
+	return hdr.nsack > 0 && (blk.start.lt(hdr.ack) ||
+		(hdr.nsack > 1 && hdr.sack[1].start.leq(blk.start) && blk.end.leq(hdr.sack[1].end)))
+}
+
+// dsackReceived processes a DSACK in the ACK hdr,
+// once it has been processed as usual.
+func (conn *Conn) dsackReceived(hdr *genericHeader) {
+	if !isDSACK(hdr) {
+		return
+	}
+	blk := hdr.sack[0]
+	conn.counters.DSACKsReceived++
+	if !conn.undoActive || conn.undoRetrans == 0 || blk.end.gt(conn.undoEnd) {
+		return
+	}
+	conn.undoRetrans--
+	if conn.undoRetrans > 0 {
+		return
+	}
+
+	// every retransmission was unnecessary
+	conn.undoActive = false
+	conn.counters.SpuriousRecoveries++
+	if conn.inRecovery {
+		conn.inRecovery = false
+		conn.cc.(FastRecovery).ExitRecovery()
+	}
+	if u, ok := conn.cc.(LossUndoer); ok {
+		u.UndoLoss(conn.flightSize())
+	}
+}
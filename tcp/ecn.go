@@ -0,0 +1,63 @@
+package tcp
+
+// setECN sets the ECN state of hdr, a non-SYN segment starting at s and
+// carrying b.
+func (conn *Conn) setECN(hdr *genericHeader, s seq, n int) {
+	if !conn.ecnOK {
+		return
+	}
+	if conn.ecnEcho {
+		hdr.SetECE(true)
+	}
+	// Only new data is sent ECN-capable; pure ACKs, retransmissions,
+	// and window probes aren't, since their loss isn't a congestion
+	// signal that the congestion window would respond to.
+	// See https://tools.ietf.org/html/rfc3168#section-6.1.4
+	_, ok := conn.cc.(ECNCongestionControl)
+	if !ok || n == 0 || s.lt(conn.sndMax) || conn.sndWnd == 0 {
+		return
+	}
+	hdr.ect = true
+	if conn.cwrPending {
+		// tell the other side that we've reduced the window
+		hdr.SetCWR(true)
+		conn.cwrPending = false
+	}
+}
+
+// handleECN processes the ECN state of an acceptable segment. As the
+// receiver, a congestion experienced mark is echoed in the ECE flag of every
+// segment we send until the other side sets CWR. As the sender, the window is
+// reduced in response to ECE at most once per round trip.
+// See https://tools.ietf.org/html/rfc3168#section-6.1.2
+func (conn *Conn) handleECN(hdr *genericHeader) {
+	if !conn.ecnOK {
+		return
+	}
+	if hdr.CWR() {
+		conn.ecnEcho = false
+	}
+	if hdr.ce {
+		conn.ecnEcho = true
+	}
+
+	ecc, ok := conn.cc.(ECNCongestionControl)
+	if !ok || !hdr.ECE() || conn.inRecovery || !conn.sndUna.gt(conn.ecnRecover) {
+		// a loss is already being responded to, or the ECE
+		// refers to data sent before the window was last reduced
+		return
+	}
+	ecc.OnECE(conn.flightSize())
+	conn.ecnRecover = conn.sndMax
+	conn.cwrPending = true
+}
+
+// dragECNRecover is called when an ACK advances sndUna from prevUna. Like
+// dragRecover, once ecnRecover has been reached, it is moved up to just behind
+// sndUna so that comparisons against it don't wrap around after 2^31 bytes
+// have been acknowledged without a congestion mark.
+func (conn *Conn) dragECNRecover(prevUna seq) {
+	if prevUna.geq(conn.ecnRecover) {
+		conn.ecnRecover = conn.sndUna - 1
+	}
+}
@@ -0,0 +1,104 @@
+package tcp
+
+// the states of F-RTO; see https://tools.ietf.org/html/rfc5682#section-2.1
+const (
+	// not detecting whether a retransmission timeout was spurious
+	frtoOff = iota
+	// the first unacknowledged segment has been retransmitted after a
+	// timeout; waiting for the first ACK
+	frtoFirstAck
+	// new data has been sent in response to the first ACK;
+	// waiting for the second
+	frtoSecondAck
+)
+
+// SetFRTO controls whether c uses F-RTO to detect spurious retransmission
+// timeouts, which occur when the round-trip time suddenly increases (as is
+// common on wireless links) even though nothing has been lost. After a
+// timeout, c retransmits the first unacknowledged segment, but then sends new
+// data rather than retransmitting the rest. If the ACKs which follow
+// acknowledge data which wasn't retransmitted, the timeout was spurious, so
+// nothing else is retransmitted, and, if c's CongestionControl implements
+// LossUndoer, the congestion window is restored. It is on by default.
+// See https://tools.ietf.org/html/rfc5682
+func (c *Conn) SetFRTO(on bool) {
+	c.mu.Lock()
+	c.frtoEnabled = on
+	if !on {
+		c.frto = frtoOff
+	}
+	c.mu.Unlock()
+}
+
+// frtoTimeout is called when the retransmission timer expires, before
+// recovery state is reset, and starts F-RTO if possible. F-RTO isn't used if
+// the timeout occurred during fast recovery, or before the data outstanding
+// at a previous timeout has been acknowledged.
+func (conn *Conn) frtoTimeout() {
+	if !conn.frtoEnabled || conn.frto != frtoOff || conn.inRecovery || conn.sndUna.lt(conn.recover) {
+		conn.frto = frtoOff
+		return
+	}
+	conn.frto = frtoFirstAck
+}
+
+// frtoAck processes an ACK received during F-RTO, once it has been processed
+// as usual. dup is whether it was a duplicate ACK, and prevUna is sndUna
+// before it was processed. Any ACK which doesn't show that the timeout was
+// spurious ends F-RTO, and conventional recovery continues, retransmitting
+// the outstanding data in slow start.
+func (conn *Conn) frtoAck(hdr *genericHeader, dup bool, prevUna seq) {
+	advanced := hdr.ack.gt(prevUna)
+	if !dup && !advanced {
+		// for example, a window update
+		return
+	}
+	switch conn.frto {
+	case frtoFirstAck:
+		// See step 2, https://tools.ietf.org/html/rfc5682#section-2.1
+		if dup || conn.sndUna.geq(conn.recover) {
+			conn.frto = frtoOff
+			return
+		}
+		unsent := conn.outgoing.Len() - int(conn.sndMax-seq(conn.outgoing.Seq()))
+		if unsent <= 0 || uint32(conn.sndMax-conn.sndUna) >= conn.sndWnd {
+			// we can't send new data to probe with
+			conn.frto = frtoOff
+			return
+		}
+		// send up to two new segments regardless of the
+		// congestion window (see frtoLimit) rather than
+		// retransmitting what follows
+		conn.sndNxt = conn.sndMax
+		conn.frtoLimit = conn.sndMax + seq(2*conn.sendMSS())
+		conn.frto = frtoSecondAck
+	case frtoSecondAck:
+		// See step 3, https://tools.ietf.org/html/rfc5682#section-2.1
+		conn.frto = frtoOff
+		if dup {
+			// go back and retransmit in slow start
+			conn.recover = conn.sndMax
+			conn.sndNxt = conn.sndUna
+			return
+		}
+		// the ACK covers data which was never retransmitted
+		conn.counters.SpuriousTimeouts++
+		conn.undoActive = false
+		if u, ok := conn.cc.(LossUndoer); ok {
+			u.UndoLoss(conn.flightSize())
+		}
+	default:
+		panic("unreachable")
+	}
+}
+
+// frtoWindow returns the congestion window to use in transmit, which is
+// cwnd unless F-RTO allows more new data to be sent.
+func (conn *Conn) frtoWindow(cwnd uint32) uint32 {
+	if conn.frto == frtoSecondAck && conn.frtoLimit.gt(conn.sndUna) {
+		if lim := uint32(conn.frtoLimit - conn.sndUna); lim > cwnd {
+			return lim
+		}
+	}
+	return cwnd
+}
@@ -0,0 +1,142 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/errors"
+)
+
+// the default delay between connection attempts in DialHappyEyeballs;
+// see https://tools.ietf.org/html/rfc8305#section-5
+const defaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// A Resolver looks up the addresses of host names.
+// It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupHost(host string) ([]net.IP, error)
+}
+
+// SetResolver sets the Resolver used by DialHappyEyeballs.
+func (host *Host) SetResolver(r Resolver) {
+	host.mu.Lock()
+	host.resolver = r
+	host.mu.Unlock()
+}
+
+// SetHappyEyeballsDelay sets how long DialHappyEyeballs waits for a connection
+// attempt to succeed before starting the next one. The default is 250ms.
+func (host *Host) SetHappyEyeballsDelay(d time.Duration) {
+	host.mu.Lock()
+	host.happyEyeballsDelay = d
+	host.mu.Unlock()
+}
+
+// DialHappyEyeballs looks up the addresses of name with the host's Resolver
+// (see SetResolver), and opens a connection to the given port on one of them
+// using the Happy Eyeballs algorithm: the addresses are tried in turn,
+// alternating between IPv6 and IPv4 starting with IPv6, and each attempt is
+// given a head start (see SetHappyEyeballsDelay) before the next one begins,
+// without waiting for the earlier ones to fail. The first connection to be
+// established is returned, and the other attempts are abandoned. Addresses of
+// IP versions that the host doesn't support are skipped. If every attempt
+// fails, the error from the first is returned.
+// See https://tools.ietf.org/html/rfc8305
+func (host *Host) DialHappyEyeballs(name string, port Port) (*Conn, error) {
+	host.mu.RLock()
+	resolver, delay := host.resolver, host.happyEyeballsDelay
+	host.mu.RUnlock()
+	if resolver == nil {
+		return nil, errors.New("dial: no resolver")
+	}
+	addrs, err := resolver.LookupHost(name)
+	if err != nil {
+		return nil, errors.Annotate(err, "dial")
+	}
+	addrs = host.interleave(addrs)
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("dial %v: no addresses of a supported IP version", name)
+	}
+
+	type result struct {
+		c   *Conn
+		err error
+	}
+	cancel := make(chan struct{})
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	var timer <-chan time.Time
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := host.dial(addr, port, time.Time{}, cancel)
+			results <- result{c, err}
+		}()
+		timer = nil
+		if next < len(addrs) {
+			timer = time.After(delay)
+		}
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer:
+			start()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				close(cancel)
+				go func(pending int) {
+					// an attempt may have been established before
+					// it noticed that it was abandoned
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							r.c.abort()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				// don't wait out the delay after a failure
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// interleave returns the addresses in addrs of the IP versions that host
+// supports, reordered to alternate between IPv6 and IPv4, starting with IPv6.
+// Within each version, the order is preserved.
+// See https://tools.ietf.org/html/rfc8305#section-4
+func (host *Host) interleave(addrs []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		switch {
+		case addr.IPVersion() == 4 && host.ipv4 != nil:
+			v4 = append(v4, addr)
+		case addr.IPVersion() == 6 && host.ipv6 != nil:
+			v6 = append(v6, addr)
+		}
+	}
+	var out []net.IP
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return out
+}
@@ -1,21 +1,45 @@
 package tcp
 
 import (
+	"github.com/joshlf/net"
 	"github.com/joshlf/net/internal/errors"
 	"github.com/joshlf/net/internal/parse"
 )
 
+// maximum length of a TCP header including options
+const maxHeaderLen = 60
+
 type optionType uint8
 
 const (
 	optionTypeEnd optionType = 0
 	optionTypeNOP optionType = 1
 	optionTypeMSS optionType = 2
+	// See https://tools.ietf.org/html/rfc7323#section-2
+	optionTypeWindowScale optionType = 3
+	// See https://tools.ietf.org/html/rfc2018#section-2
+	optionTypeSACKPermitted optionType = 4
+	// See https://tools.ietf.org/html/rfc2018#section-3
+	optionTypeSACK optionType = 5
+	// See https://tools.ietf.org/html/rfc7323#section-3
+	optionTypeTimestamp optionType = 8
+)
+
+// maximum number of SACK blocks that fit in the options space,
+// and that fit alongside the timestamps option
+const (
+	maxSACKBlocks   = 4
+	maxSACKBlocksTS = 3
 )
 
+// a SACK block reports that the bytes in [start, end) were received
+type sackBlock struct {
+	start, end seq
+}
+
 type genericHeader struct {
-	seq     uint32
-	ack     uint32
+	seq     seq
+	ack     seq
 	dataOff uint8 // 4 bits
 	flags
 	window   uint16
@@ -25,9 +49,22 @@ type genericHeader struct {
 	// options
 	mss    uint16
 	mssSet bool
+	wscale uint8
+	wsSet  bool
+	tsVal  uint32
+	tsEcr  uint32
+	tsSet  bool
+
+	sackPermitted bool
+	sack          [maxSACKBlocks]sackBlock
+	nsack         int
+
+	// ECN state carried in the IP header rather than the TCP header
+	ect bool // the segment is to be sent with ECT(0)
+	ce  bool // the segment was received with CE
 }
 
-type tcpIPv4Header struct {
+type tcpHeader struct {
 	srcport Port
 	dstport Port
 	genericHeader
@@ -36,17 +73,17 @@ type tcpIPv4Header struct {
 // TODO(joshlf): Actually check error conditions
 
 // returns the number of bytes consumed from b unless an error is returned
-func parseTCPIPv4Header(b []byte, hdr *tcpIPv4Header) (n int, err error) {
+func parseTCPHeader(b []byte, hdr *tcpHeader) (n int, err error) {
 	if len(b) < 20 {
 		return 0, errors.Errorf("invalid header length: %v", len(b))
 	}
 
 	hdr.srcport = Port(parse.GetUint16(&b))
 	hdr.dstport = Port(parse.GetUint16(&b))
-	hdr.seq = parse.GetUint32(&b)
-	hdr.ack = parse.GetUint32(&b)
-	hdr.dataOff = b[0] >> 5
-	hdr.flags = flags(b[0]&1)<<7 | flags(b[1])
+	hdr.seq = seq(parse.GetUint32(&b))
+	hdr.ack = seq(parse.GetUint32(&b))
+	hdr.dataOff = b[0] >> 4
+	hdr.flags = flags(b[0]&1)<<8 | flags(b[1])
 	b = b[2:]
 	hdr.window = parse.GetUint16(&b)
 	hdr.checksum = parse.GetUint16(&b)
@@ -71,10 +108,12 @@ func parseTCPIPv4Header(b []byte, hdr *tcpIPv4Header) (n int, err error) {
 		defer func() {
 			r := recover()
 			if r != nil {
-				err = errors.New("malformed options")
+				n, err = 0, errors.New("malformed options")
 			}
 		}()
 
+		// only consider the options, not the payload
+		b = b[:hdrlen-20]
 	LOOP:
 		for len(b) > 0 {
 			typ := optionType(parse.GetByte(&b))
@@ -87,30 +126,75 @@ func parseTCPIPv4Header(b []byte, hdr *tcpIPv4Header) (n int, err error) {
 				parse.GetByte(&b) // we know the length
 				hdr.mss = parse.GetUint16(&b)
 				hdr.mssSet = true
+			case optionTypeWindowScale:
+				parse.GetByte(&b) // we know the length
+				hdr.wscale = parse.GetByte(&b)
+				hdr.wsSet = true
+			case optionTypeTimestamp:
+				parse.GetByte(&b) // we know the length
+				hdr.tsVal = parse.GetUint32(&b)
+				hdr.tsEcr = parse.GetUint32(&b)
+				hdr.tsSet = true
+			case optionTypeSACKPermitted:
+				parse.GetByte(&b) // we know the length
+				hdr.sackPermitted = true
+			case optionTypeSACK:
+				olen := int(parse.GetByte(&b))
+				n := (olen - 2) / 8
+				for i := 0; i < n; i++ {
+					start := seq(parse.GetUint32(&b))
+					end := seq(parse.GetUint32(&b))
+					if hdr.nsack < maxSACKBlocks {
+						hdr.sack[hdr.nsack] = sackBlock{start, end}
+						hdr.nsack++
+					}
+				}
 			default:
 				// we don't know what this option is,
 				// but at least we can skip it
 				olen := int(parse.GetByte(&b))
 				// we already chomped the first 2 bytes
-				parse.GetBytes(&b, 2-olen)
+				parse.GetBytes(&b, olen-2)
 			}
 		}
 	}
 	return hdrlen, nil
 }
 
-// returns the number of bytes consumed from b; if hdr.mssOn, len(b) >= 24
-func writeTCPIPv4Header(b []byte, hdr *tcpIPv4Header) (int, error) {
+// returns the number of bytes consumed from b; len(b) >= maxHeaderLen
+func writeTCPHeader(b []byte, hdr *tcpHeader) (int, error) {
 	parse.PutUint16(&b, uint16(hdr.srcport))
 	parse.PutUint16(&b, uint16(hdr.dstport))
 	parse.PutUint32(&b, uint32(hdr.seq))
 	parse.PutUint32(&b, uint32(hdr.ack))
 
-	hdr.dataOff = 5
+	hdrlen := 20
 	if hdr.mssSet {
-		hdr.dataOff = 6
+		hdrlen += 4
+	}
+	if hdr.wsSet {
+		// padded with a NOP
+		hdrlen += 4
 	}
-	b[0] = (hdr.dataOff << 5) | uint8(hdr.flags>>8)
+	if hdr.tsSet {
+		// padded with two NOPs to keep the
+		// timestamps 4-byte aligned
+		hdrlen += 12
+	}
+	if hdr.sackPermitted {
+		// padded with two NOPs
+		hdrlen += 4
+	}
+	if hdr.nsack > 0 {
+		// padded with two NOPs to keep the
+		// blocks 4-byte aligned
+		hdrlen += 4 + 8*hdr.nsack
+	}
+	if hdrlen > maxHeaderLen {
+		return 0, errors.Errorf("options too long: %v bytes", hdrlen-20)
+	}
+	hdr.dataOff = uint8(hdrlen / 4)
+	b[0] = (hdr.dataOff << 4) | uint8(hdr.flags>>8)
 	b[1] = uint8(hdr.flags)
 	b = b[2:]
 
@@ -118,17 +202,60 @@ func writeTCPIPv4Header(b []byte, hdr *tcpIPv4Header) (int, error) {
 	parse.PutUint16(&b, uint16(hdr.checksum))
 	parse.PutUint16(&b, uint16(hdr.urgptr))
 
-	hdrlen := 20
 	if hdr.mssSet {
-		hdrlen = 24
 		parse.PutByte(&b, byte(optionTypeMSS))
 		parse.PutByte(&b, 4) // length of option
 		parse.PutUint16(&b, hdr.mss)
 	}
+	if hdr.wsSet {
+		parse.PutByte(&b, byte(optionTypeNOP))
+		parse.PutByte(&b, byte(optionTypeWindowScale))
+		parse.PutByte(&b, 3) // length of option
+		parse.PutByte(&b, hdr.wscale)
+	}
+	if hdr.tsSet {
+		parse.PutByte(&b, byte(optionTypeNOP))
+		parse.PutByte(&b, byte(optionTypeNOP))
+		parse.PutByte(&b, byte(optionTypeTimestamp))
+		parse.PutByte(&b, 10) // length of option
+		parse.PutUint32(&b, hdr.tsVal)
+		parse.PutUint32(&b, hdr.tsEcr)
+	}
+	if hdr.sackPermitted {
+		parse.PutByte(&b, byte(optionTypeNOP))
+		parse.PutByte(&b, byte(optionTypeNOP))
+		parse.PutByte(&b, byte(optionTypeSACKPermitted))
+		parse.PutByte(&b, 2) // length of option
+	}
+	if hdr.nsack > 0 {
+		parse.PutByte(&b, byte(optionTypeNOP))
+		parse.PutByte(&b, byte(optionTypeNOP))
+		parse.PutByte(&b, byte(optionTypeSACK))
+		parse.PutByte(&b, byte(2+8*hdr.nsack)) // length of option
+		for _, blk := range hdr.sack[:hdr.nsack] {
+			parse.PutUint32(&b, uint32(blk.start))
+			parse.PutUint32(&b, uint32(blk.end))
+		}
+	}
 
 	return hdrlen, nil
 }
 
+// tcpChecksum computes the checksum of the TCP segment b sent from src to
+// dst, covering the IPv4 or IPv6 pseudo-header. The checksum field of b must
+// be zero.
+// See https://tools.ietf.org/html/rfc793#page-17 and
+// https://tools.ietf.org/html/rfc2460#section-8.1
+func tcpChecksum(b []byte, src, dst net.IP) uint16 {
+	return ^net.Checksum(b, net.PseudoHeaderSum(src, dst, net.IPProtocolTCP, len(b)))
+}
+
+// setChecksum sets the checksum field of the encoded TCP segment b.
+func setChecksum(b []byte, checksum uint16) {
+	b[16] = byte(checksum >> 8)
+	b[17] = byte(checksum)
+}
+
 type flags uint16
 
 func (f flags) NS() bool  { return f&0x100 != 0 }
@@ -0,0 +1,106 @@
+package tcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	test := func(hdr tcpHeader) {
+		b := make([]byte, maxHeaderLen)
+		n, err := writeTCPHeader(b, &hdr)
+		if err != nil {
+			t.Fatalf("unexpected error writing header: %v", err)
+		}
+		var got tcpHeader
+		m, err := parseTCPHeader(b[:n], &got)
+		if err != nil {
+			t.Fatalf("unexpected error parsing header: %v", err)
+		}
+		if m != n {
+			t.Errorf("unexpected parsed header length: got %v; want %v", m, n)
+		}
+		if !reflect.DeepEqual(got, hdr) {
+			t.Errorf("unexpected parsed header: got %+v; want %+v", got, hdr)
+		}
+	}
+
+	hdr := tcpHeader{srcport: 1234, dstport: 80}
+	hdr.seq = 0xDEADBEEF
+	hdr.ack = 0xFEEDFACE
+	hdr.SetSYN(true)
+	hdr.SetACK(true)
+	hdr.SetNS(true)
+	hdr.window = 65535
+	test(hdr)
+
+	hdr.mss, hdr.mssSet = 1460, true
+	test(hdr)
+
+	hdr.tsVal, hdr.tsEcr, hdr.tsSet = 0x01020304, 0xFFFFFFFF, true
+	test(hdr)
+
+	hdr.mss, hdr.mssSet = 0, false
+	test(hdr)
+
+	hdr.sackPermitted = true
+	test(hdr)
+
+	hdr.sackPermitted = false
+	hdr.sack[0] = sackBlock{0x10000000, 0x10000200}
+	hdr.nsack = 1
+	test(hdr)
+
+	hdr.sack[1] = sackBlock{0x0FFFFF00, 0x10000400}
+	hdr.sack[2] = sackBlock{0xFFFFFFF0, 0x00000010}
+	hdr.nsack = 3
+	test(hdr)
+}
+
+func TestParseHeaderOptions(t *testing.T) {
+	b := []byte{
+		0x04, 0xd2, 0x00, 0x50, // ports 1234 and 80
+		0xde, 0xad, 0xbe, 0xef, // sequence number
+		0xfe, 0xed, 0xfa, 0xce, // acknowledgement number
+		0x71, 0x10, // data offset of 7 words, NS and ACK
+		0xff, 0xff, 0x00, 0x00, 0x00, 0x00, // window, checksum, urgent pointer
+		30, 4, 0xaa, 0xbb, // unknown option, which is skipped
+		byte(optionTypeMSS), 4, 0x05, 0xb4,
+		// the payload, which looks like a window scale
+		// option but isn't parsed as one
+		byte(optionTypeWindowScale), 3, 7,
+	}
+	var hdr tcpHeader
+	n, err := parseTCPHeader(b, &hdr)
+	if err != nil {
+		t.Fatalf("unexpected error parsing header: %v", err)
+	}
+	if n != 28 {
+		t.Errorf("unexpected header length: got %v; want 28", n)
+	}
+	if hdr.srcport != 1234 || hdr.dstport != 80 || hdr.seq != 0xDEADBEEF || hdr.ack != 0xFEEDFACE {
+		t.Errorf("unexpected header fields: %+v", hdr)
+	}
+	if !hdr.NS() || !hdr.ACK() || hdr.SYN() || hdr.dataOff != 7 {
+		t.Errorf("unexpected data offset or flags: %v, %+v", hdr.dataOff, hdr.flags)
+	}
+	if !hdr.mssSet || hdr.mss != 1460 || hdr.wsSet {
+		t.Errorf("unexpected options: %+v", hdr)
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	hdr := tcpHeader{srcport: 1234, dstport: 80}
+	hdr.SetNS(true)
+	hdr.SetACK(true)
+	hdr.mss, hdr.mssSet = 1460, true
+	b := make([]byte, 24)
+	n, err := writeTCPHeader(b, &hdr)
+	if err != nil {
+		t.Fatalf("unexpected error writing header: %v", err)
+	}
+	// a data offset of 6 words, NS and ACK
+	if n != 24 || b[12] != 0x61 || b[13] != 0x10 {
+		t.Errorf("unexpected header: got length %v, data offset and flags %#x %#x; want 24, 0x61 0x10", n, b[12], b[13])
+	}
+}
@@ -0,0 +1,61 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// SetIdleTimeout sets how long c may go without any data being written or
+// read by the application, or received from the other side, before it is
+// reset. Once it has been, Read and Write return an error matching
+// net.ErrIdleTimeout, including any calls which were blocked at the time.
+// This allows a server to reclaim connections whose clients have gone quiet,
+// whether or not they're still reachable. If d is 0, which is the default, c
+// is never reset for being idle. The idle period starts again from the time
+// SetIdleTimeout is called.
+func (c *Conn) SetIdleTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopIdleTimer()
+	c.idleTimeout = d
+	if d <= 0 || c.state == StateClosed {
+		return
+	}
+	c.lastActive = timeout.NowMonotonic()
+	c.idleHandle = c.timeoutd.AddTimeout(c.idleTimerExpired, c.lastActive.Add(d))
+}
+
+// active records that data has just been sent or received on conn. Since this
+// happens for nearly every segment, the idle timer isn't rescheduled, which
+// would mean cancelling it and adding a new timeout each time; instead, when
+// it expires, it checks whether conn has been active since it was started.
+func (conn *Conn) active() {
+	if conn.idleTimeout > 0 {
+		conn.lastActive = timeout.NowMonotonic()
+	}
+}
+
+// idleTimerExpired is called when the idle timer expires. If conn has been
+// active since the timer was started, it is restarted to expire a full idle
+// timeout after that activity; otherwise, conn is reset.
+func (conn *Conn) idleTimerExpired() {
+	conn.idleHandle = nil
+	if conn.state == StateClosed {
+		return
+	}
+	if deadline := conn.lastActive.Add(conn.idleTimeout); timeout.NowMonotonic().Before(deadline) {
+		conn.idleHandle = conn.timeoutd.AddTimeout(conn.idleTimerExpired, deadline)
+		return
+	}
+	conn.err = errors.IdleTimeoutf("tcp")
+	conn.abortLocked()
+}
+
+func (conn *Conn) stopIdleTimer() {
+	if conn.idleHandle != nil {
+		conn.idleHandle.Cancel()
+		conn.idleHandle = nil
+	}
+}
@@ -16,6 +16,17 @@ func (c *circularBuffer) Len() int {
 	return len(c.buf)
 }
 
+// Resize changes the length of c to n, preserving the first used bytes. No
+// input validation is performed, and the behavior if used > n is undefined.
+func (c *circularBuffer) Resize(n, used int) {
+	buf := make([]byte, n)
+	if used > 0 {
+		c.CopyFrom(buf[:used], 0)
+	}
+	c.start = 0
+	c.buf = buf
+}
+
 // Advance advances the start of the buffer by n bytes. The n bytes at the
 // beginning of the buffer are no longer available, while n more bytes at
 // the end of the buffer are now available.
@@ -1,6 +1,7 @@
 package buffer
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -68,6 +69,20 @@ func TestIntervalAllocator(t *testing.T) {
 	}
 }
 
+func TestIntervalAllocatorGrow(t *testing.T) {
+	// allocating more intervals than were allocated up
+	// front grows the allocator rather than reusing any
+	allocator := newIntervalAllocator(2)
+	allocated := make(map[int]bool)
+	for i := 0; i < 16; i++ {
+		idx := allocator.New()
+		if allocated[idx] {
+			t.Fatalf("double-allocation of index %v", idx)
+		}
+		allocated[idx] = true
+	}
+}
+
 func BenchmarkIntervalAllocator(b *testing.B) {
 	slabsize := 65536
 	ia := newIntervalAllocator(slabsize)
@@ -302,3 +317,149 @@ func BenchmarkCircularBuffer(b *testing.B) {
 		b.Run(fmt.Sprintf("copyFrom/%v", size), getRun(size, 65535, (*circularBuffer).CopyFrom))
 	}
 }
+
+func TestReadAndAdvance(t *testing.T) {
+	data := make([]byte, 64)
+	rand.Read(data)
+	const seq = 1000
+	r := NewReadBuffer(16, seq)
+
+	// data arriving out of order stays at the same sequence number
+	// as data before it is read, and reading wraps around the
+	// underlying buffer many times
+	var read []byte
+	for next := 0; next < len(data); next += 8 {
+		r.Write(data[next+4:next+8], uint32(seq+next+4))
+		r.Write(data[next:next+4], uint32(seq+next))
+		if n := r.Available(); n != 8 {
+			t.Fatalf("unexpected number of bytes available: got %v; want 8", n)
+		}
+		b := make([]byte, 3)
+		r.ReadAndAdvance(b)
+		read = append(read, b...)
+		if got, want := r.Seq(), uint32(seq+next+3); got != want {
+			t.Fatalf("unexpected sequence number after read: got %v; want %v", got, want)
+		}
+		b = make([]byte, 5)
+		r.ReadAndAdvance(b)
+		read = append(read, b...)
+		if r.Available() != 0 || r.Cap() != 16 {
+			t.Fatalf("unexpected state after reading everything: %v available, capacity %v", r.Available(), r.Cap())
+		}
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("unexpected data read: got %v; want %v", read, data)
+	}
+
+	// reading from the beginning moves later out-of-order
+	// data closer to the beginning rather than farther
+	r.Write(data[:4], uint32(seq+64))
+	r.Write(data[8:12], uint32(seq+72))
+	r.ReadAndAdvance(make([]byte, 4))
+	r.Write(data[4:8], uint32(seq+68))
+	b := make([]byte, 8)
+	r.ReadAndAdvance(b)
+	if !bytes.Equal(b, data[4:12]) {
+		t.Errorf("unexpected data read: got %v; want %v", b, data[4:12])
+	}
+}
+
+func TestBlock(t *testing.T) {
+	// --###--####
+	rb := NewReadBuffer(1024, 100)
+	rb.Write(make([]byte, 3), 102)
+	rb.Write(make([]byte, 4), 107)
+	for _, test := range []struct {
+		seq, start, end uint32
+		ok              bool
+	}{
+		{seq: 99},
+		{seq: 100},
+		{seq: 102, start: 102, end: 105, ok: true},
+		{seq: 104, start: 102, end: 105, ok: true},
+		{seq: 105},
+		{seq: 110, start: 107, end: 111, ok: true},
+		{seq: 111},
+	} {
+		start, end, ok := rb.Block(test.seq)
+		if start != test.start || end != test.end || ok != test.ok {
+			t.Errorf("unexpected block containing %v: got (%v, %v, %v); want (%v, %v, %v)",
+				test.seq, start, end, ok, test.start, test.end, test.ok)
+		}
+	}
+}
+
+func TestTrimOutOfOrder(t *testing.T) {
+	// ##--###--####
+	rb := NewReadBuffer(1024, 0)
+	rb.Write(make([]byte, 2), 0)
+	rb.Write(make([]byte, 3), 4)
+	rb.Write(make([]byte, 4), 9)
+	if n := rb.OutOfOrder(); n != 7 {
+		t.Fatalf("unexpected number of out-of-order bytes: got %v; want 7", n)
+	}
+
+	for _, test := range []struct{ max, trimmed, left int }{
+		{max: 7, trimmed: 0, left: 7},
+		{max: 5, trimmed: 2, left: 5},
+		{max: 2, trimmed: 3, left: 2},
+		{max: 0, trimmed: 2, left: 0},
+	} {
+		if n := rb.TrimOutOfOrder(test.max); n != test.trimmed {
+			t.Errorf("unexpected number of bytes trimmed to %v: got %v; want %v", test.max, n, test.trimmed)
+		}
+		if n := rb.OutOfOrder(); n != test.left {
+			t.Errorf("unexpected number of out-of-order bytes after trimming to %v: got %v; want %v", test.max, n, test.left)
+		}
+	}
+	if rb.Available() != 2 || rb.Next() != 2 {
+		t.Errorf("in-order bytes trimmed: %v available, next %v; want 2 and 2", rb.Available(), rb.Next())
+	}
+
+	// the gap can be filled again after trimming
+	rb.Write(make([]byte, 4), 2)
+	if rb.Next() != 6 || rb.OutOfOrder() != 0 {
+		t.Errorf("unexpected state after refilling: next %v, %v out of order; want 6 and 0", rb.Next(), rb.OutOfOrder())
+	}
+}
+
+func TestResize(t *testing.T) {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// wrap the data around the end of the buffer before resizing
+	wb := NewWriteBuffer(64, 0)
+	wb.Write(data[:48])
+	wb.Advance(32)
+	wb.Write(data[48:80])
+	wb.Resize(128)
+	if wb.Len() != 48 || wb.Cap() != 80 {
+		t.Fatalf("unexpected WriteBuffer size after Resize: Len %v, Cap %v; want 48, 80", wb.Len(), wb.Cap())
+	}
+	wb.Write(data[80:])
+	buf := make([]byte, 68)
+	wb.Read(buf, 0)
+	if !bytes.Equal(buf, data[32:]) {
+		t.Errorf("unexpected WriteBuffer contents after Resize: got %v; want %v", buf, data[32:])
+	}
+
+	rb := NewReadBuffer(64, 0)
+	rb.Write(data[:48], 0)
+	rb.ReadAndAdvance(make([]byte, 32))
+	rb.Write(data[56:72], 56)
+	if rb.End() != 72 {
+		t.Fatalf("unexpected End: got %v; want 72", rb.End())
+	}
+	rb.Resize(128)
+	if rb.Cap() != 128-16 {
+		t.Errorf("unexpected ReadBuffer Cap after Resize: got %v; want %v", rb.Cap(), 128-16)
+	}
+	rb.Write(data[48:56], 48)
+	buf = make([]byte, rb.Available())
+	rb.ReadAndAdvance(buf)
+	if !bytes.Equal(buf, data[32:72]) {
+		t.Errorf("unexpected ReadBuffer contents after Resize: got %v; want %v", buf, data[32:72])
+	}
+}
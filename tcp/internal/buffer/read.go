@@ -10,6 +10,10 @@ type ReadBuffer struct {
 	intervals intervalAllocator
 }
 
+// the number of intervals to allocate up front; more are
+// allocated on demand
+const initialIntervals = 8
+
 // NewReadBuffer creates a new ReadBuffer whose first byte has the given
 // sequence number and which has an underlying buffer of size n.
 func NewReadBuffer(n int, seq uint32) *ReadBuffer {
@@ -17,7 +21,7 @@ func NewReadBuffer(n int, seq uint32) *ReadBuffer {
 		seq:           seq,
 		firstInterval: -1,
 		buf:           *newCircularBuffer(n),
-		intervals:     newIntervalAllocator(n),
+		intervals:     newIntervalAllocator(initialIntervals),
 	}
 }
 
@@ -32,18 +36,66 @@ func (r *ReadBuffer) Write(b []byte, seq uint32) (next uint32) {
 // to the first byte not read into b. If len(b) bytes are not available
 // at the beginning of r, the behavior of ReadAndAdvance is undefined.
 func (r *ReadBuffer) ReadAndAdvance(b []byte) {
+	if len(b) == 0 {
+		return
+	}
 	r.buf.CopyFrom(b, 0)
+	r.buf.Advance(len(b))
 	r.seq += uint32(len(b))
-	for idx := r.firstInterval; idx != -1; idx = r.intervals.intervals[idx].next {
-		r.intervals.intervals[idx].begin += len(b)
+
+	// the first interval begins at offset 0 (otherwise
+	// no bytes would be available), so it just shrinks;
+	// every other interval moves closer to the beginning
+	first := r.firstInterval
+	r.intervals.intervals[first].len -= len(b)
+	for idx := r.intervals.intervals[first].next; idx != -1; idx = r.intervals.intervals[idx].next {
+		r.intervals.intervals[idx].begin -= len(b)
+	}
+	if r.intervals.intervals[first].len == 0 {
+		r.firstInterval = r.intervals.intervals[first].next
+		r.intervals.Free(first)
 	}
 }
 
+// Peek reads from r into b starting at the given sequence number without
+// advancing r. If the len(b) bytes starting at seq have not been written,
+// the behavior of Peek is undefined.
+func (r *ReadBuffer) Peek(b []byte, seq uint32) {
+	r.buf.CopyFrom(b, int(seq-r.seq))
+}
+
 // Next returns the sequence number of the next byte which has not been written.
 func (r *ReadBuffer) Next() uint32 {
 	return uint32(int(r.seq) + r.Available())
 }
 
+// Seq returns the sequence number of the first byte in r.
+func (r *ReadBuffer) Seq() uint32 {
+	return r.seq
+}
+
+// End returns the sequence number following the last byte which has been
+// written, whether or not it is available to be read.
+func (r *ReadBuffer) End() uint32 {
+	end := r.seq
+	for idx := r.firstInterval; idx != -1; idx = r.intervals.intervals[idx].next {
+		ivl := &r.intervals.intervals[idx]
+		end = r.seq + uint32(ivl.begin+ivl.len)
+	}
+	return end
+}
+
+// Resize changes the size of r's underlying buffer to n bytes, preserving its
+// contents. The behavior if n is less than End() - Seq() is undefined.
+func (r *ReadBuffer) Resize(n int) {
+	r.buf.Resize(n, int(r.End()-r.seq))
+}
+
+// Cap returns the number of bytes following Next which can be written into r.
+func (r *ReadBuffer) Cap() int {
+	return r.buf.Len() - int(r.Next()-r.seq)
+}
+
 // Available returns the number of bytes available to be read from the beginning
 // of the buffer.
 func (r *ReadBuffer) Available() int {
@@ -55,10 +107,69 @@ func (r *ReadBuffer) Available() int {
 	return r.intervals.intervals[r.firstInterval].len
 }
 
+// OutOfOrder returns the number of bytes which have been written into r
+// following a gap, and so are not yet available to be read.
+func (r *ReadBuffer) OutOfOrder() int {
+	var n int
+	for idx := r.firstInterval; idx != -1; idx = r.intervals.intervals[idx].next {
+		if ivl := &r.intervals.intervals[idx]; ivl.begin > 0 {
+			n += ivl.len
+		}
+	}
+	return n
+}
+
+// Block returns the bounds [start, end) of the contiguous block of written
+// bytes which contains seq. ok is false if seq hasn't been written.
+func (r *ReadBuffer) Block(seq uint32) (start, end uint32, ok bool) {
+	offset := int(int32(seq - r.seq))
+	if offset < 0 {
+		return 0, 0, false
+	}
+	for idx := r.firstInterval; idx != -1; idx = r.intervals.intervals[idx].next {
+		ivl := &r.intervals.intervals[idx]
+		if ivl.begin <= offset && offset < ivl.begin+ivl.len {
+			return r.seq + uint32(ivl.begin), r.seq + uint32(ivl.begin+ivl.len), true
+		}
+	}
+	return 0, 0, false
+}
+
+// TrimOutOfOrder discards out-of-order bytes, starting with those furthest
+// from the beginning of r, until at most max remain, and returns the number
+// of bytes discarded. Bytes available to be read are never discarded.
+func (r *ReadBuffer) TrimOutOfOrder(max int) int {
+	excess := r.OutOfOrder() - max
+	var trimmed int
+	for trimmed < excess {
+		// find the last interval, which must follow a gap
+		// since there are out-of-order bytes left
+		cur := &r.firstInterval
+		for r.intervals.intervals[*cur].next != -1 {
+			cur = &r.intervals.intervals[*cur].next
+		}
+		idx := *cur
+		ivl := &r.intervals.intervals[idx]
+		n := excess - trimmed
+		if n > ivl.len {
+			n = ivl.len
+		}
+		ivl.len -= n
+		trimmed += n
+		if ivl.len == 0 {
+			*cur = -1
+			r.intervals.Free(idx)
+		}
+	}
+	return trimmed
+}
+
 func (r *ReadBuffer) write(b []byte, offset int) {
 	r.buf.CopyTo(b, offset)
+	// allocate before taking any pointers into r.intervals.intervals
+	// since allocating may grow (and thus move) the slice
+	idx := r.intervals.New()
 	if r.firstInterval == -1 {
-		idx := r.intervals.New()
 		ivl := &r.intervals.intervals[idx]
 		ivl.begin = offset
 		ivl.len = len(b)
@@ -78,7 +189,6 @@ func (r *ReadBuffer) write(b []byte, offset int) {
 		cur = &r.intervals.intervals[next].next
 		next = *cur
 	}
-	idx := r.intervals.New()
 	ivl := &r.intervals.intervals[idx]
 	ivl.begin = offset
 	ivl.len = len(b)
@@ -118,7 +228,7 @@ type interval struct {
 	// begin, end int // [begin, end) as offsets from the beginning of the buffer
 	next int // index into intervals slice of next interval or -1 if none
 
-	// for internal allocator use: index of next free interval object
+	// for internal allocator use: index of next free interval object or -1
 	nextFree int
 }
 
@@ -132,16 +242,21 @@ type intervalAllocator struct {
 }
 
 func newIntervalAllocator(n int) intervalAllocator {
-	ia := intervalAllocator{intervals: make([]interval, n)}
-	for i := 0; i < n-1; i++ {
-		ia.intervals[i].nextFree = i + 1
+	ia := intervalAllocator{intervals: make([]interval, n), firstFree: -1}
+	for i := n - 1; i >= 0; i-- {
+		ia.intervals[i].nextFree = ia.firstFree
+		ia.firstFree = i
 	}
 	return ia
 }
 
-// New allocates a new interval from i and returns its index.
-// If no intervals are free, the behavior of New is undefined.
+// New allocates a new interval from i and returns its index. If no intervals
+// are free, i is grown, which invalidates any pointers into i.intervals.
 func (i *intervalAllocator) New() int {
+	if i.firstFree == -1 {
+		i.intervals = append(i.intervals, interval{})
+		return len(i.intervals) - 1
+	}
 	idx := i.firstFree
 	i.firstFree = i.intervals[idx].nextFree
 	return idx
@@ -27,6 +27,12 @@ func (w *WriteBuffer) Cap() int {
 	return w.buf.Len() - w.len
 }
 
+// Resize changes the total capacity of w to n, preserving its contents. The
+// behavior if n < w.Len() is undefined.
+func (w *WriteBuffer) Resize(n int) {
+	w.buf.Resize(n, w.len)
+}
+
 // Seq returns the sequence number of the first byte in w.
 func (w *WriteBuffer) Seq() uint32 {
 	return w.seq
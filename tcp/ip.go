@@ -0,0 +1,118 @@
+package tcp
+
+import (
+	stdnet "net"
+
+	"github.com/joshlf/net"
+)
+
+// the lengths of the IP and TCP headers without options
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+)
+
+// An ipLayer sends TCP segments over one version of IP.
+type ipLayer interface {
+	writeTo(b []byte, dst net.IP, ect bool) (n int, err error)
+	sourceAddr(dst net.IP) (net.IP, error)
+	// pathMTU returns the path MTU to dst, or 0 if it isn't known
+	pathMTU(dst net.IP) int
+	// the length of the IP header without options
+	headerLen() int
+}
+
+type ipv4Layer struct {
+	iphost  net.IPv4Host
+	ectHost net.IPv4Host // sends segments marked ECN-capable
+}
+
+func newIPv4Layer(iphost net.IPv4Host) *ipv4Layer {
+	// segments are sized to fit the path MTU rather than fragmented
+	iphost = iphost.GetConfigCopyIPv4()
+	iphost.SetDontFragment(true)
+	ectHost := iphost.GetConfigCopyIPv4()
+	ectHost.SetECN(net.ECNECT0)
+	return &ipv4Layer{iphost: iphost, ectHost: ectHost}
+}
+
+func (l *ipv4Layer) writeTo(b []byte, dst net.IP, ect bool) (n int, err error) {
+	iphost := l.iphost
+	if ect {
+		iphost = l.ectHost
+	}
+	return iphost.WriteToIPv4(b, dst.(net.IPv4), net.IPProtocolTCP)
+}
+
+func (l *ipv4Layer) sourceAddr(dst net.IP) (net.IP, error) {
+	src, err := l.iphost.IPv4SourceAddr(dst.(net.IPv4))
+	return src, err
+}
+
+func (l *ipv4Layer) pathMTU(dst net.IP) int { return l.iphost.IPv4PathMTU(dst.(net.IPv4)) }
+func (l *ipv4Layer) headerLen() int         { return ipv4HeaderLen }
+
+type ipv6Layer struct {
+	iphost  net.IPv6Host
+	ectHost net.IPv6Host // sends segments marked ECN-capable
+}
+
+func newIPv6Layer(iphost net.IPv6Host) *ipv6Layer {
+	iphost = iphost.GetConfigCopyIPv6()
+	ectHost := iphost.GetConfigCopyIPv6()
+	ectHost.SetECN(net.ECNECT0)
+	return &ipv6Layer{iphost: iphost, ectHost: ectHost}
+}
+
+func (l *ipv6Layer) writeTo(b []byte, dst net.IP, ect bool) (n int, err error) {
+	iphost := l.iphost
+	if ect {
+		iphost = l.ectHost
+	}
+	return iphost.WriteToIPv6(b, dst.(net.IPv6), net.IPProtocolTCP)
+}
+
+func (l *ipv6Layer) sourceAddr(dst net.IP) (net.IP, error) {
+	src, err := l.iphost.IPv6SourceAddr(dst.(net.IPv6))
+	return src, err
+}
+
+func (l *ipv6Layer) pathMTU(dst net.IP) int { return l.iphost.IPv6PathMTU(dst.(net.IPv6)) }
+func (l *ipv6Layer) headerLen() int         { return ipv6HeaderLen }
+
+// unspecifiedAddr returns the unspecified address
+// (0.0.0.0 or ::) of the same IP version as addr.
+func unspecifiedAddr(addr net.IP) net.IP {
+	if addr.IPVersion() == 4 {
+		return net.IPv4{}
+	}
+	return net.IPv6{}
+}
+
+// fromStdIP converts ip, from the standard library's net
+// package, to an IPv4 or IPv6, returning nil if it's invalid.
+func fromStdIP(ip stdnet.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		var addr net.IPv4
+		copy(addr[:], ip4)
+		return addr
+	}
+	if len(ip) != stdnet.IPv6len {
+		return nil
+	}
+	var addr net.IPv6
+	copy(addr[:], ip)
+	return addr
+}
+
+// toStdIP converts ip to an IP from the standard library's net package.
+func toStdIP(ip net.IP) stdnet.IP {
+	switch ip := ip.(type) {
+	case net.IPv4:
+		return stdnet.IPv4(ip[0], ip[1], ip[2], ip[3])
+	case net.IPv6:
+		return append(stdnet.IP(nil), ip[:]...)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net/internal/timeout"
+)
+
+const (
+	// the default time a connection must be idle before keepalive probes
+	// are sent, and the interval between them; this is the same as the
+	// default used by the standard library
+	defaultKeepAlivePeriod = 15 * time.Second
+	// the number of unacknowledged keepalive probes
+	// after which the connection is closed
+	keepAliveCount = 9
+)
+
+// SetKeepAlive sets whether c sends keepalive probes. Once nothing has been
+// received from the other side for the keepalive period (see
+// SetKeepAlivePeriod), a probe is sent every period until something is. Any
+// segment counts, so a connection on which data only flows in one direction
+// is kept alive by the ACKs flowing in the other. If 9 probes in a row go
+// unacknowledged, c is closed, and Read and Write return a timeout error. This
+// allows a connection which only reads to detect that the other side has
+// silently gone away. See https://tools.ietf.org/html/rfc1122#page-101
+func (c *Conn) SetKeepAlive(keepalive bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keepAlive = keepalive
+	c.restartKeepAlive()
+}
+
+// SetKeepAlivePeriod sets the time c must be idle before keepalive probes are
+// sent, and the interval between them. It defaults to 15 seconds.
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d <= 0 {
+		d = defaultKeepAlivePeriod
+	}
+	c.keepAlivePeriod = d
+	c.restartKeepAlive()
+}
+
+// IsAlive returns false if c has been closed, or if a keepalive probe has
+// gone unacknowledged for a full keepalive period. This allows code which
+// only reads from c to check whether the other side is still there without
+// writing or waiting for keepalive to close c. A probe which has just been
+// sent doesn't count until the other side has had time to answer it. If
+// keepalive is disabled, it only returns false once c has been closed.
+func (c *Conn) IsAlive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// kaProbes is incremented when each probe is sent, so
+	// the first has only gone unanswered once it is 2
+	return c.state != StateClosed && c.kaProbes <= 1
+}
+
+// restartKeepAlive restarts the keepalive timer, starting a new idle period,
+// or stops it if keepalive has been disabled.
+func (conn *Conn) restartKeepAlive() {
+	conn.stopKeepAliveTimer()
+	conn.kaProbes = 0
+	if !conn.keepAlive || !conn.keepAliveState() {
+		return
+	}
+	conn.lastHeard = timeout.NowMonotonic()
+	conn.kaHandle = conn.timeoutd.AddTimeout(conn.keepAliveTimeout, conn.lastHeard.Add(conn.keepAlivePeriod))
+}
+
+// keepAliveState reports whether keepalive probes may be sent in conn's
+// current state: once it is synchronized, until it enters TIME_WAIT.
+func (conn *Conn) keepAliveState() bool {
+	switch conn.state {
+	case StateListen, StateSYNSent, StateSYNRcvd, StateTimeWait, StateClosed:
+		return false
+	}
+	return true
+}
+
+// heard records that an acceptable segment has just been received. Like the
+// idle timer, the keepalive timer isn't rescheduled for each segment; when it
+// expires, it checks whether anything has been heard since it was started.
+func (conn *Conn) heard() {
+	if conn.keepAlive {
+		conn.lastHeard = timeout.NowMonotonic()
+		conn.kaProbes = 0
+	}
+}
+
+// keepAliveTimeout is called when the keepalive timer expires. If nothing has
+// been heard from the other side for the keepalive period, it sends a probe,
+// or, if keepAliveCount probes have already gone unacknowledged, closes conn
+// with a timeout error.
+func (conn *Conn) keepAliveTimeout() {
+	conn.kaHandle = nil
+	if !conn.keepAliveState() {
+		return
+	}
+	now := timeout.NowMonotonic()
+	if next := conn.lastHeard.Add(conn.keepAlivePeriod); conn.kaProbes == 0 && now.Before(next) {
+		conn.kaHandle = conn.timeoutd.AddTimeout(conn.keepAliveTimeout, next)
+		return
+	}
+	if conn.kaProbes >= keepAliveCount {
+		conn.err = timeoutErr
+		conn.close()
+		return
+	}
+	if conn.rtxHandle == nil {
+		// With data outstanding, the retransmission timer detects
+		// whether the other side has gone away, and retransmissions
+		// serve as probes. Otherwise, the probe is a segment whose
+		// sequence number is one less than the next expected, which
+		// is unacceptable to the other side, so it sends an ACK.
+		var f flags
+		f.SetACK(true)
+		conn.send(f, conn.sndNxt-1, payload{})
+		conn.counters.KeepAliveProbes++
+	}
+	conn.kaProbes++
+	conn.kaHandle = conn.timeoutd.AddTimeout(conn.keepAliveTimeout, now.Add(conn.keepAlivePeriod))
+}
+
+func (conn *Conn) stopKeepAliveTimer() {
+	if conn.kaHandle != nil {
+		conn.kaHandle.Cancel()
+		conn.kaHandle = nil
+	}
+}
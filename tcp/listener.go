@@ -1,49 +1,112 @@
 package tcp
 
 import (
-	"errors"
+	stdnet "net"
 	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/timeout"
 )
 
-const listenQueueLen = 1024
+const (
+	// the default maximum number of established connections
+	// waiting to be accepted
+	defaultBacklog = 128
+	// the default maximum number of half-open connections
+	// (those in SYN_RCVD)
+	defaultSYNBacklog = 1024
+)
 
 type Listener struct {
-	conns []*Conn
+	// the local address and port on which the listener listens
+	addr twoTuple
+	// established connections waiting to be accepted
+	conns   []*Conn
+	backlog int
+	// the number of half-open connections
+	halfOpen   int
+	synBacklog int
+	// the number of connections which have completed their handshake
+	// and haven't yet been closed or entered TIME_WAIT, and the limit
+	// on that number; 0 for no limit
+	nconns   int
+	maxConns int
+	// the MSS clamp for new connections; 0 to use the host's
+	mssClamp uint16
+	// the initial congestion window of new connections
+	// in segments; 0 to use the host's
+	initCwnd int
+	// whether other listeners may listen on the same port;
+	// see Host.ListenTCPReusePort
+	reusePort bool
 	// lock and unlock operate on the host's write lock;
 	// close removes the listener from the host
 	lock, unlock, close func()
 	closed              bool
 
+	// the deadline for calls to AcceptTCP and Accept, in the space used
+	// by timeout.NowMonotonic; the zero value means no deadline
+	deadline time.Time
+	dhandle  *timeout.Timeout
+	timeoutd *timeout.Daemon
+
 	cond sync.Cond
 	mu   sync.Mutex
 }
 
-func newListener(close func()) *Listener {
-	l := &Listener{close: close}
+// newListener creates a new Listener. If backlog is 0, defaultBacklog is used.
+func newListener(backlog int, lock, unlock, close func()) *Listener {
+	if backlog <= 0 {
+		backlog = defaultBacklog
+	}
+	l := &Listener{
+		backlog:    backlog,
+		synBacklog: defaultSYNBacklog,
+		lock:       lock,
+		unlock:     unlock,
+		close:      close,
+	}
 	l.cond.L = &l.mu
+	l.timeoutd = timeout.NewDaemon(&l.mu)
 	return l
 }
 
+// Close stops listening. Any pending calls to AcceptTCP or Accept are
+// unblocked and return an error, and connections which are established
+// but haven't yet been accepted are reset.
 func (l *Listener) Close() error {
 	// acquire a write lock on the host first to avoid deadlock
 	l.lock()
 	l.mu.Lock()
-	defer l.unlock()
-	defer l.mu.Unlock()
 	if l.closed {
+		l.mu.Unlock()
+		l.unlock()
 		return errors.New("close on already-closed Listener")
 	}
-	for _, conn := range l.conns {
-		// TODO(joshlf): Send RST
-		_ = conn
-	}
+	conns := l.conns
+	l.conns = nil
 	l.close()
 	l.closed = true
-	l.mu.Unlock()
+	l.timeoutd.Stop()
 	l.cond.Broadcast()
+	l.mu.Unlock()
+	l.unlock()
+
+	// The connections in the accept queue acquired their locks before
+	// l.mu when they were established, so they're reset only once l.mu
+	// has been released. They've already been detached from l, so they
+	// won't call back into it.
+	for _, conn := range conns {
+		conn.abort()
+	}
 	return nil
 }
 
+// AcceptTCP waits for and returns the next connection. Once l has been closed,
+// it returns an error which matches net.ErrClosed from the standard library.
+// If the deadline set with SetDeadline passes first, it returns a timeout
+// error.
 func (l *Listener) AcceptTCP() (*Conn, error) {
 	l.mu.Lock()
 LOOP:
@@ -51,9 +114,12 @@ LOOP:
 		switch {
 		case l.closed:
 			l.mu.Unlock()
-			return nil, errors.New("accept on closed Listener")
+			return nil, errors.Annotate(stdnet.ErrClosed, "accept")
 		case len(l.conns) > 0:
 			break LOOP
+		case reachedDeadline(l.deadline):
+			l.mu.Unlock()
+			return nil, timeoutErr
 		}
 		l.cond.Wait()
 	}
@@ -63,15 +129,156 @@ LOOP:
 	return conn, nil
 }
 
-func (l *Listener) accept(conn *Conn) bool {
+// Accept implements the net.Listener Accept method. The returned connection
+// is a *NetConn.
+func (l *Listener) Accept() (stdnet.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return NewNetConn(conn), nil
+}
+
+// SetDeadline sets the deadline for pending and future calls to AcceptTCP and
+// Accept. Once it has passed, they return a timeout error rather than waiting
+// for a connection. A zero value for t means they will not time out.
+func (l *Listener) SetDeadline(t time.Time) {
+	t = timeToMonotonic(t)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deadline = t
+	if l.dhandle != nil {
+		l.dhandle.Cancel()
+		l.dhandle = nil
+	}
+	if t == (time.Time{}) || l.closed {
+		return
+	}
+	l.dhandle = l.timeoutd.AddTimeout(l.deadlineTimeout, t)
+}
+
+// deadlineTimeout is called when the deadline passes;
+// it wakes any pending calls to AcceptTCP.
+func (l *Listener) deadlineTimeout() { l.dhandle = nil; l.cond.Broadcast() }
+
+// Addr implements the net.Listener Addr method. The returned address is a
+// *net.TCPAddr.
+func (l *Listener) Addr() stdnet.Addr {
+	return l.addr.tcpAddr()
+}
+
+// SetSYNBacklog sets the maximum number of half-open connections; SYNs which
+// would open a new connection beyond this limit are dropped. It does not
+// affect connections which are already half-open.
+func (l *Listener) SetSYNBacklog(n int) {
+	l.mu.Lock()
+	l.synBacklog = n
+	l.mu.Unlock()
+}
+
+// SetMSSClamp sets the MSS clamp of connections subsequently accepted by l,
+// overriding the host's (see Host.SetMSSClamp). If mss is 0, the host's
+// clamp is used.
+func (l *Listener) SetMSSClamp(mss uint16) {
+	l.mu.Lock()
+	l.mssClamp = mss
+	l.mu.Unlock()
+}
+
+// SetInitialCwnd sets the initial congestion window, in segments, of
+// connections subsequently accepted by l, overriding the host's (see
+// Host.SetInitialCwnd). If segments is 0, the host's is used.
+func (l *Listener) SetInitialCwnd(segments int) {
+	l.mu.Lock()
+	l.initCwnd = segments
+	l.mu.Unlock()
+}
+
+// SetMaxConns sets the maximum number of connections accepted by l which may
+// be open at once, counting each from the time its handshake completes until
+// it is closed or enters TIME_WAIT, whether or not it has been returned by
+// AcceptTCP. While l is at the limit, connections completing their handshake
+// are reset. Unlike the backlog, this bounds the resources held by accepted
+// connections as well as queued ones. Connections which are already open are
+// unaffected by a smaller limit. If n is 0, which is the default, there is no
+// limit.
+func (l *Listener) SetMaxConns(n int) {
+	l.mu.Lock()
+	l.maxConns = n
+	l.mu.Unlock()
+}
+
+// NumConns returns the number of open connections
+// which count toward the limit set with SetMaxConns.
+func (l *Listener) NumConns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nconns
+}
+
+// AcceptQueueLen returns the number of established
+// connections waiting to be accepted.
+func (l *Listener) AcceptQueueLen() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns)
+}
+
+// SYNQueueLen returns the number of half-open connections.
+func (l *Listener) SYNQueueLen() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.halfOpen
+}
+
+// synReceived reserves room for a new half-open connection,
+// returning false if there is none.
+func (l *Listener) synReceived() bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	// don't need to check for l being closed because
 	// l.Close removes l from the host, which means
-	// l.accept is never called after l.Close
-	if len(l.conns) >= listenQueueLen {
+	// l.synReceived is never called after l.Close
+	if l.halfOpen >= l.synBacklog {
 		return false
 	}
-	l.conns = append(l.conns, conn)
+	l.halfOpen++
 	return true
 }
+
+// established moves conn, which has just completed its handshake, from the
+// SYN queue to the accept queue. If the accept queue is full, it returns false,
+// and conn should remain half-open. If l is at its connection limit, it returns
+// false and reset true, and conn should be reset. Once it returns true, conn
+// counts toward the limit until it calls l.released.
+func (l *Listener) established(conn *Conn) (ok, reset bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || len(l.conns) >= l.backlog {
+		return false, false
+	}
+	if l.maxConns > 0 && l.nconns >= l.maxConns {
+		return false, true
+	}
+	l.halfOpen--
+	l.nconns++
+	l.conns = append(l.conns, conn)
+	l.cond.Broadcast()
+	return true, false
+}
+
+// released is called when a connection which
+// was counted by established is no longer open.
+func (l *Listener) released() {
+	l.mu.Lock()
+	l.nconns--
+	l.mu.Unlock()
+}
+
+// abandoned removes a half-open connection which was closed
+// before completing its handshake from the SYN queue.
+func (l *Listener) abandoned() {
+	l.mu.Lock()
+	l.halfOpen--
+	l.mu.Unlock()
+}
@@ -0,0 +1,126 @@
+package tcp
+
+import (
+	"context"
+	stdnet "net"
+	"strconv"
+	"time"
+
+	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/errors"
+)
+
+// A NetConn adapts a Conn to the net.Conn interface from the standard
+// library's net package so that it can be used with existing code such as
+// HTTP clients and servers or TLS. Its addresses are *net.TCPAddrs. The
+// embedded Conn can be used to access TCP-specific functionality such as
+// SetNoDelay.
+type NetConn struct {
+	*Conn
+}
+
+var _ stdnet.Conn = (*NetConn)(nil)
+var _ stdnet.Listener = (*Listener)(nil)
+
+// NewNetConn returns a NetConn which wraps c.
+func NewNetConn(c *Conn) *NetConn {
+	return &NetConn{c}
+}
+
+// LocalAddr implements the net.Conn LocalAddr method.
+func (c *NetConn) LocalAddr() stdnet.Addr {
+	return c.local.tcpAddr()
+}
+
+// RemoteAddr implements the net.Conn RemoteAddr method.
+func (c *NetConn) RemoteAddr() stdnet.Addr {
+	return c.remote.tcpAddr()
+}
+
+// SetDeadline implements the net.Conn SetDeadline method. Once the deadline
+// passes, blocked and future calls to Read and Write return an error for
+// which net.IsTimeout returns true.
+func (c *NetConn) SetDeadline(t time.Time) error {
+	c.Conn.SetDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+func (c *NetConn) SetReadDeadline(t time.Time) error {
+	c.Conn.SetReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+func (c *NetConn) SetWriteDeadline(t time.Time) error {
+	c.Conn.SetWriteDeadline(t)
+	return nil
+}
+
+// DialContext connects to the given address, which must be an IP address and
+// port such as "10.0.0.1:80" or "[fe80::1]:80", and returns the connection as
+// a *NetConn. network must be "tcp", "tcp4", or "tcp6"; "tcp4" and "tcp6"
+// only allow addresses of the corresponding IP version. If ctx has a
+// deadline, the handshake is abandoned with a timeout error once it passes,
+// and if ctx is canceled, the handshake is abandoned immediately. Once the
+// connection is established, ctx has no effect on it. DialContext can be used
+// as the DialContext field of an http.Transport.
+func (host *Host) DialContext(ctx context.Context, network, address string) (stdnet.Conn, error) {
+	addr, port, err := parseAddress(network, address)
+	if err != nil {
+		return nil, errors.Annotate(err, "dial")
+	}
+	deadline, _ := ctx.Deadline()
+	c, err := host.dial(addr, port, deadline, ctx.Done())
+	if err != nil {
+		return nil, err
+	}
+	return NewNetConn(c), nil
+}
+
+// DialTimeout is like DialContext, but the handshake is abandoned with a
+// timeout error if it hasn't completed after the given timeout.
+func (host *Host) DialTimeout(network, address string, timeout time.Duration) (stdnet.Conn, error) {
+	addr, port, err := parseAddress(network, address)
+	if err != nil {
+		return nil, errors.Annotate(err, "dial")
+	}
+	c, err := host.DialTCP(addr, port, time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	return NewNetConn(c), nil
+}
+
+// parseAddress parses an address of the form "host:port", where host is an IP
+// address whose version is allowed by network.
+func parseAddress(network, address string) (addr net.IP, port Port, err error) {
+	var version int
+	switch network {
+	case "tcp":
+	case "tcp4":
+		version = 4
+	case "tcp6":
+		version = 6
+	default:
+		return nil, 0, errors.Errorf("unsupported network: %v", network)
+	}
+	host, portstr, err := stdnet.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	addr = fromStdIP(stdnet.ParseIP(host))
+	if addr == nil || (version != 0 && addr.IPVersion() != version) {
+		return nil, 0, errors.Errorf("not a %v address: %v", network, host)
+	}
+	p, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, 0, errors.Errorf("invalid port: %v", portstr)
+	}
+	return addr, Port(p), nil
+}
+
+// tcpAddr converts t to a *net.TCPAddr.
+func (t twoTuple) tcpAddr() *stdnet.TCPAddr {
+	return &stdnet.TCPAddr{IP: toStdIP(t.addr), Port: int(t.port)}
+}
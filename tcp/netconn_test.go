@@ -0,0 +1,912 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"io"
+	"math/rand"
+	stdnet "net"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net"
+)
+
+// newLoopbackHost creates a Host on a Stack with
+// an up LoopbackDevice addressed 127.0.0.1/8.
+func newLoopbackHost(t testing.TB) (host *Host, lo *net.LoopbackDevice) {
+	lo, err := net.NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	lo.SetIPv4(net.IPv4{127, 0, 0, 1}, net.IPv4{255, 0, 0, 0})
+	s := net.NewStack(net.StackOptions{})
+	if err := s.AddDevice("lo", lo); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	host, err = NewIPv4Host(s.IPv4Host)
+	if err != nil {
+		t.Fatalf("could not create host: %v", err)
+	}
+	return host, lo
+}
+
+func TestStackOptions(t *testing.T) {
+	opts := net.StackOptions{
+		MSL:              time.Second,
+		InitialCwnd:      4,
+		MinRTO:           200 * time.Millisecond,
+		MaxRTO:           10 * time.Second,
+		EphemeralPortMin: 50000,
+		EphemeralPortMax: 50009,
+		MaxWindowScale:   2,
+		KeepAlive:        true,
+		KeepAlivePeriod:  30 * time.Second,
+	}
+	lo, err := net.NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	lo.SetIPv4(net.IPv4{127, 0, 0, 1}, net.IPv4{255, 0, 0, 0})
+	s := net.NewStack(opts)
+	if err := s.AddDevice("lo", lo); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer lo.BringDown()
+	host, err := NewStackHost(s)
+	if err != nil {
+		t.Fatalf("could not create host: %v", err)
+	}
+	defer host.Close()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	// a large receive buffer would ordinarily call for a larger window scale
+	host.SetReadBuffer(1 << 20)
+	c, err := host.DialTCP(net.IPv4{127, 0, 0, 1}, 80, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rtt.min != opts.MinRTO || c.rtt.max != opts.MaxRTO || c.rtt.rto < opts.MinRTO {
+		t.Errorf("unexpected RTO bounds: got [%v, %v] (RTO %v); want [%v, %v]",
+			c.rtt.min, c.rtt.max, c.rtt.rto, opts.MinRTO, opts.MaxRTO)
+	}
+	if c.msl != opts.MSL {
+		t.Errorf("unexpected MSL: got %v; want %v", c.msl, opts.MSL)
+	}
+	if c.initCwnd != opts.InitialCwnd {
+		t.Errorf("unexpected initial window: got %v; want %v", c.initCwnd, opts.InitialCwnd)
+	}
+	if port := c.local.port; port < 50000 || port > 50009 {
+		t.Errorf("unexpected local port: got %v; want one in [50000, 50009]", port)
+	}
+	if c.rcvShift != opts.MaxWindowScale || c.rcvBufSize > 0xFFFF<<opts.MaxWindowScale {
+		t.Errorf("unexpected window scale: got %v (buffer size %v); want %v", c.rcvShift, c.rcvBufSize, opts.MaxWindowScale)
+	}
+	// the keepalive timer starts once the connection is established
+	if !c.keepAlive || c.keepAlivePeriod != opts.KeepAlivePeriod || c.kaHandle == nil {
+		t.Errorf("unexpected keepalive state: got %v, period %v, timer running %v; want %v, period %v, timer running",
+			c.keepAlive, c.keepAlivePeriod, c.kaHandle != nil, opts.KeepAlive, opts.KeepAlivePeriod)
+	}
+
+	opts.MinRTO = time.Minute
+	if _, err := NewStackHost(net.NewStack(opts)); err == nil {
+		t.Errorf("no error creating host with minimum RTO greater than maximum")
+	}
+}
+
+func TestJumboMTU(t *testing.T) {
+	const mtu = 9000
+	lo, err := net.NewLoopbackDevice(mtu)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	lo.SetIPv4(net.IPv4{127, 0, 0, 1}, net.IPv4{255, 0, 0, 0})
+	lo.SetIPv6(net.IPv6{15: 1}, net.IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	s := net.NewStack(net.StackOptions{})
+	if err := s.AddDevice("lo", lo); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	defer lo.BringDown()
+	// record the largest TCP payload sent
+	var mu sync.Mutex
+	var largest int
+	s.SetOutboundHook(func(pkt []byte) ([]byte, bool) {
+		if len(pkt) > mtu {
+			t.Errorf("packet of %v bytes exceeds MTU", len(pkt))
+		}
+		iplen := ipv6HeaderLen
+		if pkt[0]>>4 == 4 {
+			iplen = int(pkt[0]&0xF) * 4
+		}
+		n := len(pkt) - iplen - int(pkt[iplen+12]>>4)*4
+		mu.Lock()
+		if n > largest {
+			largest = n
+		}
+		mu.Unlock()
+		return pkt, false
+	})
+	host, err := NewHost(&s.IPHost)
+	if err != nil {
+		t.Fatalf("could not create host: %v", err)
+	}
+	defer host.Close()
+
+	for _, tc := range []struct {
+		addr     net.IP
+		iphdrlen int
+	}{
+		{net.IPv4{127, 0, 0, 1}, ipv4HeaderLen},
+		{net.IPv6{15: 1}, ipv6HeaderLen},
+	} {
+		mu.Lock()
+		largest = 0
+		mu.Unlock()
+
+		l, err := host.ListenTCP(tc.addr, 80, 0)
+		if err != nil {
+			t.Fatalf("%v: unexpected error listening: %v", tc.addr, err)
+		}
+		defer l.Close()
+		c, err := host.DialTCP(tc.addr, 80, time.Now().Add(5*time.Second))
+		if err != nil {
+			t.Fatalf("%v: unexpected error dialing: %v", tc.addr, err)
+		}
+		defer c.Close()
+		ac, err := l.AcceptTCP()
+		if err != nil {
+			t.Fatalf("%v: unexpected error accepting: %v", tc.addr, err)
+		}
+		defer ac.Close()
+
+		data := make([]byte, 1<<20)
+		rand.Read(data)
+		go func() {
+			c.Write(data)
+			c.CloseWrite()
+		}()
+		got, err := io.ReadAll(ac)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%v: data corrupted in transit: got %v bytes (err: %v); want %v", tc.addr, len(got), err, len(data))
+		}
+
+		c.mu.Lock()
+		mss := c.sendMSS()
+		c.mu.Unlock()
+		// the MSS is the MTU less the IP and TCP headers,
+		// and the timestamp option carried by every segment
+		if want := mtu - tc.iphdrlen - tcpHeaderLen - timestampOptionLen; mss != want {
+			t.Errorf("%v: unexpected MSS: got %v; want %v", tc.addr, mss, want)
+		}
+		mu.Lock()
+		if largest != mss {
+			t.Errorf("%v: unexpected largest segment: got %v bytes; want %v", tc.addr, largest, mss)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestNetConnHTTP(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	if addr := l.Addr().String(); addr != "127.0.0.1:80" {
+		t.Errorf("unexpected listener address: got %v; want 127.0.0.1:80", addr)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(http.LocalAddrContextKey).(*stdnet.TCPAddr); !ok {
+			t.Errorf("local address is not a *net.TCPAddr")
+		}
+		io.WriteString(w, "hello from "+r.RemoteAddr)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	var local string
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: host.DialContext},
+		Timeout:   5 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://127.0.0.1/")
+		if err != nil {
+			t.Fatalf("unexpected error making request: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading response: %v", err)
+		}
+		// the second request reuses the first connection
+		if i == 0 {
+			local = string(body)
+		} else if string(body) != local {
+			t.Errorf("unexpected response to second request: got %q; want %q", body, local)
+		}
+	}
+	if want := "hello from 127.0.0.1:"; len(local) <= len(want) || local[:len(want)] != want {
+		t.Errorf("unexpected response: got %q; want %q followed by a port", local, want)
+	}
+}
+
+func TestNetConnDeadline(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	c, err := host.DialContext(context.Background(), "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	if raddr := c.RemoteAddr().(*stdnet.TCPAddr); raddr.String() != "127.0.0.1:80" {
+		t.Errorf("unexpected remote address: got %v; want 127.0.0.1:80", raddr)
+	}
+
+	// a blocked read is interrupted by the deadline
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	res := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		if nerr, ok := err.(stdnet.Error); !ok || !nerr.Timeout() {
+			t.Errorf("unexpected error from read past deadline: got %v; want timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read not interrupted by deadline")
+	}
+
+	if _, err := host.DialContext(context.Background(), "udp", "127.0.0.1:80"); err == nil {
+		t.Errorf("no error dialing unsupported network")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	c, err := host.DialTimeout("tcp", "127.0.0.1:80", 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	c.Close()
+
+	// nothing answers SYNs sent through a testIPv4Host
+	const timeout = 100 * time.Millisecond
+	bh, _ := NewIPv4Host(new(testIPv4Host))
+	start := time.Now()
+	if _, err := bh.DialTimeout("tcp", "10.0.0.1:80", timeout); !net.IsTimeout(err) {
+		t.Errorf("unexpected error dialing black hole: got %v; want timeout", err)
+	}
+	if d := time.Since(start); d < timeout {
+		t.Errorf("dial timed out after %v; want at least %v", d, timeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(timeout, cancel)
+	start = time.Now()
+	if _, err := bh.DialContext(ctx, "tcp", "10.0.0.1:80"); err == nil || net.IsTimeout(err) {
+		t.Errorf("unexpected error from canceled dial: got %v; want cancellation", err)
+	}
+	if d := time.Since(start); d < timeout {
+		t.Errorf("dial canceled after %v; want at least %v", d, timeout)
+	}
+	waitFor(t, "abandoned connections to be removed", func() bool {
+		bh.mu.RLock()
+		defer bh.mu.RUnlock()
+		return len(bh.conns) == 0
+	})
+}
+
+func TestListenerServe(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 8080, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello, "+r.URL.Path[1:])
+		}))
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: host.DialContext, DisableKeepAlives: true},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get("http://127.0.0.1:8080/world")
+	if err != nil {
+		t.Fatalf("unexpected error making request: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "hello, world" {
+		t.Errorf("unexpected response: got %q (err: %v); want %q", body, err, "hello, world")
+	}
+
+	// closing the listener unblocks the pending Accept in http.Serve
+	l.Close()
+	select {
+	case err := <-served:
+		if !stderrors.Is(err, stdnet.ErrClosed) {
+			t.Errorf("unexpected error from Serve: got %v; want %v", err, stdnet.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after listener was closed")
+	}
+	if err := l.Close(); err == nil {
+		t.Errorf("no error closing already-closed listener")
+	}
+}
+
+func TestListenerDeadline(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+
+	// with no incoming connection, a pending accept
+	// is interrupted by the deadline
+	const timeout = 50 * time.Millisecond
+	l.SetDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	res := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		if nerr, ok := err.(stdnet.Error); !ok || !nerr.Timeout() {
+			t.Errorf("unexpected error from accept past deadline: got %v; want timeout", err)
+		}
+		if d := time.Since(start); d < timeout {
+			t.Errorf("accept timed out after %v; want at least %v", d, timeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("accept not interrupted by deadline")
+	}
+
+	// clearing the deadline lets accept block again
+	l.SetDeadline(time.Time{})
+	c, err := host.DialContext(context.Background(), "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	ac, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %v", err)
+	}
+	ac.Close()
+}
+
+func TestListenerMaxConns(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	const max = 2
+	l.SetMaxConns(max)
+
+	// dial returns the client and server sides of a new connection
+	dial := func() (c, s *Conn) {
+		c, err := host.DialTCP(net.IPv4{127, 0, 0, 1}, 80, time.Now().Add(5*time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error dialing: %v", err)
+		}
+		s, err = l.AcceptTCP()
+		if err != nil {
+			t.Fatalf("unexpected error accepting: %v", err)
+		}
+		return c, s
+	}
+
+	var clients, servers []*Conn
+	for i := 0; i < max; i++ {
+		c, s := dial()
+		defer c.Close()
+		defer s.Close()
+		clients, servers = append(clients, c), append(servers, s)
+	}
+	if n := l.NumConns(); n != max {
+		t.Errorf("unexpected number of connections: got %v; want %v", n, max)
+	}
+
+	// beyond the limit, connections are reset once their handshake
+	// completes, which may happen before DialTCP returns
+	c, err := host.DialTCP(net.IPv4{127, 0, 0, 1}, 80, time.Now().Add(5*time.Second))
+	if err == nil {
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.Read(make([]byte, 1))
+	}
+	if !net.IsConnReset(err) {
+		t.Errorf("unexpected error from connection beyond limit: got %v; want connection reset", err)
+	}
+	if l.AcceptQueueLen() != 0 {
+		t.Errorf("connection beyond limit queued to be accepted")
+	}
+
+	// the established connections are unaffected
+	for i, c := range clients {
+		if _, err := c.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("unexpected error writing to connection %v: %v", i, err)
+		}
+		b := make([]byte, 1)
+		servers[i].SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := servers[i].Read(b); err != nil || b[0] != byte(i) {
+			t.Errorf("unexpected read from connection %v: got %v, %v; want %v, <nil>", i, b[0], err, i)
+		}
+	}
+
+	// once a connection is closed, there is room for another
+	clients[0].Close()
+	servers[0].Close()
+	for start := time.Now(); l.NumConns() == max; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("closed connection still counted")
+		}
+	}
+	c, s := dial()
+	c.Close()
+	s.Close()
+}
+
+func TestListenerCloseResetsQueued(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	c, err := host.DialTCP(net.IPv4{127, 0, 0, 1}, 80, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	// the server side of the connection is in the accept queue once the
+	// client's ACK of its SYN-ACK has been delivered
+	for start := time.Now(); l.AcceptQueueLen() == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("connection never established")
+		}
+	}
+
+	l.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); !net.IsConnReset(err) {
+		t.Errorf("unexpected error reading from connection reset by closed listener: got %v; want connection reset", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	c, err := host.DialTCP(net.IPv4{127, 0, 0, 1}, 80, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	s, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %v", err)
+	}
+	defer s.Close()
+
+	const idle = 100 * time.Millisecond
+	c.SetIdleTimeout(idle)
+	res := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		res <- err
+	}()
+
+	// a connection which is written to more often than the idle timeout
+	// stays open
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, s)
+		copied <- err
+	}()
+	for start := time.Now(); time.Since(start) < 3*idle; time.Sleep(idle / 5) {
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatalf("unexpected error writing to active connection: %v", err)
+		}
+	}
+	select {
+	case err := <-res:
+		t.Fatalf("active connection closed: %v", err)
+	default:
+	}
+
+	// once it goes idle, it is reset, and the blocked read fails
+	select {
+	case err := <-res:
+		if !stderrors.Is(err, net.ErrIdleTimeout) {
+			t.Errorf("unexpected error from read on idle connection: got %v; want idle timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle connection not closed")
+	}
+	if _, err := c.Write([]byte("ping")); !stderrors.Is(err, net.ErrIdleTimeout) {
+		t.Errorf("unexpected error from write on idle connection: got %v; want idle timeout", err)
+	}
+	select {
+	case err := <-copied:
+		if !net.IsConnReset(err) {
+			t.Errorf("unexpected error reading from peer of idle connection: got %v; want connection reset", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("peer of idle connection not reset")
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	host, lo := newLoopbackHost(t)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	c, err := host.DialTCP(net.IPv4{127, 0, 0, 1}, 80, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	s, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %v", err)
+	}
+	defer s.Close()
+
+	const (
+		interval = 100 * time.Millisecond
+		chunk    = 16 << 10
+	)
+	// everything must happen within throughputSamples intervals of
+	// starting to sample, or the ring overwrites the earliest samples
+	sampling := time.Now()
+	c.SetThroughputInterval(interval)
+	s.SetThroughputInterval(interval)
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, s)
+		copied <- err
+	}()
+
+	// write at a steady rate for five intervals
+	var total uint64
+	start := time.Now()
+	for time.Since(start) < 5*interval {
+		if _, err := c.Write(make([]byte, chunk)); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		total += chunk
+		time.Sleep(interval / 5)
+	}
+	want := float64(total) / time.Since(start).Seconds()
+	// wait for the last of the data to be read and
+	// acknowledged, and then for another sample
+	deadline := sampling.Add((throughputSamples - 3) * interval)
+	for ; c.Stats().BytesAcked != total || s.Stats().BytesRead != total; time.Sleep(interval / 5) {
+		if time.Now().After(deadline) {
+			t.Fatalf("data not delivered: %+v", c.Stats())
+		}
+	}
+	time.Sleep(2 * interval)
+
+	// check checks that the samples account for all of the data, and that
+	// the median rate of those taken while data was being written is
+	// within tolerance of the rate at which it was written
+	check := func(name string, samples []Sample, bytes func(Sample) uint64, rate func(Sample) float64) {
+		if len(samples) < 5 || len(samples) > throughputSamples {
+			t.Fatalf("%v: unexpected number of samples: %v", name, len(samples))
+		}
+		var sum uint64
+		var rates []float64
+		for _, smp := range samples {
+			sum += bytes(smp)
+			if bytes(smp) > 0 {
+				rates = append(rates, rate(smp))
+			}
+		}
+		if sum != total {
+			t.Errorf("%v: samples account for %v bytes; want %v", name, sum, total)
+		}
+		if last := samples[len(samples)-1].Time; last.Before(start) || last.After(time.Now()) {
+			t.Errorf("%v: last sample taken at %v; want between %v and now", name, last, start)
+		}
+		sort.Float64s(rates)
+		if got := rates[len(rates)/2]; got < want/2 || got > want*2 {
+			t.Errorf("%v: unexpected median rate: got %.0f bytes/s; want about %.0f", name, got, want)
+		}
+	}
+	check("read", s.Throughput(), func(smp Sample) uint64 { return smp.Read }, Sample.ReadRate)
+	check("acked", c.Throughput(), func(smp Sample) uint64 { return smp.Acked }, Sample.AckRate)
+
+	// disabling sampling discards the samples
+	s.SetThroughputInterval(0)
+	if samples := s.Throughput(); len(samples) != 0 {
+		t.Errorf("unexpected samples after disabling sampling: %+v", samples)
+	}
+	c.Close()
+	if err := <-copied; err != nil {
+		t.Errorf("unexpected error reading: %v", err)
+	}
+}
+
+// newUDPStackPair creates two Stacks, each with a Host, linked by a
+// UDPIPv4Device addressed 10.0.0.x/24 and a UDPIPv6Device addressed
+// fd00::x/64, where x is 1 for a and 2 for b.
+func newUDPStackPair(t *testing.T) (a, b *Host) {
+	freeUDPAddr := func() *stdnet.UDPAddr {
+		conn, err := stdnet.ListenUDP("udp", &stdnet.UDPAddr{IP: stdnet.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("could not listen on UDP: %v", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*stdnet.UDPAddr)
+	}
+	addra4, addrb4 := freeUDPAddr(), freeUDPAddr()
+	addra6, addrb6 := freeUDPAddr(), freeUDPAddr()
+	var hosts []*Host
+	for i, addrs := range [][4]*stdnet.UDPAddr{{addra4, addrb4, addra6, addrb6}, {addrb4, addra4, addrb6, addra6}} {
+		dev4, err := net.NewUDPIPv4Device(addrs[0], addrs[1], 1500)
+		if err != nil {
+			t.Fatalf("could not create device: %v", err)
+		}
+		dev6, err := net.NewUDPIPv6Device(addrs[2], addrs[3], 1500)
+		if err != nil {
+			t.Fatalf("could not create device: %v", err)
+		}
+		dev4.SetIPv4(net.IPv4{10, 0, 0, byte(i + 1)}, net.IPv4{255, 255, 255, 0})
+		dev6.SetIPv6(net.IPv6{0: 0xfd, 15: byte(i + 1)}, net.IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		s := net.NewStack(net.StackOptions{})
+		s.AddDevice("udp4:0", dev4)
+		s.AddDevice("udp6:0", dev6)
+		for _, dev := range []net.Device{dev4, dev6} {
+			if err := dev.BringUp(); err != nil {
+				t.Fatalf("could not bring device up: %v", err)
+			}
+			t.Cleanup(func() { dev.BringDown() })
+		}
+		host, err := NewHost(&s.IPHost)
+		if err != nil {
+			t.Fatalf("could not create host: %v", err)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts[0], hosts[1]
+}
+
+func TestListenDualStack(t *testing.T) {
+	client, server := newUDPStackPair(t)
+	var (
+		clientAddr4 = net.IPv4{10, 0, 0, 1}
+		serverAddr4 = net.IPv4{10, 0, 0, 2}
+		clientAddr6 = net.IPv6{0: 0xfd, 15: 1}
+		serverAddr6 = net.IPv6{0: 0xfd, 15: 2}
+	)
+
+	// dial connects to addr:port, checks that a connection is accepted by l
+	// with the given local and remote addresses, and exchanges data over it
+	dial := func(l *Listener, addr net.IP, port Port, local, remote net.IP) {
+		c, err := client.DialTCP(addr, port, time.Now().Add(5*time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error dialing %v: %v", addr, err)
+		}
+		defer c.Close()
+		s, err := l.AcceptTCP()
+		if err != nil {
+			t.Fatalf("unexpected error accepting: %v", err)
+		}
+		defer s.Close()
+		ns := NewNetConn(s)
+		if got, want := ns.LocalAddr().String(), (twoTuple{addr: local, port: port}).tcpAddr().String(); got != want {
+			t.Errorf("unexpected local address: got %v; want %v", got, want)
+		}
+		if got := ns.RemoteAddr().(*stdnet.TCPAddr); fromStdIP(got.IP) != remote || got.Port != int(NewNetConn(c).LocalAddr().(*stdnet.TCPAddr).Port) {
+			t.Errorf("unexpected remote address: got %v; want %v with the client's port", got, remote)
+		}
+		c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(s, b); err != nil || string(b) != "hello" {
+			t.Errorf("unexpected data: got %q (err: %v); want %q", b, err, "hello")
+		}
+	}
+
+	l, err := server.ListenDualStack(80, 0, false)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	if addr := l.Addr().String(); addr != "[::]:80" {
+		t.Errorf("unexpected listener address: got %v; want [::]:80", addr)
+	}
+	dial(l, serverAddr4, 80, serverAddr4, clientAddr4)
+	dial(l, serverAddr6, 80, serverAddr6, clientAddr6)
+	if _, err := server.ListenTCP(net.IPv4{}, 80, 0); err == nil {
+		t.Errorf("no error listening on a port in use by a dual-stack listener")
+	}
+
+	// a more specific listener takes precedence
+	l4, err := server.ListenTCP(serverAddr4, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	dial(l4, serverAddr4, 80, serverAddr4, clientAddr4)
+	l4.Close()
+
+	l6, err := server.ListenDualStack(81, 0, true)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l6.Close()
+	dial(l6, serverAddr6, 81, serverAddr6, clientAddr6)
+	if _, err := client.DialTCP(serverAddr4, 81, time.Now().Add(5*time.Second)); !net.IsConnRefused(err) {
+		t.Errorf("unexpected error dialing IPv4 to an IPv6-only listener: got %v; want connection refused", err)
+	}
+	// the IPv4 port is still free
+	l4, err = server.ListenTCP(net.IPv4{}, 81, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening on IPv4 alongside an IPv6-only listener: %v", err)
+	}
+	l4.Close()
+}
+
+// A testResolver resolves names from a fixed table.
+type testResolver map[string][]net.IP
+
+func (r testResolver) LookupHost(host string) ([]net.IP, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, net.ErrNoSuchHost
+	}
+	return addrs, nil
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	client, server := newUDPStackPair(t)
+	// nothing answers at the IPv6 address, so the IPv4
+	// attempt, which starts after delay, wins the race
+	blackHole6 := net.IPv6{0: 0xfd, 15: 3}
+	serverAddr4 := net.IPv4{10, 0, 0, 2}
+	client.SetResolver(testResolver{"server.example": {serverAddr4, blackHole6}})
+	client.SetHappyEyeballsDelay(delay)
+
+	l, err := server.ListenDualStack(80, 0, false)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+
+	start := time.Now()
+	c, err := client.DialHappyEyeballs("server.example", 80)
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	if d := time.Since(start); d < delay {
+		t.Errorf("connected after %v; want the IPv6 attempt to get a %v head start", d, delay)
+	}
+	if raddr := NewNetConn(c).RemoteAddr().String(); raddr != "10.0.0.2:80" {
+		t.Errorf("unexpected remote address: got %v; want 10.0.0.2:80", raddr)
+	}
+
+	// the IPv6 attempt is abandoned
+	waitFor(t, "IPv6 attempt to be abandoned", func() bool {
+		client.mu.RLock()
+		defer client.mu.RUnlock()
+		for fourtuple := range client.conns {
+			if fourtuple.src.IPVersion() == 6 {
+				return false
+			}
+		}
+		return true
+	})
+
+	if _, err := client.DialHappyEyeballs("missing.example", 80); !net.IsNoSuchHost(err) {
+		t.Errorf("unexpected error dialing nonexistent host: got %v; want no such host", err)
+	}
+}
+
+// BenchmarkWrite measures the cost of sending 1MB with a single Write over
+// a loopback device, including segmenting it and reading it on the other side.
+func BenchmarkWrite(b *testing.B) {
+	host, lo := newLoopbackHost(b)
+	defer lo.BringDown()
+
+	l, err := host.ListenTCP(net.IPv4{127, 0, 0, 1}, 80, 0)
+	if err != nil {
+		b.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+	c, err := host.DialTCP(net.IPv4{127, 0, 0, 1}, 80, time.Time{})
+	if err != nil {
+		b.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	s, err := l.AcceptTCP()
+	if err != nil {
+		b.Fatalf("unexpected error accepting: %v", err)
+	}
+	defer s.Close()
+
+	buf, rbuf := make([]byte, 1<<20), make([]byte, 1<<20)
+	done := make(chan error, 1)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		go func() {
+			_, err := io.ReadFull(s, rbuf)
+			done <- err
+		}()
+		if _, err := c.Write(buf); err != nil {
+			b.Fatalf("unexpected error writing: %v", err)
+		}
+		if err := <-done; err != nil {
+			b.Fatalf("unexpected error reading: %v", err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package tcp
+
+import (
+	stdnet "net"
+)
+
+// NegotiatedOptions describes the parameters of a connection which were
+// agreed upon in the three-way handshake, as returned by
+// (*Conn).NegotiatedOptions.
+type NegotiatedOptions struct {
+	LocalAddr  *stdnet.TCPAddr
+	RemoteAddr *stdnet.TCPAddr
+
+	// the maximum segment size advertised by the other side,
+	// after clamping; see (*Listener).SetMSSClamp
+	MSS int
+
+	// whether window scaling is in use, and if so, the shift
+	// applied to windows advertised by each side
+	// See https://tools.ietf.org/html/rfc7323#section-2
+	WindowScaling  bool
+	SndWindowScale uint8 // the other side's window scale
+	RcvWindowScale uint8 // our window scale
+
+	// See https://tools.ietf.org/html/rfc7323#section-3
+	Timestamps bool
+	// See https://tools.ietf.org/html/rfc3168#section-6.1.1
+	ECN bool
+	// whether selective acknowledgements are in use, both to report
+	// out-of-order and duplicate segments (DSACK) and to choose what
+	// to retransmit during fast recovery
+	// See https://tools.ietf.org/html/rfc2018 and
+	// https://tools.ietf.org/html/rfc2883
+	SACK bool
+}
+
+// snapshotOptions records the results of the handshake
+// in conn.negotiated. It is called with mu held.
+func (conn *Conn) snapshotOptions() {
+	conn.negotiated = &NegotiatedOptions{
+		LocalAddr:     conn.local.tcpAddr(),
+		RemoteAddr:    conn.remote.tcpAddr(),
+		MSS:           int(conn.mss),
+		WindowScaling: conn.wsOK,
+		Timestamps:    conn.tsOK,
+		ECN:           conn.ecnOK,
+		SACK:          conn.sackOK,
+	}
+	if conn.wsOK {
+		conn.negotiated.SndWindowScale = conn.sndShift
+		conn.negotiated.RcvWindowScale = conn.rcvShift
+	}
+}
+
+// NegotiatedOptions returns the options agreed upon in the handshake which
+// established conn. The second return value is false if the handshake has
+// not yet completed. Once the handshake completes, the returned options
+// never change, even after the connection is closed.
+func (conn *Conn) NegotiatedOptions() (NegotiatedOptions, bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.negotiated == nil {
+		return NegotiatedOptions{}, false
+	}
+	return *conn.negotiated, true
+}
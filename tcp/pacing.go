@@ -0,0 +1,76 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// SetPacing controls whether the connection paces its transmissions. Without
+// pacing, every segment that the congestion and send windows allow is sent
+// at once, which can overrun shallow buffers along the path. With pacing, the
+// segments are instead spread out over the round-trip time, at a rate of one
+// congestion window per smoothed round-trip time. No pacing is done until
+// the round-trip time has been measured. Pacing is off by default.
+func (c *Conn) SetPacing(pacing bool) {
+	c.mu.Lock()
+	c.pacing = pacing
+	if !pacing {
+		c.stopPaceTimer()
+		c.transmit()
+	}
+	c.mu.Unlock()
+}
+
+// pacingRate returns the rate, in bytes per second, at which the connection
+// paces its transmissions, or 0 if it doesn't.
+func (conn *Conn) pacingRate() uint64 {
+	if !conn.pacing || conn.rtt.srtt == 0 || conn.cc == nil {
+		return 0
+	}
+	return uint64(conn.cc.CongestionWindow()) * uint64(time.Second) / uint64(conn.rtt.srtt)
+}
+
+// paced reports whether sending a segment must wait for the pacing timer,
+// starting the timer if it isn't already running.
+func (conn *Conn) paced() bool {
+	if conn.pacingRate() == 0 {
+		return false
+	}
+	if conn.paceHandle != nil {
+		return true
+	}
+	if now := timeout.NowMonotonic(); now.Before(conn.paceNext) {
+		conn.paceHandle = conn.timeoutd.AddTimeout(conn.paceTimeout, conn.paceNext)
+		return true
+	}
+	return false
+}
+
+// paceSent records that a segment of n bytes was sent, and computes when the
+// next one may be sent.
+func (conn *Conn) paceSent(n int) {
+	rate := conn.pacingRate()
+	if rate == 0 {
+		return
+	}
+	now := timeout.NowMonotonic()
+	if conn.paceNext.Before(now) {
+		// don't make up for time spent idle with a burst
+		conn.paceNext = now
+	}
+	conn.paceNext = conn.paceNext.Add(time.Duration(uint64(n) * uint64(time.Second) / rate))
+}
+
+// paceTimeout is called when the next segment may be sent.
+func (conn *Conn) paceTimeout() {
+	conn.paceHandle = nil
+	conn.transmit()
+}
+
+func (conn *Conn) stopPaceTimer() {
+	if conn.paceHandle != nil {
+		conn.paceHandle.Cancel()
+		conn.paceHandle = nil
+	}
+}
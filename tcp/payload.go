@@ -0,0 +1,43 @@
+package tcp
+
+import "github.com/joshlf/net/tcp/internal/buffer"
+
+// A payload is the data carried by an outgoing segment: n bytes starting at
+// the given offset into the send buffer. Rather than copying each segment's
+// data out of the send buffer into a slice of its own, only for it to be
+// copied again along with the segment's header, the transmitter describes the
+// data, and output reads it straight into the buffer in which the segment is
+// built. Thus a large write sits in the send buffer as a single unit, and is
+// only carved into segments as the windows allow - and carved afresh, perhaps
+// at a different MSS, when it's retransmitted.
+//
+// A payload is only valid until output returns, since the send buffer may be
+// advanced or overwritten once the Conn's lock is released.
+type payload struct {
+	buf    *buffer.WriteBuffer // nil if the segment carries no data
+	offset int
+	n      int
+}
+
+// sendBufferPayload returns the payload of n bytes starting at sequence
+// number s in conn's send buffer.
+func (conn *Conn) sendBufferPayload(s seq, n int) payload {
+	return payload{buf: &conn.outgoing, offset: int(s - seq(conn.outgoing.Seq())), n: n}
+}
+
+// Len returns the length of p.
+func (p payload) Len() int { return p.n }
+
+// CopyTo copies p into b, which must be at least p.Len() bytes long.
+func (p payload) CopyTo(b []byte) {
+	if p.n > 0 {
+		p.buf.Read(b[:p.n], p.offset)
+	}
+}
+
+// Bytes returns a copy of p.
+func (p payload) Bytes() []byte {
+	b := make([]byte, p.n)
+	p.CopyTo(b)
+	return b
+}
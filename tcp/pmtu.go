@@ -0,0 +1,53 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net/internal/timeout"
+)
+
+const (
+	// the length of the IPv4 and TCP headers without options, which the
+	// MSS doesn't include; see Conn.overhead for other IP versions
+	headerOverhead = ipv4HeaderLen + tcpHeaderLen
+	// how often the path MTU is queried; the IP layer eventually forgets
+	// a reduced path MTU in case the path has changed, and this is how
+	// we find out that we can try sending larger segments again
+	pmtuCheckInterval = time.Minute
+)
+
+// checkPathMTU updates pmtu if it hasn't been checked recently.
+func (conn *Conn) checkPathMTU() {
+	if conn.pathMTU == nil {
+		return
+	}
+	now := timeout.NowMonotonic()
+	if !conn.pmtuChecked.IsZero() && now.Sub(conn.pmtuChecked) < pmtuCheckInterval {
+		return
+	}
+	conn.pmtuChecked = now
+	conn.pmtu = conn.pathMTU()
+}
+
+// pathMTUChanged is called when a segment sent by conn is reported too big
+// for a link on the path, which now has the given MTU. Since the segment
+// was dropped, any outstanding data is retransmitted in smaller segments
+// right away. This is not a sign of congestion, so the congestion window
+// is left alone.
+// See https://tools.ietf.org/html/rfc1191#section-6.4
+func (conn *Conn) pathMTUChanged(mtu int) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if mtu <= 0 || (conn.pmtu > 0 && mtu >= conn.pmtu) {
+		return
+	}
+	conn.pmtu = mtu
+	conn.pmtuChecked = timeout.NowMonotonic()
+	if !conn.sending() || conn.sndUna == conn.sndMax {
+		return
+	}
+	// the retransmitted segments would make any RTT sample ambiguous
+	conn.rttTiming = false
+	conn.sndNxt = conn.sndUna
+	conn.transmit()
+}
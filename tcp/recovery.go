@@ -0,0 +1,132 @@
+package tcp
+
+// the number of duplicate ACKs which trigger fast retransmit
+const dupAckThreshold = 3
+
+// isDupAck reports whether hdr is a duplicate ACK as defined in RFC 5681.
+// See https://tools.ietf.org/html/rfc5681#section-2
+func (conn *Conn) isDupAck(hdr *genericHeader, b []byte) bool {
+	return hdr.ack == conn.sndUna &&
+		conn.sndMax != conn.sndUna &&
+		len(b) == 0 &&
+		!hdr.SYN() && !hdr.FIN() &&
+		conn.sndWindow(hdr) == conn.sndWnd
+}
+
+// flightSize returns the number of bytes which have been sent but not yet
+// acknowledged. See https://tools.ietf.org/html/rfc5681#section-2
+func (conn *Conn) flightSize() uint32 {
+	return uint32(conn.sndMax - conn.sndUna)
+}
+
+// handleDupAck handles a duplicate ACK, entering fast recovery on the third.
+// See https://tools.ietf.org/html/rfc6582#section-3.2
+func (conn *Conn) handleDupAck() {
+	conn.dupAcks++
+	conn.counters.DupAcksReceived++
+	fr, ok := conn.cc.(FastRecovery)
+	switch {
+	case conn.inRecovery:
+		// a lost segment retransmitted in response to the
+		// duplicate ACK takes the place of new data
+		if !conn.retransmitHole() && ok {
+			fr.OnDupAck()
+		}
+	case conn.dupAcks == dupAckThreshold && conn.sndUna.gt(conn.recover):
+		// Only enter recovery if the duplicate ACKs cover more than
+		// the data outstanding when the last recovery began; otherwise
+		// they may belong to the same loss event, and would trigger
+		// another fast retransmit for it.
+		conn.recover = conn.sndMax
+		conn.sackRtxNext = conn.sndUna
+		conn.lossEpisode()
+		if ok {
+			conn.inRecovery = true
+			fr.EnterRecovery(conn.flightSize())
+		} else {
+			conn.cc.OnLoss(conn.flightSize())
+		}
+		conn.retransmitFirst()
+	}
+}
+
+// limitedTransmitWindow returns the congestion window to use in transmit,
+// which is cwnd plus a segment for each of the first two duplicate ACKs. Each
+// allows a segment of new data to be sent without changing cwnd, which, when
+// there are too few segments in flight for a loss to produce three duplicate
+// ACKs, may elicit enough to trigger fast retransmit rather than waiting for
+// the retransmission timer. See https://tools.ietf.org/html/rfc3042#section-2
+func (conn *Conn) limitedTransmitWindow(cwnd uint32) uint32 {
+	if conn.inRecovery || conn.dupAcks == 0 || conn.dupAcks >= dupAckThreshold || conn.sndNxt != conn.sndMax {
+		// only new data may be sent
+		return cwnd
+	}
+	return cwnd + uint32(conn.dupAcks*conn.sendMSS())
+}
+
+// handleRecoveryAck handles an ACK of new data during fast recovery. If it
+// acknowledges everything outstanding when recovery began, recovery is over.
+// Otherwise, it is a partial ACK, which indicates that the next segment was
+// lost as well, so that segment is retransmitted immediately, unless it
+// already has been in response to SACK information.
+func (conn *Conn) handleRecoveryAck() {
+	if conn.sndUna.geq(conn.recover) {
+		conn.inRecovery = false
+		conn.cc.(FastRecovery).ExitRecovery()
+		return
+	}
+	if conn.sndUna.lt(conn.sackRtxNext) {
+		return
+	}
+	conn.retransmitFirst()
+}
+
+// dragRecover is called when an ACK outside of fast recovery advances sndUna
+// from prevUna. Once recover has been reached, it is moved up to just behind
+// sndUna. Otherwise, it would only be updated on a loss, and after 2^31 bytes
+// had been acknowledged without one, comparisons against it would wrap
+// around, and every duplicate ACK would appear to belong to the last loss.
+func (conn *Conn) dragRecover(prevUna seq) {
+	if prevUna.geq(conn.recover) {
+		conn.recover = conn.sndUna - 1
+	}
+}
+
+// retransmitFirst retransmits the first unacknowledged segment without
+// affecting sndNxt. If the other side has SACKed data within the segment,
+// only the hole before it is retransmitted.
+func (conn *Conn) retransmitFirst() {
+	n := conn.outgoing.Len()
+	if n > conn.sendMSS() {
+		n = conn.sendMSS()
+	}
+	if sent := int(conn.sndMax - conn.sndUna); n > sent {
+		n = sent
+	}
+	n = conn.nextHole(conn.sndUna, n)
+	if n <= 0 {
+		// only a SYN or FIN is outstanding, which will
+		// be handled by the retransmission timer
+		return
+	}
+	conn.retransmit(conn.sndUna, n)
+	conn.sackRtxNext = conn.sndUna + seq(n)
+}
+
+// retransmit retransmits the n bytes of data starting at s, which have
+// already been sent, without affecting sndNxt.
+func (conn *Conn) retransmit(s seq, n int) {
+	if conn.rttTiming && conn.rttSeq.gt(s) {
+		// the timed segment may be being retransmitted;
+		// see Karn's algorithm
+		conn.rttTiming = false
+	}
+	var f flags
+	f.SetACK(true)
+	conn.send(f, s, conn.sendBufferPayload(s, n))
+	conn.cc.OnPacketSent(uint32(n))
+	conn.counters.SegsRetransmitted++
+	conn.counters.BytesRetransmitted += uint64(n)
+	conn.counters.FastRetransmits++
+	conn.retransmitted()
+}
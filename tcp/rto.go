@@ -0,0 +1,90 @@
+package tcp
+
+import "time"
+
+// Retransmission timeout parameters; see "The Basic Algorithm,"
+// https://tools.ietf.org/html/rfc6298#section-2
+const (
+	initialRTO = time.Second
+	minRTO     = time.Second
+	maxRTO     = 60 * time.Second
+	// the granularity of timeout.NowMonotonic
+	clockGranularity = time.Millisecond
+)
+
+// An rtoEstimator computes the retransmission timeout from
+// a sequence of round-trip time samples as described in RFC 6298.
+type rtoEstimator struct {
+	srtt   time.Duration // smoothed round-trip time
+	rttvar time.Duration // round-trip time variation
+	rto    time.Duration
+	// min and max bound the RTO; they're fields rather than constants
+	// so that they can be configured (see Host.SetRTOBounds)
+	min, max time.Duration
+	sampled  bool // whether any sample has been taken yet
+}
+
+func newRTOEstimator() rtoEstimator {
+	return rtoEstimator{rto: initialRTO, min: minRTO, max: maxRTO}
+}
+
+// setBounds sets the minimum and maximum RTOs, clamping the current RTO
+// between them.
+func (r *rtoEstimator) setBounds(min, max time.Duration) {
+	r.min, r.max = min, max
+	if r.rto < min {
+		r.rto = min
+	}
+	if r.rto > max {
+		r.rto = max
+	}
+}
+
+// sample updates the estimator with the round-trip time sample rtt.
+// Per Karn's algorithm, samples must not be taken from segments which
+// were retransmitted.
+func (r *rtoEstimator) sample(rtt time.Duration) { r.sampleWeighted(rtt, 1) }
+
+// sampleWeighted is like sample, but gives rtt 1/n of the usual weight. When
+// samples are taken from every ACK rather than once per round trip, n is the
+// number of samples expected per round trip, so that the estimates still
+// remember about as many round trips as they would otherwise. See Appendix G,
+// https://tools.ietf.org/html/rfc7323#appendix-G
+func (r *rtoEstimator) sampleWeighted(rtt time.Duration, n int) {
+	if !r.sampled {
+		// See (2.2), https://tools.ietf.org/html/rfc6298#section-2
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+		r.sampled = true
+	} else {
+		// See (2.3), https://tools.ietf.org/html/rfc6298#section-2;
+		// alpha = 1/(8n) and beta = 1/(4n)
+		delta := r.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		w := time.Duration(n)
+		r.rttvar = ((4*w-1)*r.rttvar + delta) / (4 * w)
+		r.srtt = ((8*w-1)*r.srtt + rtt) / (8 * w)
+	}
+
+	k := 4 * r.rttvar
+	if k < clockGranularity {
+		k = clockGranularity
+	}
+	r.setRTO(r.srtt + k)
+}
+
+// backoff doubles the RTO in response to the retransmission timer expiring.
+// See (5.5), https://tools.ietf.org/html/rfc6298#section-5
+func (r *rtoEstimator) backoff() { r.setRTO(2 * r.rto) }
+
+func (r *rtoEstimator) setRTO(rto time.Duration) {
+	switch {
+	case rto < r.min:
+		rto = r.min
+	case rto > r.max:
+		rto = r.max
+	}
+	r.rto = rto
+}
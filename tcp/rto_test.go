@@ -0,0 +1,69 @@
+package tcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOEstimator(t *testing.T) {
+	const ms = time.Millisecond
+
+	type event struct {
+		sample  time.Duration // 0 for a backoff
+		srtt    time.Duration
+		rttvar  time.Duration
+		wantRTO time.Duration
+	}
+
+	test := func(r rtoEstimator, events []event) {
+		for i, ev := range events {
+			if ev.sample == 0 {
+				r.backoff()
+			} else {
+				r.sample(ev.sample)
+			}
+			if r.srtt != ev.srtt || r.rttvar != ev.rttvar || r.rto != ev.wantRTO {
+				t.Errorf("event %v (%+v): got SRTT %v, RTTVAR %v, RTO %v", i, ev, r.srtt, r.rttvar, r.rto)
+			}
+		}
+	}
+
+	r := newRTOEstimator()
+	if r.rto != initialRTO {
+		t.Errorf("unexpected initial RTO: got %v; want %v", r.rto, initialRTO)
+	}
+	test(r, []event{
+		{sample: 1000 * ms, srtt: 1000 * ms, rttvar: 500 * ms, wantRTO: 3000 * ms},
+		{sample: 2000 * ms, srtt: 1125 * ms, rttvar: 625 * ms, wantRTO: 3625 * ms},
+		{sample: 1000 * ms, srtt: 1109375 * time.Microsecond, rttvar: 500 * ms, wantRTO: 3109375 * time.Microsecond},
+		// backoff doubles the RTO but leaves the estimates alone
+		{srtt: 1109375 * time.Microsecond, rttvar: 500 * ms, wantRTO: 6218750 * time.Microsecond},
+		// a new sample recomputes the RTO from scratch
+		{sample: 1000 * ms, srtt: 1095703125, rttvar: 402343750, wantRTO: 2705078125},
+		// backoff is capped at the maximum RTO
+		{srtt: 1095703125, rttvar: 402343750, wantRTO: 5410156250},
+		{srtt: 1095703125, rttvar: 402343750, wantRTO: 10820312500},
+		{srtt: 1095703125, rttvar: 402343750, wantRTO: 21640625000},
+		{srtt: 1095703125, rttvar: 402343750, wantRTO: 43281250000},
+		{srtt: 1095703125, rttvar: 402343750, wantRTO: maxRTO},
+	})
+
+	// short round-trip times are clamped to the minimum RTO
+	test(newRTOEstimator(), []event{
+		{sample: 10 * ms, srtt: 10 * ms, rttvar: 5 * ms, wantRTO: minRTO},
+		{sample: 10 * ms, srtt: 10 * ms, rttvar: 3750 * time.Microsecond, wantRTO: minRTO},
+	})
+
+	// with no minimum, the variance term is never less than
+	// the clock granularity
+	r = newRTOEstimator()
+	r.min = 0
+	test(r, []event{
+		{sample: 100 * ms, srtt: 100 * ms, rttvar: 50 * ms, wantRTO: 300 * ms},
+		{sample: 100 * ms, srtt: 100 * ms, rttvar: 37500 * time.Microsecond, wantRTO: 250 * ms},
+	})
+	r.srtt, r.rttvar, r.sampled = 100*ms, 0, true
+	test(r, []event{
+		{sample: 100 * ms, srtt: 100 * ms, rttvar: 0, wantRTO: 100*ms + clockGranularity},
+	})
+}
@@ -0,0 +1,191 @@
+package tcp
+
+// outOfOrderReceived records that data beginning at s has been received out of
+// order, so that the block containing it is reported first in the SACK options
+// of the ACKs which follow. See https://tools.ietf.org/html/rfc2018#section-4
+func (conn *Conn) outOfOrderReceived(s seq) {
+	if !conn.sackOK {
+		return
+	}
+	start, end, ok := conn.incoming.Block(uint32(s))
+	if !ok {
+		// trimmed to respect the reassembly limit
+		return
+	}
+	blocks := [maxSACKBlocks]sackBlock{{seq(start), seq(end)}}
+	n := 1
+	for _, blk := range conn.rcvSACK[:conn.nrcvSACK] {
+		// blocks which have since been merged into
+		// this one are superseded by it
+		if n < maxSACKBlocks && (blk.end.lt(blocks[0].start) || blk.start.gt(blocks[0].end)) {
+			blocks[n] = blk
+			n++
+		}
+	}
+	conn.rcvSACK, conn.nrcvSACK = blocks, n
+}
+
+// setSACK sets the SACK option of the outgoing ACK hdr. The duplicate recorded
+// by duplicateReceived, if any, is reported first. It is followed by the blocks
+// of out-of-order data most recently reported, as many as fit alongside the
+// other options, starting with the one most recently received. Blocks which
+// have since been filled in are dropped.
+// See https://tools.ietf.org/html/rfc2018#section-4
+func (conn *Conn) setSACK(hdr *genericHeader) {
+	max := maxSACKBlocks
+	if hdr.tsSet {
+		max = maxSACKBlocksTS
+	}
+	if conn.dsackSet {
+		hdr.sack[0] = conn.dsack
+		hdr.nsack = 1
+		conn.dsackSet = false
+	}
+
+	var n int
+	for _, blk := range conn.rcvSACK[:conn.nrcvSACK] {
+		start, end, ok := conn.incoming.Block(uint32(blk.start))
+		if !ok || seq(end).leq(conn.rcvNxt) {
+			continue
+		}
+		blk = sackBlock{seq(start), seq(end)}
+		dup := false
+		for _, prev := range conn.rcvSACK[:n] {
+			if prev == blk {
+				// merged with a more recent block
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		conn.rcvSACK[n] = blk
+		n++
+		if hdr.nsack < max {
+			hdr.sack[hdr.nsack] = blk
+			hdr.nsack++
+		}
+	}
+	conn.nrcvSACK = n
+}
+
+// sacked adds the SACK blocks of the ACK hdr, apart from a DSACK, to the
+// scoreboard of data which the other side has received above sndUna.
+func (conn *Conn) sacked(hdr *genericHeader) {
+	blocks := hdr.sack[:hdr.nsack]
+	if isDSACK(hdr) {
+		blocks = blocks[1:]
+	}
+	for _, blk := range blocks {
+		if blk.start.lt(conn.sndUna) {
+			blk.start = conn.sndUna
+		}
+		if blk.end.gt(conn.sndMax) {
+			blk.end = conn.sndMax
+		}
+		if blk.start.geq(blk.end) {
+			continue
+		}
+		conn.markSACKed(blk)
+	}
+}
+
+// markSACKed adds blk to the scoreboard, which is kept
+// sorted and with overlapping blocks merged.
+func (conn *Conn) markSACKed(blk sackBlock) {
+	old := conn.scoreboard
+	board := make([]sackBlock, 0, len(old)+1)
+	i := 0
+	for ; i < len(old) && old[i].end.lt(blk.start); i++ {
+		board = append(board, old[i])
+	}
+	for ; i < len(old) && old[i].start.leq(blk.end); i++ {
+		if old[i].start.lt(blk.start) {
+			blk.start = old[i].start
+		}
+		if old[i].end.gt(blk.end) {
+			blk.end = old[i].end
+		}
+	}
+	board = append(board, blk)
+	conn.scoreboard = append(board, old[i:]...)
+}
+
+// trimScoreboard drops the parts of the scoreboard
+// which have been cumulatively acknowledged.
+func (conn *Conn) trimScoreboard() {
+	i := 0
+	for i < len(conn.scoreboard) && conn.scoreboard[i].end.leq(conn.sndUna) {
+		i++
+	}
+	conn.scoreboard = conn.scoreboard[i:]
+	if len(conn.scoreboard) > 0 && conn.scoreboard[0].start.lt(conn.sndUna) {
+		conn.scoreboard[0].start = conn.sndUna
+	}
+}
+
+// clearScoreboard forgets everything the other side has SACKed. It is called
+// when the retransmission timer expires, since the other side may have
+// discarded the data. See https://tools.ietf.org/html/rfc2018#section-8
+func (conn *Conn) clearScoreboard() {
+	conn.scoreboard = conn.scoreboard[:0]
+}
+
+// nextHole returns the length of the hole in the scoreboard beginning at s,
+// which is at most max, or 0 if the other side has already received s.
+func (conn *Conn) nextHole(s seq, max int) int {
+	for _, blk := range conn.scoreboard {
+		if blk.end.leq(s) {
+			continue
+		}
+		if blk.start.leq(s) {
+			return 0
+		}
+		if n := int(blk.start - s); n < max {
+			return n
+		}
+		break
+	}
+	return max
+}
+
+// retransmitHole is called for a duplicate ACK during fast recovery. It
+// retransmits a segment from the first hole in the scoreboard which hasn't
+// been retransmitted since recovery began and which is presumed lost: at
+// least dupAckThreshold segments' worth of data above it have been SACKed.
+// This repairs several losses in a window in a single round trip rather than
+// one per partial ACK. It returns false if nothing was retransmitted.
+// See https://tools.ietf.org/html/rfc6675#section-4
+func (conn *Conn) retransmitHole() bool {
+	mss := conn.sendMSS()
+	s := conn.sackRtxNext
+	if s.lt(conn.sndUna) {
+		s = conn.sndUna
+	}
+	for i, blk := range conn.scoreboard {
+		if blk.end.leq(s) {
+			continue
+		}
+		if blk.start.leq(s) {
+			// already received; the hole (if any) follows this block
+			s = blk.end
+			continue
+		}
+		var above int
+		for _, b := range conn.scoreboard[i:] {
+			above += int(b.end - b.start)
+		}
+		if above < dupAckThreshold*mss {
+			return false
+		}
+		n := int(blk.start - s)
+		if n > mss {
+			n = mss
+		}
+		conn.retransmit(s, n)
+		conn.sackRtxNext = s + seq(n)
+		return true
+	}
+	return false
+}
@@ -1,72 +1,845 @@
 package tcp
 
 import (
+	"container/list"
+	"hash/fnv"
+	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/joshlf/net"
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
 )
 
 // Port represents a TCP port.
 type Port uint16
 
-type ipv4FourTuple struct {
-	src     net.IPv4
+// The addresses in a fourTuple or twoTuple are of the same IP version,
+// which keeps the connections of each version distinct from one another.
+type fourTuple struct {
+	src     net.IP
 	srcport Port
-	dst     net.IPv4
+	dst     net.IP
 	dstport Port
 }
 
-type ipv4TwoTuple struct {
-	addr net.IPv4
+type twoTuple struct {
+	addr net.IP
 	port Port
 }
 
-// IPv4Host ... the zero value is not a valid IPv4Host
-type IPv4Host struct {
-	iphost    net.IPv4Host
-	listeners map[ipv4TwoTuple]*Listener
-	conns     map[ipv4FourTuple]*Conn
+// the default maximum number of connections in TIME_WAIT
+const defaultMaxTimeWait = 4096
+
+// the default range of ports from which the local ports of outgoing
+// connections are chosen; see https://tools.ietf.org/html/rfc6335#section-6
+const (
+	defaultEphemeralMin Port = 49152
+	defaultEphemeralMax Port = 65535
+)
+
+// A Host runs TCP over IPv4, IPv6, or both. Connections of either version
+// share the host's ports and configuration. The zero value is not a valid
+// Host.
+type Host struct {
+	ipv4      ipLayer                  // nil if the host doesn't support IPv4
+	ipv6      ipLayer                  // nil if the host doesn't support IPv6
+	listeners map[twoTuple][]*Listener // more than one only if they reuse the port
+	conns     map[fourTuple]*Conn
+	newCC     func(mss int) CongestionControl // nil for the default
+	mssClamp  uint16                          // 0 to derive it from the path MTU
+	initCwnd  int                             // 0 for the default
+	ecn       bool                            // whether new connections negotiate ECN
+	rcvBuf    int                             // 0 for the default
+	sndBuf    int                             // 0 for the default
+	autoTune  int                             // 0 if auto-tuning is disabled
+
+	synRetries int           // see SetSYNRetries
+	msl        time.Duration // see SetMSL
+
+	minRTO, maxRTO time.Duration // see SetRTOBounds
+	maxWindowScale uint8         // see SetMaxWindowScale
+
+	// see SetKeepAlive and SetKeepAlivePeriod
+	keepAlive       bool
+	keepAlivePeriod time.Duration // 0 for the default
+
+	// see DialHappyEyeballs
+	resolver           Resolver
+	happyEyeballsDelay time.Duration
+
+	// connections in TIME_WAIT, oldest first; when there are more
+	// than maxTimeWait, the oldest are closed early
+	timeWait      *list.List // of fourTuple
+	timeWaitElems map[fourTuple]*list.Element
+	maxTimeWait   int
+
+	// the range of ephemeral ports (see SetEphemeralPortRange),
+	// and the next one to try
+	ephemeralMin, ephemeralMax Port
+	nextEphemeral              Port
+
+	closed bool // see Close
+	// the goroutines started by stateHooks; Close waits for them
+	hooks sync.WaitGroup
 
 	mu sync.RWMutex
 }
 
-func NewIPv4Host(iphost net.IPv4Host) (*IPv4Host, error) {
-	host := &IPv4Host{iphost: iphost}
-	iphost.RegisterIPv4Callback(host.callback, net.IPProtocolTCP)
+// NewHost creates a Host which runs TCP over both IPv4 and IPv6 on iphost,
+// such as the IPHost embedded in a net.Stack.
+func NewHost(iphost *net.IPHost) (*Host, error) {
+	host := newHost()
+	host.addIPv4(iphost.IPv4Host)
+	host.addIPv6(iphost.IPv6Host)
 	return host, nil
 }
 
-func (host *IPv4Host) callback(b []byte, src, dst net.IPv4) {
-	var hdr tcpIPv4Header
-	n, err := parseTCPIPv4Header(b, &hdr)
+// NewStackHost creates a Host which runs TCP over both IPv4 and IPv6 on s,
+// using the defaults for new connections given by s's options (see
+// net.StackOptions). The defaults can still be changed later with the Host's
+// setters. The Host is closed when s is, if it hasn't been closed already.
+// It is an error if s has already been closed.
+func NewStackHost(s *net.Stack) (*Host, error) {
+	host, err := NewHost(&s.IPHost)
+	if err != nil {
+		return nil, err
+	}
+	opts := s.Options()
+	if opts.MSL > 0 {
+		host.SetMSL(opts.MSL)
+	}
+	host.SetInitialCwnd(opts.InitialCwnd)
+	if err := host.SetRTOBounds(opts.MinRTO, opts.MaxRTO); err != nil {
+		return nil, errors.Annotate(err, "new stack host")
+	}
+	if opts.EphemeralPortMin != 0 || opts.EphemeralPortMax != 0 {
+		min, max := Port(opts.EphemeralPortMin), Port(opts.EphemeralPortMax)
+		if min == 0 {
+			min = defaultEphemeralMin
+		}
+		if max == 0 {
+			max = defaultEphemeralMax
+		}
+		if err := host.SetEphemeralPortRange(min, max); err != nil {
+			return nil, errors.Annotate(err, "new stack host")
+		}
+	}
+	if opts.MaxWindowScale != 0 {
+		if err := host.SetMaxWindowScale(opts.MaxWindowScale); err != nil {
+			return nil, errors.Annotate(err, "new stack host")
+		}
+	}
+	host.SetKeepAlive(opts.KeepAlive)
+	host.SetKeepAlivePeriod(opts.KeepAlivePeriod)
+	err = s.OnClose(func() error {
+		// host may have been closed explicitly before s was
+		host.shutdown()
+		return nil
+	})
+	if err != nil {
+		host.shutdown()
+		return nil, errors.Annotate(err, "new stack host")
+	}
+	return host, nil
+}
+
+// NewIPv4Host creates a Host which runs TCP over IPv4 only.
+func NewIPv4Host(iphost net.IPv4Host) (*Host, error) {
+	host := newHost()
+	host.addIPv4(iphost)
+	return host, nil
+}
+
+// NewIPv6Host creates a Host which runs TCP over IPv6 only.
+func NewIPv6Host(iphost net.IPv6Host) (*Host, error) {
+	host := newHost()
+	host.addIPv6(iphost)
+	return host, nil
+}
+
+func newHost() *Host {
+	host := &Host{
+		listeners:     make(map[twoTuple][]*Listener),
+		conns:         make(map[fourTuple]*Conn),
+		timeWait:      list.New(),
+		timeWaitElems: make(map[fourTuple]*list.Element),
+		maxTimeWait:   defaultMaxTimeWait,
+		synRetries:    defaultSYNRetries,
+		msl:           defaultMSL,
+
+		minRTO:         minRTO,
+		maxRTO:         maxRTO,
+		maxWindowScale: maxWindowScale,
+
+		happyEyeballsDelay: defaultHappyEyeballsDelay,
+	}
+	host.setEphemeralPortRange(defaultEphemeralMin, defaultEphemeralMax)
+	return host
+}
+
+func (host *Host) addIPv4(iphost net.IPv4Host) {
+	layer := newIPv4Layer(iphost)
+	host.ipv4 = layer
+	layer.iphost.RegisterIPv4InfoCallback(func(b []byte, src, dst net.IPv4, info net.PacketInfo) {
+		host.callback(b, src, dst, info)
+	}, net.IPProtocolTCP)
+	layer.iphost.RegisterIPv4PathMTUCallback(func(mtu int, b []byte, src, dst net.IPv4) {
+		host.pathMTUCallback(mtu, b, src, dst)
+	}, net.IPProtocolTCP)
+}
+
+func (host *Host) addIPv6(iphost net.IPv6Host) {
+	layer := newIPv6Layer(iphost)
+	host.ipv6 = layer
+	layer.iphost.RegisterIPv6InfoCallback(func(b []byte, src, dst net.IPv6, info net.PacketInfo) {
+		host.callback(b, src, dst, info)
+	}, net.IPProtocolTCP)
+}
+
+// layer returns the ipLayer for addr's IP version,
+// or nil if the host doesn't support it.
+func (host *Host) layer(addr net.IP) ipLayer {
+	switch addr.(type) {
+	case net.IPv4:
+		return host.ipv4
+	case net.IPv6:
+		return host.ipv6
+	}
+	return nil
+}
+
+// SetCongestionControl sets the function used to construct a CongestionControl
+// for each new connection, given the connection's maximum segment size. It
+// does not affect existing connections. If newCC is nil, NewReno is used.
+func (host *Host) SetCongestionControl(newCC func(mss int) CongestionControl) {
+	host.mu.Lock()
+	host.newCC = newCC
+	host.mu.Unlock()
+}
+
+// SetMSSClamp sets the MSS clamp of new connections: the MSS advertised in
+// their SYNs, and the largest MSS they will accept from the other side. This
+// keeps segments small enough to fit through tunnels whose MTU is smaller than
+// the MTUs at either end of the connection. If mss is 0, which is the
+// default, the clamp is the path MTU at the time of the handshake minus the
+// size of the IP and TCP headers, and if the path MTU isn't known, no MSS is
+// advertised. It does not affect existing connections. A Listener's clamp
+// overrides the host's.
+func (host *Host) SetMSSClamp(mss uint16) {
+	host.mu.Lock()
+	host.mssClamp = mss
+	host.mu.Unlock()
+}
+
+// SetInitialCwnd sets the initial congestion window of new connections, in
+// segments. The window is clamped to the window advertised by the other side
+// during the handshake, and it only takes effect if the connection's
+// CongestionControl implements InitialWindowSetter. If segments is 0, the
+// default of 10 segments is used. It does not affect existing connections. A
+// Listener's initial window overrides the host's.
+// See https://tools.ietf.org/html/rfc6928
+func (host *Host) SetInitialCwnd(segments int) {
+	host.mu.Lock()
+	host.initCwnd = segments
+	host.mu.Unlock()
+}
+
+// SetSYNRetries sets the number of times that new connections retransmit an
+// unanswered SYN (or, for connections accepted by a listener, SYN-ACK) before
+// giving up. The first retransmission happens after a second, and each one
+// after that waits twice as long as the last. The default of 6 gives up after
+// just over two minutes. A dial which gives up returns a timeout error. It
+// does not affect existing connections.
+func (host *Host) SetSYNRetries(n int) {
+	host.mu.Lock()
+	host.synRetries = n
+	host.mu.Unlock()
+}
+
+// SetMSL sets the maximum segment lifetime (MSL) assumed by new connections:
+// the longest that a segment may survive in the network. A connection which
+// closes actively remains in TIME_WAIT for twice the MSL, during which its
+// four-tuple can't be reused (except by a SYN which is newer than the old
+// connection). The default is the two minutes given by RFC 793; shorter
+// values are mainly useful for tests which reconnect on the same four-tuple.
+// It does not affect existing connections.
+// See https://tools.ietf.org/html/rfc793#page-28
+func (host *Host) SetMSL(d time.Duration) {
+	host.mu.Lock()
+	host.msl = d
+	host.mu.Unlock()
+}
+
+// SetRTOBounds sets the minimum and maximum retransmission timeouts of new
+// connections. The defaults of one second and one minute are those given by
+// RFC 6298; a smaller minimum recovers from losses more quickly on networks
+// with short round trips, at the risk of spurious retransmissions. If min or
+// max is 0, its default is used. It is an error if min is greater than max.
+// It does not affect existing connections.
+// See https://tools.ietf.org/html/rfc6298#section-2
+func (host *Host) SetRTOBounds(min, max time.Duration) error {
+	if min == 0 {
+		min = minRTO
+	}
+	if max == 0 {
+		max = maxRTO
+	}
+	if min > max {
+		return errors.Errorf("set RTO bounds: minimum %v greater than maximum %v", min, max)
+	}
+	host.mu.Lock()
+	host.minRTO, host.maxRTO = min, max
+	host.mu.Unlock()
+	return nil
+}
+
+// SetMaxWindowScale sets the largest window scale offered by new connections,
+// which limits their receive windows, and thus their receive buffers, to
+// 65535<<shift bytes. The default is 14, the largest allowed by RFC 7323. It
+// is an error if shift is greater than 14. It does not affect existing
+// connections.
+func (host *Host) SetMaxWindowScale(shift uint8) error {
+	if shift > maxWindowScale {
+		return errors.Errorf("set max window scale: %v greater than %v", shift, maxWindowScale)
+	}
+	host.mu.Lock()
+	host.maxWindowScale = shift
+	host.mu.Unlock()
+	return nil
+}
+
+// SetEphemeralPortRange sets the range, inclusive, from which the local ports
+// of outgoing connections are chosen. The default is 49152 to 65535, the range
+// assigned by IANA. It is an error if min is 0 or greater than max.
+func (host *Host) SetEphemeralPortRange(min, max Port) error {
+	if min == 0 || min > max {
+		return errors.Errorf("set ephemeral port range: invalid range %v-%v", min, max)
+	}
+	host.mu.Lock()
+	host.setEphemeralPortRange(min, max)
+	host.mu.Unlock()
+	return nil
+}
+
+// setEphemeralPortRange sets the range of ephemeral ports; it must be called
+// with host.mu held.
+func (host *Host) setEphemeralPortRange(min, max Port) {
+	host.ephemeralMin, host.ephemeralMax = min, max
+	// start at a random port so that ports are harder to predict;
+	// see https://tools.ietf.org/html/rfc6056#section-3.3.1
+	host.nextEphemeral = min + Port(rand.Intn(int(max-min)+1))
+}
+
+// SetECN sets whether new connections negotiate the use of Explicit Congestion
+// Notification, which allows routers to signal congestion by marking segments
+// rather than dropping them. It is off by default. It does not affect existing
+// connections. See https://tools.ietf.org/html/rfc3168
+func (host *Host) SetECN(on bool) {
+	host.mu.Lock()
+	host.ecn = on
+	host.mu.Unlock()
+}
+
+// SetKeepAlive sets whether new connections send keepalive probes. See
+// Conn.SetKeepAlive. It is off by default. It does not affect existing
+// connections.
+func (host *Host) SetKeepAlive(on bool) {
+	host.mu.Lock()
+	host.keepAlive = on
+	host.mu.Unlock()
+}
+
+// SetKeepAlivePeriod sets the keepalive period of new connections. See
+// Conn.SetKeepAlivePeriod. If d is 0, the default of 15 seconds is used. It
+// does not affect existing connections.
+func (host *Host) SetKeepAlivePeriod(d time.Duration) {
+	host.mu.Lock()
+	host.keepAlivePeriod = d
+	host.mu.Unlock()
+}
+
+// SetReadBuffer sets the size of the receive buffers of new connections. Since
+// the window scale is chosen during the handshake to fit the buffer size, this
+// is the only way to give a connection a receive buffer larger than 64KiB. See
+// Conn.SetReadBuffer. If bytes is 0, the default of 64KiB is used.
+func (host *Host) SetReadBuffer(bytes int) {
+	host.mu.Lock()
+	host.rcvBuf = bytes
+	host.mu.Unlock()
+}
+
+// SetWriteBuffer sets the size of the send buffers of new connections. See
+// Conn.SetWriteBuffer. If bytes is 0, the default of 64KiB is used.
+func (host *Host) SetWriteBuffer(bytes int) {
+	host.mu.Lock()
+	host.sndBuf = bytes
+	host.mu.Unlock()
+}
+
+// SetReadBufferAutoTuning sets the auto-tuning limit of new connections. See
+// Conn.SetReadBufferAutoTuning. If max is 0, which is the default, auto-tuning
+// is disabled. If auto-tuning is enabled, the size set by SetReadBuffer is the
+// initial size of the receive buffer.
+func (host *Host) SetReadBufferAutoTuning(max int) {
+	host.mu.Lock()
+	host.autoTune = max
+	host.mu.Unlock()
+}
+
+// configureConn sets up c, a new connection identified by fourtuple, with its
+// addresses and the host's defaults for new connections; it must be called
+// with host.mu held.
+func (host *Host) configureConn(c *Conn, fourtuple fourTuple) {
+	// the four-tuple is from the perspective of incoming segments
+	c.local = twoTuple{addr: fourtuple.dst, port: fourtuple.dstport}
+	c.remote = twoTuple{addr: fourtuple.src, port: fourtuple.srcport}
+	c.stateHook = host.stateHook(fourtuple)
+	layer := host.layer(fourtuple.src)
+	c.pathMTU = func() int { return layer.pathMTU(fourtuple.src) }
+	c.overhead = layer.headerLen() + tcpHeaderLen
+	c.mssClamp = host.mssClamp
+	c.ecn = host.ecn
+	if host.initCwnd > 0 {
+		c.initCwnd = host.initCwnd
+	}
+	c.synRetries = host.synRetries
+	c.msl = host.msl
+	c.keepAlive = host.keepAlive
+	if host.keepAlivePeriod > 0 {
+		c.keepAlivePeriod = host.keepAlivePeriod
+	}
+	c.rtt.setBounds(host.minRTO, host.maxRTO)
+	c.setMaxWindowScale(host.maxWindowScale)
+	host.setBuffers(c)
+}
+
+// setBuffers sets the buffer sizes of c, a new connection, to the host's; it
+// must be called with host.mu held.
+func (host *Host) setBuffers(c *Conn) {
+	c.setAutoTuning(host.autoTune)
+	if host.rcvBuf > 0 {
+		c.setReadBuffer(host.rcvBuf)
+	}
+	if host.sndBuf > 0 {
+		c.setWriteBuffer(host.sndBuf)
+	}
+}
+
+// ListenTCP listens for incoming connections to the given local address and
+// port. If addr is the unspecified address (0.0.0.0 or ::), the listener
+// accepts connections to any of the host's addresses of that IP version which
+// no other listener is listening on. backlog is the maximum number of
+// established connections waiting to be accepted; if it is 0, a default is
+// used.
+func (host *Host) ListenTCP(addr net.IP, port Port, backlog int) (*Listener, error) {
+	if addr == nil || host.layer(addr) == nil {
+		return nil, errors.Errorf("listen: unsupported address: %v", addr)
+	}
+	return host.listen(backlog, false, twoTuple{addr: addr, port: port})
+}
+
+// ListenTCPReusePort is like ListenTCP, but any number of listeners created by
+// ListenTCPReusePort can listen on the same address and port, as with the
+// SO_REUSEPORT socket option. Each new connection is assigned to one of them
+// by a hash of its four-tuple, so that each listener can be served by its own
+// goroutine. Once a listener is closed, new connections are assigned among
+// the rest.
+func (host *Host) ListenTCPReusePort(addr net.IP, port Port, backlog int) (*Listener, error) {
+	if addr == nil || host.layer(addr) == nil {
+		return nil, errors.Errorf("listen: unsupported address: %v", addr)
+	}
+	return host.listen(backlog, true, twoTuple{addr: addr, port: port})
+}
+
+// ListenDualStack listens for incoming connections to the given port on any
+// of the host's IPv4 and IPv6 addresses, as with ListenTCP on the unspecified
+// addresses of both versions. Accepted connections report the local and
+// remote addresses of the version over which they were established. If
+// v6only is true, or the host doesn't support IPv4, only IPv6 connections are
+// accepted, as with the IPV6_V6ONLY socket option. It is an error if the
+// host doesn't support IPv6.
+func (host *Host) ListenDualStack(port Port, backlog int, v6only bool) (*Listener, error) {
+	if host.ipv6 == nil {
+		return nil, errors.New("listen: IPv6 not supported")
+	}
+	twotuples := []twoTuple{{addr: net.IPv6{}, port: port}}
+	if !v6only && host.ipv4 != nil {
+		twotuples = append(twotuples, twoTuple{addr: net.IPv4{}, port: port})
+	}
+	return host.listen(backlog, false, twotuples...)
+}
+
+// listen creates a Listener which listens on all of twotuples, the first of
+// which is its address. If reusePort is true, it may share them with other
+// listeners which reuse the port.
+func (host *Host) listen(backlog int, reusePort bool, twotuples ...twoTuple) (*Listener, error) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if host.closed {
+		return nil, errors.New("listen on closed host")
+	}
+	for _, t := range twotuples {
+		if ls := host.listeners[t]; len(ls) > 0 && !(reusePort && ls[0].reusePort) {
+			return nil, errors.Errorf("address already in use: %v", t.tcpAddr())
+		}
+	}
+	var l *Listener
+	l = newListener(backlog, host.mu.Lock, host.mu.Unlock, func() {
+		for _, t := range twotuples {
+			host.removeListener(t, l)
+		}
+	})
+	l.addr = twotuples[0]
+	l.reusePort = reusePort
+	for _, t := range twotuples {
+		host.listeners[t] = append(host.listeners[t], l)
+	}
+	return l, nil
+}
+
+// removeListener removes l from the listeners on twotuple;
+// it must be called with host.mu held.
+func (host *Host) removeListener(twotuple twoTuple, l *Listener) {
+	ls := host.listeners[twotuple]
+	for i, other := range ls {
+		if other == l {
+			ls = append(ls[:i:i], ls[i+1:]...)
+			break
+		}
+	}
+	if len(ls) == 0 {
+		delete(host.listeners, twotuple)
+	} else {
+		host.listeners[twotuple] = ls
+	}
+}
+
+// listener returns the listener for incoming connections on fourtuple (from
+// the perspective of incoming segments): one listening on its local address
+// if any, or otherwise one listening on the unspecified address. If several
+// listeners reuse the port, one is chosen by hashing fourtuple, so every
+// segment on a four-tuple chooses the same one. It must be called with
+// host.mu held.
+func (host *Host) listener(fourtuple fourTuple) (*Listener, bool) {
+	ls, ok := host.listeners[twoTuple{addr: fourtuple.dst, port: fourtuple.dstport}]
+	if !ok {
+		ls, ok = host.listeners[twoTuple{addr: unspecifiedAddr(fourtuple.dst), port: fourtuple.dstport}]
+	}
+	if !ok {
+		return nil, false
+	}
+	return ls[fourtuple.hash()%uint32(len(ls))], true
+}
+
+// hash returns a hash of t.
+func (t fourTuple) hash() uint32 {
+	h := fnv.New32a()
+	for _, addr := range []net.IP{t.src, t.dst} {
+		switch addr := addr.(type) {
+		case net.IPv4:
+			h.Write(addr[:])
+		case net.IPv6:
+			h.Write(addr[:])
+		}
+	}
+	h.Write([]byte{byte(t.srcport >> 8), byte(t.srcport), byte(t.dstport >> 8), byte(t.dstport)})
+	return h.Sum32()
+}
+
+// DialTCP opens a connection to the given remote address and port from an
+// ephemeral local port, blocking until the three-way handshake completes.
+// If the connection is refused, the returned error matches
+// net.ErrConnRefused. If deadline is non-zero and the handshake hasn't
+// completed by then, or if the SYN goes unanswered after being retransmitted
+// the number of times set by SetSYNRetries, the connection is abandoned and a
+// timeout error is returned.
+func (host *Host) DialTCP(addr net.IP, port Port, deadline time.Time) (*Conn, error) {
+	return host.dial(addr, port, deadline, nil)
+}
+
+// dial implements DialTCP. If cancel is non-nil, the
+// handshake is also abandoned once it is closed.
+func (host *Host) dial(addr net.IP, port Port, deadline time.Time, cancel <-chan struct{}) (*Conn, error) {
+	layer := host.layer(addr)
+	if layer == nil {
+		return nil, errors.Errorf("dial: unsupported address: %v", addr)
+	}
+	src, err := layer.sourceAddr(addr)
+	if err != nil {
+		return nil, errors.Annotate(err, "dial")
+	}
+
+	host.mu.Lock()
+	if host.closed {
+		host.mu.Unlock()
+		return nil, errors.New("dial on closed host")
+	}
+	lport, ok := host.ephemeralPort(src, addr, port)
+	if !ok {
+		host.mu.Unlock()
+		return nil, errors.New("dial: no free ports")
+	}
+	// the four-tuple is from the perspective of incoming segments
+	fourtuple := fourTuple{src: addr, srcport: port, dst: src, dstport: lport}
+	c := newConn(host.output(fourtuple), host.newCC)
+	host.configureConn(c, fourtuple)
+	host.conns[fourtuple] = c
+	host.mu.Unlock()
+
+	c.dial()
+	if err := c.waitEstablished(deadline, cancel); err != nil {
+		return nil, errors.Annotatef(err, "dial %v:%v", addr, port)
+	}
+	return c, nil
+}
+
+// ephemeralPort returns an ephemeral port which isn't in use by any listener
+// on src (including one on the unspecified address) or by any connection from
+// src to dst:dstport, including one in TIME_WAIT. Ports are tried in turn,
+// starting after the last one chosen and wrapping around at the end of the
+// range, so that connections to different destinations can share ports, and
+// false is returned if every port is in use. It must be called with host.mu
+// held.
+func (host *Host) ephemeralPort(src, dst net.IP, dstport Port) (Port, bool) {
+	for i := 0; i <= int(host.ephemeralMax-host.ephemeralMin); i++ {
+		port := host.nextEphemeral
+		host.nextEphemeral++
+		if port == host.ephemeralMax {
+			host.nextEphemeral = host.ephemeralMin
+		}
+		fourtuple := fourTuple{src: dst, srcport: dstport, dst: src, dstport: port}
+		if _, ok := host.conns[fourtuple]; ok {
+			continue
+		}
+		if _, ok := host.listener(fourtuple); ok {
+			continue
+		}
+		return port, true
+	}
+	return 0, false
+}
+
+// output returns a function which writes segments on the connection
+// identified by fourtuple (from the perspective of incoming segments,
+// so fourtuple.dst is the local address).
+func (host *Host) output(fourtuple fourTuple) func(hdr *genericHeader, p payload) {
+	return func(hdr *genericHeader, p payload) {
+		thdr := tcpHeader{
+			srcport:       fourtuple.dstport,
+			dstport:       fourtuple.srcport,
+			genericHeader: *hdr,
+		}
+		thdr.checksum = 0
+		// the payload is read straight from the send buffer
+		// into the segment, without an intermediate copy
+		buf := make([]byte, maxHeaderLen+p.Len())
+		n, _ := writeTCPHeader(buf, &thdr)
+		p.CopyTo(buf[n:])
+		buf = buf[:n+p.Len()]
+		setChecksum(buf, tcpChecksum(buf, fourtuple.dst, fourtuple.src))
+		host.layer(fourtuple.src).writeTo(buf, fourtuple.src, hdr.ect)
+		// TODO(joshlf): Log error
+	}
+}
+
+// sendReset sends a RST in response to the segment hdr, which was received
+// on the four-tuple fourtuple but doesn't belong to any connection. A RST is
+// never sent in response to a RST.
+// See "If the connection does not exist," https://tools.ietf.org/html/rfc793#page-65
+func (host *Host) sendReset(fourtuple fourTuple, hdr *genericHeader, b []byte) {
+	if hdr.RST() {
+		return
+	}
+	host.output(fourtuple)(makeReset(hdr, b), payload{})
+}
+
+// stateHook returns a Conn.stateHook for the connection identified by
+// fourtuple. Since it is called with the Conn's lock held, and the Conn may be
+// called with host.mu held, it updates the host asynchronously. Close waits
+// for the updates to finish.
+func (host *Host) stateHook(fourtuple fourTuple) func(conn *Conn, s State) {
+	return func(conn *Conn, s State) {
+		switch s {
+		case StateTimeWait:
+			host.hooks.Add(1)
+			go func() {
+				defer host.hooks.Done()
+				host.addTimeWait(fourtuple, conn)
+			}()
+		case StateClosed:
+			host.hooks.Add(1)
+			go func() {
+				defer host.hooks.Done()
+				host.removeConn(fourtuple, conn)
+			}()
+		}
+	}
+}
+
+// addTimeWait adds conn, which has entered TIME_WAIT, to the TIME_WAIT table,
+// closing the oldest connections in the table if it is full.
+func (host *Host) addTimeWait(fourtuple fourTuple, conn *Conn) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if host.conns[fourtuple] != conn {
+		// conn has already been removed
+		return
+	}
+	if _, ok := host.timeWaitElems[fourtuple]; ok {
+		return
+	}
+	host.timeWaitElems[fourtuple] = host.timeWait.PushBack(fourtuple)
+	for host.timeWait.Len() > host.maxTimeWait {
+		oldest := host.timeWait.Remove(host.timeWait.Front()).(fourTuple)
+		delete(host.timeWaitElems, oldest)
+		c := host.conns[oldest]
+		delete(host.conns, oldest)
+		c.mu.Lock()
+		c.close()
+		c.mu.Unlock()
+	}
+}
+
+// removeConn removes conn, which has been closed, from the host.
+func (host *Host) removeConn(fourtuple fourTuple, conn *Conn) {
+	host.mu.Lock()
+	host.removeConnLocked(fourtuple, conn)
+	host.mu.Unlock()
+}
+
+func (host *Host) removeConnLocked(fourtuple fourTuple, conn *Conn) {
+	if host.conns[fourtuple] != conn {
+		// conn has already been removed, and
+		// the four-tuple may have been reused
+		return
+	}
+	delete(host.conns, fourtuple)
+	if elem, ok := host.timeWaitElems[fourtuple]; ok {
+		host.timeWait.Remove(elem)
+		delete(host.timeWaitElems, fourtuple)
+	}
+}
+
+// Close shuts down the host. Its listeners are closed, and its connections,
+// including any in TIME_WAIT, are reset, so that goroutines blocked in Accept,
+// Read, or Write return errors. Close returns once the goroutines which
+// service the connections' timers have exited. Once the host has been
+// closed, dialing or listening on it returns an error, and segments it
+// receives are dropped.
+func (host *Host) Close() error {
+	if !host.shutdown() {
+		return errors.New("close on already-closed Host")
+	}
+	return nil
+}
+
+// shutdown implements Close. It returns false, having done nothing,
+// if host was already closed.
+func (host *Host) shutdown() bool {
+	host.mu.Lock()
+	if host.closed {
+		host.mu.Unlock()
+		return false
+	}
+	host.closed = true
+	listeners := make(map[*Listener]bool)
+	for _, ls := range host.listeners {
+		for _, l := range ls {
+			listeners[l] = true
+		}
+	}
+	conns := make([]*Conn, 0, len(host.conns))
+	for _, c := range host.conns {
+		conns = append(conns, c)
+	}
+	host.conns = make(map[fourTuple]*Conn)
+	host.timeWait.Init()
+	host.timeWaitElems = make(map[fourTuple]*list.Element)
+	host.mu.Unlock()
+
+	// Listener.Close acquires host.mu, and resets the
+	// connections in the accept queue
+	for l := range listeners {
+		l.Close()
+	}
+	for _, c := range conns {
+		c.abort()
+		c.timeoutd.StopAndWait()
+	}
+	// every connection is now closed, so no more hooks will start
+	host.hooks.Wait()
+	return true
+}
+
+// pathMTUCallback is called when a segment sent by host from src to dst
+// was too big for the path, which has the given MTU. b is the beginning
+// of the segment's header.
+func (host *Host) pathMTUCallback(mtu int, b []byte, src, dst net.IP) {
+	if len(b) < 4 {
+		return
+	}
+	srcport := Port(parse.GetUint16(&b))
+	dstport := Port(parse.GetUint16(&b))
+	// the four-tuple is from the perspective of incoming segments
+	fourtuple := fourTuple{src: dst, srcport: dstport, dst: src, dstport: srcport}
+	host.mu.RLock()
+	conn, ok := host.conns[fourtuple]
+	host.mu.RUnlock()
+	if ok {
+		conn.pathMTUChanged(mtu)
+	}
+}
+
+func (host *Host) callback(b []byte, src, dst net.IP, info net.PacketInfo) {
+	if net.Checksum(b, net.PseudoHeaderSum(src, dst, net.IPProtocolTCP, len(b))) != 0xFFFF {
+		// TODO(joshlf): Log it
+		return
+	}
+	var hdr tcpHeader
+	n, err := parseTCPHeader(b, &hdr)
 	if err != nil {
 		// TODO(joshlf): Log it
 		return
 	}
-	// TODO(joshlf): Validate checksum
 
+	hdr.ce = info.ECN == net.ECNCE
 	b = b[n:]
 	host.handle(b, src, dst, &hdr)
 }
 
-func (host *IPv4Host) handle(b []byte, src, dst net.IPv4, hdr *tcpIPv4Header) {
-	fourtuple := ipv4FourTuple{
+func (host *Host) handle(b []byte, src, dst net.IP, hdr *tcpHeader) {
+	fourtuple := fourTuple{
 		src: src, srcport: hdr.srcport,
 		dst: dst, dstport: hdr.dstport,
 	}
-	twotuple := ipv4TwoTuple{addr: dst, port: hdr.dstport}
 
 	host.mu.RLock()
+	if host.closed {
+		host.mu.RUnlock()
+		return
+	}
 	conn, ok := host.conns[fourtuple]
+	if ok && conn.reopen(&hdr.genericHeader) {
+		// a new SYN for a connection in TIME_WAIT; conn has been
+		// closed, so remove it and start over to open a new one
+		host.mu.RUnlock()
+		host.mu.Lock()
+		host.removeConnLocked(fourtuple, conn)
+		host.mu.Unlock()
+		host.handle(b, src, dst, hdr)
+		return
+	}
 	if ok {
 		conn.callback(&hdr.genericHeader, b)
 		host.mu.RUnlock()
 		return
 	}
 
-	if _, ok = host.listeners[twotuple]; !ok {
+	if _, ok = host.listener(fourtuple); !ok {
 		host.mu.RUnlock()
-		// TODO(joshlf): Send ICMP or RST
+		host.sendReset(fourtuple, &hdr.genericHeader, b)
 		return
 	}
 
@@ -91,33 +864,54 @@ func (host *IPv4Host) handle(b []byte, src, dst net.IPv4, hdr *tcpIPv4Header) {
 		return
 	}
 
-	listener, ok := host.listeners[twotuple]
+	listener, ok := host.listener(fourtuple)
 	if !ok {
 		// This is unlikely to happen - the listener disappeared
 		// in the time between us releasing and re-acquiring the
-		// lock - but that's fine; just send an ICMP or RST as
-		// normal.
+		// lock - but that's fine; just send a RST as normal.
 		host.mu.Unlock()
-		// TODO(joshlf): Send ICMP or RST
+		host.sendReset(fourtuple, &hdr.genericHeader, b)
+		return
+	}
+	if !hdr.SYN() || hdr.ACK() || hdr.RST() {
+		// Only a SYN can open a new connection. An ACK can't be
+		// for any connection of the listener's, so it is reset;
+		// anything else is dropped.
+		// See "If the state is LISTEN," https://tools.ietf.org/html/rfc793#page-65
+		host.mu.Unlock()
+		if hdr.ACK() {
+			host.sendReset(fourtuple, &hdr.genericHeader, b)
+		}
+		return
 	}
 
-	// We actually have a new connection - construct it
-	// and inform the listener about it
-	c := newListenConn()
-	ok = listener.accept(c)
+	// We actually have a new connection - reserve room for it
+	// in the listener's SYN queue and construct it; the listener
+	// will be informed again once the handshake completes
+	ok = listener.synReceived()
 	if !ok {
-		// The listener didn't have room in its buffer;
+		// The listener didn't have room in its SYN queue;
 		// just drop the segment on the floor and let them
 		// retry or time out
 		host.mu.Unlock()
 		return
 	}
+	c := newListenConn(host.output(fourtuple), host.newCC)
+	c.listener = listener
+	host.configureConn(c, fourtuple)
+	listener.mu.Lock()
+	if listener.mssClamp > 0 {
+		c.mssClamp = listener.mssClamp
+	}
+	if listener.initCwnd > 0 {
+		c.initCwnd = listener.initCwnd
+	}
+	listener.mu.Unlock()
 
-	// We have a connection that has been successfully accepted;
-	// put it in the map and then start the whole process of segment
-	// handling over again. We need to release the write lock and
-	// re-acquire the read lock anyway, so easier to just start
-	// from scratch.
+	// Put the new connection in the map and then start the whole
+	// process of segment handling over again. We need to release
+	// the write lock and re-acquire the read lock anyway, so easier
+	// to just start from scratch.
 	host.conns[fourtuple] = c
 	host.mu.Unlock()
 	host.handle(b, src, dst, hdr)
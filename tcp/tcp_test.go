@@ -0,0 +1,954 @@
+package tcp
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net"
+)
+
+var (
+	testClientAddr = net.IPv4{10, 0, 0, 1}
+	testServerAddr = net.IPv4{10, 0, 0, 2}
+)
+
+// A testIPv4Host is a net.IPv4Host which captures the packets written to it.
+// Only the methods used by Host are implemented. Its path MTU is always
+// mtu, which is 0 by default.
+type testIPv4Host struct {
+	net.IPv4Host
+	callback    func(b []byte, src, dst net.IPv4)
+	mtuCallback func(mtu int, b []byte, src, dst net.IPv4)
+	df          bool
+	mtu         int
+	pkts        [][]byte
+	mu          sync.Mutex
+}
+
+func (h *testIPv4Host) RegisterIPv4InfoCallback(f func(b []byte, src, dst net.IPv4, info net.PacketInfo), proto net.IPProtocol) {
+	h.callback = func(b []byte, src, dst net.IPv4) { f(b, src, dst, net.PacketInfo{}) }
+}
+
+func (h *testIPv4Host) RegisterIPv4PathMTUCallback(f func(mtu int, b []byte, src, dst net.IPv4), proto net.IPProtocol) {
+	h.mtuCallback = f
+}
+
+func (h *testIPv4Host) IPv4PathMTU(addr net.IPv4) int   { return h.mtu }
+func (h *testIPv4Host) SetDontFragment(on bool)         { h.df = on }
+func (h *testIPv4Host) GetConfigCopyIPv4() net.IPv4Host { return h }
+func (h *testIPv4Host) SetECN(ecn uint8) error          { return nil }
+
+func (h *testIPv4Host) IPv4SourceAddr(dst net.IPv4) (net.IPv4, error) {
+	return testServerAddr, nil
+}
+
+func (h *testIPv4Host) WriteToIPv4(b []byte, addr net.IPv4, proto net.IPProtocol) (n int, err error) {
+	h.mu.Lock()
+	h.pkts = append(h.pkts, append([]byte(nil), b...))
+	h.mu.Unlock()
+	return len(b), nil
+}
+
+// take removes and returns all of the packets captured so far.
+func (h *testIPv4Host) take() [][]byte {
+	h.mu.Lock()
+	pkts := h.pkts
+	h.pkts = nil
+	h.mu.Unlock()
+	return pkts
+}
+
+// A testClient is a Conn on a simulated remote host
+// which talks to a Host through a testIPv4Host.
+type testClient struct {
+	*Conn
+	port Port
+	link testLink
+}
+
+// newTestClients creates n Conns which dial from
+// testClientAddr using ports starting at base.
+func newTestClients(n int, base Port) []*testClient {
+	var clients []*testClient
+	for i := 0; i < n; i++ {
+		clients = append(clients, newTestClient(base+Port(i), nil))
+	}
+	return clients
+}
+
+// newTestClient creates a Conn which dials from testClientAddr:port. If setup
+// is non-nil, it is called on the Conn before the initial SYN is sent.
+func newTestClient(port Port, setup func(c *Conn)) *testClient {
+	c := &testClient{port: port}
+	c.Conn = newConn(c.link.output, nil)
+	if setup != nil {
+		setup(c.Conn)
+	}
+	c.dial()
+	return c
+}
+
+// encode encodes seg as sent from c to the given port on testServerAddr.
+func (c *testClient) encode(seg testSegment, port Port) []byte {
+	hdr := tcpHeader{srcport: c.port, dstport: port, genericHeader: seg.hdr}
+	b := make([]byte, maxHeaderLen+len(seg.b))
+	n, _ := writeTCPHeader(b, &hdr)
+	b = b[:n+copy(b[n:], seg.b)]
+	setChecksum(b, tcpChecksum(b, testClientAddr, testServerAddr))
+	return b
+}
+
+// exchange delivers segments between the clients and the host
+// until there are none left to deliver.
+func exchange(t *testing.T, ih *testIPv4Host, port Port, clients []*testClient) {
+	byPort := make(map[Port]*testClient)
+	for _, c := range clients {
+		byPort[c.port] = c
+	}
+	for delivered := true; delivered; {
+		delivered = false
+		for _, c := range clients {
+			for _, seg := range c.link.take() {
+				ih.callback(c.encode(seg, port), testClientAddr, testServerAddr)
+				delivered = true
+			}
+		}
+		for _, pkt := range ih.take() {
+			var hdr tcpHeader
+			n, err := parseTCPHeader(pkt, &hdr)
+			if err != nil {
+				t.Fatalf("could not parse segment from host: %v", err)
+			}
+			c, ok := byPort[hdr.dstport]
+			if !ok {
+				t.Fatalf("segment from host to unknown port %v", hdr.dstport)
+			}
+			c.callback(&hdr.genericHeader, pkt[n:])
+			delivered = true
+		}
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	const (
+		port    = 80
+		backlog = 3
+		dials   = 8
+	)
+
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	l, err := host.ListenTCP(testServerAddr, port, backlog)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	if _, err := host.ListenTCP(testServerAddr, port, backlog); err == nil {
+		t.Errorf("expected error listening on address in use")
+	}
+
+	exchange(t, ih, port, newTestClients(dials, 10000))
+	if n := l.AcceptQueueLen(); n != backlog {
+		t.Errorf("unexpected accept queue length: got %v; want %v", n, backlog)
+	}
+	// the connections which didn't fit are left half-open
+	if n := l.SYNQueueLen(); n != dials-backlog {
+		t.Errorf("unexpected SYN queue length: got %v; want %v", n, dials-backlog)
+	}
+	for i := 0; i < backlog; i++ {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			t.Fatalf("unexpected error accepting: %v", err)
+		}
+		if c.State() != StateEstablished {
+			t.Errorf("accepted connection in state %v", c.State())
+		}
+	}
+	if n := l.AcceptQueueLen(); n != 0 {
+		t.Errorf("unexpected accept queue length after accepting: got %v; want 0", n)
+	}
+	l.Close()
+
+	// SYNs beyond the SYN backlog are dropped; deliver only
+	// the SYNs so that the connections remain half-open
+	l, _ = host.ListenTCP(testServerAddr, port, backlog)
+	l.SetSYNBacklog(backlog)
+	for _, c := range newTestClients(dials, 20000) {
+		for _, seg := range c.link.take() {
+			ih.callback(c.encode(seg, port), testClientAddr, testServerAddr)
+		}
+	}
+	if n := len(ih.take()); n != backlog {
+		t.Errorf("unexpected number of SYN-ACKs: got %v; want %v", n, backlog)
+	}
+	if n := l.SYNQueueLen(); n != backlog {
+		t.Errorf("unexpected SYN queue length: got %v; want %v", n, backlog)
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	const (
+		port    = 80
+		dials   = 30
+		backlog = dials
+	)
+
+	// assign returns the index of the listener to which each
+	// connection from newTestClients(dials, 10000) is assigned
+	assign := func() []int {
+		ih := new(testIPv4Host)
+		host, _ := NewIPv4Host(ih)
+		var ls []*Listener
+		for i := 0; i < 3; i++ {
+			l, err := host.ListenTCPReusePort(testServerAddr, port, backlog)
+			if err != nil {
+				t.Fatalf("unexpected error listening: %v", err)
+			}
+			ls = append(ls, l)
+		}
+		if _, err := host.ListenTCP(testServerAddr, port, backlog); err == nil {
+			t.Errorf("expected error listening without port reuse on port in use")
+		}
+
+		var assigned []int
+		for _, c := range newTestClients(dials, 10000) {
+			// a retransmitted SYN is assigned to the same listener
+			for _, seg := range c.link.take() {
+				ih.callback(c.encode(seg, port), testClientAddr, testServerAddr)
+				ih.callback(c.encode(seg, port), testClientAddr, testServerAddr)
+			}
+			exchange(t, ih, port, []*testClient{c})
+			idx := -1
+			for i, l := range ls {
+				if l.AcceptQueueLen() == 1 {
+					if idx != -1 {
+						t.Fatalf("connection from port %v accepted by more than one listener", c.port)
+					}
+					l.AcceptTCP()
+					idx = i
+				}
+			}
+			if idx == -1 {
+				t.Fatalf("handshake from port %v failed", c.port)
+			}
+			assigned = append(assigned, idx)
+		}
+		return assigned
+	}
+
+	a, b := assign(), assign()
+	counts := make([]int, 3)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Errorf("connection %v assigned to different listeners: %v and %v", i, a[i], b[i])
+		}
+		counts[a[i]]++
+	}
+	for i, n := range counts {
+		if n == 0 {
+			t.Errorf("no connections assigned to listener %v: %v", i, counts)
+		}
+	}
+
+	// listeners which reuse the port can't share it
+	// with one which doesn't
+	host, _ := NewIPv4Host(new(testIPv4Host))
+	l, _ := host.ListenTCP(testServerAddr, port, backlog)
+	if _, err := host.ListenTCPReusePort(testServerAddr, port, backlog); err == nil {
+		t.Errorf("expected error reusing port in use without port reuse")
+	}
+	l.Close()
+	l, err := host.ListenTCPReusePort(testServerAddr, port, backlog)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	l.Close()
+	if _, err := host.ListenTCP(testServerAddr, port, backlog); err != nil {
+		t.Errorf("unexpected error listening after closing listeners: %v", err)
+	}
+}
+
+// connect completes the handshake between c and the host, and accepts the
+// resulting connection from l.
+func connect(t *testing.T, ih *testIPv4Host, port Port, l *Listener, c *testClient) *Conn {
+	exchange(t, ih, port, []*testClient{c})
+	if l.AcceptQueueLen() != 1 {
+		t.Fatalf("handshake from port %v failed", c.port)
+	}
+	conn, _ := l.AcceptTCP()
+	return conn
+}
+
+// waitFor waits up to a second for cond to become true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+	}
+}
+
+func TestEphemeralPort(t *testing.T) {
+	host, _ := NewIPv4Host(new(testIPv4Host))
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	remote := net.IPv4{10, 0, 0, 3}
+
+	// every port in the range can be used for connections to the
+	// same destination, and then they are exhausted
+	ports := make(map[Port]bool)
+	for i := 0; i <= int(host.ephemeralMax-host.ephemeralMin); i++ {
+		port, ok := host.ephemeralPort(testServerAddr, remote, 80)
+		if !ok {
+			t.Fatalf("ports exhausted after %v connections", i)
+		}
+		if port < host.ephemeralMin || ports[port] {
+			t.Fatalf("unexpected port: %v", port)
+		}
+		ports[port] = true
+		host.conns[fourTuple{src: remote, srcport: 80, dst: testServerAddr, dstport: port}] = nil
+	}
+	if port, ok := host.ephemeralPort(testServerAddr, remote, 80); ok {
+		t.Errorf("unexpected port after exhausting the range: %v", port)
+	}
+	// but they can still be used for another destination
+	if _, ok := host.ephemeralPort(testServerAddr, remote, 81); !ok {
+		t.Errorf("no port for connection to a different destination")
+	}
+
+	// the first port chosen is random
+	first := newHost().nextEphemeral
+	for i := 0; i < 10; i++ {
+		if newHost().nextEphemeral != first {
+			return
+		}
+	}
+	t.Errorf("every host starts at port %v", first)
+}
+
+func TestDemux(t *testing.T) {
+	const (
+		port    = 80
+		clients = 100
+	)
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	// every connection shares the server's address and port
+	cs := newTestClients(clients, 10000)
+	servers := make([]*Conn, clients)
+	for i, c := range cs {
+		servers[i] = connect(t, ih, port, l, c)
+	}
+	for _, c := range cs {
+		c.Write([]byte(strconv.Itoa(int(c.port))))
+	}
+	exchange(t, ih, port, cs)
+	for i, s := range servers {
+		b := make([]byte, 16)
+		n, _ := s.Read(b)
+		if want := strconv.Itoa(int(cs[i].port)); string(b[:n]) != want {
+			t.Errorf("unexpected data on connection from port %v: got %q; want %q", cs[i].port, b[:n], want)
+		}
+	}
+}
+
+// BenchmarkDemux measures the cost of demultiplexing a segment
+// to its connection as the number of connections grows.
+func BenchmarkDemux(b *testing.B) {
+	for _, n := range []int{1, 100, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			host, _ := NewIPv4Host(new(testIPv4Host))
+			var conns []*Conn
+			for i := 0; i < n; i++ {
+				c := newConn(func(*genericHeader, payload) {}, nil)
+				c.setState(StateListen)
+				conns = append(conns, c)
+				host.conns[fourTuple{
+					src: testClientAddr, srcport: Port(10000 + i),
+					dst: testServerAddr, dstport: 80,
+				}] = c
+			}
+			defer func() {
+				for _, c := range conns {
+					c.timeoutd.Stop()
+				}
+			}()
+
+			// a RST is ignored by a connection in LISTEN, so
+			// this measures little but the lookup itself
+			var hdr tcpHeader
+			hdr.srcport, hdr.dstport = Port(10000+n/2), 80
+			hdr.SetRST(true)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				host.handle(nil, testClientAddr, testServerAddr, &hdr)
+			}
+		})
+	}
+}
+
+func TestHostClose(t *testing.T) {
+	const conns = 3
+	before := runtime.NumGoroutine()
+
+	lo, err := net.NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	lo.SetIPv4(net.IPv4{127, 0, 0, 1}, net.IPv4{255, 0, 0, 0})
+	s := net.NewStack(net.StackOptions{})
+	if err := s.AddDevice("lo", lo); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	host, err := NewStackHost(s)
+	if err != nil {
+		t.Fatalf("unexpected error creating host: %v", err)
+	}
+	addr := net.IPv4{127, 0, 0, 1}
+	l, err := host.ListenTCP(addr, 80, 0)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+
+	// block in every kind of operation: Accept, Read on both sides
+	// of each connection, and Write on one whose peer doesn't read
+	errs := make(chan error, 2*conns)
+	for i := 0; i < conns; i++ {
+		c, err := host.DialTCP(addr, 80, time.Now().Add(5*time.Second))
+		if err != nil {
+			t.Fatalf("unexpected error dialing: %v", err)
+		}
+		sc, err := l.AcceptTCP()
+		if err != nil {
+			t.Fatalf("unexpected error accepting: %v", err)
+		}
+		read := func(c *Conn) {
+			_, err := c.Read(make([]byte, 1))
+			errs <- err
+		}
+		if i == 0 {
+			go func() {
+				_, err := sc.Write(make([]byte, 1<<24))
+				errs <- err
+			}()
+		} else {
+			go read(sc)
+			go read(c)
+		}
+	}
+	go func() {
+		_, err := l.AcceptTCP()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// closing the stack closes the host
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error closing stack: %v", err)
+	}
+	for i := 0; i < 2*conns; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Errorf("blocked operation returned without error after Close")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("blocked operations didn't return after Close")
+		}
+	}
+	if _, err := host.DialTCP(addr, 80, time.Time{}); err == nil {
+		t.Errorf("no error dialing on closed host")
+	}
+	if err := host.Close(); err == nil {
+		t.Errorf("no error closing host twice")
+	}
+	if names := s.DeviceNames(); len(names) != 0 {
+		t.Errorf("unexpected devices after closing stack: %v", names)
+	}
+	waitFor(t, "goroutines to exit", func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestHostCloseConcurrent(t *testing.T) {
+	// closing a host and its stack at the same time closes the
+	// host exactly once, and closing the stack never fails
+	for i := 0; i < 100; i++ {
+		s := net.NewStack(net.StackOptions{})
+		host, err := NewStackHost(s)
+		if err != nil {
+			t.Fatalf("unexpected error creating host: %v", err)
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- host.Close() }()
+		if err := s.Close(); err != nil {
+			t.Fatalf("unexpected error closing stack: %v", err)
+		}
+		<-errs
+		if err := host.Close(); err == nil {
+			t.Fatalf("no error closing host after stack")
+		}
+	}
+}
+
+func TestAbortiveClose(t *testing.T) {
+	const port = 80
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	c := newTestClient(10000, nil)
+	s := connect(t, ih, port, l, c)
+	s.SetLinger(0)
+	s.Write([]byte("discarded"))
+	ih.take()
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error from Close with zero linger: %v", err)
+	}
+	pkts := ih.take()
+	var hdr tcpHeader
+	if len(pkts) != 1 {
+		t.Fatalf("unexpected number of segments after Close: got %v; want 1", len(pkts))
+	}
+	if n, _ := parseTCPHeader(pkts[0], &hdr); !hdr.RST() || len(pkts[0]) != n {
+		t.Errorf("unexpected segment after Close: %+v", hdr)
+	}
+
+	// the connection is released immediately rather than lingering in TIME_WAIT
+	if s.State() != StateClosed {
+		t.Errorf("unexpected state after Close: got %v; want CLOSED", s.State())
+	}
+	waitFor(t, "connection to be removed", func() bool {
+		host.mu.RLock()
+		defer host.mu.RUnlock()
+		return len(host.conns) == 0 && host.timeWait.Len() == 0
+	})
+	for name, err := range map[string]error{
+		"Write": func() error { _, err := s.Write([]byte("x")); return err }(),
+		"Read":  func() error { _, err := s.Read(make([]byte, 1)); return err }(),
+		"Close": s.Close(),
+	} {
+		if err != closedErr {
+			t.Errorf("unexpected error from %v after Close: got %v; want %v", name, err, closedErr)
+		}
+	}
+}
+
+func TestTimeWait(t *testing.T) {
+	const port = 80
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	c1 := newTestClient(10000, nil)
+	s1 := connect(t, ih, port, l, c1)
+	c1.Write([]byte("hello"))
+	old := c1.link.take()
+	for _, seg := range old {
+		ih.callback(c1.encode(seg, port), testClientAddr, testServerAddr)
+	}
+
+	// the server closes actively, and so ends up in TIME_WAIT
+	s1.Close()
+	exchange(t, ih, port, []*testClient{c1})
+	if s1.State() != StateFINWait2 || c1.State() != StateCloseWait {
+		t.Fatalf("unexpected states after server close: server %v, client %v", s1.State(), c1.State())
+	}
+	c1.Close()
+	exchange(t, ih, port, []*testClient{c1})
+	if s1.State() != StateTimeWait || c1.State() != StateClosed {
+		t.Fatalf("unexpected states after client close: server %v, client %v", s1.State(), c1.State())
+	}
+
+	// a stray old segment is ACKed and otherwise ignored
+	ih.callback(c1.encode(old[0], port), testClientAddr, testServerAddr)
+	pkts := ih.take()
+	var hdr tcpHeader
+	if len(pkts) != 1 {
+		t.Fatalf("unexpected number of responses to old segment: got %v; want 1", len(pkts))
+	}
+	parseTCPHeader(pkts[0], &hdr)
+	if !hdr.ACK() || hdr.RST() {
+		t.Errorf("unexpected response to old segment: %+v", hdr)
+	}
+	if s1.State() != StateTimeWait {
+		t.Errorf("unexpected state after old segment: %v", s1.State())
+	}
+
+	// a SYN which is older than the last connection can't reopen it
+	c2 := newTestClient(10000, func(c *Conn) {
+		c.setISS(c1.iss)
+		c.tsOffset = c1.tsOffset - 1000000
+	})
+	exchange(t, ih, port, []*testClient{c2})
+	if s1.State() != StateTimeWait || l.AcceptQueueLen() != 0 {
+		t.Errorf("old SYN reopened connection in TIME_WAIT")
+	}
+
+	// but a newer SYN can
+	c3 := newTestClient(10000, func(c *Conn) {
+		c.setISS(c1.iss + 100000)
+		c.tsOffset = c1.tsOffset + 1000
+	})
+	s3 := connect(t, ih, port, l, c3)
+	if s1.State() != StateClosed || s3.State() != StateEstablished || c3.State() != StateEstablished {
+		t.Errorf("unexpected states after reopening: old %v, new server %v, new client %v", s1.State(), s3.State(), c3.State())
+	}
+
+	// once 2*MSL has elapsed, the connection is closed and removed
+	s3.mu.Lock()
+	s3.msl = time.Millisecond
+	s3.mu.Unlock()
+	s3.Close()
+	exchange(t, ih, port, []*testClient{c3})
+	c3.Close()
+	exchange(t, ih, port, []*testClient{c3})
+	waitFor(t, "TIME_WAIT to expire", func() bool {
+		host.mu.RLock()
+		defer host.mu.RUnlock()
+		return len(host.conns) == 0 && host.timeWait.Len() == 0
+	})
+}
+
+func TestSetMSL(t *testing.T) {
+	const (
+		port = 80
+		msl  = 50 * time.Millisecond
+	)
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	host.SetMSL(msl)
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	c := newTestClient(10000, nil)
+	s := connect(t, ih, port, l, c)
+	s.Close()
+	exchange(t, ih, port, []*testClient{c})
+	c.Close()
+	exchange(t, ih, port, []*testClient{c})
+	start := time.Now()
+	if s.State() != StateTimeWait {
+		t.Fatalf("unexpected state after closing: got %v; want %v", s.State(), StateTimeWait)
+	}
+	waitFor(t, "TIME_WAIT to expire", func() bool {
+		host.mu.RLock()
+		defer host.mu.RUnlock()
+		return len(host.conns) == 0
+	})
+	if d := time.Since(start); d < 2*msl {
+		t.Errorf("TIME_WAIT expired after %v; want at least %v", d, 2*msl)
+	}
+
+	// the four-tuple can be reused by any SYN
+	c = newTestClient(10000, nil)
+	if s := connect(t, ih, port, l, c); s.State() != StateEstablished {
+		t.Errorf("unexpected state of new connection: %v", s.State())
+	}
+}
+
+func TestTimeWaitTable(t *testing.T) {
+	const (
+		port = 80
+		max  = 2
+	)
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	host.maxTimeWait = max
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	var servers []*Conn
+	for i := 0; i < max+1; i++ {
+		c := newTestClient(Port(10000+i), nil)
+		s := connect(t, ih, port, l, c)
+		s.Close()
+		exchange(t, ih, port, []*testClient{c})
+		c.Close()
+		exchange(t, ih, port, []*testClient{c})
+		servers = append(servers, s)
+		waitFor(t, "connection to enter TIME_WAIT table", func() bool {
+			host.mu.RLock()
+			defer host.mu.RUnlock()
+			_, ok := host.timeWaitElems[fourTuple{
+				src: testClientAddr, srcport: c.port,
+				dst: testServerAddr, dstport: port,
+			}]
+			return ok
+		})
+	}
+
+	// the oldest connection was recycled to make room
+	host.mu.RLock()
+	n := host.timeWait.Len()
+	host.mu.RUnlock()
+	if n != max {
+		t.Errorf("unexpected TIME_WAIT table size: got %v; want %v", n, max)
+	}
+	for i, s := range servers {
+		want := StateTimeWait
+		if i == 0 {
+			want = StateClosed
+		}
+		if s.State() != want {
+			t.Errorf("unexpected state of connection %v: got %v; want %v", i, s.State(), want)
+		}
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	const (
+		port = 80
+		mtu  = 296
+	)
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	if !ih.df {
+		t.Errorf("DF flag not set")
+	}
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+	c := newTestClient(10000, nil)
+	s := connect(t, ih, port, l, c)
+
+	// payloadLens returns the lengths of the payloads of pkts
+	payloadLens := func(pkts [][]byte) []int {
+		var lens []int
+		for _, pkt := range pkts {
+			var hdr tcpHeader
+			n, _ := parseTCPHeader(pkt, &hdr)
+			lens = append(lens, len(pkt)-n)
+		}
+		return lens
+	}
+
+	s.Write(make([]byte, 1000))
+	pkts := ih.take()
+	if lens := payloadLens(pkts); len(lens) == 0 || lens[0] != s.sendMSS() || s.sendMSS() <= mtu-headerOverhead {
+		t.Fatalf("unexpected segment sizes before the path MTU was reduced: %v", lens)
+	}
+
+	// the first segment was too big for a link on the path
+	ih.mtuCallback(mtu, pkts[0][:8], testServerAddr, testClientAddr)
+	want := mtu - headerOverhead - timestampOptionLen
+	if mss := s.sendMSS(); mss != want {
+		t.Errorf("unexpected MSS after the path MTU was reduced: got %v; want %v", mss, want)
+	}
+	// the data is retransmitted immediately in smaller segments
+	lens := payloadLens(ih.take())
+	var total int
+	for _, n := range lens {
+		if n > want {
+			t.Errorf("retransmitted segment exceeds path MTU: %v", lens)
+			break
+		}
+		total += n
+	}
+	if total < want {
+		t.Errorf("data wasn't retransmitted after the path MTU was reduced: %v", lens)
+	}
+}
+
+func TestMSSClamp(t *testing.T) {
+	const (
+		port = 80
+		mtu  = 296
+	)
+	ih := &testIPv4Host{mtu: mtu}
+	host, _ := NewIPv4Host(ih)
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	// maxPayload returns the length of the largest payload in pkts
+	maxPayload := func(pkts [][]byte) int {
+		var max int
+		for _, pkt := range pkts {
+			var hdr tcpHeader
+			n, _ := parseTCPHeader(pkt, &hdr)
+			if len(pkt)-n > max {
+				max = len(pkt) - n
+			}
+		}
+		return max
+	}
+
+	for _, clamp := range []uint16{0, 200} {
+		l.SetMSSClamp(clamp)
+		want := clamp
+		if clamp == 0 {
+			// derived from the MTU of the path to the client
+			want = mtu - headerOverhead
+		}
+		// the client advertises a larger MSS than the clamp allows
+		c := newTestClient(Port(10000+clamp), func(c *Conn) { c.mssClamp = 1460 })
+		s := connect(t, ih, port, l, c)
+		if s.mss != want {
+			t.Errorf("clamp %v: unexpected server MSS: got %v; want %v", clamp, s.mss, want)
+		}
+		// the client was told to use the clamped MSS
+		if c.mss != want {
+			t.Errorf("clamp %v: unexpected client MSS: got %v; want %v", clamp, c.mss, want)
+		}
+
+		s.SetNoDelay(true)
+		s.Write(make([]byte, 2000))
+		if n := maxPayload(ih.take()); n > int(want)-timestampOptionLen {
+			t.Errorf("clamp %v: segment payload of %v bytes exceeds MSS", clamp, n)
+		}
+		c.SetNoDelay(true)
+		c.Write(make([]byte, 2000))
+		for _, seg := range c.link.take() {
+			if len(seg.b) > int(want)-timestampOptionLen {
+				t.Errorf("clamp %v: client segment payload of %v bytes exceeds MSS", clamp, len(seg.b))
+				break
+			}
+		}
+	}
+}
+
+func TestInitialCwnd(t *testing.T) {
+	const port = 80
+	ih := new(testIPv4Host)
+	host, _ := NewIPv4Host(ih)
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	// inflight returns the number of segments the server sends
+	// before receiving an ACK when it has plenty of data to send
+	inflight := func(cport Port, setup func(c *Conn)) (int, *Conn) {
+		c := newTestClient(cport, setup)
+		s := connect(t, ih, port, l, c)
+		s.SetNoDelay(true)
+		s.Write(make([]byte, 20*s.sendMSS()))
+		var n int
+		for _, pkt := range ih.take() {
+			var hdr tcpHeader
+			hlen, _ := parseTCPHeader(pkt, &hdr)
+			if len(pkt) > hlen {
+				n++
+			}
+		}
+		return n, s
+	}
+
+	if n, _ := inflight(10000, nil); n != defaultInitCwnd {
+		t.Errorf("unexpected number of segments in the default initial window: got %v; want %v", n, defaultInitCwnd)
+	}
+	host.SetInitialCwnd(4)
+	if n, _ := inflight(10001, nil); n != 4 {
+		t.Errorf("unexpected number of segments in the host's initial window: got %v; want 4", n)
+	}
+	l.SetInitialCwnd(2)
+	if n, _ := inflight(10002, nil); n != 2 {
+		t.Errorf("unexpected number of segments in the listener's initial window: got %v; want 2", n)
+	}
+
+	// the initial window is clamped to the window advertised by the client
+	l.SetInitialCwnd(100)
+	_, s := inflight(10003, func(c *Conn) { c.setReadBuffer(4096) })
+	s.mu.Lock()
+	cwnd := s.cc.CongestionWindow()
+	s.mu.Unlock()
+	if cwnd != 4096 {
+		t.Errorf("unexpected initial window: got %v; want the client's window of 4096", cwnd)
+	}
+}
+
+func TestNegotiatedOptions(t *testing.T) {
+	const port = 80
+	ih := &testIPv4Host{}
+	host, _ := NewIPv4Host(ih)
+	host.SetECN(true)
+	host.SetReadBuffer(1 << 17)
+	host.SetReadBufferAutoTuning(0)
+	l, _ := host.ListenTCP(testServerAddr, port, 0)
+
+	c := newTestClient(10000, func(c *Conn) {
+		c.mssClamp = 1000
+		c.ecn = true
+		c.setReadBuffer(1 << 20)
+	})
+	exchange(t, ih, port, []*testClient{c})
+	if l.AcceptQueueLen() != 1 {
+		t.Fatalf("handshake failed")
+	}
+	s, _ := l.AcceptTCP()
+
+	got, ok := s.NegotiatedOptions()
+	if !ok {
+		t.Fatalf("no options reported for established connection")
+	}
+	want := NegotiatedOptions{
+		LocalAddr:      twoTuple{addr: testServerAddr, port: port}.tcpAddr(),
+		RemoteAddr:     twoTuple{addr: testClientAddr, port: 10000}.tcpAddr(),
+		MSS:            1000,
+		WindowScaling:  true,
+		SndWindowScale: windowShift(1 << 20),
+		RcvWindowScale: windowShift(1 << 17),
+		Timestamps:     true,
+		ECN:            true,
+		SACK:           true,
+	}
+	if got.LocalAddr.String() != want.LocalAddr.String() || got.RemoteAddr.String() != want.RemoteAddr.String() {
+		t.Errorf("unexpected addresses: got %v -> %v; want %v -> %v", got.LocalAddr, got.RemoteAddr, want.LocalAddr, want.RemoteAddr)
+	}
+	got.LocalAddr, got.RemoteAddr = nil, nil
+	want.LocalAddr, want.RemoteAddr = nil, nil
+	if got != want {
+		t.Errorf("unexpected options: got %+v; want %+v", got, want)
+	}
+
+	// the options don't change once the connection is closed
+	s.abort()
+	if after, _ := s.NegotiatedOptions(); after.MSS != 1000 || !after.WindowScaling {
+		t.Errorf("options changed after close: %+v", after)
+	}
+
+	// a connection which never completes its handshake reports no options
+	if _, ok := newConn(nil, nil).NegotiatedOptions(); ok {
+		t.Errorf("options reported before handshake")
+	}
+}
+
+func TestResetClosedPort(t *testing.T) {
+	ih := new(testIPv4Host)
+	NewIPv4Host(ih)
+
+	// parse parses the single packet sent by the host, if any
+	parse := func() (*tcpHeader, bool) {
+		pkts := ih.take()
+		if len(pkts) != 1 {
+			return nil, false
+		}
+		var hdr tcpHeader
+		parseTCPHeader(pkts[0], &hdr)
+		return &hdr, true
+	}
+
+	// a SYN to a closed port is refused
+	c := newTestClient(10000, nil)
+	exchange(t, ih, 80, []*testClient{c})
+	if c.State() != StateClosed || !net.IsConnRefused(c.err) {
+		t.Errorf("unexpected result of connecting to closed port: state %v, error %v", c.State(), c.err)
+	}
+
+	// a segment with an ACK is reset at the acknowledged sequence number
+	var seg testSegment
+	seg.hdr.SetACK(true)
+	seg.hdr.seq = 1000
+	seg.hdr.ack = 2000
+	seg.b = []byte("data")
+	ih.callback(c.encode(seg, 80), testClientAddr, testServerAddr)
+	hdr, ok := parse()
+	if !ok || !hdr.RST() || hdr.ACK() || hdr.seq != 2000 || hdr.dstport != 10000 || hdr.srcport != 80 {
+		t.Errorf("unexpected response to ACK to closed port: %+v", hdr)
+	}
+
+	// a RST is never answered
+	seg.hdr = genericHeader{}
+	seg.hdr.SetRST(true)
+	ih.callback(c.encode(seg, 80), testClientAddr, testServerAddr)
+	if _, ok := parse(); ok || len(ih.take()) != 0 {
+		t.Errorf("RST to closed port answered")
+	}
+}
@@ -0,0 +1,105 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// the number of samples kept by a Conn; see SetThroughputInterval
+const throughputSamples = 32
+
+// A Sample measures a connection's throughput over an interval.
+// See (*Conn).SetThroughputInterval.
+type Sample struct {
+	Time     time.Time     // when the sample was taken, according to time.Now
+	Interval time.Duration // the time since the previous sample
+	Read     uint64        // bytes read by the application during the interval
+	Acked    uint64        // bytes acknowledged by the other side during the interval
+}
+
+// ReadRate returns the rate in bytes per second at which
+// the application read data during the interval.
+func (s Sample) ReadRate() float64 { return rate(s.Read, s.Interval) }
+
+// AckRate returns the rate in bytes per second at which
+// the other side acknowledged data during the interval.
+func (s Sample) AckRate() float64 { return rate(s.Acked, s.Interval) }
+
+func rate(bytes uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) / d.Seconds()
+}
+
+// SetThroughputInterval starts sampling c's throughput every d, discarding
+// any samples already taken. Each sample records the number of bytes read by
+// the application, and the number of bytes written which were acknowledged by
+// the other side, since the last. The most recent samples are returned by
+// Throughput. If d is 0, which is the default, c's throughput isn't sampled.
+func (c *Conn) SetThroughputInterval(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopThroughputTimer()
+	c.tputInterval = d
+	c.tputSamples = nil
+	c.tputNext = 0
+	if d <= 0 || c.state == StateClosed {
+		return
+	}
+	c.tputSamples = make([]Sample, 0, throughputSamples)
+	c.tputLast = timeout.NowMonotonic()
+	c.tputRead, c.tputAcked = c.counters.BytesRead, c.counters.BytesAcked
+	c.tputDue = c.tputLast.Add(d)
+	c.tputHandle = c.timeoutd.AddTimeout(c.sampleThroughput, c.tputDue)
+}
+
+// Throughput returns the samples taken since SetThroughputInterval was last
+// called, oldest first. Only the most recent samples are kept.
+func (c *Conn) Throughput() []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples := make([]Sample, 0, len(c.tputSamples))
+	samples = append(samples, c.tputSamples[c.tputNext:]...)
+	return append(samples, c.tputSamples[:c.tputNext]...)
+}
+
+// sampleThroughput is called every conn.tputInterval to take a sample. The
+// timer is rearmed relative to when it was due, rather than when it fired, so
+// that the samples don't drift.
+func (conn *Conn) sampleThroughput() {
+	conn.tputHandle = nil
+	// the interval is measured with the monotonic clock,
+	// which can't be compared with time.Now
+	now := timeout.NowMonotonic()
+	s := Sample{
+		Time:     time.Now(),
+		Interval: now.Sub(conn.tputLast),
+		Read:     conn.counters.BytesRead - conn.tputRead,
+		Acked:    conn.counters.BytesAcked - conn.tputAcked,
+	}
+	if len(conn.tputSamples) < cap(conn.tputSamples) {
+		conn.tputSamples = append(conn.tputSamples, s)
+	} else {
+		// the ring is full; overwrite the oldest sample
+		conn.tputSamples[conn.tputNext] = s
+		conn.tputNext = (conn.tputNext + 1) % len(conn.tputSamples)
+	}
+	conn.tputLast = now
+	conn.tputRead, conn.tputAcked = conn.counters.BytesRead, conn.counters.BytesAcked
+
+	conn.tputDue = conn.tputDue.Add(conn.tputInterval)
+	if conn.tputDue.Before(now) {
+		// we fell behind by more than an interval
+		conn.tputDue = now.Add(conn.tputInterval)
+	}
+	conn.tputHandle = conn.timeoutd.AddTimeout(conn.sampleThroughput, conn.tputDue)
+}
+
+func (conn *Conn) stopThroughputTimer() {
+	if conn.tputHandle != nil {
+		conn.tputHandle.Cancel()
+		conn.tputHandle = nil
+	}
+}
@@ -0,0 +1,181 @@
+package tcp
+
+import "github.com/joshlf/net/internal/errors"
+
+// UrgentPointerStyle selects how the urgent pointer is interpreted. RFC 793
+// is ambiguous as to whether it points to the last byte of urgent data or to
+// the byte following it, and RFC 1122 chose the former, but most
+// implementations, following BSD, use the latter. Both sides of a connection
+// must use the same style for urgent data to be delivered correctly.
+// See https://tools.ietf.org/html/rfc6093#section-2
+type UrgentPointerStyle uint8
+
+const (
+	// UrgentPointerBSD interprets the urgent pointer as pointing to the
+	// byte following the urgent data. It is the default, and is what
+	// RFC 6093 recommends.
+	UrgentPointerBSD UrgentPointerStyle = iota
+	// UrgentPointerRFC1122 interprets the urgent pointer as pointing
+	// to the last byte of urgent data.
+	UrgentPointerRFC1122
+)
+
+var noUrgentErr = errors.New("no urgent data available")
+
+// WriteUrgent is like Write, but the last byte of b is marked as urgent. The
+// other side can read the urgent byte out of band with ReadUrgent; it is not
+// delivered by Read. As with BSD sockets, only a single byte of urgent data
+// is supported, so writing urgent data before the other side has read the
+// previous urgent byte may cause that byte to be delivered in the normal
+// stream instead. See https://tools.ietf.org/html/rfc6093
+func (c *Conn) WriteUrgent(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write([][]byte{b}, true)
+}
+
+// ReadUrgent returns the most recent byte of urgent data sent by the other
+// side. If no urgent data has arrived which hasn't already been returned by
+// ReadUrgent, it returns an error without blocking. UrgentPending reports
+// whether urgent data has been signaled.
+func (c *Conn) ReadUrgent() (b byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readClosed {
+		return 0, closedErr
+	}
+	if !c.oobValid {
+		return 0, noUrgentErr
+	}
+	c.oobValid = false
+	return c.oob, nil
+}
+
+// UrgentPending reports whether the other side has sent urgent data which
+// hasn't been read with ReadUrgent. It may return true before the urgent byte
+// itself has arrived, in which case ReadUrgent will return an error until it
+// does.
+func (c *Conn) UrgentPending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.oobValid || c.oobPending
+}
+
+// AtUrgentMark reports whether all of the data preceding the most recent
+// urgent byte has been read. Read never returns data from both sides of the
+// urgent byte at once, so once AtUrgentMark returns true, the data returned
+// by the next call to Read was sent after the urgent data.
+func (c *Conn) AtUrgentMark() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rcvUrgent && seq(c.incoming.Seq()) == c.rcvUp-1
+}
+
+// SetUrgentPointerStyle sets the interpretation of the urgent pointer in
+// segments sent and received by c. The default is UrgentPointerBSD.
+func (c *Conn) SetUrgentPointerStyle(style UrgentPointerStyle) {
+	c.mu.Lock()
+	c.urgStyle = style
+	c.mu.Unlock()
+}
+
+// setUrgentPointer sets the URG flag and urgent pointer of hdr, a segment
+// starting at s, if there is urgent data at or after s which hasn't been
+// acknowledged.
+func (conn *Conn) setUrgentPointer(hdr *genericHeader, s seq) {
+	if !conn.sndUrgent || !conn.sndUp.gt(s) {
+		return
+	}
+	off := uint32(conn.sndUp - s)
+	if conn.urgStyle == UrgentPointerRFC1122 {
+		off--
+	}
+	if off > 0xFFFF {
+		// the urgent data is further ahead than can be expressed;
+		// a later segment will carry the real pointer
+		// See https://tools.ietf.org/html/rfc6093#section-4
+		off = 0xFFFF
+	}
+	hdr.SetURG(true)
+	hdr.urgptr = uint16(off)
+}
+
+// urgentAcked leaves urgent mode once all urgent data has been acknowledged.
+func (conn *Conn) urgentAcked() {
+	if conn.sndUrgent && conn.sndUna.geq(conn.sndUp) {
+		conn.sndUrgent = false
+	}
+}
+
+// handleUrgent processes the urgent pointer of an acceptable segment.
+// See "Urgent Pointer," https://tools.ietf.org/html/rfc1122#page-84
+func (conn *Conn) handleUrgent(hdr *genericHeader) {
+	if !hdr.URG() {
+		return
+	}
+	switch conn.state {
+	case StateEstablished, StateFINWait1, StateFINWait2:
+	default:
+		return
+	}
+	// up is the sequence number following the urgent byte
+	up := hdr.seq + seq(hdr.urgptr)
+	if conn.urgStyle == UrgentPointerRFC1122 {
+		up++
+	}
+	// rcvUp is only updated when urgent data arrives, so it is only
+	// compared against while the urgent byte hasn't been read; otherwise,
+	// it may be so far behind that the comparison would wrap around
+	known := (conn.rcvUrgent || conn.oobPending) && !up.gt(conn.rcvUp)
+	if !up.gt(hdr.seq) || known || !up.gt(seq(conn.incoming.Seq())) {
+		// a zero pointer, a mark we already know about,
+		// or urgent data that has already been read
+		return
+	}
+	if conn.rcvUrgent {
+		// The previous urgent byte hasn't been reached in the
+		// stream yet. Rather than losing it, leave it there.
+		conn.oobValid = false
+	}
+	conn.rcvUp = up
+	conn.rcvUrgent = true
+	conn.oobPending = true
+	conn.readCond.Broadcast()
+}
+
+// captureUrgent copies the urgent byte out of the receive buffer once it has
+// arrived in sequence.
+func (conn *Conn) captureUrgent() {
+	if !conn.oobPending || conn.rcvNxt.lt(conn.rcvUp) {
+		return
+	}
+	var b [1]byte
+	conn.incoming.Peek(b[:], uint32(conn.rcvUp-1))
+	conn.oob = b[0]
+	conn.oobValid = true
+	conn.oobPending = false
+}
+
+// readable returns the number of bytes which Read may return. If the urgent
+// byte is at the beginning of the receive buffer, it is discarded first, since
+// it is delivered by ReadUrgent instead. Read stops at the urgent byte so
+// that AtUrgentMark can distinguish the data before and after it.
+func (conn *Conn) readable() int {
+	if conn.rcvUrgent && seq(conn.incoming.Seq()) == conn.rcvUp-1 && conn.incoming.Available() > 0 {
+		var b [1]byte
+		prev := conn.incoming.Cap()
+		conn.incoming.ReadAndAdvance(b[:])
+		conn.rcvUrgent = false
+		conn.windowUpdate(prev)
+	}
+	n := conn.incoming.Available()
+	if conn.rcvUrgent {
+		if mark := int(conn.rcvUp - 1 - seq(conn.incoming.Seq())); mark < n {
+			n = mark
+		}
+	}
+	return n
+}
@@ -0,0 +1,200 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/joshlf/net/internal/timeout"
+)
+
+// windowShift returns the smallest window scale which allows a window of
+// size bytes to be advertised.
+func windowShift(size int) uint8 {
+	var shift uint8
+	for shift < maxWindowScale && size > 0xFFFF<<shift {
+		shift++
+	}
+	return shift
+}
+
+// sndWindow returns the send window advertised by hdr. The window field of a
+// SYN is never scaled. See https://tools.ietf.org/html/rfc7323#section-2.2
+func (conn *Conn) sndWindow(hdr *genericHeader) uint32 {
+	if hdr.SYN() {
+		return uint32(hdr.window)
+	}
+	return uint32(hdr.window) << conn.sndShift
+}
+
+// encodeWindow returns the value of the window field of an outgoing segment,
+// which is scaled down by our window scale unless the segment is a SYN. Since
+// the scaled window is rounded down, the other side may see the window shrink
+// by less than 1<<rcvShift bytes, which RFC 7323 allows for.
+func (conn *Conn) encodeWindow(syn bool) uint16 {
+	shift := conn.rcvShift
+	if syn {
+		shift = 0
+	}
+	wnd := conn.window() >> shift
+	if wnd > 0xFFFF {
+		wnd = 0xFFFF
+	}
+	return uint16(wnd)
+}
+
+// setReadBuffer sets the size of the receive buffer, clamped to the allowed
+// range. Before the handshake, it determines the window scale we offer, which
+// in turn limits the size once the connection is synchronized. The buffer is
+// never made too small to hold the data it already contains.
+func (conn *Conn) setReadBuffer(n int) {
+	max := 0xFFFF << conn.maxRcvShift
+	synchronized := conn.state != StateListen && conn.state != StateSYNSent
+	if synchronized {
+		max = 0xFFFF << conn.rcvShift
+	}
+	n = clampBufferSize(n, max)
+	if !synchronized {
+		conn.rcvBufSize = n
+		conn.setRcvShift()
+		return
+	}
+	if used := int(conn.incoming.End() - conn.incoming.Seq()); n < used {
+		n = used
+	}
+	prev := conn.incoming.Cap()
+	conn.rcvBufSize = n
+	conn.incoming.Resize(n)
+	conn.windowUpdate(prev)
+}
+
+// setRcvShift chooses the window scale to offer in our SYN, which must allow
+// for the receive buffer to grow to the auto-tuning limit.
+func (conn *Conn) setRcvShift() {
+	size := conn.rcvBufSize
+	if conn.autoTuneMax > size {
+		size = conn.autoTuneMax
+	}
+	conn.rcvShift = windowShift(size)
+	if conn.rcvShift > conn.maxRcvShift {
+		conn.rcvShift = conn.maxRcvShift
+	}
+}
+
+// setMaxWindowScale sets the largest window scale we offer, clamping the
+// receive buffer and auto-tuning limit to the largest window it allows. It
+// must be called before the handshake.
+func (conn *Conn) setMaxWindowScale(shift uint8) {
+	conn.maxRcvShift = shift
+	conn.setReadBuffer(conn.rcvBufSize)
+	conn.setAutoTuning(conn.autoTuneMax)
+}
+
+// setAutoTuning sets the auto-tuning limit, clamped to the allowed range. Once
+// the connection is synchronized, the window scale can't be changed, so the
+// limit can't exceed the largest window the scale allows.
+func (conn *Conn) setAutoTuning(max int) {
+	if max == 0 {
+		conn.autoTuneMax = 0
+		return
+	}
+	if conn.state == StateListen || conn.state == StateSYNSent {
+		conn.autoTuneMax = clampBufferSize(max, 0xFFFF<<conn.maxRcvShift)
+		conn.setRcvShift()
+		return
+	}
+	conn.autoTuneMax = clampBufferSize(max, 0xFFFF<<conn.rcvShift)
+}
+
+// autoTune implements receive buffer auto-tuning (also known as dynamic
+// right-sizing). It is called by Read with the number of bytes just read.
+//
+// Once per round trip, we measure how much data the application has read
+// during the last round trip. That is the throughput that the connection is
+// achieving, limited either by the window or by the application. The target
+// buffer size is twice that, so that the window stays ahead of a sender in
+// slow start, which doubles its rate every round trip. If the target is larger
+// than the buffer, the buffer grows immediately. If the application isn't
+// keeping up and the target is smaller, the buffer shrinks toward it as data
+// is read, so that the right edge of the window is never retracted.
+func (conn *Conn) autoTune(n int) {
+	if conn.autoTuneMax == 0 || !conn.wsOK {
+		return
+	}
+	if excess := conn.rcvBufSize - conn.autoTuneTarget; excess > 0 {
+		if excess > n {
+			excess = n
+		}
+		conn.rcvBufSize -= excess
+		conn.incoming.Resize(conn.rcvBufSize)
+	}
+
+	conn.rcvCopied += n
+	rtt := conn.rcvRTT
+	if rtt == 0 {
+		// we may be sending data as well
+		rtt = conn.rtt.srtt
+	}
+	now := timeout.NowMonotonic()
+	if rtt == 0 || now.Sub(conn.rcvSpaceTime) < rtt {
+		return
+	}
+	target := 2 * conn.rcvCopied
+	switch {
+	case target < conn.autoTuneMin:
+		target = conn.autoTuneMin
+	case target > conn.autoTuneMax:
+		target = conn.autoTuneMax
+	}
+	conn.autoTuneTarget = target
+	if target > conn.rcvBufSize {
+		conn.rcvBufSize = target
+		conn.incoming.Resize(target)
+	}
+	conn.rcvCopied = 0
+	conn.rcvSpaceTime = now
+}
+
+// sampleRcvRTT updates the RTT estimate used by auto-tuning from hdr, an
+// incoming data segment. A receiver which sends no data can't measure the RTT
+// from ACKs, but if timestamps are in use, the timestamp echoed by the other
+// side tells how long ago we sent the ACK which its data is responding to.
+// See https://tools.ietf.org/html/rfc7323#section-4.1
+func (conn *Conn) sampleRcvRTT(hdr *genericHeader) {
+	if conn.autoTuneMax == 0 || !conn.tsOK || !hdr.tsSet || hdr.tsEcr == 0 {
+		return
+	}
+	rtt := time.Duration(conn.tsNow()-hdr.tsEcr) * time.Millisecond
+	if rtt <= 0 {
+		// below the resolution of the timestamp clock
+		rtt = time.Millisecond
+	}
+	if conn.rcvRTT == 0 {
+		conn.rcvRTT = rtt
+		return
+	}
+	// the same smoothing as for SRTT; see
+	// https://tools.ietf.org/html/rfc6298#section-2
+	conn.rcvRTT += (rtt - conn.rcvRTT) / 8
+}
+
+// setWriteBuffer sets the size of the send buffer, clamped to the allowed
+// range. The buffer is never made too small to hold the data it already
+// contains.
+func (conn *Conn) setWriteBuffer(n int) {
+	n = clampBufferSize(n, maxBufferSize)
+	if used := conn.outgoing.Len(); n < used {
+		n = used
+	}
+	conn.sndBufSize = n
+	conn.outgoing.Resize(n)
+	conn.writeCond.Broadcast()
+}
+
+func clampBufferSize(n, max int) int {
+	switch {
+	case n < minBufferSize:
+		return minBufferSize
+	case n > max:
+		return max
+	}
+	return n
+}
@@ -0,0 +1,371 @@
+//go:build linux
+
+package net
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// the maximum size of a packet read from a TUN device; the kernel will never
+// give us anything larger than the maximum IP packet size
+const maxTUNPacket = 65535
+
+// ifreq is the argument to the network device ioctls. The kernel's ifreq is a
+// name followed by a union of request-specific fields; we only use flags
+// (TUNSETIFF) and the MTU (SIOCGIFMTU and SIOCSIFMTU), which both live at the
+// start of the union. See netdevice(7).
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	union [24]byte
+}
+
+func (ifr *ifreq) setFlags(flags uint16) { *(*uint16)(unsafe.Pointer(&ifr.union[0])) = flags }
+func (ifr *ifreq) mtu() int              { return int(*(*int32)(unsafe.Pointer(&ifr.union[0]))) }
+func (ifr *ifreq) setMTU(mtu int)        { *(*int32)(unsafe.Pointer(&ifr.union[0])) = int32(mtu) }
+
+func (ifr *ifreq) ifname() string {
+	for i, c := range ifr.name {
+		if c == 0 {
+			return string(ifr.name[:i])
+		}
+	}
+	return string(ifr.name[:])
+}
+
+func ioctl(fd uintptr, req uintptr, ifr *ifreq) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(ifr)))
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// TUNDevice is a Device backed by a Linux TUN interface, which exchanges raw
+// IP packets with the kernel. Packets written to a TUNDevice are received by
+// the kernel's network stack as though they had arrived on the interface, and
+// packets which the kernel routes out of the interface are received by the
+// TUNDevice. A TUNDevice is capable of sending and receiving both IPv4 and
+// IPv6 packets.
+//
+// The TUN interface is created when the TUNDevice is brought up and destroyed
+// when it is brought down. The kernel side of the interface must be configured
+// separately (for example, using the ip command) with its own addresses; a
+// TUNDevice's addresses are those of this stack, not of the kernel. Creating
+// TUN interfaces requires the CAP_NET_ADMIN capability.
+//
+// The zero TUNDevice is not a valid TUNDevice. TUNDevices are safe for
+// concurrent access.
+type TUNDevice struct {
+	name string
+	file *os.File // down if nil
+	mtu  int
+
+	addr4, netmask4 IPv4
+	addr4Set        bool
+	addr6, netmask6 IPv6
+	addr6Set        bool
+
+	callback4, callback6 func(b []byte) // unset if nil
+	stats                deviceStats
+
+	sync syncer
+}
+
+var _ IPv4Device = &TUNDevice{}
+var _ IPv6Device = &TUNDevice{}
+
+// NewTUNDevice creates a new TUNDevice, which is down by default. name is the
+// name of the TUN interface, and may contain a "%d", which the kernel will
+// replace with the lowest number for which no interface exists. If name is
+// empty, the kernel will choose a name.
+func NewTUNDevice(name string) (*TUNDevice, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, errors.New("new TUNDevice: interface name too long")
+	}
+	return &TUNDevice{name: name}, nil
+}
+
+// Name returns the name of dev's TUN interface. If dev is up, this is the name
+// chosen by the kernel; otherwise, it is the name passed to NewTUNDevice.
+func (dev *TUNDevice) Name() string {
+	dev.sync.RLock()
+	name := dev.name
+	dev.sync.RUnlock()
+	return name
+}
+
+// BringUp brings dev up by creating its TUN interface. If it is already up,
+// BringUp is a no-op.
+func (dev *TUNDevice) BringUp() error {
+	return dev.sync.BringUp(func() error {
+		dev.sync.Lock()
+		defer dev.sync.Unlock()
+
+		// opening with os.OpenFile puts the file in non-blocking mode
+		// and registers it with the runtime poller, which allows the read
+		// daemon to use read deadlines to notice when it's told to stop
+		file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+		if err != nil {
+			return errors.Annotate(err, "bring device up")
+		}
+		var ifr ifreq
+		copy(ifr.name[:], dev.name)
+		ifr.setFlags(syscall.IFF_TUN | syscall.IFF_NO_PI)
+		rc, err := file.SyscallConn()
+		if err == nil {
+			rc.Control(func(fd uintptr) { err = ioctl(fd, syscall.TUNSETIFF, &ifr) })
+		}
+		if err != nil {
+			file.Close()
+			return errors.Annotate(err, "bring device up: create TUN interface")
+		}
+		mtu, err := interfaceMTU(&ifr)
+		if err != nil {
+			file.Close()
+			return errors.Annotate(err, "bring device up")
+		}
+		dev.name, dev.file, dev.mtu = ifr.ifname(), file, mtu
+		return nil
+	}, dev.readDaemon)
+}
+
+// interfaceMTU gets the MTU of the interface named by ifr.
+func interfaceMTU(ifr *ifreq) (int, error) {
+	err := socketIoctl(syscall.SIOCGIFMTU, ifr)
+	if err != nil {
+		return 0, errors.Annotate(err, "get interface MTU")
+	}
+	return ifr.mtu(), nil
+}
+
+// socketIoctl performs an ioctl which, like getting or setting an interface's
+// MTU, can only be performed through a socket.
+func socketIoctl(req uintptr, ifr *ifreq) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	return ioctl(uintptr(fd), req, ifr)
+}
+
+// BringDown brings dev down, destroying its TUN interface. If it is already
+// down, BringDown is a no-op.
+func (dev *TUNDevice) BringDown() error {
+	return dev.sync.BringDown(func() error {
+		dev.sync.Lock()
+		defer dev.sync.Unlock()
+		err := dev.file.Close()
+		dev.file = nil
+		dev.mtu = 0
+		return errors.Annotate(err, "bring device down")
+	})
+}
+
+// IsUp returns true if dev is up.
+func (dev *TUNDevice) IsUp() bool {
+	dev.sync.RLock()
+	up := dev.isUp()
+	dev.sync.RUnlock()
+	return up
+}
+
+func (dev *TUNDevice) isUp() bool {
+	return dev.file != nil
+}
+
+// MTU returns the MTU of dev's TUN interface as configured in the kernel when
+// dev was brought up, or 0 if dev is down.
+func (dev *TUNDevice) MTU() int {
+	dev.sync.RLock()
+	mtu := dev.mtu
+	dev.sync.RUnlock()
+	return mtu
+}
+
+// Stats returns a snapshot of dev's packet counters.
+func (dev *TUNDevice) Stats() DeviceStats { return dev.stats.snapshot() }
+
+// Capabilities returns dev's capabilities. The kernel computes the checksums
+// of packets it sends to dev, but validates those written to it, so dev only
+// offloads checksum verification.
+func (dev *TUNDevice) Capabilities() DeviceCaps { return RxChecksumOffload }
+
+// SetMTU sets the MTU of dev's TUN interface in the kernel. It must be at
+// least the minimum for the IP versions for which dev has addresses. Since
+// the interface only exists while dev is up, SetMTU can only be called when
+// dev is up.
+func (dev *TUNDevice) SetMTU(mtu int) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if !dev.isUp() {
+		return errors.New("set MTU on down device")
+	}
+	if err := checkMTU(mtu, true, dev.addr6Set); err != nil {
+		return err
+	}
+	var ifr ifreq
+	copy(ifr.name[:], dev.name)
+	ifr.setMTU(mtu)
+	if err := socketIoctl(syscall.SIOCSIFMTU, &ifr); err != nil {
+		return errors.Annotate(err, "set MTU")
+	}
+	dev.mtu = mtu
+	return nil
+}
+
+// IPv4 returns dev's IPv4 address and network mask if they have been set.
+func (dev *TUNDevice) IPv4() (addr, netmask IPv4, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addr4, dev.netmask4, dev.addr4Set
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv4 sets dev's IPv4 address and network mask, returning any error
+// encountered. SetIPv4 can only be called when dev is down.
+func (dev *TUNDevice) SetIPv4(addr, netmask IPv4) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("set device IP address on up device")
+	}
+	dev.addr4, dev.netmask4, dev.addr4Set = addr, netmask, true
+	return nil
+}
+
+// UnsetIPv4 unsets dev's IPv4 address and network mask, returning any error
+// encountered. UnsetIPv4 can only be called when dev is down.
+func (dev *TUNDevice) UnsetIPv4() error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("unset device IP address on up device")
+	}
+	dev.addr4, dev.netmask4, dev.addr4Set = IPv4{}, IPv4{}, false
+	return nil
+}
+
+// IPv6 returns dev's IPv6 address and network mask if they have been set.
+func (dev *TUNDevice) IPv6() (addr, netmask IPv6, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addr6, dev.netmask6, dev.addr6Set
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv6 sets dev's IPv6 address and network mask, returning any error
+// encountered. SetIPv6 can only be called when dev is down.
+func (dev *TUNDevice) SetIPv6(addr, netmask IPv6) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("set device IP address on up device")
+	}
+	dev.addr6, dev.netmask6, dev.addr6Set = addr, netmask, true
+	return nil
+}
+
+// UnsetIPv6 unsets dev's IPv6 address and network mask, returning any error
+// encountered. UnsetIPv6 can only be called when dev is down.
+func (dev *TUNDevice) UnsetIPv6() error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("unset device IP address on up device")
+	}
+	dev.addr6, dev.netmask6, dev.addr6Set = IPv6{}, IPv6{}, false
+	return nil
+}
+
+// RegisterIPv4Callback registers f to be called when IPv4 packets are received.
+func (dev *TUNDevice) RegisterIPv4Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback4 = f
+	dev.sync.Unlock()
+}
+
+// RegisterIPv6Callback registers f to be called when IPv6 packets are received.
+func (dev *TUNDevice) RegisterIPv6Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback6 = f
+	dev.sync.Unlock()
+}
+
+// WriteToIPv4 writes the IPv4 packet b to the kernel. Since a TUN interface is
+// point-to-point, dst is ignored.
+func (dev *TUNDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.write(b)
+}
+
+// WriteToIPv6 writes the IPv6 packet b to the kernel. Since a TUN interface is
+// point-to-point, dst is ignored.
+func (dev *TUNDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.write(b)
+}
+
+func (dev *TUNDevice) write(b []byte) (n int, err error) {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	if !dev.isUp() {
+		dev.stats.txDrop()
+		return 0, errors.New("write to down device")
+	}
+	if len(b) > dev.mtu {
+		dev.stats.txDrop()
+		return 0, errors.MTUf(dev.mtu, "write to device: IP packet exceeds MTU")
+	}
+	n, err = dev.file.Write(b)
+	if err != nil {
+		dev.stats.txDrop()
+	} else {
+		dev.stats.tx(n)
+	}
+	return n, errors.Annotate(err, "write to device")
+}
+
+func (dev *TUNDevice) readDaemon() {
+	b := make([]byte, maxTUNPacket)
+	for {
+		select {
+		case <-dev.sync.StopChan():
+			return
+		default:
+		}
+
+		dev.sync.RLock()
+		err := dev.file.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		if err != nil {
+			// TODO(joshlf): Log it
+			dev.sync.RUnlock()
+			continue
+		}
+		n, err := dev.file.Read(b)
+		if err != nil || n == 0 {
+			if !errors.IsTimeout(err) {
+				// TODO(joshlf): Log it
+				dev.stats.rxError()
+			}
+			dev.sync.RUnlock()
+			continue
+		}
+		dev.stats.rx(n)
+		// without packet information (IFF_NO_PI), the
+		// version field is the only way to tell IPv4
+		// and IPv6 packets apart
+		switch {
+		case b[0]>>4 == 4 && dev.callback4 != nil:
+			dev.callback4(b[:n])
+		case b[0]>>4 == 6 && dev.callback6 != nil:
+			dev.callback6(b[:n])
+		default:
+			dev.stats.rxDrop()
+		}
+		dev.sync.RUnlock()
+	}
+}
@@ -0,0 +1,77 @@
+//go:build linux && tun
+
+// This test creates a real TUN interface, so it requires the CAP_NET_ADMIN
+// capability and the ip command. Run it with:
+//
+//   go test -tags tun -run TestTUNDevice
+
+package net
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestTUNDevice(t *testing.T) {
+	dev, err := NewTUNDevice("nettest%d")
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	if err := dev.SetIPv4(IPv4{10, 99, 0, 2}, IPv4{255, 255, 255, 0}); err != nil {
+		t.Fatalf("could not set device address: %v", err)
+	}
+	if err := dev.BringUp(); err != nil {
+		t.Fatalf("could not bring device up (is CAP_NET_ADMIN missing?): %v", err)
+	}
+	defer dev.BringDown()
+	if mtu := dev.MTU(); mtu != 1500 {
+		t.Errorf("unexpected MTU: got %v; want the kernel's default of 1500", mtu)
+	}
+
+	// configure the kernel's side of the interface
+	name := dev.Name()
+	for _, args := range [][]string{
+		{"addr", "add", "10.99.0.1/24", "dev", name},
+		{"link", "set", name, "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("could not configure interface: %v: %s", err, out)
+		}
+	}
+
+	s := NewStack(StackOptions{})
+	if err := s.AddDevice("tun0", dev); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	type packet struct {
+		b        []byte
+		src, dst IPv4
+	}
+	recv := make(chan packet, 16)
+	const udp = 17
+	s.IPv4Host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) {
+		recv <- packet{append([]byte(nil), b...), src, dst}
+	}, udp)
+
+	// the kernel routes the datagram out of the TUN interface
+	conn, err := net.Dial("udp", "10.99.0.2:9")
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+
+	select {
+	case p := <-recv:
+		// skip the 8-byte UDP header
+		if p.src != (IPv4{10, 99, 0, 1}) || p.dst != (IPv4{10, 99, 0, 2}) || len(p.b) < 8 || string(p.b[8:]) != "hello" {
+			t.Errorf("unexpected packet from kernel: %v -> %v: %q", p.src, p.dst, p.b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no packet received from kernel")
+	}
+}
@@ -0,0 +1,548 @@
+package net
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+	"github.com/joshlf/net/internal/parse"
+)
+
+const (
+	udpHeaderLen = 8
+	// the number of datagrams which can be queued on a UDPConn
+	// before further datagrams are dropped
+	udpQueueLen = 64
+	// the range from which ports are chosen when
+	// listening on port 0, as suggested by RFC 6335
+	// See https://tools.ietf.org/html/rfc6335#section-6
+	udpEphemeralMin = 49152
+	udpEphemeralMax = 65535
+)
+
+// Addr represents a network address. It is equivalent to Addr from the
+// standard library's net package.
+type Addr interface {
+	Network() string
+	String() string
+}
+
+// UDPAddr is the address of a UDP endpoint.
+type UDPAddr struct {
+	IP   IP // nil for any local address
+	Port uint16
+}
+
+// Network returns "udp".
+func (a *UDPAddr) Network() string { return "udp" }
+
+func (a *UDPAddr) String() string {
+	host := ""
+	if a.IP != nil {
+		host = ipString(a.IP)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+}
+
+type udpDatagram struct {
+	b    []byte
+	addr *UDPAddr
+	dst  IP
+	info PacketInfo
+}
+
+// PktInfo holds ancillary information about a datagram received by a UDPConn,
+// like that provided by the IP_PKTINFO and IPV6_PKTINFO socket options. A
+// socket bound to the unspecified address can use it to learn which of its
+// addresses a datagram was sent to, and reply from that address with
+// WriteToFrom.
+type PktInfo struct {
+	// Dst is the destination address of the datagram.
+	Dst IP
+	// PacketInfo holds the remaining information, including the device on
+	// which the datagram was received.
+	PacketInfo
+}
+
+// UDPConn is a UDP socket bound to a local port on a Stack. A UDPConn may
+// be connected to a remote peer (see DialUDP), in which case Read and Write
+// can be used to exchange datagrams with that peer.
+//
+// UDPConns are safe for concurrent access.
+type UDPConn struct {
+	mux *udpMux
+	// a configuration copy of the mux's host so
+	// that TTLs and DSCPs can be set per socket
+	host  *IPHost
+	laddr UDPAddr
+	raddr *UDPAddr // nil if not connected
+	queue chan udpDatagram
+	// holds an error reported asynchronously,
+	// such as an ICMP port unreachable message,
+	// to be returned from the next read
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+}
+
+// ListenUDP creates a UDP socket on s bound to laddr. If laddr.IP is nil, the
+// socket receives datagrams addressed to any of s's addresses; otherwise, it
+// must be the address of one of s's devices. If laddr is nil or laddr.Port is
+// 0, an unused port is chosen.
+//
+// Datagrams addressed to ports without a socket are answered with ICMP port
+// unreachable messages.
+func (s *Stack) ListenUDP(laddr *UDPAddr) (*UDPConn, error) {
+	addr, err := s.udpLocalAddr(laddr)
+	if err != nil {
+		return nil, errors.Annotate(err, "listen UDP")
+	}
+	c, err := s.listenUDP(addr, nil)
+	return c, errors.Annotate(err, "listen UDP")
+}
+
+// DialUDP creates a UDP socket on s bound to laddr, as with ListenUDP, and
+// connects it to raddr, which must have a non-nil IP and a non-zero port.
+// Read only returns datagrams sent from raddr, and Write sends datagrams to
+// raddr. Only ICMP errors reporting that raddr is unreachable are returned
+// from Read or ReadFrom.
+func (s *Stack) DialUDP(laddr, raddr *UDPAddr) (*UDPConn, error) {
+	if raddr == nil || raddr.IP == nil || raddr.Port == 0 {
+		return nil, errors.New("dial UDP: invalid remote address")
+	}
+	addr, err := s.udpLocalAddr(laddr)
+	if err != nil {
+		return nil, errors.Annotate(err, "dial UDP")
+	}
+	if addr.IP != nil && addr.IP.IPVersion() != raddr.IP.IPVersion() {
+		return nil, errors.New("dial UDP: mixed local and remote IP versions")
+	}
+	r := *raddr
+	c, err := s.listenUDP(addr, &r)
+	return c, errors.Annotate(err, "dial UDP")
+}
+
+// listenUDP creates a UDP socket bound to addr and, if raddr is non-nil,
+// connected to raddr, unless s has been closed. s.mu is held so that
+// the socket is either created before Close closes all of them, or not
+// at all.
+func (s *Stack) listenUDP(addr UDPAddr, raddr *UDPAddr) (*UDPConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("stack is closed")
+	}
+	return s.udp.listen(addr, raddr)
+}
+
+// udpLocalAddr validates the local address laddr,
+// which may be nil for any address and port.
+func (s *Stack) udpLocalAddr(laddr *UDPAddr) (UDPAddr, error) {
+	var addr UDPAddr
+	if laddr != nil {
+		addr = *laddr
+	}
+	if addr.IP != nil && !s.isLocal(addr.IP) {
+		return addr, errors.Errorf("not a local address: %v", ipString(addr.IP))
+	}
+	return addr, nil
+}
+
+// isLocal returns true if addr is the address of one of s's devices.
+func (s *Stack) isLocal(addr IP) bool {
+	for _, name := range s.DeviceNames() {
+		dev, _ := s.Device(name)
+		if dev4, ok := dev.(IPv4Device); ok {
+			if devaddr, _, ok := dev4.IPv4(); ok && devaddr == addr {
+				return true
+			}
+		}
+		if dev6, ok := dev.(IPv6Device); ok {
+			if devaddr, _, ok := dev6.IPv6(); ok && devaddr == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LocalAddr returns the local address to which c is bound.
+func (c *UDPConn) LocalAddr() Addr {
+	addr := c.laddr
+	return &addr
+}
+
+// RemoteAddr returns the remote address to which c is connected, or nil if
+// c is not connected.
+func (c *UDPConn) RemoteAddr() Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	addr := *c.raddr
+	return &addr
+}
+
+// ReadFrom reads a datagram into b, returning the number of bytes read and
+// the address from which it was sent. If b is too small to hold the datagram,
+// the remainder is discarded. ReadFrom blocks until a datagram is received
+// or c is closed. If c is connected, ReadFrom still returns datagrams from
+// any address; use Read to receive only datagrams from the connected peer.
+//
+// If an ICMP message was received reporting that a datagram sent by c could
+// not be delivered, ReadFrom returns an error for which IsUnreachable returns
+// true. It also matches the sentinel error for the reason given in the ICMP
+// message, such as ErrPortUnreachable (which in turn matches ErrConnRefused),
+// when checked with the standard library's errors.Is. Subsequent calls to ReadFrom will return datagrams as usual.
+func (c *UDPConn) ReadFrom(b []byte) (n int, addr Addr, err error) {
+	n, addr, _, err = c.ReadFromInfo(b)
+	return n, addr, err
+}
+
+// ReadFromInfo is like ReadFrom, but also returns information from the IP
+// header of the datagram, such as the TTL (for IPv4) or hop limit (for IPv6)
+// with which it was received. Since a datagram's TTL can only be decremented
+// in transit, applications can use it to reject datagrams which did not
+// originate nearby.
+// See https://tools.ietf.org/html/rfc5082
+func (c *UDPConn) ReadFromInfo(b []byte) (n int, addr Addr, info PacketInfo, err error) {
+	n, addr, pi, err := c.readFrom(b, nil)
+	return n, addr, pi.PacketInfo, err
+}
+
+// ReadFromPktInfo is like ReadFromInfo, but also returns the address to which
+// the datagram was sent.
+func (c *UDPConn) ReadFromPktInfo(b []byte) (n int, addr Addr, info PktInfo, err error) {
+	return c.readFrom(b, nil)
+}
+
+// readFrom is like ReadFromPktInfo, but gives up with a timeout error
+// once timeout fires. If timeout is nil, it waits indefinitely.
+func (c *UDPConn) readFrom(b []byte, timeout <-chan time.Time) (n int, addr Addr, info PktInfo, err error) {
+	select {
+	case <-c.closed:
+		return 0, nil, info, errors.New("read from closed UDP socket")
+	case err := <-c.errs:
+		return 0, nil, info, err
+	case d := <-c.queue:
+		return copy(b, d.b), d.addr, PktInfo{Dst: d.dst, PacketInfo: d.info}, nil
+	case <-timeout:
+		return 0, nil, info, errors.Timeoutf("read from UDP socket timed out")
+	}
+}
+
+// Read is like ReadFrom, but if c is connected, datagrams which were not sent
+// from the connected peer are discarded.
+func (c *UDPConn) Read(b []byte) (n int, err error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil || c.raddr == nil || *addr.(*UDPAddr) == *c.raddr {
+			return n, err
+		}
+	}
+}
+
+// SetTTL sets the TTL of IPv4 datagrams sent by c. ttl must be in the range
+// [1, 255]. The default is 64.
+func (c *UDPConn) SetTTL(ttl int) error {
+	if ttl < 1 || ttl > 255 {
+		return errors.New("set UDP socket TTL: TTL out of range")
+	}
+	c.host.IPv4Host.SetTTL(uint8(ttl))
+	return nil
+}
+
+// SetHopLimit is like SetTTL, but sets the hop limit of IPv6 datagrams.
+func (c *UDPConn) SetHopLimit(hops int) error {
+	if hops < 1 || hops > 255 {
+		return errors.New("set UDP socket hop limit: hop limit out of range")
+	}
+	c.host.IPv6Host.SetTTL(uint8(hops))
+	return nil
+}
+
+// SetBroadcast sets whether c may send datagrams to IPv4 broadcast addresses -
+// 255.255.255.255, or the broadcast address of a device's subnet. Like the
+// SO_BROADCAST socket option, it is off by default, and writes to broadcast
+// addresses fail until it is set. Broadcasts are received regardless, as long
+// as c isn't bound to a particular address.
+func (c *UDPConn) SetBroadcast(on bool) {
+	c.host.IPv4Host.SetBroadcast(on)
+}
+
+// SetDSCP sets the differentiated services codepoint of datagrams sent by c,
+// which must fit in 6 bits. The default is 0.
+func (c *UDPConn) SetDSCP(dscp uint8) error {
+	return errors.Annotate(c.host.SetDSCP(dscp), "set UDP socket DSCP")
+}
+
+// Write writes a datagram with the payload b to the peer to which c is
+// connected. It is an error if c is not connected.
+func (c *UDPConn) Write(b []byte) (n int, err error) {
+	if c.raddr == nil {
+		return 0, errors.New("write UDP datagram: socket not connected")
+	}
+	return c.WriteTo(b, c.raddr)
+}
+
+// WriteTo writes a datagram with the payload b to addr, which must be a
+// *UDPAddr with a non-nil IP and a non-zero port. If c is connected, addr
+// need not be the connected peer. If c is bound to a particular address, the
+// datagram is sent from that address; otherwise, it is sent from the address
+// of the device through which addr is routed.
+func (c *UDPConn) WriteTo(b []byte, addr Addr) (n int, err error) {
+	return c.WriteToFrom(b, addr, nil)
+}
+
+// WriteToFrom is like WriteTo, but the datagram is sent from src, which must be
+// the address of one of the Stack's devices. This allows a socket bound to the
+// unspecified address to reply from the address to which a request was sent
+// (see ReadFromPktInfo). If src is nil, it is equivalent to WriteTo. It is an
+// error if c is bound to a different address.
+func (c *UDPConn) WriteToFrom(b []byte, addr Addr, src IP) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("write to closed UDP socket")
+	default:
+	}
+	raddr, ok := addr.(*UDPAddr)
+	if !ok || raddr.IP == nil || raddr.Port == 0 {
+		return 0, errors.New("write UDP datagram: invalid address")
+	}
+	if len(b) > 0xFFFF-udpHeaderLen {
+		return 0, errors.New("write UDP datagram: payload exceeds maximum datagram size")
+	}
+
+	if c.laddr.IP != nil {
+		if src != nil && src != c.laddr.IP {
+			return 0, errors.New("write UDP datagram: source address differs from bound address")
+		}
+		src = c.laddr.IP
+	}
+	if src != nil && src.IPVersion() != raddr.IP.IPVersion() {
+		return 0, errors.New("write UDP datagram: mixed source and destination IP versions")
+	}
+
+	host := c.host
+	pinned := src != nil
+	if !pinned {
+		switch dst := raddr.IP.(type) {
+		case IPv4:
+			src, err = host.IPv4Host.IPv4SourceAddr(dst)
+		case IPv6:
+			src, err = host.IPv6Host.IPv6SourceAddr(dst)
+		}
+		if err != nil {
+			return 0, errors.Annotate(err, "write UDP datagram")
+		}
+	}
+
+	buf := make([]byte, udpHeaderLen+len(b))
+	hdr := buf
+	parse.PutUint16(&hdr, c.laddr.Port)
+	parse.PutUint16(&hdr, raddr.Port)
+	parse.PutUint16(&hdr, uint16(len(buf)))
+	copy(buf[udpHeaderLen:], b)
+	setUDPChecksum(buf, udpChecksum(buf, src, raddr.IP))
+
+	if pinned {
+		n, err = host.WriteToFrom(buf, src, raddr.IP, IPProtocolUDP)
+	} else {
+		n, err = host.WriteTo(buf, raddr.IP, IPProtocolUDP)
+	}
+	if n < udpHeaderLen {
+		n = 0
+	} else {
+		n -= udpHeaderLen
+	}
+	return n, errors.Annotate(err, "write UDP datagram")
+}
+
+// Close closes c, unblocking any blocked calls to ReadFrom, and frees its
+// port. Closing an already-closed UDPConn is a no-op.
+func (c *UDPConn) Close() error {
+	c.once.Do(func() {
+		c.mux.remove(c)
+		close(c.closed)
+	})
+	return nil
+}
+
+// udpMux demultiplexes incoming UDP datagrams to the UDPConn bound to their
+// destination ports. The zero value is not a valid udpMux; use init.
+type udpMux struct {
+	host  *IPHost
+	conns map[uint16]*UDPConn
+	// the next port to try when choosing a port
+	nextEphemeral uint16
+
+	mu sync.RWMutex
+}
+
+func (mux *udpMux) init(host *IPHost) {
+	mux.host = host
+	mux.conns = make(map[uint16]*UDPConn)
+	mux.nextEphemeral = udpEphemeralMin
+	host.RegisterInfoCallback(mux.callback, IPProtocolUDP)
+	host.RegisterUnreachableCallback(mux.unreachableCallback, IPProtocolUDP)
+}
+
+// listen creates a UDPConn bound to laddr and,
+// if raddr is non-nil, connected to raddr.
+func (mux *udpMux) listen(laddr UDPAddr, raddr *UDPAddr) (*UDPConn, error) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if laddr.Port == 0 {
+		port, ok := mux.ephemeralPort()
+		if !ok {
+			return nil, errors.New("no free ports")
+		}
+		laddr.Port = port
+	} else if _, ok := mux.conns[laddr.Port]; ok {
+		return nil, errors.Errorf("address already in use: %v", &laddr)
+	}
+	c := &UDPConn{
+		mux:    mux,
+		host:   mux.host.GetConfigCopy(),
+		laddr:  laddr,
+		raddr:  raddr,
+		queue:  make(chan udpDatagram, udpQueueLen),
+		errs:   make(chan error, 1),
+		closed: make(chan struct{}),
+	}
+	mux.conns[laddr.Port] = c
+	return c, nil
+}
+
+// ephemeralPort returns an unused port in the ephemeral range;
+// assumes mux.mu.Lock
+func (mux *udpMux) ephemeralPort() (uint16, bool) {
+	for i := 0; i <= udpEphemeralMax-udpEphemeralMin; i++ {
+		port := mux.nextEphemeral
+		if port == udpEphemeralMax {
+			mux.nextEphemeral = udpEphemeralMin
+		} else {
+			mux.nextEphemeral++
+		}
+		if _, ok := mux.conns[port]; !ok {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (mux *udpMux) remove(c *UDPConn) {
+	mux.mu.Lock()
+	if mux.conns[c.laddr.Port] == c {
+		delete(mux.conns, c.laddr.Port)
+	}
+	mux.mu.Unlock()
+}
+
+// closeAll closes all of mux's UDPConns.
+func (mux *udpMux) closeAll() {
+	mux.mu.RLock()
+	conns := make([]*UDPConn, 0, len(mux.conns))
+	for _, c := range mux.conns {
+		conns = append(conns, c)
+	}
+	mux.mu.RUnlock()
+	// Close acquires mux.mu to remove each UDPConn
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// callback handles the UDP datagram b sent from src to dst
+// and received with the given header information.
+// See https://tools.ietf.org/html/rfc768
+func (mux *udpMux) callback(b []byte, src, dst IP, info PacketInfo) {
+	if len(b) < udpHeaderLen {
+		// TODO(joshlf): Log it
+		return
+	}
+	hdr := b
+	srcport := parse.GetUint16(&hdr)
+	dstport := parse.GetUint16(&hdr)
+	length := int(parse.GetUint16(&hdr))
+	sum := parse.GetUint16(&hdr)
+	if length < udpHeaderLen || length > len(b) {
+		// TODO(joshlf): Log it
+		return
+	}
+	b = b[:length]
+	switch {
+	case sum == 0 && dst.IPVersion() == 6:
+		// the checksum is mandatory in IPv6
+		// See https://tools.ietf.org/html/rfc2460#section-8.1
+		return
+	case sum != 0 && Checksum(b, PseudoHeaderSum(src, dst, IPProtocolUDP, len(b))) != 0xFFFF:
+		// TODO(joshlf): Log it
+		return
+	}
+
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	c, ok := mux.conns[dstport]
+	if !ok || (c.laddr.IP != nil && c.laddr.IP != dst) {
+		switch dst := dst.(type) {
+		case IPv4:
+			mux.host.IPv4Host.WriteIPv4Unreachable(UnreachablePort, b, src.(IPv4), dst, IPProtocolUDP)
+		case IPv6:
+			mux.host.IPv6Host.WriteIPv6Unreachable(UnreachablePort, b, src.(IPv6), dst, IPProtocolUDP)
+		}
+		// TODO(joshlf): Log error
+		return
+	}
+	select {
+	// the caller may reuse b once we return
+	case c.queue <- udpDatagram{append([]byte(nil), b[udpHeaderLen:]...), &UDPAddr{IP: src, Port: srcport}, dst, info}:
+	default:
+		// TODO(joshlf): Log it
+	}
+}
+
+// unreachableCallback handles an ICMP message reporting that the UDP datagram
+// beginning with b, sent from src to dst, could not be delivered.
+func (mux *udpMux) unreachableCallback(code UnreachableCode, b []byte, src, dst IP) {
+	if len(b) < 4 {
+		return
+	}
+	srcport := parse.GetUint16(&b)
+	dstport := parse.GetUint16(&b)
+	mux.mu.RLock()
+	c, ok := mux.conns[srcport]
+	mux.mu.RUnlock()
+	if !ok {
+		return
+	}
+	raddr := &UDPAddr{IP: dst, Port: dstport}
+	if c.raddr != nil && *c.raddr != *raddr {
+		// a connected socket only reports errors about its peer
+		return
+	}
+	select {
+	case c.errs <- errors.NewUnreachable(raddr.String(), code.err()):
+	default:
+		// an error is already pending
+	}
+}
+
+// udpChecksum computes the checksum of the UDP datagram b sent from src to
+// dst, covering the pseudo-header. The checksum field of b must be zero.
+func udpChecksum(b []byte, src, dst IP) uint16 {
+	sum := ^Checksum(b, PseudoHeaderSum(src, dst, IPProtocolUDP, len(b)))
+	if sum == 0 {
+		// a zero checksum means that no checksum
+		// was computed, so it's sent as all ones
+		sum = 0xFFFF
+	}
+	return sum
+}
+
+// setUDPChecksum sets the checksum field of the encoded UDP datagram b.
+func setUDPChecksum(b []byte, sum uint16) {
+	b = b[6:]
+	parse.PutUint16(&b, sum)
+}
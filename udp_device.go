@@ -7,11 +7,17 @@ import (
 	"github.com/joshlf/net/internal/errors"
 )
 
+// the largest MTU of a UDP device: the largest payload of a UDP datagram
+// sent over IPv4, which is the most that the underlying socket can carry
+// regardless of the IP version of the tunnel's endpoints
+const maxUDPDeviceMTU = 0xFFFF - 20 - 8
+
 type udpDevice struct {
 	laddr, raddr *net.UDPAddr
 	conn         *net.UDPConn // only a listening connection; down if nil
 	mtu          int
 	callback     func(b []byte) // unset if nil
+	stats        deviceStats
 
 	sync syncer
 }
@@ -24,6 +30,55 @@ func (dev *udpDevice) UDPAddrs() (laddr, raddr *net.UDPAddr) {
 	return laddr, raddr
 }
 
+// Rebind changes the local and remote UDP addresses used by dev, which is
+// useful when the other end of the tunnel moves. dev keeps its IP
+// configuration, and remains attached to any Stack to which it has been added.
+//
+// If dev is up and laddr differs from its current local address, a socket
+// is bound to laddr before the old one is closed. If binding fails, dev is
+// left unchanged and the error is returned. Otherwise, reads and writes in
+// progress complete on the old socket, and subsequent ones use the new one.
+// Frames which arrive at the old socket after the swap are lost.
+func (dev *udpDevice) Rebind(laddr, raddr *net.UDPAddr) error {
+	return dev.sync.WhileUpOrDown(func(up bool) error {
+		dev.sync.RLock()
+		rebind := up && !udpAddrEqual(laddr, dev.laddr)
+		dev.sync.RUnlock()
+
+		var conn *net.UDPConn
+		if rebind {
+			var err error
+			conn, err = net.ListenUDP("udp", laddr)
+			if err != nil {
+				return errors.Annotate(err, "rebind device")
+			}
+		}
+
+		// this waits for any read by the read daemon to time out, after
+		// which it starts reading from the new socket
+		dev.sync.Lock()
+		old := dev.conn
+		dev.laddr, dev.raddr = laddr, raddr
+		if rebind {
+			dev.conn = conn
+		}
+		dev.sync.Unlock()
+		if rebind {
+			old.Close()
+		}
+		return nil
+	})
+}
+
+// udpAddrEqual returns true if a and b are the same address with the same
+// non-zero port, so that a socket bound to a is already bound to b.
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Port != 0 && a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
+
 // BringUp brings dev up. If it is already up, BringUp is a no-op.
 func (dev *udpDevice) BringUp() error {
 	return dev.sync.BringUp(func() error {
@@ -70,7 +125,32 @@ func (dev *udpDevice) isUp() bool {
 }
 
 // MTU returns dev's MTU.
-func (dev *udpDevice) MTU() int { return dev.mtu }
+func (dev *udpDevice) MTU() int {
+	dev.sync.RLock()
+	mtu := dev.mtu
+	dev.sync.RUnlock()
+	return mtu
+}
+
+// setMTU sets dev's MTU, which must be valid for the given IP version.
+func (dev *udpDevice) setMTU(mtu int, v4, v6 bool) error {
+	if err := checkMTU(mtu, v4, v6); err != nil {
+		return err
+	}
+	if mtu > maxUDPDeviceMTU {
+		return errors.Errorf("set MTU: MTU above maximum for UDP devices of %v", maxUDPDeviceMTU)
+	}
+	dev.sync.Lock()
+	dev.mtu = mtu
+	dev.sync.Unlock()
+	return nil
+}
+
+// Stats returns a snapshot of dev's packet counters.
+func (dev *udpDevice) Stats() DeviceStats { return dev.stats.snapshot() }
+
+// Capabilities returns dev's capabilities, of which it has none.
+func (dev *udpDevice) Capabilities() DeviceCaps { return 0 }
 
 func (dev *udpDevice) registerCallback(f func(b []byte)) {
 	dev.sync.Lock()
@@ -79,21 +159,28 @@ func (dev *udpDevice) registerCallback(f func(b []byte)) {
 }
 
 func (dev *udpDevice) write(b []byte) (n int, err error) {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
 	if len(b) > dev.mtu {
+		dev.stats.txDrop()
 		return 0, errors.MTUf(dev.mtu, "write to device: IPv4 payload exceeds MTU")
 	}
-	dev.sync.RLock()
-	defer dev.sync.RUnlock()
 	if !dev.isUp() {
+		dev.stats.txDrop()
 		return 0, errors.New("write to down device")
 	}
 
 	n, err = dev.conn.WriteToUDP(b, dev.raddr)
+	if err != nil {
+		dev.stats.txDrop()
+	} else {
+		dev.stats.tx(n)
+	}
 	return n, errors.Annotate(err, "write to device")
 }
 
 func (dev *udpDevice) readDaemon() {
-	b := make([]byte, dev.mtu)
+	var b []byte
 	for {
 		select {
 		case <-dev.sync.StopChan():
@@ -102,6 +189,10 @@ func (dev *udpDevice) readDaemon() {
 		}
 
 		dev.sync.RLock()
+		if len(b) != dev.mtu {
+			// the MTU has changed since the last read
+			b = make([]byte, dev.mtu)
+		}
 		err := dev.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		if err != nil {
 			// TODO(joshlf): Log it
@@ -117,12 +208,16 @@ func (dev *udpDevice) readDaemon() {
 		if err != nil {
 			if !errors.IsTimeout(err) {
 				// TODO(joshlf): Log it
+				dev.stats.rxError()
 			}
 			dev.sync.RUnlock()
 			continue
 		}
+		dev.stats.rx(n)
 		if dev.callback != nil {
 			dev.callback(b[:n])
+		} else {
+			dev.stats.rxDrop()
 		}
 		dev.sync.RUnlock()
 	}
@@ -153,6 +248,9 @@ func NewUDPIPv4Device(laddr, raddr *net.UDPAddr, mtu int) (dev *UDPIPv4Device, e
 	if mtu == 0 {
 		return nil, errors.New("new UDPIPv4Device: zero MTU")
 	}
+	if mtu > maxUDPDeviceMTU {
+		return nil, errors.Errorf("new UDPIPv4Device: MTU above maximum of %v", maxUDPDeviceMTU)
+	}
 	return &UDPIPv4Device{udpDevice: udpDevice{laddr: laddr, raddr: raddr, mtu: mtu}}, nil
 }
 
@@ -188,6 +286,13 @@ func (dev *UDPIPv4Device) UnsetIPv4() error {
 	return nil
 }
 
+// SetMTU sets dev's MTU, which must be at least 68, the minimum for IPv4. It is
+// the caller's responsibility to ensure that the MTU on the other side of the
+// connection is changed to match. SetMTU can be called while dev is up.
+func (dev *UDPIPv4Device) SetMTU(mtu int) error {
+	return dev.setMTU(mtu, true, false)
+}
+
 // RegisterIPv4Callback registers f to be called when IPv4 packets are received.
 func (dev *UDPIPv4Device) RegisterIPv4Callback(f func(b []byte)) {
 	dev.registerCallback(f)
@@ -222,7 +327,10 @@ var _ IPv6Device = &UDPIPv6Device{}
 // so an overly-large MTU will result in significant memory waste.
 func NewUDPIPv6Device(laddr, raddr *net.UDPAddr, mtu int) (dev *UDPIPv6Device, err error) {
 	if mtu == 0 {
-		return nil, errors.New("new UDPIPv4Device: zero MTU")
+		return nil, errors.New("new UDPIPv6Device: zero MTU")
+	}
+	if mtu > maxUDPDeviceMTU {
+		return nil, errors.Errorf("new UDPIPv6Device: MTU above maximum of %v", maxUDPDeviceMTU)
 	}
 	return &UDPIPv6Device{udpDevice: udpDevice{laddr: laddr, raddr: raddr, mtu: mtu}}, nil
 }
@@ -259,6 +367,13 @@ func (dev *UDPIPv6Device) UnsetIPv6() error {
 	return nil
 }
 
+// SetMTU sets dev's MTU, which must be at least 1280, the minimum for IPv6. It
+// is the caller's responsibility to ensure that the MTU on the other side of
+// the connection is changed to match. SetMTU can be called while dev is up.
+func (dev *UDPIPv6Device) SetMTU(mtu int) error {
+	return dev.setMTU(mtu, false, true)
+}
+
 // RegisterIPv6Callback registers f to be called when IPv6 packets are received.
 func (dev *UDPIPv6Device) RegisterIPv6Callback(f func(b []byte)) {
 	dev.registerCallback(f)
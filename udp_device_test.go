@@ -0,0 +1,197 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPDeviceStats(t *testing.T) {
+	addra, addrb := freeUDPAddr(t), freeUDPAddr(t)
+	a, err := NewUDPIPv4Device(addra, addrb, 1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	b, err := NewUDPIPv4Device(addrb, addra, 1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	for _, dev := range []*UDPIPv4Device{a, b} {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("could not bring device up: %v", err)
+		}
+		defer dev.BringDown()
+	}
+	recv := make(chan int, 16)
+	b.RegisterIPv4Callback(func(b []byte) { recv <- len(b) })
+
+	sizes := []int{20, 100, 1500}
+	for _, n := range sizes {
+		if _, err := a.WriteToIPv4(make([]byte, n), IPv4{}); err != nil {
+			t.Fatalf("unexpected error writing packet: %v", err)
+		}
+	}
+	for range sizes {
+		select {
+		case <-recv:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet not received")
+		}
+	}
+	// too big to send
+	a.WriteToIPv4(make([]byte, 1501), IPv4{})
+
+	// dropped by b since there's no callback
+	b.RegisterIPv4Callback(nil)
+	a.WriteToIPv4(make([]byte, 40), IPv4{})
+	for start := time.Now(); b.Stats().RxDropped == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("packet not received")
+		}
+	}
+
+	if got, want := a.Stats(), (DeviceStats{TxPackets: 4, TxBytes: 1660, TxDropped: 1}); got != want {
+		t.Errorf("unexpected sender stats: got %+v; want %+v", got, want)
+	}
+	if got, want := b.Stats(), (DeviceStats{RxPackets: 4, RxBytes: 1660, RxDropped: 1}); got != want {
+		t.Errorf("unexpected receiver stats: got %+v; want %+v", got, want)
+	}
+}
+
+func TestUDPDeviceSetMTU(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	addra, addrb := freeUDPAddr(t), freeUDPAddr(t)
+	a, _ := NewUDPIPv4Device(addra, addrb, 1500)
+	b, _ := NewUDPIPv4Device(addrb, addra, 1500)
+	a.SetIPv4(IPv4{10, 0, 0, 1}, IPv4{255, 255, 255, 0})
+	b.SetIPv4(IPv4{10, 0, 0, 2}, IPv4{255, 255, 255, 0})
+	sa, sb := NewStack(StackOptions{}), NewStack(StackOptions{})
+	sa.AddDevice("udp4:0", a)
+	sb.AddDevice("udp4:0", b)
+	for _, dev := range []*UDPIPv4Device{a, b} {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("could not bring device up: %v", err)
+		}
+		defer dev.BringDown()
+	}
+	recv := make(chan []byte, 16)
+	sb.IPv4Host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) {
+		recv <- append([]byte(nil), b...)
+	}, proto)
+
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	// send sends payload from sa to sb, and returns the number of
+	// packets it took to do so
+	send := func() int {
+		before := a.Stats().TxPackets
+		if _, err := sa.IPv4Host.WriteToIPv4(payload, IPv4{10, 0, 0, 2}, proto); err != nil {
+			t.Fatalf("unexpected error writing payload: %v", err)
+		}
+		select {
+		case got := <-recv:
+			if string(got) != string(payload) {
+				t.Fatalf("received payload differs from original")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("payload not received")
+		}
+		return int(a.Stats().TxPackets - before)
+	}
+
+	if n := send(); n != 1 {
+		t.Errorf("unexpected number of packets with MTU 1500: got %v; want 1", n)
+	}
+	for _, dev := range []*UDPIPv4Device{a, b} {
+		if err := dev.SetMTU(576); err != nil {
+			t.Fatalf("unexpected error setting MTU: %v", err)
+		}
+	}
+	// each fragment carries (576-20)&^7 = 552 bytes
+	if n := send(); n != 2 {
+		t.Errorf("unexpected number of packets with MTU 576: got %v; want 2", n)
+	}
+
+	if err := a.SetMTU(67); err == nil {
+		t.Errorf("no error setting MTU below IPv4 minimum")
+	}
+	if err := a.SetMTU(maxUDPDeviceMTU + 1); err == nil {
+		t.Errorf("no error setting MTU larger than a UDP datagram")
+	}
+	if _, err := NewLoopbackDevice(maxMTU + 1); err == nil {
+		t.Errorf("no error creating device with MTU above maximum")
+	}
+	dev6, _ := NewUDPIPv6Device(addra, addrb, 1500)
+	if err := dev6.SetMTU(1279); err == nil {
+		t.Errorf("no error setting MTU below IPv6 minimum")
+	}
+	if mtu := a.MTU(); mtu != 576 {
+		t.Errorf("unexpected MTU after failed SetMTU: got %v; want 576", mtu)
+	}
+}
+
+func TestUDPDeviceRebind(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	addra, addrb, addrc := freeUDPAddr(t), freeUDPAddr(t), freeUDPAddr(t)
+	a, _ := NewUDPIPv4Device(addra, addrb, 1500)
+	b, _ := NewUDPIPv4Device(addrb, addra, 1500)
+	a.SetIPv4(IPv4{10, 0, 0, 1}, IPv4{255, 255, 255, 0})
+	b.SetIPv4(IPv4{10, 0, 0, 2}, IPv4{255, 255, 255, 0})
+	sa, sb := NewStack(StackOptions{}), NewStack(StackOptions{})
+	sa.AddDevice("udp4:0", a)
+	sb.AddDevice("udp4:0", b)
+	for _, dev := range []*UDPIPv4Device{a, b} {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("could not bring device up: %v", err)
+		}
+		defer dev.BringDown()
+	}
+	recv := make(chan string, 16)
+	sb.IPv4Host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) {
+		recv <- string(b)
+	}, proto)
+	send := func(payload string) {
+		t.Helper()
+		if _, err := sa.IPv4Host.WriteToIPv4([]byte(payload), IPv4{10, 0, 0, 2}, proto); err != nil {
+			t.Fatalf("unexpected error writing payload: %v", err)
+		}
+		select {
+		case got := <-recv:
+			if got != payload {
+				t.Fatalf("unexpected payload: got %q; want %q", got, payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("payload not received")
+		}
+	}
+	send("before")
+
+	// b moves to a new port, and a follows it
+	if err := b.Rebind(addrc, addra); err != nil {
+		t.Fatalf("unexpected error rebinding: %v", err)
+	}
+	if err := a.Rebind(addra, addrc); err != nil {
+		t.Fatalf("unexpected error rebinding: %v", err)
+	}
+	if laddr, _ := b.UDPAddrs(); laddr != addrc {
+		t.Errorf("unexpected local address after rebinding: got %v; want %v", laddr, addrc)
+	}
+	if addr, _, _ := b.IPv4(); addr != (IPv4{10, 0, 0, 2}) || !b.IsUp() {
+		t.Errorf("device configuration not preserved across rebinding")
+	}
+	send("after")
+	// the old port has been released
+	if conn, err := net.ListenUDP("udp", addrb); err != nil {
+		t.Errorf("could not bind old port: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// a's port is in use, so b is left as it was
+	if err := b.Rebind(addra, addra); err == nil {
+		t.Errorf("no error rebinding to a port in use")
+	}
+	send("still")
+}
@@ -0,0 +1,410 @@
+package net
+
+import (
+	stderrors "errors"
+	"testing"
+	"time"
+
+	"github.com/joshlf/net/internal/parse"
+)
+
+// newLoopbackStack creates a Stack with an up LoopbackDevice
+// addressed 127.0.0.1/8 and ::1/128.
+func newLoopbackStack(t *testing.T) (s *Stack, lo *LoopbackDevice) {
+	lo, err := NewLoopbackDevice(1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	lo.SetIPv4(IPv4{127, 0, 0, 1}, IPv4{255, 0, 0, 0})
+	lo.SetIPv6(IPv6{15: 1}, IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	s = NewStack(StackOptions{})
+	if err := s.AddDevice("lo", lo); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err := lo.BringUp(); err != nil {
+		t.Fatalf("could not bring device up: %v", err)
+	}
+	return s, lo
+}
+
+type udpReadResult struct {
+	b    []byte
+	addr Addr
+	err  error
+}
+
+// readFrom reads a datagram from c, failing if none arrives in time.
+func readFrom(t *testing.T, c *UDPConn) udpReadResult {
+	res := make(chan udpReadResult, 1)
+	go func() {
+		b := make([]byte, 0xFFFF)
+		n, addr, err := c.ReadFrom(b)
+		res <- udpReadResult{b[:n], addr, err}
+	}()
+	select {
+	case r := <-res:
+		return r
+	case <-time.After(5 * time.Second):
+		c.Close()
+		t.Fatalf("no datagram received")
+		panic("unreachable")
+	}
+}
+
+func TestUDPConn(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+
+	for _, ip := range []IP{IPv4{127, 0, 0, 1}, IPv6{15: 1}} {
+		a, err := s.ListenUDP(&UDPAddr{Port: 1234})
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		b, err := s.ListenUDP(&UDPAddr{IP: ip})
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		if _, err := s.ListenUDP(&UDPAddr{Port: 1234}); err == nil {
+			t.Errorf("no error listening on port in use")
+		}
+		bport := b.LocalAddr().(*UDPAddr).Port
+		if bport < udpEphemeralMin {
+			t.Errorf("unexpected ephemeral port: %v", bport)
+		}
+
+		if _, err := b.WriteTo([]byte("hello"), &UDPAddr{IP: ip, Port: 1234}); err != nil {
+			t.Fatalf("unexpected error writing to %v: %v", ip, err)
+		}
+		r := readFrom(t, a)
+		if r.err != nil || string(r.b) != "hello" || *r.addr.(*UDPAddr) != (UDPAddr{IP: ip, Port: bport}) {
+			t.Fatalf("unexpected datagram: got %q from %v (err: %v); want %q from %v:%v", r.b, r.addr, r.err, "hello", ip, bport)
+		}
+
+		// reply to the sender
+		if _, err := a.WriteTo([]byte("world"), r.addr); err != nil {
+			t.Fatalf("unexpected error replying to %v: %v", r.addr, err)
+		}
+		r = readFrom(t, b)
+		if r.err != nil || string(r.b) != "world" || *r.addr.(*UDPAddr) != (UDPAddr{IP: ip, Port: 1234}) {
+			t.Fatalf("unexpected reply: got %q from %v (err: %v); want %q from %v:1234", r.b, r.addr, r.err, "world", ip)
+		}
+
+		a.Close()
+		b.Close()
+		if _, _, err := a.ReadFrom(nil); err == nil {
+			t.Errorf("no error reading from closed socket")
+		}
+	}
+}
+
+func TestUDPConnUnreachable(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+
+	for _, ip := range []IP{IPv4{127, 0, 0, 1}, IPv6{15: 1}} {
+		c, err := s.ListenUDP(nil)
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		if _, err := c.WriteTo([]byte("hello"), &UDPAddr{IP: ip, Port: 1234}); err != nil {
+			t.Fatalf("unexpected error writing to %v: %v", ip, err)
+		}
+		if r := readFrom(t, c); !IsUnreachable(r.err) || !IsConnRefused(r.err) || !stderrors.Is(r.err, ErrPortUnreachable) {
+			t.Errorf("unexpected result writing to unbound port on %v: got %q (err: %v); want port unreachable error", ip, r.b, r.err)
+		}
+		c.Close()
+	}
+}
+
+func TestUDPChecksum(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+	c, err := s.ListenUDP(&UDPAddr{Port: 1234})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+
+	// datagrams from port 5678 to port 1234
+	bad := []byte{0x16, 0x2E, 0x04, 0xD2, 0, 11, 0xBE, 0xEF, 'b', 'a', 'd'}
+	good := []byte{0x16, 0x2E, 0x04, 0xD2, 0, 12, 0, 0, 'g', 'o', 'o', 'd'}
+	src := IPv4{127, 0, 0, 1}
+	setUDPChecksum(good, udpChecksum(good, src, src))
+	if sum := Checksum(good, PseudoHeaderSum(src, src, IPProtocolUDP, len(good))); sum != 0xFFFF {
+		t.Fatalf("checksum of datagram with computed checksum: got %#x; want 0xffff", sum)
+	}
+	for _, b := range [][]byte{bad, good} {
+		if _, err := s.WriteTo(b, src, IPProtocolUDP); err != nil {
+			t.Fatalf("unexpected error writing datagram: %v", err)
+		}
+	}
+	// the datagram with the bad checksum is dropped
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "good" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "good")
+	}
+}
+
+func TestUDPConnConnected(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+	ip := IPv4{127, 0, 0, 1}
+
+	peer, err := s.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer peer.Close()
+	third, err := s.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer third.Close()
+	if _, err := third.Write([]byte("hello")); err == nil {
+		t.Errorf("no error writing to unconnected socket")
+	}
+
+	paddr := peer.LocalAddr().(*UDPAddr)
+	paddr.IP = ip
+	c, err := s.DialUDP(nil, paddr)
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer c.Close()
+	if raddr := c.RemoteAddr().(*UDPAddr); *raddr != *paddr {
+		t.Errorf("unexpected remote address: got %v; want %v", raddr, paddr)
+	}
+	caddr := c.LocalAddr().(*UDPAddr)
+	caddr.IP = ip
+
+	// the third party's datagram arrives first, but is discarded
+	if _, err := third.WriteTo([]byte("intruder"), caddr); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if _, err := peer.WriteTo([]byte("hello"), caddr); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	res := make(chan string, 1)
+	go func() {
+		b := make([]byte, 1500)
+		n, err := c.Read(b)
+		if err != nil {
+			res <- err.Error()
+			return
+		}
+		res <- string(b[:n])
+	}()
+	select {
+	case got := <-res:
+		if got != "hello" {
+			t.Errorf("unexpected datagram: got %q; want %q", got, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no datagram received")
+	}
+
+	if _, err := c.Write([]byte("world")); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	r := readFrom(t, peer)
+	if r.err != nil || string(r.b) != "world" || *r.addr.(*UDPAddr) != *caddr {
+		t.Errorf("unexpected datagram: got %q from %v (err: %v); want %q from %v", r.b, r.addr, r.err, "world", caddr)
+	}
+}
+
+func TestUDPConnTTL(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+
+	for _, ip := range []IP{IPv4{127, 0, 0, 1}, IPv6{15: 1}} {
+		a, err := s.ListenUDP(&UDPAddr{Port: 1234})
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		b, err := s.ListenUDP(nil)
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		setTTL := b.SetTTL
+		if ip.IPVersion() == 6 {
+			setTTL = b.SetHopLimit
+		}
+		if err := setTTL(0); err == nil {
+			t.Errorf("no error setting TTL to 0")
+		}
+
+		// the loopback device delivers packets with their TTLs intact
+		for _, ttl := range []int{0, 1, 200} {
+			if ttl != 0 {
+				if err := setTTL(ttl); err != nil {
+					t.Fatalf("unexpected error setting TTL: %v", err)
+				}
+			}
+			if _, err := b.WriteTo([]byte("hello"), &UDPAddr{IP: ip, Port: 1234}); err != nil {
+				t.Fatalf("unexpected error writing to %v: %v", ip, err)
+			}
+			want := ttl
+			if ttl == 0 {
+				want = defaultTTL
+			}
+			buf := make([]byte, 16)
+			if _, _, info, err := a.ReadFromInfo(buf); err != nil || int(info.TTL) != want {
+				t.Errorf("unexpected TTL to %v: got %v (err: %v); want %v", ip, info.TTL, err, want)
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestUDPConnDSCP(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+
+	for _, ip := range []IP{IPv4{127, 0, 0, 1}, IPv6{15: 1}} {
+		a, err := s.ListenUDP(&UDPAddr{Port: 1234})
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		b, err := s.ListenUDP(nil)
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		if err := b.SetDSCP(64); err == nil {
+			t.Errorf("no error setting DSCP which exceeds 6 bits")
+		}
+		if err := b.SetDSCP(46); err != nil {
+			t.Fatalf("unexpected error setting DSCP: %v", err)
+		}
+		if _, err := b.WriteTo([]byte("hello"), &UDPAddr{IP: ip, Port: 1234}); err != nil {
+			t.Fatalf("unexpected error writing to %v: %v", ip, err)
+		}
+		buf := make([]byte, 16)
+		if _, _, info, err := a.ReadFromInfo(buf); err != nil || info.DSCP != 46 {
+			t.Errorf("unexpected DSCP to %v: got %v (err: %v); want 46", ip, info.DSCP, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestUDPConnBroadcast(t *testing.T) {
+	s, lo := newLoopbackStack(t)
+	defer lo.BringDown()
+	// a default route, through which limited broadcasts are sent
+	s.IPv4Host.AddIPv4DeviceRoute(IPv4Subnet{}, lo)
+
+	a, err := s.ListenUDP(&UDPAddr{Port: 1234})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer a.Close()
+	b, err := s.ListenUDP(nil)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer b.Close()
+	bport := b.LocalAddr().(*UDPAddr).Port
+
+	for _, ip := range []IPv4{{127, 255, 255, 255}, {255, 255, 255, 255}} {
+		if _, err := b.WriteTo([]byte("hello"), &UDPAddr{IP: ip, Port: 1234}); err == nil {
+			t.Errorf("no error writing to %v without SetBroadcast", ip)
+		}
+	}
+	b.SetBroadcast(true)
+	for _, ip := range []IPv4{{127, 255, 255, 255}, {255, 255, 255, 255}} {
+		if _, err := b.WriteTo([]byte("hello"), &UDPAddr{IP: ip, Port: 1234}); err != nil {
+			t.Fatalf("unexpected error writing to %v: %v", ip, err)
+		}
+		r := readFrom(t, a)
+		if r.err != nil || string(r.b) != "hello" || *r.addr.(*UDPAddr) != (UDPAddr{IP: IPv4{127, 0, 0, 1}, Port: bport}) {
+			t.Errorf("unexpected datagram: got %q from %v (err: %v); want %q from 127.0.0.1:%v", r.b, r.addr, r.err, "hello", bport)
+		}
+	}
+
+	// a socket bound to a particular address doesn't receive broadcasts
+	c, err := s.ListenUDP(&UDPAddr{IP: IPv4{127, 0, 0, 1}, Port: 1235})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+	if _, err := b.WriteTo([]byte("hello"), &UDPAddr{IP: IPv4{127, 255, 255, 255}, Port: 1235}); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if _, err := b.WriteTo([]byte("world"), &UDPAddr{IP: IPv4{127, 0, 0, 1}, Port: 1235}); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if r := readFrom(t, c); r.err != nil || string(r.b) != "world" {
+		t.Errorf("unexpected datagram: got %q (err: %v); want only %q", r.b, r.err, "world")
+	}
+}
+
+func TestUDPConnPktInfo(t *testing.T) {
+	s := newTestStack(t)
+	defer s.close()
+	c, err := s.ListenUDP(&UDPAddr{Port: 53})
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer c.Close()
+	peer := IPv4{10, 0, 0, 2}
+
+	// datagrams to either of s's addresses arrive through eth0
+	for _, dst := range []IPv4{{10, 0, 0, 1}, {10, 0, 1, 1}} {
+		b := make([]byte, udpHeaderLen+len("query"))
+		hdr := b
+		parse.PutUint16(&hdr, 1234)
+		parse.PutUint16(&hdr, 53)
+		parse.PutUint16(&hdr, uint16(len(b)))
+		copy(b[udpHeaderLen:], "query")
+		setUDPChecksum(b, udpChecksum(b, peer, dst))
+		s.send(t, &ipv4Header{TTL: 64, proto: IPProtocolUDP, src: peer, dst: dst}, b)
+
+		type result struct {
+			b    []byte
+			addr Addr
+			info PktInfo
+			err  error
+		}
+		res := make(chan result, 1)
+		go func() {
+			buf := make([]byte, 100)
+			n, addr, info, err := c.ReadFromPktInfo(buf)
+			res <- result{buf[:n], addr, info, err}
+		}()
+		var r result
+		select {
+		case r = <-res:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no datagram received")
+		}
+		addr, info := r.addr, r.info
+		if r.err != nil || string(r.b) != "query" {
+			t.Fatalf("unexpected datagram: got %q (err: %v); want %q", r.b, r.err, "query")
+		}
+		if info.Dst != dst || info.Device != s.eth0 {
+			t.Errorf("unexpected packet info: got destination %v on %v; want %v on eth0", info.Dst, info.Device, dst)
+		}
+
+		// the reply is pinned to the address the query was sent to,
+		// even though it leaves through eth0
+		if _, err := c.WriteToFrom([]byte("reply"), addr, info.Dst); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		rhdr, payload := recv(t, s.peer0)
+		if rhdr.src != dst || rhdr.dst != peer || Checksum(payload, PseudoHeaderSum(rhdr.src, rhdr.dst, IPProtocolUDP, len(payload))) != 0xFFFF ||
+			string(payload[udpHeaderLen:]) != "reply" {
+			t.Errorf("unexpected reply: got %x from %v; want %q from %v", payload, rhdr.src, "reply", dst)
+		}
+	}
+
+	// without a source, the reply is sent from eth0's address
+	if _, err := c.WriteTo([]byte("reply"), &UDPAddr{IP: peer, Port: 1234}); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if hdr, _ := recv(t, s.peer0); hdr.src != (IPv4{10, 0, 0, 1}) {
+		t.Errorf("unexpected source address: got %v; want 10.0.0.1", hdr.src)
+	}
+	if _, err := c.WriteToFrom([]byte("reply"), &UDPAddr{IP: peer, Port: 1234}, IPv4{10, 0, 2, 1}); err == nil {
+		t.Errorf("no error writing from non-local address")
+	}
+}
@@ -0,0 +1,298 @@
+package net
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/joshlf/net/internal/errors"
+)
+
+// UnixgramDevice represents a device created by sending link-layer packets
+// over Unix domain datagram sockets. Like a UDP device, it is point-to-point,
+// but since its endpoints are named by paths in the filesystem rather than
+// ports, any number of them can be wired together on one host without
+// allocating ports. A UnixgramDevice is capable of sending and receiving
+// both IPv4 and IPv6 packets.
+//
+// The zero UnixgramDevice is not a valid UnixgramDevice. UnixgramDevices are
+// safe for concurrent access.
+type UnixgramDevice struct {
+	laddr, raddr *net.UnixAddr
+	conn         *net.UnixConn // only a listening connection; down if nil
+	mtu          int
+
+	addr4, netmask4 IPv4
+	addr4Set        bool
+	addr6, netmask6 IPv6
+	addr6Set        bool
+
+	callback4, callback6 func(b []byte) // unset if nil
+	stats                deviceStats
+
+	sync syncer
+}
+
+var _ IPv4Device = &UnixgramDevice{}
+var _ IPv6Device = &UnixgramDevice{}
+
+// NewUnixgramDevice creates a new UnixgramDevice, which is down by default.
+// laddr is the path of the socket on which it receives packets, and raddr
+// is the path of the socket on the other side of the connection, to which
+// it sends them. It is the caller's responsibility to ensure that both sides
+// of the connection are configured with the same MTU, which must be non-zero.
+// As with UDP devices, a single MTU-sized buffer will be allocated in order
+// to read incoming packets.
+func NewUnixgramDevice(laddr, raddr string, mtu int) (*UnixgramDevice, error) {
+	if mtu == 0 {
+		return nil, errors.New("new UnixgramDevice: zero MTU")
+	}
+	if mtu > maxMTU {
+		return nil, errors.Errorf("new UnixgramDevice: MTU above maximum of %v", maxMTU)
+	}
+	return &UnixgramDevice{
+		laddr: &net.UnixAddr{Name: laddr, Net: "unixgram"},
+		raddr: &net.UnixAddr{Name: raddr, Net: "unixgram"},
+		mtu:   mtu,
+	}, nil
+}
+
+// UnixAddrs returns the local and remote socket addresses used by dev.
+func (dev *UnixgramDevice) UnixAddrs() (laddr, raddr *net.UnixAddr) {
+	dev.sync.RLock()
+	laddr, raddr = dev.laddr, dev.raddr
+	dev.sync.RUnlock()
+	return laddr, raddr
+}
+
+// BringUp brings dev up by creating its local socket. If it is already up,
+// BringUp is a no-op. The other side's socket need not exist yet; until it
+// does, writes to dev will fail.
+func (dev *UnixgramDevice) BringUp() error {
+	return dev.sync.BringUp(func() error {
+		dev.sync.Lock()
+		defer dev.sync.Unlock()
+
+		// NOTE(joshlf): We use a listening connection rather than one created
+		// with DialUnix so that the two sides can be brought up in either order.
+		conn, err := net.ListenUnixgram("unixgram", dev.laddr)
+		if err != nil {
+			return errors.Annotate(err, "bring device up")
+		}
+		dev.conn = conn
+		return nil
+	}, dev.readDaemon)
+}
+
+// BringDown brings dev down, closing and removing its local socket. If it is
+// already down, BringDown is a no-op.
+func (dev *UnixgramDevice) BringDown() error {
+	return dev.sync.BringDown(func() error {
+		dev.sync.Lock()
+		defer dev.sync.Unlock()
+
+		err := dev.conn.Close()
+		dev.conn = nil
+		// unlike a UnixListener, a UnixConn leaves its socket file
+		// behind, which would prevent bringing dev up again
+		if rerr := os.Remove(dev.laddr.Name); err == nil && !os.IsNotExist(rerr) {
+			err = rerr
+		}
+		return errors.Annotate(err, "bring device down")
+	})
+}
+
+// IsUp returns true if dev is up.
+func (dev *UnixgramDevice) IsUp() bool {
+	dev.sync.RLock()
+	up := dev.isUp()
+	dev.sync.RUnlock()
+	return up
+}
+
+func (dev *UnixgramDevice) isUp() bool {
+	return dev.conn != nil
+}
+
+// MTU returns dev's MTU.
+func (dev *UnixgramDevice) MTU() int {
+	dev.sync.RLock()
+	mtu := dev.mtu
+	dev.sync.RUnlock()
+	return mtu
+}
+
+// SetMTU sets dev's MTU, which must be at least the minimum for the IP versions
+// for which dev has addresses. It is the caller's responsibility to ensure that
+// the MTU on the other side of the connection is changed to match. SetMTU can
+// be called while dev is up.
+func (dev *UnixgramDevice) SetMTU(mtu int) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if err := checkMTU(mtu, true, dev.addr6Set); err != nil {
+		return err
+	}
+	dev.mtu = mtu
+	return nil
+}
+
+// Stats returns a snapshot of dev's packet counters.
+func (dev *UnixgramDevice) Stats() DeviceStats { return dev.stats.snapshot() }
+
+// Capabilities returns dev's capabilities, of which it has none.
+func (dev *UnixgramDevice) Capabilities() DeviceCaps { return 0 }
+
+// IPv4 returns dev's IPv4 address and network mask if they have been set.
+func (dev *UnixgramDevice) IPv4() (addr, netmask IPv4, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addr4, dev.netmask4, dev.addr4Set
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv4 sets dev's IPv4 address and network mask, returning any error
+// encountered. SetIPv4 can only be called when dev is down.
+func (dev *UnixgramDevice) SetIPv4(addr, netmask IPv4) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("set device IP address on up device")
+	}
+	dev.addr4, dev.netmask4, dev.addr4Set = addr, netmask, true
+	return nil
+}
+
+// UnsetIPv4 unsets dev's IPv4 address and network mask, returning any error
+// encountered. UnsetIPv4 can only be called when dev is down.
+func (dev *UnixgramDevice) UnsetIPv4() error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("unset device IP address on up device")
+	}
+	dev.addr4, dev.netmask4, dev.addr4Set = IPv4{}, IPv4{}, false
+	return nil
+}
+
+// IPv6 returns dev's IPv6 address and network mask if they have been set.
+func (dev *UnixgramDevice) IPv6() (addr, netmask IPv6, ok bool) {
+	dev.sync.RLock()
+	addr, netmask, ok = dev.addr6, dev.netmask6, dev.addr6Set
+	dev.sync.RUnlock()
+	return addr, netmask, ok
+}
+
+// SetIPv6 sets dev's IPv6 address and network mask, returning any error
+// encountered. SetIPv6 can only be called when dev is down.
+func (dev *UnixgramDevice) SetIPv6(addr, netmask IPv6) error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("set device IP address on up device")
+	}
+	dev.addr6, dev.netmask6, dev.addr6Set = addr, netmask, true
+	return nil
+}
+
+// UnsetIPv6 unsets dev's IPv6 address and network mask, returning any error
+// encountered. UnsetIPv6 can only be called when dev is down.
+func (dev *UnixgramDevice) UnsetIPv6() error {
+	dev.sync.Lock()
+	defer dev.sync.Unlock()
+	if dev.isUp() {
+		return errors.New("unset device IP address on up device")
+	}
+	dev.addr6, dev.netmask6, dev.addr6Set = IPv6{}, IPv6{}, false
+	return nil
+}
+
+// RegisterIPv4Callback registers f to be called when IPv4 packets are received.
+func (dev *UnixgramDevice) RegisterIPv4Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback4 = f
+	dev.sync.Unlock()
+}
+
+// RegisterIPv6Callback registers f to be called when IPv6 packets are received.
+func (dev *UnixgramDevice) RegisterIPv6Callback(f func(b []byte)) {
+	dev.sync.Lock()
+	dev.callback6 = f
+	dev.sync.Unlock()
+}
+
+// WriteToIPv4 writes the IPv4 packet b to the other side of the connection.
+// Since dev is point-to-point, dst is ignored.
+func (dev *UnixgramDevice) WriteToIPv4(b []byte, dst IPv4) (n int, err error) {
+	return dev.write(b)
+}
+
+// WriteToIPv6 writes the IPv6 packet b to the other side of the connection.
+// Since dev is point-to-point, dst is ignored.
+func (dev *UnixgramDevice) WriteToIPv6(b []byte, dst IPv6) (n int, err error) {
+	return dev.write(b)
+}
+
+func (dev *UnixgramDevice) write(b []byte) (n int, err error) {
+	dev.sync.RLock()
+	defer dev.sync.RUnlock()
+	if len(b) > dev.mtu {
+		dev.stats.txDrop()
+		return 0, errors.MTUf(dev.mtu, "write to device: IP packet exceeds MTU")
+	}
+	if !dev.isUp() {
+		dev.stats.txDrop()
+		return 0, errors.New("write to down device")
+	}
+
+	n, err = dev.conn.WriteToUnix(b, dev.raddr)
+	if err != nil {
+		dev.stats.txDrop()
+	} else {
+		dev.stats.tx(n)
+	}
+	return n, errors.Annotate(err, "write to device")
+}
+
+func (dev *UnixgramDevice) readDaemon() {
+	var b []byte
+	for {
+		select {
+		case <-dev.sync.StopChan():
+			return
+		default:
+		}
+
+		dev.sync.RLock()
+		if len(b) != dev.mtu {
+			// the MTU has changed since the last read
+			b = make([]byte, dev.mtu)
+		}
+		err := dev.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		if err != nil {
+			// TODO(joshlf): Log it
+			dev.sync.RUnlock()
+			continue
+		}
+		n, _, err := dev.conn.ReadFromUnix(b)
+		if err != nil || n == 0 {
+			if !errors.IsTimeout(err) {
+				// TODO(joshlf): Log it
+				dev.stats.rxError()
+			}
+			dev.sync.RUnlock()
+			continue
+		}
+		dev.stats.rx(n)
+		// as with TUN devices, the version field is
+		// the only way to tell IPv4 and IPv6 apart
+		switch {
+		case b[0]>>4 == 4 && dev.callback4 != nil:
+			dev.callback4(b[:n])
+		case b[0]>>4 == 6 && dev.callback6 != nil:
+			dev.callback6(b[:n])
+		default:
+			dev.stats.rxDrop()
+		}
+		dev.sync.RUnlock()
+	}
+}
@@ -0,0 +1,76 @@
+package net
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixgramDevice(t *testing.T) {
+	const proto = 253 // reserved for experimentation
+	dir := t.TempDir()
+	patha, pathb := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	a, err := NewUnixgramDevice(patha, pathb, 1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	b, err := NewUnixgramDevice(pathb, patha, 1500)
+	if err != nil {
+		t.Fatalf("could not create device: %v", err)
+	}
+	netmask6 := IPv6{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	a.SetIPv4(IPv4{10, 0, 0, 1}, IPv4{255, 255, 255, 0})
+	b.SetIPv4(IPv4{10, 0, 0, 2}, IPv4{255, 255, 255, 0})
+	a.SetIPv6(IPv6{0xfd, 15: 1}, netmask6)
+	b.SetIPv6(IPv6{0xfd, 15: 2}, netmask6)
+	sa, sb := NewStack(StackOptions{}), NewStack(StackOptions{})
+	sa.AddDevice("unixgram:0", a)
+	sb.AddDevice("unixgram:0", b)
+	for _, dev := range []*UnixgramDevice{a, b} {
+		if err := dev.BringUp(); err != nil {
+			t.Fatalf("could not bring device up: %v", err)
+		}
+		defer dev.BringDown()
+	}
+	recv := make(chan string, 16)
+	sb.IPv4Host.RegisterIPv4Callback(func(b []byte, src, dst IPv4) {
+		recv <- string(b)
+	}, proto)
+	sb.IPv6Host.RegisterIPv6Callback(func(b []byte, src, dst IPv6) {
+		recv <- string(b)
+	}, proto)
+	expect := func(want string) {
+		select {
+		case got := <-recv:
+			if got != want {
+				t.Errorf("unexpected payload: got %q; want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("payload %q not received", want)
+		}
+	}
+
+	if _, err := sa.IPv4Host.WriteToIPv4([]byte("hello over IPv4"), IPv4{10, 0, 0, 2}, proto); err != nil {
+		t.Fatalf("unexpected error writing IPv4 payload: %v", err)
+	}
+	expect("hello over IPv4")
+	if _, err := sa.IPv6Host.WriteToIPv6([]byte("hello over IPv6"), IPv6{0xfd, 15: 2}, proto); err != nil {
+		t.Fatalf("unexpected error writing IPv6 payload: %v", err)
+	}
+	expect("hello over IPv6")
+
+	// bringing a device down removes its socket, so it can be brought up again
+	if err := a.BringDown(); err != nil {
+		t.Fatalf("unexpected error bringing device down: %v", err)
+	}
+	if _, err := os.Stat(patha); !os.IsNotExist(err) {
+		t.Errorf("socket not removed after bringing device down: %v", err)
+	}
+	if err := a.BringUp(); err != nil {
+		t.Fatalf("could not bring device back up: %v", err)
+	}
+	if _, err := a.WriteToIPv4(make([]byte, 1501), IPv4{}); err == nil {
+		t.Errorf("no error writing packet larger than MTU")
+	}
+}